@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// ProviderAdapter lets clients keep speaking OpenAI chat completions to a
+// provider with a different API. The router translates the request on the
+// way out and the response, streamed or not, on the way back. Providers
+// without an adapter are OpenAI-compatible and passed through untouched.
+type ProviderAdapter interface {
+	// Path is the upstream endpoint chat completions are sent to.
+	Path() string
+	// Authorize sets the provider's credential headers.
+	Authorize(h http.Header, apiKey string)
+	// TranslateRequest converts an OpenAI chat-completions body.
+	TranslateRequest(body []byte) ([]byte, error)
+	// TranslateResponse converts a complete response body, success or
+	// error, into the OpenAI shape.
+	TranslateResponse(status int, body []byte) ([]byte, error)
+	// TranslateStream converts the provider's event stream into OpenAI
+	// chat.completion.chunk events, ending with data: [DONE].
+	TranslateStream(dst io.Writer, src io.Reader) error
+}
+
+// providerAdapters maps a provider's format setting to its adapter;
+// "openai" (the default) needs none.
+var providerAdapters = map[string]ProviderAdapter{
+	"anthropic": anthropicAdapter{},
+}
+
+// adapterError is a request the provider's adapter could not translate,
+// which is the client's fault rather than the upstream's.
+type adapterError struct{ err error }
+
+func (e *adapterError) Error() string { return e.err.Error() }
+func (e *adapterError) Unwrap() error { return e.err }
+
+// translateRequest returns the upstream path and body for a request to
+// the OpenAI endpoint at path on p. Only chat completions can be
+// translated; other endpoints need an OpenAI-compatible HTTP provider.
+func translateRequest(p *Provider, path string, body []byte) (string, []byte, error) {
+	if path != chatCompletionsPath {
+		if p.Adapter != nil || p.GRPC != nil {
+			return "", nil, fmt.Errorf("%s is not supported by this provider", path)
+		}
+		return path, body, nil
+	}
+	if a := p.Adapter; a != nil {
+		translated, err := a.TranslateRequest(body)
+		if err != nil {
+			return "", nil, err
+		}
+		return a.Path(), translated, nil
+	}
+	return path, body, nil
+}
+
+// adaptResponse swaps resp's body for its OpenAI translation. Event streams
+// are translated on the fly as the caller reads, so streaming stays
+// incremental; anything else is read fully and rewritten.
+func adaptResponse(a ProviderAdapter, resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		src := resp.Body
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(a.TranslateStream(pw, src))
+		}()
+		resp.Body = pipeBody{PipeReader: pr, src: src}
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	out, err := a.TranslateResponse(resp.StatusCode, body)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// pipeBody closes the upstream body along with the translated stream, so
+// the translating goroutine is never left blocked on either side.
+type pipeBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+func (b pipeBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// Admin serves the operator API on its own listener (ADMIN_PORT), sharing
+// the main server's registry. Weight changes and removals made here last
+// until the next config reload; route overrides and blue-green cutovers
+// until the next restart. /admin/inflight lists the requests being
+// served and cancels them. /debug/pprof serves the runtime profiles.
+// Without a token the API only shows the routing table and is open; with
+// one every endpoint requires it, and each change is logged with the
+// token's fingerprint.
+type Admin struct {
+	registry *ModelRegistry
+	inflight *InFlight
+	token    string
+	logger   *slog.Logger
+}
+
+func NewAdmin(registry *ModelRegistry, inflight *InFlight, token string, logger *slog.Logger) *Admin {
+	return &Admin{registry: registry, inflight: inflight, token: token, logger: logger}
+}
+
+type AdminBackend struct {
+	Name string `json:"name"`
+	// Pool names the pool of models with routing policies.
+	Pool    string `json:"pool,omitempty"`
+	Variant string `json:"variant,omitempty"`
+	// Slot is "blue" or "green" for blue-green models.
+	Slot    string `json:"slot,omitempty"`
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Breaker string `json:"breaker"`
+	// Warmup is "warming", "ready" or "degraded" for models with a
+	// warmup_payload.
+	Warmup string `json:"warmup,omitempty"`
+}
+
+type AdminModel struct {
+	Name     string         `json:"name"`
+	Priority int            `json:"priority,omitempty"`
+	Backends []AdminBackend `json:"backends"`
+	// Aliases are the aliases whose model this entry routes.
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// Handler returns the admin mux. Model names and matches containing "/"
+// must be URL-escaped in paths (meta-llama%2F*). The mutating endpoints,
+// the list of requests in flight, which names their keys and tenants, and
+// the profiles, which give away the command line and memory, exist only
+// when a token is configured.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/models", a.listModels)
+	mux.HandleFunc("GET /admin/routes", a.listRoutes)
+	mux.HandleFunc("GET /admin/providers", a.listProviders)
+	mux.HandleFunc("GET /admin/models/{name}/active-slot", a.activeSlot)
+	mux.HandleFunc("GET /admin/models/{name}/canary-status", a.canaryStatus)
+	if a.token == "" {
+		return withErrorEnvelope(mux)
+	}
+	mux.HandleFunc("GET /admin/inflight", a.listInFlight)
+	// Profiles, e.g. /debug/pprof/goroutine?debug=1 to see how many
+	// upstream connections are open.
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("PUT /admin/models/{name}/weight", a.setWeight)
+	mux.HandleFunc("DELETE /admin/models/{name}", a.deleteModel)
+	mux.HandleFunc("POST /admin/models/{name}/warmup", a.warmUp)
+	mux.HandleFunc("PUT /admin/models/{name}/active-slot", a.setActiveSlot)
+	mux.HandleFunc("PUT /admin/models/{name}/canary-weight", a.setCanaryWeight)
+	mux.HandleFunc("POST /admin/routes", a.setRoute)
+	mux.HandleFunc("DELETE /admin/routes/{match}", a.deleteRoute)
+	mux.HandleFunc("DELETE /admin/inflight/{id}", a.cancelInFlight)
+	mux.HandleFunc("POST /v1/explain", a.explain)
+	return a.requireToken(withErrorEnvelope(mux))
+}
+
+type adminActorKey struct{}
+
+func (a *Admin) requireToken(next http.Handler) http.Handler {
+	sum := sha256.Sum256([]byte(a.token))
+	actor := "token:" + hex.EncodeToString(sum[:4])
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-router-admin"`)
+			writeError(w, http.StatusUnauthorized, "invalid_api_key", "a valid admin token is required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminActorKey{}, actor)))
+	})
+}
+
+// audit logs a change together with who made it: the fingerprint of the
+// admin token, never the token itself.
+func (a *Admin) audit(r *http.Request, msg string, attrs ...any) {
+	actor, _ := r.Context().Value(adminActorKey{}).(string)
+	attrs = append([]any{slog.String("admin", actor)}, attrs...)
+	middleware.LoggerFrom(r.Context(), a.logger).Info(msg, attrs...)
+}
+
+func adminBackends(p *BackendPool, variant, slot string) []AdminBackend {
+	var out []AdminBackend
+	weights := p.Weights()
+	for _, b := range p.Backends() {
+		ab := AdminBackend{
+			Name:    b.Name(),
+			Variant: variant,
+			Slot:    slot,
+			URL:     b.Provider.BaseURL,
+			Weight:  weights[b.Name()],
+			Breaker: b.Breaker.State().String(),
+		}
+		if b.Warmup != nil {
+			ab.Warmup = b.Warmup.String()
+		}
+		out = append(out, ab)
+	}
+	return out
+}
+
+func adminModel(e *ModelEntry) AdminModel {
+	m := AdminModel{Name: e.Name, Priority: e.Priority, Backends: []AdminBackend{}}
+	add := func(variant string, p *BackendPool) {
+		m.Backends = append(m.Backends, adminBackends(p, variant, "")...)
+	}
+	if bg := e.BlueGreen; bg != nil {
+		for _, slot := range []*blueGreenSlot{bg.blue, bg.green} {
+			m.Backends = append(m.Backends, adminBackends(slot.Pool, "", slot.Name)...)
+		}
+		return m
+	}
+	if c := e.Canary; c != nil {
+		for _, v := range []*Variant{c.stable, c.canary} {
+			add(v.Name, v.Pool)
+		}
+		return m
+	}
+	if c := e.Policies; c != nil {
+		for _, name := range c.Names() {
+			for _, ab := range adminBackends(c.pools[name], "", "") {
+				ab.Pool = name
+				m.Backends = append(m.Backends, ab)
+			}
+		}
+		return m
+	}
+	if e.Split == nil {
+		add("", e.Pool)
+		return m
+	}
+	for _, v := range e.Split.Variants {
+		add(v.Name, v.Pool)
+	}
+	return m
+}
+
+func (a *Admin) listModels(w http.ResponseWriter, r *http.Request) {
+	aliases := a.registry.Aliases()
+	byEntry := make(map[string][]string)
+	for _, alias := range sortedKeys(aliases) {
+		if e, ok := a.registry.Lookup(aliases[alias]); ok {
+			byEntry[e.Name] = append(byEntry[e.Name], alias)
+		}
+	}
+	models := []AdminModel{}
+	for _, e := range a.registry.Entries() {
+		m := adminModel(e)
+		m.Aliases = byEntry[e.Name]
+		models = append(models, m)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"models": models, "aliases": aliases})
+}
+
+// setWeight takes {"backend": "<name>", "weight": n}; backend may be
+// omitted when the model has a single backend.
+func (a *Admin) setWeight(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Backend string `json:"backend"`
+		Weight  *int   `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", `body must be {"backend": "<name>", "weight": <n>}`)
+		return
+	}
+	if *req.Weight < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "weight must not be negative")
+		return
+	}
+	entry, ok := a.registry.Entry(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return
+	}
+	if req.Backend == "" {
+		backends := entry.Backends()
+		if len(backends) != 1 {
+			writeError(w, http.StatusBadRequest, "invalid_request", "model "+name+" has several backends; set \"backend\"")
+			return
+		}
+		req.Backend = backends[0].Name()
+	}
+	if !a.registry.SetWeight(name, req.Backend, *req.Weight) {
+		writeError(w, http.StatusNotFound, "backend_not_found", "model "+name+" has no backend "+req.Backend)
+		return
+	}
+	a.audit(r, "admin set backend weight",
+		slog.String("model", name), slog.String("backend", req.Backend), slog.Int("weight", *req.Weight))
+	writeJSON(w, http.StatusOK, adminModel(entry))
+}
+
+// deleteModel removes the whole entry, or with ?backend=<name> just that
+// backend. New requests stop going there at once; in-flight ones finish.
+func (a *Admin) deleteModel(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if backend := r.URL.Query().Get("backend"); backend != "" {
+		entry, ok := a.registry.Entry(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+			return
+		}
+		if !a.registry.RemoveBackend(name, backend) {
+			writeError(w, http.StatusNotFound, "backend_not_found", "model "+name+" has no backend "+backend)
+			return
+		}
+		a.audit(r, "admin removed backend", slog.String("model", name), slog.String("backend", backend))
+		writeJSON(w, http.StatusOK, adminModel(entry))
+		return
+	}
+	if !a.registry.Remove(name) {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return
+	}
+	a.audit(r, "admin removed model", slog.String("model", name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listInFlight lists the requests the router is serving, oldest first.
+func (a *Admin) listInFlight(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"requests": a.inflight.List(time.Now())})
+}
+
+// cancelInFlight cancels the request with the ID in the path, or every
+// request of a batch with it. Its client gets a 499 request_cancelled
+// error and its upstream call is aborted.
+func (a *Admin) cancelInFlight(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	n := a.inflight.Cancel(id)
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "request_not_found", "no request in flight with ID "+id)
+		return
+	}
+	a.audit(r, "admin cancelled request", slog.String("cancelled_request_id", id), slog.Int("requests", n))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// warmUp takes the model's backends out of service and warms them up again
+// in the background; progress shows in GET /admin/models.
+func (a *Admin) warmUp(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := a.registry.Entry(name); !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return
+	}
+	started, ok := a.registry.WarmUp(name)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "model "+name+" has no warmup_payload")
+		return
+	}
+	a.audit(r, "admin started warm-up", slog.String("model", name), slog.Any("backends", started))
+	writeJSON(w, http.StatusAccepted, map[string]any{"model": name, "warming": started})
+}
+
+// AdminActiveSlot is the state of a blue-green model. Draining names the
+// previous slot while it is kept open for in-flight requests, and
+// RollbackUntil is set while the last cutover can still be rolled back
+// automatically.
+type AdminActiveSlot struct {
+	Model         string         `json:"model"`
+	Slot          string         `json:"slot"`
+	SwitchedAt    *time.Time     `json:"switched_at,omitempty"`
+	Draining      string         `json:"draining,omitempty"`
+	DrainUntil    *time.Time     `json:"drain_until,omitempty"`
+	RollbackUntil *time.Time     `json:"rollback_until,omitempty"`
+	Backends      []AdminBackend `json:"backends"`
+}
+
+func adminActiveSlot(name string, bg *BlueGreenController) AdminActiveSlot {
+	st := bg.Status()
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	active, _ := bg.Slot(st.Active)
+	return AdminActiveSlot{
+		Model:         name,
+		Slot:          st.Active,
+		SwitchedAt:    optional(st.SwitchedAt),
+		Draining:      st.Draining,
+		DrainUntil:    optional(st.DrainUntil),
+		RollbackUntil: optional(st.RollbackUntil),
+		Backends:      adminBackends(active.Pool, "", active.Name),
+	}
+}
+
+// blueGreenEntry resolves the blue-green model called name, answering the
+// request itself if there is none.
+func (a *Admin) blueGreenEntry(w http.ResponseWriter, name string) (*BlueGreenController, bool) {
+	entry, ok := a.registry.Entry(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return nil, false
+	}
+	if entry.BlueGreen == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "model "+name+" has no blue_green slots")
+		return nil, false
+	}
+	return entry.BlueGreen, true
+}
+
+func (a *Admin) activeSlot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if bg, ok := a.blueGreenEntry(w, name); ok {
+		writeJSON(w, http.StatusOK, adminActiveSlot(name, bg))
+	}
+}
+
+func (a *Admin) canaryStatus(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	entry, ok := a.registry.Entry(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return
+	}
+	if entry.Canary == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "model "+name+" has no canary")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry.Canary.Status())
+}
+
+// setCanaryWeight takes {"weight": n}, the percentage of the model's
+// traffic for its canary, and holds the canary there; automatic steps stop
+// until the canary's configuration changes.
+func (a *Admin) setCanaryWeight(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", `body must be {"weight": <0-100>}`)
+		return
+	}
+	if *req.Weight < 0 || *req.Weight > 100 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "weight must be between 0 and 100")
+		return
+	}
+	entry, ok := a.registry.Entry(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "model_not_found", "no model configured as "+name)
+		return
+	}
+	if entry.Canary == nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "model "+name+" has no canary")
+		return
+	}
+	entry.Canary.SetWeight(*req.Weight)
+	a.audit(r, "admin set canary weight", slog.String("model", name), slog.Int("weight", *req.Weight))
+	writeJSON(w, http.StatusOK, entry.Canary.Status())
+}
+
+// setActiveSlot takes {"slot": "blue" | "green"} and cuts the model's
+// traffic over at once. Setting the active slot again changes nothing.
+func (a *Admin) setActiveSlot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Slot string `json:"slot"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", `body must be {"slot": "blue" | "green"}`)
+		return
+	}
+	bg, ok := a.blueGreenEntry(w, name)
+	if !ok {
+		return
+	}
+	from := bg.Active().Name
+	if !bg.Switch(req.Slot) {
+		writeError(w, http.StatusBadRequest, "invalid_request", `slot must be "blue" or "green"`)
+		return
+	}
+	if from != req.Slot {
+		a.audit(r, "admin switched active slot", slog.String("model", name), slog.String("from", from), slog.String("to", req.Slot))
+	}
+	writeJSON(w, http.StatusOK, adminActiveSlot(name, bg))
+}
+
+// AdminRoute is one entry of the effective routing table.
+type AdminRoute struct {
+	AdminModel
+	Kind      string         `json:"kind"` // exact or glob
+	When      *RuleCondition `json:"when,omitempty"`
+	Strategy  string         `json:"strategy"`
+	Affinity  bool           `json:"affinity,omitempty"`
+	Fallbacks []string       `json:"fallbacks,omitempty"`
+	// Source is "config" for entries from the file and "admin" for route
+	// overrides, which are also marked ephemeral.
+	Source    string `json:"source"`
+	Ephemeral bool   `json:"ephemeral,omitempty"`
+}
+
+// AdminOverride describes a route override without its backend settings,
+// which may hold TLS keys.
+type AdminOverride struct {
+	Match     string    `json:"match"`
+	Priority  int       `json:"priority,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Disabled  bool      `json:"disabled,omitempty"`
+	Ephemeral bool      `json:"ephemeral"`
+	ChangedBy string    `json:"changed_by"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+func adminOverride(ov RouteOverride) AdminOverride {
+	return AdminOverride{
+		Match:     ov.Rule.Match,
+		Priority:  ov.Rule.Priority,
+		Provider:  ov.Rule.Backend.Provider,
+		Disabled:  ov.Disabled,
+		Ephemeral: true,
+		ChangedBy: ov.ChangedBy,
+		ChangedAt: ov.ChangedAt,
+	}
+}
+
+// listRoutes serves the routing table in the order lookups try it, with
+// the overrides currently layered over the config file.
+func (a *Admin) listRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := []AdminRoute{}
+	for _, e := range a.registry.Routes() {
+		route := AdminRoute{
+			AdminModel: adminModel(e),
+			Kind:       "exact",
+			Strategy:   strategyFor(e.Config.Strategy).Name(),
+			Affinity:   e.Config.Affinity,
+			Fallbacks:  e.Config.Fallbacks,
+			Source:     "config",
+			Ephemeral:  e.Ephemeral,
+		}
+		if e.Condition != nil {
+			route.When = &e.Condition.RuleCondition
+		}
+		if strings.ContainsAny(e.Name, "*?") {
+			route.Kind = "glob"
+		}
+		if e.Ephemeral {
+			route.Source = "admin"
+		}
+		routes = append(routes, route)
+	}
+	overrides := []AdminOverride{}
+	for _, ov := range a.registry.RouteOverrides() {
+		overrides = append(overrides, adminOverride(ov))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"config_version": a.registry.Version(),
+		"routes":         routes,
+		"overrides":      overrides,
+	})
+}
+
+// AdminProvider is a backend target's health and the breakers guarding it.
+type AdminProvider struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Health string `json:"health"` // up, down, unknown or unchecked
+	// LastError is the last failed health probe's error.
+	LastError string `json:"last_error,omitempty"`
+	// Breakers maps each breaker in front of the target to its state;
+	// several exist when models configure breakers of their own.
+	Breakers map[string]string `json:"breakers"`
+}
+
+func (a *Admin) listProviders(w http.ResponseWriter, r *http.Request) {
+	byName := make(map[string]*AdminProvider)
+	var names []string
+	for _, e := range a.registry.Routes() {
+		for _, b := range e.Backends() {
+			p, ok := byName[b.Name()]
+			if !ok {
+				p = &AdminProvider{Name: b.Name(), URL: b.Provider.BaseURL, Health: "unchecked", Breakers: make(map[string]string)}
+				if b.Health != nil {
+					s := b.Health.status()
+					p.Health, p.LastError = s.Status, s.LastError
+				}
+				byName[b.Name()] = p
+				names = append(names, b.Name())
+			}
+			p.Breakers[b.Breaker.Name()] = b.Breaker.State().String()
+		}
+	}
+	sort.Strings(names)
+	providers := make([]*AdminProvider, 0, len(names))
+	for _, name := range names {
+		providers = append(providers, byName[name])
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"providers": providers})
+}
+
+// setRoute takes a rule as written in the config file, e.g.
+// {"match": "gpt-5*", "priority": 20, "provider": "openai"}, or
+// {"match": "gpt-4o", "disabled": true} to switch a model or rule off.
+func (a *Admin) setRoute(w http.ResponseWriter, r *http.Request) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON rule object")
+		return
+	}
+	ov := RouteOverride{ChangedAt: time.Now().UTC()}
+	ov.ChangedBy, _ = r.Context().Value(adminActorKey{}).(string)
+	if raw, ok := fields["disabled"]; ok {
+		if err := json.Unmarshal(raw, &ov.Disabled); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "disabled must be a boolean")
+			return
+		}
+		delete(fields, "disabled")
+	}
+	rest, _ := json.Marshal(fields)
+	if err := json.Unmarshal(rest, &ov.Rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid rule: "+err.Error())
+		return
+	}
+	if ov.Rule.Match == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "match is required")
+		return
+	}
+	if ov.Disabled {
+		if _, ok := a.registry.Entry(ov.Rule.Match); !ok {
+			writeError(w, http.StatusNotFound, "model_not_found", "no model or rule configured as "+ov.Rule.Match)
+			return
+		}
+		ov.Rule = RuleConfig{Match: ov.Rule.Match}
+	}
+	if err := a.registry.SetRoute(ov); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if ov.Disabled {
+		a.audit(r, "admin changed route", slog.String("action", "disabled"), slog.String("match", ov.Rule.Match))
+	} else {
+		a.audit(r, "admin changed route", slog.String("action", "added"), slog.String("match", ov.Rule.Match),
+			slog.Int("priority", ov.Rule.Priority), slog.String("provider", ov.Rule.Backend.Provider))
+	}
+	writeJSON(w, http.StatusOK, adminOverride(ov))
+}
+
+// deleteRoute drops a route override, restoring the config file's routing
+// for that match.
+func (a *Admin) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	match := r.PathValue("match")
+	if !a.registry.DeleteRoute(match) {
+		writeError(w, http.StatusNotFound, "route_not_found", "no route override for "+match)
+		return
+	}
+	a.audit(r, "admin changed route", slog.String("action", "removed"), slog.String("match", match))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	cfg := testConfig(t, `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: a
+`)
+	registry := NewModelRegistry(cfg, "", nil, nil, nil, nil, testLogger())
+	tests := []struct {
+		name   string
+		token  string
+		sent   string
+		method string
+		path   string
+		want   int
+	}{
+		{name: "open routing table", method: http.MethodGet, path: "/admin/models", want: http.StatusOK},
+		{name: "no inflight list without a token", method: http.MethodGet, path: "/admin/inflight", want: http.StatusNotFound},
+		{name: "no profiles without a token", method: http.MethodGet, path: "/debug/pprof/", want: http.StatusNotFound},
+		{name: "no command line without a token", method: http.MethodGet, path: "/debug/pprof/cmdline", want: http.StatusNotFound},
+		{name: "no changes without a token", method: http.MethodPut, path: "/admin/models/m/weight", want: http.StatusNotFound},
+		{name: "routing table needs the token", token: "secret", method: http.MethodGet, path: "/admin/models", want: http.StatusUnauthorized},
+		{name: "inflight list needs the token", token: "secret", method: http.MethodGet, path: "/admin/inflight", want: http.StatusUnauthorized},
+		{name: "profiles need the token", token: "secret", method: http.MethodGet, path: "/debug/pprof/", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", sent: "guess", method: http.MethodGet, path: "/debug/pprof/", want: http.StatusUnauthorized},
+		{name: "inflight list", token: "secret", sent: "secret", method: http.MethodGet, path: "/admin/inflight", want: http.StatusOK},
+		{name: "profiles", token: "secret", sent: "secret", method: http.MethodGet, path: "/debug/pprof/", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewAdmin(registry, NewInFlight(), tt.token, testLogger()).Handler()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.sent != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.sent)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// SessionHeader names the conversation a request belongs to, for backends
+// with affinity. Without it, the body's conversation_id is used.
+const SessionHeader = "X-Aspendos-Session"
+
+// maxRemappedSessions bounds how many remapped sessions a pool remembers
+// for logging; past it the record starts over, which at worst logs a
+// remap twice.
+const maxRemappedSessions = 10000
+
+// sessionKey returns the request's session from SessionHeader or the
+// body's conversation_id, or "" if it names none.
+func sessionKey(body []byte, h http.Header) string {
+	if s := h.Get(SessionHeader); s != "" {
+		return s
+	}
+	if !bytes.Contains(body, []byte(`"conversation_id"`)) {
+		return ""
+	}
+	var req struct {
+		ConversationID string `json:"conversation_id"`
+	}
+	json.Unmarshal(body, &req)
+	return req.ConversationID
+}
+
+// sessionAffinity pins each session to one replica with weighted
+// rendezvous hashing: every replica scores the session, and the highest
+// score among the available replicas wins. The score depends only on the
+// session, the replica's name and its weight, so every router instance
+// agrees, and when a replica goes down only its sessions move, each to its
+// next-highest scorer, returning once it is back.
+type sessionAffinity struct {
+	model  string
+	logger *slog.Logger
+	// remapped records the replica serving each session away from its
+	// home, so each move is logged once. Guarded by the pool's lock.
+	remapped map[string]string
+}
+
+func newSessionAffinity(model string, logger *slog.Logger) *sessionAffinity {
+	return &sessionAffinity{model: model, logger: logger, remapped: make(map[string]string)}
+}
+
+// Pick places the session among candidates; backends are all the pool's
+// replicas, used to find the session's home. It runs under the pool's
+// lock. A dry run neither records nor logs a remapping.
+func (a *sessionAffinity) Pick(session string, backends, candidates []*Backend, dry bool) (*Backend, Decision) {
+	var serving []*Backend
+	for _, b := range backends {
+		if b.Weight > 0 {
+			serving = append(serving, b)
+		}
+	}
+	home := rendezvous(session, serving)
+	b := rendezvous(session, candidates)
+	d := Decision{Strategy: "affinity", Backend: b.Name(), Latency: b.Latency()}
+	if b == home {
+		d.Reason = "session"
+		if from, ok := a.remapped[session]; ok && !dry {
+			delete(a.remapped, session)
+			a.logger.Info("session returned to its backend",
+				slog.String("model", a.model), slog.String("session", session),
+				slog.String("from", from), slog.String("to", b.Name()))
+		}
+		return b, d
+	}
+	d.Reason = "session remapped from " + home.Name()
+	if a.remapped[session] != b.Name() && !dry {
+		if len(a.remapped) >= maxRemappedSessions {
+			clear(a.remapped)
+		}
+		a.remapped[session] = b.Name()
+		a.logger.Warn("session remapped; its backend is unavailable",
+			slog.String("model", a.model), slog.String("session", session),
+			slog.String("from", home.Name()), slog.String("to", b.Name()))
+	}
+	return b, d
+}
+
+// rendezvous returns the backend with the highest weighted score for
+// session, -weight/ln(u) for u the hash of session and backend in (0, 1).
+func rendezvous(session string, backends []*Backend) *Backend {
+	var best *Backend
+	bestScore := math.Inf(-1)
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(session))
+		h.Write([]byte{0})
+		h.Write([]byte(b.Name()))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(b.Weight) / math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
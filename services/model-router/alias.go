@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// validateAliases checks cfg.Aliases, which map old model names to the
+// ones they now go by: an alias may name another alias, but not start a
+// loop, and must end at a model the config routes. It returns each alias
+// resolved to the end of its chain.
+func validateAliases(cfg *Config) (map[string]string, error) {
+	resolved := make(map[string]string, len(cfg.Aliases))
+	for _, alias := range sortedKeys(cfg.Aliases) {
+		target := cfg.Aliases[alias]
+		switch {
+		case alias == "" || target == "":
+			return nil, fmt.Errorf("aliases: model names must not be empty")
+		case strings.ContainsAny(alias, "*?"):
+			return nil, fmt.Errorf("aliases[%q]: an alias is an exact model name, not a glob", alias)
+		}
+		if _, ok := cfg.Models[alias]; ok {
+			return nil, fmt.Errorf("aliases[%q]: is also defined under models", alias)
+		}
+		chain := []string{alias}
+		for {
+			next, ok := cfg.Aliases[target]
+			if !ok {
+				break
+			}
+			if slices.Contains(chain, target) {
+				return nil, fmt.Errorf("aliases: %s form a cycle", strings.Join(append(chain, target), " -> "))
+			}
+			chain = append(chain, target)
+			target = next
+		}
+		if !cfg.routes(target) {
+			return nil, fmt.Errorf("aliases[%q]: %q is not a model under models or matched by a rule", alias, target)
+		}
+		resolved[alias] = target
+	}
+	return resolved, nil
+}
+
+// routes reports whether a model key or rule matches model.
+func (cfg *Config) routes(model string) bool {
+	for pattern := range cfg.Models {
+		if matchGlob(pattern, model) {
+			return true
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if matchGlob(rule.Match, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Canonical returns the model an alias stands for under the current
+// table, and whether model is an alias at all.
+func (reg *ModelRegistry) Canonical(model string) (string, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	canonical, ok := reg.table.aliases[model]
+	return canonical, ok
+}
+
+// Aliases maps every alias of the current table to its model.
+func (reg *ModelRegistry) Aliases() map[string]string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.table.aliases
+}
+
+// canonicalModel returns the model to route a request for model as. An
+// alias is logged, with who sent it, so operators can find the callers
+// still on an old name.
+func (rt *Router) canonicalModel(r *http.Request, model string) string {
+	canonical, ok := rt.registry.Canonical(model)
+	if !ok {
+		return model
+	}
+	info := middleware.RequestInfoFrom(r.Context())
+	middleware.LoggerFrom(r.Context(), rt.logger).Warn("model alias used; the caller should move to the model's name",
+		slog.String("alias", model), slog.String("model", canonical),
+		slog.String("api_key", info.APIKey()), slog.String("tenant", info.Tenant()))
+	return canonical
+}
+
+// Aliases rewrites requests for an alias to name its model instead, so
+// everything from here on, the upstream included, sees only the model.
+func (rt *Router) Aliases(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || len(rt.registry.Aliases()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isMultipart(r.Header) {
+			if sent, err := peekFormModel(r); err == nil {
+				if model := rt.canonicalModel(r, sent); model != sent {
+					setFormModel(r, model)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.Model == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if model := rt.canonicalModel(r, req.Model); model != req.Model {
+			if rewritten, err := withModel(body, model); err == nil {
+				r.Body = io.NopCloser(bytes.NewReader(rewritten))
+				r.ContentLength = int64(len(rewritten))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// modelEcho is an upstream answering with its name and the model it was
+// asked for.
+func modelEcho(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.Unmarshal(body, &req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"backend":%q,"model":%q}`, name, req.Model)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// aliasCall sends a chat completion for model through h and returns the
+// backend that served it and the model that backend was asked for.
+func aliasCall(t *testing.T, h http.Handler, model string) (backend, sent string) {
+	t.Helper()
+	req, _ := middleware.WithRequestInfo(chatRequest(`{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status = %d: %s", model, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Backend string `json:"backend"`
+		Model   string `json:"model"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp.Backend, resp.Model
+}
+
+const aliasConfig = `
+providers:
+  canonical: {base_url: %s}
+  other: {base_url: %s}
+models:
+  gpt-4o: canonical
+  "gpt-*": other
+aliases:
+  gpt4: gpt-4o
+  gpt-4-latest: gpt4
+`
+
+// A request for an alias, or for an alias of an alias, reaches the
+// canonical model's backend asking for the canonical model by name, even
+// where the alias itself would match another route.
+func TestAliasRouting(t *testing.T) {
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(aliasConfig, modelEcho(t, "canonical"), modelEcho(t, "other"))))
+	h := middleware.Chain(routeChain(t, rt), rt.Aliases)
+	tests := []struct {
+		model   string
+		backend string
+		sent    string
+	}{
+		{model: "gpt-4o", backend: "canonical", sent: "gpt-4o"},
+		{model: "gpt4", backend: "canonical", sent: "gpt-4o"},
+		{model: "gpt-4-latest", backend: "canonical", sent: "gpt-4o"},
+		{model: "gpt-4o-mini", backend: "other", sent: "gpt-4o-mini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if backend, sent := aliasCall(t, h, tt.model); backend != tt.backend || sent != tt.sent {
+				t.Errorf("served by %s as %q, want %s as %q", backend, sent, tt.backend, tt.sent)
+			}
+		})
+	}
+	if got, ok := rt.registry.Canonical("gpt-4-latest"); !ok || got != "gpt-4o" {
+		t.Errorf("Canonical(gpt-4-latest) = %q, %v, want gpt-4o", got, ok)
+	}
+}
+
+func TestAliasConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases string
+		wantErr string
+	}{
+		{name: "alias of an alias", aliases: "{a: b, b: m}"},
+		{name: "alias matched by a rule", aliases: "{a: ruled-model}"},
+		{name: "cycle", aliases: "{a: b, b: a}", wantErr: "aliases: a -> b -> a form a cycle"},
+		{name: "longer cycle", aliases: "{a: b, b: c, c: a}", wantErr: "form a cycle"},
+		{name: "alias of itself", aliases: "{a: a}", wantErr: "aliases: a -> a form a cycle"},
+		{name: "glob", aliases: `{"old-*": m}`, wantErr: "an alias is an exact model name"},
+		{name: "shadowing a model", aliases: "{m: n}", wantErr: `aliases["m"]: is also defined under models`},
+		{name: "unrouted target", aliases: "{a: nowhere}", wantErr: `"nowhere" is not a model under models or matched by a rule`},
+		{name: "empty target", aliases: `{a: ""}`, wantErr: "must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "router.yaml", `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: a
+  n: a
+rules:
+  - {match: "ruled-*", provider: a}
+aliases: `+tt.aliases+"\n"))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A reload that would make the aliases loop is refused, and the aliases
+// already loaded keep working.
+func TestAliasCycleRefusedOnReload(t *testing.T) {
+	canonical, other := modelEcho(t, "canonical"), modelEcho(t, "other")
+	path := writeConfig(t, "router.yaml", fmt.Sprintf(aliasConfig, canonical, other))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewModelRegistry(cfg, path, nil, nil, nil, nil, testLogger())
+	rt := NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger()))
+	h := middleware.Chain(routeChain(t, rt), rt.Aliases)
+
+	cycle := strings.Replace(fmt.Sprintf(aliasConfig, canonical, other), "gpt4: gpt-4o", "gpt4: gpt-4-latest", 1)
+	if err := os.WriteFile(path, []byte(cycle), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Reload(); err == nil || !strings.Contains(err.Error(), "form a cycle") {
+		t.Fatalf("Reload error = %v, want the cycle", err)
+	}
+	if backend, sent := aliasCall(t, h, "gpt-4-latest"); backend != "canonical" || sent != "gpt-4o" {
+		t.Errorf("after the refused reload served by %s as %q, want canonical as gpt-4o", backend, sent)
+	}
+}
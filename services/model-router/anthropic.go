@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+const (
+	anthropicVersion = "2023-06-01"
+	// anthropicDefaultMaxTokens fills max_tokens, which Anthropic requires
+	// and OpenAI clients usually omit.
+	anthropicDefaultMaxTokens = 4096
+)
+
+// anthropicAdapter speaks the Anthropic Messages API (/v1/messages).
+type anthropicAdapter struct{}
+
+func (anthropicAdapter) Path() string { return "/v1/messages" }
+
+func (anthropicAdapter) Authorize(h http.Header, apiKey string) {
+	if apiKey != "" {
+		h.Set("x-api-key", apiKey)
+	}
+	h.Set("anthropic-version", anthropicVersion)
+}
+
+type openAIChatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []openAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	Stop                json.RawMessage `json:"stop,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	User                string          `json:"user,omitempty"`
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Metadata      *anthropicMetadata `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id"`
+}
+
+// TranslateRequest pulls system (and developer) messages into the top-level
+// system field, maps stop to stop_sequences and max_completion_tokens or
+// max_tokens to max_tokens. Only text content is supported.
+func (anthropicAdapter) TranslateRequest(body []byte) ([]byte, error) {
+	var in openAIChatRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	out := anthropicRequest{
+		Model:       in.Model,
+		MaxTokens:   anthropicDefaultMaxTokens,
+		Temperature: in.Temperature,
+		TopP:        in.TopP,
+		Stream:      in.Stream,
+	}
+	switch {
+	case in.MaxCompletionTokens != nil:
+		out.MaxTokens = *in.MaxCompletionTokens
+	case in.MaxTokens != nil:
+		out.MaxTokens = *in.MaxTokens
+	}
+	if in.User != "" {
+		out.Metadata = &anthropicMetadata{UserID: in.User}
+	}
+	if len(in.Stop) > 0 && !bytes.Equal(in.Stop, []byte("null")) {
+		var one string
+		if err := json.Unmarshal(in.Stop, &one); err == nil {
+			out.StopSequences = []string{one}
+		} else if err := json.Unmarshal(in.Stop, &out.StopSequences); err != nil {
+			return nil, fmt.Errorf("stop must be a string or an array of strings")
+		}
+	}
+
+	var system []string
+	for i, m := range in.Messages {
+		text, err := messageText(m.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, text)
+		case "user", "assistant":
+			out.Messages = append(out.Messages, anthropicMessage{
+				Role:    m.Role,
+				Content: []anthropicBlock{{Type: "text", Text: text}},
+			})
+		default:
+			return nil, fmt.Errorf("messages[%d]: role %q is not supported by this provider", i, m.Role)
+		}
+	}
+	out.System = strings.Join(system, "\n\n")
+	return json.Marshal(out)
+}
+
+// messageText flattens OpenAI content, a string or an array of text parts.
+func messageText(content json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(content, &s); err == nil {
+		return s, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", errors.New("content must be a string or an array of content parts")
+	}
+	var b strings.Builder
+	for _, p := range parts {
+		if p.Type != "text" {
+			return "", fmt.Errorf("content part type %q is not supported by this provider", p.Type)
+		}
+		b.WriteString(p.Text)
+	}
+	return b.String(), nil
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChoice struct {
+	Index        int          `json:"index"`
+	Message      *openAIReply `json:"message,omitempty"`
+	Delta        *openAIReply `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type openAIReply struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type openAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// finishReason maps Anthropic's stop_reason to OpenAI's finish_reason.
+func finishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
+
+// TranslateResponse joins the text content blocks into one assistant
+// message. Error bodies are rewritten into the OpenAI error envelope with
+// Anthropic's error type as the code.
+func (anthropicAdapter) TranslateResponse(status int, body []byte) ([]byte, error) {
+	if status >= 400 {
+		var e anthropicError
+		if err := json.Unmarshal(body, &e); err != nil || e.Error.Message == "" {
+			return body, nil
+		}
+		return json.Marshal(apierror.Response{Error: apierror.Detail{
+			Message: e.Error.Message,
+			Type:    openAIErrorType(status),
+			Code:    e.Error.Type,
+		}})
+	}
+	var in anthropicResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	var text strings.Builder
+	for _, b := range in.Content {
+		if b.Type == "text" {
+			text.WriteString(b.Text)
+		}
+	}
+	reason := finishReason(in.StopReason)
+	return json.Marshal(openAIChatResponse{
+		ID:      in.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   in.Model,
+		Choices: []openAIChoice{{
+			Message:      &openAIReply{Role: "assistant", Content: text.String()},
+			FinishReason: &reason,
+		}},
+		Usage: &openAIUsage{
+			PromptTokens:     in.Usage.InputTokens,
+			CompletionTokens: in.Usage.OutputTokens,
+			TotalTokens:      in.Usage.InputTokens + in.Usage.OutputTokens,
+		},
+	})
+}
+
+func openAIErrorType(status int) string {
+	if status >= 500 {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+type anthropicEvent struct {
+	Type    string             `json:"type"`
+	Message *anthropicResponse `json:"message"`
+	Delta   struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// TranslateStream turns message_start into the opening role chunk,
+// content_block_delta text into content deltas, message_delta into the
+// chunk carrying finish_reason and usage, and message_stop into [DONE]. Pings and
+// block boundaries have no OpenAI counterpart and are dropped.
+func (anthropicAdapter) TranslateStream(dst io.Writer, src io.Reader) error {
+	var id, model string
+	var usage anthropicUsage
+	created := time.Now().Unix()
+	emit := func(delta openAIReply, finish *string, u *openAIUsage) error {
+		chunk, err := json.Marshal(openAIChatResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []openAIChoice{{Delta: &delta, FinishReason: finish}},
+			Usage:   u,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(dst, "data: %s\n\n", chunk)
+		return err
+	}
+
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if payload, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data.Write(bytes.TrimSpace(payload))
+			continue
+		}
+		if len(bytes.TrimSpace(line)) != 0 || data.Len() == 0 {
+			continue
+		}
+
+		var ev anthropicEvent
+		err := json.Unmarshal(data.Bytes(), &ev)
+		data.Reset()
+		if err != nil {
+			return fmt.Errorf("decode anthropic event: %w", err)
+		}
+		switch ev.Type {
+		case "message_start":
+			if ev.Message != nil {
+				id, model = ev.Message.ID, ev.Message.Model
+				usage = ev.Message.Usage
+			}
+			err = emit(openAIReply{Role: "assistant"}, nil, nil)
+		case "content_block_delta":
+			if ev.Delta.Type == "text_delta" {
+				err = emit(openAIReply{Content: ev.Delta.Text}, nil, nil)
+			}
+		case "message_delta":
+			if ev.Usage != nil {
+				usage.OutputTokens = ev.Usage.OutputTokens
+			}
+			if ev.Delta.StopReason != "" {
+				reason := finishReason(ev.Delta.StopReason)
+				err = emit(openAIReply{}, &reason, &openAIUsage{
+					PromptTokens:     usage.InputTokens,
+					CompletionTokens: usage.OutputTokens,
+					TotalTokens:      usage.InputTokens + usage.OutputTokens,
+				})
+			}
+		case "message_stop":
+			_, err = dst.Write([]byte("data: [DONE]\n\n"))
+			return err
+		case "error":
+			if ev.Error != nil {
+				return fmt.Errorf("anthropic stream error: %s: %s", ev.Error.Type, ev.Error.Message)
+			}
+			return errors.New("anthropic stream error")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
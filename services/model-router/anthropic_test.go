@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// created matches the creation time of a translated response, the one
+// part of it that changes from run to run.
+var created = regexp.MustCompile(`"created":\s*\d+`)
+
+// indentJSON indents a JSON document for a golden file, its creation time
+// zeroed.
+func indentJSON(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := json.Indent(&out, created.ReplaceAll(b, []byte(`"created":0`)), "", "  "); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes()
+}
+
+// goldenCases calls check with each file matching pattern and the path of
+// its golden file.
+func goldenCases(t *testing.T, pattern string, check func(t *testing.T, input []byte, golden string)) {
+	t.Helper()
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no files match %s: %v", pattern, err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, input, strings.TrimSuffix(file, filepath.Ext(file))+".golden")
+		})
+	}
+}
+
+// Each OpenAI request in testdata/anthropic/request translates to the
+// Anthropic request in its .golden file.
+func TestAnthropicRequestGolden(t *testing.T) {
+	goldenCases(t, "testdata/anthropic/request/*.json", func(t *testing.T, input []byte, golden string) {
+		got, err := anthropicAdapter{}.TranslateRequest(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, golden, indentJSON(t, got))
+	})
+}
+
+// Each Anthropic response in testdata/anthropic/response translates to the
+// OpenAI response in its .golden file; an error-<status> file is an error
+// response with that status.
+func TestAnthropicResponseGolden(t *testing.T) {
+	goldenCases(t, "testdata/anthropic/response/*.json", func(t *testing.T, input []byte, golden string) {
+		status := http.StatusOK
+		if code, ok := strings.CutPrefix(filepath.Base(golden), "error-"); ok {
+			status, _ = strconv.Atoi(strings.TrimSuffix(code, ".golden"))
+		}
+		got, err := anthropicAdapter{}.TranslateResponse(status, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, golden, indentJSON(t, got))
+	})
+}
+
+// Each Anthropic event stream in testdata/anthropic/stream translates to
+// the OpenAI stream in its .golden file, followed by the error that ended
+// it, if any.
+func TestAnthropicStreamGolden(t *testing.T) {
+	goldenCases(t, "testdata/anthropic/stream/*.sse", func(t *testing.T, input []byte, golden string) {
+		var out bytes.Buffer
+		err := anthropicAdapter{}.TranslateStream(&out, bytes.NewReader(input))
+		got := created.ReplaceAll(out.Bytes(), []byte(`"created":0`))
+		if err != nil {
+			got = fmt.Appendf(got, "error: %v\n", err)
+		}
+		checkGolden(t, golden, got)
+	})
+}
+
+func TestAnthropicRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "tool message", body: `{"model":"c","messages":[{"role":"tool","content":"42"}]}`, wantErr: `messages[0]: role "tool" is not supported`},
+		{name: "image part", body: `{"model":"c","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"x"}}]}]}`, wantErr: `content part type "image_url" is not supported`},
+		{name: "content not text", body: `{"model":"c","messages":[{"role":"user","content":42}]}`, wantErr: "content must be a string or an array"},
+		{name: "stop not strings", body: `{"model":"c","messages":[],"stop":42}`, wantErr: "stop must be a string or an array of strings"},
+		{name: "not JSON", body: `{"model":`, wantErr: "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := anthropicAdapter{}.TranslateRequest([]byte(tt.body))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Through the router, a model on an Anthropic provider is asked at
+// /v1/messages with Anthropic's headers, and the client gets OpenAI
+// responses, streamed or not.
+func TestAnthropicRouted(t *testing.T) {
+	response, _ := os.ReadFile("testdata/anthropic/response/text.json")
+	stream, _ := os.ReadFile("testdata/anthropic/stream/text.sse")
+	requests := make(chan *http.Request, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req anthropicRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests <- r
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write(stream)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}))
+	defer upstream.Close()
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-test")
+	h := routeChain(t, newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  anthropic: {base_url: %s, format: anthropic, api_key_env: ANTHROPIC_API_KEY}
+models:
+  claude-sonnet-4: anthropic
+`, upstream.URL))))
+
+	tests := []struct {
+		name   string
+		body   string
+		golden string
+	}{
+		{name: "response", body: `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`, golden: "testdata/anthropic/response/text.golden"},
+		{name: "stream", body: `{"model":"claude-sonnet-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`, golden: "testdata/anthropic/stream/text.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, chatRequest(tt.body))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			r := <-requests
+			if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "sk-ant-test" || r.Header.Get("anthropic-version") != anthropicVersion || r.Header.Get("Authorization") != "" {
+				t.Errorf("upstream asked at %s with headers %v", r.URL.Path, r.Header)
+			}
+			got := rec.Body.Bytes()
+			if tt.name == "response" {
+				got = indentJSON(t, got)
+			} else {
+				got = created.ReplaceAll(got, []byte(`"created":0`))
+			}
+			want, _ := os.ReadFile(tt.golden)
+			if !bytes.Equal(got, want) {
+				t.Errorf("client got:\n%s\nwant, as in %s:\n%s", got, tt.golden, want)
+			}
+		})
+	}
+}
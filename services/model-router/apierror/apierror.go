@@ -0,0 +1,145 @@
+// Package apierror writes the JSON error envelope shared by every handler
+// and middleware in the router:
+//
+//	{"error": {"message": "...", "type": "invalid_request_error", "code": "model_not_found", "request_id": "..."}}
+//
+// Type is api_error for 5xx statuses and invalid_request_error otherwise,
+// as in OpenAI's API. Code is what clients branch on: one of the codes
+// below, or a narrower one documented where it is returned, such as
+// quota_exceeded or policy_violation.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// CodeInvalidRequest is a request the router or its provider cannot
+	// serve as sent; sending it again unchanged fails again.
+	CodeInvalidRequest = "invalid_request"
+	// CodeModelNotFound is a model that no route, or no provider, serves.
+	CodeModelNotFound = "model_not_found"
+	// CodeProviderUnavailable is no backend of the model being able to
+	// take the request, or the one that took it failing.
+	CodeProviderUnavailable = "provider_unavailable"
+	// CodeRateLimited is the client or the provider being over a limit;
+	// Retry-After says when to try again.
+	CodeRateLimited = "rate_limited"
+	// CodeTimeout is the request running out of time, in the router or
+	// upstream.
+	CodeTimeout = "timeout"
+	// CodeInternal is a failure of the router itself.
+	CodeInternal = "internal"
+)
+
+type Detail struct {
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// Provider and ProviderDetail are set on errors a provider answered
+	// with: its name and its own message, redacted.
+	Provider       string `json:"provider,omitempty"`
+	ProviderDetail string `json:"provider_detail,omitempty"`
+}
+
+type Response struct {
+	Error Detail `json:"error"`
+}
+
+// APIError is an error as the client is answered with it.
+type APIError struct {
+	Status         int
+	Code           string
+	Message        string
+	Provider       string
+	ProviderDetail string
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+// Write sends e in the envelope, like Write.
+func (e *APIError) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(Response{Error: Detail{
+		Message:        e.Message,
+		Type:           errorType(e.Status),
+		Code:           e.Code,
+		RequestID:      w.Header().Get("X-Request-ID"),
+		Provider:       e.Provider,
+		ProviderDetail: e.ProviderDetail,
+	}})
+}
+
+// Write sends the error envelope. The request ID is taken from the
+// X-Request-ID response header, which the request ID middleware sets before
+// any handler runs, so clients can quote it when reporting failures.
+func Write(w http.ResponseWriter, status int, code, message string) {
+	(&APIError{Status: status, Code: code, Message: message}).Write(w)
+}
+
+// WriteWithDetails sends the error envelope with details as extra
+// top-level fields beside "error", for errors clients act on by value.
+func WriteWithDetails(w http.ResponseWriter, status int, code, message string, details map[string]any) {
+	body := make(map[string]any, len(details)+1)
+	for k, v := range details {
+		body[k] = v
+	}
+	body["error"] = Detail{
+		Message:   message,
+		Type:      errorType(status),
+		Code:      code,
+		RequestID: w.Header().Get("X-Request-ID"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func errorType(status int) string {
+	if status >= 500 {
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// maxDetailLen bounds a provider's message as passed on.
+const maxDetailLen = 512
+
+var (
+	urlPattern = regexp.MustCompile(`(?i)\b(?:https?|wss?|grpcs?)://[^\s"'<>]+`)
+	// keyPattern matches credentials as providers tend to echo them: bearer
+	// tokens, keys with a known prefix and key=value pairs.
+	keyPattern = regexp.MustCompile(`(?i)\bbearer\s+[^\s"',]+|\b(?:sk|pk|rk|gsk|xai|fw)[-_][A-Za-z0-9_\-]{8,}|\b(?:api[_-]?key|access[_-]?token|token|secret|password)\b["']?\s*[:=]\s*["']?[^\s"',&]+`)
+)
+
+// Redact returns a provider's error message fit to pass on to clients:
+// without URLs, which name internal hosts, credentials, including each of
+// secrets wherever it appears, or control characters, and cut to a few
+// hundred bytes.
+func Redact(message string, secrets ...string) string {
+	for _, s := range secrets {
+		if len(s) >= 4 {
+			message = strings.ReplaceAll(message, s, "[redacted]")
+		}
+	}
+	message = keyPattern.ReplaceAllString(message, "[redacted]")
+	message = urlPattern.ReplaceAllString(message, "[url]")
+	message = strings.Join(strings.FieldsFunc(message, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}), " ")
+	message = strings.TrimSpace(message)
+	if len(message) > maxDetailLen {
+		cut := maxDetailLen
+		for cut > 0 && !utf8.RuneStart(message[cut]) {
+			cut--
+		}
+		message = message[:cut] + "..."
+	}
+	return message
+}
@@ -0,0 +1,109 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		status   int
+		code     string
+		wantType string
+	}{
+		{status: http.StatusBadRequest, code: CodeInvalidRequest, wantType: "invalid_request_error"},
+		{status: http.StatusNotFound, code: CodeModelNotFound, wantType: "invalid_request_error"},
+		{status: http.StatusTooManyRequests, code: CodeRateLimited, wantType: "invalid_request_error"},
+		{status: http.StatusInternalServerError, code: CodeInternal, wantType: "api_error"},
+		{status: http.StatusBadGateway, code: CodeProviderUnavailable, wantType: "api_error"},
+		{status: http.StatusGatewayTimeout, code: CodeTimeout, wantType: "api_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set("X-Request-ID", "req-1")
+			Write(rec, tt.status, tt.code, "it failed")
+			if rec.Code != tt.status || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("status = %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			var resp Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := Detail{Message: "it failed", Type: tt.wantType, Code: tt.code, RequestID: "req-1"}
+			if resp.Error != want {
+				t.Errorf("error = %+v, want %+v", resp.Error, want)
+			}
+		})
+	}
+}
+
+func TestWriteProviderDetail(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&APIError{Status: http.StatusBadGateway, Code: CodeProviderUnavailable, Message: "upstream a failed", Provider: "a", ProviderDetail: "overloaded"}).Write(rec)
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Provider != "a" || resp.Error.ProviderDetail != "overloaded" || resp.Error.Type != "api_error" {
+		t.Errorf("error = %+v", resp.Error)
+	}
+	if strings.Contains(rec.Body.String(), "request_id") {
+		t.Errorf("body = %s, want no request_id without an X-Request-ID", rec.Body)
+	}
+}
+
+func TestWriteWithDetails(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteWithDetails(rec, http.StatusPaymentRequired, "quota_exceeded", "over quota", map[string]any{"quota_used": 14, "error": "shadowed"})
+	var resp struct {
+		Error Detail `json:"error"`
+		Used  int    `json:"quota_used"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Code != "quota_exceeded" || resp.Error.Message != "over quota" || resp.Used != 14 {
+		t.Errorf("body = %s", rec.Body)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		secrets []string
+		want    string
+	}{
+		{name: "plain", message: "model is overloaded", want: "model is overloaded"},
+		{name: "bearer token", message: "Authorization: Bearer abc.def.ghi rejected", want: "Authorization: [redacted] rejected"},
+		{name: "prefixed key", message: "Incorrect API key provided: sk-proj-abcdefgh1234", want: "Incorrect API key provided: [redacted]"},
+		{name: "key=value", message: `bad request api_key="hunter22" given`, want: `bad request [redacted]" given`},
+		{name: "secret anywhere", message: "key r0uter-s3cret is disabled", secrets: []string{"r0uter-s3cret"}, want: "key [redacted] is disabled"},
+		{name: "short secret is left", message: "abc is fine", secrets: []string{"abc"}, want: "abc is fine"},
+		{name: "internal url", message: "dial http://10.0.0.7:8000/v1/chat failed", want: "dial [url] failed"},
+		{name: "host", message: "no route to vllm.internal:8000", secrets: []string{"vllm.internal:8000"}, want: "no route to [redacted]"},
+		{name: "control characters", message: "line one\n\tline two\x00", want: "line one line two"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.message, tt.secrets...); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactCutsLongMessages(t *testing.T) {
+	got := Redact(strings.Repeat("é", maxDetailLen))
+	if len(got) > maxDetailLen+len("...") || !strings.HasSuffix(got, "...") {
+		t.Fatalf("len = %d, want at most %d ending in ...", len(got), maxDetailLen+3)
+	}
+	if !utf8.ValidString(got) {
+		t.Errorf("cut splits a rune: %q", got[len(got)-8:])
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	defaultAuditMaxSizeMB  = 100
+	defaultAuditMaxBackups = 5
+	defaultAuditBufferSize = 10000
+	// auditMaxBatch bounds how many queued records are handed to the
+	// AuditLogger at once.
+	auditMaxBatch = 512
+	// auditWarnInterval spaces out warnings while the AuditLogger fails,
+	// e.g. during a Kafka outage.
+	auditWarnInterval = 10 * time.Second
+)
+
+// promptFields are the request fields holding the prompt, across the chat,
+// completion and embeddings APIs. They are hashed together into
+// prompt_sha256 and never written.
+var promptFields = []string{"messages", "prompt", "input"}
+
+// AuditConfig records every routed request, one JSON object each, to the
+// backend AUDIT_BACKEND names: "file" (default) appends lines to Path,
+// rotated once it reaches MaxSizeMB (default 100) with MaxBackups
+// (default 5) timestamped old files kept beside it, and "kafka" publishes
+// to Kafka.Topic. Records carry hashes instead of the prompt; HashFields
+// names further top-level request fields, such as "user", whose values are
+// recorded as hashes too. Up to BufferSize (default 10000) records wait
+// for the backend; past that they are dropped and counted in
+// router_audit_dropped_total, so a slow backend never holds up requests.
+// AUDIT_LOG=off turns the log off, e.g. for development. Changes take
+// effect on restart, not reload.
+type AuditConfig struct {
+	Path       string            `json:"path,omitempty"`
+	MaxSizeMB  int               `json:"max_size_mb,omitempty"`
+	MaxBackups int               `json:"max_backups,omitempty"`
+	HashFields []string          `json:"hash_fields,omitempty"`
+	Kafka      *AuditKafkaConfig `json:"kafka,omitempty"`
+	BufferSize int               `json:"buffer_size,omitempty"`
+}
+
+// AuditKafkaConfig is where AUDIT_BACKEND=kafka publishes records.
+type AuditKafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+func (c AuditConfig) maxSizeMB() int {
+	if c.MaxSizeMB > 0 {
+		return c.MaxSizeMB
+	}
+	return defaultAuditMaxSizeMB
+}
+
+func (c AuditConfig) maxBackups() int {
+	if c.MaxBackups > 0 {
+		return c.MaxBackups
+	}
+	return defaultAuditMaxBackups
+}
+
+func (c AuditConfig) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+	return defaultAuditBufferSize
+}
+
+// auditBackend is the AUDIT_BACKEND setting, "file" by default.
+func auditBackend() string {
+	if b := os.Getenv("AUDIT_BACKEND"); b != "" {
+		return b
+	}
+	return "file"
+}
+
+func validateAudit(ac AuditConfig) error {
+	switch b := auditBackend(); b {
+	case "file":
+		if ac.Path == "" {
+			return fmt.Errorf("audit.path is required")
+		}
+	case "kafka":
+		if ac.Kafka == nil || len(ac.Kafka.Brokers) == 0 || ac.Kafka.Topic == "" {
+			return fmt.Errorf("audit.kafka: brokers and topic are required with AUDIT_BACKEND=kafka")
+		}
+	default:
+		return fmt.Errorf("audit: unknown AUDIT_BACKEND %q (want file or kafka)", b)
+	}
+	if ac.MaxSizeMB < 0 || ac.MaxBackups < 0 || ac.BufferSize < 0 {
+		return fmt.Errorf("audit: max_size_mb, max_backups and buffer_size must not be negative")
+	}
+	for _, f := range ac.HashFields {
+		if f == "" {
+			return fmt.Errorf("audit.hash_fields: field names must not be empty")
+		}
+	}
+	return nil
+}
+
+// AuditEntry is one audit record. APIKey is the name of the key that
+// authenticated the request, never the key; Subject is the JWT sub claim
+// and TenantID the tenant the key belongs to. Model is what the client
+// asked for and ServedModel what answered, which differ after a fallback.
+type AuditEntry struct {
+	Timestamp         time.Time         `json:"timestamp"`
+	RequestID         string            `json:"request_id"`
+	TenantID          string            `json:"tenant_id,omitempty"`
+	APIKey            string            `json:"api_key,omitempty"`
+	Subject           string            `json:"subject,omitempty"`
+	Path              string            `json:"path"`
+	Model             string            `json:"model,omitempty"`
+	ServedModel       string            `json:"served_model,omitempty"`
+	Provider          string            `json:"provider,omitempty"`
+	BackendURL        string            `json:"backend_url,omitempty"`
+	StatusCode        int               `json:"status_code"`
+	LatencyMs         float64           `json:"latency_ms"`
+	RequestSizeBytes  int64             `json:"request_size_bytes"`
+	ResponseSizeBytes int64             `json:"response_size_bytes"`
+	PromptTokens      int64             `json:"prompt_tokens,omitempty"`
+	CompletionTokens  int64             `json:"completion_tokens,omitempty"`
+	TotalTokens       int64             `json:"total_tokens,omitempty"`
+	Cache             string            `json:"cache,omitempty"`
+	PromptSHA256      string            `json:"prompt_sha256,omitempty"`
+	Hashed            map[string]string `json:"hashed,omitempty"`
+}
+
+// AuditRedactor fills in entry from a request body's top-level fields.
+// Redactors must only record hashes or other values that reveal nothing
+// of the prompt.
+type AuditRedactor func(fields map[string]json.RawMessage, entry *AuditEntry)
+
+// hashPrompt records the SHA-256 of the prompt fields, compacted so the
+// hash does not depend on the client's formatting.
+func hashPrompt(fields map[string]json.RawMessage, entry *AuditEntry) {
+	h := sha256.New()
+	found := false
+	for _, name := range promptFields {
+		if raw, ok := fields[name]; ok {
+			found = true
+			h.Write([]byte(name + "\x00"))
+			h.Write(compactJSON(raw))
+		}
+	}
+	if found {
+		entry.PromptSHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// hashFields returns a redactor recording the SHA-256 of each of names
+// that the request sets.
+func hashFields(names []string) AuditRedactor {
+	return func(fields map[string]json.RawMessage, entry *AuditEntry) {
+		for _, name := range names {
+			raw, ok := fields[name]
+			if !ok {
+				continue
+			}
+			if entry.Hashed == nil {
+				entry.Hashed = make(map[string]string)
+			}
+			sum := sha256.Sum256(compactJSON(raw))
+			entry.Hashed[name] = hex.EncodeToString(sum[:])
+		}
+	}
+}
+
+func compactJSON(raw json.RawMessage) []byte {
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return raw
+	}
+	return buf.Bytes()
+}
+
+// AuditLogger stores audit records, each a JSON object. Write is only
+// called from one goroutine, with the records queued since the last call
+// in the order they were made, and should return once they are durable.
+type AuditLogger interface {
+	Write(records [][]byte) error
+	Close() error
+}
+
+// FileAuditLogger appends records as lines to a file, rotating it by size.
+type FileAuditLogger struct {
+	out *lumberjack.Logger
+	buf bytes.Buffer
+}
+
+// NewFileAuditLogger opens the log at cfg.Path, failing early if it
+// cannot be written.
+func NewFileAuditLogger(cfg AuditConfig) (*FileAuditLogger, error) {
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &FileAuditLogger{out: &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.maxSizeMB(),
+		MaxBackups: cfg.maxBackups(),
+	}}, nil
+}
+
+// Write appends records in one write, so a batch is never split across
+// files.
+func (l *FileAuditLogger) Write(records [][]byte) error {
+	l.buf.Reset()
+	for _, r := range records {
+		l.buf.Write(r)
+		l.buf.WriteByte('\n')
+	}
+	_, err := l.out.Write(l.buf.Bytes())
+	return err
+}
+
+func (l *FileAuditLogger) Close() error {
+	return l.out.Close()
+}
+
+// KafkaAuditLogger publishes each record as a message, keyless, waiting
+// for every in-sync replica to have it.
+type KafkaAuditLogger struct {
+	w *kafka.Writer
+}
+
+func NewKafkaAuditLogger(cfg AuditKafkaConfig) *KafkaAuditLogger {
+	return &KafkaAuditLogger{w: &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.RoundRobin{},
+		RequiredAcks: kafka.RequireAll,
+		BatchSize:    auditMaxBatch,
+		// Batches are formed by Auditor, so the writer need not wait
+		// for more.
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (l *KafkaAuditLogger) Write(records [][]byte) error {
+	msgs := make([]kafka.Message, len(records))
+	for i, r := range records {
+		msgs[i].Value = r
+	}
+	return l.w.WriteMessages(context.Background(), msgs...)
+}
+
+func (l *KafkaAuditLogger) Close() error {
+	return l.w.Close()
+}
+
+// newAuditLogger opens the AuditLogger AUDIT_BACKEND selects.
+func newAuditLogger(cfg AuditConfig) (AuditLogger, error) {
+	if auditBackend() == "kafka" {
+		return NewKafkaAuditLogger(*cfg.Kafka), nil
+	}
+	return NewFileAuditLogger(cfg)
+}
+
+// Auditor records every request that reaches it, whatever the outcome,
+// once the response is complete. Records are queued for a background
+// writer handing them to the AuditLogger, and dropped when the queue is
+// full. Close must run at shutdown, after in-flight requests have
+// finished.
+type Auditor struct {
+	out       AuditLogger
+	redactors []AuditRedactor
+	metrics   *metrics.Metrics
+	logger    *slog.Logger
+
+	queue chan AuditEntry
+	stop  chan struct{}
+	done  chan struct{}
+	// failed counts records lost since the last warning; run owns it.
+	failed   int
+	lastWarn time.Time
+}
+
+// NewAuditor starts writing records to out.
+func NewAuditor(cfg AuditConfig, out AuditLogger, m *metrics.Metrics, logger *slog.Logger) *Auditor {
+	a := &Auditor{
+		out:       out,
+		redactors: []AuditRedactor{hashPrompt},
+		metrics:   m,
+		logger:    logger,
+		queue:     make(chan AuditEntry, cfg.bufferSize()),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if len(cfg.HashFields) > 0 {
+		a.AddRedactor(hashFields(cfg.HashFields))
+	}
+	go a.run()
+	return a
+}
+
+// AddRedactor adds r to the rules applied to every request body. Call it
+// before the auditor is used.
+func (a *Auditor) AddRedactor(r AuditRedactor) {
+	a.redactors = append(a.redactors, r)
+}
+
+// Record queues entry without waiting, dropping it if the queue is full.
+func (a *Auditor) Record(entry AuditEntry) {
+	select {
+	case a.queue <- entry:
+	default:
+		a.metrics.AuditDropped()
+	}
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	batch := make([][]byte, 0, auditMaxBatch)
+	for {
+		select {
+		case e := <-a.queue:
+			batch = a.appendRecord(batch[:0], e)
+			for len(batch) < auditMaxBatch && len(a.queue) > 0 {
+				batch = a.appendRecord(batch, <-a.queue)
+			}
+			a.write(batch)
+		case <-a.stop:
+			for len(a.queue) > 0 {
+				batch = batch[:0]
+				for len(batch) < auditMaxBatch && len(a.queue) > 0 {
+					batch = a.appendRecord(batch, <-a.queue)
+				}
+				a.write(batch)
+			}
+			return
+		}
+	}
+}
+
+func (a *Auditor) appendRecord(batch [][]byte, e AuditEntry) [][]byte {
+	record, err := json.Marshal(e)
+	if err != nil {
+		return batch
+	}
+	return append(batch, record)
+}
+
+func (a *Auditor) write(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	err := a.out.Write(batch)
+	if err == nil {
+		return
+	}
+	a.failed += len(batch)
+	if time.Since(a.lastWarn) < auditWarnInterval {
+		return
+	}
+	a.logger.Warn("failed to write audit log", slog.Int("records", a.failed), slog.String("error", err.Error()))
+	a.failed, a.lastWarn = 0, time.Now()
+}
+
+// Close writes the records still queued and closes the AuditLogger.
+// Records made after Close are dropped.
+func (a *Auditor) Close() error {
+	close(a.stop)
+	<-a.done
+	return a.out.Close()
+}
+
+// Middleware records each request it wraps. It reads the body to hash it
+// and hands the handler the same bytes.
+func (a *Auditor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := AuditEntry{
+			Timestamp: start.UTC(),
+			RequestID: middleware.RequestIDFrom(r.Context()),
+			Path:      r.URL.Path,
+		}
+		var upload *uploadBody
+		switch {
+		case r.Body == nil:
+		case isMultipart(r.Header):
+			// Uploads stream through; they are counted, not hashed.
+			entry.Model = peekModel(r)
+			upload = &uploadBody{ReadCloser: r.Body, limit: math.MaxInt64}
+			r.Body = upload
+		default:
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			entry.RequestSizeBytes = int64(len(body))
+			if err != nil {
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			} else {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				a.redact(body, &entry)
+			}
+		}
+		rw := middleware.WrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		if upload != nil {
+			entry.RequestSizeBytes = max(upload.n, r.ContentLength)
+		}
+
+		info := middleware.RequestInfoFrom(r.Context())
+		entry.StatusCode = rw.StatusCode()
+		entry.ResponseSizeBytes = rw.Written
+		entry.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		entry.APIKey, entry.Subject, entry.TenantID = info.APIKey(), info.Subject(), info.Tenant()
+		entry.ServedModel, entry.Provider = info.Route()
+		entry.BackendURL = info.BackendURL()
+		entry.PromptTokens, entry.CompletionTokens = info.TokenCounts()
+		entry.TotalTokens = info.Tokens()
+		entry.Cache, _ = info.Cache()
+		a.Record(entry)
+	})
+}
+
+func (a *Auditor) redact(body []byte, entry *AuditEntry) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return
+	}
+	if raw, ok := fields["model"]; ok {
+		json.Unmarshal(raw, &entry.Model)
+	}
+	for _, r := range a.redactors {
+		r(fields, entry)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	defaultBackendHealthPath    = "/health"
+	defaultProbeInterval        = 10 * time.Second
+	defaultConsecutiveFailures  = 3
+	defaultConsecutiveSuccesses = 2
+	// backendProbeTimeout bounds each backend probe, whatever the model's
+	// request timeout, so a hanging backend is found out quickly.
+	backendProbeTimeout = 2 * time.Second
+)
+
+// backendProbeConfig is a model's backend probe settings with defaults
+// applied.
+type backendProbeConfig struct {
+	path      string
+	interval  time.Duration
+	failures  int
+	successes int
+}
+
+// probe returns the model's backend probe settings, or false if it sets
+// neither health_path nor probe_interval_seconds.
+func (bc BackendConfig) probe() (backendProbeConfig, bool) {
+	if bc.HealthPath == "" && bc.ProbeIntervalSeconds <= 0 {
+		return backendProbeConfig{}, false
+	}
+	pc := backendProbeConfig{
+		path:      bc.HealthPath,
+		interval:  time.Duration(bc.ProbeIntervalSeconds * float64(time.Second)),
+		failures:  bc.ConsecutiveFailures,
+		successes: bc.ConsecutiveSuccesses,
+	}
+	if pc.path == "" {
+		pc.path = defaultBackendHealthPath
+	}
+	if pc.interval <= 0 {
+		pc.interval = defaultProbeInterval
+	}
+	if pc.failures <= 0 {
+		pc.failures = defaultConsecutiveFailures
+	}
+	if pc.successes <= 0 {
+		pc.successes = defaultConsecutiveSuccesses
+	}
+	return pc, true
+}
+
+type backendProbe struct {
+	model    string
+	provider Provider
+	cfg      backendProbeConfig
+	client   *http.Client
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// BackendHealthChecker probes each backend of the models with backend
+// probes configured, one goroutine per model and backend, and takes
+// backends that keep failing out of rotation until they keep passing
+// again. Probes go through a client of their own with a short timeout, so
+// they neither wait as long as requests nor share their connection limits.
+// Update reconciles the probers with each routing table built.
+type BackendHealthChecker struct {
+	client  *http.Client
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	ctx      context.Context
+	probes   map[string]*backendProbe
+	statuses map[string]*ProviderHealth
+}
+
+func NewBackendHealthChecker(m *metrics.Metrics, logger *slog.Logger) *BackendHealthChecker {
+	return &BackendHealthChecker{
+		client:   &http.Client{Timeout: backendProbeTimeout},
+		metrics:  m,
+		logger:   logger,
+		probes:   make(map[string]*backendProbe),
+		statuses: make(map[string]*ProviderHealth),
+	}
+}
+
+// Start launches the probers configured so far and any added later; they
+// run until ctx ends or Stop is called.
+func (bh *BackendHealthChecker) Start(ctx context.Context) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	bh.ctx = ctx
+	for key, p := range bh.probes {
+		bh.launch(key, p)
+	}
+}
+
+// Stop ends every prober and waits for them to exit.
+func (bh *BackendHealthChecker) Stop() {
+	bh.mu.Lock()
+	probes := bh.probes
+	bh.probes = make(map[string]*backendProbe)
+	bh.ctx = nil
+	bh.mu.Unlock()
+	for _, p := range probes {
+		p.halt()
+	}
+}
+
+// Update starts, restarts or stops probers so they match t, and returns
+// the health of each probed backend by "model/backend" for the table to
+// link.
+func (bh *BackendHealthChecker) Update(t *routingTable) map[string]*ProviderHealth {
+	wanted := make(map[string]*backendProbe)
+	for _, e := range t.entries() {
+		cfg, ok := e.Config.probe()
+		if !ok {
+			continue
+		}
+		for _, b := range e.Backends() {
+			p := &backendProbe{model: e.Name, provider: *b.Provider, cfg: cfg, client: bh.client}
+			if b.Provider.Client != nil {
+				// Keep the backend's own TLS settings.
+				p.client = &http.Client{Transport: b.Provider.Client.Transport, Timeout: backendProbeTimeout}
+			}
+			wanted[e.Name+"/"+b.Name()] = p
+		}
+	}
+
+	bh.mu.Lock()
+	var stale []*backendProbe
+	for key, p := range bh.probes {
+		w, ok := wanted[key]
+		if !ok || w.cfg != p.cfg || !sameTarget(w.provider, p.provider) {
+			stale = append(stale, p)
+			delete(bh.probes, key)
+		}
+	}
+	out := make(map[string]*ProviderHealth, len(wanted))
+	for key, p := range wanted {
+		h, ok := bh.statuses[key]
+		if !ok {
+			h = &ProviderHealth{name: key, checked: true}
+			bh.statuses[key] = h
+		}
+		h.mu.Lock()
+		h.baseURL = p.provider.BaseURL
+		h.mu.Unlock()
+		out[key] = h
+		if _, running := bh.probes[key]; running {
+			continue
+		}
+		bh.probes[key] = p
+		if bh.ctx != nil {
+			bh.launch(key, p)
+		}
+	}
+	for key := range bh.statuses {
+		if _, ok := wanted[key]; !ok {
+			delete(bh.statuses, key)
+		}
+	}
+	bh.mu.Unlock()
+	for _, p := range stale {
+		p.halt()
+	}
+	return out
+}
+
+// launch starts p's goroutine; bh.mu must be held.
+func (bh *BackendHealthChecker) launch(key string, p *backendProbe) {
+	ctx, cancel := context.WithCancel(bh.ctx)
+	p.stop, p.done = cancel, make(chan struct{})
+	go bh.run(ctx, p, bh.statuses[key])
+}
+
+func (p *backendProbe) halt() {
+	if p.stop != nil {
+		p.stop()
+		<-p.done
+	}
+}
+
+func (bh *BackendHealthChecker) run(ctx context.Context, p *backendProbe, h *ProviderHealth) {
+	defer close(p.done)
+	backend := strings.TrimPrefix(h.name, p.model+"/")
+	ticker := time.NewTicker(p.cfg.interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := probeGet(ctx, p.client, &p.provider, p.cfg.path, backendProbeTimeout)
+		if ctx.Err() != nil {
+			return
+		}
+		before, after := h.record(err, time.Since(start), p.cfg.failures, p.cfg.successes)
+		if before != after {
+			bh.metrics.BackendHealthState(p.model, backend, after == "up")
+			switch {
+			case after == "down":
+				bh.logger.Warn("backend removed from rotation; health probes failing",
+					slog.String("model", p.model), slog.String("backend", backend), slog.String("error", err.Error()))
+			case before == "down":
+				bh.logger.Info("backend back in rotation", slog.String("model", p.model), slog.String("backend", backend))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A backend is trusted at its first passing probe, leaves rotation only
+// after consecutive_failures failures in a row and comes back only after
+// consecutive_successes passes in a row.
+func TestBackendHealthThresholds(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes string // + passes, - fails
+		want   []string
+	}{
+		{name: "first pass", probes: "+", want: []string{"up"}},
+		{name: "failing from the start", probes: "---", want: []string{"unknown", "unknown", "down"}},
+		{name: "under the failure threshold", probes: "+--", want: []string{"up", "up", "up"}},
+		{name: "at the failure threshold", probes: "+---", want: []string{"up", "up", "up", "down"}},
+		{name: "a pass resets the failures", probes: "+--+--", want: []string{"up", "up", "up", "up", "up", "up"}},
+		{name: "under the success threshold", probes: "---+", want: []string{"unknown", "unknown", "down", "down"}},
+		{name: "at the success threshold", probes: "---++", want: []string{"unknown", "unknown", "down", "down", "up"}},
+		{name: "a failure resets the passes", probes: "---+-++", want: []string{"unknown", "unknown", "down", "down", "down", "down", "up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ProviderHealth{name: "m/b", checked: true}
+			var got []string
+			for _, p := range tt.probes {
+				var err error
+				if p == '-' {
+					err = errors.New("probe failed")
+				}
+				_, after := h.record(err, 0, 3, 2)
+				got = append(got, after)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("statuses = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// healthToggled is a replica answering requests with its name, whose
+// /health passes while healthy is set.
+func healthToggled(t *testing.T, name string, healthy *atomic.Bool) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"backend":%q}`, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// A replica whose probes keep failing takes no requests until they keep
+// passing again.
+func TestBackendProbesRotation(t *testing.T) {
+	var aHealthy, bHealthy atomic.Bool
+	aHealthy.Store(true)
+	bHealthy.Store(true)
+	urlA, urlB := healthToggled(t, "a", &aHealthy), healthToggled(t, "b", &bHealthy)
+	cfg := testConfig(t, fmt.Sprintf(`
+models:
+  m:
+    replicas: [{url: %s}, {url: %s}]
+    health_path: /health
+    probe_interval_seconds: 0.01
+    consecutive_failures: 2
+    consecutive_successes: 2
+`, urlA, urlB))
+	probes := NewBackendHealthChecker(nil, testLogger())
+	registry := NewModelRegistry(cfg, "", nil, nil, probes, nil, testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	probes.Start(ctx)
+	defer probes.Stop()
+	rt := NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger()))
+	h := routeChain(t, rt)
+	served := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for range n {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+			var resp struct {
+				Backend string `json:"backend"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			counts[resp.Backend]++
+		}
+		return counts
+	}
+	// Probes are keyed by model and replica, a replica named by its host.
+	statusOf := func(url string) string {
+		return registry.BackendProbes()["m/"+strings.TrimPrefix(url, "http://")].Status
+	}
+
+	waitFor(t, "both up", func() bool { return statusOf(urlA) == "up" && statusOf(urlB) == "up" })
+	if got := served(10); got["a"] == 0 || got["b"] == 0 {
+		t.Errorf("served while both are healthy = %v, want both", got)
+	}
+	bHealthy.Store(false)
+	waitFor(t, "b down", func() bool { return statusOf(urlB) == "down" })
+	if got := served(10); got["a"] != 10 {
+		t.Errorf("served while b is down = %v, want all by a", got)
+	}
+	bHealthy.Store(true)
+	waitFor(t, "b back up", func() bool { return statusOf(urlB) == "up" })
+	if got := served(10); got["b"] == 0 {
+		t.Errorf("served once b recovered = %v, want some by b", got)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	// slowStartFloor is the share of its weight a replica starts slow
+	// start with.
+	slowStartFloor = 0.1
+	// outlierSamples is how many recent responses of a replica outlier
+	// detection keeps.
+	outlierSamples = 128
+
+	defaultOutlierInterval    = 30 * time.Second
+	defaultOutlierMinRequests = 10
+	defaultOutlierErrorRate   = 50
+	defaultOutlierEjection    = 30 * time.Second
+	defaultMaxEjectionPercent = 50
+)
+
+// OutlierDetectionConfig ejects a replica from its pool for
+// EjectionSeconds (default 30) once, over its responses of the last
+// IntervalSeconds (default 30), at least MinRequests (default 10), more
+// than MaxErrorRatePercent (default 50) were transport errors or 5xx, or
+// their p95 latency to response headers exceeded MaxP95LatencyMs (default
+// none). At most MaxEjectionPercent (default 50) of the pool's replicas are
+// ejected at once, rounded down, so a pool of one is never ejected. An
+// ejected replica is judged afresh when it comes back.
+type OutlierDetectionConfig struct {
+	IntervalSeconds     float64 `json:"interval_seconds,omitempty"`
+	MinRequests         int     `json:"min_requests,omitempty"`
+	MaxErrorRatePercent float64 `json:"max_error_rate_percent,omitempty"`
+	MaxP95LatencyMs     float64 `json:"max_p95_latency_ms,omitempty"`
+	EjectionSeconds     float64 `json:"ejection_seconds,omitempty"`
+	MaxEjectionPercent  int     `json:"max_ejection_percent,omitempty"`
+}
+
+func validateOutlierDetection(od OutlierDetectionConfig) error {
+	if od.IntervalSeconds < 0 || od.MaxP95LatencyMs < 0 || od.EjectionSeconds < 0 {
+		return fmt.Errorf("outlier_detection: interval_seconds, max_p95_latency_ms and ejection_seconds must not be negative")
+	}
+	if od.MinRequests < 0 || od.MinRequests > outlierSamples {
+		return fmt.Errorf("outlier_detection.min_requests must be between 0 and %d", outlierSamples)
+	}
+	if od.MaxErrorRatePercent < 0 || od.MaxErrorRatePercent > 100 {
+		return fmt.Errorf("outlier_detection.max_error_rate_percent must be between 0 and 100")
+	}
+	if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier_detection.max_ejection_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (od OutlierDetectionConfig) withDefaults() OutlierDetectionConfig {
+	if od.IntervalSeconds == 0 {
+		od.IntervalSeconds = defaultOutlierInterval.Seconds()
+	}
+	if od.MinRequests == 0 {
+		od.MinRequests = defaultOutlierMinRequests
+	}
+	if od.MaxErrorRatePercent == 0 {
+		od.MaxErrorRatePercent = defaultOutlierErrorRate
+	}
+	if od.EjectionSeconds == 0 {
+		od.EjectionSeconds = defaultOutlierEjection.Seconds()
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+	return od
+}
+
+// balancer is the slow start and outlier ejection of a pool whose model
+// configures either. now is its clock, time.Now but for tests. Its fields
+// after metrics are guarded by the pool's lock.
+type balancer struct {
+	model     string
+	slowStart time.Duration
+	// outliers is nil without outlier detection.
+	outliers *OutlierDetectionConfig
+	now      func() time.Time
+	logger   *slog.Logger
+	metrics  *metrics.Metrics
+
+	states map[*Backend]*backendBalance
+}
+
+// backendBalance is what a balancer knows of one replica.
+type backendBalance struct {
+	// inRotation is whether the replica was a candidate last time the pool
+	// picked, and since when, for slow start to tell when it joined.
+	inRotation bool
+	since      time.Time
+	ramping    bool
+
+	samples      []outlierSample
+	next         int
+	ejectedUntil time.Time
+}
+
+type outlierSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+// newBalancer returns the balancer for model's pool as bc configures it,
+// or nil if it configures neither slow start nor outlier detection.
+func newBalancer(model string, bc BackendConfig, backends []*Backend, logger *slog.Logger) *balancer {
+	if bc.SlowStartSeconds <= 0 && bc.OutlierDetection == nil {
+		return nil
+	}
+	bl := &balancer{
+		model:     model,
+		slowStart: time.Duration(bc.SlowStartSeconds * float64(time.Second)),
+		now:       time.Now,
+		logger:    logger,
+		states:    make(map[*Backend]*backendBalance, len(backends)),
+	}
+	if od := bc.OutlierDetection; od != nil {
+		cfg := od.withDefaults()
+		bl.outliers = &cfg
+	}
+	for _, b := range backends {
+		bl.states[b] = &backendBalance{}
+	}
+	return bl
+}
+
+func balanceKey(b *Backend) string {
+	return b.Name() + "\x00" + b.Provider.BaseURL
+}
+
+// carryOver continues prev's state, that of the same pool in the table
+// being replaced, for the replicas both have, so a reload neither restarts
+// slow start nor ends an ejection. Replicas new to the pool start slow
+// start once they take traffic. A pool new to the table, with prev nil,
+// starts with every replica in rotation: slow start only tells replicas
+// apart, and all of them are new alike, or were there before the router
+// started.
+func (bl *balancer) carryOver(prev *balancer, m *metrics.Metrics) {
+	if bl == nil {
+		return
+	}
+	bl.metrics = m
+	previous := make(map[string]*backendBalance)
+	if prev != nil {
+		for b, st := range prev.states {
+			previous[balanceKey(b)] = st
+		}
+	}
+	for b := range bl.states {
+		if prev == nil {
+			bl.states[b].inRotation = true
+		}
+		if st, ok := previous[balanceKey(b)]; ok {
+			bl.states[b] = st
+			b.ejected = !st.ejectedUntil.IsZero()
+		}
+		if bl.slowStart > 0 {
+			m.EffectiveWeight(bl.model, b.Name(), float64(b.Weight))
+		}
+	}
+}
+
+// available reports whether b is out of ejection, ending an ejection whose
+// time is up.
+func (bl *balancer) available(b *Backend, now time.Time) bool {
+	if bl == nil || !b.ejected {
+		return true
+	}
+	st := bl.states[b]
+	if now.Before(st.ejectedUntil) {
+		return false
+	}
+	st.ejectedUntil, b.ejected = time.Time{}, false
+	bl.logger.Info("outlier ejection over; replica back in rotation",
+		slog.String("model", bl.model), slog.String("backend", b.Name()))
+	return true
+}
+
+// weigh sets the effective weight of the pool's backends for the next
+// pick, the candidates' slowed while they ramp up. Unless dry, a candidate
+// that was not one last time starts slow start.
+func (bl *balancer) weigh(backends, candidates []*Backend, now time.Time, dry bool) {
+	for _, b := range candidates {
+		b.effective = b.Weight * 100
+	}
+	if bl == nil {
+		return
+	}
+	for _, b := range backends {
+		st := bl.states[b]
+		candidate := slices.Contains(candidates, b)
+		if !dry {
+			if candidate && !st.inRotation {
+				st.since, st.ramping = now, bl.slowStart > 0
+			}
+			st.inRotation = candidate
+		}
+		if !candidate || !st.ramping {
+			continue
+		}
+		share := float64(now.Sub(st.since)) / float64(bl.slowStart)
+		if share >= 1 {
+			if !dry {
+				st.ramping = false
+				bl.metrics.EffectiveWeight(bl.model, b.Name(), float64(b.Weight))
+			}
+			continue
+		}
+		share = slowStartFloor + (1-slowStartFloor)*share
+		b.effective = max(int(float64(b.Weight*100)*share), 1)
+		if !dry {
+			bl.metrics.EffectiveWeight(bl.model, b.Name(), float64(b.Weight)*share)
+		}
+	}
+}
+
+// observe records a response of b, or its failure, that took latency, and
+// ejects b if it has become an outlier and the pool can spare it.
+func (bl *balancer) observe(backends []*Backend, b *Backend, latency time.Duration, failed bool) {
+	st, ok := bl.states[b]
+	if !ok || b.ejected {
+		return
+	}
+	now := bl.now()
+	sample := outlierSample{at: now, latency: latency, failed: failed}
+	if len(st.samples) < outlierSamples {
+		st.samples = append(st.samples, sample)
+	} else {
+		st.samples[st.next] = sample
+		st.next = (st.next + 1) % outlierSamples
+	}
+
+	od := bl.outliers
+	from := now.Add(-time.Duration(od.IntervalSeconds * float64(time.Second)))
+	latencies := make([]time.Duration, 0, len(st.samples))
+	failures := 0
+	for _, s := range st.samples {
+		if s.at.Before(from) {
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		if s.failed {
+			failures++
+		}
+	}
+	if len(latencies) < od.MinRequests {
+		return
+	}
+	var reason string
+	slices.Sort(latencies)
+	p95 := latencies[(len(latencies)*95+99)/100-1]
+	errorRate := 100 * float64(failures) / float64(len(latencies))
+	switch {
+	case errorRate > od.MaxErrorRatePercent:
+		reason = fmt.Sprintf("error rate %.0f%% over %d requests", errorRate, len(latencies))
+	case od.MaxP95LatencyMs > 0 && float64(p95)/float64(time.Millisecond) > od.MaxP95LatencyMs:
+		reason = fmt.Sprintf("p95 latency %s over %d requests", p95.Round(time.Millisecond), len(latencies))
+	default:
+		return
+	}
+	ejected := 0
+	for _, other := range backends {
+		if !bl.available(other, now) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(backends)*od.MaxEjectionPercent {
+		return
+	}
+	cooldown := time.Duration(od.EjectionSeconds * float64(time.Second))
+	st.ejectedUntil, b.ejected = now.Add(cooldown), true
+	st.samples, st.next = nil, 0
+	bl.metrics.OutlierEjection(bl.model, b.Name())
+	if bl.slowStart > 0 {
+		bl.metrics.EffectiveWeight(bl.model, b.Name(), 0)
+	}
+	bl.logger.Warn("replica ejected as an outlier",
+		slog.String("model", bl.model), slog.String("backend", b.Name()),
+		slog.String("reason", reason), slog.String("cooldown", cooldown.String()))
+}
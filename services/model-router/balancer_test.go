@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// balancedPool is a pool of n replicas, r0 to r<n-1>, of weight 10 each,
+// balanced as bc configures on a clock the test moves by setting *now.
+func balancedPool(t *testing.T, bc BackendConfig, n int) (*BackendPool, []*Backend, *time.Time) {
+	t.Helper()
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = &Backend{Provider: &Provider{Name: fmt.Sprintf("r%d", i)}, Weight: 10}
+	}
+	p := NewBackendPool(backends, nil)
+	p.balance = newBalancer("m", bc, backends, testLogger())
+	if p.balance == nil {
+		t.Fatal("no balancer")
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.balance.now = func() time.Time { return now }
+	p.balance.carryOver(nil, nil)
+	return p, backends, &now
+}
+
+// fail records n failed responses of b.
+func fail(b *Backend, n int) {
+	for range n {
+		b.ObserveOutcome(10*time.Millisecond, true)
+	}
+}
+
+// A replica a pool starts with takes its whole weight at once, and one that
+// joins later starts at 10% of it, growing linearly to all of it over the
+// slow start.
+func TestSlowStartRamp(t *testing.T) {
+	p, backends, now := balancedPool(t, BackendConfig{SlowStartSeconds: 100}, 2)
+	joining := backends[1]
+	p.Next(RouteHint{})
+	if joining.effective != 1000 {
+		t.Fatalf("replica of a new pool has effective weight %d, want all 1000", joining.effective)
+	}
+
+	// Out of rotation and back, as after a failed health check.
+	p.SetWeight("r1", 0)
+	p.Next(RouteHint{})
+	p.SetWeight("r1", 10)
+	start := *now
+	tests := []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{elapsed: 0, want: 100},
+		{elapsed: 25 * time.Second, want: 325},
+		{elapsed: 50 * time.Second, want: 550},
+		{elapsed: 99 * time.Second, want: 991},
+		{elapsed: 100 * time.Second, want: 1000},
+		{elapsed: time.Hour, want: 1000},
+	}
+	for _, tt := range tests {
+		*now = start.Add(tt.elapsed)
+		p.Next(RouteHint{})
+		if joining.effective != tt.want {
+			t.Errorf("after %v effective weight = %d, want %d", tt.elapsed, joining.effective, tt.want)
+		}
+		if backends[0].effective != 1000 {
+			t.Errorf("after %v the settled replica's effective weight = %d, want 1000", tt.elapsed, backends[0].effective)
+		}
+	}
+
+	// At 10% the joining replica takes 1 request in 11.
+	p.SetWeight("r1", 0)
+	p.Next(RouteHint{})
+	p.SetWeight("r1", 10)
+	if got := pickCounts(p, 110); got["r1"] != 10 || got["r0"] != 100 {
+		t.Errorf("picks at the start of slow start = %v, want 10 of 110 for r1", got)
+	}
+}
+
+// An explanation of the pool's choice neither starts nor advances slow
+// start.
+func TestSlowStartExplainIsDry(t *testing.T) {
+	p, backends, now := balancedPool(t, BackendConfig{SlowStartSeconds: 100}, 2)
+	p.SetWeight("r1", 0)
+	p.Next(RouteHint{})
+	p.SetWeight("r1", 10)
+	p.next(RouteHint{}, &PoolExplanation{})
+	*now = now.Add(50 * time.Second)
+	p.Next(RouteHint{})
+	if backends[1].effective != 100 {
+		t.Errorf("effective weight = %d, want slow start to begin with the first real pick", backends[1].effective)
+	}
+}
+
+// A replica answering with more than the allowed share of errors is
+// ejected, takes no traffic until its cooldown is over, and then comes
+// back through slow start.
+func TestOutlierEjection(t *testing.T) {
+	bc := BackendConfig{
+		SlowStartSeconds: 100,
+		OutlierDetection: &OutlierDetectionConfig{MinRequests: 10, MaxErrorRatePercent: 50, EjectionSeconds: 30, IntervalSeconds: 30},
+	}
+	p, backends, now := balancedPool(t, bc, 2)
+	bad := backends[0]
+
+	fail(bad, 9)
+	if bad.ejected {
+		t.Fatal("ejected before min_requests responses")
+	}
+	fail(bad, 1)
+	if !bad.ejected {
+		t.Fatal("not ejected after 10 failures in 10 responses")
+	}
+	ejectedAt := *now
+	if got := pickCounts(p, 20); got["r0"] != 0 {
+		t.Errorf("picks while ejected = %v, want none for r0", got)
+	}
+	*now = ejectedAt.Add(29 * time.Second)
+	if got := pickCounts(p, 4); got["r0"] != 0 {
+		t.Errorf("picks a second before the cooldown ends = %v, want none for r0", got)
+	}
+	*now = ejectedAt.Add(30 * time.Second)
+	p.Next(RouteHint{})
+	if bad.ejected || bad.effective != 100 {
+		t.Errorf("after the cooldown ejected = %v, effective weight %d: want back at 10%% of its weight", bad.ejected, bad.effective)
+	}
+}
+
+func TestOutlierThresholds(t *testing.T) {
+	od := OutlierDetectionConfig{MinRequests: 10, MaxErrorRatePercent: 50, MaxP95LatencyMs: 500, IntervalSeconds: 30}
+	tests := []struct {
+		name    string
+		observe func(b *Backend, now *time.Time)
+		ejected bool
+	}{
+		{
+			name: "error rate at the limit",
+			observe: func(b *Backend, now *time.Time) {
+				for i := range 10 {
+					b.ObserveOutcome(time.Millisecond, i%2 == 0)
+				}
+			},
+		},
+		{
+			name: "error rate over the limit",
+			observe: func(b *Backend, now *time.Time) {
+				for i := range 10 {
+					b.ObserveOutcome(time.Millisecond, i%3 != 0)
+				}
+			},
+			ejected: true,
+		},
+		{
+			name: "failures older than the interval",
+			observe: func(b *Backend, now *time.Time) {
+				fail(b, 9)
+				*now = now.Add(31 * time.Second)
+				fail(b, 1)
+			},
+		},
+		{
+			name: "slow p95",
+			observe: func(b *Backend, now *time.Time) {
+				for i := range 20 {
+					latency := 100 * time.Millisecond
+					if i >= 18 {
+						latency = time.Second
+					}
+					b.ObserveOutcome(latency, false)
+				}
+			},
+			ejected: true,
+		},
+		{
+			// With 20 fast responses already, one slow is above the p95.
+			name: "one slow response in 21",
+			observe: func(b *Backend, now *time.Time) {
+				for range 20 {
+					b.ObserveOutcome(100*time.Millisecond, false)
+				}
+				b.ObserveOutcome(time.Second, false)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, backends, now := balancedPool(t, BackendConfig{OutlierDetection: &od}, 2)
+			tt.observe(backends[0], now)
+			if backends[0].ejected != tt.ejected {
+				t.Errorf("ejected = %v, want %v", backends[0].ejected, tt.ejected)
+			}
+		})
+	}
+}
+
+// However many replicas fail, no more than max_ejection_percent of the
+// pool, rounded down, is ejected at once.
+func TestOutlierEjectionCap(t *testing.T) {
+	tests := []struct {
+		replicas int
+		percent  int
+		want     int
+	}{
+		{replicas: 4, want: 2},
+		{replicas: 3, want: 1},
+		{replicas: 2, want: 1},
+		{replicas: 1, want: 0},
+		{replicas: 4, percent: 100, want: 4},
+		{replicas: 4, percent: 10, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d replicas, %d%%", tt.replicas, tt.percent), func(t *testing.T) {
+			od := OutlierDetectionConfig{MinRequests: 10, MaxEjectionPercent: tt.percent}
+			p, backends, now := balancedPool(t, BackendConfig{OutlierDetection: &od}, tt.replicas)
+			for _, b := range backends {
+				fail(b, 10)
+			}
+			var heldBack []*Backend
+			for _, b := range backends {
+				if !b.ejected {
+					heldBack = append(heldBack, b)
+				}
+			}
+			if ejected := tt.replicas - len(heldBack); ejected != tt.want {
+				t.Fatalf("%d ejected, want %d", ejected, tt.want)
+			}
+			if tt.want == 0 || tt.want == tt.replicas {
+				return
+			}
+			// Once the first ejections end, the replicas the cap held back
+			// are ejected at their next failure, up to the cap again.
+			*now = now.Add(defaultOutlierEjection)
+			p.Next(RouteHint{})
+			ejected := 0
+			for _, b := range heldBack {
+				fail(b, 1)
+				if b.ejected {
+					ejected++
+				}
+			}
+			if want := min(len(heldBack), tt.want); ejected != want {
+				t.Errorf("%d held back replicas ejected after the cooldown, want %d", ejected, want)
+			}
+		})
+	}
+}
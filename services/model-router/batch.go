@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	batchPath = "/v1/batch"
+	// maxBatchModels bounds the models of one batch, and batchConcurrency
+	// how many of them are in flight at once, so one batch cannot take
+	// over the upstreams' capacity.
+	maxBatchModels   = 16
+	batchConcurrency = 4
+)
+
+// BatchResult is the answer of one model of a batch: its response, or
+// the error a request for it alone would have been answered with.
+type BatchResult struct {
+	Model    string           `json:"model"`
+	Status   int              `json:"status"`
+	ServedBy string           `json:"served_by,omitempty"`
+	Response json.RawMessage  `json:"response,omitempty"`
+	Error    *apierror.Detail `json:"error,omitempty"`
+	// info is the RequestInfo the model's request was served with.
+	info *middleware.RequestInfo
+}
+
+// BatchResponse answers POST /v1/batch, with the results in the order the
+// models were given.
+type BatchResponse struct {
+	Object  string        `json:"object"`
+	Results []BatchResult `json:"results"`
+}
+
+// Batch serves POST /v1/batch for eval harnesses comparing models: a chat
+// completion request naming several models, {"models": [...], "messages":
+// [...]}, is sent to each of them, at most batchConcurrency at a time,
+// through chat, the handler of POST /v1/chat/completions with its whole
+// middleware chain. Each model thus gets the aliases, tenant policy,
+// allowed models, rate limits, quotas, cache and deadline a request for it
+// alone would, X-Request-Timeout-Ms included, and its usage is recorded by
+// itself. A model failing is reported in its result; the batch as a whole
+// fails only if the request is invalid for every model alike. Streaming
+// is not supported.
+func (rt *Router) Batch(chat http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rt.registry.MaxBodyBytes()))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the router limit")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+			return
+		}
+		// An override would send every model's request to the same one.
+		if r.Header.Get(ModelOverrideHeader) != "" {
+			writeError(w, http.StatusBadRequest, "invalid_request", ModelOverrideHeader+" does not apply to batches; name the models in models")
+			return
+		}
+		models, fields, verr := parseBatch(r.Header.Get("Content-Type"), body)
+		if verr != nil {
+			writeError(w, verr.Status, verr.Code, verr.Message)
+			return
+		}
+
+		results := make([]BatchResult, len(models))
+		sem := make(chan struct{}, batchConcurrency)
+		var wg sync.WaitGroup
+		for i, model := range models {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				results[i] = rt.batchItem(chat, r, model, fields)
+			}()
+		}
+		wg.Wait()
+
+		// The batch's own log line counts every model's tokens.
+		var tokens, prompt, completion int64
+		for _, res := range results {
+			tokens += res.info.Tokens()
+			p, c := res.info.TokenCounts()
+			prompt, completion = prompt+p, completion+c
+		}
+		info := middleware.RequestInfoFrom(r.Context())
+		info.SetTokens(tokens)
+		info.SetTokenCounts(prompt, completion)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BatchResponse{Object: "batch", Results: results})
+	}
+}
+
+// parseBatch checks a batch request and returns its models and the rest of
+// its fields, the body of each model's request but for model. The request
+// is validated as a chat completion for its first model, so errors shared
+// by every model are reported once.
+func parseBatch(contentType string, body []byte) ([]string, map[string]json.RawMessage, *ValidationError) {
+	if !isJSONMediaType(contentType) {
+		return nil, nil, invalid("unsupported_content_type", "content type must be application/json")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, nil, invalid("invalid_json", "request body must be a valid JSON object")
+	}
+	var models []string
+	if err := json.Unmarshal(fields["models"], &models); err != nil || len(models) == 0 {
+		return nil, nil, invalid("missing_models", "models must be a non-empty array of model names")
+	}
+	if len(models) > maxBatchModels {
+		return nil, nil, invalid("too_many_models", fmt.Sprintf("a batch may name at most %d models", maxBatchModels))
+	}
+	for i, m := range models {
+		if strings.TrimSpace(m) == "" {
+			return nil, nil, invalid("missing_models", "model names must not be empty")
+		}
+		if slices.Contains(models[:i], m) {
+			return nil, nil, invalid("duplicate_model", fmt.Sprintf("model %q is named more than once", m))
+		}
+	}
+	if _, ok := fields["model"]; ok {
+		return nil, nil, invalid("invalid_request", "a batch names its models in models, not model")
+	}
+	var stream bool
+	if json.Unmarshal(fields["stream"], &stream) == nil && stream {
+		return nil, nil, invalid("stream_not_supported", "batch requests cannot stream")
+	}
+	delete(fields, "models")
+	first, err := batchItemBody(fields, models[0])
+	if err != nil {
+		return nil, nil, invalid("invalid_json", "request body must be a valid JSON object")
+	}
+	if _, verr := ValidateRouteRequest(contentType, first); verr != nil {
+		return nil, nil, verr
+	}
+	return models, fields, nil
+}
+
+// batchItemBody is the chat completion request for model of a batch.
+func batchItemBody(fields map[string]json.RawMessage, model string) ([]byte, error) {
+	item := make(map[string]json.RawMessage, len(fields)+1)
+	for k, v := range fields {
+		item[k] = v
+	}
+	name, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	item["model"] = name
+	return json.Marshal(item)
+}
+
+// batchItem sends the batch r's request for model through chat, as a
+// request of its own from the same caller.
+func (rt *Router) batchItem(chat http.Handler, r *http.Request, model string, fields map[string]json.RawMessage) BatchResult {
+	body, err := batchItemBody(fields, model)
+	if err != nil {
+		return BatchResult{Model: model, Status: http.StatusBadRequest, Error: &apierror.Detail{Message: "could not encode the request", Type: "invalid_request_error", Code: apierror.CodeInvalidRequest}}
+	}
+	sub, info := middleware.Derive(r)
+	sub = sub.Clone(sub.Context())
+	sub.URL.Path = chatCompletionsPath
+	sub.Body = io.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	sub.Header.Del("Content-Length")
+	// Each model would otherwise claim the batch's key, and all but the
+	// first be turned away as conflicting retries.
+	sub.Header.Del("Idempotency-Key")
+
+	rec := &bufferedResponse{header: make(http.Header)}
+	chat.ServeHTTP(rec, sub)
+	res := BatchResult{Model: model, Status: rec.status, ServedBy: rec.header.Get("X-Aspendos-Served-By"), info: info}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	if res.Status == http.StatusOK && json.Valid(rec.body.Bytes()) {
+		res.Response = json.RawMessage(rec.body.Bytes())
+		return res
+	}
+	var envelope apierror.Response
+	if json.Unmarshal(rec.body.Bytes(), &envelope) == nil && envelope.Error.Code != "" {
+		res.Error = &envelope.Error
+		return res
+	}
+	res.Error = &apierror.Detail{
+		Message: apierror.Redact(rec.body.String()),
+		Type:    "api_error",
+		Code:    apierror.CodeInternal,
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aspendos/model-router/cmd/benchmark"
+	"github.com/aspendos/model-router/metrics"
+)
+
+// benchmarkProvider is the provider label of the benchmark's requests in
+// the router's metrics.
+const benchmarkProvider = "benchmark"
+
+// runBenchmark implements "model-router benchmark": a load test of one
+// backend, to size it before it joins a pool. Its requests go through a
+// circuit breaker and the router's upstream client and metrics, served on
+// -metrics-addr while it runs, so the test shows in Prometheus like
+// production traffic and a failing backend is backed off from rather
+// than hammered.
+func runBenchmark(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("benchmark", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	target := fs.String("url", "", "backend URL to POST to; a URL without a path gets "+chatCompletionsPath)
+	model := fs.String("model", "", "model to set in the payload")
+	payloadFile := fs.String("payload-file", "", "JSON request body to send (default a short chat completion)")
+	concurrency := fs.Int("concurrency", 8, "requests in flight at once")
+	duration := fs.Duration("duration", 30*time.Second, "how long to measure for, after the warm-up")
+	warmUp := fs.Int("warm-up-seconds", 0, "seconds to send requests for before measuring")
+	output := fs.String("output", "text", "report format: text or json")
+	metricsAddr := fs.String("metrics-addr", ":9091", `address to serve /metrics on while the test runs, "" for none`)
+	failures := fs.Int("breaker-failures", DefaultBreakerConfig().FailureThreshold, "consecutive failures that open the circuit breaker")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || fs.NArg() > 0 || (*output != "text" && *output != "json") || *warmUp < 0 || *failures <= 0 {
+		fmt.Fprintln(stderr, "usage: model-router benchmark -url http://backend:8000 [-model name] [-payload-file body.json] [-concurrency 8] [-duration 30s] [-warm-up-seconds 0] [-output text|json]")
+		return 2
+	}
+	u, err := url.Parse(*target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(stderr, "benchmark: -url must be an http or https URL, got %q\n", *target)
+		return 2
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = chatCompletionsPath
+	}
+	var payload []byte
+	if *payloadFile != "" {
+		if payload, err = os.ReadFile(*payloadFile); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	m := metrics.New()
+	name := benchmarkProvider + "/" + u.Host
+	breaker := NewCircuitBreaker(name, BreakerConfig{FailureThreshold: *failures, Cooldown: DefaultBreakerConfig().Cooldown},
+		func(name string, _, to BreakerState) { m.BreakerState(name, int(to)) })
+	m.BreakerState(name, int(Closed))
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			fmt.Fprintf(stderr, "benchmark: serve metrics: %v\n", err)
+			return 1
+		}
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", m.Handler())
+		srv := &http.Server{Handler: mux}
+		go srv.Serve(ln)
+		defer srv.Close()
+		fmt.Fprintf(stderr, "serving metrics on %s/metrics\n", ln.Addr())
+	}
+
+	b := &benchmark.Benchmark{
+		URL:         u.String(),
+		Model:       *model,
+		Payload:     payload,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		WarmUp:      time.Duration(*warmUp) * time.Second,
+		Client:      NewUpstreamClient(benchmarkProvider, TransportConfig{}, m),
+		Allow:       breaker.Acquire,
+		Observe: func(status int, latency time.Duration, err error) {
+			m.UpstreamRequest(benchmarkProvider, *model, status, latency)
+			if err != nil || status >= 500 {
+				breaker.Failure()
+				return
+			}
+			breaker.Success()
+		},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	report, err := b.Run(ctx)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if *output == "json" {
+		err = json.NewEncoder(stdout).Encode(report)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
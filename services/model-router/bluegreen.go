@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	slotBlue  = "blue"
+	slotGreen = "green"
+)
+
+// blueGreenSlot is one of the two deployments of a blue-green model.
+type blueGreenSlot struct {
+	Name string
+	Pool *BackendPool
+}
+
+// closeIdle drops the idle connections of the slot's backends that have
+// clients of their own; the router's shared client is left alone.
+func (s *blueGreenSlot) closeIdle() {
+	for _, b := range s.Pool.Backends() {
+		if b.Provider.Client != nil {
+			b.Provider.Client.CloseIdleConnections()
+		}
+	}
+}
+
+// BlueGreenController sends all of a model's traffic to one of two pools
+// and cuts over between them atomically: a request that picked a backend
+// before the switch finishes there, every later one goes to the new slot.
+// The previous slot stays open for the drain timeout and is then shut
+// down, which only closes its idle connections, so switching back is
+// always instant.
+type BlueGreenController struct {
+	model  string
+	cfg    BlueGreenConfig
+	blue   *blueGreenSlot
+	green  *blueGreenSlot
+	active atomic.Pointer[blueGreenSlot]
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	switchedAt time.Time
+	draining   *blueGreenSlot
+	drainUntil time.Time
+	drainTimer *time.Timer
+	// watchUntil is the end of the rollback window of the last cutover;
+	// requests and failures count the active slot's outcomes until then.
+	watchUntil time.Time
+	requests   int
+	failures   int
+}
+
+func newBlueGreenController(model string, cfg BlueGreenConfig, blue, green *BackendPool, logger *slog.Logger) *BlueGreenController {
+	c := &BlueGreenController{
+		model:  model,
+		cfg:    cfg,
+		blue:   &blueGreenSlot{Name: slotBlue, Pool: blue},
+		green:  &blueGreenSlot{Name: slotGreen, Pool: green},
+		logger: logger,
+	}
+	if cfg.Active == slotGreen {
+		c.active.Store(c.green)
+	} else {
+		c.active.Store(c.blue)
+	}
+	return c
+}
+
+// Active returns the slot taking new requests.
+func (c *BlueGreenController) Active() *blueGreenSlot {
+	return c.active.Load()
+}
+
+// Slot returns the slot called name.
+func (c *BlueGreenController) Slot(name string) (*blueGreenSlot, bool) {
+	switch name {
+	case slotBlue:
+		return c.blue, true
+	case slotGreen:
+		return c.green, true
+	}
+	return nil, false
+}
+
+func (c *BlueGreenController) other(s *blueGreenSlot) *blueGreenSlot {
+	if s == c.blue {
+		return c.green
+	}
+	return c.blue
+}
+
+// Pools returns the pools of both slots, blue first.
+func (c *BlueGreenController) Pools() []*BackendPool {
+	return []*BackendPool{c.blue.Pool, c.green.Pool}
+}
+
+// Switch makes the slot called name the active one and starts draining
+// the other. It reports false if there is no such slot; switching to the
+// active slot changes nothing.
+func (c *BlueGreenController) Switch(name string) bool {
+	next, ok := c.Slot(name)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.switchLocked(next, true)
+	return true
+}
+
+// switchLocked cuts over to next. watch arms the automatic rollback, which
+// a rollback itself does not.
+func (c *BlueGreenController) switchLocked(next *blueGreenSlot, watch bool) {
+	prev := c.active.Load()
+	if prev == next {
+		return
+	}
+	c.active.Store(next)
+	now := time.Now()
+	c.switchedAt = now
+	c.requests, c.failures = 0, 0
+	c.watchUntil = time.Time{}
+	if watch && c.cfg.RollbackErrorRate > 0 {
+		c.watchUntil = now.Add(c.cfg.rollbackWindow())
+	}
+	if c.drainTimer != nil {
+		c.drainTimer.Stop()
+	}
+	timeout := c.cfg.drainTimeout()
+	c.draining, c.drainUntil = prev, now.Add(timeout)
+	c.drainTimer = time.AfterFunc(timeout, func() { c.finishDrain(prev) })
+}
+
+func (c *BlueGreenController) finishDrain(slot *blueGreenSlot) {
+	c.mu.Lock()
+	if c.draining != slot {
+		c.mu.Unlock()
+		return
+	}
+	c.draining, c.drainUntil = nil, time.Time{}
+	c.mu.Unlock()
+	slot.closeIdle()
+	c.logger.Info("blue-green slot drained", slog.String("model", c.model), slog.String("slot", slot.Name))
+}
+
+// Observe feeds the outcome of a request for slot into the automatic
+// rollback. A request turned away because every backend of the slot is
+// unavailable, breakers open included, counts as a failure.
+func (c *BlueGreenController) Observe(slot *blueGreenSlot, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot != c.active.Load() || c.watchUntil.IsZero() {
+		return
+	}
+	if time.Now().After(c.watchUntil) {
+		c.watchUntil = time.Time{}
+		return
+	}
+	c.requests++
+	if failed {
+		c.failures++
+	}
+	if c.requests < c.cfg.rollbackMinRequests() || float64(c.failures)/float64(c.requests) <= c.cfg.RollbackErrorRate {
+		return
+	}
+	back := c.other(slot)
+	c.logger.Warn("blue-green cutover rolled back",
+		slog.String("model", c.model),
+		slog.String("from", slot.Name),
+		slog.String("to", back.Name),
+		slog.Int("failures", c.failures),
+		slog.Int("requests", c.requests))
+	c.switchLocked(back, false)
+}
+
+// carryOver keeps the active slot of prev, the controller of the same
+// model in the table being replaced, unless the config now names a
+// different initial slot than it did.
+func (c *BlueGreenController) carryOver(prev *BlueGreenController) {
+	if prev.cfg.Active != c.cfg.Active {
+		return
+	}
+	if s, _ := c.Slot(prev.Active().Name); s != nil {
+		c.active.Store(s)
+	}
+}
+
+// BlueGreenStatus is a controller's state for the admin API.
+type BlueGreenStatus struct {
+	Active        string
+	SwitchedAt    time.Time
+	Draining      string
+	DrainUntil    time.Time
+	RollbackUntil time.Time
+}
+
+func (c *BlueGreenController) Status() BlueGreenStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := BlueGreenStatus{Active: c.active.Load().Name, SwitchedAt: c.switchedAt, DrainUntil: c.drainUntil}
+	if c.draining != nil {
+		st.Draining = c.draining.Name
+	}
+	if time.Now().Before(c.watchUntil) {
+		st.RollbackUntil = c.watchUntil
+	}
+	return st
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	Closed BreakerState = iota
+	HalfOpen
+	Open
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold"`
+	Cooldown         Duration `json:"cooldown"`
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{FailureThreshold: 5, Cooldown: Duration(30 * time.Second)}
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive failures, rejects
+// traffic for Cooldown, then lets a single half-open probe through: success
+// closes it, failure re-opens it for another cooldown. The move to
+// half-open happens lazily, on the first check after the cooldown.
+type CircuitBreaker struct {
+	name     string
+	cfg      BreakerConfig
+	onChange BreakerObserver
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerObserver is told about every state transition. It runs with the
+// breaker's lock held and must not call back into the breaker.
+type BreakerObserver func(name string, from, to BreakerState)
+
+// NewCircuitBreaker creates a closed breaker; onChange may be nil.
+func NewCircuitBreaker(name string, cfg BreakerConfig, onChange BreakerObserver) *CircuitBreaker {
+	return &CircuitBreaker{name: name, cfg: cfg, onChange: onChange}
+}
+
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+func (cb *CircuitBreaker) transition(to BreakerState) {
+	from := cb.state
+	cb.state = to
+	if from != to && cb.onChange != nil {
+		cb.onChange(cb.name, from, to)
+	}
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	return cb.state
+}
+
+// advance moves an open breaker to half-open once its cooldown has elapsed.
+func (cb *CircuitBreaker) advance() {
+	if cb.state == Open && time.Since(cb.openedAt) >= time.Duration(cb.cfg.Cooldown) {
+		cb.transition(HalfOpen)
+		cb.probing = false
+	}
+}
+
+// Ready reports whether a request could be sent now without consuming the
+// half-open probe slot.
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	return cb.state == Closed || (cb.state == HalfOpen && !cb.probing)
+}
+
+// Acquire claims permission to send; in half-open it takes the single probe slot.
+func (cb *CircuitBreaker) Acquire() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	switch cb.state {
+	case Closed:
+		return true
+	case HalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.transition(Closed)
+	cb.failures = 0
+	cb.probing = false
+}
+
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.state == HalfOpen || cb.failures >= cb.cfg.FailureThreshold {
+		cb.transition(Open)
+		cb.openedAt = time.Now()
+		cb.probing = false
+	}
+}
+
+// Cancel releases a half-open probe whose outcome says nothing about the
+// backend, such as a request the client abandoned.
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	cb.probing = false
+	cb.mu.Unlock()
+}
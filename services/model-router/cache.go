@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// CachedResponse is a stored upstream answer. UpstreamLatency is how long
+// the request that produced it took, so hits can still report it.
+type CachedResponse struct {
+	Status          int           `json:"status"`
+	Header          http.Header   `json:"header"`
+	Body            []byte        `json:"body"`
+	UpstreamLatency time.Duration `json:"upstream_latency"`
+}
+
+// ResponseCache stores responses by key. Implementations must be safe for
+// concurrent use; a failing backend should behave like a miss.
+type ResponseCache interface {
+	Get(ctx context.Context, key string) (*CachedResponse, bool)
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration)
+}
+
+const (
+	defaultCacheEntries = 10000
+	defaultCacheBytes   = 64 << 20
+)
+
+// NewResponseCache builds the cache selected by cfg (nil means the default
+// in-memory LRU).
+func NewResponseCache(cfg *CacheConfig, logger *slog.Logger) (ResponseCache, error) {
+	if cfg == nil {
+		cfg = &CacheConfig{}
+	}
+	switch cfg.Backend {
+	case "redis":
+		return NewRedisCache(cfg.redisURL(), logger)
+	default:
+		entries, size := cfg.MaxEntries, cfg.MaxBytes
+		if entries == 0 {
+			entries = defaultCacheEntries
+		}
+		if size == 0 {
+			size = defaultCacheBytes
+		}
+		return NewMemoryCache(entries, size)
+	}
+}
+
+// cacheKey is sha256(model + "::" + body), hex encoded, over the
+// normalized body so that key order and whitespace do not split entries.
+func cacheKey(model string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(model + "::"))
+	h.Write(normalizeJSON(body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeJSON re-encodes body with sorted object keys and no
+// insignificant whitespace. Numbers keep their literal form.
+func normalizeJSON(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// cacheable reports whether a request may be answered from the cache:
+// never for streams, and for sampled requests (temperature > 0) only when
+// the model opts in with cache_sampled.
+func cacheable(bc BackendConfig, body []byte) bool {
+	var req struct {
+		Stream      bool     `json:"stream"`
+		Temperature *float64 `json:"temperature"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.Stream {
+		return false
+	}
+	return bc.CacheSampled || req.Temperature == nil || *req.Temperature <= 0
+}
+
+// noCache reports whether the client asked for a fresh response with
+// Cache-Control: no-cache.
+func noCache(h http.Header) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CachingRouter answers repeated identical requests for models with
+// cache_enabled from a ResponseCache. Streamed requests always go upstream.
+// Cached and fresh answers are marked with X-Cache (and the older
+// X-Aspendos-Cache): HIT or MISS.
+type CachingRouter struct {
+	registry *ModelRegistry
+	cache    ResponseCache
+	metrics  *metrics.Metrics
+}
+
+func NewCachingRouter(registry *ModelRegistry, cache ResponseCache, m *metrics.Metrics) *CachingRouter {
+	return &CachingRouter{registry: registry, cache: cache, metrics: m}
+}
+
+var cacheHeaders = []string{"X-Cache", "X-Aspendos-Cache"}
+
+func setCacheHeaders(h http.Header, result string) {
+	for _, name := range cacheHeaders {
+		h.Set(name, result)
+	}
+}
+
+func (c *CachingRouter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMultipart(r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req RouteRequest
+		if json.Unmarshal(body, &req) != nil || req.Model == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry, ok := c.registry.Lookup(req.Model)
+		if !ok || !entry.Config.CacheEnabled || !cacheable(entry.Config, body) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		variant, ok := cacheVariant(entry, r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := middleware.RequestInfoFrom(r.Context())
+		key := cacheKey(req.Model, body)
+		if variant != "" {
+			// A split's variants may be different models or deployments,
+			// and each client must get the answers of its own.
+			key += "\x00" + variant
+		}
+		if tenant := info.Tenant(); tenant != "" {
+			// Tenants call upstream with their own keys and must not
+			// share answers.
+			key = tenant + "\x00" + key
+		}
+		if cached, ok := c.lookup(r, key); ok {
+			c.metrics.CacheHit(req.Model)
+			info.SetCache("hit", cached.UpstreamLatency)
+			if provider, model, ok := strings.Cut(cached.Header.Get("X-Aspendos-Served-By"), "/"); ok {
+				info.SetRoute(model, provider)
+			}
+			for k, v := range cached.Header {
+				w.Header()[k] = v
+			}
+			setCacheHeaders(w.Header(), "HIT")
+			w.WriteHeader(cached.Status)
+			w.Write(cached.Body)
+			return
+		}
+
+		c.metrics.CacheMiss(req.Model)
+		info.SetCache("miss", 0)
+		rec := &bufferedResponse{header: w.Header().Clone(), live: w}
+		setCacheHeaders(rec.header, "MISS")
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		latency := time.Since(start)
+		if rec.streamed {
+			// Sent as it came, and not worth keeping: an event stream
+			// replayed at once is no stream.
+			return
+		}
+		rec.replay(w)
+
+		if rec.status != http.StatusOK || int64(rec.body.Len()) > entry.Config.cacheMaxBytes() {
+			return
+		}
+		header := rec.header.Clone()
+		header.Del(middleware.RequestIDHeader)
+		for _, name := range cacheHeaders {
+			header.Del(name)
+		}
+		c.cache.Set(context.WithoutCancel(r.Context()), key, &CachedResponse{
+			Status:          rec.status,
+			Header:          header,
+			Body:            bytes.Clone(rec.body.Bytes()),
+			UpstreamLatency: latency,
+		}, entry.Config.cacheTTL())
+	})
+}
+
+// cacheVariant is the traffic split variant r will be routed to, which
+// its cache key must include, or "" for an entry without variants. It
+// reports false where the variant cannot be known ahead of routing and the
+// request should go upstream uncached: a split's variant is random for
+// clients without X-Client-ID, and a canary's share and error rate are
+// measured on the requests it actually serves.
+func cacheVariant(entry *ModelEntry, r *http.Request) (string, bool) {
+	switch {
+	case entry.Canary != nil:
+		return "", false
+	case entry.Split != nil:
+		clientID := r.Header.Get(ClientIDHeader)
+		if clientID == "" {
+			return "", false
+		}
+		return entry.Split.Assign(clientID, time.Now()).Name, true
+	}
+	return "", true
+}
+
+// lookup consults the cache unless the client demanded a fresh response;
+// the fresh response still replaces the cached one.
+func (c *CachingRouter) lookup(r *http.Request, key string) (*CachedResponse, bool) {
+	if noCache(r.Header) {
+		return nil, false
+	}
+	return c.cache.Get(r.Context(), key)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// MemoryCache is a per-process LRU of responses, bounded both by entry
+// count and by the total size of the stored bodies. Entries carry their own
+// expiry since TTLs differ per model; expired ones are dropped on read.
+type MemoryCache struct {
+	// mu makes each Set, including the evictions it triggers, atomic with
+	// respect to the byte accounting.
+	mu       sync.Mutex
+	lru      *lru.Cache[string, memoryEntry]
+	bytes    int64
+	maxBytes int64
+}
+
+type memoryEntry struct {
+	resp    *CachedResponse
+	expires time.Time
+}
+
+func NewMemoryCache(maxEntries int, maxBytes int64) (*MemoryCache, error) {
+	m := &MemoryCache{maxBytes: maxBytes}
+	c, err := lru.NewWithEvict(maxEntries, func(_ string, e memoryEntry) {
+		// Runs inside Add or Remove, so mu is already held.
+		m.bytes -= int64(len(e.resp.Body))
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.lru = c
+	return m, nil
+}
+
+func (m *MemoryCache) Get(_ context.Context, key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		m.lru.Remove(key)
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// Set stores resp, evicting least recently used entries until the byte
+// budget holds again. A body larger than the whole budget is not stored.
+func (m *MemoryCache) Set(_ context.Context, key string, resp *CachedResponse, ttl time.Duration) {
+	size := int64(len(resp.Body))
+	if size > m.maxBytes {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.Remove(key)
+	m.lru.Add(key, memoryEntry{resp: resp, expires: time.Now().Add(ttl)})
+	m.bytes += size
+	for m.bytes > m.maxBytes {
+		if _, _, ok := m.lru.RemoveOldest(); !ok {
+			break
+		}
+	}
+}
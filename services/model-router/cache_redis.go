@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisCachePrefix = "model-router:cache:"
+
+// RedisCache shares cached responses between router replicas. Redis
+// expires entries itself; errors are logged and treated as misses so a
+// Redis outage only costs cache hits.
+type RedisCache struct {
+	client *redis.Client
+	logger *slog.Logger
+}
+
+func NewRedisCache(url string, logger *slog.Logger) (*RedisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("cache redis url: %w", err)
+	}
+	return &RedisCache{client: redis.NewClient(opts), logger: logger}, nil
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	data, err := c.client.Get(ctx, redisCachePrefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.logger.Warn("cache read failed", slog.String("error", err.Error()))
+		}
+		return nil, false
+	}
+	var resp CachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		c.logger.Warn("cache entry unreadable", slog.String("error", err.Error()))
+		return nil, false
+	}
+	return &resp, true
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	if err := c.client.Set(ctx, redisCachePrefix+key, data, ttl).Err(); err != nil {
+		c.logger.Warn("cache write failed", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingBackend answers each request with a new id naming the backend,
+// and counts them.
+type countingBackend struct {
+	name  string
+	calls atomic.Int64
+}
+
+func (b *countingBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := b.calls.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":"%s-%d"}`, b.name, n)
+}
+
+func newCountingBackend(t *testing.T, name string) (*countingBackend, string) {
+	t.Helper()
+	b := &countingBackend{name: name}
+	srv := httptest.NewServer(b)
+	t.Cleanup(srv.Close)
+	return b, srv.URL
+}
+
+// cachedCall sends body through h with header, and returns the response's
+// id and X-Cache.
+func cachedCall(t *testing.T, h http.Handler, body string, header map[string]string) (id, cache string) {
+	t.Helper()
+	req := chatRequest(body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp.ID, rec.Header().Get("X-Cache")
+}
+
+// A repeat of a cached request is answered without reaching the backend,
+// however its JSON is laid out, unless it is one the cache does not keep.
+func TestCacheServesRepeats(t *testing.T) {
+	const body = `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name   string
+		repeat string
+		header map[string]string
+		hit    bool
+	}{
+		{name: "identical", repeat: body, hit: true},
+		{name: "reordered and spaced", repeat: `{ "messages": [{"content": "hi", "role": "user"}], "model": "m" }`, hit: true},
+		{name: "other prompt", repeat: `{"model":"m","messages":[{"role":"user","content":"bye"}]}`},
+		{name: "sampled", repeat: `{"model":"m","messages":[{"role":"user","content":"hi"}],"temperature":0.7}`},
+		{name: "no-cache", repeat: body, header: map[string]string{"Cache-Control": "no-cache"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, url := newCountingBackend(t, "a")
+			rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a, cache_enabled: true}
+`, url)))
+			h := routeChain(t, rt)
+			first, cache := cachedCall(t, h, body, nil)
+			if cache != "MISS" {
+				t.Fatalf("first X-Cache = %q, want MISS", cache)
+			}
+			second, cache := cachedCall(t, h, tt.repeat, tt.header)
+			if calls := backend.calls.Load(); tt.hit && (calls != 1 || second != first || cache != "HIT") {
+				t.Errorf("repeat = %s, X-Cache %q, after %d backend calls: want %s from the cache", second, cache, calls, first)
+			} else if !tt.hit && (calls != 2 || second == first) {
+				t.Errorf("repeat = %s after %d backend calls: want a fresh answer", second, calls)
+			}
+		})
+	}
+}
+
+// Clients in different variants of a traffic split never get each other's
+// cached answers, a client without X-Client-ID is not cached, and neither
+// is a canary.
+func TestCacheVariants(t *testing.T) {
+	control, controlURL := newCountingBackend(t, "control")
+	candidate, candidateURL := newCountingBackend(t, "candidate")
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+  b: {base_url: %s}
+models:
+  split:
+    cache_enabled: true
+    traffic_split:
+      experiment: e1
+      variants:
+        - {name: control, percent: 50, provider: a}
+        - {name: candidate, percent: 50, provider: b}
+  canaried:
+    cache_enabled: true
+    canary:
+      stable: {provider: a}
+      canary: {provider: b}
+      initial_canary_weight: 50
+`, controlURL, candidateURL)))
+	h := routeChain(t, rt)
+
+	// A client of each variant.
+	split := rt.registry.LookupAll("split")[0].Split
+	clients := map[string]string{}
+	for i := 0; len(clients) < 2; i++ {
+		id := fmt.Sprintf("client-%d", i)
+		if v := split.Assign(id, time.Now()); clients[v.Name] == "" {
+			clients[v.Name] = id
+		}
+	}
+	const body = `{"model":"split","messages":[{"role":"user","content":"hi"}]}`
+	as := func(client string) map[string]string { return map[string]string{ClientIDHeader: client} }
+
+	first, _ := cachedCall(t, h, body, as(clients["control"]))
+	second, cache := cachedCall(t, h, body, as(clients["candidate"]))
+	if second != "candidate-1" || cache != "MISS" {
+		t.Errorf("candidate client got %s, X-Cache %q: want the candidate's own answer", second, cache)
+	}
+	if again, cache := cachedCall(t, h, body, as(clients["control"])); again != first || cache != "HIT" {
+		t.Errorf("control client again got %s, X-Cache %q: want its cached %s", again, cache, first)
+	}
+	calls := control.calls.Load() + candidate.calls.Load()
+	cachedCall(t, h, body, nil)
+	cachedCall(t, h, body, nil)
+	if got := control.calls.Load() + candidate.calls.Load() - calls; got != 2 {
+		t.Errorf("clients without an ID made %d backend calls, want 2", got)
+	}
+
+	calls = control.calls.Load() + candidate.calls.Load()
+	for range 3 {
+		if _, cache := cachedCall(t, h, `{"model":"canaried","messages":[{"role":"user","content":"hi"}]}`, nil); cache != "" {
+			t.Errorf("canary X-Cache = %q, want none", cache)
+		}
+	}
+	if got := control.calls.Load() + candidate.calls.Load() - calls; got != 3 {
+		t.Errorf("canary made %d backend calls, want 3", got)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// CanaryHeader tells the client whether a model with a canary served the
+// request from it ("true") or from the stable deployment ("false").
+const CanaryHeader = "X-Aspendos-Canary"
+
+const (
+	canaryStable = "stable"
+	canaryArm    = "canary"
+
+	defaultCanaryTargetWeight  = 100
+	defaultCanaryStep          = 10
+	defaultCanaryStepInterval  = 5 * time.Minute
+	defaultCanaryMaxErrorRate  = 1.0
+	defaultCanaryMinRequests   = 10
+	canaryWebhookTimeout       = 10 * time.Second
+	canaryStateFilePermissions = 0o644
+)
+
+// CanaryConfig names the stable and canary deployments of a model. The
+// canary starts with InitialCanaryWeight percent of requests and gains
+// StepPercent (default 10) every StepIntervalSeconds (default 300) until
+// it reaches TargetCanaryWeight (default 100), as long as fewer than
+// MaxErrorRatePercent (default 1) of its upstream attempts in the
+// interval failed, with no response or a 5xx. An interval with fewer than
+// MinRequests (default 10) attempts carries over into the next one. Once
+// the error rate is too high the weight freezes where it is and
+// WebhookURL, if set, is notified; it stays frozen until the canary's
+// configuration changes. StateFile keeps the weight across restarts.
+// Setting the weight through the admin API holds it there instead, until
+// the admin API sets it again or the configuration changes.
+//
+// Requests for the canary are sent as CanaryModel, when set, such as a
+// fine-tuned variant's name. StickyKey "api_key" or "session" makes the
+// weight a share of callers rather than of requests: each API key, or each
+// session as named by X-Aspendos-Session or the body's conversation_id,
+// hashes to a fixed bucket and keeps getting the same deployment, and a
+// growing weight only moves callers from stable to canary. Requests
+// without that key are assigned at random.
+//
+// The error rate comes from model_router_upstream_requests_total, so the
+// canary must not share a provider or URL with the stable deployment.
+type CanaryConfig struct {
+	Stable              BackendConfig `json:"stable"`
+	Canary              BackendConfig `json:"canary"`
+	InitialCanaryWeight int           `json:"initial_canary_weight"`
+	TargetCanaryWeight  int           `json:"target_canary_weight,omitempty"`
+	StepPercent         int           `json:"step_percent,omitempty"`
+	StepIntervalSeconds float64       `json:"step_interval_seconds,omitempty"`
+	MaxErrorRatePercent float64       `json:"max_error_rate_percent,omitempty"`
+	MinRequests         int           `json:"min_requests,omitempty"`
+	WebhookURL          string        `json:"webhook_url,omitempty"`
+	StateFile           string        `json:"state_file,omitempty"`
+	CanaryModel         string        `json:"canary_model,omitempty"`
+	StickyKey           string        `json:"sticky_key,omitempty"`
+}
+
+func (cc CanaryConfig) targetWeight() int {
+	if cc.TargetCanaryWeight > 0 {
+		return cc.TargetCanaryWeight
+	}
+	return defaultCanaryTargetWeight
+}
+
+func (cc CanaryConfig) step() int {
+	if cc.StepPercent > 0 {
+		return cc.StepPercent
+	}
+	return defaultCanaryStep
+}
+
+func (cc CanaryConfig) stepInterval() time.Duration {
+	if cc.StepIntervalSeconds > 0 {
+		return time.Duration(cc.StepIntervalSeconds * float64(time.Second))
+	}
+	return defaultCanaryStepInterval
+}
+
+func (cc CanaryConfig) maxErrorRate() float64 {
+	if cc.MaxErrorRatePercent > 0 {
+		return cc.MaxErrorRatePercent
+	}
+	return defaultCanaryMaxErrorRate
+}
+
+func (cc CanaryConfig) minRequests() int {
+	if cc.MinRequests > 0 {
+		return cc.MinRequests
+	}
+	return defaultCanaryMinRequests
+}
+
+func validateCanary(cfg *Config, cc CanaryConfig) error {
+	if cc.InitialCanaryWeight < 1 || cc.InitialCanaryWeight > cc.targetWeight() || cc.targetWeight() > 100 {
+		return fmt.Errorf("canary: want 1 <= initial_canary_weight <= target_canary_weight <= 100")
+	}
+	if cc.StepPercent < 0 || cc.StepIntervalSeconds < 0 || cc.MinRequests < 0 {
+		return fmt.Errorf("canary: step_percent, step_interval_seconds and min_requests must not be negative")
+	}
+	if cc.MaxErrorRatePercent < 0 || cc.MaxErrorRatePercent > 100 {
+		return fmt.Errorf("canary.max_error_rate_percent must be between 0 and 100")
+	}
+	switch cc.StickyKey {
+	case "", "api_key", "session":
+	default:
+		return fmt.Errorf("canary.sticky_key: unknown key %q (want api_key or session)", cc.StickyKey)
+	}
+	if cc.WebhookURL != "" {
+		if err := validateURL(cc.WebhookURL); err != nil {
+			return fmt.Errorf("canary.webhook_url: %w", err)
+		}
+	}
+	stable := make(map[string]bool)
+	for _, arm := range []struct {
+		name string
+		bc   BackendConfig
+	}{{canaryStable, cc.Stable}, {canaryArm, cc.Canary}} {
+		if arm.bc.TrafficSplit != nil || arm.bc.BlueGreen != nil || arm.bc.Canary != nil {
+			return fmt.Errorf("canary.%s: cannot split or have slots of its own", arm.name)
+		}
+		if err := validateBackend(cfg, arm.bc); err != nil {
+			return fmt.Errorf("canary.%s: %w", arm.name, err)
+		}
+		for _, rc := range arm.bc.replicas() {
+			name := targetName(rc.Provider, rc.URL)
+			if arm.name == canaryStable {
+				stable[name] = true
+			} else if stable[name] {
+				return fmt.Errorf("canary.canary: %s also serves canary.stable, so their error rates cannot be told apart", name)
+			}
+		}
+	}
+	return nil
+}
+
+// targetName is the name tableBuilder.target gives a backend, which its
+// upstream metrics are labelled with.
+func targetName(provider, rawURL string) string {
+	switch {
+	case rawURL == "":
+		return provider
+	case provider == "":
+		return hostOf(rawURL)
+	default:
+		return provider + "@" + hostOf(rawURL)
+	}
+}
+
+// canaryState is what a canary's state file holds. Config fingerprints
+// the canary's configuration, so a changed canary starts over.
+type canaryState struct {
+	Model     string     `json:"model"`
+	Config    string     `json:"config"`
+	Weight    int        `json:"weight"`
+	Frozen    bool       `json:"frozen,omitempty"`
+	Manual    bool       `json:"manual,omitempty"`
+	LastStep  *time.Time `json:"last_step,omitempty"`
+	ErrorRate float64    `json:"error_rate_percent"`
+}
+
+// CanaryController shifts a model's traffic from its stable deployment to
+// its canary one step at a time, judging each step by the canary's
+// upstream error rate since the last. The table built on a reload gets a
+// new controller for the same canary, which takes over the previous
+// one's weight and stops it.
+type CanaryController struct {
+	model       string
+	cfg         CanaryConfig
+	fingerprint string
+	stable      *Variant
+	canary      *Variant
+	weight      atomic.Int32
+	logger      *slog.Logger
+	metrics     *metrics.Metrics
+
+	mu        sync.Mutex
+	frozen    bool
+	manual    bool
+	lastStep  time.Time
+	errorRate float64
+	// baseRequests and baseFailures are the canary's counter totals at the
+	// start of the current interval.
+	baseRequests float64
+	baseFailures float64
+	providers    map[string]bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	// done is closed when the background stepping ends; it is nil until
+	// start.
+	done chan struct{}
+}
+
+func newCanaryController(model string, cfg CanaryConfig, stable, canary *BackendPool, logger *slog.Logger) *CanaryController {
+	raw, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(raw)
+	c := &CanaryController{
+		model:       model,
+		cfg:         cfg,
+		fingerprint: hex.EncodeToString(sum[:6]),
+		stable:      &Variant{Name: canaryStable, Pool: stable},
+		canary:      &Variant{Name: canaryArm, Model: cfg.CanaryModel, Pool: canary},
+		logger:      logger,
+		providers:   make(map[string]bool),
+		stop:        make(chan struct{}),
+	}
+	for _, b := range canary.Backends() {
+		c.providers[b.Provider.Name] = true
+	}
+	c.weight.Store(int32(cfg.InitialCanaryWeight))
+	return c
+}
+
+// Pick returns the canary for the current weight's share of requests, or
+// of callers with a sticky key, and the stable deployment for the rest.
+func (c *CanaryController) Pick(hint RouteHint) *Variant {
+	bucket := rand.IntN(100)
+	var key string
+	switch c.cfg.StickyKey {
+	case "api_key":
+		key = hint.APIKey
+	case "session":
+		key = hint.Session
+	}
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(c.model))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		bucket = int(h.Sum32() % 100)
+	}
+	if bucket < int(c.weight.Load()) {
+		return c.canary
+	}
+	return c.stable
+}
+
+// IsCanary reports whether v is the canary deployment.
+func (c *CanaryController) IsCanary(v *Variant) bool {
+	return v == c.canary
+}
+
+// SetWeight sets the canary's share to weight percent and holds it there.
+func (c *CanaryController) SetWeight(weight int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from := int(c.weight.Load())
+	c.weight.Store(int32(weight))
+	c.manual = true
+	c.lastStep = time.Now()
+	c.persist()
+	c.logger.Info("canary weight set", slog.String("model", c.model), slog.Int("from", from), slog.Int("to", weight))
+}
+
+// Pools returns the stable pool, then the canary's.
+func (c *CanaryController) Pools() []*BackendPool {
+	return []*BackendPool{c.stable.Pool, c.canary.Pool}
+}
+
+// start resumes from prev, the controller of the same model in the table
+// being replaced, if it runs the same canary, or else from the state
+// file, and then steps the weight in the background until Stop.
+func (c *CanaryController) start(prev *CanaryController, m *metrics.Metrics) {
+	c.metrics = m
+	if prev != nil {
+		prev.Stop()
+	}
+	switch {
+	case prev != nil && prev.fingerprint == c.fingerprint:
+		prev.mu.Lock()
+		c.weight.Store(prev.weight.Load())
+		c.frozen, c.manual, c.lastStep, c.errorRate = prev.frozen, prev.manual, prev.lastStep, prev.errorRate
+		c.baseRequests, c.baseFailures = prev.baseRequests, prev.baseFailures
+		prev.mu.Unlock()
+	case c.resume():
+		c.baseRequests, c.baseFailures = m.UpstreamTotals(c.counts)
+	default:
+		c.baseRequests, c.baseFailures = m.UpstreamTotals(c.counts)
+		c.persist()
+	}
+	c.done = make(chan struct{})
+	go c.run()
+}
+
+// resume loads the state file, reporting whether it held this canary.
+func (c *CanaryController) resume() bool {
+	if c.cfg.StateFile == "" {
+		return false
+	}
+	raw, err := os.ReadFile(c.cfg.StateFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			c.logger.Warn("failed to read canary state", slog.String("model", c.model), slog.String("error", err.Error()))
+		}
+		return false
+	}
+	var st canaryState
+	if err := json.Unmarshal(raw, &st); err != nil || st.Model != c.model || st.Config != c.fingerprint {
+		return false
+	}
+	if st.Manual {
+		c.weight.Store(int32(min(max(st.Weight, 0), 100)))
+	} else {
+		c.weight.Store(int32(min(max(st.Weight, c.cfg.InitialCanaryWeight), c.cfg.targetWeight())))
+	}
+	c.frozen, c.manual, c.errorRate = st.Frozen, st.Manual, st.ErrorRate
+	if st.LastStep != nil {
+		c.lastStep = *st.LastStep
+	}
+	c.logger.Info("canary resumed", slog.String("model", c.model), slog.Int("weight", int(c.weight.Load())), slog.Bool("frozen", c.frozen))
+	return true
+}
+
+// persist writes the state file, if any, replacing it atomically.
+func (c *CanaryController) persist() {
+	if c.cfg.StateFile == "" {
+		return
+	}
+	st := canaryState{Model: c.model, Config: c.fingerprint, Weight: int(c.weight.Load()), Frozen: c.frozen, Manual: c.manual, ErrorRate: c.errorRate}
+	if !c.lastStep.IsZero() {
+		st.LastStep = &c.lastStep
+	}
+	raw, _ := json.MarshalIndent(st, "", "  ")
+	tmp, err := os.CreateTemp(filepath.Dir(c.cfg.StateFile), ".canary-*")
+	if err == nil {
+		_, err = tmp.Write(append(raw, '\n'))
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			os.Chmod(tmp.Name(), canaryStateFilePermissions)
+			err = os.Rename(tmp.Name(), c.cfg.StateFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		c.logger.Warn("failed to save canary state", slog.String("model", c.model), slog.String("error", err.Error()))
+	}
+}
+
+// Stop ends the background stepping and waits for it to finish; it is
+// safe to call more than once.
+func (c *CanaryController) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	if c.done != nil {
+		<-c.done
+	}
+}
+
+func (c *CanaryController) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cfg.stepInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.evaluate()
+		}
+	}
+}
+
+// counts selects the upstream attempts of the canary's backends for this
+// model.
+func (c *CanaryController) counts(provider, model string) bool {
+	return c.providers[provider] && matchGlob(c.model, model)
+}
+
+// evaluate judges the interval just ended and steps or freezes the weight.
+func (c *CanaryController) evaluate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	weight := int(c.weight.Load())
+	if c.frozen || c.manual || weight >= c.cfg.targetWeight() {
+		return
+	}
+	requests, failures := c.metrics.UpstreamTotals(c.counts)
+	if requests < c.baseRequests {
+		// The counters were reset; start the interval over.
+		c.baseRequests, c.baseFailures = requests, failures
+		return
+	}
+	n, failed := requests-c.baseRequests, failures-c.baseFailures
+	if n < float64(c.cfg.minRequests()) {
+		return
+	}
+	c.baseRequests, c.baseFailures = requests, failures
+	c.errorRate = 100 * failed / n
+	if c.errorRate >= c.cfg.maxErrorRate() {
+		c.frozen = true
+		c.persist()
+		c.logger.Warn("canary frozen: error rate too high",
+			slog.String("model", c.model),
+			slog.Int("weight", weight),
+			slog.Float64("error_rate_percent", c.errorRate),
+			slog.Float64("max_error_rate_percent", c.cfg.maxErrorRate()),
+			slog.Int("requests", int(n)))
+		go c.alert(weight, c.errorRate, int(n))
+		return
+	}
+	next := min(weight+c.cfg.step(), c.cfg.targetWeight())
+	c.weight.Store(int32(next))
+	c.lastStep = time.Now()
+	c.persist()
+	c.logger.Info("canary weight increased",
+		slog.String("model", c.model),
+		slog.Int("from", weight),
+		slog.Int("to", next),
+		slog.Float64("error_rate_percent", c.errorRate))
+}
+
+// alert posts the freeze to the webhook, if one is configured.
+func (c *CanaryController) alert(weight int, errorRate float64, requests int) {
+	if c.cfg.WebhookURL == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]any{
+		"event":                  "canary_frozen",
+		"model":                  c.model,
+		"weight":                 weight,
+		"error_rate_percent":     errorRate,
+		"max_error_rate_percent": c.cfg.maxErrorRate(),
+		"requests":               requests,
+		"time":                   time.Now().UTC(),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), canaryWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.WebhookURL, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		var resp *http.Response
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		c.logger.Warn("failed to send canary alert", slog.String("model", c.model), slog.String("error", err.Error()))
+	}
+}
+
+// CanaryStatus is a controller's state for the admin API.
+type CanaryStatus struct {
+	Model               string     `json:"model"`
+	State               string     `json:"state"` // "progressing", "frozen", "manual" or "complete"
+	Weight              int        `json:"weight"`
+	TargetWeight        int        `json:"target_weight"`
+	ErrorRatePercent    float64    `json:"error_rate_percent"`
+	MaxErrorRatePercent float64    `json:"max_error_rate_percent"`
+	LastStep            *time.Time `json:"last_step,omitempty"`
+}
+
+func (c *CanaryController) Status() CanaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := CanaryStatus{
+		Model:               c.model,
+		State:               "progressing",
+		Weight:              int(c.weight.Load()),
+		TargetWeight:        c.cfg.targetWeight(),
+		ErrorRatePercent:    c.errorRate,
+		MaxErrorRatePercent: c.cfg.maxErrorRate(),
+	}
+	switch {
+	case c.frozen:
+		st.State = "frozen"
+	case c.manual:
+		st.State = "manual"
+	case st.Weight >= st.TargetWeight:
+		st.State = "complete"
+	}
+	if !c.lastStep.IsZero() {
+		last := c.lastStep
+		st.LastStep = &last
+	}
+	return st
+}
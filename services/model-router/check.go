@@ -0,0 +1,272 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkMode is the --check flag: off, online (a bare --check), which also
+// probes every provider, or offline.
+type checkMode string
+
+const (
+	checkOff     checkMode = ""
+	checkOnline  checkMode = "online"
+	checkOffline checkMode = "offline"
+)
+
+func (c *checkMode) String() string { return string(*c) }
+
+// IsBoolFlag lets the flag be given bare, as --check.
+func (*checkMode) IsBoolFlag() bool { return true }
+
+func (c *checkMode) Set(v string) error {
+	switch v {
+	case "true", "online":
+		*c = checkOnline
+	case "offline":
+		*c = checkOffline
+	case "false":
+		*c = checkOff
+	default:
+		return fmt.Errorf("want --check or --check=offline, got %q", v)
+	}
+	return nil
+}
+
+// Severities of check findings. Errors fail the check; warnings are worth
+// a look but would not stop the router serving.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Exit codes of --check.
+const (
+	checkPassed   = 0
+	checkFailed   = 1
+	checkWarnings = 3
+)
+
+// CheckReport is what --check prints: every finding, and the state of each
+// provider.
+type CheckReport struct {
+	Config        string          `json:"config"`
+	ConfigVersion string          `json:"config_version,omitempty"`
+	Mode          checkMode       `json:"mode"`
+	OK            bool            `json:"ok"`
+	Errors        int             `json:"errors"`
+	Warnings      int             `json:"warnings"`
+	Findings      []CheckFinding  `json:"findings"`
+	Providers     []ProviderCheck `json:"providers"`
+}
+
+// CheckFinding is one problem found: Check names what found it (config,
+// environment, tls, credentials, rules, providers or connectivity).
+type CheckFinding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Provider string `json:"provider,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ProviderCheck is one provider's state: Status is "ok" or the worst
+// severity of its findings. Reachable is unset when it was not probed.
+type ProviderCheck struct {
+	Name       string  `json:"name"`
+	BaseURL    string  `json:"base_url,omitempty"`
+	Credential string  `json:"credential,omitempty"`
+	Used       bool    `json:"used"`
+	Reachable  *bool   `json:"reachable,omitempty"`
+	LatencyMs  float64 `json:"latency_ms,omitempty"`
+	Status     string  `json:"status"`
+}
+
+func (r *CheckReport) add(severity, check, provider, format string, args ...any) {
+	r.Findings = append(r.Findings, CheckFinding{Severity: severity, Check: check, Provider: provider, Message: fmt.Sprintf(format, args...)})
+	if severity == severityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// runCheck is --check: it loads and validates configPath and the
+// environment as a boot would, without serving, and prints a CheckReport
+// as JSON, for deploy pipelines to gate a rollout on. Unlike a boot, a
+// config that fails to load is an error, not a fall back to the cached
+// one. It returns checkFailed on any error, checkWarnings on warnings
+// alone.
+func runCheck(configPath string, mode checkMode, stdout io.Writer) int {
+	r := &CheckReport{Config: configPath, Mode: mode, Findings: []CheckFinding{}, Providers: []ProviderCheck{}}
+	if r.Config == "" {
+		r.Config = "(default)"
+	}
+	// The boot path's own warnings belong in the report, not on stderr.
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	if _, err := newLogger(io.Discard); err != nil {
+		r.add(severityError, "environment", "", "%v", err)
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		r.add(severityError, "config", "", "%v", err)
+		return r.print(stdout)
+	}
+	r.ConfigVersion = cfg.Version
+	for _, w := range cfg.Warnings {
+		r.add(severityWarning, "config", "", "%s", w)
+	}
+	env, err := loadSettings(cfg)
+	if err != nil {
+		r.add(severityError, "environment", "", "%v", err)
+	} else if env.certFile != "" {
+		if _, err := serverTLSConfig(env.certFile, env.keyFile, env.clientCA, logger); err != nil {
+			r.add(severityError, "tls", "", "%v", err)
+		}
+	}
+	for _, c := range ruleConflicts(cfg) {
+		r.add(severityWarning, "rules", "", "%s", c)
+	}
+	r.checkProviders(cfg, logger)
+	return r.print(stdout)
+}
+
+// checkProviders reports providers missing their credentials or routed to
+// by nothing, and, online, those that do not answer a probe.
+func (r *CheckReport) checkProviders(cfg *Config, logger *slog.Logger) {
+	_, used := cfg.table(nil, logger, nil)
+	providers := cfg.providers()
+	names := sortedKeys(cfg.Providers)
+	checks := make([]ProviderCheck, len(names))
+	for i, name := range names {
+		pc := cfg.Providers[name]
+		checks[i] = ProviderCheck{Name: name, BaseURL: pc.BaseURL, Used: used[name]}
+		switch {
+		case pc.APIKeyFile != "":
+			checks[i].Credential = "api_key_file " + pc.APIKeyFile
+		case pc.APIKeyEnv != "":
+			checks[i].Credential = "api_key_env " + pc.APIKeyEnv
+			if os.Getenv(pc.APIKeyEnv) == "" && pc.APIKey == "" {
+				r.add(severityError, "credentials", name, "api_key_env %s is not set and there is no api_key to fall back to", pc.APIKeyEnv)
+			}
+		case pc.APIKey != "":
+			checks[i].Credential = "api_key"
+		}
+		if !checks[i].Used {
+			r.add(severityWarning, "providers", name, "no model, rule or shadow backend routes to the provider")
+		}
+	}
+	if r.Mode == checkOnline {
+		var wg sync.WaitGroup
+		errs := make([]error, len(names))
+		for i, name := range names {
+			pc := cfg.Providers[name]
+			if pc.Discovery != nil {
+				continue
+			}
+			hc := HealthCheckConfig{}
+			if pc.HealthCheck != nil {
+				hc = *pc.HealthCheck
+			}
+			hc = hc.withDefaults()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				errs[i] = probeGet(context.Background(), &http.Client{}, providers[name], hc.Path, time.Duration(hc.Timeout))
+				reachable := errs[i] == nil
+				checks[i].Reachable = &reachable
+				checks[i].LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+			}()
+		}
+		wg.Wait()
+		for i, name := range names {
+			if errs[i] != nil {
+				r.add(severityError, "connectivity", name, "probe of %s failed: %v", cfg.Providers[name].BaseURL, errs[i])
+			}
+		}
+	}
+	status := make(map[string]string)
+	for _, f := range r.Findings {
+		if f.Provider != "" && status[f.Provider] != severityError {
+			status[f.Provider] = f.Severity
+		}
+	}
+	for i := range checks {
+		checks[i].Status = cmp.Or(status[checks[i].Name], "ok")
+	}
+	r.Providers = checks
+}
+
+// ruleConflicts describes pairs of globs, among rules without conditions,
+// that some model matches both of at equal priority and equal specificity,
+// so only the order of the patterns decides which serves it: most likely
+// not what was meant. Identical matches fail validation already.
+func ruleConflicts(cfg *Config) []string {
+	var conflicts []string
+	for j, b := range cfg.Rules {
+		if b.When != nil || !strings.ContainsAny(b.Match, "*?") {
+			continue
+		}
+		for i, a := range cfg.Rules[:j] {
+			if a.When != nil || !strings.ContainsAny(a.Match, "*?") || a.Priority != b.Priority ||
+				literalLen(a.Match) != literalLen(b.Match) || !globsOverlap(a.Match, b.Match) {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("rules[%d] (%q) and rules[%d] (%q) can match the same model at priority %d; %q wins only by sorting first",
+				i, a.Match, j, b.Match, b.Priority, min(a.Match, b.Match)))
+		}
+	}
+	return conflicts
+}
+
+// globsOverlap reports whether some name matches both patterns, in the
+// syntax of matchGlob.
+func globsOverlap(a, b string) bool {
+	seen := make(map[[2]int]bool)
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if i == len(a) && j == len(b) {
+			return true
+		}
+		k := [2]int{i, j}
+		if done, ok := seen[k]; ok {
+			return done
+		}
+		seen[k] = false
+		var ok bool
+		switch {
+		case i < len(a) && a[i] == '*':
+			ok = overlap(i+1, j) || (j < len(b) && overlap(i, j+1))
+		case j < len(b) && b[j] == '*':
+			ok = overlap(i, j+1) || (i < len(a) && overlap(i+1, j))
+		case i < len(a) && j < len(b) && (a[i] == b[j] || a[i] == '?' || b[j] == '?'):
+			ok = overlap(i+1, j+1)
+		}
+		seen[k] = ok
+		return ok
+	}
+	return overlap(0, 0)
+}
+
+func (r *CheckReport) print(w io.Writer) int {
+	r.OK = r.Errors == 0
+	out, _ := json.MarshalIndent(r, "", "  ")
+	fmt.Fprintf(w, "%s\n", out)
+	switch {
+	case r.Errors > 0:
+		return checkFailed
+	case r.Warnings > 0:
+		return checkWarnings
+	}
+	return checkPassed
+}
@@ -0,0 +1,273 @@
+// Package benchmark load-tests a model backend before it takes production
+// traffic: it sends a chat completion to a URL from a fixed number of
+// concurrent workers for a while and reports the latency percentiles and
+// throughput it saw. The router runs it as "model-router benchmark".
+package benchmark
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// DefaultPayload is the request sent when no payload file is given: a
+// short chat completion, so the numbers measure the backend's overhead
+// and first tokens rather than long generations.
+var DefaultPayload = []byte(`{"messages":[{"role":"user","content":"Say hello."}],"max_tokens":16}`)
+
+const (
+	// maxLatency is the highest latency the histogram tells apart; slower
+	// requests are counted at it.
+	maxLatency = 10 * time.Minute
+	// rejectedBackoff is how long a worker waits after Allow turns a
+	// request down, so an open breaker does not spin the pool.
+	rejectedBackoff = 10 * time.Millisecond
+)
+
+// Benchmark sends Payload, with its model set to Model if that is not
+// empty, to URL from Concurrency workers at once for WarmUp and then
+// Duration. Requests that start during WarmUp are sent but left out of
+// the report, so connection setup and cold caches do not skew it.
+type Benchmark struct {
+	URL         string
+	Model       string
+	Payload     []byte
+	Concurrency int
+	Duration    time.Duration
+	WarmUp      time.Duration
+	// Client sends the requests; http.DefaultClient if nil.
+	Client *http.Client
+	// Allow, if set, is asked before each request whether to send it, and
+	// Observe, if set, told how each one sent went: the router has its
+	// circuit breaker and metrics watch the test through them.
+	Allow   func() bool
+	Observe func(status int, latency time.Duration, err error)
+}
+
+// Report is what a benchmark measured after its warm-up. Errors are
+// requests that failed or were answered with a status of 400 or above;
+// their latencies are in the percentiles too. Rejected are requests Allow
+// turned down, which were not sent.
+type Report struct {
+	URL             string           `json:"url"`
+	Model           string           `json:"model,omitempty"`
+	Concurrency     int              `json:"concurrency"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Requests        int64            `json:"requests"`
+	Errors          int64            `json:"errors"`
+	Rejected        int64            `json:"rejected,omitempty"`
+	Statuses        map[string]int64 `json:"statuses"`
+	RPS             float64          `json:"rps"`
+	P50Ms           float64          `json:"p50_ms"`
+	P95Ms           float64          `json:"p95_ms"`
+	P99Ms           float64          `json:"p99_ms"`
+	MaxMs           float64          `json:"max_ms"`
+}
+
+// outcome is one request of the benchmark, as recorded by its worker.
+type outcome struct {
+	status int // 0 for a request that failed before its response
+	failed bool
+}
+
+// Run runs the benchmark until it is over or ctx is cancelled and reports
+// on it. Requests still in flight at the end are cut off and left out.
+func (b *Benchmark) Run(ctx context.Context) (*Report, error) {
+	if b.URL == "" {
+		return nil, errors.New("benchmark: a URL is required")
+	}
+	if b.Concurrency <= 0 || b.Duration <= 0 || b.WarmUp < 0 {
+		return nil, errors.New("benchmark: concurrency and duration must be positive, warm-up not negative")
+	}
+	payload, err := b.payload()
+	if err != nil {
+		return nil, err
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	measureFrom := start.Add(b.WarmUp)
+	ctx, cancel := context.WithDeadline(ctx, measureFrom.Add(b.Duration))
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		outcomes  []outcome
+		rejected  int64
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, b.Concurrency)
+	for ctx.Err() == nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			sent := time.Now()
+			if b.Allow != nil && !b.Allow() {
+				if !sent.Before(measureFrom) {
+					mu.Lock()
+					rejected++
+					mu.Unlock()
+				}
+				select {
+				case <-time.After(rejectedBackoff):
+				case <-ctx.Done():
+				}
+				return
+			}
+			o, latency, err := b.send(ctx, client, payload)
+			if err != nil && ctx.Err() != nil {
+				// Cut off by the end of the test, not the backend's doing.
+				return
+			}
+			if b.Observe != nil {
+				b.Observe(o.status, latency, err)
+			}
+			if sent.Before(measureFrom) {
+				return
+			}
+			mu.Lock()
+			latencies = append(latencies, latency)
+			outcomes = append(outcomes, o)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(measureFrom)
+	if elapsed > b.Duration {
+		elapsed = b.Duration
+	}
+	return b.report(latencies, outcomes, rejected, elapsed), nil
+}
+
+// payload is the request body of every request of the benchmark.
+func (b *Benchmark) payload() ([]byte, error) {
+	payload := b.Payload
+	if len(payload) == 0 {
+		payload = DefaultPayload
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, fmt.Errorf("benchmark: payload must be a JSON object: %w", err)
+	}
+	if b.Model == "" {
+		if _, ok := doc["model"]; !ok {
+			return nil, errors.New("benchmark: the payload names no model, and none was given")
+		}
+		return payload, nil
+	}
+	model, err := json.Marshal(b.Model)
+	if err != nil {
+		return nil, err
+	}
+	doc["model"] = model
+	return json.Marshal(doc)
+}
+
+// send sends one request and reads its response to the end, so latency
+// covers the whole completion.
+func (b *Benchmark) send(ctx context.Context, client *http.Client, payload []byte) (outcome, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.URL, bytes.NewReader(payload))
+	if err != nil {
+		return outcome{failed: true}, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return outcome{failed: true}, time.Since(start), err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	return outcome{status: resp.StatusCode, failed: err != nil || resp.StatusCode >= 400}, latency, err
+}
+
+func (b *Benchmark) report(latencies []time.Duration, outcomes []outcome, rejected int64, elapsed time.Duration) *Report {
+	r := &Report{
+		URL:             b.URL,
+		Model:           b.Model,
+		Concurrency:     b.Concurrency,
+		DurationSeconds: round2(elapsed.Seconds()),
+		Requests:        int64(len(latencies)),
+		Rejected:        rejected,
+		Statuses:        make(map[string]int64),
+	}
+	for _, o := range outcomes {
+		label := "error"
+		if o.status > 0 {
+			label = strconv.Itoa(o.status)
+		}
+		r.Statuses[label]++
+		if o.failed {
+			r.Errors++
+		}
+	}
+	if elapsed > 0 {
+		r.RPS = round2(float64(r.Requests) / elapsed.Seconds())
+	}
+	if len(latencies) == 0 {
+		return r
+	}
+	// Microseconds, to three significant figures.
+	h := hdrhistogram.New(1, maxLatency.Microseconds(), 3)
+	for _, l := range latencies {
+		h.RecordValue(min(max(l.Microseconds(), 1), maxLatency.Microseconds()))
+	}
+	ms := func(us int64) float64 { return round2(float64(us) / 1000) }
+	r.P50Ms = ms(h.ValueAtQuantile(50))
+	r.P95Ms = ms(h.ValueAtQuantile(95))
+	r.P99Ms = ms(h.ValueAtQuantile(99))
+	r.MaxMs = ms(h.Max())
+	return r
+}
+
+// WriteText writes r for people to read.
+func (r *Report) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "target:      %s", r.URL)
+	if r.Model != "" {
+		fmt.Fprintf(&buf, " (model %s)", r.Model)
+	}
+	fmt.Fprintf(&buf, "\nconcurrency: %d\nduration:    %.2fs\n", r.Concurrency, r.DurationSeconds)
+	fmt.Fprintf(&buf, "requests:    %d (%.2f/s), %d errors", r.Requests, r.RPS, r.Errors)
+	if r.Rejected > 0 {
+		fmt.Fprintf(&buf, ", %d rejected by the circuit breaker", r.Rejected)
+	}
+	buf.WriteString("\nstatuses:   ")
+	labels := make([]string, 0, len(r.Statuses))
+	for label := range r.Statuses {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(&buf, " %s=%d", label, r.Statuses[label])
+	}
+	fmt.Fprintf(&buf, "\nlatency:     p50 %.2fms  p95 %.2fms  p99 %.2fms  max %.2fms\n", r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RuleCondition limits a rule to requests whose prompt looks a certain
+// way; every field that is set must hold. Tokens are the estimate of the
+// text of all messages, bounds included. LastUserMessage is a regular
+// expression searched for in the text of the last user message.
+type RuleCondition struct {
+	MinTokens       int    `json:"min_tokens,omitempty"`
+	MaxTokens       int    `json:"max_tokens,omitempty"`
+	HasImages       *bool  `json:"has_images,omitempty"`
+	LastUserMessage string `json:"last_user_message,omitempty"`
+}
+
+func validateCondition(rc RuleCondition) error {
+	if rc.MinTokens < 0 || rc.MaxTokens < 0 {
+		return fmt.Errorf("when: min_tokens and max_tokens must not be negative")
+	}
+	if rc.MaxTokens > 0 && rc.MinTokens > rc.MaxTokens {
+		return fmt.Errorf("when: min_tokens is above max_tokens")
+	}
+	if rc.MinTokens == 0 && rc.MaxTokens == 0 && rc.HasImages == nil && rc.LastUserMessage == "" {
+		return fmt.Errorf("when: at least one condition is required")
+	}
+	if _, err := regexp.Compile(rc.LastUserMessage); err != nil {
+		return fmt.Errorf("when.last_user_message: %w", err)
+	}
+	return nil
+}
+
+// ruleCondition is a RuleCondition ready to evaluate.
+type ruleCondition struct {
+	RuleCondition
+	lastUser *regexp.Regexp
+}
+
+// newRuleCondition compiles rc, which Validate has checked.
+func newRuleCondition(rc RuleCondition) *ruleCondition {
+	c := &ruleCondition{RuleCondition: rc}
+	if rc.LastUserMessage != "" {
+		c.lastUser = regexp.MustCompile(rc.LastUserMessage)
+	}
+	return c
+}
+
+func (c *ruleCondition) Matches(f *PromptFeatures) bool {
+	switch {
+	case f.Tokens < c.MinTokens:
+		return false
+	case c.MaxTokens > 0 && f.Tokens > c.MaxTokens:
+		return false
+	case c.HasImages != nil && *c.HasImages != f.HasImages:
+		return false
+	case c.lastUser != nil && !c.lastUser.MatchString(f.LastUserMessage):
+		return false
+	}
+	return true
+}
+
+// TokenEstimator counts the tokens of prompt text for rule conditions.
+type TokenEstimator interface {
+	EstimateTokens(text string) int
+}
+
+// CharTokenEstimator assumes four characters per token, which is close
+// enough for English prose to tell short prompts from long ones.
+type CharTokenEstimator struct{}
+
+func (CharTokenEstimator) EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// tokenEstimator is what rule conditions count tokens with.
+var tokenEstimator TokenEstimator = CharTokenEstimator{}
+
+// SetTokenEstimator replaces the estimator rule conditions use, for builds
+// that compile in a real tokenizer. Call it from an init function, before
+// any request is served.
+func SetTokenEstimator(e TokenEstimator) {
+	tokenEstimator = e
+}
+
+// PromptFeatures are the properties of a chat request that rule
+// conditions look at.
+type PromptFeatures struct {
+	Tokens          int
+	HasImages       bool
+	LastUserMessage string
+}
+
+// newPromptFeatures reads body's messages. Content may be a string or a
+// list of parts; image parts of the OpenAI and Anthropic shapes count as
+// images. A body without messages has no features.
+func newPromptFeatures(body []byte) *PromptFeatures {
+	var req struct {
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	f := &PromptFeatures{}
+	if json.Unmarshal(body, &req) != nil {
+		return f
+	}
+	var all strings.Builder
+	for _, m := range req.Messages {
+		var text string
+		if json.Unmarshal(m.Content, &text) != nil {
+			var parts []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			}
+			json.Unmarshal(m.Content, &parts)
+			var b strings.Builder
+			for _, p := range parts {
+				switch p.Type {
+				case "image_url", "image", "input_image":
+					f.HasImages = true
+				default:
+					b.WriteString(p.Text)
+				}
+			}
+			text = b.String()
+		}
+		all.WriteString(text)
+		if m.Role == "user" {
+			f.LastUserMessage = text
+		}
+	}
+	f.Tokens = tokenEstimator.EstimateTokens(all.String())
+	return f
+}
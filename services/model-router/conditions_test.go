@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPromptFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want PromptFeatures
+	}{
+		{name: "no messages", body: `{"model":"auto"}`, want: PromptFeatures{}},
+		{name: "not JSON", body: `{"model":`, want: PromptFeatures{}},
+		{
+			name: "string content",
+			body: `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"Hello there"}]}`,
+			// 20 characters over both messages.
+			want: PromptFeatures{Tokens: 5, LastUserMessage: "Hello there"},
+		},
+		{
+			name: "last user message",
+			body: `{"messages":[{"role":"user","content":"first"},{"role":"assistant","content":"reply"},{"role":"user","content":"second"}]}`,
+			want: PromptFeatures{Tokens: 4, LastUserMessage: "second"},
+		},
+		{
+			name: "OpenAI image part",
+			body: `{"messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}]}`,
+			want: PromptFeatures{Tokens: 4, HasImages: true, LastUserMessage: "What is this?"},
+		},
+		{
+			name: "Anthropic image part",
+			body: `{"messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","data":"AAAA"}}]}]}`,
+			want: PromptFeatures{HasImages: true},
+		},
+		{
+			name: "Responses input_image part",
+			body: `{"messages":[{"role":"user","content":[{"type":"input_image","image_url":"https://example.com/a.png"},{"type":"text","text":"hi"}]}]}`,
+			want: PromptFeatures{Tokens: 1, HasImages: true, LastUserMessage: "hi"},
+		},
+		{
+			// Characters, not bytes, are counted.
+			name: "multibyte",
+			body: `{"messages":[{"role":"user","content":"héllo wörld"}]}`,
+			want: PromptFeatures{Tokens: 3, LastUserMessage: "héllo wörld"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := *newPromptFeatures([]byte(tt.body)); got != tt.want {
+				t.Errorf("features = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// conditionRules routes "auto" as config.example.yaml does: images first,
+// then code or stack traces, then short prompts, and everything else to
+// the plain rule.
+const conditionRules = `
+providers:
+  openai: {base_url: %s}
+  anthropic: {base_url: %s}
+  groq: {base_url: %s}
+  together: {base_url: %s}
+rules:
+  - match: "auto"
+    priority: 20
+    when: {has_images: true}
+    provider: openai
+  - match: "auto"
+    priority: 10
+    when: {last_user_message: "` + "```" + `|(?i)\\b(stack trace|traceback)\\b"}
+    provider: anthropic
+  - match: "auto"
+    when: {max_tokens: 500}
+    provider: groq
+  - match: "auto"
+    provider: together
+`
+
+func TestConditionRouting(t *testing.T) {
+	cfg := testConfig(t, fmt.Sprintf(conditionRules,
+		modelEcho(t, "openai"), modelEcho(t, "anthropic"), modelEcho(t, "groq"), modelEcho(t, "together")))
+	h := routeChain(t, newTestRouter(t, cfg))
+	long := strings.Repeat("Tell me more about the history of the region. ", 50)
+	tests := []struct {
+		name     string
+		messages string
+		want     string
+	}{
+		{name: "short", messages: `[{"role":"user","content":"What is 2+2?"}]`, want: "groq"},
+		{name: "long", messages: `[{"role":"user","content":"` + long + `"}]`, want: "together"},
+		{name: "code block", messages: `[{"role":"user","content":"Why does this fail?\n` + "```" + `go\nx := nil\n` + "```" + `"}]`, want: "anthropic"},
+		{name: "stack trace, any case", messages: `[{"role":"user","content":"Here is the Traceback I got"}]`, want: "anthropic"},
+		{name: "word within a word", messages: `[{"role":"user","content":"my tracebacks"}]`, want: "groq"},
+		{
+			// Only the last user message is searched.
+			name:     "code in an earlier message",
+			messages: `[{"role":"user","content":"` + "```" + `"},{"role":"assistant","content":"ok"},{"role":"user","content":"thanks"}]`,
+			want:     "groq",
+		},
+		{name: "image over code", messages: `[{"role":"user","content":[{"type":"text","text":"traceback"},{"type":"image_url","image_url":{"url":"data:,"}}]}]`, want: "openai"},
+		{name: "long with an image", messages: `[{"role":"user","content":[{"type":"text","text":"` + long + `"},{"type":"image_url","image_url":{"url":"data:,"}}]}]`, want: "openai"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, chatRequest(`{"model":"auto","messages":`+tt.messages+`}`))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var resp struct {
+				Backend string `json:"backend"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Backend != tt.want {
+				t.Errorf("routed to %s, want %s", resp.Backend, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCondition(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name    string
+		cond    RuleCondition
+		wantErr string
+	}{
+		{name: "token range", cond: RuleCondition{MinTokens: 10, MaxTokens: 10}},
+		{name: "images", cond: RuleCondition{HasImages: &yes}},
+		{name: "regex", cond: RuleCondition{LastUserMessage: `(?i)^sql:`}},
+		{name: "empty", wantErr: "at least one condition"},
+		{name: "negative", cond: RuleCondition{MinTokens: -1}, wantErr: "must not be negative"},
+		{name: "inverted range", cond: RuleCondition{MinTokens: 11, MaxTokens: 10}, wantErr: "min_tokens is above max_tokens"},
+		{name: "bad regex", cond: RuleCondition{LastUserMessage: `(unclosed`}, wantErr: "when.last_user_message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCondition(tt.cond)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateCondition = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// wordEstimator counts a token per word.
+type wordEstimator struct{}
+
+func (wordEstimator) EstimateTokens(text string) int { return len(strings.Fields(text)) }
+
+func TestSetTokenEstimator(t *testing.T) {
+	defer SetTokenEstimator(tokenEstimator)
+	SetTokenEstimator(wordEstimator{})
+	f := newPromptFeatures([]byte(`{"messages":[{"role":"user","content":"one two three"}]}`))
+	if f.Tokens != 3 {
+		t.Errorf("tokens = %d, want 3 by the plugged-in estimator", f.Tokens)
+	}
+}
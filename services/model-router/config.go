@@ -0,0 +1,1591 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// ProviderConfig is a named upstream. The API key is read from the
+// APIKeyFile when one is given, such as a mounted secret, which is
+// re-read as it is rotated; otherwise from the APIKeyEnv variable when
+// that is set and non-empty, falling back to APIKey, so secrets can stay
+// out of the file.
+type ProviderConfig struct {
+	BaseURL    string       `json:"base_url"`
+	APIKey     string       `json:"api_key,omitempty"`
+	APIKeyEnv  string       `json:"api_key_env,omitempty"`
+	APIKeyFile string       `json:"api_key_file,omitempty"`
+	Timeout    Duration     `json:"timeout,omitempty"`
+	Retry      *RetryPolicy `json:"retry,omitempty"`
+	// Format is the provider's API: "openai" (default) or "anthropic",
+	// whose requests and responses are translated from and to OpenAI's.
+	Format string `json:"format,omitempty"`
+	// Price is what the provider charges per 1K tokens, used by the
+	// cheapest strategy.
+	Price *Price `json:"price,omitempty"`
+	// HealthCheck probes the provider in the background; while probes
+	// fail its backends are skipped.
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
+	// Concurrency limits requests in flight to the provider, queueing the
+	// rest.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+	// RateLimit sets how close to the limits the provider reports in its
+	// rate-limit headers it may get before it is routed around.
+	RateLimit *UpstreamRateLimitConfig `json:"rate_limit,omitempty"`
+
+	// Transport tunes the provider's connection pool. Every provider has
+	// a pool of its own; models with tls_* or connection settings of their
+	// own use theirs instead.
+	Transport *TransportConfig `json:"transport,omitempty"`
+
+	// CircuitBreaker configures the breaker shared by every model routed
+	// to this provider.
+	CircuitBreaker *BreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// Discovery finds the provider's targets by DNS or label selector, in
+	// place of base_url.
+	Discovery *DiscoveryConfig `json:"discovery,omitempty"`
+}
+
+// Duration unmarshals from a Go duration string ("30s") or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// BackendConfig describes where one model (or glob of models) is
+// served. It either points at a named provider, whose settings it may
+// override, or at its own URL; Replicas lists several such targets sharing
+// traffic by weight. A bare string is shorthand for
+// {"provider": "<name>"}.
+type BackendConfig struct {
+	Provider string   `json:"provider,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	// MaxRetries bounds how often a failed attempt is retried (default 2,
+	// or the provider's retry policy).
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// TimeoutSeconds is the overall deadline for a request, across
+	// queueing, retries and fallbacks (default REQUEST_TIMEOUT, or 30),
+	// shortened by the client's X-Request-Timeout-Ms. Streams only need
+	// their first bytes within it. Timeout above bounds each attempt's
+	// wait for response headers.
+	TimeoutSeconds float64         `json:"timeout_seconds,omitempty"`
+	Weight         *int            `json:"weight,omitempty"`
+	Replicas       []ReplicaConfig `json:"replicas,omitempty"`
+	// Strategy picks among replicas: "weighted" (default) by weight,
+	// "static" the first available in order, "cheapest" by provider
+	// price, honouring X-Aspendos-Max-Latency-Ms, or "latency_aware" the
+	// faster to first byte of two at random, tuned by LatencyAware.
+	Strategy     string              `json:"strategy,omitempty"`
+	LatencyAware *LatencyAwareConfig `json:"latency_aware,omitempty"`
+	// Affinity sends every request of a session, named by the
+	// X-Aspendos-Session header or the body's conversation_id, to the same
+	// replica while it is available, for backends that keep per-
+	// conversation state. Requests without a session use Strategy.
+	Affinity bool `json:"affinity,omitempty"`
+	// SlowStartSeconds ramps a replica's share of traffic, when it joins
+	// the pool or comes back after being unavailable, from a tenth of its
+	// weight to all of it over that many seconds, so a replica still
+	// loading its model is not swamped. It applies to the weighted
+	// strategy.
+	SlowStartSeconds float64 `json:"slow_start_seconds,omitempty"`
+	// OutlierDetection takes replicas answering with too many errors or
+	// too slowly out of rotation for a while.
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+
+	// CircuitBreaker gives this model breakers of its own instead of
+	// sharing the provider's.
+	CircuitBreaker *BreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// TLSCACert pins the CA that upstream server certificates must chain
+	// to, and TLSClientCert and TLSClientKey are the certificate the router
+	// presents for mTLS. Each is a file path or inline PEM; files are
+	// re-read on reload.
+	TLSCACert     string `json:"tls_ca_cert,omitempty"`
+	TLSClientCert string `json:"tls_client_cert,omitempty"`
+	TLSClientKey  string `json:"tls_client_key,omitempty"`
+
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeoutSeconds size the
+	// keep-alive pool of connections to the model's HTTP backends
+	// (defaults 256, 64 and 90s), and ResponseHeaderTimeoutSeconds bounds a
+	// connection's wait for response headers (default none beyond
+	// timeout). Backends with any of these set get a client of their own.
+	MaxIdleConns                 int     `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost          int     `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeoutSeconds       float64 `json:"idle_conn_timeout_seconds,omitempty"`
+	ResponseHeaderTimeoutSeconds float64 `json:"response_header_timeout_seconds,omitempty"`
+
+	// MaxBodyBytes caps the request body (default server.max_request_bytes) and
+	// AcceptedContentTypes lists the media types the model takes
+	// (default application/json).
+	MaxBodyBytes         int64    `json:"max_body_bytes,omitempty"`
+	AcceptedContentTypes []string `json:"accepted_content_types,omitempty"`
+	// IntegrityCheck rejects a request whose body does not match the
+	// SHA-256 its X-Content-SHA256 header declares, if it sends one, and
+	// sends the SHA-256 of each passed-through response body in an
+	// X-Content-SHA256 trailer, so truncation in transit either way shows.
+	IntegrityCheck bool `json:"integrity_check,omitempty"`
+
+	// Fallbacks are models tried in order when this one fails with a
+	// transport error, timeout, 429 or 5xx before any response is sent. The
+	// request's model field is rewritten for each. Fallbacks of fallbacks
+	// are not followed.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// Deduplicate coalesces identical concurrent requests into one upstream
+	// call. Only enable it for stateless models where identical input
+	// should yield a shared answer.
+	Deduplicate bool `json:"deduplicate,omitempty"`
+
+	// TrafficSplit divides the model's traffic between variant backends for
+	// an A/B test. It replaces provider, url and replicas.
+	TrafficSplit *TrafficSplitConfig `json:"traffic_split,omitempty"`
+
+	// BlueGreen keeps two deployments of the model, one serving all of its
+	// traffic, for cutovers through the admin API. It replaces provider,
+	// url and replicas.
+	BlueGreen *BlueGreenConfig `json:"blue_green,omitempty"`
+
+	// Canary sends a growing share of the model's traffic to a new
+	// deployment while its error rate stays low. It replaces provider, url
+	// and replicas.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+
+	// RegionGroup divides the model's replicas into a primary and a
+	// failover region. It replaces provider, url and replicas.
+	RegionGroup *RegionGroupConfig `json:"region_group,omitempty"`
+
+	// Pools are further backends of the model, by name, and
+	// RoutingPolicies choose among them and the model's own backends,
+	// the "default" pool, by request; see RoutingPolicy. A request no
+	// policy matches goes to the default pool.
+	Pools           map[string]BackendConfig `json:"pools,omitempty"`
+	RoutingPolicies []RoutingPolicyConfig    `json:"routing_policies,omitempty"`
+
+	// ShadowBackend receives a copy of every request in the background.
+	// Its responses are discarded and never delay or affect the client's.
+	ShadowBackend *ShadowConfig `json:"shadow_backend,omitempty"`
+
+	// CacheEnabled serves repeated identical non-streamed requests from the
+	// response cache for CacheTTLSeconds (default 300). Only 200 responses
+	// up to CacheMaxBytes (default 1 MiB) are stored. Requests sampling
+	// with temperature > 0 bypass the cache unless CacheSampled is set. A
+	// traffic split keeps each variant's answers apart and caches only
+	// requests with X-Client-ID; a canary is never cached.
+	CacheEnabled    bool  `json:"cache_enabled,omitempty"`
+	CacheTTLSeconds int   `json:"cache_ttl_seconds,omitempty"`
+	CacheMaxBytes   int64 `json:"cache_max_bytes,omitempty"`
+	CacheSampled    bool  `json:"cache_sampled,omitempty"`
+
+	// WarmupPayload is a JSON request file sent to the model's backends
+	// when they are added, before they take live traffic, until
+	// WarmupRequests (default 3) in a row return 200 within
+	// WarmupMaxLatencySeconds (default 10). A backend still failing after
+	// WarmupTimeoutSeconds (default 120) is marked degraded and only used
+	// when no other replica is available.
+	WarmupPayload           string  `json:"warmup_payload,omitempty"`
+	WarmupRequests          int     `json:"warmup_requests,omitempty"`
+	WarmupMaxLatencySeconds float64 `json:"warmup_max_latency_seconds,omitempty"`
+	WarmupTimeoutSeconds    float64 `json:"warmup_timeout_seconds,omitempty"`
+
+	// HealthPath or ProbeIntervalSeconds turns on probes of each of the
+	// model's backends, separate from any provider health_check: a GET of
+	// HealthPath (default /health) every ProbeIntervalSeconds (default 10),
+	// each given 2s. A backend leaves rotation after ConsecutiveFailures
+	// (default 3) failed probes in a row and rejoins after
+	// ConsecutiveSuccesses (default 2) successful ones.
+	HealthPath           string  `json:"health_path,omitempty"`
+	ProbeIntervalSeconds float64 `json:"probe_interval_seconds,omitempty"`
+	ConsecutiveFailures  int     `json:"consecutive_failures,omitempty"`
+	ConsecutiveSuccesses int     `json:"consecutive_successes,omitempty"`
+
+	// Protocol is how the model's backends are called: "http" (default) or
+	// "grpc" for the KServe v2 gRPC inference protocol of Triton and
+	// compatible servers; see GRPCBackend. An https url means gRPC over
+	// TLS, using the tls_* settings.
+	Protocol string `json:"protocol,omitempty"`
+
+	// RequestEncoding is the body format of the model's HTTP backends:
+	// "json" (default), "msgpack", or "protobuf" with the messages named
+	// ProtoRequestMessage and ProtoResponseMessage (full names) from the
+	// schema at ProtoFile, which is re-read on reload. Clients still send
+	// and receive JSON; see BodyTransformer.
+	RequestEncoding      string `json:"request_encoding,omitempty"`
+	ProtoFile            string `json:"proto_file,omitempty"`
+	ProtoRequestMessage  string `json:"proto_request_message,omitempty"`
+	ProtoResponseMessage string `json:"proto_response_message,omitempty"`
+
+	// EmbeddingBatchWindow, when set (e.g. "20ms"), holds /v1/embeddings
+	// requests for the model that long and sends the inputs that arrived
+	// together as one upstream call of at most EmbeddingMaxBatchSize
+	// (default 2048) inputs; see EmbeddingBatcher.
+	EmbeddingBatchWindow  Duration `json:"embedding_batch_window,omitempty"`
+	EmbeddingMaxBatchSize int      `json:"embedding_max_batch_size,omitempty"`
+
+	// Plugins transform the model's upstream requests and responses, in
+	// order; see Plugin.
+	Plugins []PluginConfig `json:"plugins,omitempty"`
+	// Guardrails check the model's requests before they are sent upstream
+	// and its responses before the client sees them, in order; see
+	// Guardrail.
+	Guardrails []GuardrailConfig `json:"guardrails,omitempty"`
+	// Transforms rewrite the model's request JSON before it is forwarded,
+	// or its response JSON, in order; see the transforms map for the
+	// names.
+	Transforms []TransformConfig `json:"transforms,omitempty"`
+	// ResponseSchema is a JSON Schema file the model's successful JSON
+	// responses must match; a response that does not is answered with a
+	// 502. See ResponseValidator.
+	ResponseSchema string `json:"response_schema,omitempty"`
+}
+
+const (
+	defaultCacheTTL      = 5 * time.Minute
+	defaultCacheMaxBytes = 1 << 20
+)
+
+func (b BackendConfig) cacheTTL() time.Duration {
+	if b.CacheTTLSeconds > 0 {
+		return time.Duration(b.CacheTTLSeconds) * time.Second
+	}
+	return defaultCacheTTL
+}
+
+func (b BackendConfig) cacheMaxBytes() int64 {
+	if b.CacheMaxBytes > 0 {
+		return b.CacheMaxBytes
+	}
+	return defaultCacheMaxBytes
+}
+
+const defaultEmbeddingMaxBatchSize = 2048
+
+func (b BackendConfig) embeddingMaxBatchSize() int {
+	if b.EmbeddingMaxBatchSize > 0 {
+		return b.EmbeddingMaxBatchSize
+	}
+	return defaultEmbeddingMaxBatchSize
+}
+
+// ShadowConfig names the dark-launch target for a model. Model, when set,
+// replaces the mirrored request's model field. Timeout defaults to twice
+// the primary request deadline. SampleRate is the fraction of requests
+// mirrored (default 1, all of them) and MaxConcurrency bounds the shadow
+// calls in flight (default 16); requests beyond it are not mirrored. A
+// bare string is shorthand for {"provider": "<name>"}.
+type ShadowConfig struct {
+	Provider       string   `json:"provider,omitempty"`
+	URL            string   `json:"url,omitempty"`
+	Model          string   `json:"model,omitempty"`
+	Timeout        Duration `json:"timeout,omitempty"`
+	SampleRate     *float64 `json:"sample_rate,omitempty"`
+	MaxConcurrency int      `json:"max_concurrency,omitempty"`
+}
+
+const defaultShadowConcurrency = 16
+
+func (s ShadowConfig) sampleRate() float64 {
+	if s.SampleRate != nil {
+		return *s.SampleRate
+	}
+	return 1
+}
+
+func (s ShadowConfig) maxConcurrency() int {
+	if s.MaxConcurrency > 0 {
+		return s.MaxConcurrency
+	}
+	return defaultShadowConcurrency
+}
+
+func (s *ShadowConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = ShadowConfig{Provider: name}
+		return nil
+	}
+	type plain ShadowConfig
+	return decodeStrict(data, (*plain)(s))
+}
+
+const maxFallbacks = 3
+
+// TrafficSplitConfig assigns each client to one variant by hashing its
+// X-Client-ID with the experiment name, so a client keeps its variant for
+// as long as the percentages (and the current window) stay the same.
+// Changing percentages only moves the clients whose bucket changes hands.
+type TrafficSplitConfig struct {
+	// Experiment seeds the hash (default: the model name). Renaming it
+	// reshuffles every client.
+	Experiment string `json:"experiment,omitempty"`
+	// Window, when set, re-draws assignments every window; otherwise they
+	// never expire.
+	Window   Duration        `json:"window,omitempty"`
+	Variants []VariantConfig `json:"variants"`
+}
+
+// BlueGreenConfig names the backends of the two slots. Active is the slot
+// serving when the config is first loaded (default blue); a cutover made
+// through the admin API is kept across reloads. After a cutover the
+// previous slot is kept open for DrainTimeoutSeconds (default 30) so
+// in-flight requests can finish. When RollbackErrorRate is set, the
+// router switches back by itself if more than that fraction of the new
+// slot's requests fail (a transport error or 5xx, as for the circuit
+// breaker) within RollbackWindowSeconds (default 60) of the cutover, once
+// RollbackMinRequests (default 10) have completed.
+type BlueGreenConfig struct {
+	Blue                  BackendConfig `json:"blue"`
+	Green                 BackendConfig `json:"green"`
+	Active                string        `json:"active,omitempty"`
+	DrainTimeoutSeconds   float64       `json:"drain_timeout_seconds,omitempty"`
+	RollbackErrorRate     float64       `json:"rollback_error_rate,omitempty"`
+	RollbackWindowSeconds float64       `json:"rollback_window_seconds,omitempty"`
+	RollbackMinRequests   int           `json:"rollback_min_requests,omitempty"`
+}
+
+const (
+	defaultDrainTimeout        = 30 * time.Second
+	defaultRollbackWindow      = time.Minute
+	defaultRollbackMinRequests = 10
+)
+
+func (bg BlueGreenConfig) drainTimeout() time.Duration {
+	if bg.DrainTimeoutSeconds > 0 {
+		return time.Duration(bg.DrainTimeoutSeconds * float64(time.Second))
+	}
+	return defaultDrainTimeout
+}
+
+func (bg BlueGreenConfig) rollbackWindow() time.Duration {
+	if bg.RollbackWindowSeconds > 0 {
+		return time.Duration(bg.RollbackWindowSeconds * float64(time.Second))
+	}
+	return defaultRollbackWindow
+}
+
+func (bg BlueGreenConfig) rollbackMinRequests() int {
+	if bg.RollbackMinRequests > 0 {
+		return bg.RollbackMinRequests
+	}
+	return defaultRollbackMinRequests
+}
+
+// VariantConfig is one arm of a traffic split. Percentages must add up to
+// 100. Model, when set, replaces the request's model field for traffic
+// sent to this variant, so two versions of a model can share a provider.
+type VariantConfig struct {
+	Name    string
+	Percent int
+	Model   string
+	Backend BackendConfig
+}
+
+// UnmarshalJSON reads name, percent and model alongside the backend fields,
+// like RuleConfig: {"name": "b", "percent": 10, "provider": "anthropic"}.
+func (vc *VariantConfig) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, dst := range map[string]any{"name": &vc.Name, "percent": &vc.Percent, "model": &vc.Model} {
+		if raw, ok := fields[key]; ok {
+			if err := json.Unmarshal(raw, dst); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			delete(fields, key)
+		}
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rest, &vc.Backend)
+}
+
+func (b BackendConfig) maxBodyBytes(fallback int64) int64 {
+	if b.MaxBodyBytes > 0 {
+		return b.MaxBodyBytes
+	}
+	return fallback
+}
+
+func (b BackendConfig) acceptedContentTypes() []string {
+	if len(b.AcceptedContentTypes) > 0 {
+		return b.AcceptedContentTypes
+	}
+	return []string{"application/json"}
+}
+
+// ReplicaConfig is one member of a model's backend pool. Weight defaults
+// to 1; a weight of 0 keeps the replica configured but out of rotation.
+type ReplicaConfig struct {
+	Provider string `json:"provider,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Weight   *int   `json:"weight,omitempty"`
+}
+
+// replicas lists the backend's replicas; with a region group, the primary
+// ones first.
+func (b BackendConfig) replicas() []ReplicaConfig {
+	if rg := b.RegionGroup; rg != nil {
+		return append(append([]ReplicaConfig{}, rg.PrimaryBackends...), rg.FailoverBackends...)
+	}
+	if len(b.Replicas) > 0 {
+		return b.Replicas
+	}
+	return []ReplicaConfig{{Provider: b.Provider, URL: b.URL, Weight: b.Weight}}
+}
+
+func weightOrDefault(w *int) int {
+	if w == nil {
+		return 1
+	}
+	return *w
+}
+
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*b = BackendConfig{Provider: name}
+		return nil
+	}
+	type plain BackendConfig
+	return decodeStrict(data, (*plain)(b))
+}
+
+// RuleConfig routes every model matching a glob to a backend. Rules are
+// tried in descending priority; among equal priorities the more specific
+// pattern (more literal characters) wins.
+//
+// A rule with When only applies to requests whose prompt meets it. Such
+// rules are tried first, in the same order, and the model's ordinary
+// entry (under models, or a rule without conditions) is the fall-through
+// when none holds. Several of them may share a match, and may match a
+// name under models.
+type RuleConfig struct {
+	Match    string
+	Priority int
+	When     *RuleCondition
+	Backend  BackendConfig
+}
+
+// UnmarshalJSON reads match, priority and when alongside the backend
+// fields, so a rule is written flat: {"match": "gpt-4*", "priority": 10,
+// "provider": "openai"}.
+func (rc *RuleConfig) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if raw, ok := fields["match"]; ok {
+		if err := json.Unmarshal(raw, &rc.Match); err != nil {
+			return fmt.Errorf("match: %w", err)
+		}
+		delete(fields, "match")
+	}
+	if raw, ok := fields["priority"]; ok {
+		if err := json.Unmarshal(raw, &rc.Priority); err != nil {
+			return fmt.Errorf("priority: %w", err)
+		}
+		delete(fields, "priority")
+	}
+	if raw, ok := fields["when"]; ok {
+		rc.When = new(RuleCondition)
+		if err := decodeStrict(raw, rc.When); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+		delete(fields, "when")
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rest, &rc.Backend)
+}
+
+// ServerConfig holds listener settings. Zero values keep the defaults:
+// port 8081 and no read or write deadline. A write timeout also bounds
+// streaming responses, so keep it above the longest expected stream.
+type ServerConfig struct {
+	Port         int      `json:"port,omitempty"`
+	ReadTimeout  Duration `json:"read_timeout,omitempty"`
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+	// MaxRequestBytes is the default request body limit for every model
+	// (1 MiB); MAX_REQUEST_BYTES overrides it.
+	MaxRequestBytes int64 `json:"max_request_bytes,omitempty"`
+}
+
+const defaultMaxRequestBytes = 1 << 20
+
+func (s ServerConfig) maxRequestBytes() int64 {
+	if s.MaxRequestBytes > 0 {
+		return s.MaxRequestBytes
+	}
+	return defaultMaxRequestBytes
+}
+
+// Config is the router's configuration file. Model keys and rule matches
+// may contain the globs "*" (any run of characters, including "/") and
+// "?" (one character); names without them must match the requested model
+// exactly and always win over globs.
+type Config struct {
+	Server     ServerConfig                `json:"server"`
+	Providers  map[string]ProviderConfig   `json:"providers"`
+	Models     map[string]BackendConfig    `json:"models"`
+	Rules      []RuleConfig                `json:"rules,omitempty"`
+	RateLimits *middleware.RateLimitConfig `json:"rate_limits,omitempty"`
+	Auth       *middleware.AuthConfig      `json:"auth,omitempty"`
+	JWT        *JWTConfig                  `json:"jwt,omitempty"`
+	Cache      *CacheConfig                `json:"cache,omitempty"`
+	// CORS lets browsers on other origins call the router. Changes take
+	// effect on restart, not reload.
+	CORS *middleware.CORSConfig `json:"cors,omitempty"`
+	// Compression negotiates compressed responses; on by default.
+	Compression *middleware.CompressionConfig `json:"compression,omitempty"`
+	// Quotas caps the tokens each tenant may use per period.
+	Quotas *QuotaConfig `json:"quotas,omitempty"`
+	// Realtime carries WebSocket sessions to realtime model APIs.
+	Realtime *RealtimeConfig `json:"realtime,omitempty"`
+	// Audit records every routed request, with the prompt hashed. Changes
+	// take effect on restart, not reload.
+	Audit *AuditConfig `json:"audit,omitempty"`
+	// Queue serves routed requests by X-Request-Priority under load.
+	Queue *PriorityQueueConfig `json:"queue,omitempty"`
+	// Idempotency tunes how long responses to requests with an
+	// Idempotency-Key are kept.
+	Idempotency *IdempotencyConfig `json:"idempotency,omitempty"`
+	// Tenants gives customers sharing the router their own provider keys
+	// and model allowlists, by tenant name.
+	Tenants map[string]TenantConfig `json:"tenants,omitempty"`
+	// Aliases keep old model names working: a request for an alias is
+	// routed, and sent upstream, as the model it names.
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Version identifies the loaded file contents (a short SHA-256), or
+	// "builtin" for DefaultConfig.
+	Version string `json:"-"`
+	// Warnings are what loading a deployment manifest ignored.
+	Warnings []string `json:"-"`
+	// source is the document the config was decoded from, as JSON, for the
+	// last-known-good copy.
+	source []byte
+}
+
+// CacheConfig selects where models with cache_enabled keep responses:
+// "memory" (default), an LRU per router replica bounded by MaxEntries
+// (default 10000) and MaxBytes of response bodies (default 64 MiB), or
+// "redis", shared by every replica. The URL comes from
+// RedisURLEnv when that variable is set, then RedisURL. Changes take effect
+// on restart, not reload.
+type CacheConfig struct {
+	Backend     string `json:"backend,omitempty"`
+	MaxEntries  int    `json:"max_entries,omitempty"`
+	MaxBytes    int64  `json:"max_bytes,omitempty"`
+	RedisURL    string `json:"redis_url,omitempty"`
+	RedisURLEnv string `json:"redis_url_env,omitempty"`
+}
+
+func (c CacheConfig) redisURL() string {
+	if v := os.Getenv(c.RedisURLEnv); c.RedisURLEnv != "" && v != "" {
+		return v
+	}
+	return c.RedisURL
+}
+
+// QuotaConfig enforces a token budget per tenant, counted in Redis so
+// every replica shares it. A tenant's limit comes from the LimitsHash Redis
+// hash (tenant → tokens) when it has an entry there, then from LimitsFile,
+// a YAML or JSON map of the same shape, then DefaultLimit; 0 is unlimited.
+// Budgets reset at the start of each UTC day, or month with Period
+// "monthly". Changes take effect on restart, not reload, except for the
+// hash, which is read on every request.
+type QuotaConfig struct {
+	RedisURL     string `json:"redis_url,omitempty"`
+	RedisURLEnv  string `json:"redis_url_env,omitempty"`
+	Period       string `json:"period,omitempty"`
+	DefaultLimit int64  `json:"default_limit,omitempty"`
+	LimitsFile   string `json:"limits_file,omitempty"`
+	LimitsHash   string `json:"limits_hash,omitempty"`
+	// RequireTenant rejects requests without a tenant instead of letting
+	// them through unmetered: with auth, those whose key belongs to none,
+	// and without, those sending no X-Tenant-ID.
+	RequireTenant bool `json:"require_tenant,omitempty"`
+}
+
+func (c QuotaConfig) redisURL() string {
+	if v := os.Getenv(c.RedisURLEnv); c.RedisURLEnv != "" && v != "" {
+		return v
+	}
+	return c.RedisURL
+}
+
+// JWTConfig adds a refresh_interval duration (default 5m) to the
+// middleware's settings.
+type JWTConfig struct {
+	middleware.JWTConfig
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+// DefaultConfig builds the OpenAI/Anthropic table used when no config file
+// is given, from the OPENAI_* and ANTHROPIC_* variables.
+func DefaultConfig() *Config {
+	return &Config{
+		Version: "builtin",
+		Providers: map[string]ProviderConfig{
+			"openai": {
+				BaseURL:   getEnv("OPENAI_BASE_URL", "https://api.openai.com"),
+				APIKeyEnv: "OPENAI_API_KEY",
+			},
+			"anthropic": {
+				BaseURL:   getEnv("ANTHROPIC_BASE_URL", "https://api.anthropic.com"),
+				APIKeyEnv: "ANTHROPIC_API_KEY",
+			},
+		},
+		Models: map[string]BackendConfig{
+			"gpt-*":    {Provider: "openai"},
+			"o1*":      {Provider: "openai"},
+			"o3*":      {Provider: "openai"},
+			"claude-*": {Provider: "anthropic"},
+		},
+	}
+}
+
+// LoadConfig reads and validates a YAML or JSON config file (JSON is parsed
+// as YAML, so both formats share one decoder). Unknown fields, duplicate
+// keys and rules that repeat a model pattern are rejected. The file may
+// also be a DeploymentManifest.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+	return parseConfig(path, data)
+}
+
+// parseConfig decodes and validates data, the contents of path.
+func parseConfig(path string, data []byte) (*Config, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	// Re-encode as JSON so the json tags and custom unmarshalers above
+	// apply to YAML input too.
+	asJSON, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if isManifest(doc) {
+		cfg, warnings, err := manifestConfig(data, doc)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", path, err)
+		}
+		cfg.Warnings = warnings
+		cfg.source = asJSON
+		return cfg, nil
+	}
+	var cfg Config
+	if err := decodeStrict(asJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	sum := sha256.Sum256(cfg.hashTLSFiles(data))
+	cfg.Version = hex.EncodeToString(sum[:6])
+	cfg.source = asJSON
+	return &cfg, nil
+}
+
+// ApplyEnv lets environment variables override file settings.
+func (cfg *Config) ApplyEnv() error {
+	if v := os.Getenv("MAX_REQUEST_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("MAX_REQUEST_BYTES: %q is not a positive byte count", v)
+		}
+		cfg.Server.MaxRequestBytes = n
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Validate checks every field and names the first bad one in its error.
+func (cfg *Config) Validate() error {
+	if p := cfg.Server.Port; p < 0 || p > 65535 {
+		return fmt.Errorf("server.port: %d is not a valid port", p)
+	}
+	if cfg.Server.MaxRequestBytes < 0 {
+		return fmt.Errorf("server.max_request_bytes must not be negative")
+	}
+	if cfg.Server.ReadTimeout < 0 {
+		return fmt.Errorf("server.read_timeout must not be negative")
+	}
+	if cfg.Server.WriteTimeout < 0 {
+		return fmt.Errorf("server.write_timeout must not be negative")
+	}
+	for name, pc := range cfg.Providers {
+		if dc := pc.Discovery; dc != nil {
+			if pc.BaseURL != "" {
+				return fmt.Errorf("providers[%q]: discovery cannot be combined with base_url", name)
+			}
+			if pc.HealthCheck != nil {
+				return fmt.Errorf("providers[%q]: discovery cannot be combined with health_check; probe each target with the models' probe_interval_seconds", name)
+			}
+			if err := validateDiscovery(*dc); err != nil {
+				return fmt.Errorf("providers[%q].discovery: %w", name, err)
+			}
+		} else if err := validateURL(pc.BaseURL); err != nil {
+			return fmt.Errorf("providers[%q].base_url: %w", name, err)
+		}
+		if pc.Timeout < 0 {
+			return fmt.Errorf("providers[%q].timeout must not be negative", name)
+		}
+		if pc.APIKeyFile != "" {
+			if _, err := readCredential(pc.APIKeyFile); err != nil {
+				return fmt.Errorf("providers[%q].api_key_file: %w", name, err)
+			}
+		}
+		if rp := pc.Retry; rp != nil {
+			if rp.MaxAttempts < 1 {
+				return fmt.Errorf("providers[%q].retry.max_attempts must be at least 1", name)
+			}
+			if rp.BaseDelay <= 0 || rp.MaxDelay < rp.BaseDelay {
+				return fmt.Errorf("providers[%q].retry: base_delay must be positive and not exceed max_delay", name)
+			}
+		}
+		if _, ok := providerAdapters[pc.Format]; !ok && pc.Format != "" && pc.Format != "openai" {
+			return fmt.Errorf("providers[%q].format: unknown format %q", name, pc.Format)
+		}
+		if hc := pc.HealthCheck; hc != nil {
+			if hc.Interval < 0 || hc.Timeout < 0 || hc.UnhealthyThreshold < 0 {
+				return fmt.Errorf("providers[%q].health_check: interval, timeout and unhealthy_threshold must not be negative", name)
+			}
+			if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+				return fmt.Errorf("providers[%q].health_check.path must start with /", name)
+			}
+		}
+		if tc := pc.Transport; tc != nil {
+			if err := tc.validate(); err != nil {
+				return fmt.Errorf("providers[%q].transport: %w", name, err)
+			}
+		}
+		if cc := pc.Concurrency; cc != nil {
+			if cc.MaxConcurrent < 1 {
+				return fmt.Errorf("providers[%q].concurrency.max_concurrent must be at least 1", name)
+			}
+			if cc.MaxQueue < 0 || cc.QueueTimeout < 0 {
+				return fmt.Errorf("providers[%q].concurrency: max_queue and queue_timeout must not be negative", name)
+			}
+			if cc.LowPriorityQueueTimeout < 0 || cc.LowPriorityMaxQueue < 0 || cc.AgingInterval < 0 {
+				return fmt.Errorf("providers[%q].concurrency: low_priority_queue_timeout, low_priority_max_queue and aging_interval must not be negative", name)
+			}
+			if cc.LowPriorityMaxQueue > cc.withDefaults().MaxQueue {
+				return fmt.Errorf("providers[%q].concurrency.low_priority_max_queue must not exceed max_queue", name)
+			}
+		}
+		if rl := pc.RateLimit; rl != nil && (rl.MinRemainingRequests < 0 || rl.MinRemainingTokens < 0) {
+			return fmt.Errorf("providers[%q].rate_limit: min_remaining_requests and min_remaining_tokens must not be negative", name)
+		}
+		if pr := pc.Price; pr != nil && (pr.InputPer1K < 0 || pr.OutputPer1K < 0) {
+			return fmt.Errorf("providers[%q].price must not be negative", name)
+		}
+		if cb := pc.CircuitBreaker; cb != nil && (cb.FailureThreshold < 1 || cb.Cooldown <= 0) {
+			return fmt.Errorf("providers[%q].circuit_breaker: failure_threshold must be at least 1 and cooldown positive", name)
+		}
+	}
+	for model, bc := range cfg.Models {
+		if model == "" {
+			return fmt.Errorf("models: model name must not be empty")
+		}
+		if err := validateBackend(cfg, bc); err != nil {
+			return fmt.Errorf("models[%q]: %w", model, err)
+		}
+	}
+	seen := make(map[string]int, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		if rule.Match == "" {
+			return fmt.Errorf("rules[%d].match is required", i)
+		}
+		if rule.When != nil {
+			if err := validateCondition(*rule.When); err != nil {
+				return fmt.Errorf("rules[%d].%w", i, err)
+			}
+			if err := validateBackend(cfg, rule.Backend); err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			continue
+		}
+		if _, ok := cfg.Models[rule.Match]; ok {
+			return fmt.Errorf("rules[%d].match: %q is already defined under models", i, rule.Match)
+		}
+		if j, ok := seen[rule.Match]; ok {
+			return fmt.Errorf("rules[%d].match: duplicate of rules[%d] (%q)", i, j, rule.Match)
+		}
+		seen[rule.Match] = i
+		if err := validateBackend(cfg, rule.Backend); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+	if rl := cfg.RateLimits; rl != nil {
+		if rl.Default != nil && (rl.Default.RequestsPerSecond <= 0 || rl.Default.Burst <= 0) {
+			return fmt.Errorf("rate_limits.default: requests_per_second and burst must be positive")
+		}
+		for model, l := range rl.Models {
+			if l.RequestsPerSecond <= 0 || l.Burst <= 0 {
+				return fmt.Errorf("rate_limits.models[%q]: requests_per_second and burst must be positive", model)
+			}
+		}
+	}
+	if cc := cfg.CORS; cc != nil {
+		if cc.Default != nil {
+			if err := validateCORSPolicy(*cc.Default); err != nil {
+				return fmt.Errorf("cors.default: %w", err)
+			}
+		}
+		for model, p := range cc.Models {
+			if err := validateCORSPolicy(p); err != nil {
+				return fmt.Errorf("cors.models[%q]: %w", model, err)
+			}
+		}
+	}
+	if cc := cfg.Compression; cc != nil {
+		if err := middleware.ValidateCompression(*cc); err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+	}
+	if auth := cfg.Auth; auth != nil {
+		if len(auth.Keys) == 0 && auth.Redis == nil {
+			return fmt.Errorf("auth.keys: at least one key is required when auth is configured without redis")
+		}
+		if rc := auth.Redis; rc != nil {
+			if rc.RedisURL == "" && rc.RedisURLEnv == "" {
+				return fmt.Errorf("auth.redis: redis_url or redis_url_env is required")
+			}
+			if rc.CacheTTLSeconds < 0 {
+				return fmt.Errorf("auth.redis.cache_ttl_seconds must not be negative")
+			}
+		}
+		names := make(map[string]bool, len(auth.Keys))
+		for i, k := range auth.Keys {
+			if k.Name == "" {
+				return fmt.Errorf("auth.keys[%d].name is required", i)
+			}
+			if names[k.Name] {
+				return fmt.Errorf("auth.keys[%d].name: duplicate key name %q", i, k.Name)
+			}
+			names[k.Name] = true
+			if k.Key == "" && k.KeyEnv == "" && k.KeySHA256 == "" {
+				return fmt.Errorf("auth.keys[%d]: one of key, key_env or key_sha256 is required", i)
+			}
+			if k.RequestsPerMinute < 0 {
+				return fmt.Errorf("auth.keys[%d].requests_per_minute must not be negative", i)
+			}
+			if slices.Contains(k.AllowedModels, "") {
+				return fmt.Errorf("auth.keys[%d].allowed_models must not contain empty patterns", i)
+			}
+			if !validPriorityClass(k.Priority) || !validPriorityClass(k.MaxPriority) {
+				return fmt.Errorf("auth.keys[%d]: priority and max_priority must be high, normal or low", i)
+			}
+			if k.Priority != "" && k.MaxPriority != "" && priorityClasses[k.Priority] > priorityClasses[k.MaxPriority] {
+				return fmt.Errorf("auth.keys[%d].priority must not exceed max_priority", i)
+			}
+		}
+	}
+	if jc := cfg.JWT; jc != nil {
+		if cfg.Auth != nil {
+			return fmt.Errorf("jwt: cannot be combined with auth; configure one authentication method")
+		}
+		if err := validateURL(jc.JWKSURL); err != nil {
+			return fmt.Errorf("jwt.jwks_url: %w", err)
+		}
+		if jc.Audience == "" {
+			return fmt.Errorf("jwt.audience is required")
+		}
+		if jc.RefreshInterval < 0 {
+			return fmt.Errorf("jwt.refresh_interval must not be negative")
+		}
+	}
+	if cc := cfg.Cache; cc != nil {
+		switch cc.Backend {
+		case "", "memory":
+		case "redis":
+			if cc.RedisURL == "" && cc.RedisURLEnv == "" {
+				return fmt.Errorf("cache: redis_url or redis_url_env is required for the redis backend")
+			}
+		default:
+			return fmt.Errorf("cache.backend: unknown backend %q (want memory or redis)", cc.Backend)
+		}
+		if cc.MaxEntries < 0 || cc.MaxBytes < 0 {
+			return fmt.Errorf("cache.max_entries and cache.max_bytes must not be negative")
+		}
+	}
+	if qc := cfg.Quotas; qc != nil {
+		if qc.RedisURL == "" && qc.RedisURLEnv == "" {
+			return fmt.Errorf("quotas: redis_url or redis_url_env is required")
+		}
+		switch qc.Period {
+		case "", "daily", "monthly":
+		default:
+			return fmt.Errorf("quotas.period: unknown period %q (want daily or monthly)", qc.Period)
+		}
+		if qc.DefaultLimit < 0 {
+			return fmt.Errorf("quotas.default_limit must not be negative")
+		}
+		if qc.LimitsFile != "" {
+			if _, err := loadQuotaLimits(qc.LimitsFile); err != nil {
+				return fmt.Errorf("quotas.limits_file: %w", err)
+			}
+		}
+	}
+	if rc := cfg.Realtime; rc != nil {
+		if err := validateRealtime(*rc); err != nil {
+			return err
+		}
+	}
+	if ac := cfg.Audit; ac != nil {
+		if err := validateAudit(*ac); err != nil {
+			return err
+		}
+	}
+	if qc := cfg.Queue; qc != nil && qc.MaxQueueDepth < 0 {
+		return fmt.Errorf("queue.max_queue_depth must not be negative")
+	}
+	if ic := cfg.Idempotency; ic != nil {
+		if err := validateIdempotency(*ic); err != nil {
+			return err
+		}
+	}
+	if err := validateTenants(cfg); err != nil {
+		return err
+	}
+	if _, err := validateAliases(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateBackend(cfg *Config, bc BackendConfig) error {
+	if len(bc.Replicas) > 0 && (bc.Provider != "" || bc.URL != "" || bc.Weight != nil) {
+		return fmt.Errorf("replicas cannot be combined with provider, url or weight")
+	}
+	if bc.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if bc.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout_seconds must not be negative")
+	}
+	if bc.MaxRetries != nil && *bc.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+	if bc.MaxBodyBytes < 0 {
+		return fmt.Errorf("max_body_bytes must not be negative")
+	}
+	if bc.MaxIdleConns < 0 || bc.MaxIdleConnsPerHost < 0 || bc.IdleConnTimeoutSeconds < 0 || bc.ResponseHeaderTimeoutSeconds < 0 {
+		return fmt.Errorf("max_idle_conns, max_idle_conns_per_host, idle_conn_timeout_seconds and response_header_timeout_seconds must not be negative")
+	}
+	if _, ok := strategies[bc.Strategy]; !ok && bc.Strategy != "" {
+		return fmt.Errorf("strategy: unknown strategy %q (want static, weighted, cheapest or latency_aware)", bc.Strategy)
+	}
+	if lc := bc.LatencyAware; lc != nil {
+		if bc.Strategy != "latency_aware" {
+			return fmt.Errorf("latency_aware needs strategy latency_aware")
+		}
+		if err := validateLatencyAware(*lc); err != nil {
+			return err
+		}
+	}
+	if bc.SlowStartSeconds < 0 {
+		return fmt.Errorf("slow_start_seconds must not be negative")
+	}
+	if od := bc.OutlierDetection; od != nil {
+		if err := validateOutlierDetection(*od); err != nil {
+			return err
+		}
+	}
+	if bc.CacheTTLSeconds < 0 || bc.CacheMaxBytes < 0 {
+		return fmt.Errorf("cache_ttl_seconds and cache_max_bytes must not be negative")
+	}
+	if bc.WarmupRequests < 0 || bc.WarmupMaxLatencySeconds < 0 || bc.WarmupTimeoutSeconds < 0 {
+		return fmt.Errorf("warmup_requests, warmup_max_latency_seconds and warmup_timeout_seconds must not be negative")
+	}
+	if bc.WarmupPayload != "" {
+		data, err := os.ReadFile(bc.WarmupPayload)
+		if err != nil {
+			return fmt.Errorf("warmup_payload: %w", err)
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("warmup_payload: %s is not valid JSON", bc.WarmupPayload)
+		}
+	}
+	if bc.ProbeIntervalSeconds < 0 || bc.ConsecutiveFailures < 0 || bc.ConsecutiveSuccesses < 0 {
+		return fmt.Errorf("probe_interval_seconds, consecutive_failures and consecutive_successes must not be negative")
+	}
+	if bc.HealthPath != "" && !strings.HasPrefix(bc.HealthPath, "/") {
+		return fmt.Errorf("health_path must start with /")
+	}
+	if bc.EmbeddingBatchWindow < 0 || bc.EmbeddingMaxBatchSize < 0 {
+		return fmt.Errorf("embedding_batch_window and embedding_max_batch_size must not be negative")
+	}
+	switch bc.Protocol {
+	case "", "http", "grpc":
+	default:
+		return fmt.Errorf("protocol: unknown protocol %q (want http or grpc)", bc.Protocol)
+	}
+	if bc.RequestEncoding == "protobuf" {
+		if bc.ProtoFile == "" || bc.ProtoRequestMessage == "" || bc.ProtoResponseMessage == "" {
+			return fmt.Errorf("request_encoding: protobuf needs proto_file, proto_request_message and proto_response_message")
+		}
+	} else if bc.ProtoFile != "" || bc.ProtoRequestMessage != "" || bc.ProtoResponseMessage != "" {
+		return fmt.Errorf("proto_file, proto_request_message and proto_response_message need request_encoding protobuf")
+	}
+	if bc.Protocol == "grpc" && bc.RequestEncoding != "" && bc.RequestEncoding != "json" {
+		return fmt.Errorf("request_encoding: gRPC backends have their own encoding")
+	}
+	if _, ok := bc.probe(); ok && bc.Protocol == "grpc" {
+		return fmt.Errorf("health_path: gRPC backends cannot be probed over HTTP")
+	}
+	if _, err := newBodyTransformer(bc); err != nil {
+		return err
+	}
+	if _, err := newPluginChain(bc.Plugins); err != nil {
+		return err
+	}
+	if _, err := newGuardrails(bc.Guardrails); err != nil {
+		return err
+	}
+	if _, err := newTransformPipeline(bc.Transforms); err != nil {
+		return err
+	}
+	if bc.ResponseSchema != "" {
+		if _, err := NewResponseValidator(bc.ResponseSchema); err != nil {
+			return fmt.Errorf("response_schema: %w", err)
+		}
+	}
+	for _, ct := range bc.AcceptedContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("accepted_content_types: %q: %w", ct, err)
+		}
+	}
+	if cb := bc.CircuitBreaker; cb != nil && (cb.FailureThreshold < 1 || cb.Cooldown <= 0) {
+		return fmt.Errorf("circuit_breaker: failure_threshold must be at least 1 and cooldown positive")
+	}
+	if _, err := bc.tlsConfig(); err != nil {
+		return err
+	}
+	if len(bc.Fallbacks) > maxFallbacks {
+		return fmt.Errorf("fallbacks: at most %d allowed", maxFallbacks)
+	}
+	for i, fb := range bc.Fallbacks {
+		if fb == "" {
+			return fmt.Errorf("fallbacks[%d] must not be empty", i)
+		}
+	}
+	if sc := bc.ShadowBackend; sc != nil {
+		if err := validateShadow(cfg, *sc); err != nil {
+			return fmt.Errorf("shadow_backend: %w", err)
+		}
+	}
+	if len(bc.Pools) > 0 || len(bc.RoutingPolicies) > 0 {
+		if bc.TrafficSplit != nil || bc.BlueGreen != nil || bc.Canary != nil {
+			return fmt.Errorf("pools and routing_policies cannot be combined with traffic_split, blue_green or canary")
+		}
+		if err := validateRoutingPolicies(cfg, bc); err != nil {
+			return err
+		}
+	}
+	if bc.TrafficSplit != nil {
+		if bc.Provider != "" || bc.URL != "" || bc.Weight != nil || len(bc.Replicas) > 0 || bc.BlueGreen != nil || bc.Canary != nil {
+			return fmt.Errorf("traffic_split cannot be combined with provider, url, weight, replicas, blue_green or canary")
+		}
+		return validateSplit(cfg, *bc.TrafficSplit)
+	}
+	if bc.BlueGreen != nil {
+		if bc.Provider != "" || bc.URL != "" || bc.Weight != nil || len(bc.Replicas) > 0 || bc.Canary != nil {
+			return fmt.Errorf("blue_green cannot be combined with provider, url, weight, replicas or canary")
+		}
+		return validateBlueGreen(cfg, *bc.BlueGreen)
+	}
+	if bc.Canary != nil {
+		if bc.Provider != "" || bc.URL != "" || bc.Weight != nil || len(bc.Replicas) > 0 {
+			return fmt.Errorf("canary cannot be combined with provider, url, weight or replicas")
+		}
+		return validateCanary(cfg, *bc.Canary)
+	}
+	if bc.RegionGroup != nil {
+		if bc.Provider != "" || bc.URL != "" || bc.Weight != nil || len(bc.Replicas) > 0 {
+			return fmt.Errorf("region_group cannot be combined with provider, url, weight or replicas")
+		}
+		if err := validateRegionGroup(*bc.RegionGroup); err != nil {
+			return err
+		}
+	}
+	total := 0
+	for i, rc := range bc.replicas() {
+		if rc.Provider == "" && rc.URL == "" {
+			return fmt.Errorf("replica %d: either provider or url is required", i)
+		}
+		if rc.Provider != "" {
+			if _, ok := cfg.Providers[rc.Provider]; !ok {
+				return fmt.Errorf("replica %d references unknown provider %q", i, rc.Provider)
+			}
+		}
+		if rc.URL != "" {
+			if err := validateURL(rc.URL); err != nil {
+				return fmt.Errorf("replica %d url: %w", i, err)
+			}
+		}
+		if bc.hasTLS() && !strings.HasPrefix(replicaURL(cfg, rc), "https://") {
+			return fmt.Errorf("replica %d: tls_* settings need an https url", i)
+		}
+		if bc.Protocol == "grpc" && rc.Provider != "" && cfg.Providers[rc.Provider].Format != "" && cfg.Providers[rc.Provider].Format != "openai" {
+			return fmt.Errorf("replica %d: provider %q has format %s, which gRPC backends do not support", i, rc.Provider, cfg.Providers[rc.Provider].Format)
+		}
+		w := weightOrDefault(rc.Weight)
+		if w < 0 {
+			return fmt.Errorf("replica %d weight must not be negative", i)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one replica needs a positive weight")
+	}
+	return nil
+}
+
+// replicaURL is where a replica sends requests: its own url, else its
+// provider's base_url. For a provider with discovery, which has no single
+// URL, it is just the scheme its targets use.
+func replicaURL(cfg *Config, rc ReplicaConfig) string {
+	if rc.URL != "" {
+		return rc.URL
+	}
+	pc := cfg.Providers[rc.Provider]
+	if pc.Discovery != nil {
+		return pc.Discovery.withDefaults().Scheme + "://"
+	}
+	return pc.BaseURL
+}
+
+func validateShadow(cfg *Config, sc ShadowConfig) error {
+	if sc.Provider == "" && sc.URL == "" {
+		return fmt.Errorf("either provider or url is required")
+	}
+	if sc.Provider != "" {
+		pc, ok := cfg.Providers[sc.Provider]
+		if !ok {
+			return fmt.Errorf("unknown provider %q", sc.Provider)
+		}
+		if pc.Discovery != nil && sc.URL == "" {
+			return fmt.Errorf("provider %q uses discovery; give the shadow a url", sc.Provider)
+		}
+	}
+	if sc.URL != "" {
+		if err := validateURL(sc.URL); err != nil {
+			return fmt.Errorf("url: %w", err)
+		}
+	}
+	if sc.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if r := sc.sampleRate(); r < 0 || r > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if sc.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency must not be negative")
+	}
+	return nil
+}
+
+func validateSplit(cfg *Config, ts TrafficSplitConfig) error {
+	if len(ts.Variants) < 2 {
+		return fmt.Errorf("traffic_split: at least two variants are required")
+	}
+	if ts.Window < 0 {
+		return fmt.Errorf("traffic_split: window must not be negative")
+	}
+	names := make(map[string]bool, len(ts.Variants))
+	total := 0
+	for i, v := range ts.Variants {
+		if v.Name == "" {
+			return fmt.Errorf("traffic_split variant %d: name is required", i)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("traffic_split: duplicate variant %q", v.Name)
+		}
+		names[v.Name] = true
+		if v.Percent < 0 {
+			return fmt.Errorf("traffic_split variant %q: percent must not be negative", v.Name)
+		}
+		total += v.Percent
+		if v.Backend.TrafficSplit != nil || v.Backend.Canary != nil {
+			return fmt.Errorf("traffic_split variant %q: variants cannot split again", v.Name)
+		}
+		if err := validateBackend(cfg, v.Backend); err != nil {
+			return fmt.Errorf("traffic_split variant %q: %w", v.Name, err)
+		}
+	}
+	if total != 100 {
+		return fmt.Errorf("traffic_split: percentages add up to %d, not 100", total)
+	}
+	return nil
+}
+
+func validateBlueGreen(cfg *Config, bg BlueGreenConfig) error {
+	switch bg.Active {
+	case "", slotBlue, slotGreen:
+	default:
+		return fmt.Errorf("blue_green.active: %q is not blue or green", bg.Active)
+	}
+	if bg.DrainTimeoutSeconds < 0 || bg.RollbackWindowSeconds < 0 || bg.RollbackMinRequests < 0 {
+		return fmt.Errorf("blue_green: drain_timeout_seconds, rollback_window_seconds and rollback_min_requests must not be negative")
+	}
+	if bg.RollbackErrorRate < 0 || bg.RollbackErrorRate > 1 {
+		return fmt.Errorf("blue_green.rollback_error_rate must be between 0 and 1")
+	}
+	for _, slot := range []struct {
+		name string
+		bc   BackendConfig
+	}{{slotBlue, bg.Blue}, {slotGreen, bg.Green}} {
+		if slot.bc.TrafficSplit != nil || slot.bc.BlueGreen != nil || slot.bc.Canary != nil {
+			return fmt.Errorf("blue_green.%s: a slot cannot split or have slots of its own", slot.name)
+		}
+		if err := validateBackend(cfg, slot.bc); err != nil {
+			return fmt.Errorf("blue_green.%s: %w", slot.name, err)
+		}
+	}
+	return nil
+}
+
+// validateCORSPolicy rejects a policy browsers would refuse: a wildcard
+// origin or header list combined with credentials.
+func validateCORSPolicy(p middleware.CORSPolicy) error {
+	if len(p.AllowedOrigins) == 0 {
+		return fmt.Errorf("allowed_origins must list at least one origin")
+	}
+	if p.AllowCredentials && p.AllowsAnyOrigin() {
+		return fmt.Errorf("allowed_origins cannot be \"*\" when allow_credentials is set")
+	}
+	if p.AllowCredentials && slices.Contains(p.AllowedHeaders, "*") {
+		return fmt.Errorf("allowed_headers cannot be \"*\" when allow_credentials is set")
+	}
+	for _, o := range p.AllowedOrigins {
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			return fmt.Errorf("allowed_origins: %q is not an http(s) origin", o)
+		}
+	}
+	if p.MaxAgeSeconds < 0 {
+		return fmt.Errorf("max_age_seconds must not be negative")
+	}
+	return nil
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+func (c *Config) providers() map[string]*Provider {
+	providers := make(map[string]*Provider, len(c.Providers))
+	for name, pc := range c.Providers {
+		p := &Provider{
+			Name:    name,
+			Source:  name,
+			BaseURL: pc.BaseURL,
+			Timeout: time.Duration(pc.Timeout),
+			Retry:   DefaultRetryPolicy(),
+			Adapter: providerAdapters[pc.Format],
+			Price:   pc.Price,
+		}
+		if pc.Retry != nil {
+			p.Retry = *pc.Retry
+		}
+		p.APIKey = pc.APIKey
+		if v := os.Getenv(pc.APIKeyEnv); pc.APIKeyEnv != "" && v != "" {
+			p.APIKey = v
+		}
+		if pc.APIKeyFile != "" {
+			p.Credential = credentialFiles.Get(name, pc.APIKeyFile)
+		}
+		providers[name] = p
+	}
+	return providers
+}
+
+// Table resolves every model entry and rule into a pool of backends. Each
+// backend gets its own copy of the provider it points at, with the replica
+// URL and per-model overrides applied. Backends reaching the same target
+// share one circuit breaker across models unless the model configures its
+// own; onChange observes every breaker's transitions. A replica of a
+// provider with discovery becomes one backend per target in discovered,
+// the base URLs found for each such provider.
+func (c *Config) Table(onChange BreakerObserver, logger *slog.Logger, discovered map[string][]string) []*ModelEntry {
+	table, _ := c.table(onChange, logger, discovered)
+	return table
+}
+
+// table is Table, also returning the names of the providers the table
+// routes to.
+func (c *Config) table(onChange BreakerObserver, logger *slog.Logger, discovered map[string][]string) ([]*ModelEntry, map[string]bool) {
+	b := tableBuilder{
+		logger:     logger,
+		cfg:        c,
+		discovered: discovered,
+		providers:  c.providers(),
+		breakers:   make(map[string]*CircuitBreaker),
+		clients:    make(map[string]*http.Client),
+		warned:     make(map[string]bool),
+		used:       make(map[string]bool),
+		onChange:   onChange,
+	}
+	table := make([]*ModelEntry, 0, len(c.Models)+len(c.Rules))
+	for model, bc := range c.Models {
+		table = append(table, b.entry(model, 0, bc))
+	}
+	for _, rule := range c.Rules {
+		e := b.entry(rule.Match, rule.Priority, rule.Backend)
+		if rule.When != nil {
+			e.Condition = newRuleCondition(*rule.When)
+		}
+		table = append(table, e)
+	}
+	return table, b.used
+}
+
+type tableBuilder struct {
+	cfg        *Config
+	discovered map[string][]string
+	providers  map[string]*Provider
+	breakers   map[string]*CircuitBreaker
+	clients    map[string]*http.Client
+	warned     map[string]bool
+	used       map[string]bool
+	onChange   BreakerObserver
+	logger     *slog.Logger
+}
+
+func (tb *tableBuilder) entry(name string, priority int, bc BackendConfig) *ModelEntry {
+	e := &ModelEntry{
+		Name:         name,
+		Priority:     priority,
+		Config:       bc,
+		MaxBodyBytes: bc.maxBodyBytes(tb.cfg.Server.maxRequestBytes()),
+	}
+	// Validate has built these already, so they cannot fail.
+	e.Plugins, _ = newPluginChain(bc.Plugins)
+	e.Guardrails, _ = newGuardrails(bc.Guardrails)
+	e.Transforms, _ = newTransformPipeline(bc.Transforms)
+	if bc.ResponseSchema != "" {
+		e.Validator, _ = NewResponseValidator(bc.ResponseSchema)
+	}
+	if sc := bc.ShadowBackend; sc != nil {
+		p := tb.target(sc.Provider, sc.URL)
+		tb.used[sc.Provider] = true
+		e.Shadow = &Shadow{
+			Provider:   &p,
+			Model:      sc.Model,
+			Timeout:    time.Duration(sc.Timeout),
+			SampleRate: sc.sampleRate(),
+			slots:      make(chan struct{}, sc.maxConcurrency()),
+		}
+	}
+	if bg := bc.BlueGreen; bg != nil {
+		e.BlueGreen = newBlueGreenController(name, *bg, tb.pool(name, bg.Blue), tb.pool(name, bg.Green), tb.logger)
+		return e
+	}
+	if cc := bc.Canary; cc != nil {
+		e.Canary = newCanaryController(name, *cc, tb.pool(name, cc.Stable), tb.pool(name, cc.Canary), tb.logger)
+		return e
+	}
+	ts := bc.TrafficSplit
+	if ts == nil {
+		e.Pool = tb.pool(name, bc)
+		if len(bc.RoutingPolicies) > 0 {
+			e.Policies = tb.policies(name, bc, e.Pool)
+		}
+		return e
+	}
+	e.Split = &TrafficSplit{Experiment: ts.Experiment, Window: time.Duration(ts.Window)}
+	if e.Split.Experiment == "" {
+		e.Split.Experiment = name
+	}
+	for _, vc := range ts.Variants {
+		e.Split.Variants = append(e.Split.Variants, &Variant{
+			Name:    vc.Name,
+			Percent: vc.Percent,
+			Model:   vc.Model,
+			Pool:    tb.pool(name, vc.Backend),
+		})
+	}
+	return e
+}
+
+// policies builds the routing policies of model, whose default pool is
+// pool.
+func (tb *tableBuilder) policies(model string, bc BackendConfig, pool *BackendPool) *PolicyChain {
+	c := &PolicyChain{pools: map[string]*BackendPool{defaultPool: pool}}
+	// Validate has built these already, so they cannot fail.
+	c.policies, _ = newRoutingPolicies(bc.RoutingPolicies)
+	for name, pc := range bc.Pools {
+		c.pools[name] = tb.pool(model, pc)
+	}
+	return c
+}
+
+func (tb *tableBuilder) pool(model string, bc BackendConfig) *BackendPool {
+	// Validate has compiled any schema already; like certificates, one
+	// that has since stopped compiling fails every request.
+	encoding, err := newBodyTransformer(bc)
+	if err != nil {
+		encoding = failedTransformer{err}
+	}
+	var backends, failover []*Backend
+	for i, rc := range bc.replicas() {
+		tb.used[rc.Provider] = true
+		urls := []string{rc.URL}
+		if pc := tb.cfg.Providers[rc.Provider]; rc.URL == "" && pc.Discovery != nil {
+			urls = tb.discovered[rc.Provider]
+		}
+		for _, u := range urls {
+			b := tb.backend(model, rc, u, bc, encoding)
+			backends = append(backends, b)
+			if rg := bc.RegionGroup; rg != nil && i >= len(rg.PrimaryBackends) {
+				failover = append(failover, b)
+			}
+		}
+	}
+	pool := NewBackendPool(backends, newStrategy(model, bc, backends))
+	if bc.Affinity {
+		pool.affinity = newSessionAffinity(model, tb.logger)
+	}
+	if rg := bc.RegionGroup; rg != nil {
+		pool.regions = newRegionGroup(model, *rg, failover, tb.logger)
+	}
+	pool.balance = newBalancer(model, bc, backends, tb.logger)
+	return pool
+}
+
+// backend is replica rc of model's pool, sent to rawURL when it is set.
+func (tb *tableBuilder) backend(model string, rc ReplicaConfig, rawURL string, bc BackendConfig, encoding BodyTransformer) *Backend {
+	p := tb.target(rc.Provider, rawURL)
+	if bc.Timeout > 0 {
+		p.Timeout = time.Duration(bc.Timeout)
+	}
+	if bc.MaxRetries != nil {
+		p.Retry.MaxAttempts = *bc.MaxRetries + 1
+	}
+	p.Encoding = encoding
+	switch {
+	case bc.Protocol == "grpc":
+		tb.grpc(&p, bc)
+	case bc.hasTLS() || bc.hasTransport():
+		p.Client = tb.client(bc)
+	}
+	if strings.HasPrefix(p.BaseURL, "http://") && !developmentEnvironment() && !tb.warned[p.Name] {
+		tb.warned[p.Name] = true
+		tb.logger.Warn("backend is plain HTTP; configure https and tls_* settings outside development",
+			slog.String("backend", p.Name), slog.String("model", model))
+	}
+	return &Backend{
+		Provider: &p,
+		Weight:   weightOrDefault(rc.Weight),
+		Breaker:  tb.breaker(model, p.Name, rc.Provider, bc),
+	}
+}
+
+// target copies the named provider, pointed at url when one is given.
+func (tb *tableBuilder) target(provider, rawURL string) Provider {
+	var p Provider
+	if base, ok := tb.providers[provider]; ok {
+		p = *base
+	} else {
+		p = Provider{Retry: DefaultRetryPolicy()}
+	}
+	if rawURL != "" {
+		// Name each target distinctly so logs and metric labels show
+		// which replica served a request.
+		p.BaseURL = rawURL
+		if provider == "" {
+			p.Name = hostOf(rawURL)
+		} else {
+			p.Name = provider + "@" + hostOf(rawURL)
+		}
+	}
+	return p
+}
+
+func (tb *tableBuilder) breaker(model, target, provider string, bc BackendConfig) *CircuitBreaker {
+	if bc.CircuitBreaker != nil {
+		return NewCircuitBreaker(model+"/"+target, *bc.CircuitBreaker, tb.onChange)
+	}
+	if cb, ok := tb.breakers[target]; ok {
+		return cb
+	}
+	cfg := DefaultBreakerConfig()
+	if pc, ok := tb.cfg.Providers[provider]; ok && pc.CircuitBreaker != nil {
+		cfg = *pc.CircuitBreaker
+	}
+	cb := NewCircuitBreaker(target, cfg, tb.onChange)
+	tb.breakers[target] = cb
+	return cb
+}
+
+func hostOf(raw string) string {
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return raw
+}
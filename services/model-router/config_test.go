@@ -0,0 +1,265 @@
+package main
+
+import (
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		// wantErr is a substring of the error, empty when loading succeeds.
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: "router.yaml",
+			data: `
+server: {port: 9000, read_timeout: 10s}
+providers:
+  openai: {base_url: https://api.openai.com, api_key_env: OPENAI_API_KEY, timeout: 30s}
+models:
+  gpt-4o: openai
+rules:
+  - {match: "gpt-*", priority: 10, provider: openai}
+`,
+		},
+		{
+			name: "json",
+			file: "router.json",
+			data: `{"providers": {"openai": {"base_url": "https://api.openai.com"}}, "rules": [{"match": "gpt-*", "provider": "openai"}]}`,
+		},
+		{
+			name:    "missing file",
+			file:    "",
+			wantErr: "read config",
+		},
+		{
+			name:    "malformed yaml",
+			file:    "router.yaml",
+			data:    "providers:\n  openai: {base_url: [\n",
+			wantErr: "parse config",
+		},
+		{
+			name:    "unknown field",
+			file:    "router.yaml",
+			data:    "providers:\n  openai: {base_url: https://api.openai.com, timout: 30s}\n",
+			wantErr: `unknown field "timout"`,
+		},
+		{
+			name:    "duplicate key",
+			file:    "router.yaml",
+			data:    "providers:\n  openai: {base_url: https://api.openai.com}\n  openai: {base_url: https://example.com}\n",
+			wantErr: "already defined",
+		},
+		{
+			name: "duplicate rule",
+			file: "router.yaml",
+			data: `
+providers:
+  openai: {base_url: https://api.openai.com}
+rules:
+  - {match: "gpt-*", provider: openai}
+  - {match: "gpt-*", priority: 5, provider: openai}
+`,
+			wantErr: `rules[1].match: duplicate of rules[0] ("gpt-*")`,
+		},
+		{
+			name: "rule repeating a model",
+			file: "router.yaml",
+			data: `
+providers:
+  openai: {base_url: https://api.openai.com}
+models:
+  gpt-4o: openai
+rules:
+  - {match: gpt-4o, provider: openai}
+`,
+			wantErr: `rules[0].match: "gpt-4o" is already defined under models`,
+		},
+		{
+			name:    "bad base url",
+			file:    "router.yaml",
+			data:    "providers:\n  openai: {base_url: api.openai.com}\n",
+			wantErr: `providers["openai"].base_url`,
+		},
+		{
+			name:    "bad port",
+			file:    "router.yaml",
+			data:    "server: {port: 70000}\n",
+			wantErr: "server.port: 70000 is not a valid port",
+		},
+		{
+			name:    "unknown provider",
+			file:    "router.yaml",
+			data:    "providers:\n  openai: {base_url: https://api.openai.com}\nmodels:\n  gpt-4o: opnai\n",
+			wantErr: `models["gpt-4o"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			if tt.file != "" {
+				path = writeConfig(t, tt.file, tt.data)
+			}
+			cfg, err := LoadConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				if cfg.Version == "" {
+					t.Error("LoadConfig left Version empty")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFields(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, "router.yaml", `
+server: {port: 9000, read_timeout: 10s, write_timeout: 20s}
+providers:
+  openai: {base_url: https://api.openai.com, api_key_env: OPENAI_API_KEY, timeout: 30s}
+rules:
+  - {match: "gpt-*", priority: 10, provider: openai}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9000 || time.Duration(cfg.Server.ReadTimeout) != 10*time.Second || time.Duration(cfg.Server.WriteTimeout) != 20*time.Second {
+		t.Errorf("server = %+v", cfg.Server)
+	}
+	p := cfg.Providers["openai"]
+	if p.BaseURL != "https://api.openai.com" || p.APIKeyEnv != "OPENAI_API_KEY" || time.Duration(p.Timeout) != 30*time.Second {
+		t.Errorf("providers[openai] = %+v", p)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Match != "gpt-*" || cfg.Rules[0].Priority != 10 || cfg.Rules[0].Backend.Provider != "openai" {
+		t.Errorf("rules = %+v", cfg.Rules)
+	}
+}
+
+// Secrets and the body limit come from the environment over the file.
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "from-env")
+	t.Setenv("MAX_REQUEST_BYTES", "2048")
+	cfg, err := LoadConfig(writeConfig(t, "router.yaml", `
+server: {max_request_bytes: 1024}
+providers:
+  openai: {base_url: https://api.openai.com, api_key: from-file, api_key_env: OPENAI_API_KEY}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.providers()["openai"].APIKey; got != "from-env" {
+		t.Errorf("api key = %q, want from-env", got)
+	}
+	if got := cfg.Server.MaxRequestBytes; got != 2048 {
+		t.Errorf("max_request_bytes = %d, want 2048", got)
+	}
+
+	t.Setenv("MAX_REQUEST_BYTES", "lots")
+	if _, err := LoadConfig(writeConfig(t, "router.yaml", "{}")); err == nil || !strings.Contains(err.Error(), "MAX_REQUEST_BYTES") {
+		t.Errorf("LoadConfig with a bad MAX_REQUEST_BYTES = %v, want an error naming it", err)
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cors    string
+		wantErr string
+	}{
+		{name: "default and per model", cors: `{default: {allowed_origins: ["https://*.example.com"]}, models: {m: {allowed_origins: ["https://console.example.com"], allow_credentials: true}}}`},
+		{name: "any origin without credentials", cors: `{default: {allowed_origins: ["*"], allowed_headers: ["*"]}}`},
+		{name: "no origins", cors: `{default: {max_age_seconds: 60}}`, wantErr: "cors.default: allowed_origins must list at least one origin"},
+		{name: "any origin with credentials", cors: `{default: {allowed_origins: ["*"], allow_credentials: true}}`, wantErr: `allowed_origins cannot be "*" when allow_credentials is set`},
+		{name: "any header with credentials", cors: `{models: {m: {allowed_origins: ["https://a.example.com"], allowed_headers: ["*"], allow_credentials: true}}}`, wantErr: `cors.models["m"]: allowed_headers cannot be "*"`},
+		{name: "not an origin", cors: `{default: {allowed_origins: ["app.example.com"]}}`, wantErr: `"app.example.com" is not an http(s) origin`},
+		{name: "negative max age", cors: `{default: {allowed_origins: ["https://a.example.com"], max_age_seconds: -1}}`, wantErr: "max_age_seconds must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "router.yaml", `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: a
+cors: `+tt.cors+"\n"))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Any file LoadConfig accepts gives every model a positive body limit and
+// content types that parse, and validates again; any other is an error,
+// never a panic.
+func FuzzLoadConfig(f *testing.F) {
+	seeds, _ := filepath.Glob("testdata/manifest/*.yaml")
+	for _, file := range append(seeds, "config.example.yaml") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	for _, seed := range []string{
+		"{}",
+		"providers:\n  a: {base_url: http://127.0.0.1:1}\nmodels:\n  m: a\n",
+		"providers:\n  a: {base_url: http://127.0.0.1:1}\nmodels:\n  m: {provider: a, max_body_bytes: 1048576, accepted_content_types: [application/json, multipart/form-data]}\n",
+		"server: {max_request_bytes: -1}\nmodels:\n  m: {provider: a, max_body_bytes: -5}\n",
+		"models:\n  m: {provider: a, accepted_content_types: ['text/plain; charset=']}\n",
+		"aliases: {a: b, b: a}\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "router.yaml")
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			return
+		}
+		for name, bc := range cfg.Models {
+			if n := bc.maxBodyBytes(cfg.Server.maxRequestBytes()); n <= 0 {
+				t.Errorf("models[%q]: body limit %d", name, n)
+			}
+			for _, ct := range bc.acceptedContentTypes() {
+				if _, _, err := mime.ParseMediaType(ct); err != nil {
+					t.Errorf("models[%q]: accepted content type %q: %v", name, ct, err)
+				}
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("loaded config fails validation again: %v", err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// defaultConfigCachePath is where the last-known-good config is kept
+	// unless CONFIG_CACHE_PATH says otherwise.
+	defaultConfigCachePath = "/tmp/aspendos-router-config.json"
+	// configRetryInterval is how often the config file is retried while
+	// the router runs on its last-known-good copy.
+	configRetryInterval = 15 * time.Second
+)
+
+// cachedConfig is the last-known-good copy of the config file: the last
+// document that loaded and validated, with the version it loaded as, so a
+// pod that starts with a broken file can still route. Environment
+// overrides are not part of it; they are applied again when it is read.
+type cachedConfig struct {
+	Version string          `json:"version"`
+	Path    string          `json:"path"`
+	SavedAt time.Time       `json:"saved_at"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// saveConfigCache writes cfg, loaded from path, to cachePath. The file is
+// replaced in one rename, so a crash mid-write leaves the previous copy,
+// and is readable only by the router, as the config may hold provider keys.
+func saveConfigCache(cachePath, path string, cfg *Config) error {
+	if len(cfg.source) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(cachedConfig{Version: cfg.Version, Path: path, SavedAt: time.Now().UTC(), Config: cfg.source})
+	if err != nil {
+		return fmt.Errorf("config cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".config-cache-*")
+	if err != nil {
+		return fmt.Errorf("config cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("config cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("config cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return fmt.Errorf("config cache: %w", err)
+	}
+	return nil
+}
+
+// loadConfigCache reads the last-known-good config from cachePath and
+// validates it again, keeping the version it was saved with.
+func loadConfigCache(cachePath string) (*Config, *cachedConfig, error) {
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read config cache %s: %w", cachePath, err)
+	}
+	var cached cachedConfig
+	if err := json.Unmarshal(data, &cached); err != nil || len(cached.Config) == 0 {
+		return nil, nil, fmt.Errorf("config cache %s: not a cached config", cachePath)
+	}
+	cfg, err := parseConfig(cachePath, cached.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.Version = cached.Version
+	return cfg, &cached, nil
+}
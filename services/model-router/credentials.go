@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// credentialPollInterval is how often credential files are re-read for a
+// rotated key.
+const credentialPollInterval = 5 * time.Second
+
+var errCredentialEmpty = errors.New("credential file is empty")
+
+// Credential is a provider's API key read from its api_key_file, such as
+// a mounted secret, and re-read every credentialPollInterval, so keys
+// rotate without a restart. Requests take the key as they are sent: those
+// already sent finish with the key they went with. A file that disappears
+// or is emptied leaves the last key read in use and its problem reported,
+// never an unauthenticated request.
+type Credential struct {
+	provider string
+	path     string
+	key      atomic.Pointer[string]
+	// problem is why the file last failed to read, nil while it reads.
+	problem atomic.Pointer[string]
+}
+
+// Key returns the key last read from the file.
+func (c *Credential) Key() string {
+	if k := c.key.Load(); k != nil {
+		return *k
+	}
+	return ""
+}
+
+// Problem returns why the file last failed to read, "" if it did not.
+func (c *Credential) Problem() string {
+	if p := c.problem.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// readCredential reads the key in path, without surrounding whitespace.
+func readCredential(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", errCredentialEmpty
+	}
+	return key, nil
+}
+
+// refresh re-reads the file and swaps in its key if it changed.
+func (c *Credential) refresh(m *metrics.Metrics, logger *slog.Logger) {
+	key, err := readCredential(c.path)
+	if err != nil {
+		problem := "credential file missing; using the last key read"
+		if errors.Is(err, errCredentialEmpty) {
+			problem = "credential file empty; using the last key read"
+		}
+		if c.problem.Swap(&problem) == nil {
+			logger.Warn("cannot read provider credential, keeping the last key read",
+				slog.String("provider", c.provider), slog.String("path", c.path), slog.String("error", err.Error()))
+		}
+		return
+	}
+	if c.problem.Swap(nil) != nil {
+		logger.Info("provider credential readable again", slog.String("provider", c.provider), slog.String("path", c.path))
+	}
+	if old := c.key.Swap(&key); old == nil || *old != key {
+		m.CredentialRotated(c.provider)
+		// Logged by fingerprint, never the key itself.
+		sum := sha256.Sum256([]byte(key))
+		logger.Info("provider credential rotated",
+			slog.String("provider", c.provider), slog.String("path", c.path), slog.String("key", "sha256:"+hex.EncodeToString(sum[:4])))
+	}
+}
+
+// credentialStore holds the credential of every api_key_file, by path,
+// across reloads; credentialFiles is the router's.
+type credentialStore struct {
+	mu    sync.Mutex
+	files map[string]*Credential
+}
+
+var credentialFiles = &credentialStore{files: make(map[string]*Credential)}
+
+// Get returns the credential in path, read now if it is new.
+func (s *credentialStore) Get(provider, path string) *Credential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.files[path]; ok {
+		return c
+	}
+	c := &Credential{provider: provider, path: path}
+	if key, err := readCredential(path); err == nil {
+		c.key.Store(&key)
+	} else {
+		problem := fmt.Sprintf("credential file unreadable: %v", err)
+		c.problem.Store(&problem)
+	}
+	s.files[path] = c
+	return c
+}
+
+// Watch re-reads every credential file each credentialPollInterval until
+// ctx is cancelled, counting rotations in m.
+func (s *credentialStore) Watch(ctx context.Context, m *metrics.Metrics, logger *slog.Logger) {
+	tick := time.NewTicker(credentialPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		s.mu.Lock()
+		files := make([]*Credential, 0, len(s.files))
+		for _, c := range s.files {
+			files = append(files, c)
+		}
+		s.mu.Unlock()
+		for _, c := range files {
+			c.refresh(m, logger)
+		}
+	}
+}
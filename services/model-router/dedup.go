@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// SingleFlightRouter coalesces identical concurrent requests for models
+// with deduplicate: true into one upstream call. Requests are identical
+// when model and body bytes match; every waiter gets a replay of the same
+// buffered response. Streamed requests are never coalesced; should the
+// upstream stream events anyway, the leader gets them as they come and
+// waiters the whole stream once it ends.
+type SingleFlightRouter struct {
+	registry *ModelRegistry
+	metrics  *metrics.Metrics
+	group    singleflight.Group
+}
+
+func NewSingleFlightRouter(registry *ModelRegistry, m *metrics.Metrics) *SingleFlightRouter {
+	return &SingleFlightRouter{registry: registry, metrics: m}
+}
+
+// bufferedResponse records a handler's full response so it can be
+// replayed to every caller sharing it. With live set, an event stream is
+// not held back: it goes to live as it is written, still recorded, and
+// streamed reports that it has been sent. Any other response is held
+// until the handler returns.
+type bufferedResponse struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	live     http.ResponseWriter
+	streamed bool
+	lost     bool
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status != 0 {
+		return
+	}
+	b.status = status
+	if b.live != nil && isEventStream(b.header) {
+		for k, v := range b.header {
+			b.live.Header()[k] = v
+		}
+		b.live.WriteHeader(status)
+		b.streamed = true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	b.body.Write(p)
+	if b.streamed && !b.lost {
+		// A client gone does not end a call others wait on; the rest
+		// is only recorded.
+		if _, err := b.live.Write(p); err != nil {
+			b.lost = true
+		}
+	}
+	return len(p), nil
+}
+
+// Flush passes an event stream's events on as they come.
+func (b *bufferedResponse) Flush() {
+	if b.streamed && !b.lost {
+		http.NewResponseController(b.live).Flush()
+	}
+}
+
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for k, v := range b.header {
+		if k != middleware.RequestIDHeader {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+func (s *SingleFlightRouter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isMultipart(r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req RouteRequest
+		if json.Unmarshal(body, &req) != nil || req.Model == "" || req.Stream {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry, ok := s.registry.Lookup(req.Model)
+		if !ok || !entry.Config.Deduplicate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		key := req.Model + "\x00" + hex.EncodeToString(sum[:])
+		if entry.Split != nil {
+			// Clients in different variants must not share an answer.
+			key += "\x00" + r.Header.Get(ClientIDHeader)
+		}
+		if tenant := middleware.RequestInfoFrom(r.Context()).Tenant(); tenant != "" {
+			key += "\x00" + tenant
+		}
+		leader := false
+		v, _, _ := s.group.Do(key, func() (any, error) {
+			leader = true
+			rec := &bufferedResponse{header: w.Header().Clone(), live: w}
+			// Waiters depend on this call, so it must outlive the leader's
+			// client if that one disconnects, though not an operator
+			// cancelling the leader.
+			ctx, stop := detachFromClient(r.Context())
+			defer stop()
+			lr := r.WithContext(ctx)
+			lr.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(rec, lr)
+			if cancelledByAdmin(ctx) && !rec.streamed {
+				rec = &bufferedResponse{header: make(http.Header)}
+				writeCancelled(rec)
+			}
+			return rec, nil
+		})
+		rec := v.(*bufferedResponse)
+		if leader && rec.streamed {
+			return
+		}
+		if !leader {
+			s.metrics.DeduplicatedRequest(req.Model)
+			if provider, model, ok := strings.Cut(rec.header.Get("X-Aspendos-Served-By"), "/"); ok {
+				middleware.RequestInfoFrom(r.Context()).SetRoute(model, provider)
+			}
+		}
+		rec.replay(w)
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	defaultDiscoveryRefresh = 10 * time.Second
+	// discoveryTimeout bounds each resolution, so a slow DNS server or API
+	// server never holds up a reload for long.
+	discoveryTimeout = 5 * time.Second
+)
+
+// serviceAccountDir holds the router's service account token, the
+// cluster's CA and the namespace the router runs in.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// DiscoveryConfig finds a provider's targets at run time, for
+// self-hosted servers that scale up and down, instead of from base_url.
+// DNS is a name, typically a headless Service, resolved to one target per
+// address; LabelSelector lists the ready pods it selects in Namespace
+// (default the router's own) through the Kubernetes API, which needs the
+// router to run in the cluster with permission to list pods. Either way
+// each target is Scheme (default http) on Port, and the set is refreshed
+// every RefreshInterval (default 10s).
+//
+// Each target becomes a backend of its own, named provider@address, with
+// its own breaker and any backend probes of the models routed to it;
+// like backends with their own url, targets are not covered by the
+// provider's concurrency or rate limits. A target that goes away only
+// takes new requests out of its way, so requests and streams it was
+// serving run to the end. A failed resolution keeps the last set.
+type DiscoveryConfig struct {
+	DNS             string   `json:"dns,omitempty"`
+	LabelSelector   string   `json:"label_selector,omitempty"`
+	Namespace       string   `json:"namespace,omitempty"`
+	Port            int      `json:"port"`
+	Scheme          string   `json:"scheme,omitempty"`
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+func validateDiscovery(dc DiscoveryConfig) error {
+	if (dc.DNS == "") == (dc.LabelSelector == "") {
+		return fmt.Errorf("exactly one of dns and label_selector is required")
+	}
+	if dc.Namespace != "" && dc.LabelSelector == "" {
+		return fmt.Errorf("namespace only applies to label_selector")
+	}
+	if dc.Port < 1 || dc.Port > 65535 {
+		return fmt.Errorf("port: %d is not a valid port", dc.Port)
+	}
+	if dc.Scheme != "" && dc.Scheme != "http" && dc.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if dc.RefreshInterval < 0 {
+		return fmt.Errorf("refresh_interval must not be negative")
+	}
+	return nil
+}
+
+func (dc DiscoveryConfig) withDefaults() DiscoveryConfig {
+	if dc.Scheme == "" {
+		dc.Scheme = "http"
+	}
+	if dc.RefreshInterval <= 0 {
+		dc.RefreshInterval = Duration(defaultDiscoveryRefresh)
+	}
+	return dc
+}
+
+// targetURL is the base URL of the target at addr.
+func (dc DiscoveryConfig) targetURL(addr string) string {
+	return dc.Scheme + "://" + net.JoinHostPort(addr, strconv.Itoa(dc.Port))
+}
+
+type resolver struct {
+	provider string
+	cfg      DiscoveryConfig
+	stop     context.CancelFunc
+	done     chan struct{}
+	// failing is set while resolution fails, so only the first failure
+	// in a row is logged. td.mu guards it.
+	failing bool
+}
+
+func (r *resolver) halt() {
+	if r.stop != nil {
+		r.stop()
+		<-r.done
+	}
+}
+
+// TargetDiscovery keeps the target set of every provider with discovery,
+// re-resolving each in a goroutine of its own, like HealthChecker's
+// probers. onChange runs, without the lock, whenever a set changes, for
+// the registry to rebuild its table with it.
+type TargetDiscovery struct {
+	metrics  *metrics.Metrics
+	logger   *slog.Logger
+	onChange func()
+
+	mu        sync.Mutex
+	ctx       context.Context
+	resolvers map[string]*resolver
+	// targets is the last set resolved for each provider, as base URLs
+	// in order.
+	targets map[string][]string
+}
+
+func NewTargetDiscovery(m *metrics.Metrics, logger *slog.Logger) *TargetDiscovery {
+	return &TargetDiscovery{
+		metrics:   m,
+		logger:    logger,
+		resolvers: make(map[string]*resolver),
+		targets:   make(map[string][]string),
+	}
+}
+
+// Start launches the resolvers configured so far and any added later;
+// they run until ctx ends or Stop is called.
+func (td *TargetDiscovery) Start(ctx context.Context) {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	td.ctx = ctx
+	for _, r := range td.resolvers {
+		if r.stop == nil {
+			td.launch(r)
+		}
+	}
+}
+
+// Stop ends every resolver and waits for them to exit.
+func (td *TargetDiscovery) Stop() {
+	td.mu.Lock()
+	resolvers := td.resolvers
+	td.resolvers = make(map[string]*resolver)
+	td.ctx = nil
+	td.mu.Unlock()
+	for _, r := range resolvers {
+		r.halt()
+	}
+}
+
+// Update starts, restarts or stops resolvers so they match cfg, and
+// returns the targets of each provider with discovery for the routing
+// table to build backends from. A provider new to discovery is resolved
+// before Update returns, so the table built with it has its targets.
+func (td *TargetDiscovery) Update(cfg *Config) map[string][]string {
+	if td == nil {
+		return nil
+	}
+	td.mu.Lock()
+	var stale []*resolver
+	for name, r := range td.resolvers {
+		pc, ok := cfg.Providers[name]
+		if !ok || pc.Discovery == nil || pc.Discovery.withDefaults() != r.cfg {
+			stale = append(stale, r)
+			delete(td.resolvers, name)
+			delete(td.targets, name)
+		}
+	}
+	var added []*resolver
+	for name, pc := range cfg.Providers {
+		if _, running := td.resolvers[name]; running || pc.Discovery == nil {
+			continue
+		}
+		r := &resolver{provider: name, cfg: pc.Discovery.withDefaults()}
+		td.resolvers[name] = r
+		added = append(added, r)
+	}
+	td.mu.Unlock()
+	// Stale resolvers are not waited for: one may be rebuilding the table
+	// itself, waiting for the build that called Update. Whatever it finds
+	// is dropped, since it is no longer td's resolver for the provider.
+	for _, r := range stale {
+		if r.stop != nil {
+			r.stop()
+		}
+	}
+	for _, r := range added {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		td.refresh(ctx, r)
+		cancel()
+	}
+
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	out := make(map[string][]string, len(td.targets))
+	for name, targets := range td.targets {
+		out[name] = targets
+	}
+	for _, r := range added {
+		if td.ctx != nil && td.resolvers[r.provider] == r && r.stop == nil {
+			td.launch(r)
+		}
+	}
+	return out
+}
+
+// launch starts r's goroutine; td.mu must be held.
+func (td *TargetDiscovery) launch(r *resolver) {
+	ctx, cancel := context.WithCancel(td.ctx)
+	r.stop, r.done = cancel, make(chan struct{})
+	go td.run(ctx, r)
+}
+
+func (td *TargetDiscovery) run(ctx context.Context, r *resolver) {
+	defer close(r.done)
+	ticker := time.NewTicker(time.Duration(r.cfg.RefreshInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		resolveCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+		changed := td.refresh(resolveCtx, r)
+		cancel()
+		if changed && ctx.Err() == nil && td.onChange != nil {
+			td.onChange()
+		}
+	}
+}
+
+// refresh resolves r's targets and reports whether the set changed. A
+// failed resolution, or one finding no targets at all, keeps the set as
+// it was: an empty answer is more often a DNS or API server hiccup than
+// every replica gone at once.
+func (td *TargetDiscovery) refresh(ctx context.Context, r *resolver) bool {
+	addrs, err := r.cfg.resolve(ctx)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no targets found")
+	}
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	if td.resolvers[r.provider] != r {
+		return false
+	}
+	prev, known := td.targets[r.provider]
+	if err != nil {
+		if !r.failing && !errors.Is(err, context.Canceled) {
+			td.logger.Warn("target discovery failed; keeping the last targets",
+				slog.String("provider", r.provider), slog.Int("targets", len(prev)), slog.String("error", err.Error()))
+		}
+		r.failing = true
+		return false
+	}
+	if r.failing {
+		r.failing = false
+		td.logger.Info("target discovery recovered", slog.String("provider", r.provider))
+	}
+	targets := make([]string, len(addrs))
+	for i, addr := range addrs {
+		targets[i] = r.cfg.targetURL(addr)
+	}
+	slices.Sort(targets)
+	if known && slices.Equal(prev, targets) {
+		return false
+	}
+	td.targets[r.provider] = targets
+	td.metrics.DiscoveredTargets(r.provider, len(targets))
+	added, removed := diffTargets(prev, targets)
+	td.logger.Info("discovered targets changed",
+		slog.String("provider", r.provider), slog.Int("targets", len(targets)),
+		slog.String("added", strings.Join(added, ",")), slog.String("removed", strings.Join(removed, ",")))
+	return true
+}
+
+// diffTargets lists the targets in next but not prev, and in prev but not
+// next. Both are sorted.
+func diffTargets(prev, next []string) (added, removed []string) {
+	for _, t := range next {
+		if _, found := slices.BinarySearch(prev, t); !found {
+			added = append(added, hostOf(t))
+		}
+	}
+	for _, t := range prev {
+		if _, found := slices.BinarySearch(next, t); !found {
+			removed = append(removed, hostOf(t))
+		}
+	}
+	return added, removed
+}
+
+// resolve returns the addresses of dc's targets.
+func (dc DiscoveryConfig) resolve(ctx context.Context) ([]string, error) {
+	if dc.DNS != "" {
+		return net.DefaultResolver.LookupHost(ctx, dc.DNS)
+	}
+	return readyPods(ctx, dc.Namespace, dc.LabelSelector)
+}
+
+// podList is the part of a Kubernetes PodList discovery reads.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			DeletionTimestamp *string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// readyPods lists the IPs of the running, ready pods that selector selects
+// in namespace, through the API server of the cluster the router runs in,
+// with its service account. Terminating pods are left out so they can
+// drain.
+func readyPods(ctx context.Context, namespace, selector string) ([]string, error) {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil, errors.New("label_selector needs the router to run in a Kubernetes cluster")
+	}
+	if namespace == "" {
+		ns, err := serviceAccountNamespace()
+		if err != nil {
+			return nil, err
+		}
+		namespace = ns
+	}
+	resp, err := kubernetesGet(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods?labelSelector="+url.QueryEscape(selector))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods: Kubernetes API answered %s", resp.Status)
+	}
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+	var ips []string
+	for _, pod := range pods.Items {
+		if pod.Metadata.DeletionTimestamp != nil || pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				ips = append(ips, pod.Status.PodIP)
+				break
+			}
+		}
+	}
+	return ips, nil
+}
+
+// serviceAccountNamespace is the namespace the router runs in.
+func serviceAccountNamespace() (string, error) {
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// kubernetesGet sends a GET for path to the API server of the cluster the
+// router runs in, with its service account. Discovery reads only pods and
+// Services, so it speaks the API's REST directly rather than through
+// client-go, which would bring most of k8s.io in with it.
+func kubernetesGet(ctx context.Context, path string) (*http.Response, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster")
+	}
+	// The token is read each time: projected service account tokens are
+	// rotated in place.
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+net.JoinHostPort(host, port)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	return client.Do(req)
+}
+
+var (
+	kubernetesClientOnce sync.Once
+	kubernetesHTTPClient *http.Client
+	kubernetesClientErr  error
+)
+
+// kubernetesClient is an HTTP client trusting the cluster's CA.
+func kubernetesClient() (*http.Client, error) {
+	kubernetesClientOnce.Do(func() {
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			kubernetesClientErr = err
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			kubernetesClientErr = errors.New("no certificates in the service account's ca.crt")
+			return
+		}
+		kubernetesHTTPClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}}
+	})
+	return kubernetesHTTPClient, kubernetesClientErr
+}
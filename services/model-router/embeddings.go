@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const embeddingsPath = "/v1/embeddings"
+
+// embeddingInputs splits an embeddings request's input into the inputs it
+// embeds: a string, an array of token ids, or an array of either.
+func embeddingInputs(raw json.RawMessage) ([]json.RawMessage, error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || bytes.Equal(raw, []byte("null")):
+		return nil, errors.New("input is required")
+	case raw[0] == '"':
+		return []json.RawMessage{raw}, nil
+	}
+	var items []json.RawMessage
+	if raw[0] != '[' || json.Unmarshal(raw, &items) != nil {
+		return nil, errors.New("input must be a string or an array")
+	}
+	if len(items) == 0 {
+		return nil, errors.New("input must not be empty")
+	}
+	// An array of numbers is one tokenized input, not many.
+	if first := bytes.TrimSpace(items[0]); first[0] != '"' && first[0] != '[' {
+		return []json.RawMessage{raw}, nil
+	}
+	return items, nil
+}
+
+// EmbeddingBatcher coalesces the embeddings requests for a model that
+// arrive within its embedding_batch_window into one upstream call, for
+// providers that charge per request. Requests are only combined when
+// everything but their input matches. A batch is sent early once the next
+// request would take it past embedding_max_batch_size inputs, and a
+// request that alone reaches the limit is sent by itself.
+//
+// Each caller gets the vectors of its own inputs, in order, with usage
+// shared out by input count. When the upstream call fails every caller
+// gets the same error, or the same status and body. The call runs under
+// the deadline and trace of the request that opened the batch.
+type EmbeddingBatcher struct {
+	rt      *Router
+	mu      sync.Mutex
+	pending map[string]*embeddingBatch
+}
+
+func newEmbeddingBatcher(rt *Router) *EmbeddingBatcher {
+	return &EmbeddingBatcher{rt: rt, pending: make(map[string]*embeddingBatch)}
+}
+
+// embeddingBatch is the requests waiting to go out together. Everything
+// but calls, size and hint is taken from the first request.
+type embeddingBatch struct {
+	key     string
+	ctx     context.Context
+	model   string
+	entries []*ModelEntry
+	fields  map[string]json.RawMessage // the request without its input
+	header  http.Header
+	hint    RouteHint
+	timeout time.Duration
+	calls   []*embeddingCall
+	size    int // inputs across calls
+	timer   *time.Timer
+}
+
+type embeddingCall struct {
+	ctx    context.Context
+	inputs []json.RawMessage
+	done   chan upstreamResult
+}
+
+// Send adds body to the model's open batch, or opens one, and waits for
+// the batch's result.
+func (b *EmbeddingBatcher) Send(ctx context.Context, model string, entries []*ModelEntry, body []byte, header http.Header, hint RouteHint, timeout time.Duration) upstreamResult {
+	cfg := entries[0].Config
+	limit := cfg.embeddingMaxBatchSize()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return b.rt.send(ctx, embeddingsPath, model, entries, body, header, hint)
+	}
+	inputs, err := embeddingInputs(fields["input"])
+	if err != nil || len(inputs) >= limit {
+		return b.rt.send(ctx, embeddingsPath, model, entries, body, header, hint)
+	}
+	delete(fields, "input")
+	key, _ := json.Marshal(fields)
+	if entries[0].Split != nil {
+		// Variants are assigned per client, so clients cannot share calls.
+		key = append(key, hint.ClientID...)
+	}
+	if tenant := middleware.RequestInfoFrom(ctx).Tenant(); tenant != "" {
+		// Each tenant's inputs go upstream under its own key.
+		key = append(append(key, 0), tenant...)
+	}
+	call := &embeddingCall{ctx: ctx, inputs: inputs, done: make(chan upstreamResult, 1)}
+
+	b.mu.Lock()
+	batch := b.pending[string(key)]
+	if batch != nil && batch.size+len(inputs) > limit {
+		b.flushLocked(batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &embeddingBatch{
+			key:     string(key),
+			ctx:     ctx,
+			model:   model,
+			entries: entries,
+			fields:  fields,
+			header:  header,
+			hint:    hint,
+			timeout: timeout,
+		}
+		b.pending[batch.key] = batch
+		batch.timer = time.AfterFunc(time.Duration(cfg.EmbeddingBatchWindow), func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.pending[batch.key] == batch {
+				b.flushLocked(batch)
+			}
+		})
+	} else {
+		batch.hint.InputTokens += hint.InputTokens
+		batch.hint.OutputTokens += hint.OutputTokens
+	}
+	batch.calls = append(batch.calls, call)
+	batch.size += len(inputs)
+	if batch.size == limit {
+		b.flushLocked(batch)
+	}
+	b.mu.Unlock()
+	return <-call.done
+}
+
+// flushLocked closes batch to new requests and sends it.
+func (b *EmbeddingBatcher) flushLocked(batch *embeddingBatch) {
+	delete(b.pending, batch.key)
+	batch.timer.Stop()
+	go b.run(batch)
+}
+
+func (b *EmbeddingBatcher) run(batch *embeddingBatch) {
+	inputs := make([]json.RawMessage, 0, batch.size)
+	for _, c := range batch.calls {
+		inputs = append(inputs, c.inputs...)
+	}
+	batch.fields["input"], _ = json.Marshal(inputs)
+	body, _ := json.Marshal(batch.fields)
+
+	// The batch must not be canceled with the request that happened to
+	// open it while others are waiting on it.
+	ctx, cancel := context.WithTimeoutCause(context.WithoutCancel(batch.ctx), batch.timeout, errRequestTimeout)
+	defer cancel()
+	res := b.rt.send(ctx, embeddingsPath, batch.model, batch.entries, body, batch.header, batch.hint)
+	b.rt.logger.Debug("embeddings batch sent",
+		slog.String("model", batch.model),
+		slog.Int("requests", len(batch.calls)),
+		slog.Int("inputs", batch.size),
+		slog.String("outcome", res.reason()))
+
+	results := splitEmbeddings(res, batch.calls)
+	for i, c := range batch.calls {
+		if res.backend != nil {
+			info := middleware.RequestInfoFrom(c.ctx)
+			info.SetRoute(res.model, res.backend.Provider.Name)
+			info.SetBackendURL(res.backend.Provider.BaseURL)
+			info.SetDecision(res.decision.String())
+			if res.variant != "" {
+				info.SetVariant(res.variant)
+			}
+		}
+		c.done <- results[i]
+	}
+}
+
+// splitEmbeddings gives each call its share of the batch's result. A
+// successful response is cut up by input; anything else is repeated.
+func splitEmbeddings(res upstreamResult, calls []*embeddingCall) []upstreamResult {
+	out := make([]upstreamResult, len(calls))
+	for i := range out {
+		out[i] = res
+	}
+	if res.backend == nil || res.err != nil {
+		return out
+	}
+	body, err := io.ReadAll(res.resp.Body)
+	res.resp.Body.Close()
+	if err == nil && res.resp.StatusCode == http.StatusOK {
+		var bodies [][]byte
+		if bodies, err = splitEmbeddingsBody(body, calls); err == nil {
+			for i := range out {
+				out[i].resp = cloneResponse(res.resp, bodies[i])
+			}
+			return out
+		}
+	}
+	for i := range out {
+		if err != nil {
+			out[i].resp, out[i].err = nil, err
+		} else {
+			out[i].resp = cloneResponse(res.resp, body)
+		}
+	}
+	return out
+}
+
+// splitEmbeddingsBody cuts an embeddings response into one per call, each
+// with its vectors indexed from 0 and its share of the usage.
+func splitEmbeddingsBody(body []byte, calls []*embeddingCall) ([][]byte, error) {
+	var doc map[string]json.RawMessage
+	var data []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("embeddings response: %w", err)
+	}
+	if err := json.Unmarshal(doc["data"], &data); err != nil {
+		return nil, fmt.Errorf("embeddings response data: %w", err)
+	}
+	size := 0
+	for _, c := range calls {
+		size += len(c.inputs)
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("upstream returned %d embeddings for %d inputs", len(data), size)
+	}
+	ordered := make([]map[string]json.RawMessage, size)
+	for _, d := range data {
+		var i int
+		if err := json.Unmarshal(d["index"], &i); err != nil || i < 0 || i >= size || ordered[i] != nil {
+			return nil, fmt.Errorf("upstream returned embedding index %s for %d inputs", d["index"], size)
+		}
+		ordered[i] = d
+	}
+	var usage struct {
+		PromptTokens int64 `json:"prompt_tokens"`
+		TotalTokens  int64 `json:"total_tokens"`
+	}
+	_, hasUsage := doc["usage"]
+	json.Unmarshal(doc["usage"], &usage)
+
+	bodies := make([][]byte, len(calls))
+	var off int
+	var prompt, total int64
+	for i, c := range calls {
+		part := ordered[off : off+len(c.inputs)]
+		for j, d := range part {
+			d["index"] = json.RawMessage(strconv.Itoa(j))
+		}
+		off += len(c.inputs)
+		doc["data"], _ = json.Marshal(part)
+		if hasUsage {
+			// The last call takes the rounding remainder, so the shares add
+			// up to what the upstream charged.
+			share := usage
+			if i < len(calls)-1 {
+				share.PromptTokens = usage.PromptTokens * int64(off) / int64(size)
+				share.TotalTokens = usage.TotalTokens * int64(off) / int64(size)
+			}
+			share.PromptTokens, prompt = share.PromptTokens-prompt, share.PromptTokens
+			share.TotalTokens, total = share.TotalTokens-total, share.TotalTokens
+			doc["usage"], _ = json.Marshal(share)
+		}
+		bodies[i], _ = json.Marshal(doc)
+	}
+	return bodies, nil
+}
+
+// cloneResponse copies resp's status and headers around body.
+func cloneResponse(resp *http.Response, body []byte) *http.Response {
+	clone := *resp
+	clone.Header = resp.Header.Clone()
+	clone.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	clone.ContentLength = int64(len(body))
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	return &clone
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/bufbuild/protocompile/linker"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// BodyTransformer re-encodes the JSON the router works with for backends
+// that take a binary format. Requests are encoded last, after transforms,
+// adapters and plugins, and responses in the backend's format are decoded
+// first, so everything else in the router, and the client, only ever sees
+// JSON. Responses in any other format, such as JSON errors and event
+// streams, pass through untouched.
+type BodyTransformer interface {
+	// ContentType is the media type of encoded bodies.
+	ContentType() string
+	// EncodeRequest converts a JSON request body.
+	EncodeRequest(body []byte) ([]byte, error)
+	// DecodeResponse converts a response body back to JSON.
+	DecodeResponse(body []byte) ([]byte, error)
+}
+
+// newBodyTransformer returns the transformer for bc's request_encoding,
+// or nil for JSON.
+func newBodyTransformer(bc BackendConfig) (BodyTransformer, error) {
+	switch bc.RequestEncoding {
+	case "", "json":
+		return nil, nil
+	case "msgpack":
+		return msgpackTransformer{}, nil
+	case "protobuf":
+		return newProtobufTransformer(bc.ProtoFile, bc.ProtoRequestMessage, bc.ProtoResponseMessage)
+	}
+	return nil, fmt.Errorf("request_encoding: unknown encoding %q (want json, msgpack or protobuf)", bc.RequestEncoding)
+}
+
+// failedTransformer fails every request of a backend whose schema could
+// not be compiled.
+type failedTransformer struct{ err error }
+
+func (failedTransformer) ContentType() string                     { return "" }
+func (t failedTransformer) EncodeRequest([]byte) ([]byte, error)  { return nil, t.err }
+func (t failedTransformer) DecodeResponse([]byte) ([]byte, error) { return nil, t.err }
+
+// encodingError is a request body the backend's encoding could not
+// represent, which is the client's fault rather than the upstream's.
+type encodingError struct{ err error }
+
+func (e *encodingError) Error() string { return e.err.Error() }
+func (e *encodingError) Unwrap() error { return e.err }
+
+// encodeRequest returns body and header as sent to a backend encoding
+// with t.
+func encodeRequest(t BodyTransformer, body []byte, header http.Header) ([]byte, http.Header, error) {
+	if f, ok := t.(failedTransformer); ok {
+		return nil, nil, f.err
+	}
+	encoded, err := t.EncodeRequest(body)
+	if err != nil {
+		return nil, nil, &encodingError{err}
+	}
+	header = header.Clone()
+	header.Set("Content-Type", t.ContentType())
+	return encoded, header, nil
+}
+
+// decodeResponse swaps resp's body for its JSON form when the backend
+// answered in t's format.
+func decodeResponse(t BodyTransformer, resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != t.ContentType() {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	out, err := t.DecodeResponse(body)
+	if err != nil {
+		return fmt.Errorf("decode %s response: %w", mediaType, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// msgpackTransformer maps JSON to MessagePack value for value. Whole JSON
+// numbers become integers and the rest floats.
+type msgpackTransformer struct{}
+
+func (msgpackTransformer) ContentType() string { return "application/msgpack" }
+
+func (msgpackTransformer) EncodeRequest(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(msgpackNumbers(v))
+}
+
+func (msgpackTransformer) DecodeResponse(body []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// msgpackNumbers replaces the json.Numbers in v, which msgpack would
+// encode as strings.
+func msgpackNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = msgpackNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = msgpackNumbers(e)
+		}
+	}
+	return v
+}
+
+// protobufTransformer maps JSON to the request message of a .proto schema
+// and the response message back, with protobuf's JSON mapping, so fields
+// keep their names as written in the .proto. Request fields the schema
+// does not have are dropped.
+type protobufTransformer struct {
+	request, response protoreflect.MessageDescriptor
+}
+
+// newProtobufTransformer compiles the .proto file at path, resolving its
+// imports from the file's directory, and looks up the two messages by full
+// name, e.g. "inference.GenerateRequest".
+func newProtobufTransformer(path, request, response string) (*protobufTransformer, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: []string{filepath.Dir(path)}}),
+	}
+	files, err := compiler.Compile(context.Background(), filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("proto_file: %w", err)
+	}
+	resolver := linker.ResolverFromFile(files[0])
+	t := &protobufTransformer{}
+	for _, m := range []struct {
+		field string
+		name  string
+		dst   *protoreflect.MessageDescriptor
+	}{
+		{"proto_request_message", request, &t.request},
+		{"proto_response_message", response, &t.response},
+	} {
+		d, err := resolver.FindDescriptorByName(protoreflect.FullName(m.name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not defined in %s", m.field, m.name, path)
+		}
+		md, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s: %q is not a message", m.field, m.name)
+		}
+		*m.dst = md
+	}
+	return t, nil
+}
+
+func (*protobufTransformer) ContentType() string { return "application/x-protobuf" }
+
+func (t *protobufTransformer) EncodeRequest(body []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(t.request)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+func (t *protobufTransformer) DecodeResponse(body []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(t.response)
+	if err := proto.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// checkEnvelope fails t unless rec is the error envelope with status and
+// code, its type following the status and its request ID the response's.
+func checkEnvelope(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) apierror.Detail {
+	t.Helper()
+	var resp apierror.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d body %q is not the envelope: %v", rec.Code, rec.Body, err)
+	}
+	wantType := "invalid_request_error"
+	if status >= 500 {
+		wantType = "api_error"
+	}
+	e := resp.Error
+	if rec.Code != status || e.Code != code || e.Type != wantType || e.Message == "" {
+		t.Errorf("%d %+v, want %d %s of type %s", rec.Code, e, status, code, wantType)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if id := rec.Header().Get("X-Request-ID"); id == "" || e.RequestID != id {
+		t.Errorf("request_id = %q, want the X-Request-ID %q", e.RequestID, id)
+	}
+	return e
+}
+
+// Every handler answers its errors in the envelope, with the code clients
+// branch on, whichever layer turns the request away.
+func TestErrorEnvelope(t *testing.T) {
+	// Each model's provider answers with the status its base URL names.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.Split(r.URL.Path, "/")[1])
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"message":"upstream says no"}}`))
+	}))
+	defer down.Close()
+	cfg := testConfig(t, fmt.Sprintf(`
+server: {max_request_bytes: 1024}
+providers:
+  a: {base_url: %s/500}
+  b: {base_url: %[1]s/503}
+models:
+  m: {provider: a}
+  e: {provider: a}
+  c: {canary: {stable: {provider: a}, canary: {provider: b}, initial_canary_weight: 10}}
+  upstream-400: {url: "%[1]s/400"}
+  upstream-401: {url: "%[1]s/401"}
+  upstream-404: {url: "%[1]s/404"}
+  upstream-429: {url: "%[1]s/429"}
+  upstream-504: {url: "%[1]s/504"}
+auth:
+  keys:
+    - {name: client, key: sk-client}
+`, down.URL))
+	rt := newTestRouter(t, cfg)
+	auth, err := middleware.NewAuth(*cfg.Auth, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := routeChain(t, rt)
+	mux := http.NewServeMux()
+	mux.Handle("POST "+chatCompletionsPath, chat)
+	mux.Handle("POST "+batchPath, rt.Batch(chat))
+	mux.HandleFunc("POST "+embeddingsPath, rt.handleEmbeddings)
+	mux.HandleFunc("POST /v1/audio/transcriptions", rt.handleUpload)
+	mux.HandleFunc("GET /v1/usage", rt.handleUsage)
+	mux.HandleFunc("POST /panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	h := middleware.Chain(withErrorEnvelope(mux), middleware.RequestID, middleware.Logging(testLogger()), middleware.Recover(testLogger()), auth.Middleware)
+	// The admin API is served on a port of its own, with its own token.
+	admin := middleware.RequestID(NewAdmin(rt.registry, NewInFlight(), "sk-admin", testLogger()).Handler())
+
+	const chatBody = `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		header map[string]string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "no key", path: chatCompletionsPath, key: "-", body: chatBody, status: http.StatusUnauthorized, code: "missing_api_key"},
+		{name: "wrong key", path: chatCompletionsPath, key: "sk-guess", body: chatBody, status: http.StatusUnauthorized, code: "invalid_api_key"},
+		{name: "unknown path", path: "/v1/nothing", body: chatBody, status: http.StatusNotFound, code: "not_found"},
+		{name: "wrong method", method: http.MethodGet, path: chatCompletionsPath, status: http.StatusMethodNotAllowed, code: "method_not_allowed"},
+		{name: "panic", path: "/panic", status: http.StatusInternalServerError, code: apierror.CodeInternal},
+		{name: "malformed json", path: chatCompletionsPath, body: `{"model":`, status: http.StatusBadRequest, code: "invalid_json"},
+		{name: "missing model", path: chatCompletionsPath, body: `{"messages":[{}]}`, status: http.StatusBadRequest, code: "missing_model"},
+		{name: "empty messages", path: chatCompletionsPath, body: `{"model":"m","messages":[]}`, status: http.StatusBadRequest, code: "empty_messages"},
+		{name: "unknown model", path: chatCompletionsPath, body: `{"model":"nope","messages":[{}]}`, status: http.StatusNotFound, code: apierror.CodeModelNotFound},
+		{name: "too large", path: chatCompletionsPath, body: `{"model":"m","messages":[{"content":"` + strings.Repeat("x", 2048) + `"}]}`, status: http.StatusRequestEntityTooLarge, code: "request_too_large"},
+		{name: "long idempotency key", path: chatCompletionsPath, header: map[string]string{"Idempotency-Key": strings.Repeat("k", 1000)}, body: chatBody, status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "upstream failure", path: chatCompletionsPath, body: chatBody, status: http.StatusBadGateway, code: apierror.CodeProviderUnavailable},
+		{name: "upstream 404", path: chatCompletionsPath, body: `{"model":"upstream-404","messages":[{}]}`, status: http.StatusNotFound, code: apierror.CodeModelNotFound},
+		{name: "upstream 429", path: chatCompletionsPath, body: `{"model":"upstream-429","messages":[{}]}`, status: http.StatusTooManyRequests, code: apierror.CodeRateLimited},
+		{name: "upstream 401", path: chatCompletionsPath, body: `{"model":"upstream-401","messages":[{}]}`, status: http.StatusBadGateway, code: apierror.CodeProviderUnavailable},
+		{name: "upstream 504", path: chatCompletionsPath, body: `{"model":"upstream-504","messages":[{}]}`, status: http.StatusGatewayTimeout, code: apierror.CodeTimeout},
+		{name: "upstream 400", path: chatCompletionsPath, body: `{"model":"upstream-400","messages":[{}]}`, status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "batch override", path: batchPath, header: map[string]string{ModelOverrideHeader: "m"}, body: `{"models":["m"]}`, status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "embeddings without input", path: embeddingsPath, body: `{"model":"e"}`, status: http.StatusBadRequest, code: "invalid_input"},
+		{name: "upload not multipart", path: "/v1/audio/transcriptions", body: chatBody, status: http.StatusUnsupportedMediaType, code: "unsupported_content_type"},
+		{name: "usage since", method: http.MethodGet, path: "/v1/usage?since=yesterday", status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "usage of another key", method: http.MethodGet, path: "/v1/usage?key=other", status: http.StatusForbidden, code: "forbidden"},
+		{name: "admin token", method: http.MethodGet, path: "/admin/models", key: "sk-client", status: http.StatusUnauthorized, code: "invalid_api_key"},
+		{name: "explain unknown model", path: "/v1/explain", body: `{"model":"nope"}`, status: http.StatusNotFound, code: apierror.CodeModelNotFound},
+		{name: "admin weight", method: http.MethodPut, path: "/admin/models/m/weight", body: `{"weight":-1}`, status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "admin unknown model", method: http.MethodDelete, path: "/admin/models/nope", status: http.StatusNotFound, code: apierror.CodeModelNotFound},
+		{name: "admin canary weight", method: http.MethodPut, path: "/admin/models/c/canary-weight", body: `{"weight":101}`, status: http.StatusBadRequest, code: apierror.CodeInvalidRequest},
+		{name: "admin unknown request", method: http.MethodDelete, path: "/admin/inflight/nope", status: http.StatusNotFound, code: "request_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			handler, key := h, "sk-client"
+			if strings.HasPrefix(tt.path, "/admin/") || tt.path == "/v1/explain" {
+				handler, key = admin, "sk-admin"
+			}
+			if tt.key != "" {
+				key = tt.key
+			}
+			req := httptest.NewRequest(method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if key != "-" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			checkEnvelope(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+// Whatever a provider answers with, and however the request to it fails,
+// the router's key for it and the provider's address never reach the
+// client.
+func TestUpstreamErrorRedacted(t *testing.T) {
+	var echo string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, strings.NewReplacer("$KEY", strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), "$HOST", r.Host).Replace(echo))
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	host := func(raw string) string { u, _ := url.Parse(raw); return u.Host }
+
+	// A key of no known shape is only taken out because it is the
+	// provider's.
+	const prefixed, unprefixed = "sk-router-0123456789abcdef", "router0123456789abcdef"
+	tests := []struct {
+		name    string
+		baseURL string
+		key     string
+		echo    string
+	}{
+		{name: "key in message", baseURL: upstream.URL, key: prefixed, echo: `{"error":{"message":"Incorrect API key provided: $KEY"}}`},
+		{name: "key of no known shape", baseURL: upstream.URL, key: unprefixed, echo: `{"error":{"message":"key $KEY is disabled"}}`},
+		{name: "authorization echoed", baseURL: upstream.URL, key: unprefixed, echo: `{"detail":"Authorization: Bearer $KEY"}`},
+		{name: "internal url", baseURL: upstream.URL, key: unprefixed, echo: `{"message":"proxy to http://$HOST/v1/chat/completions failed"}`},
+		{name: "bare host", baseURL: upstream.URL, key: unprefixed, echo: "connect to $HOST refused by $HOST"},
+		{name: "plain text with both", baseURL: upstream.URL, key: unprefixed, echo: "upstream http://$HOST rejected $KEY"},
+		{name: "connection refused", baseURL: closed.URL, key: prefixed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo = tt.echo
+			rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s, api_key: %s}
+models:
+  m: {provider: a}
+`, tt.baseURL, tt.key)))
+			req, _ := middleware.WithRequestInfo(chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+			rec := httptest.NewRecorder()
+			middleware.RequestID(routeChain(t, rt)).ServeHTTP(rec, req)
+			e := checkEnvelope(t, rec, http.StatusBadGateway, apierror.CodeProviderUnavailable)
+			body := rec.Body.String()
+			for _, leak := range []string{tt.key, tt.baseURL, host(tt.baseURL)} {
+				if strings.Contains(body, leak) {
+					t.Errorf("body %s contains %q", body, leak)
+				}
+			}
+			if tt.echo != "" && e.ProviderDetail == "" {
+				t.Errorf("provider_detail is empty, want the provider's message redacted")
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Target is the backend chosen for a request, with the entry and, for
+// traffic splits and canaries, the variant, for blue-green models, the
+// slot or, for models with routing policies, the pool it came from.
+type Target struct {
+	Entry    *ModelEntry
+	Pool     string
+	Variant  *Variant
+	Slot     *blueGreenSlot
+	Backend  *Backend
+	Decision Decision
+}
+
+// TargetRequest is what choosing a target for a request reads: the
+// entries LookupFor found for its model, in routing order, and the hint
+// built from the request. Explain asks for an Explanation and for nothing
+// to change, so explaining a request never moves the routing of the next.
+type TargetRequest struct {
+	Entries []*ModelEntry
+	Hint    RouteHint
+	Explain bool
+}
+
+// errNoTarget is every entry of a request having no backend available.
+var errNoTarget = errors.New("no backend available")
+
+// Explanation is how a request would be routed: the rules looked at for
+// its model, every pool tried and its backends, and the target chosen.
+type Explanation struct {
+	Model    string             `json:"model"`
+	Rules    []RuleExplanation  `json:"rules"`
+	Pools    []PoolExplanation  `json:"pools"`
+	Selected *TargetExplanation `json:"selected,omitempty"`
+	Outcome  string             `json:"outcome"`
+	// Fallbacks are the models tried in order if the selected target
+	// fails.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+// RuleExplanation is one model key or rule considered for a request.
+// Kind is exact, glob or conditional.
+type RuleExplanation struct {
+	Match    string `json:"match"`
+	Kind     string `json:"kind"`
+	Priority int    `json:"priority,omitempty"`
+	Matched  bool   `json:"matched"`
+	Reason   string `json:"reason"`
+}
+
+// PoolExplanation is one pool tried for a request: an entry's, or that of
+// one of its variants or slots.
+type PoolExplanation struct {
+	Entry    string               `json:"entry"`
+	Pool     string               `json:"pool,omitempty"`
+	Variant  string               `json:"variant,omitempty"`
+	Slot     string               `json:"slot,omitempty"`
+	Strategy string               `json:"strategy"`
+	Failover bool                 `json:"failover,omitempty"`
+	Backends []BackendExplanation `json:"backends"`
+	Selected string               `json:"selected,omitempty"`
+}
+
+// BackendExplanation is a backend of a pool and its state. Excluded says
+// why a backend that is not a candidate is not.
+type BackendExplanation struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Weight      int    `json:"weight"`
+	Breaker     string `json:"breaker"`
+	Health      string `json:"health"`
+	RateLimited bool   `json:"rate_limited,omitempty"`
+	Warmup      string `json:"warmup,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Candidate   bool   `json:"candidate"`
+	Excluded    string `json:"excluded,omitempty"`
+}
+
+// TargetExplanation is the target chosen, with the decision as the
+// X-Aspendos-Route-Decision header would give it.
+type TargetExplanation struct {
+	Entry    string `json:"entry"`
+	Pool     string `json:"pool,omitempty"`
+	Variant  string `json:"variant,omitempty"`
+	Slot     string `json:"slot,omitempty"`
+	Backend  string `json:"backend"`
+	URL      string `json:"url"`
+	Decision string `json:"decision"`
+}
+
+// SelectTarget chooses the backend for a request: the first entry whose
+// pool, or variant's, active slot's or policy-chosen pool, has a backend
+// available. A canary with none passes its share to the stable
+// deployment. Every routed request goes through here, and so does POST
+// /v1/explain, with Explain set.
+func SelectTarget(req TargetRequest) (Target, Explanation, error) {
+	var ex Explanation
+	try := func(t *Target, pool *BackendPool) bool {
+		var pe *PoolExplanation
+		if req.Explain {
+			ex.Pools = append(ex.Pools, PoolExplanation{Entry: t.Entry.Name, Pool: t.Pool})
+			pe = &ex.Pools[len(ex.Pools)-1]
+			if t.Variant != nil {
+				pe.Variant = t.Variant.Name
+			}
+			if t.Slot != nil {
+				pe.Slot = t.Slot.Name
+			}
+		}
+		t.Backend, t.Decision = pool.next(req.Hint, pe)
+		t.Decision.Pool = t.Pool
+		if pe != nil && t.Backend != nil {
+			pe.Strategy, pe.Selected = t.Decision.Strategy, t.Backend.Name()
+		}
+		return t.Backend != nil
+	}
+	for _, e := range req.Entries {
+		t := Target{Entry: e}
+		pool := e.Pool
+		switch {
+		case e.BlueGreen != nil:
+			t.Slot = e.BlueGreen.Active()
+			pool = t.Slot.Pool
+		case e.Canary != nil:
+			t.Variant = e.Canary.Pick(req.Hint)
+			pool = t.Variant.Pool
+		case e.Split != nil:
+			t.Variant = e.Split.Assign(req.Hint.ClientID, time.Now())
+			pool = t.Variant.Pool
+		case e.Policies != nil:
+			var err error
+			if pool, t.Pool, err = e.Policies.Select(req.Hint.Request); err != nil {
+				ex.Outcome = err.Error()
+				return Target{}, ex, err
+			}
+		}
+		if try(&t, pool) {
+			ex.chose(t)
+			return t, ex, nil
+		}
+		if c := e.Canary; c != nil && t.Variant == c.canary {
+			t.Variant = c.stable
+			if try(&t, c.stable.Pool) {
+				ex.chose(t)
+				return t, ex, nil
+			}
+		}
+		if t.Slot != nil && !req.Explain {
+			e.BlueGreen.Observe(t.Slot, true)
+		}
+	}
+	ex.Outcome = errNoTarget.Error()
+	return Target{}, ex, errNoTarget
+}
+
+func (ex *Explanation) chose(t Target) {
+	ex.Selected = &TargetExplanation{
+		Entry:    t.Entry.Name,
+		Pool:     t.Pool,
+		Backend:  t.Backend.Name(),
+		URL:      t.Backend.Provider.BaseURL,
+		Decision: t.Decision.String(),
+	}
+	if t.Variant != nil {
+		ex.Selected.Variant = t.Variant.Name
+	}
+	if t.Slot != nil {
+		ex.Selected.Slot = t.Slot.Name
+	}
+	ex.Outcome = "routed to " + t.Backend.Name()
+}
+
+// record fills pe from pool p, whose backends of the region chosen are
+// backends and whose candidates are candidates. The pool's lock is held.
+func (pe *PoolExplanation) record(p *BackendPool, backends, candidates []*Backend, failover bool) {
+	pe.Strategy, pe.Failover = p.strategy.Name(), failover
+	pe.Backends = make([]BackendExplanation, 0, len(p.backends))
+	for _, b := range p.backends {
+		be := BackendExplanation{
+			Name:        b.Name(),
+			URL:         b.Provider.BaseURL,
+			Weight:      b.Weight,
+			Breaker:     "none",
+			Health:      "unchecked",
+			RateLimited: b.RateLimit.Limited(),
+			Candidate:   slices.Contains(candidates, b),
+		}
+		if b.Breaker != nil {
+			be.Breaker = b.Breaker.State().String()
+		}
+		if b.Health != nil {
+			be.Health = b.Health.status().Status
+		}
+		if b.Warmup != nil {
+			be.Warmup = b.Warmup.String()
+		}
+		if p.regions != nil {
+			be.Region = "primary"
+			if p.regions.failover[b] {
+				be.Region = "failover"
+			}
+		}
+		switch {
+		case be.Candidate:
+		case !slices.Contains(backends, b):
+			be.Excluded = "not in the region serving"
+		case b.Warmup.Degraded():
+			be.Excluded = "warm-up timed out; other backends are ready"
+		default:
+			be.Excluded = unavailable(b)
+		}
+		pe.Backends = append(pe.Backends, be)
+	}
+}
+
+// explainRequest is the part of a chat completion body routing looks at.
+type explainRequest struct {
+	Model   string          `json:"model"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// explain serves POST /v1/explain: it takes a chat completion or /route
+// body, with the headers the router reads, and answers with how the
+// request would be routed now, without sending it anywhere. Tenant routing
+// is not applied.
+func (a *Admin) explain(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.registry.MaxBodyBytes()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+		return
+	}
+	var req explainRequest
+	if err := json.Unmarshal(body, &req); err != nil || req.Model == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", `body must be a chat completion request with a "model"`)
+		return
+	}
+	routed := body
+	if len(req.Payload) > 0 {
+		routed = req.Payload
+	}
+	ex := Explanation{Model: req.Model}
+	entries := a.registry.lookupFor(req.Model, routed, &ex)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "model_not_found", "no provider configured for model "+req.Model)
+		return
+	}
+	_, selection, _ := SelectTarget(TargetRequest{Entries: entries, Hint: newRouteHint(routed, r), Explain: true})
+	ex.Pools, ex.Selected, ex.Outcome = selection.Pools, selection.Selected, selection.Outcome
+	ex.Fallbacks = entries[0].Config.Fallbacks
+	writeJSON(w, http.StatusOK, ex)
+}
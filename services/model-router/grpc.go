@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+const (
+	kserveInferMethod       = "/inference.GRPCInferenceService/ModelInfer"
+	kserveStreamInferMethod = "/inference.GRPCInferenceService/ModelStreamInfer"
+	// grpcMaxMessageBytes bounds a single response message; Triton's own
+	// default leaves room for large output tensors.
+	grpcMaxMessageBytes = 64 << 20
+)
+
+// rawCodec passes messages through as already encoded bytes, which is
+// what lets the router speak the KServe protocol without generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return *v.(*[]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// GRPCBackend sends requests to a backend speaking the KServe v2 gRPC
+// inference protocol (Triton and compatible servers) and answers with an
+// *http.Response, JSON or an event stream, so the rest of the router
+// handles it like any HTTP backend: it is a Backend in its pool with the
+// usual breaker, retries, limiter and metrics. gRPC status codes become
+// the matching HTTP statuses.
+//
+// A KServe v2 JSON request (one with "inputs") is sent as is and answered
+// with a KServe v2 JSON response. A chat completion is sent as a text
+// generation request, the text_input/text_output convention of Triton's
+// LLM backends, and answered as an OpenAI chat completion. Streamed
+// requests use ModelStreamInfer, so the model must be decoupled.
+type GRPCBackend struct {
+	conn *grpc.ClientConn
+	// err fails every request of a backend that could not be set up.
+	err error
+}
+
+var (
+	grpcConnsMu sync.Mutex
+	// grpcConns shares connections across routing tables, so a reload does
+	// not reconnect; a connection no table uses any more goes idle and
+	// closes its transport after grpc's idle timeout.
+	grpcConns = make(map[string]*GRPCBackend)
+)
+
+// grpcBackendFor returns the gRPC backend at baseURL, connecting with TLS
+// for an https URL, using tlsCfg when the backend has its own settings.
+func grpcBackendFor(baseURL string, tlsCfg *tls.Config, tlsKey string) (*GRPCBackend, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	key := baseURL + "\x00" + tlsKey
+	grpcConnsMu.Lock()
+	defer grpcConnsMu.Unlock()
+	if b, ok := grpcConns[key]; ok {
+		return b, nil
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	}
+	conn, err := grpc.NewClient(u.Host,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{}), grpc.MaxCallRecvMsgSize(grpcMaxMessageBytes)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	b := &GRPCBackend{conn: conn}
+	grpcConns[key] = b
+	return b, nil
+}
+
+// grpc points p at its gRPC backend. Like tlsClient, a backend whose
+// certificates stopped loading since validation fails every request.
+func (tb *tableBuilder) grpc(p *Provider, bc BackendConfig) {
+	cfg, err := bc.tlsConfig()
+	if err == nil {
+		p.GRPC, err = grpcBackendFor(p.BaseURL, cfg, grpcTLSKey(bc))
+	}
+	if err != nil {
+		p.GRPC = &GRPCBackend{err: err}
+	}
+}
+
+// grpcTLSKey identifies a backend's TLS material by content, so rotated
+// certificates get a new connection on the next reload.
+func grpcTLSKey(bc BackendConfig) string {
+	if !bc.hasTLS() {
+		return ""
+	}
+	h := sha256.New()
+	for _, v := range []string{bc.TLSCACert, bc.TLSClientCert, bc.TLSClientKey} {
+		pem, _ := loadPEM(v)
+		h.Write(pem)
+		h.Write([]byte{0})
+	}
+	return string(h.Sum(nil))
+}
+
+// grpcMetadata carries the request headers worth forwarding, credentials
+// and trace context among them, as gRPC metadata.
+func grpcMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for name, values := range h {
+		switch strings.ToLower(name) {
+		case "content-type", "content-length", "accept", "accept-encoding", "user-agent", "connection", "te", "host":
+			continue
+		}
+		md.Append(name, values...)
+	}
+	return md
+}
+
+// Do sends body as one inference request. It returns once the backend has
+// answered, or, for a stream, once its first response has arrived.
+func (g *GRPCBackend) Do(ctx context.Context, body []byte, header http.Header) (*http.Response, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	stream := header.Get("Accept") == "text/event-stream"
+	req, chat, err := kserveRequestFor(body, stream)
+	if err != nil {
+		return grpcErrorResponse(http.StatusBadRequest, "invalid_request", err.Error()), nil
+	}
+	msg, err := marshalKServeRequest(req)
+	if err != nil {
+		return grpcErrorResponse(http.StatusBadRequest, "invalid_request", err.Error()), nil
+	}
+	ctx = metadata.NewOutgoingContext(ctx, grpcMetadata(header))
+	if stream {
+		return g.stream(ctx, req.ModelName, msg, chat)
+	}
+
+	var out []byte
+	if err := g.conn.Invoke(ctx, kserveInferMethod, &msg, &out); err != nil {
+		return grpcStatusResponse(ctx, err)
+	}
+	resp, err := unmarshalKServeResponse(out)
+	if err != nil {
+		return nil, fmt.Errorf("decode inference response: %w", err)
+	}
+	var data []byte
+	if chat {
+		text, err := resp.chatText()
+		if err != nil {
+			return nil, err
+		}
+		reason := "stop"
+		data, err = json.Marshal(openAIChatResponse{
+			ID:      resp.ID,
+			Object:  "chat.completion",
+			Created: time.Now().Unix(),
+			Model:   req.ModelName,
+			Choices: []openAIChoice{{Message: &openAIReply{Role: "assistant", Content: text}, FinishReason: &reason}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if data, err = json.Marshal(resp); err != nil {
+		return nil, err
+	}
+	return jsonResponse(http.StatusOK, data), nil
+}
+
+// stream opens a ModelStreamInfer call and relays its responses as server
+// sent events: OpenAI chunks for a chat completion, else one KServe v2
+// JSON response per event. The backend's error message, if it sends one
+// mid-stream, ends the stream with an error.
+func (g *GRPCBackend) stream(ctx context.Context, model string, msg []byte, chat bool) (*http.Response, error) {
+	desc := &grpc.StreamDesc{StreamName: "ModelStreamInfer", ServerStreams: true, ClientStreams: true}
+	cs, err := g.conn.NewStream(ctx, desc, kserveStreamInferMethod)
+	if err != nil {
+		return grpcStatusResponse(ctx, err)
+	}
+	if err := cs.SendMsg(&msg); err != nil && !errors.Is(err, io.EOF) {
+		return grpcStatusResponse(ctx, err)
+	}
+	if err := cs.CloseSend(); err != nil {
+		return grpcStatusResponse(ctx, err)
+	}
+	// Waiting for the first response makes the attempt timeout cover the
+	// time to first token, as it covers response headers over HTTP.
+	var first []byte
+	if err := cs.RecvMsg(&first); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("inference stream ended without a response")
+		}
+		return grpcStatusResponse(ctx, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		created := time.Now().Unix()
+		emit := func(v any) error {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(pw, "data: %s\n\n", data)
+			return err
+		}
+		chunk := func(delta openAIReply, finish *string, id string) error {
+			return emit(openAIChatResponse{
+				ID: id, Object: "chat.completion.chunk", Created: created, Model: model,
+				Choices: []openAIChoice{{Delta: &delta, FinishReason: finish}},
+			})
+		}
+		relay := func() error {
+			var id string
+			if chat {
+				if err := chunk(openAIReply{Role: "assistant"}, nil, ""); err != nil {
+					return err
+				}
+			}
+			for raw := first; ; raw = nil {
+				if raw == nil {
+					if err := cs.RecvMsg(&raw); err != nil {
+						if errors.Is(err, io.EOF) {
+							break
+						}
+						return err
+					}
+				}
+				resp, err := unmarshalKServeStreamResponse(raw)
+				if err != nil {
+					return err
+				}
+				if chat {
+					id = resp.ID
+					text, err := resp.chatText()
+					if err == nil && text != "" {
+						err = chunk(openAIReply{Content: text}, nil, id)
+					}
+					if err != nil && !resp.final() {
+						return err
+					}
+				} else if err := emit(resp); err != nil {
+					return err
+				}
+				if resp.final() {
+					break
+				}
+			}
+			if chat {
+				reason := "stop"
+				if err := chunk(openAIReply{}, &reason, id); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(pw, "data: [DONE]\n\n")
+			return err
+		}
+		pw.CloseWithError(relay())
+	}()
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/event-stream"}},
+		Body:          pr,
+		ContentLength: -1,
+	}
+	return resp, nil
+}
+
+// grpcHTTPStatus maps gRPC status codes to the HTTP statuses the router's
+// retries, breakers and fallbacks act on.
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// grpcStatusResponse turns a failed call into an error response, or
+// returns the error itself when the call was canceled, which the caller
+// reports like a canceled HTTP request.
+func grpcStatusResponse(ctx context.Context, err error) (*http.Response, error) {
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	st := status.Convert(err)
+	code, ok := grpcHTTPStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	return grpcErrorResponse(code, grpcCodeName(st.Code()), st.Message()), nil
+}
+
+// grpcCodeName spells a status code in snake case: "resource_exhausted".
+func grpcCodeName(c codes.Code) string {
+	var b strings.Builder
+	for i, r := range c.String() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func grpcErrorResponse(status int, code, message string) *http.Response {
+	data, _ := json.Marshal(apierror.Response{Error: apierror.Detail{
+		Message: message,
+		Type:    openAIErrorType(status),
+		Code:    code,
+	}})
+	return jsonResponse(status, data)
+}
+
+func jsonResponse(status int, data []byte) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"application/json"}, "Content-Length": {strconv.Itoa(len(data))}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// inferCall is a request a mock KServe server received.
+type inferCall struct {
+	method string
+	req    kserveRequest
+	md     metadata.MD
+}
+
+// inferInputs decodes the model name and inputs of a ModelInferRequest.
+func inferInputs(b []byte) (kserveRequest, error) {
+	var r kserveRequest
+	err := protoFields(b, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		switch num {
+		case kfModelName:
+			s, err := protoBytes(v)
+			r.ModelName = string(s)
+			return err
+		case kfInputs:
+			t, err := unmarshalTensor(v)
+			r.Inputs = append(r.Inputs, t)
+			return err
+		}
+		return nil
+	})
+	return r, err
+}
+
+// inferResponse encodes a ModelInferResponse. Its fields up to the output
+// tensors are numbered as a request's up to its inputs, so the request
+// encoder serves.
+func inferResponse(t *testing.T, id, text string, final bool) []byte {
+	t.Helper()
+	r := kserveRequest{
+		ModelName: "ensemble",
+		ID:        id,
+		Inputs:    []kserveTensor{{Name: kserveTextOutput, Datatype: "BYTES", Shape: []int64{1}, Data: []any{text}}},
+	}
+	if final {
+		r.Parameters = map[string]any{"triton_final_response": true}
+	}
+	b, err := marshalKServeRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// streamResponse wraps a ModelInferResponse in a ModelStreamInferResponse.
+func streamResponse(resp []byte) []byte {
+	return appendBytesField(nil, kfStreamResponse, resp)
+}
+
+// kserveServer serves the KServe gRPC methods over an in-memory listener
+// with answer, which returns the messages to reply with, and registers it
+// as the connection for baseURL. Each call is sent on calls.
+func kserveServer(t *testing.T, baseURL string, answer func(inferCall) ([][]byte, error)) <-chan inferCall {
+	t.Helper()
+	calls := make(chan inferCall, 8)
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, ss grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(ss)
+		var in []byte
+		if err := ss.RecvMsg(&in); err != nil {
+			return err
+		}
+		req, err := inferInputs(in)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		call := inferCall{method: method, req: req, md: md}
+		calls <- call
+		out, err := answer(call)
+		if err != nil {
+			return err
+		}
+		for _, msg := range out {
+			if err := ss.SendMsg(&msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	key := baseURL + "\x00"
+	grpcConnsMu.Lock()
+	grpcConns[key] = &GRPCBackend{conn: conn}
+	grpcConnsMu.Unlock()
+	t.Cleanup(func() {
+		grpcConnsMu.Lock()
+		delete(grpcConns, key)
+		grpcConnsMu.Unlock()
+	})
+	return calls
+}
+
+// grpcRouter routes model llama to a gRPC backend at baseURL, renamed
+// ensemble on the way.
+func grpcRouter(t *testing.T, baseURL string) http.Handler {
+	t.Helper()
+	t.Setenv("TRITON_API_KEY", "triton-key")
+	return routeChain(t, newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  triton: {base_url: %s, api_key_env: TRITON_API_KEY}
+models:
+  llama:
+    provider: triton
+    protocol: grpc
+    max_retries: 0
+    transforms:
+      - {name: rename_model, params: {model: ensemble}}
+`, baseURL))))
+}
+
+// A chat completion is sent as a text generation request, with the
+// provider's credentials as metadata, and its text_output comes back as an
+// OpenAI chat completion.
+func TestGRPCChatCompletion(t *testing.T) {
+	const baseURL = "http://triton-chat.test:8001"
+	calls := kserveServer(t, baseURL, func(inferCall) ([][]byte, error) {
+		return [][]byte{inferResponse(t, "resp-1", "Hello there", false)}, nil
+	})
+	rec := httptest.NewRecorder()
+	grpcRouter(t, baseURL).ServeHTTP(rec, chatRequest(`{"model":"llama","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	call := <-calls
+	if call.method != kserveInferMethod || call.req.ModelName != "ensemble" {
+		t.Errorf("called %s for model %q, want %s for ensemble", call.method, call.req.ModelName, kserveInferMethod)
+	}
+	inputs := make(map[string]any)
+	for _, in := range call.req.Inputs {
+		inputs[in.Name] = in.Data[0]
+	}
+	if inputs[kserveTextInput] != "hi" || inputs[kserveStream] != false || fmt.Sprint(inputs[kserveMaxTokens]) != "16" {
+		t.Errorf("inputs = %v", inputs)
+	}
+	if got := call.md.Get("authorization"); len(got) != 1 || got[0] != "Bearer triton-key" {
+		t.Errorf("authorization metadata = %q", got)
+	}
+
+	var resp openAIChatResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "resp-1" || resp.Object != "chat.completion" || len(resp.Choices) != 1 ||
+		resp.Choices[0].Message == nil || resp.Choices[0].Message.Content != "Hello there" {
+		t.Errorf("response = %s", rec.Body)
+	}
+}
+
+// A KServe v2 JSON request sent as a /route payload goes through as is
+// and is answered in KServe v2 JSON.
+func TestGRPCKServePassthrough(t *testing.T) {
+	const baseURL = "http://triton-kserve.test:8001"
+	calls := kserveServer(t, baseURL, func(inferCall) ([][]byte, error) {
+		return [][]byte{inferResponse(t, "resp-2", "positive", false)}, nil
+	})
+	rec := httptest.NewRecorder()
+	grpcRouter(t, baseURL).ServeHTTP(rec, chatRequest(`{"model":"llama","payload":{"model_name":"sentiment","inputs":[{"name":"text_input","datatype":"BYTES","shape":[1],"data":["great film"]}]}}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	call := <-calls
+	if call.req.ModelName != "sentiment" || len(call.req.Inputs) != 1 || call.req.Inputs[0].Name != kserveTextInput || call.req.Inputs[0].Data[0] != "great film" {
+		t.Errorf("inputs = %+v", call.req.Inputs)
+	}
+	var resp kserveResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := resp.chatText(); err != nil || resp.ID != "resp-2" || text != "positive" {
+		t.Errorf("response = %s", rec.Body)
+	}
+}
+
+// A streamed chat completion goes through ModelStreamInfer and comes back
+// as OpenAI chunks: the role, one per response with text, the finish
+// reason and [DONE].
+func TestGRPCStream(t *testing.T) {
+	const baseURL = "http://triton-stream.test:8001"
+	calls := kserveServer(t, baseURL, func(inferCall) ([][]byte, error) {
+		return [][]byte{
+			streamResponse(inferResponse(t, "resp-3", "Hel", false)),
+			streamResponse(inferResponse(t, "resp-3", "lo", false)),
+			streamResponse(inferResponse(t, "resp-3", "", true)),
+		}, nil
+	})
+	rec := httptest.NewRecorder()
+	grpcRouter(t, baseURL).ServeHTTP(rec, chatRequest(`{"model":"llama","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if call := <-calls; call.method != kserveStreamInferMethod {
+		t.Errorf("called %s, want %s", call.method, kserveStreamInferMethod)
+	}
+
+	var deltas []string
+	var finish string
+	events := strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n")
+	for _, event := range events[:len(events)-1] {
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+			t.Fatalf("event %q: %v", event, err)
+		}
+		delta := chunk.Choices[0].Delta
+		deltas = append(deltas, delta.Role+delta.Content)
+		if r := chunk.Choices[0].FinishReason; r != nil {
+			finish = *r
+		}
+	}
+	if got := strings.Join(deltas, "|"); got != "assistant|Hel|lo|" || finish != "stop" {
+		t.Errorf("deltas %q finishing %q, want assistant|Hel|lo| finishing stop", got, finish)
+	}
+	if last := events[len(events)-1]; last != "data: [DONE]" {
+		t.Errorf("last event = %q", last)
+	}
+}
+
+// A failed call is answered with the HTTP status of its gRPC code, named
+// in the error.
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		code   codes.Code
+		status int
+		name   string
+	}{
+		{code: codes.ResourceExhausted, status: http.StatusTooManyRequests, name: "resource_exhausted"},
+		{code: codes.InvalidArgument, status: http.StatusBadRequest, name: "invalid_argument"},
+		{code: codes.NotFound, status: http.StatusNotFound, name: "not_found"},
+		{code: codes.Unavailable, status: http.StatusServiceUnavailable, name: "unavailable"},
+		{code: codes.DataLoss, status: http.StatusInternalServerError, name: "data_loss"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := status.Error(tt.code, "model says no")
+			resp, rerr := grpcStatusResponse(context.Background(), err)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			var e struct {
+				Error struct {
+					Message string `json:"message"`
+					Code    string `json:"code"`
+				} `json:"error"`
+			}
+			json.Unmarshal(body, &e)
+			if resp.StatusCode != tt.status || e.Error.Code != tt.name || e.Error.Message != "model says no" {
+				t.Errorf("%d %s", resp.StatusCode, body)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := grpcStatusResponse(ctx, status.Error(codes.Canceled, "canceled")); err == nil {
+		t.Error("a canceled call was answered rather than reported")
+	}
+}
+
+// Through the router, a backend refusing a request for capacity is seen
+// by the client as a 429.
+func TestGRPCStatusRouted(t *testing.T) {
+	const baseURL = "http://triton-busy.test:8001"
+	kserveServer(t, baseURL, func(inferCall) ([][]byte, error) {
+		return nil, status.Error(codes.ResourceExhausted, "queue full")
+	})
+	rec := httptest.NewRecorder()
+	grpcRouter(t, baseURL).ServeHTTP(rec, chatRequest(`{"model":"llama","messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// An error message mid-stream ends the stream without [DONE].
+func TestGRPCStreamError(t *testing.T) {
+	const baseURL = "http://triton-stream-error.test:8001"
+	kserveServer(t, baseURL, func(inferCall) ([][]byte, error) {
+		return [][]byte{
+			streamResponse(inferResponse(t, "resp-4", "Hel", false)),
+			appendStringField(nil, kfStreamError, "out of memory"),
+		}, nil
+	})
+	rec := httptest.NewRecorder()
+	grpcRouter(t, baseURL).ServeHTTP(rec, chatRequest(`{"model":"llama","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if body := rec.Body.String(); !strings.Contains(body, `"content":"Hel"`) || strings.Contains(body, "[DONE]") {
+		t.Errorf("stream = %q, want the first chunk and no [DONE]", body)
+	}
+}
+
+// A backend that could not be set up fails every request with its error.
+func TestGRPCBackendSetupError(t *testing.T) {
+	want := errors.New("tls_ca_cert: no such file")
+	if _, err := (&GRPCBackend{err: want}).Do(context.Background(), []byte(`{}`), http.Header{}); !errors.Is(err, want) {
+		t.Errorf("Do error = %v, want %v", err, want)
+	}
+}
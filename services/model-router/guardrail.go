@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// Guardrail checks a model's traffic against a policy. CheckRequest sees
+// the request body before anything is sent upstream, once per request;
+// CheckResponse sees each response body, or each line of an event stream.
+// Both return the body with what the guardrail objects to redacted, and
+// the names of the rules it broke, none if it passed. What happens to a
+// body that broke rules is up to the guardrail's on_violation action, not
+// the guardrail.
+type Guardrail interface {
+	Name() string
+	CheckRequest(ctx context.Context, body []byte) ([]byte, []string)
+	CheckResponse(ctx context.Context, body []byte) ([]byte, []string)
+}
+
+// Actions a guardrail can take on a violation. Blocking refuses a request
+// with a 400, or a response with a 502; event streams cannot be refused
+// once they have started, so their lines are redacted instead. Redacting
+// carries on with the body the guardrail redacted, and log_only with the
+// body as it was. Every violation is logged.
+const (
+	guardrailBlock   = "block"
+	guardrailRedact  = "redact"
+	guardrailLogOnly = "log_only"
+)
+
+// GuardrailConfig configures one guardrail of a model. Type is a built-in
+// guardrail, regex_blocker or regex_redactor, or one added with
+// RegisterGuardrail, which read Options. Name, which defaults to Type,
+// tells the model's guardrails apart in errors, logs and metrics.
+// OnViolation defaults to block for regex_blocker and redact otherwise.
+type GuardrailConfig struct {
+	Type        string             `json:"type"`
+	Name        string             `json:"name,omitempty"`
+	Patterns    []GuardrailPattern `json:"patterns,omitempty"`
+	Placeholder string             `json:"placeholder,omitempty"`
+	OnViolation string             `json:"on_violation,omitempty"`
+	Options     map[string]any     `json:"options,omitempty"`
+}
+
+// GuardrailPattern is a rule of a regex guardrail: the regular expression
+// Pattern, reported as Name (default "patterns[i]") when it matches.
+type GuardrailPattern struct {
+	Name    string `json:"name,omitempty"`
+	Pattern string `json:"pattern"`
+}
+
+func (gc GuardrailConfig) name() string {
+	if gc.Name != "" {
+		return gc.Name
+	}
+	return gc.Type
+}
+
+func (gc GuardrailConfig) action() string {
+	switch {
+	case gc.OnViolation != "":
+		return gc.OnViolation
+	case gc.Type == "regex_blocker":
+		return guardrailBlock
+	}
+	return guardrailRedact
+}
+
+// GuardrailFactory builds a guardrail from its configuration, reporting
+// configuration errors when the config is validated.
+type GuardrailFactory func(GuardrailConfig) (Guardrail, error)
+
+var (
+	guardrailsMu sync.RWMutex
+	// guardrailFactories maps a guardrail's type in the config to its
+	// factory.
+	guardrailFactories = map[string]GuardrailFactory{
+		"regex_blocker":  newRegexBlocker,
+		"regex_redactor": newRegexRedactor,
+	}
+)
+
+// RegisterGuardrail makes a guardrail type available to model configs,
+// like RegisterPlugin, and panics if the type is taken.
+func RegisterGuardrail(typ string, factory GuardrailFactory) {
+	guardrailsMu.Lock()
+	defer guardrailsMu.Unlock()
+	if _, ok := guardrailFactories[typ]; ok {
+		panic("model-router: guardrail " + typ + " registered twice")
+	}
+	guardrailFactories[typ] = factory
+}
+
+type configuredGuardrail struct {
+	Guardrail
+	action string
+}
+
+// Guardrails are a model's guardrails in config order. The zero value
+// checks nothing.
+type Guardrails []configuredGuardrail
+
+// newGuardrails builds the guardrails configured for a model.
+func newGuardrails(configs []GuardrailConfig) (Guardrails, error) {
+	guardrailsMu.RLock()
+	defer guardrailsMu.RUnlock()
+	var gs Guardrails
+	seen := make(map[string]bool, len(configs))
+	for i, gc := range configs {
+		factory, ok := guardrailFactories[gc.Type]
+		if !ok {
+			return nil, fmt.Errorf("guardrails[%d]: unknown guardrail type %q", i, gc.Type)
+		}
+		if seen[gc.name()] {
+			return nil, fmt.Errorf("guardrails[%d]: duplicate name %q", i, gc.name())
+		}
+		seen[gc.name()] = true
+		switch gc.action() {
+		case guardrailBlock, guardrailRedact, guardrailLogOnly:
+		default:
+			return nil, fmt.Errorf("guardrails[%d]: unknown on_violation %q (want block, redact or log_only)", i, gc.OnViolation)
+		}
+		g, err := factory(gc)
+		if err != nil {
+			return nil, fmt.Errorf("guardrails[%d] (%s): %w", i, gc.name(), err)
+		}
+		gs = append(gs, configuredGuardrail{Guardrail: g, action: gc.action()})
+	}
+	return gs, nil
+}
+
+// guardrailError is a request or response refused by a blocking
+// guardrail.
+type guardrailError struct {
+	guardrail string
+	direction string
+	rules     []string
+}
+
+func (e *guardrailError) Error() string {
+	return e.direction + " violates guardrail " + e.guardrail + ": " + strings.Join(e.rules, ", ")
+}
+
+// checkRequest runs model's guardrails over a request body before it goes
+// anywhere upstream, and returns the body to send, or the violation of the
+// first blocking guardrail it broke.
+func (rt *Router) checkRequest(ctx context.Context, model string, gs Guardrails, body []byte) ([]byte, *guardrailError) {
+	for _, g := range gs {
+		checked, rules := g.CheckRequest(ctx, body)
+		if len(rules) == 0 {
+			continue
+		}
+		rt.guardrailViolation(ctx, model, g, "request", g.action, rules)
+		switch g.action {
+		case guardrailBlock:
+			return nil, &guardrailError{guardrail: g.Name(), direction: "request", rules: rules}
+		case guardrailRedact:
+			body = checked
+		}
+	}
+	return body, nil
+}
+
+// checkResponse runs model's guardrails over resp's body. Event streams
+// are checked line by line as they are read, so a match split across
+// lines gets through, and a blocking guardrail redacts them instead.
+func (rt *Router) checkResponse(ctx context.Context, model string, gs Guardrails, resp *http.Response) error {
+	if len(gs) == 0 {
+		return nil
+	}
+	if isEventStream(resp.Header) {
+		resp.Body = &redactingBody{src: resp.Body, lines: bufio.NewReader(resp.Body), redact: func(line []byte) []byte {
+			for _, g := range gs {
+				checked, rules := g.CheckResponse(ctx, line)
+				if len(rules) == 0 {
+					continue
+				}
+				action := g.action
+				if action == guardrailBlock {
+					action = guardrailRedact
+				}
+				rt.guardrailViolation(ctx, model, g, "stream", action, rules)
+				if action == guardrailRedact {
+					line = checked
+				}
+			}
+			return line
+		}}
+		return nil
+	}
+	return rewriteBody(resp, func(body []byte) ([]byte, error) {
+		for _, g := range gs {
+			checked, rules := g.CheckResponse(ctx, body)
+			if len(rules) == 0 {
+				continue
+			}
+			rt.guardrailViolation(ctx, model, g, "response", g.action, rules)
+			switch g.action {
+			case guardrailBlock:
+				return nil, &guardrailError{guardrail: g.Name(), direction: "response", rules: rules}
+			case guardrailRedact:
+				body = checked
+			}
+		}
+		return body, nil
+	})
+}
+
+// writeGuardrailError answers a request or response refused by a
+// guardrail: a request with a 400, since the client can change it, and a
+// response with a 502.
+func writeGuardrailError(w http.ResponseWriter, model string, e *guardrailError) {
+	status := http.StatusBadRequest
+	if e.direction == "response" {
+		status = http.StatusBadGateway
+	}
+	apierror.WriteWithDetails(w, status, "policy_violation", e.direction+" for model "+model+" violates guardrail "+e.guardrail,
+		map[string]any{"guardrail": e.guardrail, "rules": e.rules})
+}
+
+func (rt *Router) guardrailViolation(ctx context.Context, model string, g configuredGuardrail, direction, action string, rules []string) {
+	rt.metrics.GuardrailViolation(model, g.Name(), direction, action)
+	middleware.LoggerFrom(ctx, rt.logger).Warn("guardrail violated",
+		slog.String("model", model), slog.String("guardrail", g.Name()), slog.String("direction", direction),
+		slog.String("rules", strings.Join(rules, ",")), slog.String("action", action))
+}
+
+// regexRules are the compiled patterns of a regex guardrail.
+type regexRules struct {
+	name        string
+	names       []string
+	patterns    []*regexp.Regexp
+	placeholder []byte
+}
+
+func newRegexRules(gc GuardrailConfig) (regexRules, error) {
+	if len(gc.Patterns) == 0 {
+		return regexRules{}, fmt.Errorf("patterns is required")
+	}
+	rr := regexRules{name: gc.name(), placeholder: []byte(gc.Placeholder)}
+	if gc.Placeholder == "" {
+		rr.placeholder = []byte("[REDACTED]")
+	}
+	for i, gp := range gc.Patterns {
+		re, err := regexp.Compile(gp.Pattern)
+		if err != nil {
+			return regexRules{}, fmt.Errorf("patterns[%d]: %w", i, err)
+		}
+		name := gp.Name
+		if name == "" {
+			name = fmt.Sprintf("patterns[%d]", i)
+		}
+		rr.names = append(rr.names, name)
+		rr.patterns = append(rr.patterns, re)
+	}
+	return rr, nil
+}
+
+func (rr regexRules) Name() string { return rr.name }
+
+// check replaces every match in body with the placeholder and returns the
+// names of the patterns that matched.
+func (rr regexRules) check(body []byte) ([]byte, []string) {
+	var broken []string
+	for i, re := range rr.patterns {
+		if re.Match(body) {
+			broken = append(broken, rr.names[i])
+			body = re.ReplaceAllLiteral(body, rr.placeholder)
+		}
+	}
+	return body, broken
+}
+
+// RegexBlocker checks requests for matches of its patterns, and blocks
+// those that have any unless configured otherwise. Responses pass.
+type RegexBlocker struct{ regexRules }
+
+func newRegexBlocker(gc GuardrailConfig) (Guardrail, error) {
+	rr, err := newRegexRules(gc)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexBlocker{rr}, nil
+}
+
+func (rb *RegexBlocker) CheckRequest(_ context.Context, body []byte) ([]byte, []string) {
+	return rb.check(body)
+}
+
+func (rb *RegexBlocker) CheckResponse(_ context.Context, body []byte) ([]byte, []string) {
+	return body, nil
+}
+
+// RegexRedactor checks responses for matches of its patterns, and replaces
+// them with its placeholder (default "[REDACTED]") unless configured
+// otherwise. Requests pass.
+type RegexRedactor struct{ regexRules }
+
+func newRegexRedactor(gc GuardrailConfig) (Guardrail, error) {
+	rr, err := newRegexRules(gc)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexRedactor{rr}, nil
+}
+
+func (rr *RegexRedactor) CheckRequest(_ context.Context, body []byte) ([]byte, []string) {
+	return body, nil
+}
+
+func (rr *RegexRedactor) CheckResponse(_ context.Context, body []byte) ([]byte, []string) {
+	return rr.check(body)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+type HealthResponse struct {
+	Status    string `json:"status"`
+	Service   string `json:"service"`
+	Version   string `json:"version"`
+	Timestamp string `json:"timestamp"`
+	RequestID string `json:"request_id,omitempty"`
+
+	Breakers map[string]string `json:"breakers,omitempty"`
+	// Backends maps "model/backend" to what probes last found: the
+	// backend's own health probes, its provider's health check, or its
+	// warm-up.
+	Backends map[string]BackendProbe `json:"backends,omitempty"`
+}
+
+// BackendProbe is the latest probe result of one backend. Status is a
+// health-check status (up, down, unknown), a warm-up state (warming,
+// ready, degraded) or "unchecked" for a backend nothing probes.
+type BackendProbe struct {
+	Status    string     `json:"status"`
+	LatencyMs float64    `json:"latency_ms,omitempty"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+}
+
+type ReadinessResponse struct {
+	HealthResponse
+	ConfigVersion string            `json:"config_version"`
+	Checks        map[string]string `json:"checks"`
+	Failed        []string          `json:"failed,omitempty"`
+	// Warnings are what keeps the router from being fully healthy without
+	// failing readiness.
+	Warnings map[string]string `json:"warnings,omitempty"`
+}
+
+// Health serves liveness (/health, /healthz) and readiness (/readyz).
+// Readiness fails until every probed backend has passed its first health
+// check or warm-up, so a new pod gets no traffic it cannot serve yet, and
+// again once the server starts draining so load balancers stop sending
+// new traffic while in-flight requests finish. Upstream trouble never
+// fails it: every pod shares the same upstreams, so taking pods out of
+// rotation for one would only turn away the models that still work, and
+// an unready pod gets no traffic to see the upstream recover by. A
+// provider that is unreachable or down, a model with every backend down,
+// a router serving its last-known-good config because the file failed to
+// load, or a provider's credential file unreadable leave the router ready
+// but degraded.
+type Health struct {
+	registry       *ModelRegistry
+	upstreams      *UpstreamTracker
+	upstreamWindow time.Duration
+	probes         *HealthChecker
+
+	draining atomic.Bool
+}
+
+func NewHealth(registry *ModelRegistry, upstreams *UpstreamTracker, upstreamWindow time.Duration, probes *HealthChecker) *Health {
+	return &Health{registry: registry, upstreams: upstreams, upstreamWindow: upstreamWindow, probes: probes}
+}
+
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+func newHealthResponse(r *http.Request, status string) HealthResponse {
+	return HealthResponse{
+		Status:    status,
+		Service:   "model-router",
+		Version:   version,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		RequestID: middleware.RequestIDFrom(r.Context()),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Health keeps the original /health behaviour: alive, but 503 while draining.
+func (h *Health) Health(w http.ResponseWriter, r *http.Request) {
+	resp := newHealthResponse(r, "ok")
+	resp.Breakers = h.registry.BreakerStates()
+	resp.Backends = h.registry.BackendProbes()
+	if h.draining.Load() {
+		resp.Status = "draining"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Live reports only that the process is up and serving HTTP.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newHealthResponse(r, "ok"))
+}
+
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{
+		HealthResponse: newHealthResponse(r, "ready"),
+		ConfigVersion:  h.registry.Version(),
+		Checks:         make(map[string]string),
+	}
+	resp.Backends = h.registry.BackendProbes()
+	fail := func(check, reason string) {
+		resp.Checks[check] = reason
+		resp.Failed = append(resp.Failed, check)
+	}
+
+	if h.draining.Load() {
+		fail("draining", "server is shutting down")
+	} else {
+		resp.Checks["draining"] = "ok"
+	}
+
+	switch {
+	case !h.registry.Loaded():
+		fail("config", "routing table not loaded")
+	case h.registry.Stale():
+		// The routing table still works, and taking the pod out of
+		// rotation for a broken file would only spread the outage.
+		resp.Checks["config"] = "ok"
+		resp.Warnings = map[string]string{"config": "stale"}
+	default:
+		resp.Checks["config"] = "ok"
+	}
+	warn := func(check, reason string) {
+		if resp.Warnings == nil {
+			resp.Warnings = make(map[string]string)
+		}
+		resp.Warnings[check] = reason
+	}
+	// A provider with an unreadable credential file still has the key it
+	// last read, which may well still work.
+	for name, problem := range h.registry.CredentialProblems() {
+		warn("credential:"+name, problem)
+	}
+
+	if pending := h.registry.PendingBackends(); len(pending) > 0 {
+		for _, name := range sortedKeys(pending) {
+			fail("backend:"+name, pending[name])
+		}
+	} else {
+		resp.Checks["backends"] = "ok"
+	}
+
+	for name, reason := range h.registry.UnhealthyModels() {
+		warn("model:"+name, reason)
+	}
+	for name, reason := range h.upstreams.Unreachable(h.upstreamWindow) {
+		warn("upstream:"+name, reason)
+	}
+	if h.probes != nil {
+		for name, reason := range h.probes.Down() {
+			warn("provider:"+name, reason)
+		}
+	}
+
+	if len(resp.Failed) > 0 {
+		resp.Status = "not_ready"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	if len(resp.Warnings) > 0 {
+		resp.Status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
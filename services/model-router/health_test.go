@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testConfig parses a YAML config as the router would load it.
+func testConfig(t *testing.T, yaml string) *Config {
+	t.Helper()
+	cfg, err := parseConfig("test.yaml", []byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func readiness(t *testing.T, h *Health) (int, ReadinessResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.Ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp ReadinessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, resp
+}
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// An upstream outage leaves the pod ready, and the health check alone,
+// without any traffic, clears it once the provider answers again.
+func TestReadinessSurvivesUpstreamOutage(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a:
+    base_url: %s
+    health_check: {path: /health, interval: 10ms, timeout: 1s, unhealthy_threshold: 1}
+models:
+  m: a
+`, upstream.URL))
+	upstreams := NewUpstreamTracker()
+	probes := NewHealthChecker(nil, upstreams, testLogger())
+	registry := NewModelRegistry(cfg, "", nil, probes, nil, nil, testLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	probes.Start(ctx)
+	defer probes.Stop()
+	h := NewHealth(registry, upstreams, time.Millisecond, probes)
+
+	waitFor(t, "first probe", func() bool { code, _ := readiness(t, h); return code == http.StatusOK })
+
+	healthy.Store(false)
+	upstreams.RecordFailure("a", errors.New("connection refused"))
+	waitFor(t, "provider down", func() bool { return len(probes.Down()) > 0 })
+	code, resp := readiness(t, h)
+	if code != http.StatusOK || resp.Status != "degraded" {
+		t.Fatalf("readiness during outage = %d %s, want 200 degraded", code, resp.Status)
+	}
+	for _, check := range []string{"upstream:a", "provider:a", "model:m"} {
+		if _, ok := resp.Warnings[check]; !ok {
+			t.Errorf("warnings = %v, want %s", resp.Warnings, check)
+		}
+	}
+
+	healthy.Store(true)
+	waitFor(t, "recovery", func() bool { _, resp := readiness(t, h); return resp.Status == "ready" })
+	if got := upstreams.Unreachable(time.Millisecond); len(got) != 0 {
+		t.Errorf("Unreachable after a passing probe = %v, want none", got)
+	}
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	cfg := testConfig(t, `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: a
+`)
+	h := NewHealth(NewModelRegistry(cfg, "", nil, nil, nil, nil, testLogger()), NewUpstreamTracker(), time.Minute, nil)
+	if code, _ := readiness(t, h); code != http.StatusOK {
+		t.Fatalf("readiness = %d, want 200", code)
+	}
+	h.SetDraining()
+	if code, resp := readiness(t, h); code != http.StatusServiceUnavailable || resp.Checks["draining"] == "ok" {
+		t.Errorf("readiness while draining = %d %v, want 503", code, resp.Checks)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	defaultHealthPath      = "/v1/models"
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 2 * time.Second
+	defaultHealthThreshold = 2
+)
+
+// HealthCheckConfig turns on active probing of a provider: a GET of Path
+// (default /v1/models) every Interval (default 10s), failing after Timeout
+// (default 2s). The provider is marked down after UnhealthyThreshold
+// (default 2) consecutive failed probes and up again after one success.
+type HealthCheckConfig struct {
+	Path               string   `json:"path,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+}
+
+func (hc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hc.Path == "" {
+		hc.Path = defaultHealthPath
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = Duration(defaultHealthInterval)
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = Duration(defaultHealthTimeout)
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = defaultHealthThreshold
+	}
+	return hc
+}
+
+// ProviderHealth is the live probe state of one provider, or of one
+// backend probed on its own. Backends keep a pointer to it, so a status
+// survives reloads of the routing table.
+type ProviderHealth struct {
+	mu         sync.Mutex
+	name       string
+	baseURL    string
+	checked    bool
+	up         bool
+	known      bool
+	failures   int
+	successes  int
+	lastError  string
+	lastCheck  time.Time
+	lastChange time.Time
+	latency    time.Duration
+	// passed is set by the first successful probe and never cleared, so
+	// readiness can wait for it at startup only.
+	passed atomic.Bool
+}
+
+// Pending reports whether the provider is probed but no probe has
+// succeeded yet.
+func (h *ProviderHealth) Pending() bool {
+	if h == nil || h.passed.Load() {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.checked
+}
+
+// Down reports whether probes currently consider the provider
+// unavailable. Before the first probe completes it is not down.
+func (h *ProviderHealth) Down() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.checked && h.known && !h.up
+}
+
+// ProviderStatus is one entry of GET /v1/providers.
+type ProviderStatus struct {
+	Name       string     `json:"name"`
+	BaseURL    string     `json:"base_url"`
+	Status     string     `json:"status"` // up, down, unknown or unchecked
+	LastError  string     `json:"last_error,omitempty"`
+	LastCheck  *time.Time `json:"last_check,omitempty"`
+	LastChange *time.Time `json:"last_change,omitempty"`
+	LatencyMs  float64    `json:"latency_ms,omitempty"`
+}
+
+func (h *ProviderHealth) status() ProviderStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := ProviderStatus{Name: h.name, BaseURL: h.baseURL, LastError: h.lastError}
+	switch {
+	case !h.checked:
+		s.Status = "unchecked"
+	case !h.known:
+		s.Status = "unknown"
+	case h.up:
+		s.Status = "up"
+	default:
+		s.Status = "down"
+	}
+	if !h.lastCheck.IsZero() {
+		t := h.lastCheck.UTC()
+		s.LastCheck = &t
+		s.LatencyMs = float64(h.latency.Microseconds()) / 1000
+	}
+	if !h.lastChange.IsZero() {
+		t := h.lastChange.UTC()
+		s.LastChange = &t
+	}
+	return s
+}
+
+// record applies one probe result and returns the provider's status
+// before and after it. It is down after failThreshold failures in a row,
+// and once down, up again after riseThreshold successes in a row.
+func (h *ProviderHealth) record(err error, latency time.Duration, failThreshold, riseThreshold int) (before, after string) {
+	before = h.status().Status
+	h.mu.Lock()
+	h.lastCheck, h.latency = time.Now(), latency
+	if err == nil {
+		h.failures, h.lastError = 0, ""
+		h.successes++
+		if h.up || !h.known || h.successes >= riseThreshold {
+			h.up, h.known = true, true
+		}
+		h.passed.Store(true)
+	} else {
+		h.successes = 0
+		h.failures++
+		h.lastError = err.Error()
+		if h.failures >= failThreshold {
+			h.up, h.known = false, true
+		}
+	}
+	h.mu.Unlock()
+	after = h.status().Status
+	if before != after {
+		h.mu.Lock()
+		h.lastChange = h.lastCheck
+		h.mu.Unlock()
+	}
+	return before, after
+}
+
+type probe struct {
+	provider Provider
+	cfg      HealthCheckConfig
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// HealthChecker runs one prober goroutine per provider with a
+// health_check. Each goroutine waits for its probe to finish or time out
+// before scheduling the next, so a hanging upstream never piles up
+// goroutines. Update reconciles the probers with a reloaded config.
+type HealthChecker struct {
+	client    *http.Client
+	metrics   *metrics.Metrics
+	upstreams *UpstreamTracker
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	ctx      context.Context
+	probes   map[string]*probe
+	statuses map[string]*ProviderHealth
+}
+
+// NewHealthChecker returns a checker that also records each passing probe
+// in upstreams, so a provider that recovers stops being reported
+// unreachable without waiting for traffic to reach it.
+func NewHealthChecker(m *metrics.Metrics, upstreams *UpstreamTracker, logger *slog.Logger) *HealthChecker {
+	return &HealthChecker{
+		client:    &http.Client{},
+		metrics:   m,
+		upstreams: upstreams,
+		logger:    logger,
+		probes:    make(map[string]*probe),
+		statuses:  make(map[string]*ProviderHealth),
+	}
+}
+
+// Start launches the probers configured so far and any added later; they
+// run until ctx ends or Stop is called.
+func (hc *HealthChecker) Start(ctx context.Context) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.ctx = ctx
+	for _, p := range hc.probes {
+		hc.launch(p)
+	}
+}
+
+// Stop ends every prober and waits for them to exit.
+func (hc *HealthChecker) Stop() {
+	hc.mu.Lock()
+	probes := hc.probes
+	hc.probes = make(map[string]*probe)
+	hc.ctx = nil
+	hc.mu.Unlock()
+	for _, p := range probes {
+		p.halt()
+	}
+}
+
+// Update starts, restarts or stops probers so they match cfg, and returns
+// the health of each provider by name for the routing table to link.
+func (hc *HealthChecker) Update(cfg *Config) map[string]*ProviderHealth {
+	providers := cfg.providers()
+	hc.mu.Lock()
+	var stale []*probe
+	for name, p := range hc.probes {
+		pc, ok := cfg.Providers[name]
+		if !ok || pc.HealthCheck == nil || pc.HealthCheck.withDefaults() != p.cfg || !sameTarget(p.provider, *providers[name]) {
+			stale = append(stale, p)
+			delete(hc.probes, name)
+		}
+	}
+	out := make(map[string]*ProviderHealth, len(cfg.Providers))
+	for name, pc := range cfg.Providers {
+		h, ok := hc.statuses[name]
+		if !ok {
+			h = &ProviderHealth{name: name}
+			hc.statuses[name] = h
+		}
+		h.mu.Lock()
+		h.baseURL, h.checked = pc.BaseURL, pc.HealthCheck != nil
+		if !h.checked {
+			h.known, h.failures, h.successes, h.lastError = false, 0, 0, ""
+		}
+		h.mu.Unlock()
+		out[name] = h
+		if _, running := hc.probes[name]; running || pc.HealthCheck == nil {
+			continue
+		}
+		p := &probe{provider: *providers[name], cfg: pc.HealthCheck.withDefaults()}
+		hc.probes[name] = p
+		if hc.ctx != nil {
+			hc.launch(p)
+		}
+	}
+	for name := range hc.statuses {
+		if _, ok := cfg.Providers[name]; !ok {
+			delete(hc.statuses, name)
+		}
+	}
+	hc.mu.Unlock()
+	for _, p := range stale {
+		p.halt()
+	}
+	return out
+}
+
+// sameTarget reports whether a and b probe the same way.
+func sameTarget(a, b Provider) bool {
+	return a.BaseURL == b.BaseURL && a.APIKey == b.APIKey && a.Credential == b.Credential && a.Adapter == b.Adapter
+}
+
+// launch starts p's goroutine; hc.mu must be held.
+func (hc *HealthChecker) launch(p *probe) {
+	ctx, cancel := context.WithCancel(hc.ctx)
+	p.stop, p.done = cancel, make(chan struct{})
+	h := hc.statuses[p.provider.Name]
+	go hc.run(ctx, p, h)
+}
+
+func (p *probe) halt() {
+	if p.stop != nil {
+		p.stop()
+		<-p.done
+	}
+}
+
+func (hc *HealthChecker) run(ctx context.Context, p *probe, h *ProviderHealth) {
+	defer close(p.done)
+	ticker := time.NewTicker(time.Duration(p.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		err := hc.check(ctx, &p.provider, p.cfg)
+		if ctx.Err() != nil {
+			return
+		}
+		before, after := h.record(err, time.Since(start), p.cfg.UnhealthyThreshold, 1)
+		if err == nil {
+			hc.upstreams.RecordSuccess(p.provider.Name)
+		}
+		if before != after {
+			hc.metrics.ProviderUp(p.provider.Name, after == "up")
+			switch {
+			case after == "down":
+				hc.logger.Warn("provider marked down", slog.String("provider", p.provider.Name), slog.String("error", err.Error()))
+			case before == "down":
+				hc.logger.Info("provider healthy again", slog.String("provider", p.provider.Name))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check runs one probe. Any 2xx answer counts as healthy.
+func (hc *HealthChecker) check(ctx context.Context, p *Provider, cfg HealthCheckConfig) error {
+	return probeGet(ctx, hc.client, p, cfg.Path, time.Duration(cfg.Timeout))
+}
+
+// probeGet sends one authorized GET of path on p with client, and fails
+// unless a 2xx answer arrives within timeout.
+func probeGet(ctx context.Context, client *http.Client, p *Provider, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(p.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	authorize(p, req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("no response within %s", timeout)
+		}
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Statuses lists every configured provider's health, sorted by name.
+func (hc *HealthChecker) Statuses() []ProviderStatus {
+	hc.mu.Lock()
+	out := make([]ProviderStatus, 0, len(hc.statuses))
+	for _, h := range hc.statuses {
+		out = append(out, h.status())
+	}
+	hc.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Down maps each provider that probes consider down to its last error.
+func (hc *HealthChecker) Down() map[string]string {
+	out := make(map[string]string)
+	for _, s := range hc.Statuses() {
+		if s.Status == "down" {
+			out[s.Name] = s.LastError
+		}
+	}
+	return out
+}
+
+// handleProviders serves GET /v1/providers.
+func (hc *HealthChecker) handleProviders(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "list",
+		"data":   hc.Statuses(),
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// enableHTTP2 serves HTTP/2 on srv alongside HTTP/1.1: negotiated with
+// ALPN over TLS, and over cleartext as h2c, with prior knowledge or an
+// Upgrade, for pod-to-pod traffic whose TLS the mesh terminates. It must
+// run after srv's TLS settings are in place. Server push stays off, as
+// handlers only see middleware's response writer, which does not offer
+// http.Pusher.
+func enableHTTP2(srv *http.Server) error {
+	h2 := &http2.Server{IdleTimeout: srv.IdleTimeout}
+	if srv.TLSConfig == nil {
+		// ConfigureServer would add a TLS config of its own.
+		srv.Handler = h2c.NewHandler(srv.Handler, h2)
+		return nil
+	}
+	return http2.ConfigureServer(srv, h2)
+}
+
+// disableHTTP2 keeps srv to HTTP/1.1; a non-nil, empty TLSNextProto stops
+// net/http from offering h2 over TLS.
+func disableHTTP2(srv *http.Server) {
+	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
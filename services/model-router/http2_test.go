@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// protoHandler answers with the protocol the request came in on.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Proto)
+})
+
+func getProto(t *testing.T, client *http.Client, url string) (resp, req string) {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.Proto, string(body)
+}
+
+// Over TLS, a client offering h2 gets HTTP/2.
+func TestHTTP2OverTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoHandler)
+	srv.EnableHTTP2 = true
+	srv.Config.TLSConfig = &tls.Config{}
+	if err := enableHTTP2(srv.Config); err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+	if resp, req := getProto(t, srv.Client(), srv.URL); resp != "HTTP/2.0" || req != "HTTP/2.0" {
+		t.Errorf("response over %s, request over %s, want HTTP/2.0", resp, req)
+	}
+}
+
+// Served as main serves it, with ServeTLS, a listener with HTTP/2 disabled
+// offers a client that would take h2 only HTTP/1.1.
+func TestHTTP2Disabled(t *testing.T) {
+	// Borrows httptest's certificate, and its client that trusts it.
+	certs := httptest.NewTLSServer(protoHandler)
+	defer certs.Close()
+	tests := []struct {
+		name  string
+		setup func(*http.Server) error
+		want  string
+	}{
+		{name: "enabled", setup: enableHTTP2, want: "HTTP/2.0"},
+		{name: "disabled", setup: func(srv *http.Server) error { disableHTTP2(srv); return nil }, want: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &http.Server{Handler: protoHandler, TLSConfig: &tls.Config{Certificates: certs.TLS.Certificates}}
+			if err := tt.setup(srv); err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.ServeTLS(l, "", "")
+			defer srv.Close()
+			client := certs.Client()
+			client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+			defer client.CloseIdleConnections()
+			if resp, req := getProto(t, client, "https://"+l.Addr().String()); resp != tt.want || req != tt.want {
+				t.Errorf("response over %s, request over %s, want %s", resp, req, tt.want)
+			}
+		})
+	}
+}
+
+// Over cleartext, a client with prior knowledge gets h2c, and one without
+// still gets HTTP/1.1.
+func TestHTTP2Cleartext(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoHandler)
+	if err := enableHTTP2(srv.Config); err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	defer srv.Close()
+
+	h2c := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	if resp, req := getProto(t, h2c, srv.URL); resp != "HTTP/2.0" || req != "HTTP/2.0" {
+		t.Errorf("prior knowledge: response over %s, request over %s, want HTTP/2.0", resp, req)
+	}
+	if resp, req := getProto(t, srv.Client(), srv.URL); resp != "HTTP/1.1" || req != "HTTP/1.1" {
+		t.Errorf("HTTP/1.1 client: response over %s, request over %s", resp, req)
+	}
+}
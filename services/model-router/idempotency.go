@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	IdempotentReplayHeader = "Idempotent-Replay"
+
+	defaultIdempotencyTTL          = 24 * time.Hour
+	defaultIdempotencyEntries      = 10000
+	defaultIdempotencyMaxBodyBytes = 1 << 20
+	maxIdempotencyKeyLength        = 255
+)
+
+// IdempotencyConfig tunes Idempotency-Key handling, which is always on:
+// responses are kept for TTL (default 24h), at most MaxEntries of them
+// (default 10000) with bodies of at most MaxBodyBytes (default 1 MiB).
+// Changes take effect on restart, not reload.
+type IdempotencyConfig struct {
+	TTL          Duration `json:"ttl,omitempty"`
+	MaxEntries   int      `json:"max_entries,omitempty"`
+	MaxBodyBytes int64    `json:"max_body_bytes,omitempty"`
+}
+
+func validateIdempotency(ic IdempotencyConfig) error {
+	if ic.TTL < 0 {
+		return fmt.Errorf("idempotency.ttl must not be negative")
+	}
+	if ic.MaxEntries < 0 || ic.MaxBodyBytes < 0 {
+		return fmt.Errorf("idempotency.max_entries and idempotency.max_body_bytes must not be negative")
+	}
+	return nil
+}
+
+func (ic IdempotencyConfig) withDefaults() IdempotencyConfig {
+	if ic.TTL <= 0 {
+		ic.TTL = Duration(defaultIdempotencyTTL)
+	}
+	if ic.MaxEntries <= 0 {
+		ic.MaxEntries = defaultIdempotencyEntries
+	}
+	if ic.MaxBodyBytes <= 0 {
+		ic.MaxBodyBytes = defaultIdempotencyMaxBodyBytes
+	}
+	return ic
+}
+
+// IdempotentResponse is the response to the first request with an
+// idempotency key, and the hash of that request's body.
+type IdempotentResponse struct {
+	BodyHash string      `json:"body_hash"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+}
+
+// IdempotencyStore keeps responses by idempotency key. Implementations
+// must be safe for concurrent use; a failing backend should behave like a
+// miss.
+type IdempotencyStore interface {
+	Get(ctx context.Context, key string) (*IdempotentResponse, bool)
+	Set(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration)
+}
+
+// MemoryIdempotencyStore is a per-process LRU of responses. Keys only
+// dedupe retries that reach the same router replica.
+type MemoryIdempotencyStore struct {
+	lru *lru.Cache[string, idempotencyEntry]
+}
+
+type idempotencyEntry struct {
+	resp    *IdempotentResponse
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore(maxEntries int) (*MemoryIdempotencyStore, error) {
+	c, err := lru.New[string, idempotencyEntry](maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryIdempotencyStore{lru: c}, nil
+}
+
+func (s *MemoryIdempotencyStore) Get(_ context.Context, key string) (*IdempotentResponse, bool) {
+	e, ok := s.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		s.lru.Remove(key)
+		return nil, false
+	}
+	return e.resp, true
+}
+
+func (s *MemoryIdempotencyStore) Set(_ context.Context, key string, resp *IdempotentResponse, ttl time.Duration) {
+	s.lru.Add(key, idempotencyEntry{resp: resp, expires: time.Now().Add(ttl)})
+}
+
+// idempotencyKey is the request's Idempotency-Key, or its
+// X-Idempotency-Key.
+func idempotencyKey(h http.Header) string {
+	if key := h.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return h.Get(IdempotencyKeyHeader)
+}
+
+// idempotentCall is the request executing for a key, which later requests
+// with the key wait for.
+type idempotentCall struct {
+	bodyHash string
+	done     chan struct{}
+	resp     *IdempotentResponse
+}
+
+// IdempotentRouter makes requests with an Idempotency-Key header safe to
+// retry. The first request with a key runs; its response is kept and
+// replayed, marked Idempotent-Replay: true, to later requests with the
+// same key and body, and requests arriving while it runs wait for it
+// rather than calling upstream again. Reusing a key with another body is
+// a 409. Keys are scoped to the caller and path. Server errors and 429s
+// are not kept, so a retry after one runs again, and neither are
+// responses larger than max_body_bytes, streamed requests or uploads,
+// whose bodies are never held to compare.
+type IdempotentRouter struct {
+	cfg     IdempotencyConfig
+	store   IdempotencyStore
+	metrics *metrics.Metrics
+
+	mu       sync.Mutex
+	inflight map[string]*idempotentCall
+}
+
+func NewIdempotentRouter(cfg IdempotencyConfig, store IdempotencyStore, m *metrics.Metrics) *IdempotentRouter {
+	return &IdempotentRouter{cfg: cfg.withDefaults(), store: store, metrics: m, inflight: make(map[string]*idempotentCall)}
+}
+
+func (ir *IdempotentRouter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := idempotencyKey(r.Header)
+		if key == "" || isMultipart(r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req RouteRequest
+		if json.Unmarshal(body, &req) == nil && req.Stream {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := middleware.RequestInfoFrom(r.Context())
+		scoped := strings.Join([]string{r.URL.Path, info.Tenant(), usageCaller(info), key}, "\x00")
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+
+		ir.mu.Lock()
+		call, running := ir.inflight[scoped]
+		if !running {
+			call = &idempotentCall{bodyHash: bodyHash, done: make(chan struct{})}
+			ir.inflight[scoped] = call
+		}
+		ir.mu.Unlock()
+		if running {
+			if call.bodyHash != bodyHash {
+				ir.conflict(w)
+				return
+			}
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.resp.BodyHash != bodyHash {
+				// The call found the key kept from an earlier request.
+				ir.conflict(w)
+				return
+			}
+			ir.metrics.IdempotentRequest("coalesced")
+			ir.replay(w, r, call.resp)
+			return
+		}
+
+		resp, ok := ir.store.Get(r.Context(), scoped)
+		streamed := false
+		if !ok {
+			resp, streamed = ir.execute(next, w, r, body, bodyHash)
+			if keep(resp, ir.cfg.MaxBodyBytes) {
+				ir.store.Set(context.WithoutCancel(r.Context()), scoped, resp, time.Duration(ir.cfg.TTL))
+			}
+		}
+		call.resp = resp
+		ir.mu.Lock()
+		delete(ir.inflight, scoped)
+		ir.mu.Unlock()
+		close(call.done)
+		switch {
+		case ok && resp.BodyHash != bodyHash:
+			ir.conflict(w)
+		case ok:
+			ir.metrics.IdempotentRequest("replayed")
+			ir.replay(w, r, resp)
+		case streamed:
+		default:
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.Status)
+			w.Write(resp.Body)
+		}
+	})
+}
+
+// execute runs the first request with a key. Retries come when the
+// client lost the connection, so the request runs on after that for the
+// retry to find its response, unless an operator cancels it. It reports
+// whether the response was an event stream, which has been sent to w as
+// it came.
+func (ir *IdempotentRouter) execute(next http.Handler, w http.ResponseWriter, r *http.Request, body []byte, bodyHash string) (*IdempotentResponse, bool) {
+	rec := &bufferedResponse{header: w.Header().Clone(), live: w}
+	ctx, stop := detachFromClient(r.Context())
+	defer stop()
+	lr := r.WithContext(ctx)
+	lr.Body = io.NopCloser(bytes.NewReader(body))
+	next.ServeHTTP(rec, lr)
+	if cancelledByAdmin(ctx) {
+		if !rec.streamed {
+			rec = &bufferedResponse{header: make(http.Header)}
+			writeCancelled(rec)
+		}
+		// Cut short, so not a response to keep for the key.
+		rec.status = StatusCancelled
+	}
+	header := rec.header.Clone()
+	header.Del(middleware.RequestIDHeader)
+	return &IdempotentResponse{BodyHash: bodyHash, Status: rec.status, Header: header, Body: rec.body.Bytes()}, rec.streamed
+}
+
+// keep reports whether resp settles its key: a retry after a server error,
+// a 429 or an operator's cancellation should run again.
+func keep(resp *IdempotentResponse, maxBodyBytes int64) bool {
+	return resp.Status < 500 && resp.Status != http.StatusTooManyRequests && resp.Status != StatusCancelled &&
+		int64(len(resp.Body)) <= maxBodyBytes
+}
+
+func (ir *IdempotentRouter) conflict(w http.ResponseWriter) {
+	ir.metrics.IdempotentRequest("conflict")
+	writeError(w, http.StatusConflict, "idempotency_key_reused", "Idempotency-Key was already used with a different request body")
+}
+
+func (ir *IdempotentRouter) replay(w http.ResponseWriter, r *http.Request, resp *IdempotentResponse) {
+	if provider, model, ok := strings.Cut(resp.Header.Get("X-Aspendos-Served-By"), "/"); ok {
+		middleware.RequestInfoFrom(r.Context()).SetRoute(model, provider)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(IdempotentReplayHeader, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	inflightQueued    = "queued"
+	inflightUpstream  = "upstream"
+	inflightStreaming = "streaming"
+
+	// StatusCancelled answers a request an operator cancelled, as nginx's
+	// 499 does one the client gave up on.
+	StatusCancelled = 499
+)
+
+// errCancelledByAdmin is the cause of the context of a request cancelled
+// through the admin API.
+var errCancelledByAdmin = errors.New("request cancelled by an operator")
+
+// InFlight tracks the requests being served, for operators to see what the
+// router is doing and cancel requests that are stuck. Requests are kept in
+// a sync.Map, written once as they start and once as they end, so tracking
+// takes no lock shared between requests. Only a request's metadata is
+// kept, never its content.
+type InFlight struct {
+	requests sync.Map // *inflightRequest to struct{}
+}
+
+type inflightRequest struct {
+	id        string
+	requested string
+	start     time.Time
+	info      *middleware.RequestInfo
+	cancel    context.CancelCauseFunc
+	// aborted ends when an operator cancels the request, even once its
+	// client has gone, for work detached from the client to end with it.
+	aborted context.Context
+	abort   context.CancelFunc
+}
+
+type inflightKey struct{}
+
+// InFlightRequest is one request of GET /admin/inflight. Model and
+// Provider are where the request is routed once it is, Model the model it
+// asked for until then. RequestID is shared by the requests of a batch.
+type InFlightRequest struct {
+	RequestID string    `json:"request_id"`
+	APIKey    string    `json:"api_key,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs float64   `json:"elapsed_ms"`
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{}
+}
+
+// Middleware tracks each request from here until it is answered, under a
+// context that Cancel can cancel. A cancelled request is answered with 499
+// unless its response has started, whatever the handler makes of its
+// context ending; a stream that has started ends with an error event.
+func (f *InFlight) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := middleware.WithRequestInfo(r)
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		aborted, abort := context.WithCancel(context.Background())
+		defer abort()
+		req := &inflightRequest{
+			id:        middleware.RequestIDFrom(ctx),
+			requested: peekModel(r),
+			start:     time.Now(),
+			info:      info,
+			cancel:    cancel,
+			aborted:   aborted,
+			abort:     abort,
+		}
+		f.requests.Store(req, struct{}{})
+		defer f.requests.Delete(req)
+		ctx = context.WithValue(ctx, inflightKey{}, req)
+
+		cw := &cancellableWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+		if cw.cancelled() && !cw.started {
+			writeCancelled(w)
+		}
+	})
+}
+
+// List returns the requests in flight, oldest first.
+func (f *InFlight) List(now time.Time) []InFlightRequest {
+	out := []InFlightRequest{}
+	f.requests.Range(func(k, _ any) bool {
+		req := k.(*inflightRequest)
+		model, provider := req.info.Route()
+		if model == "" {
+			model = req.requested
+		}
+		state := req.info.State()
+		if state == "" {
+			state = inflightQueued
+		}
+		out = append(out, InFlightRequest{
+			RequestID: req.id,
+			APIKey:    req.info.APIKey(),
+			Tenant:    req.info.Tenant(),
+			Model:     model,
+			Provider:  provider,
+			State:     state,
+			StartedAt: req.start.UTC(),
+			ElapsedMs: float64(now.Sub(req.start).Microseconds()) / 1000,
+		})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// Cancel cancels the requests in flight with request ID id, aborting their
+// upstream calls, and returns how many there were.
+func (f *InFlight) Cancel(id string) int {
+	n := 0
+	f.requests.Range(func(k, _ any) bool {
+		if req := k.(*inflightRequest); req.id == id {
+			req.abort()
+			req.cancel(errCancelledByAdmin)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// cancelledByAdmin reports whether ctx ended because an operator
+// cancelled its request.
+func cancelledByAdmin(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errCancelledByAdmin)
+}
+
+// detachFromClient returns a context for work on ctx's request that must
+// outlive its client, such as a call other requests wait on. Unlike
+// context.WithoutCancel, it still ends, with errCancelledByAdmin, when an
+// operator cancels the request. stop releases it once the work is done.
+func detachFromClient(ctx context.Context) (detached context.Context, stop func()) {
+	detached, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	req, ok := ctx.Value(inflightKey{}).(*inflightRequest)
+	if !ok {
+		return detached, func() { cancel(nil) }
+	}
+	unregister := context.AfterFunc(req.aborted, func() { cancel(errCancelledByAdmin) })
+	return detached, func() {
+		unregister()
+		cancel(nil)
+	}
+}
+
+// writeCancelled answers a request an operator cancelled.
+func writeCancelled(w http.ResponseWriter) {
+	apierror.Write(w, StatusCancelled, "request_cancelled", errCancelledByAdmin.Error())
+}
+
+// cancellableWriter drops what a handler writes for a request cancelled
+// before its response started, to be answered with 499 instead.
+type cancellableWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	started bool
+	dropped bool
+}
+
+func (cw *cancellableWriter) cancelled() bool {
+	return cancelledByAdmin(cw.ctx)
+}
+
+func (cw *cancellableWriter) WriteHeader(status int) {
+	if cw.started || cw.dropped {
+		return
+	}
+	if cw.cancelled() {
+		cw.dropped = true
+		return
+	}
+	cw.started = true
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cancellableWriter) Write(b []byte) (int, error) {
+	if !cw.started {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.dropped {
+		return len(b), nil
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *cancellableWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok && cw.started {
+		f.Flush()
+	}
+}
+
+func (cw *cancellableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	cw.started = true
+	return h.Hijack()
+}
+
+func (cw *cancellableWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// hangingUpstream holds every request until the router gives up on it,
+// counting those that started and those that were aborted.
+type hangingUpstream struct {
+	started, aborted atomic.Int64
+}
+
+func (u *hangingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The server notices the router going away once the body is read.
+	io.Copy(io.Discard, r.Body)
+	u.started.Add(1)
+	select {
+	case <-r.Context().Done():
+		u.aborted.Add(1)
+	case <-time.After(10 * time.Second):
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}
+}
+
+// Cancelling a request through the admin API aborts its upstream call and
+// answers it with 499, also where the call is kept running for others
+// that may need its response when the client goes away.
+func TestInFlightCancelAbortsUpstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		model  string
+		header map[string]string
+	}{
+		{name: "plain", model: "plain"},
+		{name: "idempotency key", model: "plain", header: map[string]string{"Idempotency-Key": "k1"}},
+		{name: "deduplicated model", model: "deduplicated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &hangingUpstream{}
+			backend := httptest.NewServer(upstream)
+			defer backend.Close()
+			cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  plain: a
+  deduplicated: {provider: a, deduplicate: true}
+`, backend.URL))
+			rt := newTestRouter(t, cfg)
+			inflight := NewInFlight()
+			handler := middleware.RequestID(routeChainTracked(t, rt, inflight))
+
+			req := chatRequest(fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"hi"}]}`, tt.model))
+			req.Header.Set(middleware.RequestIDHeader, "stuck-1")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handler.ServeHTTP(rec, req)
+			}()
+			waitFor(t, "the upstream call", func() bool { return upstream.started.Load() == 1 })
+
+			if n := inflight.Cancel("stuck-1"); n != 1 {
+				t.Fatalf("cancelled %d requests, want 1", n)
+			}
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the cancelled request was not answered")
+			}
+			if rec.Code != StatusCancelled {
+				t.Errorf("status = %d, want %d: %s", rec.Code, StatusCancelled, rec.Body)
+			}
+			waitFor(t, "the upstream call to be aborted", func() bool { return upstream.aborted.Load() == 1 })
+		})
+	}
+}
+
+// A request whose key's first call an operator cancelled runs again rather
+// than replaying the cancellation.
+func TestInFlightCancelDoesNotSettleIdempotencyKey(t *testing.T) {
+	var calls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if calls.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"second"}`))
+	}))
+	defer backend.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, backend.URL)))
+	inflight := NewInFlight()
+	handler := middleware.RequestID(routeChainTracked(t, rt, inflight))
+	send := func(id string) *httptest.ResponseRecorder {
+		req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+		req.Header.Set(middleware.RequestIDHeader, id)
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() { first <- send("first") }()
+	waitFor(t, "the first call", func() bool { return calls.Load() == 1 })
+	inflight.Cancel("first")
+	if rec := <-first; rec.Code != StatusCancelled {
+		t.Fatalf("first = %d, want %d", rec.Code, StatusCancelled)
+	}
+
+	rec := send("retry")
+	if rec.Code != http.StatusOK || rec.Header().Get(IdempotentReplayHeader) != "" || calls.Load() != 2 {
+		t.Errorf("retry = %d, replayed %q, after %d calls: want a fresh 200", rec.Code, rec.Header().Get(IdempotentReplayHeader), calls.Load())
+	}
+}
+
+// holdInFlight starts n requests through f, with request IDs req-0 to
+// req-<n-1>, that stay in flight until the returned func is called.
+func holdInFlight(b *testing.B, f *InFlight, n int) (release func()) {
+	b.Helper()
+	hold := make(chan struct{})
+	var entered, done sync.WaitGroup
+	entered.Add(n)
+	done.Add(n)
+	h := middleware.Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered.Done()
+		<-hold
+	}), middleware.RequestID, f.Middleware)
+	for i := range n {
+		go func() {
+			defer done.Done()
+			req := chatRequest(`{"model":"m"}`)
+			req.Header.Set(middleware.RequestIDHeader, fmt.Sprintf("req-%d", i))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	entered.Wait()
+	if got := len(f.List(time.Now())); got != n {
+		b.Fatalf("%d requests listed, want %d", got, n)
+	}
+	return func() {
+		close(hold)
+		done.Wait()
+	}
+}
+
+// BenchmarkInFlight times tracking a request, listing and cancelling with
+// 10,000 requests in flight, and tracking with 10,000 at once.
+func BenchmarkInFlight(b *testing.B) {
+	const inflight = 10000
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	b.Run("track with 10k in flight", func(b *testing.B) {
+		f := NewInFlight()
+		defer holdInFlight(b, f, inflight)()
+		h := f.Middleware(noop)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			h.ServeHTTP(httptest.NewRecorder(), chatRequest(`{"model":"m"}`))
+		}
+	})
+	b.Run("track 10k at once", func(b *testing.B) {
+		h := NewInFlight().Middleware(noop)
+		b.SetParallelism(max(inflight/runtime.GOMAXPROCS(0), 1))
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				h.ServeHTTP(httptest.NewRecorder(), chatRequest(`{"model":"m"}`))
+			}
+		})
+	})
+	b.Run("list 10k", func(b *testing.B) {
+		f := NewInFlight()
+		defer holdInFlight(b, f, inflight)()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for range b.N {
+			f.List(time.Now())
+		}
+	})
+	b.Run("cancel among 10k", func(b *testing.B) {
+		f := NewInFlight()
+		defer holdInFlight(b, f, inflight)()
+		b.ResetTimer()
+		for i := range b.N {
+			// Unknown IDs, so every iteration scans all 10k.
+			f.Cancel(fmt.Sprintf("missing-%d", i))
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentSHA256Header carries the hex SHA-256 of a body, as S3's
+// x-amz-content-sha256 does: on a request, the one the client sent; on a
+// response of a model with integrity_check, as a trailer, the one the
+// router passed on.
+const ContentSHA256Header = "X-Content-SHA256"
+
+// errContentDigest is a request body not matching its declared SHA-256.
+var errContentDigest = errors.New("request body does not match " + ContentSHA256Header)
+
+// declaredDigest returns the SHA-256 h declares for the request body, nil
+// if it declares none.
+func declaredDigest(h http.Header) ([]byte, error) {
+	v := strings.TrimSpace(h.Get(ContentSHA256Header))
+	if v == "" {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(v)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New(ContentSHA256Header + " must be 64 hex characters")
+	}
+	return sum, nil
+}
+
+// checkDigest checks a request body, hashed into h as it was read, against
+// the SHA-256 header declares for it, if any. h is nil when header
+// declares none.
+func checkDigest(header http.Header, h hash.Hash) *ValidationError {
+	want, err := declaredDigest(header)
+	switch {
+	case err != nil:
+		return invalid("invalid_content_sha256", err.Error())
+	case want == nil || h == nil:
+		return nil
+	case !bytes.Equal(h.Sum(nil), want):
+		return invalid("content_sha256_mismatch", errContentDigest.Error())
+	}
+	return nil
+}
+
+// digestReader checks a body against the SHA-256 declared for it as it
+// streams through. It hashes what it reads with an io.TeeReader and hands
+// it on but for the last byte read, held back until the next read: the
+// final byte is handed on only once the body has ended and matched, so a
+// corrupted or truncated body never reaches the upstream whole.
+type digestReader struct {
+	io.Closer
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+
+	held     byte
+	holding  bool
+	mismatch bool
+	err      error
+}
+
+func newDigestReader(body io.ReadCloser, want []byte) *digestReader {
+	h := sha256.New()
+	return &digestReader{Closer: body, r: io.TeeReader(body, h), h: h, want: want}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	m, err := d.r.Read(p)
+	n := 0
+	if m > 0 {
+		last := p[m-1]
+		if d.holding {
+			copy(p[1:m], p[:m-1])
+			p[0] = d.held
+			n = m
+		} else {
+			n = m - 1
+		}
+		d.held, d.holding = last, true
+	}
+	if err == nil {
+		return n, nil
+	}
+	if err != io.EOF {
+		d.err = err
+		return n, err
+	}
+	if !bytes.Equal(d.h.Sum(nil), d.want) {
+		d.mismatch, d.err = true, errContentDigest
+		return n, d.err
+	}
+	if d.holding && n < len(p) {
+		p[n] = d.held
+		n++
+		d.holding = false
+	}
+	if d.holding {
+		// No room for the last byte: the next read hands it on.
+		return n, nil
+	}
+	d.err = io.EOF
+	return n, io.EOF
+}
+
+// writeDigestTrailer declares the X-Content-SHA256 trailer on w and returns
+// src teeing into the hash it is set from by the returned func, to be
+// called once src has been copied whole. A response cut short is left
+// without the trailer.
+func writeDigestTrailer(w http.ResponseWriter, src io.Reader) (io.Reader, func()) {
+	h := sha256.New()
+	w.Header().Add("Trailer", ContentSHA256Header)
+	return io.TeeReader(src, h), func() {
+		w.Header().Set(ContentSHA256Header, hex.EncodeToString(h.Sum(nil)))
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// corruptedReader reads as body does, but with the byte at offset
+// flipped, as a proxy bit flip in transit would.
+type corruptedReader struct {
+	body   []byte
+	offset int
+	read   int
+}
+
+func (c *corruptedReader) Read(p []byte) (int, error) {
+	if c.read == len(c.body) {
+		return 0, io.EOF
+	}
+	// A byte at a time, so the corruption is read mid-stream.
+	p[0] = c.body[c.read]
+	if c.read == c.offset {
+		p[0] ^= 0xff
+	}
+	c.read++
+	return 1, nil
+}
+
+// A body read whole, as a JSON one is, must match its X-Content-SHA256
+// before anything is sent upstream, and the response carries the SHA-256
+// of what was passed back as a trailer.
+func TestIntegrityCheck(t *testing.T) {
+	const response = `{"id":"resp-1","choices":[{"message":{"content":"ok"}}]}`
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a, integrity_check: true}
+  unchecked: {provider: a}
+`, upstream.URL)))
+	srv := httptest.NewServer(routeChain(t, rt))
+	defer srv.Close()
+
+	body := []byte(`{"model":"m","messages":[{"role":"user","content":"` + strings.Repeat("a", 4096) + `"}]}`)
+	sum := sha256Hex(body)
+	tests := []struct {
+		name     string
+		body     io.Reader
+		declared string
+		want     int
+		code     string
+		trailer  bool
+	}{
+		{name: "matching", body: bytes.NewReader(body), declared: sum, want: http.StatusOK, trailer: true},
+		{name: "none declared", body: bytes.NewReader(body), want: http.StatusOK, trailer: true},
+		{name: "corrupted mid-stream", body: &corruptedReader{body: body, offset: len(body) / 2}, declared: sum, want: http.StatusBadRequest, code: "content_sha256_mismatch"},
+		{name: "short a character", body: bytes.NewReader(bytes.Replace(body, []byte("aa"), []byte("a"), 1)), declared: sum, want: http.StatusBadRequest, code: "content_sha256_mismatch"},
+		{name: "malformed header", body: bytes.NewReader(body), declared: "abc", want: http.StatusBadRequest, code: "invalid_content_sha256"},
+		{name: "unchecked model", body: bytes.NewReader(bytes.Replace(body, []byte(`"m"`), []byte(`"unchecked"`), 1)), declared: sum, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+chatCompletionsPath, tt.body)
+			req.Header.Set("Content-Type", "application/json")
+			if tt.declared != "" {
+				req.Header.Set(ContentSHA256Header, tt.declared)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want || (tt.code != "" && !strings.Contains(string(got), tt.code)) {
+				t.Fatalf("status = %d: %s, want %d %s", resp.StatusCode, got, tt.want, tt.code)
+			}
+			if tt.want != http.StatusOK && calls.Load() != 0 {
+				t.Errorf("the upstream was called %d times, want none", calls.Load())
+			}
+			trailer := resp.Trailer.Get(ContentSHA256Header)
+			switch {
+			case tt.trailer && trailer != sha256Hex([]byte(response)):
+				t.Errorf("%s trailer = %q, want the SHA-256 of %s", ContentSHA256Header, trailer, got)
+			case !tt.trailer && trailer != "":
+				t.Errorf("%s trailer = %q, want none", ContentSHA256Header, trailer)
+			}
+		})
+	}
+}
+
+// An upload is streamed upstream as it is checked, and a corrupted one is
+// answered with 400 without the upstream ever receiving all of it.
+func TestIntegrityCheckUpload(t *testing.T) {
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "whisper")
+	fw, _ := mw.CreateFormFile("file", "audio.wav")
+	fw.Write(bytes.Repeat([]byte("RIFF"), 64<<10))
+	mw.Close()
+	sum := sha256Hex(form.Bytes())
+
+	var whole atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, err := io.ReadAll(r.Body); err == nil && bytes.Equal(got, form.Bytes()) {
+			whole.Add(1)
+		}
+		io.WriteString(w, `{"text":"hi"}`)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  whisper: {provider: a, integrity_check: true, accepted_content_types: [multipart/form-data]}
+`, upstream.URL)))
+	srv := httptest.NewServer(http.HandlerFunc(rt.handleUpload))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		body  io.Reader
+		want  int
+		whole int64
+	}{
+		{name: "matching", body: bytes.NewReader(form.Bytes()), want: http.StatusOK, whole: 1},
+		{name: "corrupted mid-stream", body: &corruptedReader{body: form.Bytes(), offset: form.Len() / 2}, want: http.StatusBadRequest},
+		{name: "last byte corrupted", body: &corruptedReader{body: form.Bytes(), offset: form.Len() - 1}, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whole.Store(0)
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/audio/transcriptions", tt.body)
+			req.ContentLength = int64(form.Len())
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set(ContentSHA256Header, sum)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d: %s, want %d", resp.StatusCode, got, tt.want)
+			}
+			if whole.Load() != tt.whole {
+				t.Errorf("the upstream received the whole body %d times, want %d", whole.Load(), tt.whole)
+			}
+		})
+	}
+}
+
+// However its reads split the body, digestReader hands on all of a
+// matching one and never the last byte of one that does not match.
+func TestDigestReader(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 100))
+	want := sha256.Sum256(body)
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			got, err := io.ReadAll(newDigestReader(io.NopCloser(wrap(bytes.NewReader(body))), want[:]))
+			if err != nil || !bytes.Equal(got, body) {
+				t.Errorf("read %d bytes, %v: want all %d", len(got), err, len(body))
+			}
+			d := newDigestReader(io.NopCloser(wrap(&corruptedReader{body: body, offset: 500})), want[:])
+			got, err = io.ReadAll(d)
+			if err != errContentDigest || !d.mismatch || len(got) >= len(body) {
+				t.Errorf("corrupted: read %d bytes, %v: want fewer than %d and errContentDigest", len(got), err, len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	defaultKeyPrefix   = "model-router:apikey:"
+	defaultKeyCacheTTL = 30 * time.Second
+	// keyLookupTimeout bounds a Redis lookup, so a slow Redis costs a
+	// request at most this before a cached answer or a 503 stands in.
+	keyLookupTimeout = time.Second
+	// maxStaleKey is how long past its TTL a cached key is still honoured
+	// while Redis cannot be reached.
+	maxStaleKey    = 5 * time.Minute
+	maxCachedKeys  = 10000
+	keySweepPeriod = time.Minute
+)
+
+// RedisKeyStore looks API keys up in Redis, as laid out by
+// middleware.RedisKeysConfig, keeping each answer for the cache TTL. When
+// Redis fails, a key found within maxStaleKey of its TTL is answered from
+// the cache; unknown keys are not. now is its clock, time.Now but for
+// tests.
+type RedisKeyStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+	now    func() time.Time
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	cache   map[string]cachedKey
+	swept   time.Time
+	failing bool
+}
+
+// cachedKey is a lookup's answer: the key, or found false for one Redis
+// does not have.
+type cachedKey struct {
+	info    middleware.KeyInfo
+	found   bool
+	expires time.Time
+}
+
+func NewRedisKeyStore(cfg middleware.RedisKeysConfig, logger *slog.Logger) (*RedisKeyStore, error) {
+	opts, err := redis.ParseURL(cfg.URL())
+	if err != nil {
+		return nil, fmt.Errorf("auth.redis redis url: %w", err)
+	}
+	ks := &RedisKeyStore{client: redis.NewClient(opts), prefix: cfg.KeyPrefix, ttl: time.Duration(cfg.CacheTTLSeconds) * time.Second, now: time.Now, logger: logger, cache: make(map[string]cachedKey)}
+	if ks.prefix == "" {
+		ks.prefix = defaultKeyPrefix
+	}
+	if ks.ttl <= 0 {
+		ks.ttl = defaultKeyCacheTTL
+	}
+	return ks, nil
+}
+
+func (ks *RedisKeyStore) Lookup(ctx context.Context, secret string) (middleware.KeyInfo, error) {
+	sum := sha256.Sum256([]byte(secret))
+	digest := hex.EncodeToString(sum[:])
+	now := ks.now()
+	ks.mu.Lock()
+	cached, ok := ks.cache[digest]
+	ks.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.answer()
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, keyLookupTimeout)
+	info, err := ks.fetch(lookupCtx, digest)
+	cancel()
+	found := err == nil
+	if err != nil && !errors.Is(err, middleware.ErrKeyNotFound) {
+		ks.mu.Lock()
+		if !ks.failing {
+			ks.logger.Warn("API key lookup in Redis failed; keys found recently are answered from the cache", slog.String("error", err.Error()))
+		}
+		ks.failing = true
+		ks.mu.Unlock()
+		if ok && cached.found && now.Before(cached.expires.Add(maxStaleKey)) {
+			return cached.info, nil
+		}
+		return middleware.KeyInfo{}, fmt.Errorf("looking up API key: %w", err)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.failing {
+		ks.failing = false
+		ks.logger.Info("API key lookup in Redis recovered")
+	}
+	ks.sweep(now)
+	ks.cache[digest] = cachedKey{info: info, found: found, expires: now.Add(ks.ttl)}
+	return ks.cache[digest].answer()
+}
+
+func (c cachedKey) answer() (middleware.KeyInfo, error) {
+	if !c.found {
+		return middleware.KeyInfo{}, middleware.ErrKeyNotFound
+	}
+	return c.info, nil
+}
+
+// fetch reads the key whose secret has the hex SHA-256 digest.
+func (ks *RedisKeyStore) fetch(ctx context.Context, digest string) (middleware.KeyInfo, error) {
+	fields, err := ks.client.HGetAll(ctx, ks.prefix+digest).Result()
+	if err != nil {
+		return middleware.KeyInfo{}, err
+	}
+	if len(fields) == 0 {
+		return middleware.KeyInfo{}, middleware.ErrKeyNotFound
+	}
+	info := middleware.KeyInfo{Name: fields["name"], Tenant: fields["tenant"]}
+	if info.Name == "" {
+		// Logs name keys by the start of their digest, which identifies a
+		// key without revealing it.
+		info.Name = "redis:" + digest[:12]
+	}
+	if v := fields["requests_per_minute"]; v != "" {
+		rpm, err := strconv.Atoi(v)
+		if err != nil || rpm < 0 {
+			ks.logger.Warn("API key in Redis has an invalid requests_per_minute; ignoring it",
+				slog.String("api_key", info.Name), slog.String("requests_per_minute", v))
+		} else {
+			info.RequestsPerMinute = rpm
+		}
+	}
+	for _, p := range strings.Split(fields["allowed_models"], ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			info.AllowedModels = append(info.AllowedModels, p)
+		}
+	}
+	if v := fields["model_override"]; v != "" {
+		override, err := strconv.ParseBool(v)
+		if err != nil {
+			ks.logger.Warn("API key in Redis has an invalid model_override; ignoring it",
+				slog.String("api_key", info.Name), slog.String("model_override", v))
+		}
+		info.ModelOverride = override
+	}
+	for field, dst := range map[string]*string{"priority": &info.Priority, "max_priority": &info.MaxPriority} {
+		if v := fields[field]; !validPriorityClass(v) {
+			ks.logger.Warn("API key in Redis has an invalid "+field+"; ignoring it",
+				slog.String("api_key", info.Name), slog.String(field, v))
+		} else {
+			*dst = v
+		}
+	}
+	return info, nil
+}
+
+// sweep drops the cached keys too old to answer for even while Redis is
+// down, at most once every keySweepPeriod unless the cache is full, and
+// then whatever it takes to make room. ks.mu must be held.
+func (ks *RedisKeyStore) sweep(now time.Time) {
+	full := len(ks.cache) >= maxCachedKeys
+	if !full && now.Sub(ks.swept) < keySweepPeriod {
+		return
+	}
+	ks.swept = now
+	for digest, c := range ks.cache {
+		if (!c.found && now.After(c.expires)) || now.After(c.expires.Add(maxStaleKey)) {
+			delete(ks.cache, digest)
+		}
+	}
+	for digest := range ks.cache {
+		if len(ks.cache) < maxCachedKeys {
+			break
+		}
+		delete(ks.cache, digest)
+	}
+}
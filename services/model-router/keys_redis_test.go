@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// redisKeys is a key store on a fresh miniredis, on a clock the test moves
+// by setting *now.
+func redisKeys(t *testing.T, cfg middleware.RedisKeysConfig) (*RedisKeyStore, *miniredis.Miniredis, *time.Time) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cfg.RedisURL = "redis://" + mr.Addr()
+	ks, err := NewRedisKeyStore(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ks.client.Close() })
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ks.now = func() time.Time { return now }
+	return ks, mr, &now
+}
+
+// keyHash is where secret is kept in Redis under prefix.
+func keyHash(prefix, secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+func TestRedisKeyLookup(t *testing.T) {
+	ks, mr, _ := redisKeys(t, middleware.RedisKeysConfig{KeyPrefix: "keys:"})
+	mr.HSet(keyHash("keys:", "sk-full"),
+		"name", "batch-job", "tenant", "acme", "requests_per_minute", "60",
+		"allowed_models", "gpt-4o, llama-*,", "model_override", "true",
+		"priority", "low", "max_priority", "normal")
+	mr.HSet(keyHash("keys:", "sk-bad-fields"),
+		"requests_per_minute", "many", "model_override", "sometimes", "priority", "urgent")
+	mr.HSet(keyHash(defaultKeyPrefix, "sk-elsewhere"), "name", "other-prefix")
+
+	tests := []struct {
+		name   string
+		secret string
+		want   middleware.KeyInfo
+		err    error
+	}{
+		{
+			name:   "every field",
+			secret: "sk-full",
+			want: middleware.KeyInfo{
+				Name: "batch-job", Tenant: "acme", RequestsPerMinute: 60,
+				AllowedModels: []string{"gpt-4o", "llama-*"}, ModelOverride: true,
+				Priority: "low", MaxPriority: "normal",
+			},
+		},
+		{
+			// Invalid fields are ignored, and the key is named by its digest.
+			name:   "invalid fields",
+			secret: "sk-bad-fields",
+			want:   middleware.KeyInfo{Name: "redis:" + keyHash("", "sk-bad-fields")[:12]},
+		},
+		{name: "unknown", secret: "sk-unknown", err: middleware.ErrKeyNotFound},
+		{name: "under another prefix", secret: "sk-elsewhere", err: middleware.ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ks.Lookup(context.Background(), tt.secret)
+			if !errors.Is(err, tt.err) || (tt.err == nil && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("Lookup = %+v, %v, want %+v, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+// A key deleted in Redis keeps working until its cached lookup expires, and
+// a key added is found once the cached miss has.
+func TestRedisKeyCacheTTL(t *testing.T) {
+	ks, mr, now := redisKeys(t, middleware.RedisKeysConfig{CacheTTLSeconds: 10})
+	ctx := context.Background()
+	mr.HSet(keyHash(defaultKeyPrefix, "sk-revoked"), "name", "revoked")
+	if _, err := ks.Lookup(ctx, "sk-revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Lookup(ctx, "sk-issued"); !errors.Is(err, middleware.ErrKeyNotFound) {
+		t.Fatalf("unissued key: %v, want ErrKeyNotFound", err)
+	}
+	mr.Del(keyHash(defaultKeyPrefix, "sk-revoked"))
+	mr.HSet(keyHash(defaultKeyPrefix, "sk-issued"), "name", "issued")
+	start := *now
+
+	*now = start.Add(9 * time.Second)
+	if _, err := ks.Lookup(ctx, "sk-revoked"); err != nil {
+		t.Errorf("deleted key within the TTL: %v, want it still cached", err)
+	}
+	if _, err := ks.Lookup(ctx, "sk-issued"); !errors.Is(err, middleware.ErrKeyNotFound) {
+		t.Errorf("issued key within the TTL: %v, want the cached miss", err)
+	}
+	*now = start.Add(10 * time.Second)
+	if _, err := ks.Lookup(ctx, "sk-revoked"); !errors.Is(err, middleware.ErrKeyNotFound) {
+		t.Errorf("deleted key after the TTL: %v, want ErrKeyNotFound", err)
+	}
+	if info, err := ks.Lookup(ctx, "sk-issued"); err != nil || info.Name != "issued" {
+		t.Errorf("issued key after the TTL: %+v, %v", info, err)
+	}
+}
+
+// While Redis is down, keys found before are still served for a few
+// minutes past their TTL, and nothing else is.
+func TestRedisKeysDown(t *testing.T) {
+	ks, mr, now := redisKeys(t, middleware.RedisKeysConfig{CacheTTLSeconds: 10})
+	ctx := context.Background()
+	mr.HSet(keyHash(defaultKeyPrefix, "sk-known"), "name", "known")
+	if _, err := ks.Lookup(ctx, "sk-known"); err != nil {
+		t.Fatal(err)
+	}
+	ks.Lookup(ctx, "sk-unknown")
+	start := *now
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+
+	for _, after := range []time.Duration{time.Second, 10 * time.Second, 10*time.Second + maxStaleKey - time.Second} {
+		*now = start.Add(after)
+		if info, err := ks.Lookup(ctx, "sk-known"); err != nil || info.Name != "known" {
+			t.Errorf("%v in, known key = %+v, %v: want it from the cache", after, info, err)
+		}
+	}
+	if _, err := ks.Lookup(ctx, "sk-unknown"); err == nil || errors.Is(err, middleware.ErrKeyNotFound) {
+		t.Errorf("key cached as unknown = %v, want a lookup error", err)
+	}
+	if _, err := ks.Lookup(ctx, "sk-never-seen"); err == nil || errors.Is(err, middleware.ErrKeyNotFound) {
+		t.Errorf("key never looked up = %v, want a lookup error", err)
+	}
+	*now = start.Add(10*time.Second + maxStaleKey + time.Second)
+	if _, err := ks.Lookup(ctx, "sk-known"); err == nil {
+		t.Error("known key past the stale limit was served")
+	}
+
+	mr.SetError("")
+	if info, err := ks.Lookup(ctx, "sk-known"); err != nil || info.Name != "known" {
+		t.Errorf("after Redis recovered: %+v, %v", info, err)
+	}
+}
+
+// Behind auth, a Redis key is accepted, refused once deleted, and while
+// Redis is down a key the router cannot check is answered with 503.
+func TestRedisKeysAuth(t *testing.T) {
+	ks, mr, now := redisKeys(t, middleware.RedisKeysConfig{CacheTTLSeconds: 10})
+	auth, err := middleware.NewAuth(middleware.AuthConfig{}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.AddKeyStore(ks)
+	h := middleware.Logging(testLogger())(auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(middleware.RequestInfoFrom(r.Context()).APIKey()))
+	})))
+	call := func(secret string) *httptest.ResponseRecorder {
+		req := chatRequest(`{}`)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	mr.HSet(keyHash(defaultKeyPrefix, "sk-redis"), "name", "from-redis")
+
+	if rec := call("sk-redis"); rec.Code != http.StatusOK || rec.Body.String() != "from-redis" {
+		t.Errorf("Redis key = %d %s, want 200 as from-redis", rec.Code, rec.Body)
+	}
+	mr.Del(keyHash(defaultKeyPrefix, "sk-redis"))
+	*now = now.Add(10 * time.Second)
+	if rec := call("sk-redis"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("deleted key = %d, want 401", rec.Code)
+	}
+	mr.SetError("ERR down")
+	if rec := call("sk-other"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("unchecked key = %d, want 503 with Retry-After", rec.Code)
+	}
+}
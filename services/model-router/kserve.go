@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The KServe v2 (Open Inference Protocol) messages the router exchanges
+// with gRPC backends such as Triton, encoded by hand from
+// grpc_predict_v2.proto so no generated code is needed. The JSON shapes
+// are those of the protocol's REST binding.
+
+// kserveTensor is an input or output tensor with its data flattened in
+// row-major order.
+type kserveTensor struct {
+	Name       string         `json:"name"`
+	Datatype   string         `json:"datatype"`
+	Shape      []int64        `json:"shape"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+	Data       []any          `json:"data"`
+}
+
+type kserveOutputRequest struct {
+	Name       string         `json:"name"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// kserveRequest is a ModelInferRequest.
+type kserveRequest struct {
+	ModelName    string                `json:"model_name,omitempty"`
+	ModelVersion string                `json:"model_version,omitempty"`
+	ID           string                `json:"id,omitempty"`
+	Parameters   map[string]any        `json:"parameters,omitempty"`
+	Inputs       []kserveTensor        `json:"inputs"`
+	Outputs      []kserveOutputRequest `json:"outputs,omitempty"`
+}
+
+// kserveResponse is a ModelInferResponse.
+type kserveResponse struct {
+	ModelName    string         `json:"model_name"`
+	ModelVersion string         `json:"model_version,omitempty"`
+	ID           string         `json:"id,omitempty"`
+	Parameters   map[string]any `json:"parameters,omitempty"`
+	Outputs      []kserveTensor `json:"outputs"`
+}
+
+// output returns the output tensor called name.
+func (r *kserveResponse) output(name string) (kserveTensor, bool) {
+	for _, t := range r.Outputs {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return kserveTensor{}, false
+}
+
+// Field numbers of grpc_predict_v2.proto.
+const (
+	// ModelInferRequest, and ModelInferResponse for the first four.
+	kfModelName    protowire.Number = 1
+	kfModelVersion protowire.Number = 2
+	kfID           protowire.Number = 3
+	kfParameters   protowire.Number = 4
+	kfInputs       protowire.Number = 5
+	kfOutputs      protowire.Number = 6
+
+	// ModelInferResponse.
+	kfResponseOutputs protowire.Number = 5
+	kfRawOutputs      protowire.Number = 6
+
+	// InferInputTensor and InferOutputTensor.
+	kfTensorName    protowire.Number = 1
+	kfTensorType    protowire.Number = 2
+	kfTensorShape   protowire.Number = 3
+	kfTensorParams  protowire.Number = 4
+	kfTensorContent protowire.Number = 5
+
+	// ModelStreamInferResponse.
+	kfStreamError    protowire.Number = 1
+	kfStreamResponse protowire.Number = 2
+)
+
+// contentsField maps a datatype to its InferTensorContents field.
+var contentsField = map[string]protowire.Number{
+	"BOOL":   1,
+	"INT8":   2,
+	"INT16":  2,
+	"INT32":  2,
+	"INT64":  3,
+	"UINT8":  4,
+	"UINT16": 4,
+	"UINT32": 4,
+	"UINT64": 5,
+	"FP32":   6,
+	"FP64":   7,
+	"BYTES":  8,
+}
+
+func appendStringField(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendParameters encodes a map<string, InferParameter>.
+func appendParameters(b []byte, num protowire.Number, params map[string]any) ([]byte, error) {
+	for key, v := range params {
+		var param []byte
+		switch v := v.(type) {
+		case bool:
+			param = protowire.AppendTag(param, 1, protowire.VarintType)
+			param = protowire.AppendVarint(param, protowire.EncodeBool(v))
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				param = protowire.AppendTag(param, 2, protowire.VarintType)
+				param = protowire.AppendVarint(param, uint64(n))
+			} else if f, err := v.Float64(); err == nil {
+				param = protowire.AppendTag(param, 4, protowire.Fixed64Type)
+				param = protowire.AppendFixed64(param, math.Float64bits(f))
+			} else {
+				return nil, fmt.Errorf("parameter %q: %w", key, err)
+			}
+		case string:
+			param = appendStringField(param, 3, v)
+		default:
+			return nil, fmt.Errorf("parameter %q must be a bool, number or string", key)
+		}
+		var entry []byte
+		entry = appendStringField(entry, 1, key)
+		entry = appendBytesField(entry, 2, param)
+		b = appendBytesField(b, num, entry)
+	}
+	return b, nil
+}
+
+// flatten lists the leaves of nested JSON arrays in row-major order.
+func flatten(data []any) []any {
+	out := make([]any, 0, len(data))
+	for _, v := range data {
+		if inner, ok := v.([]any); ok {
+			out = append(out, flatten(inner)...)
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// appendContents encodes a tensor's data as InferTensorContents.
+func appendContents(b []byte, t kserveTensor) ([]byte, error) {
+	num, ok := contentsField[t.Datatype]
+	if !ok {
+		return nil, fmt.Errorf("input %q: datatype %q is not supported", t.Name, t.Datatype)
+	}
+	var packed []byte
+	var contents []byte
+	for i, v := range flatten(t.Data) {
+		bad := func() error {
+			return fmt.Errorf("input %q: data[%d] is not a %s value", t.Name, i, t.Datatype)
+		}
+		switch t.Datatype {
+		case "BYTES":
+			s, ok := v.(string)
+			if !ok {
+				return nil, bad()
+			}
+			contents = appendBytesField(contents, num, []byte(s))
+		case "BOOL":
+			bv, ok := v.(bool)
+			if !ok {
+				return nil, bad()
+			}
+			packed = protowire.AppendVarint(packed, protowire.EncodeBool(bv))
+		case "FP32", "FP64":
+			n, ok := v.(json.Number)
+			if !ok {
+				return nil, bad()
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return nil, bad()
+			}
+			if t.Datatype == "FP32" {
+				packed = protowire.AppendFixed32(packed, math.Float32bits(float32(f)))
+			} else {
+				packed = protowire.AppendFixed64(packed, math.Float64bits(f))
+			}
+		default:
+			n, ok := v.(json.Number)
+			if !ok {
+				return nil, bad()
+			}
+			x, err := n.Int64()
+			if err != nil {
+				return nil, bad()
+			}
+			packed = protowire.AppendVarint(packed, uint64(x))
+		}
+	}
+	if len(packed) > 0 {
+		contents = appendBytesField(contents, num, packed)
+	}
+	return appendBytesField(b, kfTensorContent, contents), nil
+}
+
+// marshalKServeRequest encodes r as a ModelInferRequest.
+func marshalKServeRequest(r kserveRequest) ([]byte, error) {
+	var b []byte
+	b = appendStringField(b, kfModelName, r.ModelName)
+	b = appendStringField(b, kfModelVersion, r.ModelVersion)
+	b = appendStringField(b, kfID, r.ID)
+	b, err := appendParameters(b, kfParameters, r.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range r.Inputs {
+		var tb []byte
+		tb = appendStringField(tb, kfTensorName, t.Name)
+		tb = appendStringField(tb, kfTensorType, t.Datatype)
+		var shape []byte
+		for _, d := range t.Shape {
+			shape = protowire.AppendVarint(shape, uint64(d))
+		}
+		tb = appendBytesField(tb, kfTensorShape, shape)
+		if tb, err = appendParameters(tb, kfTensorParams, t.Parameters); err != nil {
+			return nil, fmt.Errorf("input %q: %w", t.Name, err)
+		}
+		if tb, err = appendContents(tb, t); err != nil {
+			return nil, err
+		}
+		b = appendBytesField(b, kfInputs, tb)
+	}
+	for _, o := range r.Outputs {
+		var ob []byte
+		ob = appendStringField(ob, kfTensorName, o.Name)
+		if ob, err = appendParameters(ob, 2, o.Parameters); err != nil {
+			return nil, fmt.Errorf("output %q: %w", o.Name, err)
+		}
+		b = appendBytesField(b, kfOutputs, ob)
+	}
+	return b, nil
+}
+
+var errMalformedProto = errors.New("malformed protobuf message")
+
+// protoFields calls fn for every field of the message in b.
+func protoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformedProto
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return errMalformedProto
+		}
+		if err := fn(num, typ, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func protoBytes(v []byte) ([]byte, error) {
+	out, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return nil, errMalformedProto
+	}
+	return out, nil
+}
+
+// protoScalars decodes a repeated scalar field, packed or not, as raw
+// varint, fixed32 or fixed64 values.
+func protoScalars(typ protowire.Type, v []byte, packedType protowire.Type) ([]uint64, error) {
+	if typ != protowire.BytesType {
+		return consumeScalars(typ, v, false)
+	}
+	inner, err := protoBytes(v)
+	if err != nil {
+		return nil, err
+	}
+	return consumeScalars(packedType, inner, true)
+}
+
+func consumeScalars(typ protowire.Type, v []byte, many bool) ([]uint64, error) {
+	var out []uint64
+	for len(v) > 0 {
+		var x uint64
+		var n int
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(v)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(v)
+			x = uint64(x32)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(v)
+		default:
+			return nil, errMalformedProto
+		}
+		if n < 0 {
+			return nil, errMalformedProto
+		}
+		out = append(out, x)
+		v = v[n:]
+		if !many {
+			break
+		}
+	}
+	return out, nil
+}
+
+func unmarshalParameters(v []byte, into map[string]any) error {
+	entry, err := protoBytes(v)
+	if err != nil {
+		return err
+	}
+	var key string
+	var value any
+	err = protoFields(entry, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		switch num {
+		case 1:
+			s, err := protoBytes(v)
+			key = string(s)
+			return err
+		case 2:
+			param, err := protoBytes(v)
+			if err != nil {
+				return err
+			}
+			return protoFields(param, func(num protowire.Number, _ protowire.Type, v []byte) error {
+				switch num {
+				case 1:
+					x, _ := protowire.ConsumeVarint(v)
+					value = x != 0
+				case 2:
+					x, _ := protowire.ConsumeVarint(v)
+					value = int64(x)
+				case 3:
+					s, err := protoBytes(v)
+					value = string(s)
+					return err
+				case 4:
+					x, _ := protowire.ConsumeFixed64(v)
+					value = math.Float64frombits(x)
+				case 5:
+					value, _ = protowire.ConsumeVarint(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	into[key] = value
+	return err
+}
+
+// unmarshalContents decodes InferTensorContents into t.Data.
+func unmarshalContents(v []byte, t *kserveTensor) error {
+	contents, err := protoBytes(v)
+	if err != nil {
+		return err
+	}
+	return protoFields(contents, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num == 8 {
+			s, err := protoBytes(v)
+			t.Data = append(t.Data, string(s))
+			return err
+		}
+		packedType := protowire.VarintType
+		switch num {
+		case 6:
+			packedType = protowire.Fixed32Type
+		case 7:
+			packedType = protowire.Fixed64Type
+		}
+		xs, err := protoScalars(typ, v, packedType)
+		if err != nil {
+			return err
+		}
+		for _, x := range xs {
+			switch num {
+			case 1:
+				t.Data = append(t.Data, x != 0)
+			case 2:
+				t.Data = append(t.Data, int32(x))
+			case 3:
+				t.Data = append(t.Data, int64(x))
+			case 4, 5:
+				t.Data = append(t.Data, x)
+			case 6:
+				t.Data = append(t.Data, math.Float32frombits(uint32(x)))
+			case 7:
+				t.Data = append(t.Data, math.Float64frombits(x))
+			}
+		}
+		return nil
+	})
+}
+
+// decodeRaw decodes one tensor's raw_output_contents, little-endian as
+// the protocol specifies, with BYTES elements each prefixed by a 4-byte
+// length.
+func decodeRaw(t *kserveTensor, raw []byte) error {
+	size := map[string]int{"BOOL": 1, "INT8": 1, "UINT8": 1, "INT16": 2, "UINT16": 2,
+		"INT32": 4, "UINT32": 4, "FP32": 4, "INT64": 8, "UINT64": 8, "FP64": 8}
+	if t.Datatype == "BYTES" {
+		for len(raw) > 0 {
+			if len(raw) < 4 {
+				return fmt.Errorf("output %q: truncated BYTES element", t.Name)
+			}
+			n := binary.LittleEndian.Uint32(raw)
+			if uint64(len(raw)-4) < uint64(n) {
+				return fmt.Errorf("output %q: truncated BYTES element", t.Name)
+			}
+			t.Data = append(t.Data, string(raw[4:4+n]))
+			raw = raw[4+n:]
+		}
+		return nil
+	}
+	width, ok := size[t.Datatype]
+	if !ok {
+		return fmt.Errorf("output %q: datatype %q is not supported", t.Name, t.Datatype)
+	}
+	if len(raw)%width != 0 {
+		return fmt.Errorf("output %q: %d bytes is not a whole number of %s values", t.Name, len(raw), t.Datatype)
+	}
+	le := binary.LittleEndian
+	for ; len(raw) > 0; raw = raw[width:] {
+		var v any
+		switch t.Datatype {
+		case "BOOL":
+			v = raw[0] != 0
+		case "INT8":
+			v = int8(raw[0])
+		case "UINT8":
+			v = raw[0]
+		case "INT16":
+			v = int16(le.Uint16(raw))
+		case "UINT16":
+			v = le.Uint16(raw)
+		case "INT32":
+			v = int32(le.Uint32(raw))
+		case "UINT32":
+			v = le.Uint32(raw)
+		case "FP32":
+			v = math.Float32frombits(le.Uint32(raw))
+		case "INT64":
+			v = int64(le.Uint64(raw))
+		case "UINT64":
+			v = le.Uint64(raw)
+		case "FP64":
+			v = math.Float64frombits(le.Uint64(raw))
+		}
+		t.Data = append(t.Data, v)
+	}
+	return nil
+}
+
+func unmarshalTensor(v []byte) (kserveTensor, error) {
+	t := kserveTensor{Data: []any{}}
+	msg, err := protoBytes(v)
+	if err != nil {
+		return t, err
+	}
+	err = protoFields(msg, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case kfTensorName, kfTensorType:
+			s, err := protoBytes(v)
+			if num == kfTensorName {
+				t.Name = string(s)
+			} else {
+				t.Datatype = string(s)
+			}
+			return err
+		case kfTensorShape:
+			dims, err := protoScalars(typ, v, protowire.VarintType)
+			for _, d := range dims {
+				t.Shape = append(t.Shape, int64(d))
+			}
+			return err
+		case kfTensorParams:
+			if t.Parameters == nil {
+				t.Parameters = make(map[string]any)
+			}
+			return unmarshalParameters(v, t.Parameters)
+		case kfTensorContent:
+			return unmarshalContents(v, &t)
+		}
+		return nil
+	})
+	return t, err
+}
+
+// unmarshalKServeResponse decodes a ModelInferResponse, moving raw output
+// contents into their tensors.
+func unmarshalKServeResponse(b []byte) (*kserveResponse, error) {
+	r := &kserveResponse{Outputs: []kserveTensor{}}
+	var raw [][]byte
+	err := protoFields(b, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		switch num {
+		case kfModelName, kfModelVersion, kfID:
+			s, err := protoBytes(v)
+			switch num {
+			case kfModelName:
+				r.ModelName = string(s)
+			case kfModelVersion:
+				r.ModelVersion = string(s)
+			default:
+				r.ID = string(s)
+			}
+			return err
+		case kfParameters:
+			if r.Parameters == nil {
+				r.Parameters = make(map[string]any)
+			}
+			return unmarshalParameters(v, r.Parameters)
+		case kfResponseOutputs:
+			t, err := unmarshalTensor(v)
+			r.Outputs = append(r.Outputs, t)
+			return err
+		case kfRawOutputs:
+			contents, err := protoBytes(v)
+			raw = append(raw, contents)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 && len(raw) != len(r.Outputs) {
+		return nil, fmt.Errorf("%d raw output contents for %d outputs", len(raw), len(r.Outputs))
+	}
+	for i, contents := range raw {
+		if err := decodeRaw(&r.Outputs[i], contents); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// unmarshalKServeStreamResponse decodes a ModelStreamInferResponse,
+// reporting the server's error message as an error.
+func unmarshalKServeStreamResponse(b []byte) (*kserveResponse, error) {
+	var errMsg string
+	var resp []byte
+	err := protoFields(b, func(num protowire.Number, _ protowire.Type, v []byte) error {
+		var err error
+		switch num {
+		case kfStreamError:
+			var s []byte
+			s, err = protoBytes(v)
+			errMsg = string(s)
+		case kfStreamResponse:
+			resp, err = protoBytes(v)
+		}
+		return err
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case errMsg != "":
+		return nil, errors.New(errMsg)
+	}
+	return unmarshalKServeResponse(resp)
+}
+
+// Tensor names of the text generation convention Triton's LLM backends
+// (TensorRT-LLM, vLLM) follow, used for chat completion requests.
+const (
+	kserveTextInput  = "text_input"
+	kserveTextOutput = "text_output"
+	kserveMaxTokens  = "max_tokens"
+	kserveStream     = "stream"
+)
+
+// kserveRequestFor builds the inference request for body: a KServe v2 JSON
+// request (one with "inputs") as is, or a chat completion as a text
+// generation request whose prompt is the conversation.
+func kserveRequestFor(body []byte, stream bool) (kserveRequest, bool, error) {
+	var req kserveRequest
+	var probe struct {
+		Model  string          `json:"model"`
+		Inputs json.RawMessage `json:"inputs"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return req, false, err
+	}
+	if len(probe.Inputs) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var in struct {
+			kserveRequest
+			Model string `json:"model"`
+		}
+		if err := dec.Decode(&in); err != nil {
+			return req, false, err
+		}
+		req = in.kserveRequest
+		if req.ModelName == "" {
+			req.ModelName = in.Model
+		}
+		return req, false, nil
+	}
+
+	var chat openAIChatRequest
+	if err := json.Unmarshal(body, &chat); err != nil {
+		return req, true, err
+	}
+	var prompt strings.Builder
+	for i, m := range chat.Messages {
+		text, err := messageText(m.Content)
+		if err != nil {
+			return req, true, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		if len(chat.Messages) == 1 && m.Role == "user" {
+			prompt.WriteString(text)
+			break
+		}
+		fmt.Fprintf(&prompt, "%s: %s\n", m.Role, text)
+	}
+	if len(chat.Messages) > 1 {
+		prompt.WriteString("assistant:")
+	}
+	req = kserveRequest{
+		ModelName: chat.Model,
+		Inputs: []kserveTensor{
+			{Name: kserveTextInput, Datatype: "BYTES", Shape: []int64{1, 1}, Data: []any{prompt.String()}},
+			{Name: kserveStream, Datatype: "BOOL", Shape: []int64{1, 1}, Data: []any{stream}},
+		},
+		Outputs: []kserveOutputRequest{{Name: kserveTextOutput}},
+	}
+	maxTokens := chat.MaxTokens
+	if chat.MaxCompletionTokens != nil {
+		maxTokens = chat.MaxCompletionTokens
+	}
+	if maxTokens != nil {
+		req.Inputs = append(req.Inputs, kserveTensor{
+			Name: kserveMaxTokens, Datatype: "INT32", Shape: []int64{1, 1}, Data: []any{json.Number(fmt.Sprint(*maxTokens))},
+		})
+	}
+	return req, true, nil
+}
+
+// chatText returns the generated text of a text generation response.
+func (r *kserveResponse) chatText() (string, error) {
+	t, ok := r.output(kserveTextOutput)
+	if !ok {
+		return "", fmt.Errorf("response has no %s output", kserveTextOutput)
+	}
+	var b strings.Builder
+	for _, v := range t.Data {
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("%s is not a BYTES tensor", kserveTextOutput)
+		}
+		b.WriteString(s)
+	}
+	return b.String(), nil
+}
+
+// final reports whether a streamed response is the last one, which
+// Triton marks with the triton_final_response parameter.
+func (r *kserveResponse) final() bool {
+	v, _ := r.Parameters["triton_final_response"].(bool)
+	return v
+}
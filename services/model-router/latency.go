@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	defaultLatencyDecay      = 0.8
+	defaultLatencyMinSamples = 5
+)
+
+// LatencyAwareConfig tunes the latency_aware strategy. Decay is how much
+// of a replica's average time to first byte each new sample keeps,
+// between 0 and 1 (default 0.8); lower follows a slowdown sooner but is
+// noisier. A replica's average is only trusted after MinSamples (default
+// 5) samples.
+type LatencyAwareConfig struct {
+	Decay      float64 `json:"decay,omitempty"`
+	MinSamples int     `json:"min_samples,omitempty"`
+}
+
+func validateLatencyAware(lc LatencyAwareConfig) error {
+	if lc.Decay < 0 || lc.Decay >= 1 {
+		return fmt.Errorf("latency_aware.decay must be between 0 and 1")
+	}
+	if lc.MinSamples < 0 {
+		return fmt.Errorf("latency_aware.min_samples must not be negative")
+	}
+	return nil
+}
+
+func (lc LatencyAwareConfig) withDefaults() LatencyAwareConfig {
+	if lc.Decay == 0 {
+		lc.Decay = defaultLatencyDecay
+	}
+	if lc.MinSamples == 0 {
+		lc.MinSamples = defaultLatencyMinSamples
+	}
+	return lc
+}
+
+// LatencyAwareStrategy follows the replicas that answer fastest: it keeps
+// an exponentially weighted moving average of each replica's time to
+// first response byte, timed by the attempts' HTTP traces, and sends each
+// request to the faster of two candidates drawn at random, the "power of
+// two choices", which spreads load while steering it off replicas that
+// slow down. A replica without MinSamples of data counts as the average of
+// those with enough, not as the fastest, so a new replica is tried without
+// being swamped. Weights only decide which replicas are candidates; gRPC
+// backends, which are not traced, always count as average.
+type LatencyAwareStrategy struct {
+	model   string
+	cfg     LatencyAwareConfig
+	metrics *metrics.Metrics
+	// stats is fixed once built; each entry has a lock of its own, as
+	// samples arrive outside the pool's lock.
+	stats map[*Backend]*ttfbStats
+}
+
+type ttfbStats struct {
+	mu      sync.Mutex
+	ewma    time.Duration
+	samples int
+}
+
+func (st *ttfbStats) get() (time.Duration, int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ewma, st.samples
+}
+
+func newLatencyAwareStrategy(model string, lc *LatencyAwareConfig, backends []*Backend) *LatencyAwareStrategy {
+	var cfg LatencyAwareConfig
+	if lc != nil {
+		cfg = *lc
+	}
+	s := &LatencyAwareStrategy{model: model, cfg: cfg.withDefaults(), stats: make(map[*Backend]*ttfbStats, len(backends))}
+	for _, b := range backends {
+		s.stats[b] = &ttfbStats{}
+	}
+	return s
+}
+
+func (*LatencyAwareStrategy) Name() string { return "latency_aware" }
+
+func (s *LatencyAwareStrategy) Pick(candidates []*Backend, _ RouteHint) (*Backend, Decision) {
+	if len(candidates) == 1 {
+		b := candidates[0]
+		d := s.decision(b)
+		d.Reason = "only candidate"
+		return b, d
+	}
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	avg, known := s.average(candidates)
+	la, lb := s.score(a, avg), s.score(b, avg)
+	best := a
+	if lb < la {
+		best = b
+	}
+	d := s.decision(best)
+	d.Reason = "faster of two"
+	if !known {
+		d.Reason = "no latency data yet"
+	}
+	return best, d
+}
+
+// score is b's trusted average, or avg if it has too few samples.
+func (s *LatencyAwareStrategy) score(b *Backend, avg time.Duration) time.Duration {
+	if st, ok := s.stats[b]; ok {
+		if ewma, n := st.get(); n >= s.cfg.MinSamples {
+			return ewma
+		}
+	}
+	return avg
+}
+
+// average is the mean of the trusted averages of candidates, and whether
+// any has one.
+func (s *LatencyAwareStrategy) average(candidates []*Backend) (time.Duration, bool) {
+	var sum time.Duration
+	n := 0
+	for _, b := range candidates {
+		st, ok := s.stats[b]
+		if !ok {
+			continue
+		}
+		if ewma, samples := st.get(); samples >= s.cfg.MinSamples {
+			sum += ewma
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / time.Duration(n), true
+}
+
+func (s *LatencyAwareStrategy) decision(b *Backend) Decision {
+	d := Decision{Strategy: s.Name(), Backend: b.Name()}
+	if st, ok := s.stats[b]; ok {
+		if ewma, n := st.get(); n >= s.cfg.MinSamples {
+			d.Latency = ewma
+		}
+	}
+	return d
+}
+
+// observe feeds one time to first byte of b into its average.
+func (s *LatencyAwareStrategy) observe(b *Backend, d time.Duration) {
+	st, ok := s.stats[b]
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	if st.samples == 0 {
+		st.ewma = d
+	} else {
+		st.ewma = time.Duration(s.cfg.Decay*float64(st.ewma) + (1-s.cfg.Decay)*float64(d))
+	}
+	st.samples++
+	ewma := st.ewma
+	st.mu.Unlock()
+	s.metrics.TTFBAverage(s.model, b.Name(), ewma)
+}
+
+// carryOver continues prev's averages, those of the same pool in the
+// table being replaced, for the replicas both have, so a reload does not
+// forget which replicas are slow.
+func (s *LatencyAwareStrategy) carryOver(prev Strategy, m *metrics.Metrics) {
+	s.metrics = m
+	p, ok := prev.(*LatencyAwareStrategy)
+	if !ok {
+		return
+	}
+	previous := make(map[string]*ttfbStats, len(p.stats))
+	for b, st := range p.stats {
+		previous[balanceKey(b)] = st
+	}
+	for b := range s.stats {
+		if st, ok := previous[balanceKey(b)]; ok {
+			ewma, n := st.get()
+			s.stats[b] = &ttfbStats{ewma: ewma, samples: n}
+			m.TTFBAverage(s.model, b.Name(), ewma)
+		}
+	}
+}
+
+type firstByteKey struct{}
+
+// observingFirstByte has the attempts sent to b under the returned context
+// time their first response byte for b's pool, when its strategy wants to
+// know.
+func observingFirstByte(ctx context.Context, b *Backend) context.Context {
+	if b.pool == nil {
+		return ctx
+	}
+	s, ok := b.pool.strategy.(*LatencyAwareStrategy)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, firstByteKey{}, func(d time.Duration) { s.observe(b, d) })
+}
+
+// traceFirstByte adds an HTTP trace to ctx timing the first response byte
+// since start, if observingFirstByte asked for it.
+func traceFirstByte(ctx context.Context, start time.Time) context.Context {
+	observe, _ := ctx.Value(firstByteKey{}).(func(time.Duration))
+	if observe == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { observe(time.Since(start)) },
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	defaultMaxQueue      = 100
+	defaultQueueTimeout  = 10 * time.Second
+	defaultAgingInterval = 5 * time.Second
+)
+
+// ConcurrencyConfig caps how many requests a provider serves at once.
+// Requests over MaxConcurrent wait, at most MaxQueue of them (default
+// 100), for up to QueueTimeout (default 10s) before being turned away
+// with 429. A stream holds its slot until it ends.
+//
+// A freed slot goes to the waiting request of the highest priority class,
+// then the earliest; each AgingInterval (default 5s) a request waits, it
+// counts as a class higher, so low-priority requests are not starved by a
+// steady stream of high ones. Low-priority requests wait up to
+// LowPriorityQueueTimeout (default three times QueueTimeout), since batch
+// work can afford to. With LowPriorityMaxQueue set, low-priority requests
+// arriving while that many wait are turned away at once, for batch jobs
+// to back off.
+type ConcurrencyConfig struct {
+	MaxConcurrent           int      `json:"max_concurrent"`
+	MaxQueue                int      `json:"max_queue,omitempty"`
+	QueueTimeout            Duration `json:"queue_timeout,omitempty"`
+	LowPriorityQueueTimeout Duration `json:"low_priority_queue_timeout,omitempty"`
+	LowPriorityMaxQueue     int      `json:"low_priority_max_queue,omitempty"`
+	AgingInterval           Duration `json:"aging_interval,omitempty"`
+}
+
+func (cc ConcurrencyConfig) withDefaults() ConcurrencyConfig {
+	if cc.MaxQueue <= 0 {
+		cc.MaxQueue = defaultMaxQueue
+	}
+	if cc.QueueTimeout <= 0 {
+		cc.QueueTimeout = Duration(defaultQueueTimeout)
+	}
+	if cc.LowPriorityQueueTimeout <= 0 {
+		cc.LowPriorityQueueTimeout = 3 * cc.QueueTimeout
+	}
+	if cc.AgingInterval <= 0 {
+		cc.AgingInterval = Duration(defaultAgingInterval)
+	}
+	return cc
+}
+
+// queueTimeout is how long a request of priority p may wait.
+func (cc ConcurrencyConfig) queueTimeout(p priorityClass) time.Duration {
+	if p == priorityLow {
+		return time.Duration(cc.LowPriorityQueueTimeout)
+	}
+	return time.Duration(cc.QueueTimeout)
+}
+
+// queueError is why a request got no slot: the queue was full, the wait
+// timed out, or the queue was too long to take low-priority work.
+type queueError struct {
+	provider string
+	reason   string // "full", "timeout" or "shed"
+	wait     time.Duration
+}
+
+func (e *queueError) Error() string {
+	switch e.reason {
+	case "full":
+		return "provider " + e.provider + " is at its concurrency limit and its queue is full"
+	case "shed":
+		return "provider " + e.provider + " is at its concurrency limit and takes no more low-priority requests for now"
+	}
+	return fmt.Sprintf("provider %s is at its concurrency limit; no slot freed within %s", e.provider, e.wait)
+}
+
+// retryAfter suggests a delay in whole seconds: the queue timeout, since
+// that is roughly how long the current backlog takes to drain.
+func (e *queueError) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(e.wait.Seconds()))))
+}
+
+// ConcurrencyLimiter is a provider's slots and wait queue. Backends keep a
+// pointer to it, so requests in flight across a reload still count
+// against the same limit.
+type ConcurrencyLimiter struct {
+	name    string
+	cfg     ConcurrencyConfig
+	metrics *metrics.Metrics
+
+	mu      sync.Mutex
+	active  int
+	waiters waiterHeap
+	seq     uint64
+	// depth counts waiters by priority class.
+	depth [priorityHigh + 1]int
+}
+
+// waiter is a request queued for a slot; ready is closed once it has one.
+type waiter struct {
+	priority priorityClass
+	// rank orders waiters, earliest first: the arrival, brought forward an
+	// aging interval per class above low, so each interval waited is worth
+	// a class.
+	rank  time.Time
+	seq   uint64
+	index int
+	ready chan struct{}
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if !h[i].rank.Equal(h[j].rank) {
+		return h[i].rank.Before(h[j].rank)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+func newConcurrencyLimiter(name string, cfg ConcurrencyConfig, m *metrics.Metrics) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{name: name, cfg: cfg.withDefaults(), metrics: m}
+}
+
+// Acquire takes a slot, queueing by the priority class of ctx while none
+// is free, and returns the func that gives it back. It fails with a
+// *queueError when the queue is full or the wait times out, and with the
+// context's error as soon as ctx ends, leaving the queue at once. A nil
+// limiter admits everything.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	priority := priorityClassFrom(ctx)
+	timeout := l.cfg.queueTimeout(priority)
+	l.mu.Lock()
+	// A free slot is only taken while nobody is queued, so it cannot jump
+	// the line.
+	if l.active < l.cfg.MaxConcurrent && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+	reason := ""
+	switch {
+	case len(l.waiters) >= l.cfg.MaxQueue:
+		reason = "full"
+	case priority == priorityLow && l.cfg.LowPriorityMaxQueue > 0 && len(l.waiters) >= l.cfg.LowPriorityMaxQueue:
+		reason = "shed"
+	}
+	if reason != "" {
+		l.mu.Unlock()
+		l.metrics.QueueRejected(l.name, priority.String(), reason)
+		return nil, &queueError{provider: l.name, reason: reason, wait: timeout}
+	}
+	start := time.Now()
+	l.seq++
+	w := &waiter{
+		priority: priority,
+		rank:     start.Add(-time.Duration(priority) * time.Duration(l.cfg.AgingInterval)),
+		seq:      l.seq,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&l.waiters, w)
+	l.queued(priority, 1)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	granted := w.index < 0
+	if !granted {
+		heap.Remove(&l.waiters, w.index)
+		l.queued(priority, -1)
+	}
+	l.mu.Unlock()
+	wait := time.Since(start)
+	switch {
+	case granted && ctx.Err() == nil:
+		l.metrics.QueueWait(l.name, priority.String(), "acquired", wait)
+		return l.releaser(), nil
+	case ctx.Err() != nil:
+		if granted {
+			// Handed a slot as it gave up.
+			l.release()
+		}
+		l.metrics.QueueWait(l.name, priority.String(), "canceled", wait)
+		return nil, ctx.Err()
+	default:
+		l.metrics.QueueWait(l.name, priority.String(), "timeout", wait)
+		l.metrics.QueueRejected(l.name, priority.String(), "timeout")
+		return nil, &queueError{provider: l.name, reason: "timeout", wait: timeout}
+	}
+}
+
+// queued moves the count of priority p's waiters by n; l.mu must be held.
+func (l *ConcurrencyLimiter) queued(p priorityClass, n int) {
+	l.depth[p] += n
+	l.metrics.QueueDepth(l.name, p.String(), l.depth[p])
+}
+
+// release hands the slot to the first waiter, or frees it if none waits.
+func (l *ConcurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.active--
+		return
+	}
+	w := heap.Pop(&l.waiters).(*waiter)
+	l.queued(w.priority, -1)
+	close(w.ready)
+}
+
+// releaser returns a func giving back one slot; calling it again is a no-op.
+func (l *ConcurrencyLimiter) releaser() func() {
+	var once sync.Once
+	return func() { once.Do(l.release) }
+}
+
+// concurrencyLimiters keeps one limiter per provider across reloads,
+// replacing it only when the provider's limits change.
+type concurrencyLimiters struct {
+	metrics *metrics.Metrics
+
+	mu       sync.Mutex
+	limiters map[string]*ConcurrencyLimiter
+}
+
+// Update returns the limiter of each provider in cfg with a concurrency
+// setting, by name, reusing the existing one when its limits are unchanged.
+func (cl *concurrencyLimiters) Update(cfg *Config) map[string]*ConcurrencyLimiter {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	out := make(map[string]*ConcurrencyLimiter)
+	for name, pc := range cfg.Providers {
+		if pc.Concurrency == nil {
+			continue
+		}
+		l, ok := cl.limiters[name]
+		if !ok || l.cfg != pc.Concurrency.withDefaults() {
+			l = newConcurrencyLimiter(name, *pc.Concurrency, cl.metrics)
+		}
+		out[name] = l
+	}
+	cl.limiters = out
+	return out
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// queueLen is how many requests wait on l.
+func queueLen(l *ConcurrencyLimiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters)
+}
+
+// acquireAsync calls Acquire in a goroutine and waits until the request is
+// queued, so tests know the order requests joined in.
+func acquireAsync(t *testing.T, l *ConcurrencyLimiter, ctx context.Context) <-chan error {
+	t.Helper()
+	before := queueLen(l)
+	done := make(chan error, 1)
+	go func() {
+		release, err := l.Acquire(ctx)
+		if err == nil {
+			defer release()
+		}
+		done <- err
+	}()
+	waitFor(t, "request to queue", func() bool { return queueLen(l) > before })
+	return done
+}
+
+func TestConcurrencyLimiterRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ConcurrencyConfig
+		queued int
+		reason string
+	}{
+		{name: "queue timeout", cfg: ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(30 * time.Millisecond)}, reason: "timeout"},
+		{name: "queue full", cfg: ConcurrencyConfig{MaxConcurrent: 1, MaxQueue: 2, QueueTimeout: Duration(time.Second)}, queued: 2, reason: "full"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newConcurrencyLimiter("vllm", tt.cfg, nil)
+			release, err := l.Acquire(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer release()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for range tt.queued {
+				acquireAsync(t, l, ctx)
+			}
+
+			start := time.Now()
+			_, err = l.Acquire(context.Background())
+			var qe *queueError
+			if !errors.As(err, &qe) || qe.reason != tt.reason {
+				t.Fatalf("Acquire error = %v, want a %s queueError", err, tt.reason)
+			}
+			if tt.reason == "timeout" && time.Since(start) < time.Duration(tt.cfg.QueueTimeout) {
+				t.Errorf("timed out after %v, before the queue timeout", time.Since(start))
+			}
+			if qe.retryAfter() != "1" {
+				t.Errorf("Retry-After = %s, want 1", qe.retryAfter())
+			}
+			if got := queueLen(l); got != tt.queued {
+				t.Errorf("queue length = %d, want %d", got, tt.queued)
+			}
+		})
+	}
+}
+
+// A request whose client goes away leaves the queue at once, and the slot
+// it would have had goes to the next request.
+func TestConcurrencyLimiterCancelLeavesQueue(t *testing.T) {
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(time.Minute)}, nil)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := acquireAsync(t, l, ctx)
+	next := acquireAsync(t, l, context.Background())
+
+	cancel()
+	select {
+	case err := <-gone:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled Acquire = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled Acquire did not return")
+	}
+	if got := queueLen(l); got != 1 {
+		t.Errorf("queue length after cancel = %d, want 1", got)
+	}
+
+	release()
+	select {
+	case err := <-next:
+		if err != nil {
+			t.Fatalf("next Acquire = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slot did not go to the next request")
+	}
+	waitFor(t, "slot to free", func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.active == 0 && len(l.waiters) == 0
+	})
+}
+
+// Under concurrent load no more than MaxConcurrent hold a slot, and every
+// request either gets one or gives up, leaving no slot held.
+func TestConcurrencyLimiterUnderLoad(t *testing.T) {
+	const limit, requests = 3, 60
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: limit, QueueTimeout: Duration(time.Minute)}, nil)
+	var holding, peak, served, cancelled atomic.Int64
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if i%4 == 0 {
+				// Every fourth client gives up while queued or running.
+				time.AfterFunc(time.Duration(i%7)*time.Millisecond, cancel)
+			}
+			release, err := l.Acquire(ctx)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Acquire = %v", err)
+				}
+				cancelled.Add(1)
+				return
+			}
+			n := holding.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(2 * time.Millisecond)
+			holding.Add(-1)
+			served.Add(1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if peak.Load() > limit {
+		t.Errorf("%d requests held a slot at once, limit %d", peak.Load(), limit)
+	}
+	if served.Load()+cancelled.Load() != requests {
+		t.Errorf("served %d and cancelled %d of %d", served.Load(), cancelled.Load(), requests)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active != 0 || len(l.waiters) != 0 || l.depth != [priorityHigh + 1]int{} {
+		t.Errorf("after the load: active %d, waiting %d, depth %v, want none", l.active, len(l.waiters), l.depth)
+	}
+}
+
+// Requests of one class are served in the order they arrived.
+func TestConcurrencyLimiterFIFO(t *testing.T) {
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(time.Minute)}, nil)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var order []int
+	var done []<-chan error
+	for i := range 5 {
+		before := queueLen(l)
+		ch := make(chan error, 1)
+		go func() {
+			release, err := l.Acquire(context.Background())
+			if err == nil {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				release()
+			}
+			ch <- err
+		}()
+		waitFor(t, "request to queue", func() bool { return queueLen(l) > before })
+		done = append(done, ch)
+	}
+	release()
+	for _, ch := range done {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(order) != "[0 1 2 3 4]" {
+		t.Errorf("served in order %v, want arrival order", order)
+	}
+}
+
+// A request that found no slot in time gets 429 with Retry-After.
+func TestConcurrencyLimitReturns429(t *testing.T) {
+	unblock := make(chan struct{})
+	var once sync.Once
+	free := func() { once.Do(func() { close(unblock) }) }
+	defer free()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	defer free()
+	cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  vllm:
+    base_url: %s
+    concurrency: {max_concurrent: 1, queue_timeout: 50ms}
+models:
+  m: vllm
+`, backend.URL))
+	rt := newTestRouter(t, cfg)
+	handler := routeChain(t, rt)
+	const body = `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+
+	first := make(chan int, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, chatRequest(body))
+		first <- rec.Code
+	}()
+	limiter := rt.registry.LookupAll("m")[0].Pool.Backends()[0].Limiter
+	waitFor(t, "first request to take the slot", func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return limiter.active == 1
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, chatRequest(body))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("queued request = %d, Retry-After %q, want 429 and 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	free()
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first request = %d, want 200", code)
+	}
+}
+
+// Queued requests are served by priority class, high first, then in the
+// order they arrived.
+func TestConcurrencyLimiterPriorityOrder(t *testing.T) {
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(time.Minute), AgingInterval: Duration(time.Hour)}, nil)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var order []string
+	var done []<-chan error
+	for i, p := range []priorityClass{priorityLow, priorityNormal, priorityHigh, priorityLow, priorityHigh, priorityNormal} {
+		before := queueLen(l)
+		ch := make(chan error, 1)
+		go func() {
+			release, err := l.Acquire(withPriorityClass(context.Background(), p))
+			if err == nil {
+				mu.Lock()
+				order = append(order, fmt.Sprintf("%s%d", p, i))
+				mu.Unlock()
+				release()
+			}
+			ch <- err
+		}()
+		waitFor(t, "request to queue", func() bool { return queueLen(l) > before })
+		done = append(done, ch)
+	}
+	release()
+	for _, ch := range done {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprint(order); got != "[high2 high4 normal1 normal5 low0 low3]" {
+		t.Errorf("served in order %s, want by class then arrival", got)
+	}
+}
+
+// A low-priority request waiting under a steady stream of high-priority
+// ones is served once it has waited an aging interval per class between
+// them; without aging it would wait out its timeout.
+func TestConcurrencyLimiterNoStarvation(t *testing.T) {
+	tests := []struct {
+		name   string
+		aging  time.Duration
+		served bool
+	}{
+		{name: "aging", aging: 20 * time.Millisecond, served: true},
+		{name: "aging too slow to help", aging: time.Hour, served: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newConcurrencyLimiter("vllm", ConcurrencyConfig{
+				MaxConcurrent:           1,
+				QueueTimeout:            Duration(time.Minute),
+				LowPriorityQueueTimeout: Duration(time.Second),
+				AgingInterval:           Duration(tt.aging),
+			}, nil)
+			// Keep high-priority requests queued and the slot busy.
+			const workers = 4
+			var stop atomic.Bool
+			var highServed atomic.Int64
+			var wg sync.WaitGroup
+			high := withPriorityClass(context.Background(), priorityHigh)
+			for range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for !stop.Load() {
+						release, err := l.Acquire(high)
+						if err != nil {
+							t.Errorf("high-priority Acquire = %v", err)
+							return
+						}
+						time.Sleep(time.Millisecond)
+						highServed.Add(1)
+						release()
+					}
+				}()
+			}
+			defer func() {
+				stop.Store(true)
+				wg.Wait()
+			}()
+			waitFor(t, "high-priority requests to queue", func() bool { return queueLen(l) >= workers-1 })
+
+			start := time.Now()
+			release, err := l.Acquire(withPriorityClass(context.Background(), priorityLow))
+			waited := time.Since(start)
+			servedBefore := highServed.Load()
+			if !tt.served {
+				var qe *queueError
+				if !errors.As(err, &qe) || qe.reason != "timeout" {
+					t.Fatalf("low-priority Acquire = %v after %v, want it starved to a timeout", err, waited)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("low-priority Acquire = %v after %v, want it served", err, waited)
+			}
+			release()
+			if waited < 2*tt.aging {
+				t.Errorf("served after %v, before it aged past high priority (%v)", waited, 2*tt.aging)
+			}
+			if waited > 500*time.Millisecond {
+				t.Errorf("served after %v, want about %v", waited, 2*tt.aging)
+			}
+			if servedBefore == 0 {
+				t.Error("no high-priority request was served meanwhile, so none competed")
+			}
+		})
+	}
+}
+
+// Low-priority requests wait longer than the queue timeout before giving
+// up, and are advised to retry later.
+func TestConcurrencyLimiterLowPriorityTimeout(t *testing.T) {
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(30 * time.Millisecond), LowPriorityQueueTimeout: Duration(1500 * time.Millisecond)}, nil)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	tests := []struct {
+		priority   priorityClass
+		wait       time.Duration
+		retryAfter string
+	}{
+		{priority: priorityHigh, wait: 30 * time.Millisecond, retryAfter: "1"},
+		{priority: priorityNormal, wait: 30 * time.Millisecond, retryAfter: "1"},
+		{priority: priorityLow, wait: 1500 * time.Millisecond, retryAfter: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.priority.String(), func(t *testing.T) {
+			start := time.Now()
+			_, err := l.Acquire(withPriorityClass(context.Background(), tt.priority))
+			waited := time.Since(start)
+			var qe *queueError
+			if !errors.As(err, &qe) || qe.reason != "timeout" {
+				t.Fatalf("Acquire = %v, want a timeout", err)
+			}
+			if waited < tt.wait || waited > tt.wait+time.Second {
+				t.Errorf("gave up after %v, want %v", waited, tt.wait)
+			}
+			if qe.retryAfter() != tt.retryAfter {
+				t.Errorf("Retry-After = %s, want %s", qe.retryAfter(), tt.retryAfter)
+			}
+		})
+	}
+}
+
+// Past low_priority_max_queue waiters, low-priority requests are turned
+// away at once while others still queue.
+func TestConcurrencyLimiterShedsLowPriority(t *testing.T) {
+	l := newConcurrencyLimiter("vllm", ConcurrencyConfig{MaxConcurrent: 1, QueueTimeout: Duration(time.Minute), LowPriorityMaxQueue: 2}, nil)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	low := withPriorityClass(ctx, priorityLow)
+	acquireAsync(t, l, low)
+	acquireAsync(t, l, ctx)
+
+	start := time.Now()
+	_, err = l.Acquire(low)
+	var qe *queueError
+	if !errors.As(err, &qe) || qe.reason != "shed" {
+		t.Fatalf("low-priority Acquire = %v, want it shed", err)
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("shed after %v, want at once", waited)
+	}
+	for _, p := range []priorityClass{priorityNormal, priorityHigh} {
+		acquireAsync(t, l, withPriorityClass(ctx, p))
+	}
+	if got := queueLen(l); got != 4 {
+		t.Errorf("queue length = %d, want 4", got)
+	}
+	cancel()
+	release()
+	waitFor(t, "the queue to empty", func() bool { return queueLen(l) == 0 })
+}
+
+// The priority class comes from the header, else the API key, capped by
+// the key's max_priority.
+func TestPriorities(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		keyPriority string
+		keyMax      string
+		want        priorityClass
+		status      int
+	}{
+		{name: "default", want: priorityNormal},
+		{name: "header", header: "low", want: priorityLow},
+		{name: "key", keyPriority: "high", want: priorityHigh},
+		{name: "header over key", header: "low", keyPriority: "high", want: priorityLow},
+		{name: "capped by the key", header: "high", keyMax: "normal", want: priorityNormal},
+		{name: "key priority capped", keyPriority: "high", keyMax: "low", want: priorityLow},
+		{name: "unknown class", header: "urgent", status: http.StatusBadRequest},
+	}
+	rt := &Router{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got priorityClass = -1
+			h := rt.Priorities(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = priorityClassFrom(r.Context())
+			}))
+			r, info := middleware.WithRequestInfo(httptest.NewRequest(http.MethodPost, chatCompletionsPath, nil))
+			info.SetKeyPriority(tt.keyPriority, tt.keyMax)
+			if tt.header != "" {
+				r.Header.Set(PriorityClassHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if tt.status != 0 {
+				if rec.Code != tt.status {
+					t.Errorf("status = %d, want %d", rec.Code, tt.status)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("priority = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
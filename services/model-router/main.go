@@ -1,37 +1,504 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+	"github.com/aspendos/model-router/tracing"
 )
 
-type HealthResponse struct {
-	Status    string `json:"status"`
-	Service   string `json:"service"`
-	Timestamp string `json:"timestamp"`
+// version is set at build time: go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvInt accepts a positive integer.
+func getEnvInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s: want a positive integer, got %q", key, v)
+	}
+	return n, nil
+}
+
+// getEnvBool accepts true/false, 1/0 and the other forms of
+// strconv.ParseBool.
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: want true or false, got %q", key, v)
+	}
+	return b, nil
+}
+
+// getEnvDuration accepts Go duration strings ("45s", "2m") or plain seconds.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	return d, nil
+}
+
+// newLogger builds the JSON logger at LOG_LEVEL. An invalid level is
+// reported alongside a logger at info, so it can be logged.
+func newLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info")))
+	if err != nil {
+		err = fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})), err
+}
+
+// fatal logs err and exits, as log.Fatal would.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, slog.String("error", err.Error()))
+	os.Exit(1)
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	response := HealthResponse{
-		Status:    "ok",
-		Service:   "model-router",
-		Timestamp: fmt.Sprintf("%v", r.Header.Get("Date")),
+// loadConfig reads path when set and otherwise falls back to DefaultConfig.
+func loadConfig(path string) (*Config, error) {
+	if path == "" {
+		cfg := DefaultConfig()
+		return cfg, cfg.ApplyEnv()
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return LoadConfig(path)
+}
+
+// settings are the environment settings the router reads at start, beside
+// its config file. loadSettings checks them all, for the boot path and
+// --check alike.
+type settings struct {
+	port               string
+	shutdownTimeout    time.Duration
+	shutdownDelay      time.Duration
+	readinessWindow    time.Duration
+	usageFlushInterval time.Duration
+	requestTimeout     time.Duration
+	// workers is zero unless cfg has a queue.
+	workers int
+	http2   bool
+	// certFile, keyFile and clientCA are the TLS files, if any; certFile
+	// and keyFile are set together.
+	certFile, keyFile, clientCA string
+}
+
+func loadSettings(cfg *Config) (settings, error) {
+	s := settings{port: "8081"}
+	if cfg.Server.Port != 0 {
+		s.port = strconv.Itoa(cfg.Server.Port)
+	}
+	s.port = getEnv("PORT", s.port)
+	var err error
+	// SHUTDOWN_TIMEOUT is the older name of SHUTDOWN_GRACE_PERIOD.
+	if s.shutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return s, err
+	}
+	if s.shutdownTimeout, err = getEnvDuration("SHUTDOWN_GRACE_PERIOD", s.shutdownTimeout); err != nil {
+		return s, err
+	}
+	if s.shutdownDelay, err = getEnvDuration("SHUTDOWN_DELAY", 0); err != nil {
+		return s, err
+	}
+	if s.readinessWindow, err = getEnvDuration("READINESS_UPSTREAM_WINDOW", 60*time.Second); err != nil {
+		return s, err
+	}
+	if s.usageFlushInterval, err = getEnvDuration("USAGE_FLUSH_INTERVAL", time.Minute); err != nil {
+		return s, err
+	}
+	if s.requestTimeout, err = getEnvDuration("REQUEST_TIMEOUT", defaultRequestTimeout); err != nil {
+		return s, err
+	}
+	if cfg.Queue != nil {
+		if s.workers, err = getEnvInt("WORKER_POOL_SIZE", defaultWorkerPoolSize); err != nil {
+			return s, err
+		}
+	}
+	// HTTP2_ENABLED=false (default true) keeps the listener to HTTP/1.1,
+	// even over TLS.
+	if s.http2, err = getEnvBool("HTTP2_ENABLED", true); err != nil {
+		return s, err
+	}
+	// TLS_CERT_FILE and TLS_KEY_FILE serve HTTPS; TLS_CLIENT_CA_FILE also
+	// requires client certificates signed by that CA.
+	s.certFile, s.keyFile, s.clientCA = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE")
+	if (s.certFile == "") != (s.keyFile == "") {
+		return s, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if s.clientCA != "" && s.certFile == "" {
+		return s, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	return s, nil
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8081"
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		os.Exit(runBenchmark(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	configPath := flag.String("config", os.Getenv("CONFIG_PATH"), "path to a YAML or JSON config file (default $CONFIG_PATH)")
+	var check checkMode
+	flag.Var(&check, "check", "check the config and environment, probe every provider and print a JSON report instead of serving; --check=offline skips the probes. Exits 1 on errors, 3 on warnings alone")
+	flag.Parse()
+	if check != checkOff {
+		os.Exit(runCheck(*configPath, check, os.Stdout))
+	}
+
+	logger, err := newLogger(os.Stdout)
+	if err != nil {
+		fatal(logger, "invalid log level", err)
+	}
+	// A config file that fails to load at start, say a broken ConfigMap
+	// push, falls back to the last one that loaded, rather than crash-loop.
+	cachePath := getEnv("CONFIG_CACHE_PATH", defaultConfigCachePath)
+	cfg, err := loadConfig(*configPath)
+	stale := false
+	if err != nil {
+		if *configPath == "" {
+			fatal(logger, "failed to load config", err)
+		}
+		cached, saved, cacheErr := loadConfigCache(cachePath)
+		if cacheErr != nil {
+			logger.Error("no last-known-good config to fall back to", slog.String("cache", cachePath), slog.String("error", cacheErr.Error()))
+			fatal(logger, "failed to load config", err)
+		}
+		logger.Error("failed to load config, serving the last-known-good config instead",
+			slog.String("path", *configPath), slog.String("error", err.Error()), slog.String("cache", cachePath),
+			slog.String("config_version", cached.Version), slog.Time("saved_at", saved.SavedAt))
+		cfg, stale = cached, true
+	} else {
+		logger.Info("loaded config", slog.String("path", *configPath), slog.String("config_version", cfg.Version))
+	}
+	for _, w := range cfg.Warnings {
+		logger.Warn("config warning", slog.String("path", *configPath), slog.String("warning", w))
+	}
+	env, err := loadSettings(cfg)
+	if err != nil {
+		fatal(logger, "invalid environment", err)
+	}
+
+	tracer, err := tracing.New(context.Background(), "model-router", version)
+	if err != nil {
+		fatal(logger, "failed to set up tracing", err)
+	}
+	m := metrics.New()
+	upstreams := NewUpstreamTracker()
+	probes := NewHealthChecker(m, upstreams, logger)
+	backendProbes := NewBackendHealthChecker(m, logger)
+	discovery := NewTargetDiscovery(m, logger)
+	registry := NewModelRegistry(cfg, *configPath, m, probes, backendProbes, discovery, logger)
+	usage := NewUsageAccumulator(logger)
+	router := NewRouter(registry, m, upstreams, tracer, logger, usage)
+	router.defaultTimeout = env.requestTimeout
+	health := NewHealth(registry, upstreams, env.readinessWindow, probes)
+
+	routeMiddleware := []middleware.Middleware{router.Budget, router.LimitBody}
+	// AUDIT_LOG=off turns the audit log off without editing the config,
+	// for development.
+	var audit *Auditor
+	if cfg.Audit != nil && os.Getenv("AUDIT_LOG") != "off" {
+		out, err := newAuditLogger(*cfg.Audit)
+		if err != nil {
+			fatal(logger, "failed to open audit log", err)
+		}
+		audit = NewAuditor(*cfg.Audit, out, m, logger)
+		// Right inside LimitBody, so requests turned away by rate limits,
+		// quotas or the cache are recorded too.
+		routeMiddleware = append(routeMiddleware, audit.Middleware)
+	}
+	// Ahead of tenants, rate limits, quotas and the cache, so they all see
+	// the model an alias stands for. A model override may itself be an
+	// alias.
+	routeMiddleware = append(routeMiddleware, m.Middleware, router.ModelOverride, router.Aliases)
+	if len(cfg.Tenants) > 0 {
+		// Ahead of rate limits, quotas and the cache, so they all see the
+		// model the tenant is routed to.
+		routeMiddleware = append(routeMiddleware, router.Tenants)
+	}
+	if cfg.Auth != nil {
+		// After aliases and tenants, so a key's allowed models apply to the
+		// model the request is routed as.
+		routeMiddleware = append(routeMiddleware, router.KeyModels)
+	}
+	// After authentication, which records the key's priority, for the
+	// providers' concurrency queues to order requests by.
+	routeMiddleware = append(routeMiddleware, router.Priorities)
+	// Once the model is resolved, for requests served by no backend to
+	// count against it too.
+	stats := NewStatsAggregator(registry)
+	routeMiddleware = append(routeMiddleware, stats.Middleware)
+	// Ahead of everything requests may queue in, so operators can see and
+	// cancel them there too.
+	inflight := NewInFlight()
+	routeMiddleware = append(routeMiddleware, inflight.Middleware)
+	var idempotency IdempotencyConfig
+	if cfg.Idempotency != nil {
+		idempotency = *cfg.Idempotency
+	}
+	idempotencyStore, err := NewMemoryIdempotencyStore(idempotency.withDefaults().MaxEntries)
+	if err != nil {
+		fatal(logger, "failed to set up idempotency store", err)
+	}
+	// Ahead of rate limits and quotas, so replaying a response costs the
+	// client nothing.
+	routeMiddleware = append(routeMiddleware, NewIdempotentRouter(idempotency, idempotencyStore, m).Middleware)
+	if cfg.RateLimits != nil {
+		routeMiddleware = append(routeMiddleware, middleware.NewRateLimiter(*cfg.RateLimits, peekModel).Middleware)
+	}
+	if cfg.Quotas != nil {
+		quotas, err := NewQuotaManager(*cfg.Quotas, cfg.Auth != nil || cfg.JWT != nil, logger)
+		if err != nil {
+			fatal(logger, "failed to set up quotas", err)
+		}
+		routeMiddleware = append(routeMiddleware, quotas.Middleware)
+	}
+	cache, err := NewResponseCache(cfg.Cache, logger)
+	if err != nil {
+		fatal(logger, "failed to set up response cache", err)
+	}
+	routeMiddleware = append(routeMiddleware,
+		NewCachingRouter(registry, cache, m).Middleware,
+		NewSingleFlightRouter(registry, m).Middleware,
+	)
+	// Last, so cache hits and requests waiting on an identical one in
+	// flight never take a worker.
+	var queue *PriorityQueue
+	if cfg.Queue != nil {
+		queue = NewPriorityQueue(*cfg.Queue, env.workers, router.defaultTimeout, m, logger)
+		routeMiddleware = append(routeMiddleware, queue.Middleware)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	drainer := middleware.NewDrainer(5 * time.Second)
+	var compression middleware.CompressionConfig
+	if cfg.Compression != nil {
+		compression = *cfg.Compression
+	}
+	compressor := middleware.NewCompressor(compression)
+	serverMiddleware := []middleware.Middleware{middleware.RequestID, tracer.Middleware, middleware.Logging(logger), middleware.Recover(logger), compressor.Middleware, m.HTTPMiddleware, drainer.Middleware}
+	if cfg.CORS != nil {
+		// Ahead of authentication, so preflights, which never carry
+		// credentials, are answered and auth errors are readable by scripts.
+		serverMiddleware = append(serverMiddleware, middleware.NewCORSMiddleware(*cfg.CORS, router.peekModelWithinLimit).Middleware)
+	}
+	if cfg.Auth != nil {
+		auth, err := middleware.NewAuth(*cfg.Auth, logger)
+		if err != nil {
+			fatal(logger, "failed to set up API key auth", err)
+		}
+		if cfg.Auth.Redis != nil {
+			keys, err := NewRedisKeyStore(*cfg.Auth.Redis, logger)
+			if err != nil {
+				fatal(logger, "failed to set up API key auth", err)
+			}
+			auth.AddKeyStore(keys)
+		}
+		auth.ResolveTenants(registry.ResolveTenant)
+		serverMiddleware = append(serverMiddleware, auth.Middleware)
+	}
+	if cfg.JWT != nil {
+		jc := cfg.JWT.JWTConfig
+		jc.RefreshInterval = time.Duration(cfg.JWT.RefreshInterval)
+		jwtAuth := middleware.NewJWTAuthMiddleware(ctx, jc, logger)
+		router.onUpstreamUnauthorized = jwtAuth.Refresh
+		serverMiddleware = append(serverMiddleware, jwtAuth.Middleware)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", health.Health)
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", health.Ready)
+	mux.Handle("GET /metrics", m.Handler())
+	mux.HandleFunc("GET /metrics/models", stats.ServeModels)
+	routeHandler := middleware.Chain(http.HandlerFunc(router.handleRoute), routeMiddleware...)
+	mux.Handle("POST /route", routeHandler)
+	mux.Handle("POST "+chatCompletionsPath, routeHandler)
+	mux.Handle("POST "+batchPath, router.Batch(routeHandler))
+	mux.Handle("POST "+embeddingsPath, middleware.Chain(http.HandlerFunc(router.handleEmbeddings), routeMiddleware...))
+	uploadHandler := middleware.Chain(http.HandlerFunc(router.handleUpload), routeMiddleware...)
+	for _, path := range uploadPaths {
+		mux.Handle("POST "+path, uploadHandler)
+	}
+	mux.HandleFunc("GET /v1/models", router.handleModels)
+	mux.HandleFunc("GET /v1/usage", router.handleUsage)
+	mux.HandleFunc("GET /v1/providers", probes.handleProviders)
+	if cfg.Realtime != nil {
+		NewRealtimeProxy(router, *cfg.Realtime, cfg.Auth != nil).Register(mux)
+	}
+
+	srv := &http.Server{
+		Addr:         ":" + env.port,
+		Handler:      middleware.Chain(withErrorEnvelope(mux), serverMiddleware...),
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeout),
+		// Failed TLS handshakes are reported here.
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	// Rotated TLS files are picked up without a restart.
+	if env.certFile != "" {
+		srv.TLSConfig, err = serverTLSConfig(env.certFile, env.keyFile, env.clientCA, logger)
+		if err != nil {
+			fatal(logger, "failed to set up TLS", err)
+		}
+	}
+	if env.http2 {
+		if err := enableHTTP2(srv); err != nil {
+			fatal(logger, "failed to set up HTTP/2", err)
+		}
+	} else {
+		disableHTTP2(srv)
 	}
 
-	http.HandleFunc("/health", healthHandler)
+	// Usage is flushed as JSON lines to USAGE_LOG: a file path, "-" for
+	// stdout (the default) or "off". The last flush runs after draining so
+	// it includes the requests that were in flight at shutdown.
+	usageCtx, stopUsage := context.WithCancel(context.Background())
+	usageDone := make(chan struct{})
+	switch usageLog := getEnv("USAGE_LOG", "-"); usageLog {
+	case "off":
+		close(usageDone)
+	case "-":
+		go func() { usage.Run(usageCtx, os.Stdout, env.usageFlushInterval); close(usageDone) }()
+	default:
+		f, err := os.OpenFile(usageLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fatal(logger, "failed to open USAGE_LOG", err)
+		}
+		defer f.Close()
+		go func() { usage.Run(usageCtx, f, env.usageFlushInterval); close(usageDone) }()
+	}
 
-	log.Printf("🚀 Aspendos Model Router starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	probes.Start(ctx)
+	defer probes.Stop()
+	backendProbes.Start(ctx)
+	defer backendProbes.Stop()
+	discovery.Start(ctx)
+	defer discovery.Stop()
+	// In a Kubernetes cluster, Services annotated with a model name are
+	// routed alongside the config's models; SERVICE_DISCOVERY=off keeps to
+	// the config file alone.
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("SERVICE_DISCOVERY") != "off" {
+		services, err := NewK8sDiscovery(os.Getenv("SERVICE_DISCOVERY_NAMESPACE"), logger)
+		if err != nil {
+			fatal(logger, "failed to set up service discovery", err)
+		}
+		registry.WatchServices(ctx, services)
+	}
+	registry.UseConfigCache(ctx, cachePath, stale)
+	go credentialFiles.Watch(ctx, m, logger)
+	registry.WatchSIGHUP(ctx)
+	if err := registry.WatchFile(ctx); err != nil {
+		logger.Warn("config file changes will need SIGHUP", slog.String("error", err.Error()))
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info("model router starting", slog.String("port", env.port), slog.String("version", version),
+			slog.String("config_version", registry.Version()), slog.Bool("tls", srv.TLSConfig != nil), slog.Bool("http2", env.http2))
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// The admin API gets its own listener so it can stay off the public
+	// Service. Without ADMIN_TOKEN it only shows the routing table.
+	token := os.Getenv("ADMIN_TOKEN")
+	adminPort := getEnv("ADMIN_PORT", "9090")
+	adminSrv := &http.Server{
+		Addr:    ":" + adminPort,
+		Handler: middleware.Chain(NewAdmin(registry, inflight, token, logger).Handler(), middleware.RequestID, middleware.Logging(logger)),
+	}
+	go func() {
+		logger.Info("admin API listening", slog.String("port", adminPort), slog.Bool("read_only", token == ""))
+		serveErr <- adminSrv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal(logger, "server failed", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Fail health checks first and give the load balancer SHUTDOWN_DELAY to
+	// notice, still serving, before we turn new requests away and wait up
+	// to SHUTDOWN_GRACE_PERIOD for the ones in flight.
+	health.SetDraining()
+	logger.Info("shutdown signal received, draining", slog.String("grace_period", env.shutdownTimeout.String()))
+	time.Sleep(env.shutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.shutdownTimeout)
+	defer cancel()
+	started, remaining := drainer.Drain(shutdownCtx)
+	if remaining > 0 {
+		logger.Warn("grace period over with requests unfinished", slog.Int64("in_flight", started), slog.Int64("unfinished", remaining))
+		for _, req := range inflight.List(time.Now()) {
+			logger.Warn("request unfinished at shutdown", slog.String("request_id", req.RequestID), slog.String("model", req.Model),
+				slog.String("provider", req.Provider), slog.String("state", req.State), slog.Float64("elapsed_ms", req.ElapsedMs))
+		}
+	} else {
+		logger.Info("drained in-flight requests", slog.Int64("in_flight", started))
+	}
+	if queue != nil {
+		queue.Close()
+	}
+	adminSrv.Close()
+	<-serveErr
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("drain timeout exceeded, closing remaining connections", slog.String("error", err.Error()))
+		srv.Close()
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Warn("server exited with error", slog.String("error", err.Error()))
+	}
+	stopUsage()
+	<-usageDone
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			logger.Warn("failed to flush audit log", slog.String("error", err.Error()))
+		}
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("failed to flush traces", slog.String("error", err.Error()))
+	}
+	logger.Info("model router stopped")
 }
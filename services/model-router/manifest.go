@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	manifestAPIVersion = "aspendos.ai/v1"
+	manifestKind       = "ModelDeployment"
+)
+
+// DeploymentManifest is a config written as a Kubernetes-style resource,
+// for deployments that keep their models alongside other manifests:
+//
+//	apiVersion: aspendos.ai/v1
+//	kind: ModelDeployment
+//	metadata: {name: inference}
+//	spec:
+//	  providers:
+//	    openai: {base_url: https://api.openai.com, api_key_env: OPENAI_API_KEY}
+//	  models:
+//	    - {name: gpt-4o, provider: openai}
+//	    - {name: qwen-2.5-72b, url: http://vllm.internal:8000, timeout: 120s}
+//
+// Each model is its name alongside the fields it would have under models
+// in a config file. Unlike a config file, a manifest may carry fields the
+// router does not know, such as those of a newer schema; they are ignored
+// with a warning.
+type DeploymentManifest struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Metadata   ManifestMetadata `json:"metadata"`
+	Spec       ManifestSpec     `json:"spec"`
+}
+
+type ManifestMetadata struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type ManifestSpec struct {
+	Server    ServerConfig              `json:"server,omitempty"`
+	Providers map[string]ProviderConfig `json:"providers,omitempty"`
+	Models    []ManifestModel           `json:"models"`
+}
+
+// ManifestModel is one entry of spec.models.
+type ManifestModel struct {
+	Name    string
+	Backend BackendConfig
+}
+
+// UnmarshalJSON reads name alongside the backend fields, like
+// VariantConfig: {"name": "gpt-4o", "provider": "openai"}.
+func (mm *ManifestModel) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if raw, ok := fields["name"]; ok {
+		if err := json.Unmarshal(raw, &mm.Name); err != nil {
+			return fmt.Errorf("name: %w", err)
+		}
+		delete(fields, "name")
+	}
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(rest, &mm.Backend)
+}
+
+// isManifest reports whether doc, a decoded config file, is a manifest. A
+// config file has no kind.
+func isManifest(doc any) bool {
+	fields, ok := doc.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = fields["kind"]
+	return ok
+}
+
+// ValidateManifest reads a deployment manifest and returns the config it
+// declares, checked as LoadConfig checks a config file, with a warning for
+// each field it ignored. The warnings are returned with any error too.
+func ValidateManifest(r io.Reader) (*Config, []string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	return manifestConfig(data, doc)
+}
+
+// ParseManifest builds a registry from the deployment manifest r. Its
+// warnings are logged. The registry runs no health checks, and providers
+// with discovery keep the targets found as it is built.
+func ParseManifest(r io.Reader) (*ModelRegistry, error) {
+	cfg, warnings, err := ValidateManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.Default()
+	for _, w := range warnings {
+		logger.Warn("manifest warning", slog.String("warning", w))
+	}
+	return NewModelRegistry(cfg, "", nil, nil, nil, NewTargetDiscovery(nil, logger), logger), nil
+}
+
+// manifestConfig converts doc, the manifest read from data, to a config.
+func manifestConfig(data []byte, doc any) (*Config, []string, error) {
+	if doc == nil {
+		return nil, nil, fmt.Errorf("manifest is empty")
+	}
+	warnings := pruneUnknown(doc, reflect.TypeFor[DeploymentManifest](), "")
+	asJSON, err := json.Marshal(doc)
+	if err != nil {
+		return nil, warnings, err
+	}
+	var m DeploymentManifest
+	if err := decodeStrict(asJSON, &m); err != nil {
+		return nil, warnings, err
+	}
+	switch {
+	case m.APIVersion == "":
+		return nil, warnings, fmt.Errorf("apiVersion is required")
+	case m.APIVersion != manifestAPIVersion:
+		return nil, warnings, fmt.Errorf("apiVersion: %q is not supported, want %s", m.APIVersion, manifestAPIVersion)
+	case m.Kind != manifestKind:
+		return nil, warnings, fmt.Errorf("kind: %q is not supported, want %s", m.Kind, manifestKind)
+	case len(m.Spec.Models) == 0:
+		return nil, warnings, fmt.Errorf("spec.models: at least one model is required")
+	}
+	cfg := &Config{
+		Server:    m.Spec.Server,
+		Providers: m.Spec.Providers,
+		Models:    make(map[string]BackendConfig, len(m.Spec.Models)),
+	}
+	for i, mm := range m.Spec.Models {
+		if mm.Name == "" {
+			return nil, warnings, fmt.Errorf("spec.models[%d].name is required", i)
+		}
+		if _, dup := cfg.Models[mm.Name]; dup {
+			return nil, warnings, fmt.Errorf("spec.models[%d].name: %q is declared more than once", i, mm.Name)
+		}
+		cfg.Models[mm.Name] = mm.Backend
+	}
+	// Check each model first, so an error points at its place in the list.
+	for i, mm := range m.Spec.Models {
+		if err := validateBackend(cfg, mm.Backend); err != nil {
+			return nil, warnings, fmt.Errorf("spec.models[%d] (%s): %w", i, mm.Name, err)
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return nil, warnings, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, warnings, fmt.Errorf("spec: %w", err)
+	}
+	sum := sha256.Sum256(cfg.hashTLSFiles(data))
+	cfg.Version = hex.EncodeToString(sum[:6])
+	return cfg, warnings, nil
+}
+
+// pruneUnknown deletes from doc, a decoded YAML document, every field that
+// decoding it into t would not use, and returns a warning for each, with
+// path as the document's place in the manifest.
+func pruneUnknown(doc any, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var warnings []string
+	switch t.Kind() {
+	case reflect.Struct:
+		fields, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+		known := knownFields(t)
+		for _, key := range sortedKeys(fields) {
+			at := key
+			if path != "" {
+				at = path + "." + key
+			}
+			ft, ok := known[key]
+			if !ok {
+				warnings = append(warnings, at+": unknown field, ignored")
+				delete(fields, key)
+				continue
+			}
+			warnings = append(warnings, pruneUnknown(fields[key], ft, at)...)
+		}
+	case reflect.Map:
+		fields, ok := doc.(map[string]any)
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(fields) {
+			warnings = append(warnings, pruneUnknown(fields[key], t.Elem(), fmt.Sprintf("%s[%q]", path, key))...)
+		}
+	case reflect.Slice:
+		items, ok := doc.([]any)
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			warnings = append(warnings, pruneUnknown(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return warnings
+}
+
+// knownFields maps the JSON fields of struct t to their types. The types
+// read flat beside a backend's fields have those too.
+func knownFields(t reflect.Type) map[string]reflect.Type {
+	known := make(map[string]reflect.Type)
+	switch t {
+	case reflect.TypeFor[ManifestModel]():
+		known = knownFields(reflect.TypeFor[BackendConfig]())
+		known["name"] = reflect.TypeFor[string]()
+		return known
+	case reflect.TypeFor[VariantConfig]():
+		known = knownFields(reflect.TypeFor[BackendConfig]())
+		known["name"], known["percent"], known["model"] = reflect.TypeFor[string](), reflect.TypeFor[int](), reflect.TypeFor[string]()
+		return known
+	}
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-":
+		case name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct:
+			for k, v := range knownFields(f.Type) {
+				known[k] = v
+			}
+		case name == "":
+			known[f.Name] = f.Type
+		default:
+			known[name] = f.Type
+		}
+	}
+	return known
+}
+
+// runValidate is the validate subcommand: it checks the manifest named by
+// -f ("-" for stdin), for CI pipelines to run before a deploy. It prints a
+// line per warning and exits 1 if the manifest is invalid, 2 on bad usage.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("f", "", `deployment manifest to check, or "-" for stdin`)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" || fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: model-router validate -f manifest.yaml")
+		return 2
+	}
+	r := io.Reader(os.Stdin)
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	cfg, warnings, err := ValidateManifest(r)
+	for _, w := range warnings {
+		fmt.Fprintf(stderr, "%s: warning: %s\n", *file, w)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *file, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: valid, %d models (version %s)\n", *file, len(cfg.Models), cfg.Version)
+	return 0
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the output tests get")
+
+// checkGolden compares got to the golden file path, or with -update
+// rewrites it.
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output does not match %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// Each manifest in testdata/manifest is checked with the validate
+// subcommand, and what it prints is its .golden file.
+func TestValidateManifestGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/manifest/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no manifests in testdata/manifest: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runValidate([]string{"-f", file}, &stdout, &stderr)
+			var got bytes.Buffer
+			got.WriteString(stdout.String())
+			got.WriteString(stderr.String())
+			if valid := !strings.Contains(file, "invalid-"); valid != (code == 0) {
+				t.Errorf("exit code = %d", code)
+			}
+			checkGolden(t, strings.TrimSuffix(file, ".yaml")+".golden", got.Bytes())
+		})
+	}
+}
+
+func TestValidateManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  string
+		warnings []string
+	}{
+		{
+			name: "valid",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  models:
+    - {name: m, url: http://vllm.internal:8000}
+`,
+		},
+		{name: "empty", manifest: "", wantErr: "manifest is empty"},
+		{name: "not yaml", manifest: "kind: [", wantErr: "yaml:"},
+		{
+			name: "wrong apiVersion",
+			manifest: `
+apiVersion: aspendos.ai/v2
+kind: ModelDeployment
+spec:
+  models: [{name: m, url: http://vllm.internal:8000}]
+`,
+			wantErr: `apiVersion: "aspendos.ai/v2" is not supported`,
+		},
+		{
+			name: "wrong kind",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: Deployment
+spec:
+  models: [{name: m, url: http://vllm.internal:8000}]
+`,
+			wantErr: `kind: "Deployment" is not supported`,
+		},
+		{
+			name: "model without backend",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  models: [{name: m}]
+`,
+			wantErr: "spec.models[0] (m):",
+		},
+		{
+			name: "unknown provider",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  models: [{name: m, provider: openai}]
+`,
+			wantErr: "spec.models[0] (m):",
+		},
+		{
+			name: "provider with malformed base_url",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  providers:
+    openai: {base_url: "api.openai.com"}
+  models: [{name: m, provider: openai}]
+`,
+			wantErr: "must use http or https",
+		},
+		{
+			name: "type mismatch",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  models: [{name: m, url: http://vllm.internal:8000, timeout: [1]}]
+`,
+			wantErr: "invalid duration",
+		},
+		{
+			name: "unknown fields are warned of even when invalid",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  replicas: 3
+  models: [{name: m, gpu: a100}]
+`,
+			wantErr:  "spec.models[0] (m):",
+			warnings: []string{"spec.models[0].gpu: unknown field, ignored", "spec.replicas: unknown field, ignored"},
+		},
+		{
+			name: "unknown fields of providers and split variants",
+			manifest: `
+apiVersion: aspendos.ai/v1
+kind: ModelDeployment
+spec:
+  providers:
+    a: {base_url: http://a.internal, region: eu}
+  models:
+    - name: m
+      traffic_split:
+        experiment: e1
+        variants:
+          - {name: control, percent: 50, provider: a, gpu: a100}
+          - {name: candidate, percent: 50, provider: a}
+`,
+			warnings: []string{
+				"spec.models[0].traffic_split.variants[0].gpu: unknown field, ignored",
+				`spec.providers["a"].region: unknown field, ignored`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, warnings, err := ValidateManifest(strings.NewReader(tt.manifest))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if cfg.Version == "" || len(cfg.Models) == 0 {
+				t.Errorf("config = %+v, want its models and a version", cfg)
+			}
+			if strings.Join(warnings, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+// A manifest's models are served under their names, and its version is
+// that of its content.
+func TestParseManifest(t *testing.T) {
+	f, err := os.Open("testdata/manifest/valid.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reg, err := ParseManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for model, baseURL := range map[string]string{
+		"gpt-4o":       "https://api.openai.com",
+		"qwen-2.5-72b": "http://vllm.internal:8000",
+	} {
+		entries := reg.LookupAll(model)
+		if len(entries) != 1 {
+			t.Errorf("%s: %d entries, want 1", model, len(entries))
+			continue
+		}
+		if backends := entries[0].Backends(); len(backends) != 1 || backends[0].Provider.BaseURL != baseURL {
+			t.Errorf("%s is served by %v, want %s", model, backends, baseURL)
+		}
+	}
+	if _, ok := reg.Lookup("qwen"); ok {
+		t.Error("a model the manifest does not declare was found")
+	}
+
+	again, err := ParseManifest(strings.NewReader(strings.Replace(readFile(t, "testdata/manifest/valid.yaml"), "120s", "60s", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Version() == "" || again.Version() == reg.Version() {
+		t.Errorf("versions %q and %q, want a change with the content", reg.Version(), again.Version())
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,699 @@
+// Package metrics exposes the router's Prometheus instrumentation.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// Metrics owns its own registry rather than the global default one, so
+// building it more than once (e.g. across tests) never panics on duplicate
+// registration. All methods are safe to call on a nil *Metrics.
+type Metrics struct {
+	registry        *prometheus.Registry
+	httpRequests    *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	httpInFlight    prometheus.Gauge
+	requestDuration *prometheus.HistogramVec
+	upstreamReqs    *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	breakerState    *prometheus.GaugeVec
+	deduplicated    *prometheus.CounterVec
+	upstreamRetries *prometheus.CounterVec
+	shadowReqs      *prometheus.CounterVec
+	shadowLatency   *prometheus.HistogramVec
+	shadowBytes     *prometheus.HistogramVec
+	shadowDropped   *prometheus.CounterVec
+	cacheHits       *prometheus.CounterVec
+	schemaFailures  *prometheus.CounterVec
+	cacheMisses     *prometheus.CounterVec
+	providerUp      *prometheus.GaugeVec
+	discovered      *prometheus.GaugeVec
+	backendHealth   *prometheus.GaugeVec
+	failoverActive  *prometheus.GaugeVec
+	canaryReqs      *prometheus.CounterVec
+	guardrailHits   *prometheus.CounterVec
+	idempotent      *prometheus.CounterVec
+	sseEvents       *prometheus.CounterVec
+	queueDepth      *prometheus.GaugeVec
+	queueWait       *prometheus.HistogramVec
+	queueRejected   *prometheus.CounterVec
+	rateRemaining   *prometheus.GaugeVec
+	routerQueue     prometheus.Gauge
+	routerQueueWait *prometheus.HistogramVec
+	auditDropped    prometheus.Counter
+	upstreamConns   *prometheus.GaugeVec
+	connsAcquired   *prometheus.CounterVec
+	connPhases      *prometheus.HistogramVec
+	idleConns       *prometheus.GaugeVec
+	effectiveWeight *prometheus.GaugeVec
+	ejections       *prometheus.CounterVec
+	credRotations   *prometheus.CounterVec
+	authFailures    *prometheus.CounterVec
+	ttfbAverage     *prometheus.GaugeVec
+}
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// phaseBuckets resolve the phases of setting up a connection, which take
+// from well under a millisecond on a warm local network to seconds.
+var phaseBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests served, by route pattern.",
+		}, []string{"path", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request duration, by route pattern.",
+			Buckets: latencyBuckets,
+		}, []string{"path", "method"}),
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "model_router_request_duration_seconds",
+			Help:    "Duration of routed requests, including upstream time.",
+			Buckets: latencyBuckets,
+		}, []string{"model", "status_code", "method"}),
+		upstreamReqs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "model_router_upstream_requests_total",
+			Help: "Upstream attempts by provider, model and response status (\"error\" if none).",
+		}, []string{"provider", "model", "status"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "model_router_upstream_latency_seconds",
+			Help:    "Time from sending an upstream attempt to receiving its response headers.",
+			Buckets: latencyBuckets,
+		}, []string{"provider", "model"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "model_router_upstream_errors_total",
+			Help: "Failed upstream calls by model and failure type.",
+		}, []string{"model", "error_type"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "model_router_circuit_breaker_state",
+			Help: "Circuit breaker state per upstream target: 0=closed, 1=half-open, 2=open.",
+		}, []string{"breaker"}),
+		upstreamRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_upstream_retries_total",
+			Help: "Upstream retries by model and attempt number (2 is the first retry).",
+		}, []string{"model", "attempt"}),
+		deduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_deduplicated_requests_total",
+			Help: "Requests answered from an identical in-flight request instead of their own upstream call.",
+		}, []string{"model"}),
+		shadowReqs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shadow_requests_total",
+			Help: "Mirrored requests sent to shadow backends, by model, shadow target and status (\"error\" if none).",
+		}, []string{"model", "backend", "status"}),
+		shadowLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shadow_request_duration_seconds",
+			Help:    "Duration of mirrored shadow requests, including reading the response.",
+			Buckets: latencyBuckets,
+		}, []string{"model", "backend"}),
+		shadowBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "shadow_response_bytes",
+			Help:    "Size of shadow backend response bodies.",
+			Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"model", "backend"}),
+		shadowDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shadow_requests_dropped_total",
+			Help: "Sampled requests not mirrored because the shadow target had max_concurrency calls in flight.",
+		}, []string{"model", "backend"}),
+		schemaFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_response_validation_failures_total",
+			Help: "Upstream responses rejected for not matching the model's response_schema.",
+		}, []string{"model"}),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "model_router_cache_hits_total",
+			Help: "Requests answered from the response cache.",
+		}, []string{"model"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "model_router_cache_misses_total",
+			Help: "Cacheable requests that had to go upstream.",
+		}, []string{"model"}),
+		providerUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "model_router_provider_up",
+			Help: "Whether the provider's active health check passes (1) or not (0).",
+		}, []string{"provider"}),
+		discovered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_discovered_targets",
+			Help: "Targets last found for the provider by DNS or label selector discovery.",
+		}, []string{"provider"}),
+		backendHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_backend_health_state",
+			Help: "Whether the backend passes its health probes and is in rotation (1) or not (0).",
+		}, []string{"model", "backend"}),
+		effectiveWeight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_backend_effective_weight",
+			Help: "Weight the backend is given while slow start ramps it up, its configured weight once done; 0 while ejected as an outlier.",
+		}, []string{"model", "backend"}),
+		ejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_outlier_ejections_total",
+			Help: "Backends ejected from their pool by outlier detection.",
+		}, []string{"model", "backend"}),
+		failoverActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_failover_active",
+			Help: "Whether the model sends traffic to its failover region (1) or only its primary region (0).",
+		}, []string{"model"}),
+		canaryReqs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_canary_requests_total",
+			Help: "Upstream attempts of models with a canary, by model, whether the canary served it and status code (or error).",
+		}, []string{"model", "canary", "status"}),
+		guardrailHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_guardrail_violations_total",
+			Help: "Requests and responses that violated a guardrail, by model, guardrail, direction and action taken.",
+		}, []string{"model", "guardrail", "direction", "action"}),
+		idempotent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_idempotent_requests_total",
+			Help: "Requests with a reused Idempotency-Key, by result: replayed, coalesced (waited for the first) or conflict (different body).",
+		}, []string{"result"}),
+		sseEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_sse_events_forwarded_total",
+			Help: "Server-sent events relayed from upstream streams to clients, by model.",
+		}, []string{"model"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "model_router_provider_queue_depth",
+			Help: "Requests waiting for a concurrency slot, by provider and priority class.",
+		}, []string{"provider", "priority"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "model_router_provider_queue_wait_seconds",
+			Help:    "Time requests spent waiting for a concurrency slot, by provider, priority class and outcome (acquired, timeout, canceled).",
+			Buckets: latencyBuckets,
+		}, []string{"provider", "priority", "outcome"}),
+		queueRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "model_router_provider_queue_rejected_total",
+			Help: "Requests turned away with 429 because a provider's queue was full, the wait timed out or the queue was too long for low-priority work (shed), by provider, priority class and reason.",
+		}, []string{"provider", "priority", "reason"}),
+		rateRemaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "model_router_provider_ratelimit_remaining",
+			Help: "Requests or tokens the provider last reported left in its rate-limit window, by provider and resource (requests, tokens).",
+		}, []string{"provider", "resource"}),
+		routerQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "router_queue_depth",
+			Help: "Requests waiting for a worker in the priority queue.",
+		}),
+		routerQueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "router_queue_wait_seconds",
+			Help:    "Time requests spent in the priority queue, by priority and outcome (served, rejected, canceled, expired).",
+			Buckets: latencyBuckets,
+		}, []string{"priority", "outcome"}),
+		auditDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "router_audit_dropped_total",
+			Help: "Audit records dropped because the audit log's buffer was full.",
+		}),
+		upstreamConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_upstream_connections",
+			Help: "Connections to upstreams, by provider and state (idle, in_use). HTTP/2 requests sharing a connection each count as in use.",
+		}, []string{"provider", "state"}),
+		connsAcquired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_upstream_connections_acquired_total",
+			Help: "Connections taken for upstream requests, by provider and whether a pooled one was reused.",
+		}, []string{"provider", "reused"}),
+		connPhases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "router_upstream_phase_duration_seconds",
+			Help:    "Time upstream requests spend per phase, by backend URL: dns, connect and tls_handshake for new connections, and first_byte from the start of the request, connection set-up included, to the first response byte.",
+			Buckets: phaseBuckets,
+		}, []string{"backend_url", "phase"}),
+		idleConns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_idle_connections",
+			Help: "Idle keep-alive connections pooled for each backend URL.",
+		}, []string{"backend_url"}),
+		credRotations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_provider_credential_rotations_total",
+			Help: "New API keys picked up from providers' credential files.",
+		}, []string{"provider"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_upstream_auth_failures_total",
+			Help: "Upstream responses rejecting the router's credentials (401 or 403), by provider.",
+		}, []string{"provider", "status"}),
+		ttfbAverage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_backend_ttfb_ewma_seconds",
+			Help: "Moving average of time to first response byte per backend, for models with the latency_aware strategy.",
+		}, []string{"model", "backend"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.httpInFlight,
+		m.requestDuration,
+		m.upstreamReqs,
+		m.upstreamLatency,
+		m.upstreamErrors,
+		m.breakerState,
+		m.deduplicated,
+		m.upstreamRetries,
+		m.shadowReqs,
+		m.shadowLatency,
+		m.shadowBytes,
+		m.shadowDropped,
+		m.cacheHits,
+		m.schemaFailures,
+		m.cacheMisses,
+		m.providerUp,
+		m.discovered,
+		m.backendHealth,
+		m.failoverActive,
+		m.canaryReqs,
+		m.guardrailHits,
+		m.idempotent,
+		m.sseEvents,
+		m.queueDepth,
+		m.queueWait,
+		m.queueRejected,
+		m.rateRemaining,
+		m.routerQueue,
+		m.routerQueueWait,
+		m.auditDropped,
+		m.upstreamConns,
+		m.connsAcquired,
+		m.connPhases,
+		m.idleConns,
+		m.effectiveWeight,
+		m.ejections,
+		m.credRotations,
+		m.authFailures,
+		m.ttfbAverage,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// UpstreamTotals sums the upstream attempts counted so far whose provider
+// and model labels match, and how many of them failed with no response or
+// a 5xx.
+func (m *Metrics) UpstreamTotals(match func(provider, model string) bool) (requests, failures float64) {
+	if m == nil {
+		return 0, 0
+	}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		m.upstreamReqs.Collect(ch)
+		close(ch)
+	}()
+	for metric := range ch {
+		var pb dto.Metric
+		if metric.Write(&pb) != nil {
+			continue
+		}
+		labels := make(map[string]string, len(pb.GetLabel()))
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if !match(labels["provider"], labels["model"]) {
+			continue
+		}
+		n := pb.GetCounter().GetValue()
+		requests += n
+		if status, err := strconv.Atoi(labels["status"]); err != nil || status >= 500 {
+			failures += n
+		}
+	}
+	return requests, failures
+}
+
+// UpstreamRequest records one upstream attempt; status 0 means the attempt
+// failed before a response arrived.
+func (m *Metrics) UpstreamRequest(provider, model string, status int, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	model = labelOrUnknown(model)
+	m.upstreamReqs.WithLabelValues(provider, model, label).Inc()
+	m.upstreamLatency.WithLabelValues(provider, model).Observe(latency.Seconds())
+}
+
+func (m *Metrics) UpstreamError(model, errorType string) {
+	if m == nil {
+		return
+	}
+	m.upstreamErrors.WithLabelValues(labelOrUnknown(model), errorType).Inc()
+}
+
+// BreakerState sets a breaker's gauge: 0 closed, 1 half-open, 2 open.
+func (m *Metrics) BreakerState(breaker string, state int) {
+	if m == nil {
+		return
+	}
+	m.breakerState.WithLabelValues(breaker).Set(float64(state))
+}
+
+// UpstreamRetry counts a retry about to be sent as the given attempt.
+func (m *Metrics) UpstreamRetry(model string, attempt int) {
+	if m == nil {
+		return
+	}
+	m.upstreamRetries.WithLabelValues(labelOrUnknown(model), strconv.Itoa(attempt)).Inc()
+}
+
+func (m *Metrics) DeduplicatedRequest(model string) {
+	if m == nil {
+		return
+	}
+	m.deduplicated.WithLabelValues(labelOrUnknown(model)).Inc()
+}
+
+// ShadowRequest records one mirrored request; status 0 means it failed
+// before a response arrived.
+func (m *Metrics) ShadowRequest(model, backend string, status int, latency time.Duration, size int64) {
+	if m == nil {
+		return
+	}
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	model = labelOrUnknown(model)
+	m.shadowReqs.WithLabelValues(model, backend, label).Inc()
+	m.shadowLatency.WithLabelValues(model, backend).Observe(latency.Seconds())
+	if status > 0 {
+		m.shadowBytes.WithLabelValues(model, backend).Observe(float64(size))
+	}
+}
+
+// ShadowDropped counts a request that was not mirrored because the shadow
+// target was at its concurrency limit.
+func (m *Metrics) ShadowDropped(model, backend string) {
+	if m == nil {
+		return
+	}
+	m.shadowDropped.WithLabelValues(labelOrUnknown(model), backend).Inc()
+}
+
+// ResponseValidationFailure counts a response that failed its model's
+// schema.
+func (m *Metrics) ResponseValidationFailure(model string) {
+	if m == nil {
+		return
+	}
+	m.schemaFailures.WithLabelValues(labelOrUnknown(model)).Inc()
+}
+
+func (m *Metrics) CacheHit(model string) {
+	if m == nil {
+		return
+	}
+	m.cacheHits.WithLabelValues(labelOrUnknown(model)).Inc()
+}
+
+func (m *Metrics) CacheMiss(model string) {
+	if m == nil {
+		return
+	}
+	m.cacheMisses.WithLabelValues(labelOrUnknown(model)).Inc()
+}
+
+// ProviderUp sets the provider's health-check gauge.
+func (m *Metrics) ProviderUp(provider string, up bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if up {
+		v = 1
+	}
+	m.providerUp.WithLabelValues(provider).Set(v)
+}
+
+// DiscoveredTargets sets how many targets discovery last found for the
+// provider.
+func (m *Metrics) DiscoveredTargets(provider string, n int) {
+	if m == nil {
+		return
+	}
+	m.discovered.WithLabelValues(provider).Set(float64(n))
+}
+
+// BackendHealthState sets the backend's health-probe gauge.
+func (m *Metrics) BackendHealthState(model, backend string, up bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if up {
+		v = 1
+	}
+	m.backendHealth.WithLabelValues(model, backend).Set(v)
+}
+
+// FailoverActive sets the model's region failover gauge.
+func (m *Metrics) FailoverActive(model string, active bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if active {
+		v = 1
+	}
+	m.failoverActive.WithLabelValues(model).Set(v)
+}
+
+// EffectiveWeight sets the weight slow start gives a model's backend.
+func (m *Metrics) EffectiveWeight(model, backend string, weight float64) {
+	if m == nil {
+		return
+	}
+	m.effectiveWeight.WithLabelValues(model, backend).Set(weight)
+}
+
+// OutlierEjection counts a model's backend ejected as an outlier.
+func (m *Metrics) OutlierEjection(model, backend string) {
+	if m == nil {
+		return
+	}
+	m.ejections.WithLabelValues(model, backend).Inc()
+}
+
+// CanaryRequest counts an upstream attempt of a model with a canary;
+// status 0 means no response.
+func (m *Metrics) CanaryRequest(model, canary string, status int) {
+	if m == nil {
+		return
+	}
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	m.canaryReqs.WithLabelValues(labelOrUnknown(model), canary, label).Inc()
+}
+
+// IdempotentRequest counts a request whose Idempotency-Key was seen
+// before, by result.
+func (m *Metrics) IdempotentRequest(result string) {
+	if m == nil {
+		return
+	}
+	m.idempotent.WithLabelValues(result).Inc()
+}
+
+// SSEEventForwarded counts an event of a model's stream written to the
+// client.
+func (m *Metrics) SSEEventForwarded(model string) {
+	if m == nil {
+		return
+	}
+	m.sseEvents.WithLabelValues(labelOrUnknown(model)).Inc()
+}
+
+// GuardrailViolation counts a request or response (direction) of a model
+// that violated a guardrail, and the action taken on it.
+func (m *Metrics) GuardrailViolation(model, guardrail, direction, action string) {
+	if m == nil {
+		return
+	}
+	m.guardrailHits.WithLabelValues(labelOrUnknown(model), guardrail, direction, action).Inc()
+}
+
+// QueueDepth sets how many requests of a priority class wait for one of
+// the provider's slots.
+func (m *Metrics) QueueDepth(provider, priority string, depth int) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.WithLabelValues(provider, priority).Set(float64(depth))
+}
+
+// QueueWait records how long a queued request waited and how the wait
+// ended: "acquired", "timeout" or "canceled".
+func (m *Metrics) QueueWait(provider, priority, outcome string, wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queueWait.WithLabelValues(provider, priority, outcome).Observe(wait.Seconds())
+}
+
+// RateLimitRemaining sets how many requests or tokens the provider says
+// are left before its rate limit resets.
+func (m *Metrics) RateLimitRemaining(provider, resource string, remaining int64) {
+	if m == nil {
+		return
+	}
+	m.rateRemaining.WithLabelValues(provider, resource).Set(float64(remaining))
+}
+
+// QueueRejected counts a request refused a slot, because the queue was
+// "full", the wait hit its "timeout" or, for low-priority requests, the
+// queue was long enough to "shed" them.
+func (m *Metrics) QueueRejected(provider, priority, reason string) {
+	if m == nil {
+		return
+	}
+	m.queueRejected.WithLabelValues(provider, priority, reason).Inc()
+}
+
+// RouterQueueDepth sets how many requests wait in the priority queue.
+func (m *Metrics) RouterQueueDepth(depth int) {
+	if m == nil {
+		return
+	}
+	m.routerQueue.Set(float64(depth))
+}
+
+// RouterQueueWait records how long a request of the given priority waited
+// for a worker and how the wait ended: "served", "rejected", "canceled" or
+// "expired".
+func (m *Metrics) RouterQueueWait(priority int, outcome string, wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.routerQueueWait.WithLabelValues(strconv.Itoa(priority), outcome).Observe(wait.Seconds())
+}
+
+// AuditDropped counts an audit record dropped for want of buffer space.
+func (m *Metrics) AuditDropped() {
+	if m == nil {
+		return
+	}
+	m.auditDropped.Inc()
+}
+
+// UpstreamConnections sets the provider's open connections by state.
+func (m *Metrics) UpstreamConnections(provider string, idle, inUse int64) {
+	if m == nil {
+		return
+	}
+	m.upstreamConns.WithLabelValues(provider, "idle").Set(float64(idle))
+	m.upstreamConns.WithLabelValues(provider, "in_use").Set(float64(inUse))
+}
+
+// ConnectionAcquired counts a connection taken for a request to provider.
+func (m *Metrics) ConnectionAcquired(provider string, reused bool) {
+	if m == nil {
+		return
+	}
+	m.connsAcquired.WithLabelValues(provider, strconv.FormatBool(reused)).Inc()
+}
+
+// UpstreamPhase records how long phase took for a request to backendURL.
+func (m *Metrics) UpstreamPhase(backendURL, phase string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.connPhases.WithLabelValues(backendURL, phase).Observe(d.Seconds())
+}
+
+// IdleConnections sets the idle connections pooled for backendURL.
+func (m *Metrics) IdleConnections(backendURL string, idle int64) {
+	if m == nil {
+		return
+	}
+	m.idleConns.WithLabelValues(backendURL).Set(float64(idle))
+}
+
+// CredentialRotated counts a new key read from provider's credential file.
+func (m *Metrics) CredentialRotated(provider string) {
+	if m == nil {
+		return
+	}
+	m.credRotations.WithLabelValues(provider).Inc()
+}
+
+// UpstreamAuthFailure counts a 401 or 403 from provider.
+func (m *Metrics) UpstreamAuthFailure(provider string, status int) {
+	if m == nil {
+		return
+	}
+	m.authFailures.WithLabelValues(provider, strconv.Itoa(status)).Inc()
+}
+
+// TTFBAverage sets a model's backend's moving average of time to first
+// byte.
+func (m *Metrics) TTFBAverage(model, backend string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ttfbAverage.WithLabelValues(model, backend).Set(d.Seconds())
+}
+
+// HTTPMiddleware instruments every request served. The path label is the
+// matched ServeMux pattern rather than the raw URL to keep cardinality bounded.
+func (m *Metrics) HTTPMiddleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.httpInFlight.Inc()
+		defer m.httpInFlight.Dec()
+
+		rw := middleware.WrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		// ServeMux records the matched pattern on the request it was handed.
+		path := r.Pattern
+		if path == "" {
+			path = "unmatched"
+		}
+		m.httpRequests.WithLabelValues(path, r.Method, strconv.Itoa(rw.StatusCode())).Inc()
+		m.httpDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Middleware observes the duration of every request it wraps, labelled with
+// the model the handler resolved via middleware.RequestInfo.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := middleware.WithRequestInfo(r)
+		rw := middleware.WrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		model, _ := info.Route()
+		m.requestDuration.WithLabelValues(
+			labelOrUnknown(model),
+			strconv.Itoa(rw.StatusCode()),
+			r.Method,
+		).Observe(time.Since(start).Seconds())
+	})
+}
+
+func labelOrUnknown(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+// APIKey is one client credential. The secret comes from KeyEnv when that
+// variable is set and non-empty, then Key; KeySHA256 (hex) lets the file
+// hold only a digest. Name identifies the key in logs, never the secret.
+// AllowedModels, globs as in models, limits the key to matching models.
+// ModelOverride lets requests with the key pick their model with the
+// X-Aspendos-Model-Override header, for tools that cannot change their
+// request bodies. Priority is the priority class (high, normal or low) of
+// the key's requests for providers' concurrency slots, and MaxPriority the
+// highest they may ask for.
+type APIKey struct {
+	Name              string   `json:"name"`
+	Key               string   `json:"key,omitempty"`
+	KeyEnv            string   `json:"key_env,omitempty"`
+	KeySHA256         string   `json:"key_sha256,omitempty"`
+	RequestsPerMinute int      `json:"requests_per_minute,omitempty"`
+	AllowedModels     []string `json:"allowed_models,omitempty"`
+	ModelOverride     bool     `json:"model_override,omitempty"`
+	Priority          string   `json:"priority,omitempty"`
+	MaxPriority       string   `json:"max_priority,omitempty"`
+}
+
+type AuthConfig struct {
+	Keys []APIKey `json:"keys,omitempty"`
+	// Redis looks up keys not in Keys in Redis as well.
+	Redis *RedisKeysConfig `json:"redis,omitempty"`
+	// ExemptPaths skip authentication; defaults to the health probes
+	// (/health, /healthz, /readyz). Add /metrics or /metrics/models here to
+	// scrape without a key.
+	ExemptPaths []string `json:"exempt_paths,omitempty"`
+}
+
+var defaultExemptPaths = []string{"/health", "/healthz", "/readyz"}
+
+// TenantResolver names the tenant of a request authenticated with the key
+// called keyName, given the secret presented, or returns "" for none.
+type TenantResolver func(keyName, secret string) string
+
+// Auth checks "Authorization: Bearer <key>" against its key stores, the
+// config's keys first, and enforces each key's requests-per-minute budget.
+type Auth struct {
+	stores []KeyStore
+	exempt map[string]bool
+	tenant TenantResolver
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	limiters map[string]*keyLimiter
+}
+
+// keyLimiter is the budget of the key of a name, at rpm requests per
+// minute.
+type keyLimiter struct {
+	rpm     int
+	limiter *rate.Limiter
+}
+
+// ResolveTenants has every authenticated request's tenant recorded in its
+// RequestInfo, as named by resolve, unless its key store names one. Call
+// it before serving.
+func (a *Auth) ResolveTenants(resolve TenantResolver) {
+	a.tenant = resolve
+}
+
+// AddKeyStore has keys that no earlier store knows looked up in ks. Call
+// it before serving.
+func (a *Auth) AddKeyStore(ks KeyStore) {
+	a.stores = append(a.stores, ks)
+}
+
+func NewAuth(cfg AuthConfig, logger *slog.Logger) (*Auth, error) {
+	a := &Auth{exempt: make(map[string]bool), logger: logger, limiters: make(map[string]*keyLimiter)}
+	exempt := cfg.ExemptPaths
+	if exempt == nil {
+		exempt = defaultExemptPaths
+	}
+	for _, p := range exempt {
+		a.exempt[p] = true
+	}
+	static, err := NewStaticKeyStore(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	a.stores = append(a.stores, static)
+	return a, nil
+}
+
+func (k APIKey) digest() ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	secret := k.Key
+	if v := os.Getenv(k.KeyEnv); k.KeyEnv != "" && v != "" {
+		secret = v
+	}
+	if secret != "" {
+		return sha256.Sum256([]byte(secret)), nil
+	}
+	if k.KeySHA256 == "" {
+		return digest, fmt.Errorf("no key configured (is %s set?)", k.KeyEnv)
+	}
+	b, err := hex.DecodeString(k.KeySHA256)
+	if err != nil || len(b) != sha256.Size {
+		return digest, fmt.Errorf("key_sha256 must be 64 hex characters")
+	}
+	copy(digest[:], b)
+	return digest, nil
+}
+
+// lookup asks each store in turn for the key with secret. It fails with
+// ErrKeyNotFound only if every store answered that.
+func (a *Auth) lookup(r *http.Request, secret string) (KeyInfo, error) {
+	err := ErrKeyNotFound
+	for _, ks := range a.stores {
+		info, lookupErr := ks.Lookup(r.Context(), secret)
+		switch {
+		case lookupErr == nil:
+			return info, nil
+		case !errors.Is(lookupErr, ErrKeyNotFound):
+			err = lookupErr
+		}
+	}
+	return KeyInfo{}, err
+}
+
+// limiter returns the budget of key, or nil if it has none. A key whose
+// budget changed in its store starts on a full new one.
+func (a *Auth) limiter(key KeyInfo) *rate.Limiter {
+	if key.RequestsPerMinute <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	kl, ok := a.limiters[key.Name]
+	if !ok || kl.rpm != key.RequestsPerMinute {
+		kl = &keyLimiter{rpm: key.RequestsPerMinute, limiter: rate.NewLimiter(rate.Limit(float64(key.RequestsPerMinute)/60), key.RequestsPerMinute)}
+		a.limiters[key.Name] = kl
+	}
+	return kl.limiter
+}
+
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, secret, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-router"`)
+			apierror.Write(w, http.StatusUnauthorized, "missing_api_key", "an API key is required: Authorization: Bearer <key>")
+			return
+		}
+		secret = strings.TrimSpace(secret)
+		key, err := a.lookup(r, secret)
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-router", error="invalid_token"`)
+			apierror.Write(w, http.StatusUnauthorized, "invalid_api_key", "invalid API key")
+			return
+		case err != nil:
+			// auth_unavailable: the key could not be checked; it may well be
+			// valid, so clients should retry.
+			LoggerFrom(r.Context(), a.logger).Error("API key lookup failed", slog.String("error", err.Error()))
+			w.Header().Set("Retry-After", "1")
+			apierror.Write(w, http.StatusServiceUnavailable, "auth_unavailable", "API keys cannot be checked right now")
+			return
+		}
+		info := RequestInfoFrom(r.Context())
+		info.SetAPIKey(key.Name)
+		info.SetKeyModels(key.AllowedModels)
+		info.SetModelOverride(key.ModelOverride)
+		info.SetKeyPriority(key.Priority, key.MaxPriority)
+		switch {
+		case key.Tenant != "":
+			info.SetTenant(key.Tenant)
+		case a.tenant != nil:
+			info.SetTenant(a.tenant(key.Name, secret))
+		}
+
+		if limiter := a.limiter(key); limiter != nil {
+			res := limiter.Reserve()
+			if delay := res.Delay(); delay > 0 {
+				res.Cancel()
+				writeRateLimited(w, delay, "rate limit exceeded for API key "+key.Name)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
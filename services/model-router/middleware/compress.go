@@ -0,0 +1,309 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultMinCompressBytes is one Ethernet MTU: below it, compressing saves
+// no packets and costs CPU.
+const defaultMinCompressBytes = 1400
+
+var defaultEncodings = []string{"zstd", "gzip"}
+
+// CompressionConfig sets how JSON responses are compressed for clients
+// whose Accept-Encoding allows it. Responses under MinCompressBytes
+// (default 1400) go out as they are. Encodings are the codings offered,
+// preferred in order when a client accepts several equally (default zstd,
+// then gzip). Disabled turns compression off. Changes take effect on
+// restart, not reload.
+type CompressionConfig struct {
+	MinCompressBytes int      `json:"min_compress_bytes,omitempty"`
+	Encodings        []string `json:"encodings,omitempty"`
+	Disabled         bool     `json:"disabled,omitempty"`
+}
+
+// encoder is a compressing writer that can be reused for another
+// response.
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(w io.Writer)
+}
+
+// encoders keeps the writers of each coding, and their sizeable state,
+// across responses; each is used by one response at a time. The fastest
+// levels compress JSON nearly as well as the defaults at a fraction of
+// the cost on the request path.
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+		return zw
+	}},
+	"zstd": {New: func() any {
+		zw, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return zw
+	}},
+}
+
+func ValidateCompression(cfg CompressionConfig) error {
+	if cfg.MinCompressBytes < 0 {
+		return fmt.Errorf("min_compress_bytes must not be negative")
+	}
+	for _, e := range cfg.Encodings {
+		if _, ok := encoders[e]; !ok {
+			return fmt.Errorf("encodings: unknown encoding %q (want gzip or zstd)", e)
+		}
+	}
+	return nil
+}
+
+// Compressor compresses JSON responses as its config says. It is safe for
+// concurrent use: each response gets a writer of its own.
+type Compressor struct {
+	minBytes  int
+	encodings []string
+	disabled  bool
+}
+
+func NewCompressor(cfg CompressionConfig) *Compressor {
+	c := &Compressor{minBytes: cfg.MinCompressBytes, encodings: cfg.Encodings, disabled: cfg.Disabled}
+	if c.minBytes == 0 {
+		c.minBytes = defaultMinCompressBytes
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = defaultEncodings
+	}
+	return c
+}
+
+// Middleware compresses JSON responses of at least the threshold with the
+// coding the client's Accept-Encoding prefers, and marks every response
+// Vary: Accept-Encoding. A response is held back until it reaches the
+// threshold or ends, so small ones go out as they are. Responses that
+// already carry a Content-Encoding are never compressed again. Event
+// streams are never compressed, and a handler that flushes before the
+// threshold gets its response passed through uncompressed, so streaming
+// stays as prompt as without compression.
+func (c *Compressor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, minBytes: c.minBytes}
+		if !c.disabled && r.Method != http.MethodHead {
+			cw.encoding = negotiate(r.Header.Values("Accept-Encoding"), c.encodings)
+		}
+		// Not deferred: after a panic nothing buffered is sent, and Recover
+		// still finds the response unstarted and answers with its error.
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// negotiate returns the coding of offered the Accept-Encoding values rate
+// highest, earlier ones winning ties, or "" if they accept none: a coding
+// is rated by its own q, or that of "*" if not named.
+func negotiate(values []string, offered []string) string {
+	q := make(map[string]float64)
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "x-gzip" {
+				coding = "gzip"
+			}
+			weight := 1.0
+			if k, val, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+					weight = f
+				}
+			}
+			if coding != "" {
+				q[coding] = weight
+			}
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		weight, ok := q[coding]
+		if !ok {
+			weight = q["*"]
+		}
+		if weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// compressible reports whether a response with header h and status is one
+// a Compressor may encode.
+func compressible(h http.Header, status int) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressWriter buffers a compressible response until it is known to be
+// large enough, then either compresses it with encoding or writes it
+// through. With no encoding it only adds Vary.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+	status   int
+	buf      []byte
+	decided  bool
+	zw       encoder
+	hijacked bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if cw.encoding == "" || !compressible(cw.Header(), status) {
+		cw.passthrough()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.zw != nil {
+			return cw.zw.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minBytes {
+		if err := cw.compress(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// vary adds Accept-Encoding to the response's Vary header, once.
+func (cw *compressWriter) vary() {
+	h := cw.Header()
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if f := strings.TrimSpace(field); f == "*" || strings.EqualFold(f, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// compress starts the compressed response with what is buffered.
+func (cw *compressWriter) compress() error {
+	cw.decided = true
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.vary()
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.zw = encoders[cw.encoding].Get().(encoder)
+	cw.zw.Reset(cw.ResponseWriter)
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.zw.Write(buf)
+	return err
+}
+
+// passthrough sends the response as the handler writes it, starting with
+// what is buffered.
+func (cw *compressWriter) passthrough() {
+	cw.decided = true
+	if cw.status == 0 {
+		return
+	}
+	cw.vary()
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+// Flush sends what the handler has written so far. Before the threshold it
+// gives up on compressing, as a flushing handler is streaming.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+		cw.passthrough()
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close ends the response once the handler returns: a response still under
+// the threshold goes out as it is, a compressed one gets its trailer. A
+// handler that wrote nothing still gets Vary on the implicit 200.
+func (cw *compressWriter) close() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.vary()
+			return
+		}
+		cw.passthrough()
+		return
+	}
+	if cw.zw != nil {
+		cw.zw.Close()
+		cw.zw.Reset(io.Discard)
+		encoders[cw.encoding].Put(cw.zw)
+		cw.zw = nil
+	}
+}
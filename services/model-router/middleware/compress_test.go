@@ -0,0 +1,413 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// embeddingJSON is an embeddings response of one vector of n floats, laid
+// out as a provider would send it.
+func embeddingJSON(n int) []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	b.WriteString(`{"object":"list","data":[{"object":"embedding","index":0,"embedding":[`)
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%.8f", rng.Float64()*2-1)
+	}
+	b.WriteString(`]}],"model":"text-embedding-3-small","usage":{"prompt_tokens":8,"total_tokens":8}}`)
+	return b.Bytes()
+}
+
+// jsonHandler answers with body as JSON.
+func jsonHandler(body []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// compressed sends a request accepting acceptEncoding through h and returns
+// the recorded response.
+func compressed(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func gunzip(t testing.TB, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// A large JSON response is gzipped for a client asking for it, and sent as
+// it is to one that does not.
+func TestCompressJSON(t *testing.T) {
+	body := embeddingJSON(3000)
+	h := NewCompressor(CompressionConfig{Encodings: []string{"gzip"}}).Middleware(jsonHandler(body))
+
+	rec := compressed(h, "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if rec.Body.Len() >= len(body)/2 {
+		t.Errorf("gzipped to %d of %d bytes, want under half", rec.Body.Len(), len(body))
+	}
+	if got := gunzip(t, rec.Body.Bytes()); !bytes.Equal(got, body) {
+		t.Error("the gzipped body does not decode to the response")
+	}
+
+	rec = compressed(h, "")
+	if got := rec.Header().Get("Content-Encoding"); got != "" || !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("without Accept-Encoding: Content-Encoding %q, %d bytes, want the response as it is", got, rec.Body.Len())
+	}
+}
+
+// An event stream is passed through uncompressed, each event reaching the
+// client as it is flushed rather than when the stream ends.
+func TestCompressStreamFlushesEachEvent(t *testing.T) {
+	next := make(chan struct{})
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 3 {
+			// Each event is over the threshold, so only the content type
+			// keeps it from being held back and compressed.
+			fmt.Fprintf(w, "data: {\"index\":%d,\"pad\":%q}\n\n", i, strings.Repeat("x", 2000))
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	// Set by hand, so the client does not decode a compressed stream itself.
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Fatalf("Content-Encoding = %q, want the stream uncompressed", got)
+	}
+	events := bufio.NewReader(resp.Body)
+	for i := range 3 {
+		done := make(chan string, 1)
+		go func() {
+			line, _ := events.ReadString('\n')
+			events.ReadString('\n')
+			done <- line
+		}()
+		select {
+		case line := <-done:
+			if want := fmt.Sprintf(`data: {"index":%d,`, i); !strings.HasPrefix(line, want) {
+				t.Fatalf("event %d = %.40q, want it to start %q", i, line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d did not arrive before the next was written", i)
+		}
+		next <- struct{}{}
+	}
+	if rest, _ := io.ReadAll(events); string(rest) != "data: [DONE]\n\n" {
+		t.Errorf("stream ended with %q", rest)
+	}
+}
+
+// A response flushed before it reaches the threshold is streaming, and is
+// passed through uncompressed whatever its content type.
+func TestCompressGivesUpOnFlush(t *testing.T) {
+	h := NewCompressor(CompressionConfig{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"partial":`)
+		w.(http.Flusher).Flush()
+		io.WriteString(w, `"`+strings.Repeat("x", 4000)+`"}`)
+	}))
+	rec := compressed(h, "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "" || !rec.Flushed {
+		t.Errorf("Content-Encoding = %q, flushed = %v: want passed through and flushed", got, rec.Flushed)
+	}
+	if !strings.HasPrefix(rec.Body.String(), `{"partial":"xxx`) {
+		t.Errorf("body = %.40q", rec.Body)
+	}
+}
+
+// BenchmarkCompressJSON reports the bytes on the wire for a 3000-float
+// embedding with each coding.
+func BenchmarkCompressJSON(b *testing.B) {
+	body := embeddingJSON(3000)
+	h := NewCompressor(CompressionConfig{}).Middleware(jsonHandler(body))
+	for _, coding := range []string{"identity", "gzip", "zstd"} {
+		b.Run(coding, func(b *testing.B) {
+			b.ReportAllocs()
+			var wire int
+			for range b.N {
+				wire = compressed(h, coding).Body.Len()
+			}
+			b.ReportMetric(float64(wire), "wire-bytes")
+			b.ReportMetric(float64(wire)/float64(len(body)), "ratio")
+		})
+	}
+}
+
+// BenchmarkCompressStreamFirstEvent measures the time to the first event of
+// a stream over a real connection, which must not grow when the client
+// accepts compression.
+func BenchmarkCompressStreamFirstEvent(b *testing.B) {
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})))
+	defer srv.Close()
+	for _, coding := range []string{"identity", "gzip"} {
+		b.Run(coding, func(b *testing.B) {
+			for range b.N {
+				req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+				req.Header.Set("Accept-Encoding", coding)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+// Only a response of at least min_compress_bytes is compressed.
+func TestCompressThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		min      int
+		size     int
+		encoding string
+	}{
+		{name: "default, one under", size: 1399},
+		{name: "default, at it", size: 1400, encoding: "gzip"},
+		{name: "raised, under", min: 8192, size: 8191},
+		{name: "raised, at it", min: 8192, size: 8192, encoding: "gzip"},
+		{name: "lowered", min: 16, size: 16, encoding: "gzip"},
+		{name: "empty body", min: 16, size: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(`{"p":"` + strings.Repeat("x", max(tt.size-8, 0)) + `"}`)[:tt.size]
+			h := NewCompressor(CompressionConfig{MinCompressBytes: tt.min, Encodings: []string{"gzip"}}).Middleware(jsonHandler(body))
+			rec := compressed(h, "gzip")
+			if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			got := rec.Body.Bytes()
+			if tt.encoding != "" {
+				got = gunzip(t, got)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("body of %d bytes, want the %d written", len(got), len(body))
+			}
+		})
+	}
+}
+
+// Every response varies on Accept-Encoding, whether it was compressed or
+// not, and names it only once.
+func TestCompressVary(t *testing.T) {
+	large := embeddingJSON(1000)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		accept  string
+		cfg     CompressionConfig
+		want    string
+	}{
+		{name: "compressed", handler: jsonHandler(large).ServeHTTP, accept: "gzip", want: "Accept-Encoding"},
+		{name: "not accepted", handler: jsonHandler(large).ServeHTTP, want: "Accept-Encoding"},
+		{name: "under the threshold", handler: jsonHandler([]byte(`{}`)).ServeHTTP, accept: "gzip", want: "Accept-Encoding"},
+		{name: "compression disabled", handler: jsonHandler(large).ServeHTTP, accept: "gzip", cfg: CompressionConfig{Disabled: true}, want: "Accept-Encoding"},
+		{name: "not JSON", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(large)
+		}, accept: "gzip", want: "Accept-Encoding"},
+		{name: "error status", handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusBadGateway)
+		}, accept: "gzip", want: "Accept-Encoding"},
+		{name: "nothing written", handler: func(w http.ResponseWriter, r *http.Request) {}, accept: "gzip", want: "Accept-Encoding"},
+		{name: "already varying", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", "Origin, accept-encoding")
+			jsonHandler(large).ServeHTTP(w, r)
+		}, accept: "gzip", want: "Origin, accept-encoding"},
+		{name: "varying on everything", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", "*")
+		}, want: "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := compressed(NewCompressor(tt.cfg).Middleware(tt.handler), tt.accept)
+			if got := strings.Join(rec.Header().Values("Vary"), ", "); got != tt.want {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept  string
+		offered []string
+		want    string
+	}{
+		{accept: "", want: ""},
+		{accept: "gzip", want: "gzip"},
+		{accept: "gzip, zstd", want: "zstd"},
+		{accept: "gzip, zstd", offered: []string{"gzip", "zstd"}, want: "gzip"},
+		{accept: "zstd;q=0.5, gzip", want: "gzip"},
+		{accept: "x-gzip", want: "gzip"},
+		{accept: "GZIP", want: "gzip"},
+		{accept: "*", want: "zstd"},
+		{accept: "*, zstd;q=0", want: "gzip"},
+		{accept: "gzip;q=0", want: ""},
+		{accept: "br, identity", want: ""},
+		{accept: "zstd", offered: []string{"gzip"}, want: ""},
+	}
+	for _, tt := range tests {
+		offered := tt.offered
+		if offered == nil {
+			offered = defaultEncodings
+		}
+		if got := negotiate([]string{tt.accept}, offered); got != tt.want {
+			t.Errorf("negotiate(%q, %v) = %q, want %q", tt.accept, offered, got, tt.want)
+		}
+	}
+}
+
+// A response that already carries a Content-Encoding goes out exactly as
+// the handler wrote it.
+func TestCompressPassesEncodedThrough(t *testing.T) {
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	zw.Write(embeddingJSON(1000))
+	zw.Close()
+	h := NewCompressor(CompressionConfig{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded.Bytes())
+	}))
+	for _, accept := range []string{"gzip", "zstd", ""} {
+		rec := compressed(h, accept)
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" || !bytes.Equal(rec.Body.Bytes(), encoded.Bytes()) {
+			t.Errorf("accepting %q: Content-Encoding %q, %d bytes, want the %d gzipped bytes untouched", accept, got, rec.Body.Len(), encoded.Len())
+		}
+	}
+}
+
+// The compressor is shared by every request: run under -race, concurrent
+// responses in both codings must each decode to their own body.
+func TestCompressConcurrent(t *testing.T) {
+	c := NewCompressor(CompressionConfig{})
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := embeddingJSON(200 + i*10)
+			coding := []string{"gzip", "zstd"}[i%2]
+			h := c.Middleware(jsonHandler(body))
+			for range 10 {
+				rec := compressed(h, coding)
+				got, err := decode(rec)
+				if err != nil || !bytes.Equal(got, body) {
+					t.Errorf("%s response %d: %v, decoded %d of %d bytes", coding, i, err, len(got), len(body))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// decode undoes the recorded response's Content-Encoding.
+func decode(rec *httptest.ResponseRecorder) ([]byte, error) {
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case "zstd":
+		zr, err := zstd.NewReader(rec.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return rec.Body.Bytes(), nil
+}
+
+// BenchmarkCompressEmbedding serves a 10 KB embedding over a real
+// connection with each coding, reporting the bytes on the wire next to the
+// time per request.
+func BenchmarkCompressEmbedding(b *testing.B) {
+	body := embeddingJSON(900)
+	if len(body) < 10<<10 {
+		b.Fatalf("mock embedding is %d bytes, want 10 KB", len(body))
+	}
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{}).Middleware(jsonHandler(body)))
+	defer srv.Close()
+	for _, coding := range []string{"identity", "gzip", "zstd"} {
+		b.Run(coding, func(b *testing.B) {
+			var wire int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+					req.Header.Set("Accept-Encoding", coding)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					n, _ := io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					atomic.StoreInt64(&wire, n)
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt64(&wire)), "wire-bytes")
+		})
+	}
+}
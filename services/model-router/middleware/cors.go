@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy is what browsers on other origins may do. AllowedOrigins
+// holds exact origins ("https://app.example.com"), patterns with "*" for
+// one host label ("https://*.example.com"), or "*" for any origin, which
+// is refused together with AllowCredentials.
+type CORSPolicy struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+	// AllowedMethods defaults to GET and POST.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedHeaders are the request headers scripts may set; defaults to
+	// Authorization, Content-Type, X-Client-ID and X-Request-ID. "*" allows
+	// any header when credentials are off.
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// ExposedHeaders are the response headers scripts may read beyond the
+	// CORS-safelisted ones.
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	// MaxAgeSeconds lets browsers cache a preflight answer; 0 leaves it to
+	// the browser's default.
+	MaxAgeSeconds int `json:"max_age_seconds,omitempty"`
+}
+
+// CORSConfig applies Models[model] to requests for that model and Default
+// to every other request.
+type CORSConfig struct {
+	Default *CORSPolicy           `json:"default,omitempty"`
+	Models  map[string]CORSPolicy `json:"models,omitempty"`
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "X-Client-ID", "X-Request-ID"}
+)
+
+func (p CORSPolicy) withDefaults() CORSPolicy {
+	if len(p.AllowedMethods) == 0 {
+		p.AllowedMethods = defaultCORSMethods
+	}
+	if len(p.AllowedHeaders) == 0 {
+		p.AllowedHeaders = defaultCORSHeaders
+	}
+	return p
+}
+
+// AllowsAnyOrigin reports whether the policy admits every origin with "*".
+func (p CORSPolicy) AllowsAnyOrigin() bool {
+	return slices.Contains(p.AllowedOrigins, "*")
+}
+
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	return OriginAllowed(p.AllowedOrigins, origin)
+}
+
+// OriginAllowed reports whether origin is one of allowed, which may hold
+// "*" for any origin and patterns such as https://*.example.com.
+func OriginAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if strings.Contains(o, "*") && matchOrigin(strings.ToLower(o), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches origin against pattern label by label, so a "*"
+// stands for one host label and never for several.
+func matchOrigin(pattern, origin string) bool {
+	want, got := strings.Split(pattern, "."), strings.Split(origin, ".")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if ok, _ := path.Match(want[i], got[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (p CORSPolicy) allowsMethod(method string) bool {
+	return slices.Contains(p.AllowedMethods, strings.ToUpper(method))
+}
+
+func (p CORSPolicy) allowsHeaders(requested []string) bool {
+	if !p.AllowCredentials && slices.Contains(p.AllowedHeaders, "*") {
+		return true
+	}
+	for _, h := range requested {
+		if !slices.ContainsFunc(p.AllowedHeaders, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// CORSMiddleware answers preflight requests and adds Access-Control-*
+// headers to requests from allowed origins. Requests without an Origin
+// header, and those from origins no policy allows, get no CORS headers at
+// all, so the configuration is never revealed to them.
+//
+// A preflight carries no body, so it cannot name a model: it is approved
+// when the default policy or any model's policy admits its origin, method
+// and headers. The model's own policy is then applied to the actual
+// request, whose response the browser withholds from scripts on origins
+// that policy does not allow.
+type CORSMiddleware struct {
+	def       *CORSPolicy
+	models    map[string]CORSPolicy
+	preflight []CORSPolicy
+	modelFunc func(*http.Request) string
+}
+
+// NewCORSMiddleware builds the middleware; modelFunc extracts the requested
+// model from a request without consuming its body. It is only called for
+// cross-origin requests when some model has a policy of its own.
+func NewCORSMiddleware(cfg CORSConfig, modelFunc func(*http.Request) string) *CORSMiddleware {
+	c := &CORSMiddleware{models: make(map[string]CORSPolicy, len(cfg.Models)), modelFunc: modelFunc}
+	if cfg.Default != nil {
+		def := cfg.Default.withDefaults()
+		c.def = &def
+		c.preflight = append(c.preflight, def)
+	}
+	names := make([]string, 0, len(cfg.Models))
+	for name, p := range cfg.Models {
+		c.models[name] = p.withDefaults()
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.preflight = append(c.preflight, c.models[name])
+	}
+	return c
+}
+
+func (c *CORSMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && method != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			requested := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+			for _, p := range c.preflight {
+				if p.allowsOrigin(origin) && p.allowsMethod(method) && p.allowsHeaders(requested) {
+					setAllowOrigin(h, p, origin)
+					h.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+					if len(requested) > 0 {
+						h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+					}
+					if p.MaxAgeSeconds > 0 {
+						h.Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAgeSeconds))
+					}
+					break
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if p, ok := c.policyFor(r); ok && p.allowsOrigin(origin) {
+			setAllowOrigin(h, p, origin)
+			if len(p.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *CORSMiddleware) policyFor(r *http.Request) (CORSPolicy, bool) {
+	if len(c.models) > 0 && r.Method == http.MethodPost {
+		if p, ok := c.models[c.modelFunc(r)]; ok {
+			return p, true
+		}
+	}
+	if c.def != nil {
+		return *c.def, true
+	}
+	return CORSPolicy{}, false
+}
+
+// setAllowOrigin echoes origin back, except for a credential-less "*"
+// policy, which needs no per-origin answer.
+func setAllowOrigin(h http.Header, p CORSPolicy, origin string) {
+	if p.AllowsAnyOrigin() && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func splitHeaderList(v string) []string {
+	var out []string
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// corsHandler is the middleware for cfg ahead of a handler answering 200,
+// reading the model from the X-Model header.
+func corsHandler(cfg CORSConfig) http.Handler {
+	return NewCORSMiddleware(cfg, func(r *http.Request) string { return r.Header.Get("X-Model") }).
+		Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+var corsConfig = CORSConfig{
+	Default: &CORSPolicy{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.preview.example.com"},
+		ExposedHeaders: []string{"X-Request-ID"},
+		MaxAgeSeconds:  600,
+	},
+	Models: map[string]CORSPolicy{
+		"internal": {
+			AllowedOrigins:   []string{"https://console.example.com"},
+			AllowedMethods:   []string{"POST", "DELETE"},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "X-Tenant"},
+			AllowCredentials: true,
+		},
+	},
+}
+
+// corsHeaders are the Access-Control-* headers of h, one line each.
+func corsHeaders(h http.Header) map[string]string {
+	out := make(map[string]string)
+	for name, values := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			out[name] = strings.Join(values, ", ")
+		}
+	}
+	return out
+}
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  CORSConfig
+		origin  string
+		method  string
+		headers string
+		want    map[string]string
+	}{
+		{
+			name: "allowed origin", config: corsConfig, origin: "https://app.example.com", method: "POST", headers: "content-type, authorization",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Allow-Headers": "content-type, authorization",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name: "origin matching a pattern", config: corsConfig, origin: "https://pr-12.preview.example.com", method: "POST",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://pr-12.preview.example.com",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{name: "disallowed origin", config: corsConfig, origin: "https://evil.example.net", method: "POST", want: map[string]string{}},
+		{name: "pattern spans one label", config: corsConfig, origin: "https://a.b.preview.example.com", method: "POST", want: map[string]string{}},
+		{name: "disallowed method", config: corsConfig, origin: "https://app.example.com", method: "DELETE", want: map[string]string{}},
+		{name: "disallowed header", config: corsConfig, origin: "https://app.example.com", method: "POST", headers: "X-Tenant", want: map[string]string{}},
+		{
+			name: "allowed by a model's policy, with credentials", config: corsConfig, origin: "https://console.example.com", method: "DELETE", headers: "X-Tenant",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://console.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "POST, DELETE",
+				"Access-Control-Allow-Headers":     "X-Tenant",
+			},
+		},
+		{
+			name:   "any origin",
+			config: CORSConfig{Default: &CORSPolicy{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}}},
+			origin: "https://anywhere.example.org", method: "POST", headers: "X-Anything",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, POST",
+				"Access-Control-Allow-Headers": "X-Anything",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			rec := httptest.NewRecorder()
+			corsHandler(tt.config).ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", rec.Code)
+			}
+			got := corsHeaders(rec.Header())
+			if len(got) != len(tt.want) {
+				t.Errorf("headers = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %q, want %q", name, got[name], want)
+				}
+			}
+			if vary := rec.Header().Values("Vary"); strings.Join(vary, ", ") != "Origin, Access-Control-Request-Method, Access-Control-Request-Headers" {
+				t.Errorf("Vary = %v", vary)
+			}
+		})
+	}
+}
+
+// An actual request gets the policy of the model it names, or the
+// default, and nothing when that policy does not allow its origin.
+func TestCORSRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		model  string
+		want   map[string]string
+	}{
+		{name: "same origin", want: map[string]string{}},
+		{
+			name: "allowed origin", origin: "https://app.example.com", model: "gpt-4o",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":   "https://app.example.com",
+				"Access-Control-Expose-Headers": "X-Request-ID",
+			},
+		},
+		{name: "disallowed origin", origin: "https://evil.example.net", model: "gpt-4o", want: map[string]string{}},
+		{
+			name: "model's own policy", origin: "https://console.example.com", model: "internal",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://console.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{name: "origin of another model's policy", origin: "https://console.example.com", model: "gpt-4o", want: map[string]string{}},
+		{name: "default origin for a model with a policy", origin: "https://app.example.com", model: "internal", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			req.Header.Set("X-Model", tt.model)
+			rec := httptest.NewRecorder()
+			corsHandler(corsConfig).ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want the handler's 200", rec.Code)
+			}
+			got := corsHeaders(rec.Header())
+			if len(got) != len(tt.want) {
+				t.Errorf("headers = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %q, want %q", name, got[name], want)
+				}
+			}
+			if vary := rec.Header().Get("Vary"); (tt.origin != "") != (vary == "Origin") {
+				t.Errorf("Vary = %q", vary)
+			}
+		})
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://app.example.com", "https://*.example.org"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "HTTPS://APP.EXAMPLE.COM", want: true},
+		{origin: "http://app.example.com"},
+		{origin: "https://app.example.com:8443"},
+		{origin: "https://eu.example.org", want: true},
+		{origin: "https://example.org"},
+		{origin: "https://a.b.example.org"},
+	}
+	for _, tt := range tests {
+		if got := OriginAllowed(allowed, tt.origin); got != tt.want {
+			t.Errorf("OriginAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+	if !OriginAllowed([]string{"*"}, "https://anywhere.example.net") {
+		t.Error(`"*" does not allow every origin`)
+	}
+}
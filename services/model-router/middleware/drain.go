@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+// Drainer tracks in-flight requests so shutdown can wait for them, and
+// turns away new ones with 503 once draining starts. Health probes pass
+// through so the orchestrator keeps seeing the drain state they report.
+type Drainer struct {
+	retryAfter time.Duration
+	exempt     map[string]bool
+
+	// mu orders every wg.Add before the Wait in Drain.
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+	inFlight atomic.Int64
+}
+
+func NewDrainer(retryAfter time.Duration) *Drainer {
+	d := &Drainer{retryAfter: retryAfter, exempt: make(map[string]bool)}
+	for _, p := range defaultExemptPaths {
+		d.exempt[p] = true
+	}
+	return d
+}
+
+func (d *Drainer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(d.retryAfter.Seconds()), 1)))
+			apierror.Write(w, http.StatusServiceUnavailable, "shutting_down", "server is shutting down; retry on another instance")
+			return
+		}
+		d.wg.Add(1)
+		d.inFlight.Add(1)
+		d.mu.Unlock()
+		defer func() {
+			d.inFlight.Add(-1)
+			d.wg.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InFlight is the number of requests currently being served.
+func (d *Drainer) InFlight() int64 {
+	return d.inFlight.Load()
+}
+
+// Drain stops admitting requests and waits until those in flight finish
+// or ctx ends. It returns how many were in flight when draining began and
+// how many were still running when it returned.
+func (d *Drainer) Drain(ctx context.Context) (started, remaining int64) {
+	d.mu.Lock()
+	d.draining = true
+	started = d.inFlight.Load()
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return started, d.inFlight.Load()
+}
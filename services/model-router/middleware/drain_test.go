@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// drainServer serves slow, which answers once release is closed, and
+// everything else at once, through d.
+func drainServer(t *testing.T, d *Drainer, arrived chan<- struct{}, release <-chan struct{}) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		io.WriteString(w, "slow done")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	srv := httptest.NewServer(d.Middleware(mux))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// After SIGTERM, as main handles it, a slow request in flight runs to
+// completion while new ones are turned away with a 503 and Retry-After,
+// health probes aside, and the drain returns once the slow one is done.
+func TestDrainOnSIGTERM(t *testing.T) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	arrived, release := make(chan struct{}), make(chan struct{})
+	d := NewDrainer(5 * time.Second)
+	srv := drainServer(t, d, arrived, release)
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- resp.Status + " " + string(body)
+	}()
+	<-arrived
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("SIGTERM not delivered")
+	}
+	type drained struct{ started, remaining int64 }
+	done := make(chan drained, 1)
+	go func() {
+		started, remaining := d.Drain(context.Background())
+		done <- drained{started, remaining}
+	}()
+	for draining := false; !draining; {
+		time.Sleep(time.Millisecond)
+		d.mu.Lock()
+		draining = d.draining
+		d.mu.Unlock()
+	}
+
+	resp, err := http.Get(srv.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" ||
+		!resp.Close || !strings.Contains(string(body), "shutting_down") {
+		t.Errorf("new request: %d, Retry-After %q, connection kept %v: %s", resp.StatusCode, resp.Header.Get("Retry-After"), !resp.Close, body)
+	}
+	resp, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz while draining: %d", resp.StatusCode)
+	}
+	select {
+	case got := <-done:
+		t.Fatalf("drain returned %+v with the slow request in flight", got)
+	default:
+	}
+
+	close(release)
+	if got := <-slow; got != "200 OK slow done" {
+		t.Errorf("slow request: %s", got)
+	}
+	if got := <-done; got != (drained{1, 0}) {
+		t.Errorf("drain returned %+v, want 1 started, 0 remaining", got)
+	}
+}
+
+// A drain whose grace period ends first reports the request still running.
+func TestDrainGracePeriod(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	d := NewDrainer(0)
+	srv := drainServer(t, d, arrived, release)
+	go func() {
+		if resp, err := http.Get(srv.URL + "/slow"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if started, remaining := d.Drain(ctx); started != 1 || remaining != 1 {
+		t.Errorf("Drain = %d started, %d remaining, want 1 and 1", started, remaining)
+	}
+	// Retry-After is never less than a second.
+	rec := httptest.NewRecorder()
+	d.Middleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("%d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,330 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+type JWTConfig struct {
+	JWKSURL  string `json:"jwks_url"`
+	Audience string `json:"audience"`
+	// Issuer, when set, must match the token's iss claim.
+	Issuer string `json:"issuer,omitempty"`
+	// RefreshInterval is how often the key set is re-fetched (default 5m).
+	RefreshInterval time.Duration `json:"-"`
+	// ExemptPaths skip authentication, as in AuthConfig.
+	ExemptPaths []string `json:"exempt_paths,omitempty"`
+}
+
+// Claims are the validated token claims stored on the request context.
+type Claims struct {
+	jwt.RegisteredClaims
+}
+
+type claimsKey struct{}
+
+// ClaimsFrom returns the claims of the request's validated token, or nil.
+func ClaimsFrom(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsKey{}).(*Claims)
+	return c
+}
+
+const (
+	defaultJWKSRefresh = 5 * time.Minute
+	// minJWKSRefresh bounds on-demand refreshes triggered by unknown key IDs
+	// or upstream 401s, so a flood of bad tokens cannot hammer the IdP.
+	minJWKSRefresh = 30 * time.Second
+)
+
+// JWTAuthMiddleware validates RS256/ES256 bearer tokens against a JWKS
+// endpoint, checking exp and aud (and iss when configured).
+type JWTAuthMiddleware struct {
+	cfg    JWTConfig
+	client *http.Client
+	logger *slog.Logger
+	parser *jwt.Parser
+	exempt map[string]bool
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastFetch   time.Time
+	refreshing  bool
+	refreshDone chan struct{}
+}
+
+// NewJWTAuthMiddleware fetches the key set once and then keeps it fresh in
+// the background until ctx is cancelled. A failed initial fetch is logged,
+// not fatal: tokens are rejected until a refresh succeeds.
+func NewJWTAuthMiddleware(ctx context.Context, cfg JWTConfig, logger *slog.Logger) *JWTAuthMiddleware {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultJWKSRefresh
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithAudience(cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	j := &JWTAuthMiddleware{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		parser: jwt.NewParser(opts...),
+		exempt: make(map[string]bool),
+		keys:   make(map[string]crypto.PublicKey),
+	}
+	exempt := cfg.ExemptPaths
+	if exempt == nil {
+		exempt = defaultExemptPaths
+	}
+	for _, p := range exempt {
+		j.exempt[p] = true
+	}
+
+	j.refresh(ctx)
+	go func() {
+		ticker := time.NewTicker(cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				j.refresh(ctx)
+			}
+		}
+	}()
+	return j
+}
+
+// Refresh re-fetches the key set in the background unless that happened
+// within the last 30 seconds. Call it when an upstream rejects a request
+// with 401 in case the signing keys rotated.
+func (j *JWTAuthMiddleware) Refresh() {
+	if j == nil {
+		return
+	}
+	j.mu.RLock()
+	recent := time.Since(j.lastFetch) < minJWKSRefresh
+	j.mu.RUnlock()
+	if !recent {
+		go j.refresh(context.Background())
+	}
+}
+
+func (j *JWTAuthMiddleware) refresh(ctx context.Context) {
+	j.mu.Lock()
+	if j.refreshing {
+		done := j.refreshDone
+		j.mu.Unlock()
+		<-done
+		return
+	}
+	j.refreshing = true
+	j.refreshDone = make(chan struct{})
+	j.mu.Unlock()
+
+	keys, err := j.fetch(ctx)
+
+	j.mu.Lock()
+	j.lastFetch = time.Now()
+	if err == nil {
+		j.keys = keys
+	}
+	j.refreshing = false
+	close(j.refreshDone)
+	j.mu.Unlock()
+
+	if err != nil {
+		j.logger.Error("jwks refresh failed", slog.String("url", j.cfg.JWKSURL), slog.String("error", err.Error()))
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *JWTAuthMiddleware) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			j.logger.Warn("skipping jwks key", slog.String("kid", k.Kid), slog.String("error", err.Error()))
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// key resolves the verification key for a token. An unknown kid triggers
+// one synchronous refresh (rate limited) before giving up.
+func (j *JWTAuthMiddleware) key(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	lookup := func() (crypto.PublicKey, bool) {
+		j.mu.RLock()
+		defer j.mu.RUnlock()
+		if kid == "" && len(j.keys) == 1 {
+			for _, k := range j.keys {
+				return k, true
+			}
+		}
+		k, ok := j.keys[kid]
+		return k, ok
+	}
+	k, ok := lookup()
+	if !ok {
+		j.mu.RLock()
+		stale := time.Since(j.lastFetch) >= minJWKSRefresh
+		j.mu.RUnlock()
+		if stale {
+			j.refresh(context.Background())
+			k, ok = lookup()
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	switch k.(type) {
+	case *rsa.PublicKey:
+		if t.Method.Alg() != "RS256" {
+			return nil, fmt.Errorf("key %q is RSA but token uses %s", kid, t.Method.Alg())
+		}
+	case *ecdsa.PublicKey:
+		if t.Method.Alg() != "ES256" {
+			return nil, fmt.Errorf("key %q is EC but token uses %s", kid, t.Method.Alg())
+		}
+	}
+	return k, nil
+}
+
+func (j *JWTAuthMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if j.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-router"`)
+			apierror.Write(w, http.StatusUnauthorized, "missing_token", "a bearer token is required")
+			return
+		}
+		claims := &Claims{}
+		if _, err := j.parser.ParseWithClaims(strings.TrimSpace(token), claims, j.key); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="model-router", error="invalid_token"`)
+			apierror.Write(w, http.StatusUnauthorized, "invalid_token", "invalid bearer token: "+tokenErrorReason(err))
+			return
+		}
+		RequestInfoFrom(r.Context()).SetSubject(claims.Subject)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// tokenErrorReason gives the client a short cause without echoing the token.
+func tokenErrorReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "token expired"
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return "wrong audience"
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return "wrong issuer"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return "signature could not be verified"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed token"
+	default:
+		return "validation failed"
+	}
+}
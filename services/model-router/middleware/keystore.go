@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrKeyNotFound is a KeyStore not knowing the key it was asked for.
+var ErrKeyNotFound = errors.New("API key not found")
+
+// KeyInfo is what a KeyStore knows about an API key: the name it goes by in
+// logs, the tenant it belongs to, if the store says, its requests-per-
+// minute budget (0 for none), the models it may use, as globs (none
+// listed for any), whether it may override the model of its requests, and
+// the priority class of its requests and the highest they may ask for
+// ("" for no say).
+type KeyInfo struct {
+	Name              string
+	Tenant            string
+	RequestsPerMinute int
+	AllowedModels     []string
+	ModelOverride     bool
+	Priority          string
+	MaxPriority       string
+}
+
+// KeyStore looks up the API key whose secret a request presented. Lookup
+// returns ErrKeyNotFound for a key the store does not have, and any other
+// error when it cannot tell.
+type KeyStore interface {
+	Lookup(ctx context.Context, secret string) (KeyInfo, error)
+}
+
+// RedisKeysConfig looks up keys not in auth.keys in Redis, so keys can be
+// issued and revoked without a redeploy. Each key is a hash at KeyPrefix
+// (default "model-router:apikey:") followed by the hex SHA-256 of its
+// secret, with the fields name, tenant, requests_per_minute,
+// allowed_models (comma-separated globs), model_override (true or false),
+// priority and max_priority. Lookups are cached for CacheTTLSeconds
+// (default 30), so a deleted key stops working within
+// that; while Redis is unreachable, keys looked up in the last few
+// minutes keep working. The URL comes from RedisURLEnv when that variable
+// is set, then RedisURL. Changes take effect on restart, not reload.
+type RedisKeysConfig struct {
+	RedisURL        string `json:"redis_url,omitempty"`
+	RedisURLEnv     string `json:"redis_url_env,omitempty"`
+	KeyPrefix       string `json:"key_prefix,omitempty"`
+	CacheTTLSeconds int    `json:"cache_ttl_seconds,omitempty"`
+}
+
+func (c RedisKeysConfig) URL() string {
+	if v := os.Getenv(c.RedisURLEnv); c.RedisURLEnv != "" && v != "" {
+		return v
+	}
+	return c.RedisURL
+}
+
+// StaticKeyStore holds the keys of a config file.
+type StaticKeyStore struct {
+	keys []staticKey
+}
+
+type staticKey struct {
+	digest [sha256.Size]byte
+	info   KeyInfo
+}
+
+func NewStaticKeyStore(keys []APIKey) (*StaticKeyStore, error) {
+	s := &StaticKeyStore{}
+	for _, k := range keys {
+		digest, err := k.digest()
+		if err != nil {
+			return nil, fmt.Errorf("auth key %q: %w", k.Name, err)
+		}
+		s.keys = append(s.keys, staticKey{digest: digest, info: KeyInfo{
+			Name:              k.Name,
+			RequestsPerMinute: k.RequestsPerMinute,
+			AllowedModels:     k.AllowedModels,
+			ModelOverride:     k.ModelOverride,
+			Priority:          k.Priority,
+			MaxPriority:       k.MaxPriority,
+		}})
+	}
+	return s, nil
+}
+
+// Lookup compares the presented key's digest against every key without
+// exiting early, so response timing does not reveal a partial match.
+func (s *StaticKeyStore) Lookup(_ context.Context, secret string) (KeyInfo, error) {
+	digest := sha256.Sum256([]byte(secret))
+	var found *KeyInfo
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(digest[:], s.keys[i].digest[:]) == 1 {
+			found = &s.keys[i].info
+		}
+	}
+	if found == nil {
+		return KeyInfo{}, ErrKeyNotFound
+	}
+	return *found, nil
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type loggerKey struct{}
+
+// LoggerFrom returns the request-scoped logger that Logging attached to
+// ctx, which tags every line with the request (and trace) ID, or fallback
+// outside a request.
+func LoggerFrom(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return fallback
+}
+
+// Logging emits one structured line per request once it completes, and
+// gives handlers a logger carrying the request's IDs through LoggerFrom.
+func Logging(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, info := WithRequestInfo(r)
+			ids := []slog.Attr{slog.String("request_id", RequestIDFrom(r.Context()))}
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				ids = append(ids, slog.String("trace_id", sc.TraceID().String()))
+			}
+			scoped := slog.New(logger.Handler().WithAttrs(ids))
+			r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, scoped))
+			rw := WrapResponseWriter(w)
+			next.ServeHTTP(rw, r)
+
+			attrs := append(ids,
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("proto", r.Proto),
+				slog.Int("status_code", rw.StatusCode()),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.Int64("bytes", rw.Written),
+				slog.String("client_ip", clientIP(r)),
+			)
+			if model, provider := info.Route(); model != "" {
+				attrs = append(attrs, slog.String("model", model), slog.String("provider", provider))
+			}
+			if url := info.BackendURL(); url != "" {
+				attrs = append(attrs, slog.String("backend_url", url))
+			}
+			if variant := info.Variant(); variant != "" {
+				attrs = append(attrs, slog.String("variant", variant))
+			}
+			if decision := info.Decision(); decision != "" {
+				attrs = append(attrs, slog.String("route_decision", decision))
+			}
+			if result, upstream := info.Cache(); result != "" {
+				attrs = append(attrs, slog.String("cache", result))
+				if upstream > 0 {
+					attrs = append(attrs, slog.Float64("cached_upstream_latency_ms", float64(upstream.Microseconds())/1000))
+				}
+			}
+			if key := info.APIKey(); key != "" {
+				attrs = append(attrs, slog.String("api_key", key))
+			}
+			if sub := info.Subject(); sub != "" {
+				attrs = append(attrs, slog.String("sub", sub))
+			}
+			level := slog.LevelInfo
+			if rw.StatusCode() >= 500 {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		})
+	}
+}
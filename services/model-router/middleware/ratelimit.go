@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+type Limit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+type RateLimitConfig struct {
+	// Header carries the client identifier; defaults to X-Client-ID.
+	Header  string           `json:"header"`
+	Default *Limit           `json:"default"`
+	Models  map[string]Limit `json:"models"`
+}
+
+type bucketKey struct {
+	client string
+	model  string
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter enforces a token bucket per (client, model) pair.
+type RateLimiter struct {
+	cfg       RateLimitConfig
+	modelFunc func(*http.Request) string
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+const bucketIdleTTL = 10 * time.Minute
+
+// NewRateLimiter builds a limiter; modelFunc extracts the requested model
+// from a request without consuming its body.
+func NewRateLimiter(cfg RateLimitConfig, modelFunc func(*http.Request) string) *RateLimiter {
+	if cfg.Header == "" {
+		cfg.Header = "X-Client-ID"
+	}
+	return &RateLimiter{
+		cfg:       cfg,
+		modelFunc: modelFunc,
+		buckets:   make(map[bucketKey]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *RateLimiter) limitFor(model string) (Limit, bool) {
+	if l, ok := rl.cfg.Models[model]; ok {
+		return l, true
+	}
+	if rl.cfg.Default != nil {
+		return *rl.cfg.Default, true
+	}
+	return Limit{}, false
+}
+
+func (rl *RateLimiter) limiter(key bucketKey, l Limit) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > bucketIdleTTL {
+		for k, b := range rl.buckets {
+			if now.Sub(b.lastSeen) > bucketIdleTTL {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.RequestsPerSecond), l.Burst)}
+		rl.buckets[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		model := rl.modelFunc(r)
+		l, ok := rl.limitFor(model)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := r.Header.Get(rl.cfg.Header)
+		if client == "" {
+			client = clientIP(r)
+		}
+
+		res := rl.limiter(bucketKey{client: client, model: model}, l).Reserve()
+		if !res.OK() {
+			apierror.Write(w, http.StatusTooManyRequests, "rate_limited", "rate limit exceeded for model "+model)
+			return
+		}
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			writeRateLimited(w, delay, "rate limit exceeded for model "+model)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRateLimited answers 429 with Retry-After rounded up to whole seconds.
+func writeRateLimited(w http.ResponseWriter, delay time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	apierror.Write(w, http.StatusTooManyRequests, "rate_limited", message)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
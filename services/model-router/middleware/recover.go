@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/aspendos/model-router/apierror"
+)
+
+// Recover answers a request whose handler panicked with a 500 internal
+// error in the envelope, unless the response had already started, and
+// logs the panic with its stack. http.ErrAbortHandler is let through, as
+// the handler's way of cutting the response off on purpose.
+func Recover(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := WrapResponseWriter(w)
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				LoggerFrom(r.Context(), logger).Error("handler panicked",
+					slog.String("path", r.URL.Path), slog.String("panic", fmt.Sprint(p)), slog.String("stack", string(debug.Stack())))
+				if rw.Status == 0 {
+					apierror.Write(rw, http.StatusInternalServerError, apierror.CodeInternal, "internal error")
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
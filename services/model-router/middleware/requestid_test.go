@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		client string
+		kept   bool
+	}{
+		{name: "none"},
+		{name: "client's", client: "req-1:retry_2.a", kept: true},
+		{name: "longest allowed", client: strings.Repeat("a", 128), kept: true},
+		{name: "too long", client: strings.Repeat("a", 129)},
+		{name: "space", client: "req 1"},
+		{name: "newline", client: "req-1\nlevel=error"},
+		{name: "non-ASCII", client: "réq-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFrom(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.client != "" {
+				req.Header.Set(RequestIDHeader, tt.client)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got := rec.Header().Get(RequestIDHeader)
+			if got != seen {
+				t.Errorf("response ID %q, context ID %q: want the same", got, seen)
+			}
+			if tt.kept && got != tt.client {
+				t.Errorf("ID = %q, want the client's %q", got, tt.client)
+			}
+			if !tt.kept && !uuidV4.MatchString(got) {
+				t.Errorf("ID = %q, want a generated UUID v4", got)
+			}
+		})
+	}
+}
+
+// Generated IDs are unique.
+func TestRequestIDUnique(t *testing.T) {
+	h := RequestID(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	seen := make(map[string]bool)
+	for range 1000 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		id := rec.Header().Get(RequestIDHeader)
+		if seen[id] {
+			t.Fatalf("ID %s generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func BenchmarkRequestID(b *testing.B) {
+	h := RequestID(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for _, client := range []string{"", "req-0123456789abcdef"} {
+		name := "generated"
+		if client != "" {
+			name = "client's"
+		}
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if client != "" {
+				req.Header.Set(RequestIDHeader, client)
+			}
+			b.ReportAllocs()
+			for range b.N {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
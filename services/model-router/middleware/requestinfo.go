@@ -0,0 +1,343 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo carries routing details that handlers learn mid-request
+// (the resolved model and provider, the A/B variant, the authenticated API
+// key, its tenant or the token subject) back out to the middleware
+// wrapping them.
+type RequestInfo struct {
+	mu          sync.Mutex
+	model       string
+	provider    string
+	backendURL  string
+	apiKey      string
+	keyModels   []string
+	override    bool
+	priority    string
+	maxPriority string
+	subject     string
+	tenant      string
+	variant     string
+	decision    string
+	state       string
+
+	cache         string
+	cachedLatency time.Duration
+	tokens        int64
+	promptTokens  int64
+	outputTokens  int64
+}
+
+func (i *RequestInfo) SetRoute(model, provider string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.model, i.provider = model, provider
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Route() (model, provider string) {
+	if i == nil {
+		return "", ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.model, i.provider
+}
+
+// SetBackendURL records the base URL of the backend the request was sent to.
+func (i *RequestInfo) SetBackendURL(url string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.backendURL = url
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) BackendURL() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.backendURL
+}
+
+// SetVariant records the traffic-split variant that served the request.
+func (i *RequestInfo) SetVariant(name string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.variant = name
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Variant() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.variant
+}
+
+// SetDecision records the routing strategy's explanation of its choice.
+func (i *RequestInfo) SetDecision(d string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.decision = d
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Decision() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.decision
+}
+
+// SetCache records whether the response cache answered the request ("hit"
+// or "miss") and, for hits, the latency of the upstream call that produced
+// the cached response.
+func (i *RequestInfo) SetCache(result string, upstreamLatency time.Duration) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.cache, i.cachedLatency = result, upstreamLatency
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Cache() (result string, upstreamLatency time.Duration) {
+	if i == nil {
+		return "", 0
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.cache, i.cachedLatency
+}
+
+// SetTokens records how many tokens the response used, as reported by the
+// provider or else estimated.
+func (i *RequestInfo) SetTokens(n int64) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.tokens = n
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Tokens() int64 {
+	if i == nil {
+		return 0
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.tokens
+}
+
+// SetTokenCounts records the prompt and completion tokens of the response
+// when the provider reported them.
+func (i *RequestInfo) SetTokenCounts(prompt, completion int64) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.promptTokens, i.outputTokens = prompt, completion
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) TokenCounts() (prompt, completion int64) {
+	if i == nil {
+		return 0, 0
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.promptTokens, i.outputTokens
+}
+
+// SetAPIKey records the name (not the secret) of the key that authenticated
+// the request.
+func (i *RequestInfo) SetAPIKey(name string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.apiKey = name
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) APIKey() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.apiKey
+}
+
+// SetKeyModels records the models the request's API key is limited to,
+// as globs; none for any.
+func (i *RequestInfo) SetKeyModels(patterns []string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.keyModels = patterns
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) KeyModels() []string {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.keyModels
+}
+
+// SetKeyPriority records the priority class of the request's API key's
+// requests and the highest they may ask for; "" for no say.
+func (i *RequestInfo) SetKeyPriority(priority, maxPriority string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.priority, i.maxPriority = priority, maxPriority
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) KeyPriority() (priority, maxPriority string) {
+	if i == nil {
+		return "", ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.priority, i.maxPriority
+}
+
+// SetState records how far along the request is, for reports of the
+// requests in flight: "upstream" once it is sent to a backend, "streaming"
+// once its response streams back. A request with no state is queued.
+func (i *RequestInfo) SetState(state string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.state = state
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) State() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+// SetModelOverride records whether the request's API key may override
+// the model it names.
+func (i *RequestInfo) SetModelOverride(allowed bool) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.override = allowed
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) ModelOverride() bool {
+	if i == nil {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.override
+}
+
+// SetSubject records the sub claim of the request's validated JWT.
+func (i *RequestInfo) SetSubject(sub string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.subject = sub
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Subject() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.subject
+}
+
+// SetTenant records the tenant the request's API key belongs to.
+func (i *RequestInfo) SetTenant(name string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.tenant = name
+	i.mu.Unlock()
+}
+
+func (i *RequestInfo) Tenant() string {
+	if i == nil {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.tenant
+}
+
+// RequestInfoFrom returns the request's RequestInfo, or nil if none was attached.
+func RequestInfoFrom(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// WithRequestInfo attaches a RequestInfo to r unless one is already present.
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if info := RequestInfoFrom(r.Context()); info != nil {
+		return r, info
+	}
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// Derive returns r with a RequestInfo of its own that carries the caller
+// recorded in r's (API key, the models it may use and whether it may
+// override them, JWT subject and tenant)
+// but nothing of its route, for a sub-request routed by itself, such as
+// one model of a batch.
+func Derive(r *http.Request) (*http.Request, *RequestInfo) {
+	derived := &RequestInfo{}
+	if info := RequestInfoFrom(r.Context()); info != nil {
+		info.mu.Lock()
+		derived.apiKey, derived.keyModels, derived.override = info.apiKey, info.keyModels, info.override
+		derived.subject, derived.tenant = info.subject, info.tenant
+		info.mu.Unlock()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, derived)), derived
+}
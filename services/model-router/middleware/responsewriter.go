@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter records the status code and body size written through it
+// while still exposing http.Flusher for streaming handlers and
+// http.Hijacker for WebSocket upgrades.
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status  int
+	Written int64
+}
+
+func WrapResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (rw *ResponseWriter) WriteHeader(status int) {
+	if rw.Status == 0 {
+		rw.Status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.Status == 0 {
+		rw.Status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.Written += int64(n)
+	return n, err
+}
+
+func (rw *ResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection to a WebSocket handler, recording 101 as
+// the status.
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil && rw.Status == 0 {
+		rw.Status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// StatusCode is the status sent to the client, 200 if the handler wrote nothing.
+func (rw *ResponseWriter) StatusCode() int {
+	if rw.Status == 0 {
+		return http.StatusOK
+	}
+	return rw.Status
+}
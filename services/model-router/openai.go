@@ -0,0 +1,45 @@
+package main
+
+import "net/http"
+
+// OpenAI-compatible surface: POST /v1/chat/completions is served by the
+// same handler as /route, so an OpenAI SDK pointed at the router with
+// base_url=http://<router>/v1 gets routing, streaming and the matching
+// error envelope without changes.
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIModelList struct {
+	Object string        `json:"object"`
+	Data   []openAIModel `json:"data"`
+}
+
+// handleModels serves GET /v1/models in the OpenAI list format. created is
+// when the routing table was loaded; owned_by is the provider of the
+// entry's first backend.
+func (rt *Router) handleModels(w http.ResponseWriter, r *http.Request) {
+	entries, loaded := rt.registry.Models()
+	list := openAIModelList{Object: "list", Data: []openAIModel{}}
+	tenant := rt.tenantOf(r)
+	for _, e := range entries {
+		if tenant != nil && !tenant.Allows(e.Name) {
+			continue
+		}
+		owner := "aspendos"
+		if backends := e.Backends(); len(backends) > 0 {
+			owner = backends[0].Name()
+		}
+		list.Data = append(list.Data, openAIModel{
+			ID:      e.Name,
+			Object:  "model",
+			Created: loaded.Unix(),
+			OwnedBy: owner,
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
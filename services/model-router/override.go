@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// ModelOverrideHeader names the model to route a request as, in place of
+// the one its body names, for internal tools that cannot change their
+// request bodies. Only API keys with model_override may send it.
+const ModelOverrideHeader = "X-Aspendos-Model-Override"
+
+// ModelOverride rewrites the body of a request carrying
+// ModelOverrideHeader to name the header's model, so everything from here
+// on, the tenant's allowlist, usage accounting and the upstream included,
+// sees only that model, and the response names it too. The model a
+// request is routed as is thus the header's, then the body's, then its
+// tenant's default model. A key without the permission is turned away
+// with 403 rather than have the header silently ignored.
+func (rt *Router) ModelOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		model := strings.TrimSpace(r.Header.Get(ModelOverrideHeader))
+		if model == "" || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info := middleware.RequestInfoFrom(r.Context())
+		if !info.ModelOverride() {
+			writeError(w, http.StatusForbidden, "model_override_not_allowed", "this API key may not override the model with "+ModelOverrideHeader)
+			return
+		}
+		if isMultipart(r.Header) {
+			// The form's model field is replaced in place; a form without
+			// one is left to fail validation as it would have.
+			if sent, err := peekFormModel(r); err == nil && sent != model && setFormModel(r, model) == nil {
+				rt.logOverride(r, sent, model)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.Model == model {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rewritten, err := withModel(body, model); err == nil {
+			rt.logOverride(r, req.Model, model)
+			r.Body = io.NopCloser(bytes.NewReader(rewritten))
+			r.ContentLength = int64(len(rewritten))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rt *Router) logOverride(r *http.Request, sent, model string) {
+	info := middleware.RequestInfoFrom(r.Context())
+	middleware.LoggerFrom(r.Context(), rt.logger).Debug("model overridden by header",
+		slog.String("requested", sent), slog.String("model", model),
+		slog.String("api_key", info.APIKey()), slog.String("tenant", info.Tenant()))
+}
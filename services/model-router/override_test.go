@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// The model a request is routed as is the override header's, then the
+// body's, then its tenant's default, and whichever it is must be allowed
+// to the tenant and the key.
+func TestModelOverridePrecedence(t *testing.T) {
+	// The upstream answers with the model it was asked for.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.Unmarshal(body, &req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"model":%q}`, req.Model)
+	}))
+	defer upstream.Close()
+	cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  "*": {provider: a}
+auth:
+  keys:
+    - {name: tool, key: sk-tool, model_override: true}
+    - {name: client, key: sk-client}
+    - {name: narrow-tool, key: sk-narrow, model_override: true, allowed_models: [m-a]}
+tenants:
+  acme:
+    api_keys: [tool, client, narrow-tool]
+    allowed_models: [m-*]
+    default_model: m-default
+    model_overrides: {m-legacy: m-b}
+`, upstream.URL))
+	rt := newTestRouter(t, cfg)
+	auth, err := middleware.NewAuth(*cfg.Auth, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ResolveTenants(rt.registry.ResolveTenant)
+	h := middleware.Logging(testLogger())(auth.Middleware(
+		middleware.Chain(routeChain(t, rt), rt.ModelOverride, rt.Aliases, rt.Tenants, rt.KeyModels)))
+
+	tests := []struct {
+		name     string
+		key      string
+		override string
+		body     string
+		want     int
+		model    string
+		code     string
+	}{
+		{name: "body", key: "sk-tool", body: `"model":"m-a",`, want: http.StatusOK, model: "m-a"},
+		{name: "tenant default", key: "sk-tool", want: http.StatusOK, model: "m-default"},
+		{name: "header over body", key: "sk-tool", override: "m-b", body: `"model":"m-a",`, want: http.StatusOK, model: "m-b"},
+		{name: "header over tenant default", key: "sk-tool", override: "m-b", want: http.StatusOK, model: "m-b"},
+		{name: "header through tenant overrides", key: "sk-tool", override: "m-legacy", body: `"model":"m-a",`, want: http.StatusOK, model: "m-b"},
+		{name: "header outside tenant allowlist", key: "sk-tool", override: "secret", body: `"model":"m-a",`, want: http.StatusForbidden, code: "model_not_allowed"},
+		{name: "body outside tenant allowlist", key: "sk-tool", body: `"model":"secret",`, want: http.StatusForbidden, code: "model_not_allowed"},
+		{name: "header outside key allowlist", key: "sk-narrow", override: "m-b", body: `"model":"m-a",`, want: http.StatusForbidden, code: "model_not_allowed"},
+		{name: "header inside key allowlist", key: "sk-narrow", override: "m-a", body: `"model":"m-b",`, want: http.StatusOK, model: "m-a"},
+		{name: "key without model_override", key: "sk-client", override: "m-b", body: `"model":"m-a",`, want: http.StatusForbidden, code: "model_override_not_allowed"},
+		{name: "key without model_override, same model", key: "sk-client", override: "m-a", body: `"model":"m-a",`, want: http.StatusForbidden, code: "model_override_not_allowed"},
+		{name: "key without model_override, no header", key: "sk-client", body: `"model":"m-a",`, want: http.StatusOK, model: "m-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := chatRequest(`{` + tt.body + `"messages":[{"role":"user","content":"hi"}]}`)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			if tt.override != "" {
+				req.Header.Set(ModelOverrideHeader, tt.override)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			var resp struct {
+				Model string `json:"model"`
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != tt.want || resp.Model != tt.model || resp.Error.Code != tt.code {
+				t.Errorf("%d %s, want %d with model %q, code %q", rec.Code, rec.Body, tt.want, tt.model, tt.code)
+			}
+		})
+	}
+}
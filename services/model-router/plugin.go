@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// Plugin transforms the traffic of the models it is configured on.
+// ProcessRequest sees the upstream request before it is sent, once per
+// request rather than per retry; changes to its headers and body are what
+// the upstream receives. ProcessResponse sees the upstream response,
+// already translated to the OpenAI shape, before the client does. An error
+// from either fails the request with a 502.
+type Plugin interface {
+	ProcessRequest(ctx context.Context, req *http.Request) error
+	ProcessResponse(ctx context.Context, resp *http.Response) error
+}
+
+// PluginConfig configures one plugin of a model's chain. Headers (for
+// header_injector) and Patterns (for body_redactor) configure the built-in
+// plugins; plugins added with RegisterPlugin read Options.
+type PluginConfig struct {
+	Name     string            `json:"name"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Patterns []RedactPattern   `json:"patterns,omitempty"`
+	Options  map[string]any    `json:"options,omitempty"`
+}
+
+// RedactPattern replaces matches of the regular expression Pattern with
+// Replacement (default "[REDACTED]"), which may refer to submatches as $1.
+type RedactPattern struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// PluginFactory builds a plugin from its configuration, reporting
+// configuration errors when the config is validated.
+type PluginFactory func(PluginConfig) (Plugin, error)
+
+var (
+	pluginsMu sync.RWMutex
+	// pluginFactories maps a plugin's name in the config to its factory.
+	pluginFactories = map[string]PluginFactory{
+		"header_injector": newHeaderInjector,
+		"body_redactor":   newBodyRedactor,
+	}
+)
+
+// RegisterPlugin makes a plugin available to model configs under name. It
+// is meant for builds that compile in their own plugins, from an init
+// function, and panics if name is taken.
+func RegisterPlugin(name string, factory PluginFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, ok := pluginFactories[name]; ok {
+		panic("model-router: plugin " + name + " registered twice")
+	}
+	pluginFactories[name] = factory
+}
+
+// namedPlugin is a plugin and the name it was configured under, for errors.
+type namedPlugin struct {
+	name string
+	Plugin
+}
+
+// PluginChain runs a model's plugins in config order, stopping at the
+// first error. The zero value runs nothing.
+type PluginChain []namedPlugin
+
+// pluginError is a plugin failing a request, reported with its name.
+type pluginError struct {
+	plugin string
+	err    error
+}
+
+func (e *pluginError) Error() string { return "plugin " + e.plugin + ": " + e.err.Error() }
+func (e *pluginError) Unwrap() error { return e.err }
+
+// newPluginChain builds the plugins configured for a model.
+func newPluginChain(configs []PluginConfig) (PluginChain, error) {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	var chain PluginChain
+	for i, pc := range configs {
+		factory, ok := pluginFactories[pc.Name]
+		if !ok {
+			return nil, fmt.Errorf("plugins[%d]: unknown plugin %q", i, pc.Name)
+		}
+		p, err := factory(pc)
+		if err != nil {
+			return nil, fmt.Errorf("plugins[%d] (%s): %w", i, pc.Name, err)
+		}
+		chain = append(chain, namedPlugin{name: pc.Name, Plugin: p})
+	}
+	return chain, nil
+}
+
+func (c PluginChain) ProcessRequest(ctx context.Context, req *http.Request) error {
+	for _, p := range c {
+		if err := p.ProcessRequest(ctx, req); err != nil {
+			return &pluginError{plugin: p.name, err: err}
+		}
+	}
+	return nil
+}
+
+func (c PluginChain) ProcessResponse(ctx context.Context, resp *http.Response) error {
+	for _, p := range c {
+		if err := p.ProcessResponse(ctx, resp); err != nil {
+			return &pluginError{plugin: p.name, err: err}
+		}
+	}
+	return nil
+}
+
+// processRequest runs the chain over the request about to be sent to url
+// and returns the headers and body it should go out with.
+func (c PluginChain) processRequest(ctx context.Context, url string, body []byte, header http.Header) ([]byte, http.Header, error) {
+	if len(c) == 0 {
+		return body, header, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = header.Clone()
+	if err := c.ProcessRequest(ctx, req); err != nil {
+		return nil, nil, err
+	}
+	if req.Body != nil {
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return body, req.Header, nil
+}
+
+// HeaderInjector sets fixed headers on upstream requests, replacing any
+// the router or client set, for example a gateway token an upstream
+// requires.
+type HeaderInjector struct {
+	headers http.Header
+}
+
+func newHeaderInjector(pc PluginConfig) (Plugin, error) {
+	if len(pc.Headers) == 0 {
+		return nil, fmt.Errorf("headers is required")
+	}
+	h := make(http.Header, len(pc.Headers))
+	for name, value := range pc.Headers {
+		h.Set(name, value)
+	}
+	return &HeaderInjector{headers: h}, nil
+}
+
+func (hi *HeaderInjector) ProcessRequest(_ context.Context, req *http.Request) error {
+	for name, values := range hi.headers {
+		req.Header[name] = slices.Clone(values)
+	}
+	return nil
+}
+
+func (hi *HeaderInjector) ProcessResponse(context.Context, *http.Response) error { return nil }
+
+// BodyRedactor rewrites response bodies, replacing whatever its patterns
+// match. Event streams are rewritten line by line as they are read, so a
+// match split across lines of a stream is not redacted.
+type BodyRedactor struct {
+	patterns     []*regexp.Regexp
+	replacements [][]byte
+}
+
+func newBodyRedactor(pc PluginConfig) (Plugin, error) {
+	if len(pc.Patterns) == 0 {
+		return nil, fmt.Errorf("patterns is required")
+	}
+	br := &BodyRedactor{}
+	for i, rp := range pc.Patterns {
+		re, err := regexp.Compile(rp.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("patterns[%d]: %w", i, err)
+		}
+		replacement := rp.Replacement
+		if replacement == "" {
+			replacement = "[REDACTED]"
+		}
+		br.patterns = append(br.patterns, re)
+		br.replacements = append(br.replacements, []byte(replacement))
+	}
+	return br, nil
+}
+
+func (br *BodyRedactor) ProcessRequest(context.Context, *http.Request) error { return nil }
+
+func (br *BodyRedactor) ProcessResponse(_ context.Context, resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		resp.Body = &redactingBody{src: resp.Body, lines: bufio.NewReader(resp.Body), redact: br.redact}
+		return nil
+	}
+	return rewriteBody(resp, func(body []byte) ([]byte, error) { return br.redact(body), nil })
+}
+
+func (br *BodyRedactor) redact(b []byte) []byte {
+	for i, re := range br.patterns {
+		b = re.ReplaceAll(b, br.replacements[i])
+	}
+	return b
+}
+
+// redactingBody redacts a stream one line at a time.
+type redactingBody struct {
+	src     io.ReadCloser
+	lines   *bufio.Reader
+	redact  func([]byte) []byte
+	pending []byte
+	err     error
+}
+
+func (rb *redactingBody) Read(p []byte) (int, error) {
+	for len(rb.pending) == 0 {
+		if rb.err != nil {
+			return 0, rb.err
+		}
+		var line []byte
+		line, rb.err = rb.lines.ReadBytes('\n')
+		if len(line) > 0 {
+			rb.pending = rb.redact(line)
+		}
+	}
+	n := copy(p, rb.pending)
+	rb.pending = rb.pending[n:]
+	return n, nil
+}
+
+func (rb *redactingBody) Close() error { return rb.src.Close() }
+
+// PluginCalls records the calls of test plugins in the order they happen,
+// as "name:request" and "name:response".
+type PluginCalls struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (pc *PluginCalls) record(call string) {
+	pc.mu.Lock()
+	pc.calls = append(pc.calls, call)
+	pc.mu.Unlock()
+}
+
+// List returns the calls recorded so far.
+func (pc *PluginCalls) List() []string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return slices.Clone(pc.calls)
+}
+
+// TestPlugin records its calls into a shared PluginCalls, so a test can
+// check that a chain's plugins run, and stop, in the right order. Setting
+// RequestErr or ResponseErr makes the matching call fail.
+type TestPlugin struct {
+	Name        string
+	RequestErr  error
+	ResponseErr error
+	calls       *PluginCalls
+}
+
+// NewTestPlugin returns a plugin that records its calls into calls.
+func NewTestPlugin(name string, calls *PluginCalls) *TestPlugin {
+	return &TestPlugin{Name: name, calls: calls}
+}
+
+func (tp *TestPlugin) ProcessRequest(context.Context, *http.Request) error {
+	tp.calls.record(tp.Name + ":request")
+	return tp.RequestErr
+}
+
+func (tp *TestPlugin) ProcessResponse(context.Context, *http.Response) error {
+	tp.calls.record(tp.Name + ":response")
+	return tp.ResponseErr
+}
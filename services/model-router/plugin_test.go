@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// registerTestPlugins registers a TestPlugin under each of names, unique
+// to the test since registrations last for the process, recording into
+// calls, and returns them by name.
+func registerTestPlugins(t *testing.T, calls *PluginCalls, names ...string) map[string]*TestPlugin {
+	t.Helper()
+	plugins := make(map[string]*TestPlugin)
+	for _, name := range names {
+		p := NewTestPlugin(name, calls)
+		plugins[name] = p
+		RegisterPlugin(t.Name()+"/"+name, func(PluginConfig) (Plugin, error) { return p, nil })
+	}
+	return plugins
+}
+
+// pluginRouter routes model m to upstream through the plugins configured
+// by plugins, a YAML list.
+func pluginRouter(t *testing.T, upstream, plugins string) http.Handler {
+	t.Helper()
+	return routeChain(t, newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s, retry: {max_attempts: 2, base_delay: 1ms, max_delay: 1ms, retry_on: [429]}}
+models:
+  m: {provider: a, plugins: %s}
+`, upstream, plugins))))
+}
+
+// Plugins see the request and then the response in config order, the
+// request once however many attempts it takes.
+func TestPluginOrder(t *testing.T) {
+	var attempts atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	defer upstream.Close()
+	var calls PluginCalls
+	registerTestPlugins(t, &calls, "first", "second")
+	rec := httptest.NewRecorder()
+	pluginRouter(t, upstream.URL, fmt.Sprintf("[{name: %s/first}, {name: %s/second}]", t.Name(), t.Name())).
+		ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("%d attempts, want a retry", attempts.Load())
+	}
+	want := []string{"first:request", "second:request", "first:response", "second:response"}
+	if got := calls.List(); !slices.Equal(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+// A plugin's error fails the request with a 502 naming it, and the plugins
+// after it do not run; one failing the request keeps it from the upstream.
+func TestPluginErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      func(p *TestPlugin)
+		calls     []string
+		upstreams int64
+	}{
+		{
+			name:      "request",
+			fail:      func(p *TestPlugin) { p.RequestErr = errors.New("quota exceeded") },
+			calls:     []string{"first:request"},
+			upstreams: 0,
+		},
+		{
+			name:      "response",
+			fail:      func(p *TestPlugin) { p.ResponseErr = errors.New("quota exceeded") },
+			calls:     []string{"first:request", "second:request", "first:response"},
+			upstreams: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreams atomic.Int64
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreams.Add(1)
+				io.WriteString(w, `{"id":"resp-1"}`)
+			}))
+			defer upstream.Close()
+			var calls PluginCalls
+			plugins := registerTestPlugins(t, &calls, "first", "second")
+			tt.fail(plugins["first"])
+			rec := httptest.NewRecorder()
+			pluginRouter(t, upstream.URL, fmt.Sprintf("[{name: %s/first}, {name: %s/second}]", t.Name(), t.Name())).
+				ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+			if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "plugin_failed") ||
+				!strings.Contains(rec.Body.String(), "plugin "+t.Name()+"/first: quota exceeded") {
+				t.Errorf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if got := calls.List(); !slices.Equal(got, tt.calls) {
+				t.Errorf("calls = %v, want %v", got, tt.calls)
+			}
+			if got := upstreams.Load(); got != tt.upstreams {
+				t.Errorf("upstream called %d times, want %d", got, tt.upstreams)
+			}
+		})
+	}
+}
+
+// header_injector replaces what the client sent with its headers.
+func TestHeaderInjector(t *testing.T) {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	defer upstream.Close()
+	h := pluginRouter(t, upstream.URL, `[{name: header_injector, headers: {X-Gateway-Token: secret, X-Team: ml}}]`)
+	req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	req.Header.Set("X-Team", "client")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	header := <-got
+	if header.Get("X-Gateway-Token") != "secret" || !slices.Equal(header.Values("X-Team"), []string{"ml"}) {
+		t.Errorf("upstream headers = %v", header)
+	}
+}
+
+// body_redactor rewrites JSON responses whole and streams line by line,
+// replacing matches with [REDACTED] or the pattern's replacement.
+func TestBodyRedactor(t *testing.T) {
+	const plugins = `[{name: body_redactor, patterns: [{pattern: '\d{3}-\d{2}-\d{4}'}, {pattern: '(\w+)@example\.com', replacement: '$1@***'}]}]`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"choices":[{"message":{"content":"SSN 123-45-6789, mail ada@example.com"}}]}`,
+			want:        `{"choices":[{"message":{"content":"SSN [REDACTED], mail ada@***"}}]}`,
+		},
+		{
+			name:        "stream",
+			contentType: "text/event-stream",
+			body:        "data: {\"content\":\"123-45-6789\"}\n\ndata: {\"content\":\"ada@example.com\"}\n\ndata: [DONE]\n\n",
+			want:        "data: {\"content\":\"[REDACTED]\"}\n\ndata: {\"content\":\"ada@***\"}\n\ndata: [DONE]\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			}))
+			defer upstream.Close()
+			body := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+			if tt.name == "stream" {
+				body = `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			}
+			rec := httptest.NewRecorder()
+			pluginRouter(t, upstream.URL, plugins).ServeHTTP(rec, chatRequest(body))
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("%d %q, want %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPluginConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		plugins string
+		wantErr string
+	}{
+		{name: "unknown", plugins: "[{name: nope}]", wantErr: `plugins[0]: unknown plugin "nope"`},
+		{name: "injector without headers", plugins: "[{name: header_injector}]", wantErr: "plugins[0] (header_injector): headers is required"},
+		{name: "redactor without patterns", plugins: "[{name: body_redactor}]", wantErr: "patterns is required"},
+		{name: "bad pattern", plugins: "[{name: body_redactor, patterns: [{pattern: '('}]}]", wantErr: "patterns[0]: error parsing regexp"},
+		{name: "built-ins", plugins: "[{name: header_injector, headers: {X-A: b}}, {name: body_redactor, patterns: [{pattern: x}]}]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "router.yaml", `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: {provider: a, plugins: `+tt.plugins+"}\n"))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegisterPluginTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering header_injector again did not panic")
+		}
+	}()
+	RegisterPlugin("header_injector", newHeaderInjector)
+}
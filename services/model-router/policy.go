@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// defaultPool names, in routing policies, the pool of a model's own
+// provider, url or replicas, which serves requests no policy matches.
+const defaultPool = "default"
+
+// RoutingPolicy picks which of a model's pools serves a request, for models
+// with backends specialised by request: a GPU pool for large inputs and a
+// CPU pool for small ones, say. Select returns nil for a request the policy
+// does not match, leaving it to the next policy.
+type RoutingPolicy interface {
+	Select(r *http.Request, pools map[string]*BackendPool) (*BackendPool, error)
+}
+
+// RoutingPolicyConfig is one of a model's routing_policies: a policy Type
+// from the routingPolicies map, with its Params. Policies are tried in
+// descending Priority, those of equal priority in order.
+type RoutingPolicyConfig struct {
+	Type     string         `json:"type"`
+	Priority int            `json:"priority,omitempty"`
+	Params   map[string]any `json:"params,omitempty"`
+}
+
+var routingPolicies = map[string]func(params map[string]any) (RoutingPolicy, error){
+	"payload_size": newPayloadSizePolicy,
+	"header_match": newHeaderMatchPolicy,
+}
+
+// PolicyChain is a model's routing policies, in the order they are tried,
+// and the pools they route to by name, the model's own under "default".
+type PolicyChain struct {
+	policies []RoutingPolicy
+	pools    map[string]*BackendPool
+}
+
+// newRoutingPolicies builds configs into the order they are tried.
+func newRoutingPolicies(configs []RoutingPolicyConfig) ([]RoutingPolicy, error) {
+	order := make([]int, len(configs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return configs[order[a]].Priority > configs[order[b]].Priority })
+	policies := make([]RoutingPolicy, 0, len(configs))
+	for _, i := range order {
+		p, err := newRoutingPolicy(i, configs[i])
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+func newRoutingPolicy(i int, pc RoutingPolicyConfig) (RoutingPolicy, error) {
+	build, ok := routingPolicies[pc.Type]
+	if !ok {
+		return nil, fmt.Errorf("routing_policies[%d]: unknown policy type %q", i, pc.Type)
+	}
+	p, err := build(pc.Params)
+	if err != nil {
+		return nil, fmt.Errorf("routing_policies[%d] (%s): %w", i, pc.Type, err)
+	}
+	return p, nil
+}
+
+// Select returns the pool the first matching policy picks for r and its
+// name, or the default pool if none matches or r is nil.
+func (c *PolicyChain) Select(r *http.Request) (*BackendPool, string, error) {
+	if r == nil {
+		return c.pools[defaultPool], defaultPool, nil
+	}
+	for _, p := range c.policies {
+		pool, err := p.Select(r, c.pools)
+		if err != nil {
+			return nil, "", err
+		}
+		if pool != nil {
+			return pool, c.name(pool), nil
+		}
+	}
+	return c.pools[defaultPool], defaultPool, nil
+}
+
+func (c *PolicyChain) name(pool *BackendPool) string {
+	for name, p := range c.pools {
+		if p == pool {
+			return name
+		}
+	}
+	return ""
+}
+
+// Names returns the names of the chain's pools, the default first and the
+// rest in order, so the pools of successive tables line up.
+func (c *PolicyChain) Names() []string {
+	names := slices.DeleteFunc(sortedKeys(c.pools), func(n string) bool { return n == defaultPool })
+	return append([]string{defaultPool}, names...)
+}
+
+// Pools returns the chain's pools in the order of Names.
+func (c *PolicyChain) Pools() []*BackendPool {
+	names := c.Names()
+	pools := make([]*BackendPool, len(names))
+	for i, name := range names {
+		pools[i] = c.pools[name]
+	}
+	return pools
+}
+
+// poolNamer is a policy that can list the pools it routes to, for
+// validation to check they exist.
+type poolNamer interface {
+	poolNames() []string
+}
+
+func lookupPool(pools map[string]*BackendPool, name string) (*BackendPool, error) {
+	if p, ok := pools[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("routing policy: no pool %q", name)
+}
+
+// PayloadSizePolicy routes by the request's Content-Length: to the pool of
+// the first threshold the length is at most, a threshold without max_bytes
+// taking any length. Requests that send no Content-Length do not match.
+type PayloadSizePolicy struct {
+	Thresholds []SizeThreshold `json:"thresholds"`
+}
+
+type SizeThreshold struct {
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+	Pool     string `json:"pool"`
+}
+
+func newPayloadSizePolicy(params map[string]any) (RoutingPolicy, error) {
+	var p PayloadSizePolicy
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Thresholds) == 0 {
+		return nil, fmt.Errorf("at least one threshold is required")
+	}
+	for i, t := range p.Thresholds {
+		if t.MaxBytes < 0 {
+			return nil, fmt.Errorf("thresholds[%d]: max_bytes must not be negative", i)
+		}
+		if t.Pool == "" {
+			return nil, fmt.Errorf("thresholds[%d]: pool is required", i)
+		}
+		if i == 0 {
+			continue
+		}
+		if prev := p.Thresholds[i-1].MaxBytes; prev == 0 || (t.MaxBytes > 0 && t.MaxBytes <= prev) {
+			return nil, fmt.Errorf("thresholds[%d]: max_bytes must increase, and only the last threshold may omit it", i)
+		}
+	}
+	return &p, nil
+}
+
+func (p *PayloadSizePolicy) Select(r *http.Request, pools map[string]*BackendPool) (*BackendPool, error) {
+	if r.ContentLength < 0 {
+		return nil, nil
+	}
+	for _, t := range p.Thresholds {
+		if t.MaxBytes == 0 || r.ContentLength <= t.MaxBytes {
+			return lookupPool(pools, t.Pool)
+		}
+	}
+	return nil, nil
+}
+
+func (p *PayloadSizePolicy) poolNames() []string {
+	names := make([]string, len(p.Thresholds))
+	for i, t := range p.Thresholds {
+		names[i] = t.Pool
+	}
+	return names
+}
+
+// HeaderMatchPolicy routes to Pool the requests where every header named in
+// Headers has a value matching its regular expression. A request missing
+// one of the headers does not match.
+type HeaderMatchPolicy struct {
+	Headers map[string]*regexp.Regexp
+	Pool    string
+}
+
+func newHeaderMatchPolicy(params map[string]any) (RoutingPolicy, error) {
+	var cfg struct {
+		Headers map[string]string `json:"headers"`
+		Pool    string            `json:"pool"`
+	}
+	if err := decodeParams(params, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Headers) == 0 {
+		return nil, fmt.Errorf("at least one header is required")
+	}
+	if cfg.Pool == "" {
+		return nil, fmt.Errorf("pool is required")
+	}
+	p := &HeaderMatchPolicy{Headers: make(map[string]*regexp.Regexp, len(cfg.Headers)), Pool: cfg.Pool}
+	for name, expr := range cfg.Headers {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("headers.%s: %w", name, err)
+		}
+		p.Headers[http.CanonicalHeaderKey(name)] = re
+	}
+	return p, nil
+}
+
+func (p *HeaderMatchPolicy) Select(r *http.Request, pools map[string]*BackendPool) (*BackendPool, error) {
+	for name, re := range p.Headers {
+		if !slices.ContainsFunc(r.Header.Values(name), re.MatchString) {
+			return nil, nil
+		}
+	}
+	return lookupPool(pools, p.Pool)
+}
+
+func (p *HeaderMatchPolicy) poolNames() []string {
+	return []string{p.Pool}
+}
+
+// validateRoutingPolicies checks a model's pools and the policies routing
+// to them. A policy type the router does not know fails the config rather
+// than leaving its requests to the default pool.
+func validateRoutingPolicies(cfg *Config, bc BackendConfig) error {
+	if len(bc.RoutingPolicies) == 0 {
+		return fmt.Errorf("pools need routing_policies to route to them")
+	}
+	for _, name := range sortedKeys(bc.Pools) {
+		pc := bc.Pools[name]
+		if name == "" || name == defaultPool {
+			return fmt.Errorf("pools: %q is not a valid pool name", name)
+		}
+		if pc.TrafficSplit != nil || pc.BlueGreen != nil || pc.Canary != nil || len(pc.Pools) > 0 || len(pc.RoutingPolicies) > 0 {
+			return fmt.Errorf("pools.%s: a pool cannot have traffic_split, blue_green, canary, pools or routing_policies", name)
+		}
+		if err := validateBackend(cfg, pc); err != nil {
+			return fmt.Errorf("pools.%s: %w", name, err)
+		}
+	}
+	for i, pc := range bc.RoutingPolicies {
+		p, err := newRoutingPolicy(i, pc)
+		if err != nil {
+			return err
+		}
+		n, ok := p.(poolNamer)
+		if !ok {
+			continue
+		}
+		for _, name := range n.poolNames() {
+			if _, ok := bc.Pools[name]; !ok && name != defaultPool {
+				return fmt.Errorf("routing_policies[%d] (%s): unknown pool %q", i, pc.Type, name)
+			}
+		}
+	}
+	return nil
+}
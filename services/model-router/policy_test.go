@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+const policyConfig = `
+providers:
+  a: {base_url: "http://cpu.internal"}
+models:
+  m:
+    provider: a
+    pools:
+      gpu: {url: "http://gpu.internal"}
+      de: {url: "http://de.internal"}
+    routing_policies:
+      - type: header_match
+        priority: 10
+        params:
+          headers: {X-Aspendos-Feature: "(^|,)gpu(,|$)"}
+          pool: gpu
+      - type: header_match
+        priority: 5
+        params:
+          headers: {Accept-Language: "^de\\b"}
+          pool: de
+      - type: payload_size
+        params:
+          thresholds:
+            - {max_bytes: 1024, pool: default}
+            - {pool: gpu}
+`
+
+// Requests go to the pool of the highest priority policy they match, by
+// feature flag, language or size, and to the model's own backends when
+// none does.
+func TestRoutingPolicies(t *testing.T) {
+	rt := newTestRouter(t, testConfig(t, policyConfig))
+	chain := rt.registry.LookupAll("m")[0].Policies
+	if chain == nil {
+		t.Fatal("model m has no routing policies")
+	}
+	small, large := `{"model":"m"}`, `{"model":"m","pad":"`+strings.Repeat("x", 2048)+`"}`
+	tests := []struct {
+		name    string
+		body    string
+		header  map[string]string
+		chunked bool
+		want    string
+	}{
+		{name: "small payload", body: small, want: "default"},
+		{name: "large payload", body: large, want: "gpu"},
+		{name: "no content length", body: large, chunked: true, want: "default"},
+		{name: "feature flag", body: small, header: map[string]string{"X-Aspendos-Feature": "fast,gpu"}, want: "gpu"},
+		{name: "other feature flag", body: small, header: map[string]string{"X-Aspendos-Feature": "gpubeta"}, want: "default"},
+		{name: "language", body: small, header: map[string]string{"Accept-Language": "de-DE,de;q=0.9"}, want: "de"},
+		{name: "language before size", body: large, header: map[string]string{"Accept-Language": "de"}, want: "de"},
+		{name: "feature flag before language", body: small, header: map[string]string{"Accept-Language": "de", "X-Aspendos-Feature": "gpu"}, want: "gpu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, chatCompletionsPath, strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			pool, name, err := chain.Select(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want || pool != chain.pools[tt.want] {
+				t.Errorf("routed to pool %q, want %q", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRoutingPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies string
+		wantErr  string
+	}{
+		{name: "unknown type", policies: `[{type: language, params: {pool: gpu}}]`, wantErr: `unknown policy type "language"`},
+		{name: "unknown param", policies: `[{type: header_match, params: {headers: {X-A: a}, pool: gpu, fallback: default}}]`, wantErr: "fallback"},
+		{name: "bad regexp", policies: `[{type: header_match, params: {headers: {X-A: "("}, pool: gpu}}]`, wantErr: "headers.X-A"},
+		{name: "no headers", policies: `[{type: header_match, params: {pool: gpu}}]`, wantErr: "at least one header"},
+		{name: "undefined pool", policies: `[{type: header_match, params: {headers: {X-A: a}, pool: tpu}}]`, wantErr: "tpu"},
+		{name: "no thresholds", policies: `[{type: payload_size}]`, wantErr: "at least one threshold"},
+		{name: "thresholds out of order", policies: `[{type: payload_size, params: {thresholds: [{max_bytes: 10, pool: gpu}, {max_bytes: 5, pool: default}]}}]`, wantErr: "must increase"},
+		{name: "open threshold not last", policies: `[{type: payload_size, params: {thresholds: [{pool: gpu}, {max_bytes: 5, pool: default}]}}]`, wantErr: "must increase"},
+		{name: "valid", policies: `[{type: payload_size, params: {thresholds: [{max_bytes: 10, pool: default}, {pool: gpu}]}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig("test.yaml", []byte(fmt.Sprintf(`
+providers:
+  a: {base_url: "http://cpu.internal"}
+models:
+  m:
+    provider: a
+    pools:
+      gpu: {url: "http://gpu.internal"}
+    routing_policies: %s
+`, tt.policies)))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+var (
+	policyPools   = []string{defaultPool, "gpu", "cpu", "eu"}
+	policyHeaders = []string{"X-Aspendos-Feature", "Accept-Language", "X-Tier"}
+	policyValues  = []string{"gpu", "fast,gpu", "de", "en-US", "gold", "silver"}
+	policyExprs   = []string{"gpu", "^de", "^(gold|silver)$", "^en", "fast", "."}
+)
+
+func drawPolicyConfig(t *rapid.T, label string) RoutingPolicyConfig {
+	pool := func(label string) string { return rapid.SampledFrom(policyPools).Draw(t, label) }
+	pc := RoutingPolicyConfig{Priority: rapid.IntRange(0, 3).Draw(t, label+" priority")}
+	if rapid.Bool().Draw(t, label+" by size") {
+		pc.Type = "payload_size"
+		var thresholds []any
+		bound := 0
+		for i := range rapid.IntRange(1, 3).Draw(t, label+" thresholds") {
+			bound += rapid.IntRange(1, 4096).Draw(t, fmt.Sprintf("%s threshold %d", label, i))
+			thresholds = append(thresholds, map[string]any{"max_bytes": bound, "pool": pool(fmt.Sprintf("%s threshold %d pool", label, i))})
+		}
+		if rapid.Bool().Draw(t, label+" open threshold") {
+			thresholds = append(thresholds, map[string]any{"pool": pool(label + " open threshold pool")})
+		}
+		pc.Params = map[string]any{"thresholds": thresholds}
+		return pc
+	}
+	pc.Type = "header_match"
+	headers := map[string]any{}
+	for i := range rapid.IntRange(1, 2).Draw(t, label+" headers") {
+		name := rapid.SampledFrom(policyHeaders).Draw(t, fmt.Sprintf("%s header %d", label, i))
+		headers[name] = rapid.SampledFrom(policyExprs).Draw(t, fmt.Sprintf("%s header %d expr", label, i))
+	}
+	pc.Params = map[string]any{"headers": headers, "pool": pool(label + " pool")}
+	return pc
+}
+
+func drawPolicyRequest(t *rapid.T) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, chatCompletionsPath, nil)
+	r.ContentLength = int64(rapid.IntRange(-1, 16384).Draw(t, "content length"))
+	for _, name := range policyHeaders {
+		if rapid.Bool().Draw(t, name+" sent") {
+			r.Header.Set(name, rapid.SampledFrom(policyValues).Draw(t, name))
+		}
+	}
+	return r
+}
+
+func newTestPolicyChain(t *rapid.T, configs []RoutingPolicyConfig) *PolicyChain {
+	policies, err := newRoutingPolicies(configs)
+	if err != nil {
+		t.Fatalf("policies %+v: %v", configs, err)
+	}
+	c := &PolicyChain{policies: policies, pools: map[string]*BackendPool{}}
+	for _, name := range policyPools {
+		c.pools[name] = &BackendPool{}
+	}
+	return c
+}
+
+// referenceSelect is what the chain should pick, worked out from the
+// configs directly: the pool of the first policy matching r, in descending
+// priority and then config order.
+func referenceSelect(configs []RoutingPolicyConfig, r *http.Request) string {
+	order := make([]int, len(configs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return configs[order[a]].Priority > configs[order[b]].Priority })
+	for _, i := range order {
+		pc := configs[i]
+		switch pc.Type {
+		case "payload_size":
+			if r.ContentLength < 0 {
+				continue
+			}
+			for _, th := range pc.Params["thresholds"].([]any) {
+				th := th.(map[string]any)
+				if bound, ok := th["max_bytes"]; !ok || r.ContentLength <= int64(bound.(int)) {
+					return th["pool"].(string)
+				}
+			}
+		case "header_match":
+			matched := true
+			for name, expr := range pc.Params["headers"].(map[string]any) {
+				if v := r.Header.Get(name); v == "" || !regexp.MustCompile(expr.(string)).MatchString(v) {
+					matched = false
+				}
+			}
+			if matched {
+				return pc.Params["pool"].(string)
+			}
+		}
+	}
+	return defaultPool
+}
+
+// The policy chain is deterministic: for any policies and request, it
+// picks the same pool every time, a chain built again from the same
+// config agrees, and the pool is that of the first policy matching in
+// priority order.
+func TestPolicyChainDeterministic(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		var configs []RoutingPolicyConfig
+		for i := range rapid.IntRange(0, 5).Draw(t, "policies") {
+			configs = append(configs, drawPolicyConfig(t, fmt.Sprintf("policy %d", i)))
+		}
+		r := drawPolicyRequest(t)
+
+		chain := newTestPolicyChain(t, configs)
+		_, first, err := chain.Select(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 10 {
+			if _, again, _ := chain.Select(r); again != first {
+				t.Fatalf("selected %q, then %q", first, again)
+			}
+		}
+		if _, rebuilt, _ := newTestPolicyChain(t, configs).Select(r); rebuilt != first {
+			t.Fatalf("selected %q, and %q from a chain built again", first, rebuilt)
+		}
+		if want := referenceSelect(configs, r); first != want {
+			t.Fatalf("selected %q, want %q", first, want)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is one replica serving a model.
+type Backend struct {
+	Provider *Provider
+	Weight   int
+	Breaker  *CircuitBreaker
+	// Health is the backend's own health probes, if its model has them, or
+	// else its provider's active health check, if it has one.
+	Health *ProviderHealth
+	// Limiter caps the provider's concurrent requests, if it has a limit.
+	Limiter *ConcurrencyLimiter
+	// RateLimit is what the provider last reported about its rate limit.
+	RateLimit *UpstreamRateLimit
+	// Warmup is the backend's warm-up state when its model has a
+	// warmup_payload.
+	Warmup *WarmUpState
+
+	// pool is the pool the backend belongs to. effective, its weight in
+	// hundredths for the pool's next pick as slow start has it, and
+	// ejected, whether outlier detection has taken it out of rotation,
+	// are guarded by the pool's lock.
+	pool      *BackendPool
+	effective int
+	ejected   bool
+	current   int
+	latency   latencyEWMA
+}
+
+func (b *Backend) Name() string {
+	return b.Provider.Name
+}
+
+// Latency is the moving average of recent upstream response times, or 0
+// before the first response.
+func (b *Backend) Latency() time.Duration {
+	return b.latency.value()
+}
+
+// ObserveLatency feeds one upstream response time into Latency.
+func (b *Backend) ObserveLatency(d time.Duration) {
+	b.latency.observe(d)
+}
+
+// ObserveOutcome feeds one upstream attempt, how long it took to get
+// response headers or fail and whether it failed, to its pool's outlier
+// detection, if it has any.
+func (b *Backend) ObserveOutcome(latency time.Duration, failed bool) {
+	p := b.pool
+	if p == nil || p.balance == nil || p.balance.outliers == nil {
+		return
+	}
+	p.mu.Lock()
+	p.balance.observe(p.backends, b, latency, failed)
+	p.mu.Unlock()
+}
+
+// BackendPool spreads requests across replicas with its Strategy, by
+// default smooth weighted round-robin, which interleaves picks instead of
+// sending bursts to the heaviest replica. Replicas with weight 0 stay in
+// the pool, so the admin API can bring them back, but never receive
+// traffic. With affinity, requests naming a session bypass the strategy
+// and go to the session's replica. With a region group, only the replicas
+// of the region currently serving are considered. With slow start, a
+// replica that joins or comes back gets a growing share of its weight,
+// and with outlier detection a replica answering too slowly or with too
+// many errors is ejected for a while; see balancer.
+type BackendPool struct {
+	mu       sync.Mutex
+	backends []*Backend
+	strategy Strategy
+	affinity *sessionAffinity
+	regions  *regionGroup
+	balance  *balancer
+}
+
+// NewBackendPool builds a pool choosing with strategy; nil means
+// WeightedStrategy.
+func NewBackendPool(backends []*Backend, strategy Strategy) *BackendPool {
+	if strategy == nil {
+		strategy = WeightedStrategy{}
+	}
+	p := &BackendPool{backends: backends, strategy: strategy}
+	for _, b := range backends {
+		b.pool = p
+		b.effective = b.Weight * 100
+	}
+	return p
+}
+
+// now is the time by the pool's clock.
+func (p *BackendPool) now() time.Time {
+	if p.balance != nil {
+		return p.balance.now()
+	}
+	return time.Now()
+}
+
+// Next returns the replica for the next request and why it was chosen, or
+// nil if no replica can take it: either none has a positive weight or
+// every one is unhealthy. Replicas with an open breaker, whose provider
+// fails its health check or is at its rate limit, that are still warming
+// up or that are ejected as outliers are skipped, and
+// replicas whose warm-up timed out are only used when nothing else is
+// left. With a region group, what remains is narrowed to one region.
+// Among that, a session goes to its replica when the pool has affinity.
+func (p *BackendPool) Next(hint RouteHint) (*Backend, Decision) {
+	return p.next(hint, nil)
+}
+
+// next is Next. With ex it only explains the choice: each replica and why
+// it was or was not a candidate goes into ex, and the pool is left as it
+// was, so the next request is routed as if nothing had been asked.
+func (p *BackendPool) next(hint RouteHint, ex *PoolExplanation) (*Backend, Decision) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	candidates := make([]*Backend, 0, len(p.backends))
+	degraded := 0
+	for _, b := range p.backends {
+		if b.Weight > 0 && !b.Health.Down() && !b.RateLimit.Limited() && !b.Warmup.Warming() && (b.Breaker == nil || b.Breaker.Ready()) && p.balance.available(b, now) {
+			candidates = append(candidates, b)
+			if b.Warmup.Degraded() {
+				degraded++
+			}
+		}
+	}
+	if degraded > 0 && degraded < len(candidates) {
+		candidates = slices.DeleteFunc(candidates, func(b *Backend) bool { return b.Warmup.Degraded() })
+	}
+
+	backends, failover := p.backends, false
+	if p.regions != nil {
+		backends, candidates, failover = p.regions.route(backends, candidates, ex != nil)
+	}
+	p.balance.weigh(backends, candidates, now, ex != nil)
+	if ex != nil {
+		ex.record(p, backends, candidates, failover)
+	}
+
+	if len(candidates) == 0 {
+		return nil, Decision{}
+	}
+	if ex != nil {
+		// Strategies keep their state, such as round-robin counters, on
+		// the backends.
+		saved := make([]int, len(p.backends))
+		for i, b := range p.backends {
+			saved[i] = b.current
+		}
+		defer func() {
+			for i, b := range p.backends {
+				b.current = saved[i]
+			}
+		}()
+	}
+	var best *Backend
+	var decision Decision
+	if p.affinity != nil && hint.Session != "" {
+		best, decision = p.affinity.Pick(hint.Session, backends, candidates, ex != nil)
+	} else {
+		best, decision = p.strategy.Pick(candidates, hint)
+	}
+	if failover {
+		decision.Reason = strings.TrimPrefix(decision.Reason+"; failover region", "; ")
+	}
+	if best.Breaker != nil && ex == nil {
+		best.Breaker.Acquire()
+	}
+	return best, decision
+}
+
+// pickWeighted runs one round of smooth weighted round-robin over backends,
+// by their effective weights.
+func pickWeighted(backends []*Backend) *Backend {
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		b.current += b.effective
+		total += b.effective
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// Backends returns the pool members in configuration order.
+func (p *BackendPool) Backends() []*Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Backend(nil), p.backends...)
+}
+
+// Serving reports whether any replica has a positive weight.
+func (p *BackendPool) Serving() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Weights snapshots each replica's current weight by name.
+func (p *BackendPool) Weights() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]int, len(p.backends))
+	for _, b := range p.backends {
+		out[b.Name()] = b.Weight
+	}
+	return out
+}
+
+// SetWeight changes a replica's weight for subsequent picks. It reports
+// false if the pool has no replica with that name.
+func (p *BackendPool) SetWeight(name string, weight int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		if b.Name() == name {
+			b.Weight = weight
+			b.current = 0
+			return true
+		}
+	}
+	return false
+}
+
+// Remove drops a replica from the pool. Requests already sent to it finish
+// normally. It reports false if no replica has that name.
+func (p *BackendPool) Remove(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, b := range p.backends {
+		if b.Name() == name {
+			p.backends = append(p.backends[:i:i], p.backends[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
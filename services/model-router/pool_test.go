@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func testBackends(weights map[string]int, order ...string) []*Backend {
+	backends := make([]*Backend, len(order))
+	for i, name := range order {
+		backends[i] = &Backend{Provider: &Provider{Name: name}, Weight: weights[name]}
+	}
+	return backends
+}
+
+func pickCounts(p *BackendPool, rounds int) map[string]int {
+	counts := make(map[string]int)
+	for range rounds {
+		b, _ := p.Next(RouteHint{})
+		if b == nil {
+			counts[""]++
+			continue
+		}
+		counts[b.Name()]++
+	}
+	return counts
+}
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		order   []string
+		remove  string
+		rounds  int
+		want    map[string]int
+	}{
+		{
+			name:    "equal weights",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			order:   []string{"a", "b", "c"},
+			rounds:  30,
+			want:    map[string]int{"a": 10, "b": 10, "c": 10},
+		},
+		{
+			name:    "uneven weights",
+			weights: map[string]int{"a": 5, "b": 3, "c": 2},
+			order:   []string{"a", "b", "c"},
+			rounds:  100,
+			want:    map[string]int{"a": 50, "b": 30, "c": 20},
+		},
+		{
+			name:    "weight zero gets nothing",
+			weights: map[string]int{"a": 3, "b": 0, "c": 1},
+			order:   []string{"a", "b", "c"},
+			rounds:  40,
+			want:    map[string]int{"a": 30, "c": 10},
+		},
+		{
+			name:    "removed backend gets nothing",
+			weights: map[string]int{"a": 2, "b": 5, "c": 2},
+			order:   []string{"a", "b", "c"},
+			remove:  "b",
+			rounds:  40,
+			want:    map[string]int{"a": 20, "c": 20},
+		},
+		{
+			name:    "all weights zero",
+			weights: map[string]int{"a": 0, "b": 0},
+			order:   []string{"a", "b"},
+			rounds:  5,
+			want:    map[string]int{"": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewBackendPool(testBackends(tt.weights, tt.order...), nil)
+			if tt.remove != "" && !p.Remove(tt.remove) {
+				t.Fatalf("Remove(%q) = false", tt.remove)
+			}
+			got := pickCounts(p, tt.rounds)
+			if len(got) != len(tt.want) {
+				t.Fatalf("picks = %v, want %v", got, tt.want)
+			}
+			for name, n := range tt.want {
+				if got[name] != n {
+					t.Errorf("picks = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+// Smooth weighted round-robin interleaves picks rather than sending a
+// heavy replica's whole share in a burst.
+func TestWeightedRoundRobinInterleaves(t *testing.T) {
+	p := NewBackendPool(testBackends(map[string]int{"a": 5, "b": 1, "c": 1}, "a", "b", "c"), nil)
+	var seq string
+	for range 7 {
+		b, _ := p.Next(RouteHint{})
+		seq += b.Name()
+	}
+	if want := "aabacaa"; seq != want {
+		t.Errorf("pick order = %s, want %s", seq, want)
+	}
+}
+
+func TestSetWeightChangesDistribution(t *testing.T) {
+	p := NewBackendPool(testBackends(map[string]int{"a": 1, "b": 1}, "a", "b"), nil)
+	pickCounts(p, 3)
+	if !p.SetWeight("b", 0) {
+		t.Fatal("SetWeight(b) = false")
+	}
+	if got := pickCounts(p, 10); got["a"] != 10 {
+		t.Errorf("picks after weight 0 = %v, want all to a", got)
+	}
+	if p.SetWeight("missing", 1) {
+		t.Error("SetWeight(missing) = true")
+	}
+}
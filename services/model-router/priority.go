@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// PriorityClassHeader asks for a request's priority class, high, normal or
+// low, in the queues for providers' concurrency slots. It is unrelated to
+// PriorityHeader, whose queue a request leaves before it waits for a slot;
+// see PriorityQueueConfig.
+const PriorityClassHeader = "X-Aspendos-Priority"
+
+// priorityClass orders requests waiting for a provider's concurrency slot,
+// so batch and eval traffic yields to interactive requests.
+type priorityClass int
+
+const (
+	priorityLow priorityClass = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityClasses = map[string]priorityClass{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+func (p priorityClass) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// validPriorityClass reports whether s names a priority class; "" stands
+// for none given.
+func validPriorityClass(s string) bool {
+	_, ok := priorityClasses[s]
+	return ok || s == ""
+}
+
+type priorityClassKey struct{}
+
+func withPriorityClass(ctx context.Context, p priorityClass) context.Context {
+	return context.WithValue(ctx, priorityClassKey{}, p)
+}
+
+// priorityClassFrom returns the request's priority class, normal unless
+// Priorities resolved another.
+func priorityClassFrom(ctx context.Context) priorityClass {
+	if p, ok := ctx.Value(priorityClassKey{}).(priorityClass); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// Priorities resolves each request's priority class: X-Aspendos-Priority
+// when sent, otherwise its API key's priority, otherwise normal, and never
+// above the key's max_priority. Requests with an unknown class are
+// rejected with 400. Without API keys the header is taken as sent, so
+// clients that must not set it should have it stripped in front of the
+// router.
+func (rt *Router) Priorities(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyPriority, keyMax := middleware.RequestInfoFrom(r.Context()).KeyPriority()
+		name := keyPriority
+		if v := r.Header.Get(PriorityClassHeader); v != "" {
+			name = v
+		}
+		p, ok := priorityClasses[name]
+		switch {
+		case name == "":
+			p = priorityNormal
+		case !ok:
+			writeError(w, http.StatusBadRequest, "invalid_priority", PriorityClassHeader+" must be high, normal or low")
+			return
+		}
+		if ceiling, ok := priorityClasses[keyMax]; ok && p > ceiling {
+			p = ceiling
+		}
+		next.ServeHTTP(w, r.WithContext(withPriorityClass(r.Context(), p)))
+	})
+}
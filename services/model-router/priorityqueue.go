@@ -0,0 +1,298 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	// PriorityHeader sets a request's place in the priority queue, from 1
+	// (lowest) to 10 (highest).
+	PriorityHeader = "X-Request-Priority"
+
+	defaultPriority       = 5
+	minPriority           = 1
+	maxPriority           = 10
+	defaultMaxQueueDepth  = 1000
+	defaultWorkerPoolSize = 64
+)
+
+// PriorityQueueConfig puts routed requests through a fixed pool of
+// workers (WORKER_POOL_SIZE, default 64), queueing the rest by
+// X-Request-Priority and then arrival. At most MaxQueueDepth (default
+// 1000) wait; past that a request displaces the lowest-priority one
+// queued, if it outranks it, or is turned away with 503. The header is
+// taken as sent, so clients that must not set it should have it stripped
+// in front of the router. Changes take effect on restart, not reload.
+//
+// X-Aspendos-Priority is a second, separate ordering, of requests waiting
+// for a provider's concurrency slot. The two apply one after the other:
+// this queue decides which requests get a worker, and the provider's
+// which of those get its slot. A request waiting for a slot keeps its
+// worker, so the provider only ever orders as many requests as there are
+// workers, and one with a high class but a low X-Request-Priority waits
+// behind higher priorities for a worker all the same.
+type PriorityQueueConfig struct {
+	MaxQueueDepth int `json:"max_queue_depth,omitempty"`
+}
+
+func (c PriorityQueueConfig) maxDepth() int {
+	if c.MaxQueueDepth > 0 {
+		return c.MaxQueueDepth
+	}
+	return defaultMaxQueueDepth
+}
+
+// queuedRequest is a request waiting for, or being served by, a worker.
+type queuedRequest struct {
+	next     http.Handler
+	w        http.ResponseWriter
+	r        *http.Request
+	priority int
+	seq      uint64
+	enqueued time.Time
+	// index is the request's place in the heap, or -1 once it has left.
+	index int
+	// rejected is set when the request was displaced or the queue closed
+	// before a worker took it.
+	rejected bool
+	// aborted is set when the handler panicked with http.ErrAbortHandler,
+	// for the request's goroutine to panic with it again so the server
+	// cuts the response off.
+	aborted bool
+	done    chan struct{}
+}
+
+// requestHeap orders requests by priority, highest first, then by arrival.
+type requestHeap []*queuedRequest
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *requestHeap) Push(x any) {
+	q := x.(*queuedRequest)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *requestHeap) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	q.index = -1
+	return q
+}
+
+// lowest returns the request that would be served last.
+func (h requestHeap) lowest() *queuedRequest {
+	var low *queuedRequest
+	for _, q := range h {
+		if low == nil || q.priority < low.priority || (q.priority == low.priority && q.seq > low.seq) {
+			low = q
+		}
+	}
+	return low
+}
+
+// PriorityQueue hands requests to its workers highest priority first. A
+// worker stays with its request until the response ends, streams
+// included. While the server drains, the workers keep going, so queued
+// requests are still served in priority order; Close turns away whatever
+// is left once draining is over.
+type PriorityQueue struct {
+	maxDepth int
+	timeout  time.Duration
+	metrics  *metrics.Metrics
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending requestHeap
+	seq     uint64
+	closed  bool
+}
+
+// NewPriorityQueue starts workers goroutines serving the queue. Requests
+// still queued once their budget, the client's or timeout, has run out
+// are answered with 504.
+func NewPriorityQueue(cfg PriorityQueueConfig, workers int, timeout time.Duration, m *metrics.Metrics, logger *slog.Logger) *PriorityQueue {
+	pq := &PriorityQueue{maxDepth: cfg.maxDepth(), timeout: timeout, metrics: m, logger: logger}
+	pq.cond = sync.NewCond(&pq.mu)
+	for range workers {
+		go pq.work()
+	}
+	return pq
+}
+
+func (pq *PriorityQueue) work() {
+	for {
+		pq.mu.Lock()
+		for len(pq.pending) == 0 && !pq.closed {
+			pq.cond.Wait()
+		}
+		if len(pq.pending) == 0 {
+			pq.mu.Unlock()
+			return
+		}
+		q := heap.Pop(&pq.pending).(*queuedRequest)
+		pq.metrics.RouterQueueDepth(len(pq.pending))
+		pq.mu.Unlock()
+
+		pq.metrics.RouterQueueWait(q.priority, "served", time.Since(q.enqueued))
+		pq.serve(q)
+	}
+}
+
+// serve runs q's handler and then lets its request go. The handler runs on
+// the worker's goroutine, out of reach of the Recover middleware, so a
+// panic is recovered here the same way: logged with its stack and answered
+// with 500 if the response had not started. Left alone it would take the
+// router down.
+func (pq *PriorityQueue) serve(q *queuedRequest) {
+	rw := middleware.WrapResponseWriter(q.w)
+	defer func() {
+		if p := recover(); p != nil {
+			if p == http.ErrAbortHandler {
+				q.aborted = true
+			} else {
+				middleware.LoggerFrom(q.r.Context(), pq.logger).Error("handler panicked",
+					slog.String("path", q.r.URL.Path), slog.String("panic", fmt.Sprint(p)), slog.String("stack", string(debug.Stack())))
+				if rw.Status == 0 {
+					writeError(rw, http.StatusInternalServerError, apierror.CodeInternal, "internal error")
+				}
+			}
+		}
+		close(q.done)
+	}()
+	q.next.ServeHTTP(rw, q.r)
+}
+
+// Middleware queues each request for a worker. Requests with an invalid
+// X-Request-Priority are rejected with 400; those without one get
+// priority 5.
+func (pq *PriorityQueue) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := defaultPriority
+		if v := r.Header.Get(PriorityHeader); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil || p < minPriority || p > maxPriority {
+				writeError(w, http.StatusBadRequest, "invalid_priority", PriorityHeader+" must be an integer from 1 to 10")
+				return
+			}
+			priority = p
+		}
+		q := &queuedRequest{next: next, w: w, r: r, priority: priority, enqueued: time.Now(), done: make(chan struct{})}
+		if !pq.push(q) {
+			pq.metrics.RouterQueueWait(priority, "rejected", 0)
+			writeQueueFull(w)
+			return
+		}
+
+		expired := time.NewTimer(time.Until(budgetFrom(r.Context()).deadline(pq.timeout)))
+		defer expired.Stop()
+		select {
+		case <-q.done:
+		case <-r.Context().Done():
+			if pq.remove(q) {
+				pq.metrics.RouterQueueWait(priority, "canceled", time.Since(q.enqueued))
+				return
+			}
+			// A worker has it, and may still be writing the response.
+			<-q.done
+		case <-expired.C:
+			if pq.remove(q) {
+				pq.metrics.RouterQueueWait(priority, "expired", time.Since(q.enqueued))
+				writeDeadlineError(w, peekModel(r), phaseQueueing)
+				return
+			}
+			<-q.done
+		}
+		if q.aborted {
+			panic(http.ErrAbortHandler)
+		}
+		if q.rejected {
+			pq.metrics.RouterQueueWait(priority, "rejected", time.Since(q.enqueued))
+			writeQueueFull(w)
+		}
+	})
+}
+
+// remove takes q out of the queue, reporting false if a worker already
+// has it.
+func (pq *PriorityQueue) remove(q *queuedRequest) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if q.index < 0 {
+		return false
+	}
+	heap.Remove(&pq.pending, q.index)
+	pq.metrics.RouterQueueDepth(len(pq.pending))
+	return true
+}
+
+// push queues q, displacing the lowest-priority request if the queue is
+// full and q outranks it. It reports false if q was not queued.
+func (pq *PriorityQueue) push(q *queuedRequest) bool {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.closed {
+		return false
+	}
+	if len(pq.pending) >= pq.maxDepth {
+		low := pq.pending.lowest()
+		if low == nil || low.priority >= q.priority {
+			return false
+		}
+		heap.Remove(&pq.pending, low.index)
+		low.rejected = true
+		close(low.done)
+	}
+	pq.seq++
+	q.seq = pq.seq
+	heap.Push(&pq.pending, q)
+	pq.metrics.RouterQueueDepth(len(pq.pending))
+	pq.cond.Signal()
+	return true
+}
+
+// Close turns away every request still queued, and any that arrive later,
+// and lets the workers exit once they finish what they are serving.
+func (pq *PriorityQueue) Close() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.closed = true
+	for len(pq.pending) > 0 {
+		q := heap.Pop(&pq.pending).(*queuedRequest)
+		q.rejected = true
+		close(q.done)
+	}
+	pq.metrics.RouterQueueDepth(0)
+	pq.cond.Broadcast()
+}
+
+func writeQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusServiceUnavailable, "queue_full", "the router is at capacity; retry shortly")
+}
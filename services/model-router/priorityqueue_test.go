@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// queueDepth is how many requests pq has waiting.
+func queueDepth(pq *PriorityQueue) int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	return len(pq.pending)
+}
+
+// sendQueued serves a request with X-Request-Priority priority, and
+// X-Seq seq, through handler on its own goroutine, and answers with its
+// recorder once done.
+func sendQueued(handler http.Handler, priority int, seq string) <-chan *httptest.ResponseRecorder {
+	out := make(chan *httptest.ResponseRecorder, 1)
+	req := httptest.NewRequest(http.MethodPost, chatCompletionsPath, nil)
+	req.Header.Set(PriorityHeader, strconv.Itoa(priority))
+	req.Header.Set("X-Seq", seq)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		out <- rec
+	}()
+	return out
+}
+
+// With its one worker busy and the queue full, requests are served highest
+// priority first and then in arrival order, and each newcomer that
+// outranks the lowest waiting request displaces it, while the rest are
+// turned away.
+func TestPriorityQueueSaturated(t *testing.T) {
+	pq := NewPriorityQueue(PriorityQueueConfig{MaxQueueDepth: 4}, 1, time.Minute, nil, testLogger())
+	defer pq.Close()
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var served []string
+	handler := pq.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.Header.Get(PriorityHeader)
+		if p == "10" {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		served = append(served, p+":"+r.Header.Get("X-Seq"))
+		mu.Unlock()
+	}))
+
+	busy := sendQueued(handler, 10, "")
+	<-started
+	// Sent one by one so their arrival order is known.
+	var replies []<-chan *httptest.ResponseRecorder
+	send := func(seq, priority int) {
+		replies = append(replies, sendQueued(handler, priority, strconv.Itoa(seq)))
+	}
+	priorities := []int{3, 7, 3, 5, 1, 7}
+	for seq, p := range priorities[:4] {
+		send(seq, p)
+		waitFor(t, fmt.Sprintf("request %d to queue", seq), func() bool { return queueDepth(pq) == seq+1 })
+	}
+	// The queue is full: a 1 is turned away, and a 7 displaces the latest 3.
+	send(4, 1)
+	if rec := <-replies[4]; rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("request below every queued one = %d, want 503 with Retry-After", rec.Code)
+	}
+	send(5, 7)
+	if rec := <-replies[2]; rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("displaced request = %d, want 503", rec.Code)
+	}
+
+	close(release)
+	<-busy
+	for _, i := range []int{0, 1, 3, 5} {
+		if rec := <-replies[i]; rec.Code != http.StatusOK {
+			t.Errorf("request %d = %d, want 200", i, rec.Code)
+		}
+	}
+	if got, want := fmt.Sprint(served), "[10: 7:1 7:5 5:3 3:0]"; got != want {
+		t.Errorf("served %s, want %s", got, want)
+	}
+}
+
+// A handler panicking on a worker is answered with 500 instead of taking
+// the router down, and the worker goes on to serve the next request.
+func TestPriorityQueueRecoversPanic(t *testing.T) {
+	pq := NewPriorityQueue(PriorityQueueConfig{}, 1, time.Minute, nil, testLogger())
+	defer pq.Close()
+	handler := pq.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(PriorityHeader) {
+		case "1":
+			panic("boom")
+		case "2":
+			w.WriteHeader(http.StatusAccepted)
+			panic("after the header")
+		}
+	}))
+
+	tests := []struct {
+		priority int
+		want     int
+	}{
+		{priority: 1, want: http.StatusInternalServerError},
+		{priority: 2, want: http.StatusAccepted},
+		{priority: 5, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		select {
+		case rec := <-sendQueued(handler, tt.priority, ""):
+			if rec.Code != tt.want {
+				t.Errorf("priority %d = %d, want %d: %s", tt.priority, rec.Code, tt.want, rec.Body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("priority %d was never answered", tt.priority)
+		}
+	}
+}
+
+// http.ErrAbortHandler reaches the request's goroutine, for the server to
+// cut the response off.
+func TestPriorityQueueAbortHandler(t *testing.T) {
+	pq := NewPriorityQueue(PriorityQueueConfig{}, 1, time.Minute, nil, testLogger())
+	defer pq.Close()
+	handler := pq.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, chatCompletionsPath, nil))
+}
+
+// With both schemes in play, X-Request-Priority decides which requests
+// get a worker and X-Aspendos-Priority which of those get the provider's
+// slot. A request waiting on the slot keeps its worker, so a high class
+// with a low X-Request-Priority waits behind a normal one with a high
+// priority for a worker, and then ahead of a low class for the slot.
+func TestPriorityQueueWithPriorityClasses(t *testing.T) {
+	arrivals, proceed := make(chan string), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		arrivals <- req.Messages[0].Content
+		<-proceed
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer backend.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  vllm:
+    base_url: %s
+    concurrency: {max_concurrent: 1, max_queue: 8, queue_timeout: 1m, aging_interval: 1h}
+models:
+  m: vllm
+`, backend.URL)))
+	limiter := rt.registry.LookupAll("m")[0].Pool.Backends()[0].Limiter
+	pq := NewPriorityQueue(PriorityQueueConfig{}, 3, time.Minute, nil, testLogger())
+	defer pq.Close()
+	handler := middleware.Chain(http.HandlerFunc(rt.handleRoute), rt.Priorities, pq.Middleware)
+
+	var replies []<-chan *httptest.ResponseRecorder
+	send := func(name, class string, priority int) {
+		req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"` + name + `"}]}`)
+		req.Header.Set(PriorityClassHeader, class)
+		req.Header.Set(PriorityHeader, strconv.Itoa(priority))
+		out := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			out <- rec
+		}()
+		replies = append(replies, out)
+	}
+	next := func(want string) {
+		t.Helper()
+		if got := <-arrivals; got != want {
+			t.Fatalf("backend got %s, want %s", got, want)
+		}
+	}
+
+	send("busy", "normal", 5)
+	next("busy")
+	// Two more take the other workers and queue for the slot.
+	send("low-10", "low", 10)
+	waitFor(t, "low-10 to wait for the slot", func() bool { return queueLen(limiter) == 1 })
+	send("high-1", "high", 1)
+	waitFor(t, "high-1 to wait for the slot", func() bool { return queueLen(limiter) == 2 })
+	// The rest wait for a worker.
+	send("high-1b", "high", 1)
+	waitFor(t, "high-1b to wait for a worker", func() bool { return queueDepth(pq) == 1 })
+	send("normal-9", "normal", 9)
+	waitFor(t, "normal-9 to wait for a worker", func() bool { return queueDepth(pq) == 2 })
+
+	// Each finished request frees the slot, for the highest class waiting
+	// on it, and then its worker, for the highest X-Request-Priority.
+	proceed <- struct{}{}
+	next("high-1")
+	waitFor(t, "normal-9 to take the worker", func() bool { return queueDepth(pq) == 1 && queueLen(limiter) == 2 })
+	proceed <- struct{}{}
+	next("normal-9")
+	waitFor(t, "high-1b to take the worker", func() bool { return queueDepth(pq) == 0 && queueLen(limiter) == 2 })
+	proceed <- struct{}{}
+	next("high-1b")
+	proceed <- struct{}{}
+	next("low-10")
+	proceed <- struct{}{}
+	for _, reply := range replies {
+		if rec := <-reply; rec.Code != http.StatusOK {
+			t.Errorf("status = %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
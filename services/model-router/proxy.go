@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const defaultUpstreamTimeout = 60 * time.Second
+
+var errUpstreamTimeout = errors.New("upstream timeout")
+
+// errRequestTimeout is the cancellation cause once a request's overall
+// deadline (timeout_seconds, or the client's budget) passes.
+var errRequestTimeout = errors.New("request deadline exceeded")
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	// TimeoutHeader is the client's budget for the request in
+	// milliseconds. Request-Timeout, in seconds, is honoured too.
+	TimeoutHeader = "X-Request-Timeout-Ms"
+	// deadlineMargin is held back from every budget so an answer arriving
+	// at the last moment can still be written to the client.
+	deadlineMargin = 100 * time.Millisecond
+)
+
+// Phases of a request that can run out of time, as reported in 504s.
+const (
+	phaseQueueing  = "queueing"
+	phaseUpstream  = "upstream"
+	phaseStreaming = "streaming"
+)
+
+// deadlineError is a request that ran out of time while in phase.
+type deadlineError struct {
+	phase string
+}
+
+func (e *deadlineError) Error() string { return "request deadline exceeded while " + e.phase }
+func (e *deadlineError) Unwrap() error { return errRequestTimeout }
+
+// deadlinePhase returns the phase err ran out of time in, if it did.
+func deadlinePhase(err error) (string, bool) {
+	var de *deadlineError
+	if errors.As(err, &de) {
+		return de.phase, true
+	}
+	return "", false
+}
+
+type budgetKey struct{}
+
+// requestBudget is when a request reached the router and the budget its
+// client gave it, 0 if none.
+type requestBudget struct {
+	start  time.Time
+	client time.Duration
+}
+
+// clientTimeout reads the lower of X-Request-Timeout-Ms and
+// Request-Timeout, or 0 if the client sent neither.
+func clientTimeout(h http.Header) time.Duration {
+	var timeout time.Duration
+	if ms, err := strconv.ParseFloat(h.Get(TimeoutHeader), 64); err == nil && ms > 0 {
+		timeout = time.Duration(ms * float64(time.Millisecond))
+	}
+	if secs, err := strconv.ParseFloat(h.Get("Request-Timeout"), 64); err == nil && secs > 0 {
+		if d := time.Duration(secs * float64(time.Second)); timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// Budget starts the request's time budget as it reaches the router, so
+// time spent in the priority queue and other middleware counts against it.
+func (rt *Router) Budget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := requestBudget{start: time.Now(), client: clientTimeout(r.Header)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), budgetKey{}, b)))
+	})
+}
+
+// budgetFrom returns the request's budget, started now if Budget did not
+// run.
+func budgetFrom(ctx context.Context) requestBudget {
+	if b, ok := ctx.Value(budgetKey{}).(requestBudget); ok {
+		return b
+	}
+	return requestBudget{start: time.Now()}
+}
+
+// deadline is when a request whose timeout would otherwise be fallback
+// must be answered: the client's budget when that is lower, less
+// deadlineMargin.
+func (b requestBudget) deadline(fallback time.Duration) time.Time {
+	timeout := fallback
+	if b.client > 0 {
+		timeout = min(timeout, b.client)
+	}
+	return b.start.Add(max(timeout-deadlineMargin, timeout/2))
+}
+
+// requestTimeout is what is left of the request's budget: the model's
+// timeout_seconds, else REQUEST_TIMEOUT (default 30s), shortened to the
+// client's budget when that is lower, counted from when the request
+// arrived. It is negative if the budget is already spent.
+func (rt *Router) requestTimeout(ctx context.Context, bc BackendConfig) time.Duration {
+	timeout := rt.defaultTimeout
+	if bc.TimeoutSeconds > 0 {
+		timeout = time.Duration(bc.TimeoutSeconds * float64(time.Second))
+	}
+	return time.Until(budgetFrom(ctx).deadline(timeout))
+}
+
+type deadlineKey struct{}
+
+// withRequestDeadline derives the context every upstream call of a request
+// runs under. For plain requests it is a context.WithTimeout covering the
+// whole exchange. A streamed response may legitimately outlive any
+// deadline, so for streams the returned stop func, called once the first
+// bytes of the stream have arrived, lifts the deadline; the caller must
+// always call it.
+func withRequestDeadline(parent context.Context, timeout time.Duration, stream bool) (context.Context, func()) {
+	if !stream {
+		ctx, cancel := context.WithTimeoutCause(parent, timeout, errRequestTimeout)
+		return ctx, cancel
+	}
+	// ctx is released along with parent (the request context) once the
+	// handler returns, so stopping the timer is all the cleanup needed.
+	ctx, cancel := context.WithCancelCause(parent)
+	ctx = context.WithValue(ctx, deadlineKey{}, time.Now().Add(timeout))
+	timer := time.AfterFunc(timeout, func() { cancel(errRequestTimeout) })
+	return ctx, func() { timer.Stop() }
+}
+
+// requestDeadline is when ctx's request deadline passes, for streams too.
+func requestDeadline(ctx context.Context) (time.Time, bool) {
+	if d, ok := ctx.Value(deadlineKey{}).(time.Time); ok {
+		return d, true
+	}
+	return ctx.Deadline()
+}
+
+// cancelOnClose releases an attempt's context once the caller is done with
+// the response body, which may be long after headers arrived for streams.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// gunzipResponse undoes a gzip Content-Encoding on resp, so everything
+// past the attempt, transforms and caches included, sees the body as sent.
+// Upstream requests leave Accept-Encoding to the transport, which asks for
+// gzip and decodes it itself; this covers backends that compress unasked.
+func gunzipResponse(resp *http.Response) {
+	if resp.Uncompressed {
+		return
+	}
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+	default:
+		return
+	}
+	resp.Body = &gunzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// gunzipBody decodes a gzip body. The gzip header is read on the first
+// Read, so a bad one fails reading the body rather than the attempt.
+type gunzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (g *gunzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = gzip.NewReader(g.body)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gunzipBody) Close() error {
+	return g.body.Close()
+}
+
+// forward sends body to provider, retrying per the provider's RetryPolicy.
+// Refused connections are always retried; retryable statuses only when the
+// request is idempotent or was rate limited. The provider timeout bounds
+// each attempt up to the response headers only, so long streamed
+// generations are not cut off. The returned response has not been read;
+// the caller must close its body.
+func (rt *Router) forward(ctx context.Context, p *Provider, path string, body []byte, header http.Header, idempotent bool) (*http.Response, error) {
+	policy := p.Retry
+	attempts := max(policy.MaxAttempts, 1)
+
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.attempt(ctx, p, path, bytes.NewReader(body), int64(len(body)), header, attempt)
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !retryableError(err) || attempt >= attempts {
+				return nil, err
+			}
+			lastErr = err
+			delay = policy.backoff(attempt)
+			if !retryFits(ctx, delay) {
+				return nil, err
+			}
+		case policy.retryableStatus(resp.StatusCode) && retrySafe(resp.StatusCode, idempotent) && attempt < attempts:
+			delay = policy.backoff(attempt)
+			if ra, ok := retryAfter(resp.Header); ok {
+				if ra > time.Duration(policy.MaxDelay) {
+					// The provider wants us to wait longer than we are willing to; let the client decide.
+					return resp, nil
+				}
+				delay = max(delay, ra)
+			}
+			if !retryFits(ctx, delay) {
+				return resp, nil
+			}
+			lastErr = nil
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		attrs := []any{
+			slog.String("provider", p.Name),
+			slog.Int("attempt", attempt+1),
+			slog.Int("max_attempts", attempts),
+			slog.String("delay", delay.String()),
+		}
+		if lastErr != nil {
+			attrs = append(attrs, slog.String("error", lastErr.Error()))
+		} else {
+			attrs = append(attrs, slog.Int("status_code", resp.StatusCode))
+		}
+		middleware.LoggerFrom(ctx, rt.logger).Info("retrying upstream request", attrs...)
+		model, _ := middleware.RequestInfoFrom(ctx).Route()
+		rt.metrics.UpstreamRetry(model, attempt+1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryFits reports whether a retry after delay would start before the
+// request's deadline; one that would not could only use up the rest of
+// the budget, so the current attempt's outcome is returned instead.
+func retryFits(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := requestDeadline(ctx)
+	return !ok || time.Now().Add(delay).Before(deadline)
+}
+
+// authorize sets the provider's credentials: a bearer token for OpenAI
+// compatible APIs, or whatever the provider's adapter requires.
+func authorize(p *Provider, h http.Header) {
+	switch {
+	case p.Adapter != nil:
+		p.Adapter.Authorize(h, p.apiKey())
+	case p.apiKey() != "":
+		h.Set("Authorization", "Bearer "+p.apiKey())
+	}
+}
+
+// attempt sends one request to p, with a body of size bytes (-1 if not
+// known). The attempt's span lasts until the response body is closed when
+// the attempt succeeds, so it covers streamed generations and records the
+// tokens they used.
+func (rt *Router) attempt(ctx context.Context, p *Provider, path string, body io.Reader, size int64, header http.Header, n int) (*http.Response, error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	timer := time.AfterFunc(timeout, cancel)
+
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodPost,
+		strings.TrimRight(p.BaseURL, "/")+path, body)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header = header.Clone()
+	authorize(p, req.Header)
+	// Upstreams log the router's request ID, so their logs line up with
+	// ours; gRPC backends get it as x-request-id metadata.
+	if id := middleware.RequestIDFrom(ctx); id != "" {
+		req.Header.Set(middleware.RequestIDHeader, id)
+	}
+	model, _ := middleware.RequestInfoFrom(ctx).Route()
+	_, endSpan := rt.tracing.StartUpstream(ctx, p.Name, model, req.URL.String(), n, int(size), req.Header)
+
+	start := time.Now()
+	var resp *http.Response
+	if p.GRPC != nil {
+		// Uploads never go to gRPC backends, so body is a buffered one.
+		var message []byte
+		if message, err = io.ReadAll(body); err == nil {
+			resp, err = p.GRPC.Do(attemptCtx, message, req.Header)
+		}
+	} else {
+		resp, err = rt.clientFor(p).Do(req.WithContext(traceFirstByte(attemptCtx, start)))
+	}
+	timedOut := !timer.Stop()
+
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	if status != http.StatusOK {
+		endSpan(status, err)
+	}
+	rt.metrics.UpstreamRequest(p.Name, model, status, time.Since(start))
+	if err != nil {
+		if ctx.Err() == nil {
+			rt.upstreams.RecordFailure(p.Name, err)
+		}
+	} else {
+		rt.upstreams.RecordSuccess(p.Name)
+	}
+
+	if err != nil {
+		cancel()
+		if timedOut && ctx.Err() == nil {
+			return nil, fmt.Errorf("%w: no response from %s within %s", errUpstreamTimeout, p.Name, timeout)
+		}
+		return nil, err
+	}
+	gunzipResponse(resp)
+	if status != http.StatusOK {
+		resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: func() {
+		cancel()
+		endSpan(status, nil)
+	}}
+	return resp, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	io.WriteString(zw, s)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// A backend that gzips its responses, asked to or not, is decoded before
+// the cache keeps the response, so a hit is served as JSON too.
+func TestUpstreamGzipDecoded(t *testing.T) {
+	const response = `{"id":"resp-1","choices":[{"message":{"content":"ok"}}]}`
+	body := gzipped(t, response)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a, cache_enabled: true}
+`, upstream.URL)))
+	h := routeChain(t, rt)
+	for _, want := range []string{"MISS", "HIT"} {
+		id, cache := cachedCall(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, nil)
+		if id != "resp-1" || cache != want {
+			t.Errorf("id %q, X-Cache %q: want resp-1, %s", id, cache, want)
+		}
+	}
+}
+
+func TestGunzipResponse(t *testing.T) {
+	const body = `{"ok":true}`
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+		err      bool
+	}{
+		{name: "gzip", encoding: "gzip", body: gzipped(t, body), want: body},
+		{name: "x-gzip", encoding: "X-Gzip", body: gzipped(t, body), want: body},
+		{name: "identity", body: []byte(body), want: body},
+		{name: "other coding", encoding: "br", body: []byte("\x0b\x02"), want: "\x0b\x02"},
+		{name: "bad gzip", encoding: "gzip", body: []byte(body), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:        http.Header{"Content-Length": {fmt.Sprint(len(tt.body))}},
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			// No error here even for a bad body: that fails the read.
+			gunzipResponse(resp)
+			got, err := io.ReadAll(resp.Body)
+			if tt.err {
+				if err == nil {
+					t.Errorf("read %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("read %q, %v, want %q", got, err, tt.want)
+			}
+			decoded := strings.Contains(strings.ToLower(tt.encoding), "gzip")
+			if decoded && (resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 || !resp.Uncompressed) {
+				t.Errorf("decoded response still has header %v, length %d", resp.Header, resp.ContentLength)
+			}
+			if !decoded && resp.Uncompressed {
+				t.Error("response left as it was is marked Uncompressed")
+			}
+		})
+	}
+}
+
+// A body a backend gzipped reaches a client accepting gzip compressed once,
+// not gzipped again over the backend's encoding.
+func TestUpstreamGzipNotCompressedTwice(t *testing.T) {
+	response := `{"id":"resp-1","choices":[{"message":{"content":"` + strings.Repeat("ok ", 1000) + `"}}]}`
+	body := gzipped(t, response)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a}
+`, upstream.URL)))
+	h := middleware.NewCompressor(middleware.CompressionConfig{}).Middleware(routeChain(t, rt))
+	for _, accept := range []string{"gzip", ""} {
+		req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+		req.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := rec.Body.Bytes()
+		if accept != "" {
+			if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", enc)
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ = io.ReadAll(zr)
+		}
+		if string(got) != response {
+			t.Errorf("accepting %q: the body decodes to %.40q, want the response", accept, got)
+		}
+	}
+}
+
+// Every attempt carries the request's ID upstream, generated or the
+// client's.
+func TestRequestIDForwarded(t *testing.T) {
+	ids := make(chan string, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids <- r.Header.Get(middleware.RequestIDHeader)
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, upstream.URL)))
+	h := middleware.Chain(routeChain(t, rt), middleware.RequestID, middleware.Logging(testLogger()))
+	for _, client := range []string{"", "client-req-1"} {
+		req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+		if client != "" {
+			req.Header.Set(middleware.RequestIDHeader, client)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got, want := <-ids, rec.Header().Get(middleware.RequestIDHeader)
+		if got == "" || got != want || (client != "" && got != client) {
+			t.Errorf("client ID %q: upstream got %q, client was answered %q", client, got, want)
+		}
+	}
+}
+
+// slowUpstream answers after delay, or gives up when the router does, with
+// a stream's first event at once when asked for one.
+func slowUpstream(t *testing.T, delay time.Duration) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stream := bytes.Contains(body, []byte(`"stream":true`))
+		if stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		if stream {
+			io.WriteString(w, "data: [DONE]\n\n")
+			return
+		}
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// timeoutRouter routes model slow, with a deadline of timeout_seconds 1,
+// and model fast, under the router's default deadline, to upstream.
+func timeoutRouter(t *testing.T, upstream string) http.Handler {
+	t.Helper()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  slow: {provider: a, timeout_seconds: 1}
+  fast: a
+`, upstream)))
+	return rt.Budget(routeChain(t, rt))
+}
+
+// A backend taking 10s against a model's 1s deadline is given up on, and
+// the client answered 504 within about the deadline; a client's own
+// budget shortens it further.
+func TestModelTimeout(t *testing.T) {
+	h := timeoutRouter(t, slowUpstream(t, 10*time.Second))
+	tests := []struct {
+		name   string
+		model  string
+		header http.Header
+		within time.Duration
+	}{
+		{name: "model deadline", model: "slow", within: 1500 * time.Millisecond},
+		{name: "X-Request-Timeout-Ms", model: "slow", header: http.Header{TimeoutHeader: {"300"}}, within: 500 * time.Millisecond},
+		{name: "Request-Timeout", model: "fast", header: http.Header{"Request-Timeout": {"0.5"}}, within: 700 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := chatRequest(`{"model":"` + tt.model + `","messages":[{"role":"user","content":"hi"}]}`)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			h.ServeHTTP(rec, req)
+			took := time.Since(start)
+			if took > tt.within {
+				t.Errorf("answered after %v, want within %v", took, tt.within)
+			}
+			var resp struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+				Phase string `json:"phase"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != http.StatusGatewayTimeout || resp.Error.Code != "timeout" || resp.Phase != phaseUpstream {
+				t.Errorf("%d %s, want 504 timeout while upstream", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+// A stream needs only its first bytes within the deadline; the rest may
+// take longer.
+func TestModelTimeoutStream(t *testing.T) {
+	h := timeoutRouter(t, slowUpstream(t, 1500*time.Millisecond))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest(`{"model":"slow","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK || !strings.HasSuffix(rec.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("%d %q, want the whole stream", rec.Code, rec.Body)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{header: http.Header{}, want: 0},
+		{header: http.Header{TimeoutHeader: {"250"}}, want: 250 * time.Millisecond},
+		{header: http.Header{"Request-Timeout": {"2"}}, want: 2 * time.Second},
+		{header: http.Header{TimeoutHeader: {"250"}, "Request-Timeout": {"2"}}, want: 250 * time.Millisecond},
+		{header: http.Header{TimeoutHeader: {"5000"}, "Request-Timeout": {"2"}}, want: 2 * time.Second},
+		{header: http.Header{TimeoutHeader: {"-1"}, "Request-Timeout": {"soon"}}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := clientTimeout(tt.header); got != tt.want {
+			t.Errorf("clientTimeout(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	start := time.Now()
+	if got := (requestBudget{start: start}).deadline(time.Second); !got.Equal(start.Add(time.Second - deadlineMargin)) {
+		t.Errorf("deadline = %v after the start, want the timeout less the margin", got.Sub(start))
+	}
+	if got := (requestBudget{start: start, client: 100 * time.Millisecond}).deadline(time.Second); !got.Equal(start.Add(50 * time.Millisecond)) {
+		t.Errorf("deadline = %v after the start, want half a budget too short for the margin", got.Sub(start))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// TenantIDHeader names the tenant whose token budget a request draws on,
+// when the router does not authenticate requests itself.
+const TenantIDHeader = "X-Tenant-ID"
+
+const redisQuotaPrefix = "model-router:quota:"
+
+// loadQuotaLimits reads a tenant → token limit map from a YAML or JSON
+// file.
+func loadQuotaLimits(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var limits map[string]int64
+	if err := yaml.Unmarshal(data, &limits); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for tenant, n := range limits {
+		if n < 0 {
+			return nil, fmt.Errorf("%s: limit for %q must not be negative", path, tenant)
+		}
+	}
+	return limits, nil
+}
+
+// QuotaManager checks a tenant's remaining budget before a request is
+// routed and charges the tokens it used once it has succeeded, so failed
+// upstream calls cost nothing. Redis errors are logged and let requests
+// through: an outage suspends quotas rather than the API. now is its
+// clock, time.Now but for tests.
+type QuotaManager struct {
+	cfg           QuotaConfig
+	authenticated bool
+	limits        map[string]int64
+	client        *redis.Client
+	logger        *slog.Logger
+	now           func() time.Time
+}
+
+// NewQuotaManager charges requests to the tenant of their API key when
+// authenticated is set, and otherwise to the X-Tenant-ID they name.
+func NewQuotaManager(cfg QuotaConfig, authenticated bool, logger *slog.Logger) (*QuotaManager, error) {
+	opts, err := redis.ParseURL(cfg.redisURL())
+	if err != nil {
+		return nil, fmt.Errorf("quotas redis url: %w", err)
+	}
+	qm := &QuotaManager{cfg: cfg, authenticated: authenticated, client: redis.NewClient(opts), logger: logger, now: time.Now}
+	if cfg.LimitsFile != "" {
+		if qm.limits, err = loadQuotaLimits(cfg.LimitsFile); err != nil {
+			return nil, fmt.Errorf("quotas.limits_file: %w", err)
+		}
+	}
+	return qm, nil
+}
+
+// window returns the key suffix of the period containing now and the time
+// it ends.
+func (qm *QuotaManager) window(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	if qm.cfg.Period == "monthly" {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
+
+// QuotaStatus is a tenant's standing in the current period.
+type QuotaStatus struct {
+	Used    int64
+	Limit   int64
+	ResetAt time.Time
+}
+
+// Status reads the tenant's limit and usage in one round trip.
+func (qm *QuotaManager) Status(ctx context.Context, tenant string) (QuotaStatus, error) {
+	period, resetAt := qm.window(qm.now())
+	st := QuotaStatus{Limit: qm.cfg.DefaultLimit, ResetAt: resetAt}
+	if n, ok := qm.limits[tenant]; ok {
+		st.Limit = n
+	}
+	pipe := qm.client.Pipeline()
+	used := pipe.Get(ctx, redisQuotaPrefix+tenant+":"+period)
+	var limit *redis.StringCmd
+	if qm.cfg.LimitsHash != "" {
+		limit = pipe.HGet(ctx, qm.cfg.LimitsHash, tenant)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return st, err
+	}
+	if n, err := used.Int64(); err == nil {
+		st.Used = n
+	}
+	if limit != nil {
+		if v, err := limit.Result(); err == nil {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return st, fmt.Errorf("%s[%s]: %q is not a token limit", qm.cfg.LimitsHash, tenant, v)
+			}
+			st.Limit = n
+		}
+	}
+	return st, nil
+}
+
+// Charge adds tokens to the tenant's usage for the current period. The
+// counter expires when the period ends.
+func (qm *QuotaManager) Charge(ctx context.Context, tenant string, tokens int64) error {
+	period, resetAt := qm.window(qm.now())
+	key := redisQuotaPrefix + tenant + ":" + period
+	pipe := qm.client.TxPipeline()
+	pipe.IncrBy(ctx, key, tokens)
+	pipe.ExpireAt(ctx, key, resetAt)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// tenant is whose budget r draws on. Behind authentication that is the
+// tenant of the request's API key, as the client sets X-Tenant-ID and
+// could name any tenant with it; a key outside every tenant has none.
+// Without authentication, the header is all there is to go by, so it has
+// to come from a proxy in front of the router that clients cannot bypass.
+func (qm *QuotaManager) tenant(r *http.Request) string {
+	if qm.authenticated {
+		return middleware.RequestInfoFrom(r.Context()).Tenant()
+	}
+	return r.Header.Get(TenantIDHeader)
+}
+
+// Middleware answers 402 to tenants that have used up their budget and
+// charges successful requests afterwards. It must run inside the
+// RequestInfo middleware, which is where the router reports tokens used,
+// and inside authentication, which is where it finds the tenant.
+func (qm *QuotaManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := qm.tenant(r)
+		if tenant == "" {
+			switch {
+			case qm.cfg.RequireTenant && qm.authenticated:
+				writeError(w, http.StatusForbidden, "missing_tenant", "the request's credentials belong to no tenant")
+				return
+			case qm.cfg.RequireTenant:
+				writeError(w, http.StatusBadRequest, "missing_tenant", TenantIDHeader+" header is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger := middleware.LoggerFrom(r.Context(), qm.logger)
+		st, err := qm.Status(r.Context(), tenant)
+		switch {
+		case err != nil:
+			logger.Warn("quota check failed, allowing request", slog.String("tenant", tenant), slog.String("error", err.Error()))
+		case st.Limit > 0 && st.Used >= st.Limit:
+			w.Header().Set("Retry-After", strconv.Itoa(int(st.ResetAt.Sub(qm.now()).Seconds())+1))
+			apierror.WriteWithDetails(w, http.StatusPaymentRequired, "quota_exceeded",
+				"tenant "+tenant+" has used its token quota until "+st.ResetAt.Format(time.RFC3339),
+				map[string]any{"quota_used": st.Used, "quota_limit": st.Limit, "reset_at": st.ResetAt})
+			return
+		}
+		next.ServeHTTP(w, r)
+
+		// Tokens are only reported for successful upstream responses.
+		tokens := middleware.RequestInfoFrom(r.Context()).Tokens()
+		if tokens <= 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Second)
+		defer cancel()
+		if err := qm.Charge(ctx, tenant, tokens); err != nil {
+			logger.Warn("quota charge failed", slog.String("tenant", tenant), slog.Int64("tokens", tokens), slog.String("error", err.Error()))
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/testcontainers/testcontainers-go"
+	tcredis "github.com/testcontainers/testcontainers-go/modules/redis"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// tokenHandler reports 7 tokens used for each request, or fails upstream
+// without any when the request asks it to.
+var tokenHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Fail") != "" {
+		http.Error(w, "upstream failed", http.StatusBadGateway)
+		return
+	}
+	middleware.RequestInfoFrom(r.Context()).SetTokens(7)
+})
+
+// quotaRequest is a request naming tenant in X-Tenant-ID.
+func quotaRequest(h http.Handler, tenant string, header map[string]string) *httptest.ResponseRecorder {
+	req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`)
+	req.Header.Set(TenantIDHeader, tenant)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req, _ = middleware.WithRequestInfo(req)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// testQuotaExhaustion runs acme through a 10 token daily budget in the
+// Redis at redisURL: it is turned away with 402 once it has used it, failed
+// requests cost nothing, globex keeps its own budget, and the next day acme
+// starts again.
+func testQuotaExhaustion(t *testing.T, redisURL string) {
+	qm, err := NewQuotaManager(QuotaConfig{RedisURL: redisURL, DefaultLimit: 10}, false, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tomorrow afternoon, as Redis expires the counters by its own clock.
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	day := start.Add(15 * time.Hour)
+	qm.now = func() time.Time { return day }
+	h := qm.Middleware(tokenHandler)
+
+	for i, tt := range []struct {
+		header map[string]string
+		want   int
+	}{
+		{want: http.StatusOK},
+		{header: map[string]string{"X-Fail": "1"}, want: http.StatusBadGateway},
+		{want: http.StatusOK},
+		{want: http.StatusPaymentRequired},
+	} {
+		if rec := quotaRequest(h, "acme", tt.header); rec.Code != tt.want {
+			t.Fatalf("request %d = %d, want %d: %s", i, rec.Code, tt.want, rec.Body)
+		}
+	}
+	rec := quotaRequest(h, "acme", nil)
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+		Used    int64     `json:"quota_used"`
+		Limit   int64     `json:"quota_limit"`
+		ResetAt time.Time `json:"reset_at"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	reset := start.AddDate(0, 0, 1)
+	if body.Error.Code != "quota_exceeded" || body.Used != 14 || body.Limit != 10 || !body.ResetAt.Equal(reset) {
+		t.Errorf("402 body = %s, want 14 of 10 tokens used until %v", rec.Body, reset)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "32401" {
+		t.Errorf("Retry-After = %q, want the 9 hours to midnight", got)
+	}
+	if rec := quotaRequest(h, "globex", nil); rec.Code != http.StatusOK {
+		t.Errorf("another tenant = %d, want 200", rec.Code)
+	}
+
+	at, err := qm.client.ExpireTime(context.Background(), redisQuotaPrefix+"acme:"+start.Format("2006-01-02")).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at != time.Duration(reset.Unix())*time.Second {
+		t.Errorf("counter expires at %v, want the end of the day", time.Unix(int64(at/time.Second), 0).UTC())
+	}
+	day = reset.Add(time.Minute)
+	if rec := quotaRequest(h, "acme", nil); rec.Code != http.StatusOK {
+		t.Errorf("next day = %d, want the budget reset", rec.Code)
+	}
+}
+
+func TestQuotaExhaustion(t *testing.T) {
+	testQuotaExhaustion(t, "redis://"+miniredis.RunT(t).Addr())
+}
+
+// TestQuotaRedisIntegration runs against a real Redis in a container, and
+// is skipped where Docker is not available.
+func TestQuotaRedisIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a Redis container")
+	}
+	requireDocker(t)
+	ctx := context.Background()
+	container, err := tcredis.Run(ctx, "redis:7-alpine")
+	testcontainers.CleanupContainer(t, container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := container.ConnectionString(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testQuotaExhaustion(t, url)
+}
+
+// requireDocker skips t unless testcontainers finds a Docker to run
+// containers on. Finding none, it panics rather than reporting an error.
+func requireDocker(t *testing.T) {
+	t.Helper()
+	defer func() {
+		if p := recover(); p != nil {
+			t.Skipf("Docker is not available: %v", p)
+		}
+	}()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+}
+
+// Behind authentication the tenant is that of the API key, whatever
+// X-Tenant-ID says, and a key of no tenant draws on no budget.
+func TestQuotaTenantFromKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tests := []struct {
+		name    string
+		require bool
+		keyOf   string
+		header  string
+		want    int
+		charged string
+	}{
+		{name: "key's tenant", keyOf: "acme", header: "globex", want: http.StatusOK, charged: "[acme]"},
+		{name: "no tenant", header: "globex", want: http.StatusOK, charged: "[]"},
+		{name: "no tenant, tenant required", require: true, header: "globex", want: http.StatusForbidden, charged: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr.FlushAll()
+			qm, err := NewQuotaManager(QuotaConfig{RedisURL: "redis://" + mr.Addr(), RequireTenant: tt.require}, true, testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				middleware.RequestInfoFrom(r.Context()).SetTenant(tt.keyOf)
+				qm.Middleware(tokenHandler).ServeHTTP(w, r)
+			})
+			if rec := quotaRequest(h, tt.header, nil); rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			var charged []string
+			for _, key := range mr.Keys() {
+				tenant, _, _ := strings.Cut(strings.TrimPrefix(key, redisQuotaPrefix), ":")
+				charged = append(charged, tenant)
+			}
+			if got := fmt.Sprint(charged); got != tt.charged {
+				t.Errorf("charged %s, want %s", got, tt.charged)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+const (
+	// defaultRateLimitWindow is how long a reported remaining count is
+	// trusted when the provider does not say when it resets.
+	defaultRateLimitWindow = time.Minute
+	// defaultRateLimitCooldown is how long a provider is avoided after a
+	// 429 that gives no hint of when to come back.
+	defaultRateLimitCooldown = 5 * time.Second
+)
+
+// UpstreamRateLimitConfig is how much of its rate limit a provider may use
+// up before the router stops sending it requests until the limit resets.
+// The defaults (0) only avoid a provider that reports nothing left.
+type UpstreamRateLimitConfig struct {
+	MinRemainingRequests int64 `json:"min_remaining_requests,omitempty"`
+	MinRemainingTokens   int64 `json:"min_remaining_tokens,omitempty"`
+}
+
+// rateLimitHeaders names the headers one API reports a rate-limit
+// resource in.
+type rateLimitHeaders struct {
+	remaining string
+	reset     string
+	// resetIsTime is set when reset is an RFC 3339 timestamp rather than a
+	// duration such as "6m0s".
+	resetIsTime bool
+}
+
+var (
+	openAIRequests    = rateLimitHeaders{remaining: "X-Ratelimit-Remaining-Requests", reset: "X-Ratelimit-Reset-Requests"}
+	openAITokens      = rateLimitHeaders{remaining: "X-Ratelimit-Remaining-Tokens", reset: "X-Ratelimit-Reset-Tokens"}
+	anthropicRequests = rateLimitHeaders{remaining: "Anthropic-Ratelimit-Requests-Remaining", reset: "Anthropic-Ratelimit-Requests-Reset", resetIsTime: true}
+	anthropicTokens   = rateLimitHeaders{remaining: "Anthropic-Ratelimit-Tokens-Remaining", reset: "Anthropic-Ratelimit-Tokens-Reset", resetIsTime: true}
+	// Anthropic reports input tokens alone on some plans.
+	anthropicInputTokens = rateLimitHeaders{remaining: "Anthropic-Ratelimit-Input-Tokens-Remaining", reset: "Anthropic-Ratelimit-Input-Tokens-Reset", resetIsTime: true}
+)
+
+// rateWindow is what a provider last said about one rate-limited
+// resource.
+type rateWindow struct {
+	known     bool
+	remaining int64
+	reset     time.Time
+}
+
+// parse reads the first of sources present in h.
+func (w *rateWindow) parse(h http.Header, now time.Time, sources ...rateLimitHeaders) bool {
+	for _, src := range sources {
+		remaining, err := strconv.ParseInt(h.Get(src.remaining), 10, 64)
+		if err != nil {
+			continue
+		}
+		reset := now.Add(defaultRateLimitWindow)
+		if v := h.Get(src.reset); v != "" {
+			if src.resetIsTime {
+				if t, err := time.Parse(time.RFC3339, v); err == nil {
+					reset = t
+				}
+			} else if d, err := time.ParseDuration(v); err == nil {
+				reset = now.Add(d)
+			}
+		}
+		*w = rateWindow{known: true, remaining: remaining, reset: reset}
+		return true
+	}
+	return false
+}
+
+// exhausted reports whether the window still holds at now with no more
+// than min left.
+func (w rateWindow) exhausted(now time.Time, min int64) bool {
+	return w.known && now.Before(w.reset) && w.remaining <= min
+}
+
+// UpstreamRateLimit tracks the rate limit a provider reports in its
+// response headers, in OpenAI's x-ratelimit-* or Anthropic's
+// anthropic-ratelimit-* form. While the provider is at its limit, or
+// after it answered 429, its backends are skipped until the limit
+// resets. Backends keep a pointer to it, so the state survives reloads.
+type UpstreamRateLimit struct {
+	name    string
+	metrics *metrics.Metrics
+
+	mu       sync.Mutex
+	cfg      UpstreamRateLimitConfig
+	requests rateWindow
+	tokens   rateWindow
+	// blockedUntil is when the provider said to come back after a 429.
+	blockedUntil time.Time
+}
+
+func newUpstreamRateLimit(name string, m *metrics.Metrics) *UpstreamRateLimit {
+	return &UpstreamRateLimit{name: name, metrics: m}
+}
+
+// Observe records the rate-limit headers of resp. A nil tracker ignores
+// them.
+func (l *UpstreamRateLimit) Observe(resp *http.Response) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.requests.parse(resp.Header, now, openAIRequests, anthropicRequests) {
+		l.metrics.RateLimitRemaining(l.name, "requests", l.requests.remaining)
+	}
+	if l.tokens.parse(resp.Header, now, openAITokens, anthropicTokens, anthropicInputTokens) {
+		l.metrics.RateLimitRemaining(l.name, "tokens", l.tokens.remaining)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if d, ok := upstreamRetryAfter(resp.Header); ok {
+		// Retry-After is the provider's most precise word on when to come
+		// back, so it also bounds windows whose reset was guessed.
+		l.blockedUntil = now.Add(d)
+		for _, w := range []*rateWindow{&l.requests, &l.tokens} {
+			if w.reset.After(l.blockedUntil) {
+				w.reset = l.blockedUntil
+			}
+		}
+		return
+	}
+	// Without Retry-After, wait for whichever exhausted window resets
+	// last.
+	var until time.Time
+	for _, w := range []rateWindow{l.requests, l.tokens} {
+		if w.exhausted(now, 0) && w.reset.After(until) {
+			until = w.reset
+		}
+	}
+	if until.IsZero() {
+		until = now.Add(defaultRateLimitCooldown)
+	}
+	l.blockedUntil = until
+}
+
+// Limited reports whether the provider should not be sent requests now.
+func (l *UpstreamRateLimit) Limited() bool {
+	return !l.Until().IsZero()
+}
+
+// Until returns when the provider's rate limit lets requests through
+// again, or the zero time if it does now.
+func (l *UpstreamRateLimit) Until() time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var until time.Time
+	if now.Before(l.blockedUntil) {
+		until = l.blockedUntil
+	}
+	if l.requests.exhausted(now, l.cfg.MinRemainingRequests) && l.requests.reset.After(until) {
+		until = l.requests.reset
+	}
+	if l.tokens.exhausted(now, l.cfg.MinRemainingTokens) && l.tokens.reset.After(until) {
+		until = l.tokens.reset
+	}
+	return until
+}
+
+// setConfig replaces the thresholds, keeping what the provider reported.
+func (l *UpstreamRateLimit) setConfig(cfg UpstreamRateLimitConfig) {
+	l.mu.Lock()
+	l.cfg = cfg
+	l.mu.Unlock()
+}
+
+// upstreamRateLimits keeps one tracker per provider across reloads.
+type upstreamRateLimits struct {
+	metrics *metrics.Metrics
+
+	mu     sync.Mutex
+	limits map[string]*UpstreamRateLimit
+}
+
+// Update returns the tracker of every provider in cfg, by name, with the
+// provider's current thresholds.
+func (rl *upstreamRateLimits) Update(cfg *Config) map[string]*UpstreamRateLimit {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	out := make(map[string]*UpstreamRateLimit)
+	for name, pc := range cfg.Providers {
+		l, ok := rl.limits[name]
+		if !ok {
+			l = newUpstreamRateLimit(name, rl.metrics)
+		}
+		var thresholds UpstreamRateLimitConfig
+		if pc.RateLimit != nil {
+			thresholds = *pc.RateLimit
+		}
+		l.setConfig(thresholds)
+		out[name] = l
+	}
+	rl.limits = out
+	return out
+}
+
+// upstreamRetryAfter reads how long the provider asks to wait, from
+// Retry-After or the millisecond retry-after-ms some OpenAI deployments
+// send.
+func upstreamRetryAfter(h http.Header) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(h.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	return retryAfter(h)
+}
+
+// retryAfterSeconds formats the wait until t as a Retry-After value in
+// whole seconds, at least 1.
+func retryAfterSeconds(t time.Time) string {
+	return strconv.Itoa(max(1, int(math.Ceil(time.Until(t).Seconds()))))
+}
+
+// rateLimitedUntil returns the earliest time a rate-limited backend of
+// entries takes requests again, or the zero time if none is rate limited.
+func rateLimitedUntil(entries []*ModelEntry) time.Time {
+	var first time.Time
+	for _, e := range entries {
+		for _, b := range e.Backends() {
+			if until := b.RateLimit.Until(); !until.IsZero() && (first.IsZero() || until.Before(first)) {
+				first = until
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	defaultRealtimePrefix       = "/v1/realtime"
+	defaultRealtimeIdleTimeout  = 2 * time.Minute
+	defaultRealtimeWriteTimeout = 10 * time.Second
+	defaultRealtimePingInterval = 30 * time.Second
+	defaultRealtimeMaxMessage   = 16 << 20
+)
+
+// RealtimeConfig turns on WebSocket passthrough for realtime model APIs,
+// such as OpenAI's Realtime API, under PathPrefix (default /v1/realtime).
+// A connection is closed once nothing, not even a pong, has arrived from a
+// side for IdleTimeout (default 2m); each side is pinged every
+// PingInterval (default 30s) and each write must finish within
+// WriteTimeout (default 10s). Messages over MaxMessageBytes (default
+// 16 MiB) close the connection. Browsers may open sessions from the
+// router's own origin and from AllowedOrigins, such as
+// https://app.example.com, or "*" for any; with API keys required, from
+// any origin. Patterns such as https://*.example.com work as in cors.
+// Changes take effect on restart, not reload.
+type RealtimeConfig struct {
+	PathPrefix      string   `json:"path_prefix,omitempty"`
+	IdleTimeout     Duration `json:"idle_timeout,omitempty"`
+	WriteTimeout    Duration `json:"write_timeout,omitempty"`
+	PingInterval    Duration `json:"ping_interval,omitempty"`
+	MaxMessageBytes int64    `json:"max_message_bytes,omitempty"`
+	AllowedOrigins  []string `json:"allowed_origins,omitempty"`
+}
+
+func (c RealtimeConfig) withDefaults() RealtimeConfig {
+	if c.PathPrefix == "" {
+		c.PathPrefix = defaultRealtimePrefix
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = Duration(defaultRealtimeIdleTimeout)
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = Duration(defaultRealtimeWriteTimeout)
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = Duration(defaultRealtimePingInterval)
+	}
+	if c.MaxMessageBytes <= 0 {
+		c.MaxMessageBytes = defaultRealtimeMaxMessage
+	}
+	return c
+}
+
+func validateRealtime(c RealtimeConfig) error {
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("realtime.path_prefix must start with /")
+	}
+	if c.IdleTimeout < 0 || c.WriteTimeout < 0 || c.PingInterval < 0 || c.MaxMessageBytes < 0 {
+		return fmt.Errorf("realtime: idle_timeout, write_timeout, ping_interval and max_message_bytes must not be negative")
+	}
+	if c = c.withDefaults(); c.PingInterval >= c.IdleTimeout {
+		return fmt.Errorf("realtime.ping_interval must be shorter than idle_timeout")
+	}
+	for i, origin := range c.AllowedOrigins {
+		if scheme, host, ok := strings.Cut(origin, "://"); origin != "*" && (!ok || scheme == "" || host == "" || strings.Contains(host, "/")) {
+			return fmt.Errorf("realtime.allowed_origins[%d]: %q is not an origin such as https://app.example.com", i, origin)
+		}
+	}
+	return nil
+}
+
+// insecureKeyProtocol prefixes the subprotocol browsers use to pass an
+// OpenAI API key, which must not travel past the router.
+const insecureKeyProtocol = "openai-insecure-api-key."
+
+// RealtimeProxy carries WebSocket sessions between clients and the backend
+// of the model named by the model query parameter. The client has passed
+// the router's authentication by the time it gets here; the upstream is
+// dialled at the same path and query with the provider's credentials, and
+// the client's upgrade is only accepted once the upstream has accepted,
+// so a refused handshake reaches the client as a plain HTTP error.
+// Messages are copied unchanged in both directions until either side
+// closes, and the close code is passed on to the other. A session holds
+// one of its provider's concurrency slots until it ends.
+type RealtimeProxy struct {
+	rt       *Router
+	cfg      RealtimeConfig
+	upgrader websocket.Upgrader
+	// authenticated is whether sessions need an API key.
+	authenticated bool
+}
+
+// NewRealtimeProxy builds the proxy; authenticated says whether the
+// router requires API keys.
+func NewRealtimeProxy(rt *Router, cfg RealtimeConfig, authenticated bool) *RealtimeProxy {
+	p := &RealtimeProxy{rt: rt, cfg: cfg.withDefaults(), authenticated: authenticated}
+	p.upgrader = websocket.Upgrader{
+		HandshakeTimeout: defaultRealtimeWriteTimeout,
+		CheckOrigin:      p.checkOrigin,
+	}
+	return p
+}
+
+// checkOrigin admits clients that are not browsers, which send no Origin,
+// pages of the router's own origin and of allowed_origins. With API keys
+// required, it admits every origin: keys are never cookies, so a page
+// elsewhere gains nothing by opening a session. Without them, any page a
+// user of the network visits could otherwise spend the router's
+// credentials.
+func (p *RealtimeProxy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.authenticated {
+		return true
+	}
+	if middleware.OriginAllowed(p.cfg.AllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Register adds the proxy's routes for the prefix and everything below it.
+func (p *RealtimeProxy) Register(mux *http.ServeMux) {
+	prefix := strings.TrimRight(p.cfg.PathPrefix, "/")
+	mux.Handle("GET "+prefix, p)
+	mux.Handle("GET "+prefix+"/", p)
+}
+
+func (p *RealtimeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "expected a WebSocket upgrade")
+		return
+	}
+	// Ahead of dialling the upstream, which the upgrade would only refuse
+	// after.
+	if !p.checkOrigin(r) {
+		writeError(w, http.StatusForbidden, "origin_not_allowed", "WebSocket sessions are not allowed from origin "+r.Header.Get("Origin"))
+		return
+	}
+	query := r.URL.Query()
+	// The routes' KeyModels middleware does not run here.
+	info := middleware.RequestInfoFrom(r.Context())
+	if requested := query.Get("model"); !keyAllows(info, requested) {
+		writeKeyModelForbidden(w, info, requested)
+		return
+	}
+	model := p.rt.canonicalModel(r, query.Get("model"))
+	if model != query.Get("model") {
+		query.Set("model", model)
+	}
+	tenant := p.rt.tenantOf(r)
+	if tenant != nil {
+		if model = p.rt.tenantModel(tenant, model); model != "" && !tenant.Allows(model) {
+			writeError(w, http.StatusForbidden, "model_not_allowed", fmt.Sprintf("model %q is not available to tenant %s", model, tenant.Name))
+			return
+		}
+		query.Set("model", model)
+	}
+	if model == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "model query parameter is required")
+		return
+	}
+	entries := p.rt.registry.LookupAll(model)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "model_not_found", "no provider configured for model "+model)
+		return
+	}
+	target, _, err := SelectTarget(TargetRequest{Entries: entries, Hint: newRouteHint(nil, r)})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "provider_unavailable", "no backend available for model "+model)
+		return
+	}
+	backend := target.Backend
+	provider := tenant.Provider(backend.Provider)
+	if provider.Adapter != nil || provider.GRPC != nil {
+		backend.Breaker.Cancel()
+		writeError(w, http.StatusBadRequest, "invalid_request", "model "+model+" does not support realtime sessions")
+		return
+	}
+	if target.Variant != nil && target.Variant.Model != "" {
+		query.Set("model", target.Variant.Model)
+	}
+	info.SetRoute(model, provider.Name)
+	info.SetBackendURL(provider.BaseURL)
+	info.SetDecision(target.Decision.String())
+
+	release, err := backend.Limiter.Acquire(r.Context())
+	if err != nil {
+		backend.Breaker.Cancel()
+		var qe *queueError
+		if errors.As(err, &qe) {
+			w.Header().Set("Retry-After", qe.retryAfter())
+			writeError(w, http.StatusTooManyRequests, "rate_limited", qe.Error())
+		}
+		return
+	}
+	defer release()
+
+	upstream, resp, err := p.dial(r, provider, query)
+	if resp != nil {
+		backend.RateLimit.Observe(resp)
+		recordOutcome(backend, resp, nil, false)
+	} else {
+		recordOutcome(backend, nil, err, r.Context().Err() != nil)
+	}
+	if target.Slot != nil {
+		target.Entry.BlueGreen.Observe(target.Slot, resp == nil || resp.StatusCode >= 500)
+	}
+	if err != nil {
+		if resp == nil {
+			p.rt.metrics.UpstreamError(model, "connection")
+			writeError(w, http.StatusBadGateway, "provider_unavailable", "upstream "+provider.Name+" WebSocket connection failed")
+			return
+		}
+		// The upstream refused the handshake; pass its answer on.
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			writeUpstreamError(w, provider, model, resp)
+			return
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, io.LimitReader(resp.Body, 64<<10))
+		return
+	}
+
+	header := http.Header{}
+	if sp := upstream.Subprotocol(); sp != "" {
+		header.Set("Sec-WebSocket-Protocol", sp)
+	}
+	client, err := p.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		// The upgrader has answered the client already.
+		upstream.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Duration(p.cfg.WriteTimeout)))
+		upstream.Close()
+		return
+	}
+	start := time.Now()
+	closedBy, code := p.relay(client, upstream)
+	middleware.LoggerFrom(r.Context(), p.rt.logger).Info("realtime session ended",
+		slog.String("model", model),
+		slog.String("provider", provider.Name),
+		slog.String("closed_by", closedBy),
+		slog.Int("close_code", code),
+		slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000))
+}
+
+// dial opens the upstream WebSocket for r. The returned response is set
+// when the upstream answered the handshake, whether or not it accepted.
+func (p *RealtimeProxy) dial(r *http.Request, provider *Provider, query url.Values) (*websocket.Conn, *http.Response, error) {
+	target := strings.TrimRight(provider.BaseURL, "/") + r.URL.Path + "?" + query.Encode()
+	switch {
+	case strings.HasPrefix(target, "https://"):
+		target = "wss://" + strings.TrimPrefix(target, "https://")
+	case strings.HasPrefix(target, "http://"):
+		target = "ws://" + strings.TrimPrefix(target, "http://")
+	}
+	header := http.Header{}
+	if v := r.Header.Get("OpenAI-Beta"); v != "" {
+		header.Set("OpenAI-Beta", v)
+	}
+	if id := middleware.RequestIDFrom(r.Context()); id != "" {
+		header.Set(middleware.RequestIDHeader, id)
+	}
+	authorize(provider, header)
+	timeout := provider.Timeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  providerTLS(provider),
+	}
+	for _, sp := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(sp, insecureKeyProtocol) {
+			dialer.Subprotocols = append(dialer.Subprotocols, sp)
+		}
+	}
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(r.Context(), target, header)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	model, _ := middleware.RequestInfoFrom(r.Context()).Route()
+	p.rt.metrics.UpstreamRequest(provider.Name, model, status, time.Since(start))
+	if resp != nil {
+		p.rt.upstreams.RecordSuccess(provider.Name)
+	} else if r.Context().Err() == nil {
+		p.rt.upstreams.RecordFailure(provider.Name, err)
+	}
+	return conn, resp, err
+}
+
+// providerTLS returns the TLS settings of the provider's own client, if it
+// has one.
+func providerTLS(p *Provider) *tls.Config {
+	if p.Client == nil {
+		return nil
+	}
+	if t, ok := p.Client.Transport.(*http.Transport); ok {
+		return t.TLSClientConfig
+	}
+	return nil
+}
+
+// relayEnd is why one direction of a session stopped.
+type relayEnd struct {
+	fromClient bool // the client's side failed or closed
+	err        error
+}
+
+// relay copies messages both ways until one side closes or fails, passes
+// the close on to the other side and tears both connections down. It
+// returns which side ended the session and the close code it sent.
+func (p *RealtimeProxy) relay(client, upstream *websocket.Conn) (closedBy string, code int) {
+	done := make(chan struct{})
+	ends := make(chan relayEnd, 2)
+	go func() { ends <- relayEnd{fromClient: true, err: p.copy(upstream, client)} }()
+	go func() { ends <- relayEnd{fromClient: false, err: p.copy(client, upstream)} }()
+	go p.keepAlive(client, done)
+	go p.keepAlive(upstream, done)
+
+	end := <-ends
+	close(done)
+	var ce *websocket.CloseError
+	var fail *writeFailure
+	fromClient := end.fromClient
+	switch {
+	case errors.As(end.err, &fail):
+		// The other side could not take a message; it is the one gone.
+		fromClient = !fromClient
+		code = websocket.CloseGoingAway
+	case errors.As(end.err, &ce) && ce.Code != websocket.CloseAbnormalClosure && ce.Code != websocket.CloseTLSHandshake:
+		code = ce.Code
+	case fromClient:
+		code = websocket.CloseGoingAway
+	default:
+		code = websocket.CloseInternalServerErr
+	}
+	from, to := upstream, client
+	closedBy = "upstream"
+	if fromClient {
+		from, to = client, upstream
+		closedBy = "client"
+	}
+	text := ""
+	if ce != nil && ce.Code == code {
+		text = ce.Text
+	}
+	deadline := time.Now().Add(time.Duration(p.cfg.WriteTimeout))
+	to.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+	// Give the other side until the write timeout to answer the close, so
+	// the session ends cleanly, then drop both connections either way.
+	to.SetReadDeadline(deadline)
+	from.Close()
+	<-ends
+	to.Close()
+	return closedBy, code
+}
+
+// writeFailure is a message that could not be written to the other side.
+type writeFailure struct{ err error }
+
+func (e *writeFailure) Error() string { return "write: " + e.err.Error() }
+
+// copy forwards src's messages to dst until src fails or closes, or a
+// write to dst fails. Each message or pong from src extends its read
+// deadline.
+func (p *RealtimeProxy) copy(dst, src *websocket.Conn) error {
+	idle := time.Duration(p.cfg.IdleTimeout)
+	src.SetReadLimit(p.cfg.MaxMessageBytes)
+	src.SetReadDeadline(time.Now().Add(idle))
+	src.SetPongHandler(func(string) error {
+		return src.SetReadDeadline(time.Now().Add(idle))
+	})
+	for {
+		kind, data, err := src.ReadMessage()
+		if err != nil {
+			return err
+		}
+		src.SetReadDeadline(time.Now().Add(idle))
+		dst.SetWriteDeadline(time.Now().Add(time.Duration(p.cfg.WriteTimeout)))
+		if err := dst.WriteMessage(kind, data); err != nil {
+			return &writeFailure{err}
+		}
+	}
+}
+
+// keepAlive pings conn every PingInterval until done is closed or a ping
+// fails, in which case the missing pong soon ends the session.
+func (p *RealtimeProxy) keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(p.cfg.PingInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Duration(p.cfg.WriteTimeout))); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aspendos/model-router/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// echoUpstream is a realtime API that sends every message back, counting
+// the sessions it accepted.
+type echoUpstream struct {
+	sessions atomic.Int64
+}
+
+func (e *echoUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	e.sessions.Add(1)
+	for {
+		kind, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if conn.WriteMessage(kind, msg) != nil {
+			return
+		}
+	}
+}
+
+// newRealtimeServer serves the realtime proxy in front of an echoUpstream
+// for models m and n.
+func newRealtimeServer(t *testing.T, cfg RealtimeConfig, authenticated bool) (*httptest.Server, *echoUpstream) {
+	t.Helper()
+	return newRealtimeServerWith(t, cfg, authenticated, "")
+}
+
+// newRealtimeServerWith is newRealtimeServer with extra config, such as
+// auth, which then checks the API key of each session.
+func newRealtimeServerWith(t *testing.T, cfg RealtimeConfig, authenticated bool, extra string) (*httptest.Server, *echoUpstream) {
+	t.Helper()
+	upstream := &echoUpstream{}
+	backend := httptest.NewServer(upstream)
+	t.Cleanup(backend.Close)
+	routerCfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+  n: a
+`, backend.URL)+extra)
+	rt := newTestRouter(t, routerCfg)
+	mux := http.NewServeMux()
+	NewRealtimeProxy(rt, cfg, authenticated).Register(mux)
+	var handler http.Handler = mux
+	if routerCfg.Auth != nil {
+		auth, err := middleware.NewAuth(*routerCfg.Auth, testLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler = middleware.Logging(testLogger())(auth.Middleware(mux))
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv, upstream
+}
+
+func realtimeURL(srv *httptest.Server, model string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + defaultRealtimePrefix + "?model=" + model
+}
+
+func TestRealtimeCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticated bool
+		allowed       []string
+		origin        string
+		want          bool
+	}{
+		{name: "not a browser", want: true},
+		{name: "same origin", origin: "http://router.internal", want: true},
+		{name: "same origin, other case", origin: "http://Router.Internal", want: true},
+		{name: "foreign origin", origin: "https://evil.example", want: false},
+		{name: "allowed origin", allowed: []string{"https://app.example.com"}, origin: "https://app.example.com", want: true},
+		{name: "other scheme", allowed: []string{"https://app.example.com"}, origin: "http://app.example.com", want: false},
+		{name: "allowed pattern", allowed: []string{"https://*.example.com"}, origin: "https://chat.example.com", want: true},
+		{name: "pattern elsewhere", allowed: []string{"https://*.example.com"}, origin: "https://example.org", want: false},
+		{name: "any origin allowed", allowed: []string{"*"}, origin: "https://evil.example", want: true},
+		{name: "keys required", authenticated: true, origin: "https://evil.example", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRealtimeProxy(nil, RealtimeConfig{AllowedOrigins: tt.allowed}, tt.authenticated)
+			r := httptest.NewRequest(http.MethodGet, "http://router.internal/v1/realtime", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := p.checkOrigin(r); got != tt.want {
+				t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+// Without API keys, a page on another origin is refused before the
+// upstream is dialled; one allowed gets a working session.
+func TestRealtimeRefusesForeignOrigins(t *testing.T) {
+	srv, upstream := newRealtimeServer(t, RealtimeConfig{AllowedOrigins: []string{"https://app.example.com"}}, false)
+
+	_, resp, err := websocket.DefaultDialer.Dial(realtimeURL(srv, "m"), http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin: err %v, response %v, want 403", err, resp)
+	}
+	if n := upstream.sessions.Load(); n != 0 {
+		t.Errorf("upstream sessions after a refused origin = %d, want 0", n)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(realtimeURL(srv, "m"), http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("echo = %q, %v, want hello", msg, err)
+	}
+}
+
+// A key limited to some models cannot open a session to another, any more
+// than it could send it a request.
+func TestRealtimeKeyModels(t *testing.T) {
+	srv, upstream := newRealtimeServerWith(t, RealtimeConfig{}, true, `
+auth:
+  keys:
+    - {name: scoped, key: sk-scoped, allowed_models: [m]}
+    - {name: open, key: sk-open}
+`)
+	tests := []struct {
+		name   string
+		key    string
+		model  string
+		status int
+	}{
+		{name: "allowed model", key: "sk-scoped", model: "m", status: http.StatusSwitchingProtocols},
+		{name: "model outside the allowlist", key: "sk-scoped", model: "n", status: http.StatusForbidden},
+		{name: "key without an allowlist", key: "sk-open", model: "n", status: http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := upstream.sessions.Load()
+			conn, resp, err := websocket.DefaultDialer.Dial(realtimeURL(srv, tt.model), http.Header{"Authorization": {"Bearer " + tt.key}})
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if err != nil {
+				if n := upstream.sessions.Load(); n != before {
+					t.Errorf("upstream sessions = %d, want %d: the refused session was dialled", n, before)
+				}
+				return
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestValidateRealtimeOrigins(t *testing.T) {
+	for _, origin := range []string{"app.example.com", "https://", "https://app.example.com/path"} {
+		if err := validateRealtime(RealtimeConfig{AllowedOrigins: []string{origin}}); err == nil {
+			t.Errorf("allowed_origins [%q] passed validation", origin)
+		}
+	}
+	if err := validateRealtime(RealtimeConfig{AllowedOrigins: []string{"*", "https://*.example.com", "http://localhost:3000"}}); err != nil {
+		t.Errorf("valid allowed_origins: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// RegionGroupConfig splits a model's replicas between a primary region
+// and a failover region. Requests only go to FailoverBackends while no
+// primary backend can take them, because their breakers are open, their
+// health probes fail, or they are rate limited or warming up. Once a
+// primary backend is back, its region's share of traffic grows from none
+// to all over RecoveryWeightRampSeconds (default 0, all at once). Weights
+// apply within each region.
+type RegionGroupConfig struct {
+	PrimaryBackends           []ReplicaConfig `json:"primary_backends"`
+	FailoverBackends          []ReplicaConfig `json:"failover_backends"`
+	RecoveryWeightRampSeconds float64         `json:"recovery_weight_ramp_seconds,omitempty"`
+}
+
+func validateRegionGroup(rg RegionGroupConfig) error {
+	for _, g := range []struct {
+		field    string
+		replicas []ReplicaConfig
+	}{
+		{"primary_backends", rg.PrimaryBackends},
+		{"failover_backends", rg.FailoverBackends},
+	} {
+		total := 0
+		for _, rc := range g.replicas {
+			total += weightOrDefault(rc.Weight)
+		}
+		if total <= 0 {
+			return fmt.Errorf("region_group.%s: at least one backend needs a positive weight", g.field)
+		}
+	}
+	if rg.RecoveryWeightRampSeconds < 0 {
+		return fmt.Errorf("region_group.recovery_weight_ramp_seconds must not be negative")
+	}
+	return nil
+}
+
+// regionGroup is the failover state of a pool with a region_group. Its
+// fields after logger are guarded by the pool's lock.
+type regionGroup struct {
+	model    string
+	ramp     time.Duration
+	failover map[*Backend]bool
+	logger   *slog.Logger
+	metrics  *metrics.Metrics
+
+	failingOver bool
+	// recovering is when the primary region came back, while traffic is
+	// still shifting back to it.
+	recovering time.Time
+}
+
+func newRegionGroup(model string, rg RegionGroupConfig, failover []*Backend, logger *slog.Logger) *regionGroup {
+	g := &regionGroup{
+		model:    model,
+		ramp:     time.Duration(rg.RecoveryWeightRampSeconds * float64(time.Second)),
+		failover: make(map[*Backend]bool, len(failover)),
+		logger:   logger,
+	}
+	for _, b := range failover {
+		g.failover[b] = true
+	}
+	return g
+}
+
+// carryOver continues prev's failover, that of the same pool in the table
+// being replaced, so a reload neither resets a recovery ramp nor logs an
+// ongoing failover again.
+func (g *regionGroup) carryOver(prev *regionGroup, m *metrics.Metrics) {
+	g.metrics = m
+	if prev != nil {
+		g.failingOver, g.recovering = prev.failingOver, prev.recovering
+	}
+}
+
+func (g *regionGroup) split(backends []*Backend) (primary, failover []*Backend) {
+	for _, b := range backends {
+		if g.failover[b] {
+			failover = append(failover, b)
+		} else {
+			primary = append(primary, b)
+		}
+	}
+	return primary, failover
+}
+
+// route narrows the pool's backends and the candidates among them to the
+// region the next request should go to, and reports whether that is the
+// failover region. A dry run leaves the failover state as it is and
+// neither logs nor reports a change of region.
+func (g *regionGroup) route(backends, candidates []*Backend, dry bool) ([]*Backend, []*Backend, bool) {
+	primary, failover := g.split(backends)
+	primaryUp, failoverUp := g.split(candidates)
+	if len(primaryUp) == 0 {
+		if !g.failingOver && len(failoverUp) > 0 && !dry {
+			g.failingOver, g.recovering = true, time.Time{}
+			g.metrics.FailoverActive(g.model, true)
+			g.logger.Warn("primary region unavailable; failing over",
+				slog.String("model", g.model), slog.String("reason", unavailableReason(primary)))
+		}
+		return failover, failoverUp, true
+	}
+	recovering := g.recovering
+	if g.failingOver {
+		if g.ramp > 0 {
+			recovering = time.Now()
+		}
+		if !dry {
+			g.failingOver, g.recovering = false, recovering
+			g.logger.Warn("primary region recovered; shifting traffic back",
+				slog.String("model", g.model),
+				slog.String("reason", fmt.Sprintf("%d of %d primary backends available", len(primaryUp), len(primary))),
+				slog.String("ramp", g.ramp.String()))
+			if g.ramp <= 0 {
+				g.metrics.FailoverActive(g.model, false)
+			}
+		}
+	}
+	if !recovering.IsZero() {
+		share := float64(time.Since(recovering)) / float64(g.ramp)
+		if share >= 1 {
+			if !dry {
+				g.recovering = time.Time{}
+				g.metrics.FailoverActive(g.model, false)
+				g.logger.Info("traffic back on primary region", slog.String("model", g.model))
+			}
+		} else if len(failoverUp) > 0 && rand.Float64() >= share {
+			return failover, failoverUp, true
+		}
+	}
+	return primary, primaryUp, false
+}
+
+// unavailableReason says why none of backends can take requests.
+func unavailableReason(backends []*Backend) string {
+	if len(backends) == 0 {
+		return "no primary backends discovered"
+	}
+	counts := make(map[string]int)
+	var order []string
+	for _, b := range backends {
+		why := unavailable(b)
+		if counts[why] == 0 {
+			order = append(order, why)
+		}
+		counts[why]++
+	}
+	if len(order) == 1 {
+		return order[0] + " on every primary backend"
+	}
+	parts := make([]string, len(order))
+	for i, why := range order {
+		parts[i] = fmt.Sprintf("%d %s", counts[why], why)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// unavailable says why b cannot take requests.
+func unavailable(b *Backend) string {
+	switch {
+	case b.Weight <= 0:
+		return "weight 0"
+	case b.Breaker != nil && !b.Breaker.Ready():
+		return "circuit open"
+	case b.Health.Down():
+		return "failing health checks"
+	case b.RateLimit.Limited():
+		return "rate limited"
+	case b.Warmup.Warming():
+		return "warming up"
+	case b.ejected:
+		return "ejected as an outlier"
+	}
+	return "unavailable"
+}
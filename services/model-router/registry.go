@@ -0,0 +1,882 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// ModelEntry is one configured model, glob or rule: its settings and the
+// pool of backends serving it.
+type ModelEntry struct {
+	Name     string
+	Priority int
+	Config   BackendConfig
+	// MaxBodyBytes is the effective body limit: the model's own or the
+	// server default.
+	MaxBodyBytes int64
+	// Pool serves the entry, unless Split divides it between variants,
+	// BlueGreen picks one of two slots or Canary shares it between a
+	// stable and a canary deployment. With Policies, Pool is the default
+	// pool of the policies' chain.
+	Pool      *BackendPool
+	Policies  *PolicyChain
+	Split     *TrafficSplit
+	BlueGreen *BlueGreenController
+	Canary    *CanaryController
+	Shadow    *Shadow
+	// Plugins and Transforms rewrite the entry's upstream traffic,
+	// Validator checks its responses and Guardrails police both.
+	Plugins    PluginChain
+	Transforms *TransformPipeline
+	Validator  *ResponseValidator
+	Guardrails Guardrails
+	// Condition, on a rule with conditions, is what a request's prompt
+	// must meet for the rule to apply.
+	Condition *ruleCondition
+	// Ephemeral marks an entry added through the admin API, which lasts
+	// only until the process restarts.
+	Ephemeral bool
+}
+
+// Pools returns the entry's pool, one per variant of a traffic split, one
+// per blue-green slot, the stable and canary pools or the pools routing
+// policies choose among.
+func (e *ModelEntry) Pools() []*BackendPool {
+	if e.BlueGreen != nil {
+		return e.BlueGreen.Pools()
+	}
+	if e.Canary != nil {
+		return e.Canary.Pools()
+	}
+	if e.Policies != nil {
+		return e.Policies.Pools()
+	}
+	if e.Split == nil {
+		return []*BackendPool{e.Pool}
+	}
+	pools := make([]*BackendPool, len(e.Split.Variants))
+	for i, v := range e.Split.Variants {
+		pools[i] = v.Pool
+	}
+	return pools
+}
+
+// Backends lists the backends of every pool of the entry.
+func (e *ModelEntry) Backends() []*Backend {
+	var backends []*Backend
+	for _, p := range e.Pools() {
+		backends = append(backends, p.Backends()...)
+	}
+	return backends
+}
+
+// Serving reports whether any backend of the entry has a positive weight.
+func (e *ModelEntry) Serving() bool {
+	for _, p := range e.Pools() {
+		if p.Serving() {
+			return true
+		}
+	}
+	return false
+}
+
+type route struct {
+	pattern string
+	entry   *ModelEntry
+}
+
+// routingTable is an immutable snapshot of the model → backend mapping.
+type routingTable struct {
+	version string
+	loaded  time.Time
+	exact   map[string]*ModelEntry
+	routes  []route
+	// conditional holds the rules with conditions, in the same order as
+	// routes.
+	conditional []route
+	// maxBodyBytes is the largest limit of any entry, and at least the
+	// server default.
+	maxBodyBytes int64
+	tenants      *Tenants
+	// aliases maps each alias to the model at the end of its chain.
+	aliases map[string]string
+}
+
+func newRoutingTable(version string, maxBodyBytes int64, entries []*ModelEntry) *routingTable {
+	t := &routingTable{version: version, loaded: time.Now(), maxBodyBytes: maxBodyBytes, exact: make(map[string]*ModelEntry)}
+	for _, e := range entries {
+		t.maxBodyBytes = max(t.maxBodyBytes, e.MaxBodyBytes)
+		if e.Condition != nil {
+			t.conditional = append(t.conditional, route{pattern: e.Name, entry: e})
+			continue
+		}
+		if !strings.ContainsAny(e.Name, "*?") {
+			t.exact[e.Name] = e
+			continue
+		}
+		t.routes = append(t.routes, route{pattern: e.Name, entry: e})
+	}
+	sortRoutes(t.routes)
+	sortRoutes(t.conditional)
+	return t
+}
+
+// sortRoutes orders routes by descending priority, then specificity.
+// Routes that tie, as rules with conditions sharing a match can, keep
+// their config order.
+func sortRoutes(routes []route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.entry.Priority != b.entry.Priority {
+			return a.entry.Priority > b.entry.Priority
+		}
+		if la, lb := literalLen(a.pattern), literalLen(b.pattern); la != lb {
+			return la > lb
+		}
+		return a.pattern < b.pattern
+	})
+}
+
+// lookup prefers an exact model name, then the first matching glob in
+// priority and specificity order.
+func (t *routingTable) lookup(model string) (*ModelEntry, bool) {
+	if e, ok := t.exact[model]; ok {
+		return e, true
+	}
+	for _, r := range t.routes {
+		if matchGlob(r.pattern, model) {
+			return r.entry, true
+		}
+	}
+	return nil, false
+}
+
+func literalLen(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// matchGlob reports whether name matches pattern, where "*" matches any run
+// of bytes and "?" exactly one. Unlike path.Match, "*" crosses "/" so
+// "meta-llama/*" matches Hugging Face style model IDs.
+func matchGlob(pattern, name string) bool {
+	px, nx := 0, 0
+	starPx, starNx := -1, 0
+	for nx < len(name) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == name[nx]):
+			px++
+			nx++
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starNx = px, nx
+			px++
+		case starPx >= 0:
+			starNx++
+			px, nx = starPx+1, starNx
+		default:
+			return false
+		}
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
+
+func (t *routingTable) entries() []*ModelEntry {
+	out := make([]*ModelEntry, 0, len(t.exact)+len(t.routes)+len(t.conditional))
+	for _, e := range t.exact {
+		out = append(out, e)
+	}
+	for _, r := range t.routes {
+		out = append(out, r.entry)
+	}
+	for _, r := range t.conditional {
+		out = append(out, r.entry)
+	}
+	return out
+}
+
+// ModelRegistry holds the live routing table and swaps it atomically when
+// the config file is reloaded. Lookups hand back entries from the
+// snapshot that was current at the time, so in-flight requests finish
+// against the table they started with.
+type ModelRegistry struct {
+	path      string
+	metrics   *metrics.Metrics
+	health    *HealthChecker
+	probes    *BackendHealthChecker
+	discovery *TargetDiscovery
+	clients   *upstreamClients
+	limiters  *concurrencyLimiters
+	rates     *upstreamRateLimits
+	warmup    *WarmUpProbe
+	logger    *slog.Logger
+	// services, once WatchServices is called, finds models deployed as
+	// Kubernetes Services; buildMu guards it.
+	services *K8sDiscovery
+
+	mu    sync.RWMutex
+	table *routingTable
+	// overridden is set once the admin API changes the live table, so the
+	// next reload replaces it even if the file itself is unchanged.
+	overridden bool
+	// stale is set while the table comes from the last-known-good copy of
+	// the config because the file itself failed to load.
+	stale bool
+
+	// buildMu serializes table rebuilds, so a reload and a route override
+	// cannot interleave. base is the last config loaded from the file and
+	// overrides the admin API's routes layered over it.
+	buildMu   sync.Mutex
+	base      *Config
+	overrides map[string]RouteOverride
+	// cachePath, once UseConfigCache is called, is where every config the
+	// file loads as is kept, and cached the version last written there.
+	cachePath string
+	cached    string
+}
+
+// NewModelRegistry builds a registry from cfg. path is the file to re-read
+// on reload; it is empty when the built-in default config is in use. The
+// provider and backend health checkers and target discovery, if any, are
+// kept in step with every table built, and the table is rebuilt whenever
+// discovery finds a provider's targets have changed.
+func NewModelRegistry(cfg *Config, path string, m *metrics.Metrics, health *HealthChecker, probes *BackendHealthChecker, discovery *TargetDiscovery, logger *slog.Logger) *ModelRegistry {
+	reg := &ModelRegistry{path: path, metrics: m, health: health, probes: probes, discovery: discovery, clients: &upstreamClients{metrics: m}, limiters: &concurrencyLimiters{metrics: m}, rates: &upstreamRateLimits{metrics: m}, warmup: NewWarmUpProbe(logger), logger: logger, base: cfg}
+	if discovery != nil {
+		discovery.onChange = reg.targetsChanged
+	}
+	reg.table = reg.build(cfg)
+	return reg
+}
+
+// build compiles cfg into a routing table, links its backends to their
+// own health probes or their providers' health checks, and to their
+// providers' HTTP clients, concurrency limits and rate limits, warms up
+// backends that are new since the current table and publishes the initial
+// state of its breakers. Backends pointed at their own URL or found by
+// discovery are not covered by the provider's health check or limits. Blue-green models keep
+// the slot they were serving from, canaries their weight and pools their
+// slow start and outlier ejection state.
+func (reg *ModelRegistry) build(cfg *Config) *routingTable {
+	discovered := reg.discovery.Update(cfg)
+	t := newRoutingTable(cfg.Version, cfg.Server.maxRequestBytes(), cfg.Table(reg.breakerChanged, reg.logger, discovered))
+	t.tenants = newTenants(cfg)
+	// Validate has checked them already, so this cannot fail.
+	t.aliases, _ = validateAliases(cfg)
+	var health map[string]*ProviderHealth
+	if reg.health != nil {
+		health = reg.health.Update(cfg)
+	}
+	var probed map[string]*ProviderHealth
+	if reg.probes != nil {
+		probed = reg.probes.Update(t)
+	}
+	clients := reg.clients.Update(cfg)
+	limiters := reg.limiters.Update(cfg)
+	rates := reg.rates.Update(cfg)
+	reg.mu.RLock()
+	old := reg.table
+	reg.mu.RUnlock()
+	reg.warmUpNew(old, t)
+	var previous map[string]*ModelEntry
+	if old != nil {
+		previous = make(map[string]*ModelEntry)
+		for _, e := range old.entries() {
+			previous[e.Name] = e
+		}
+	}
+	for _, e := range t.entries() {
+		if prev := previous[e.Name]; e.BlueGreen != nil && prev != nil && prev.BlueGreen != nil {
+			e.BlueGreen.carryOver(prev.BlueGreen)
+		}
+		if e.Canary != nil {
+			var prev *CanaryController
+			if p := previous[e.Name]; p != nil {
+				prev = p.Canary
+			}
+			e.Canary.start(prev, reg.metrics)
+		}
+		var prevPools []*BackendPool
+		if p := previous[e.Name]; p != nil {
+			prevPools = p.Pools()
+		}
+		for i, p := range e.Pools() {
+			var prev *BackendPool
+			if i < len(prevPools) {
+				prev = prevPools[i]
+			}
+			var prevBalance *balancer
+			if prev != nil {
+				prevBalance = prev.balance
+			}
+			p.balance.carryOver(prevBalance, reg.metrics)
+			if s, ok := p.strategy.(*LatencyAwareStrategy); ok {
+				var prevStrategy Strategy
+				if prev != nil {
+					prevStrategy = prev.strategy
+				}
+				s.carryOver(prevStrategy, reg.metrics)
+			}
+			if p.regions == nil {
+				continue
+			}
+			var prevRegions *regionGroup
+			if prev != nil {
+				prevRegions = prev.regions
+			}
+			p.regions.carryOver(prevRegions, reg.metrics)
+		}
+		if ov, ok := reg.overrides[e.Name]; ok && !ov.Disabled {
+			e.Ephemeral = true
+		}
+		for _, b := range e.Backends() {
+			b.Health = health[b.Name()]
+			if h, ok := probed[e.Name+"/"+b.Name()]; ok {
+				b.Health = h
+			}
+			if b.Provider.Client == nil && b.Provider.GRPC == nil {
+				b.Provider.Client = clients[b.Provider.Source]
+			}
+			b.Limiter = limiters[b.Name()]
+			b.RateLimit = rates[b.Name()]
+			reg.metrics.BreakerState(b.Breaker.Name(), int(b.Breaker.State()))
+		}
+	}
+	// Stop the canaries no longer configured; the rest were stopped as
+	// their successors took over.
+	for _, prev := range previous {
+		if prev.Canary != nil {
+			prev.Canary.Stop()
+		}
+	}
+	return t
+}
+
+// targetsChanged rebuilds the table with the targets discovery has just
+// found. Like a reload, it ends any weight changes made through the admin
+// API; requests routed to a target that is gone finish where they are.
+func (reg *ModelRegistry) targetsChanged() {
+	reg.buildMu.Lock()
+	defer reg.buildMu.Unlock()
+	reg.rebuild()
+}
+
+func (reg *ModelRegistry) breakerChanged(name string, from, to BreakerState) {
+	reg.logger.Warn("circuit breaker state changed", slog.String("breaker", name), slog.String("from", from.String()), slog.String("to", to.String()))
+	reg.metrics.BreakerState(name, int(to))
+}
+
+// Loaded reports whether a routing table with at least one model is active.
+func (reg *ModelRegistry) Loaded() bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.table != nil && (len(reg.table.exact) > 0 || len(reg.table.routes) > 0)
+}
+
+// BreakerStates maps "model/backend" to the backend's circuit-breaker state.
+func (reg *ModelRegistry) BreakerStates() map[string]string {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+
+	out := make(map[string]string)
+	for _, e := range t.entries() {
+		for _, b := range e.Backends() {
+			out[e.Name+"/"+b.Name()] = b.Breaker.State().String()
+		}
+	}
+	return out
+}
+
+// BackendProbes maps "model/backend" to the backend's latest probe result.
+func (reg *ModelRegistry) BackendProbes() map[string]BackendProbe {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+
+	out := make(map[string]BackendProbe)
+	for _, e := range t.entries() {
+		for _, b := range e.Backends() {
+			probe := BackendProbe{Status: "unchecked"}
+			if b.Health != nil {
+				s := b.Health.status()
+				if s.Status != "unchecked" {
+					probe = BackendProbe{Status: s.Status, LatencyMs: s.LatencyMs, LastCheck: s.LastCheck}
+				}
+			}
+			if probe.Status == "unchecked" && b.Warmup != nil {
+				probe.Status = b.Warmup.String()
+			}
+			out[e.Name+"/"+b.Name()] = probe
+		}
+	}
+	return out
+}
+
+// PendingBackends maps "model/backend" to why the backend has not been
+// found healthy since startup: its health probes or its provider's health
+// check have not passed yet, or it is still warming up. Backends without
+// either are never pending, and a warm-up that timed out no longer is.
+func (reg *ModelRegistry) PendingBackends() map[string]string {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+
+	out := make(map[string]string)
+	for _, e := range t.entries() {
+		for _, b := range e.Backends() {
+			switch {
+			case b.Health.Pending():
+				out[e.Name+"/"+b.Name()] = "waiting for the first successful health check"
+			case b.Warmup.Warming():
+				out[e.Name+"/"+b.Name()] = "warming up"
+			}
+		}
+	}
+	return out
+}
+
+// CredentialProblems maps each provider of the table whose credential file
+// has stopped reading to why; its last key read is still in use.
+func (reg *ModelRegistry) CredentialProblems() map[string]string {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+
+	out := make(map[string]string)
+	for _, e := range t.entries() {
+		for _, b := range e.Backends() {
+			if c := b.Provider.Credential; c != nil && c.Problem() != "" {
+				out[c.provider] = c.Problem()
+			}
+		}
+	}
+	return out
+}
+
+// UnhealthyModels maps each model whose every backend is down, by its
+// health probes or its provider's health check, to why.
+func (reg *ModelRegistry) UnhealthyModels() map[string]string {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+
+	out := make(map[string]string)
+	for _, e := range t.entries() {
+		backends := e.Backends()
+		down := 0
+		for _, b := range backends {
+			if b.Health.Down() {
+				down++
+			}
+		}
+		if len(backends) > 0 && down == len(backends) {
+			out[e.Name] = "every backend is failing health checks"
+		}
+	}
+	return out
+}
+
+// MaxBodyBytes is the largest request body any configured model accepts,
+// used to cap reads before the target model is known.
+func (reg *ModelRegistry) MaxBodyBytes() int64 {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	return t.maxBodyBytes
+}
+
+func (reg *ModelRegistry) Lookup(model string) (*ModelEntry, bool) {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	return t.lookup(model)
+}
+
+// Tenants returns the tenants of the current table.
+func (reg *ModelRegistry) Tenants() *Tenants {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.table.tenants
+}
+
+// ResolveTenant names the tenant of an API key under the current table;
+// it is the auth middleware's TenantResolver.
+func (reg *ModelRegistry) ResolveTenant(keyName, secret string) string {
+	return reg.Tenants().Resolve(keyName, secret)
+}
+
+// LookupAll returns every entry matching model in routing order: the exact
+// entry first, then matching globs by priority. Later entries are the
+// fallthrough when earlier ones have no healthy backend.
+func (reg *ModelRegistry) LookupAll(model string) []*ModelEntry {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	return t.lookupAll(model, nil)
+}
+
+// lookupAll is LookupAll on t, adding each route looked at to ex if set.
+func (t *routingTable) lookupAll(model string, ex *Explanation) []*ModelEntry {
+	var out []*ModelEntry
+	if e, ok := t.exact[model]; ok {
+		out = append(out, e)
+		if ex != nil {
+			ex.Rules = append(ex.Rules, RuleExplanation{Match: e.Name, Kind: "exact", Matched: true, Reason: "exact model name"})
+		}
+	}
+	for _, r := range t.routes {
+		matched := matchGlob(r.pattern, model)
+		if matched {
+			out = append(out, r.entry)
+		}
+		if ex != nil {
+			re := RuleExplanation{Match: r.pattern, Kind: "glob", Priority: r.entry.Priority, Matched: matched, Reason: "pattern does not match"}
+			if matched {
+				re.Reason = "pattern matches"
+			}
+			ex.Rules = append(ex.Rules, re)
+		}
+	}
+	return out
+}
+
+// LookupFor is LookupAll for a request with the given prompt: the rules
+// with conditions that match model and hold for it come first, in
+// priority order. The prompt is only read if such a rule matches model.
+func (reg *ModelRegistry) LookupFor(model string, body []byte) []*ModelEntry {
+	return reg.lookupFor(model, body, nil)
+}
+
+// lookupFor is LookupFor, adding each route looked at to ex if set.
+func (reg *ModelRegistry) lookupFor(model string, body []byte, ex *Explanation) []*ModelEntry {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	var out []*ModelEntry
+	var f *PromptFeatures
+	for _, r := range t.conditional {
+		re := RuleExplanation{Match: r.pattern, Kind: "conditional", Priority: r.entry.Priority, Reason: "pattern does not match"}
+		if matchGlob(r.pattern, model) {
+			if f == nil {
+				f = newPromptFeatures(body)
+			}
+			re.Reason = "conditions do not hold for the prompt"
+			if r.entry.Condition.Matches(f) {
+				out = append(out, r.entry)
+				re.Matched, re.Reason = true, "pattern matches and conditions hold"
+			}
+		}
+		if ex != nil {
+			ex.Rules = append(ex.Rules, re)
+		}
+	}
+	return append(out, t.lookupAll(model, ex)...)
+}
+
+// Entries lists the active model entries sorted by name.
+func (reg *ModelRegistry) Entries() []*ModelEntry {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	entries := t.entries()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Models lists the exact model names of the active table, sorted, with the
+// time the table was loaded. Glob rules do not name concrete models and
+// are left out.
+func (reg *ModelRegistry) Models() ([]*ModelEntry, time.Time) {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	models := make([]*ModelEntry, 0, len(t.exact))
+	for _, e := range t.exact {
+		models = append(models, e)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models, t.loaded
+}
+
+// Entry returns the entry configured under name (an exact model or a glob
+// as written in the config), unlike Lookup which resolves a requested model.
+func (reg *ModelRegistry) Entry(name string) (*ModelEntry, bool) {
+	for _, e := range reg.Entries() {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Remove takes an entry out of the routing table until the next reload.
+// Requests already routed to it finish against the snapshot they hold.
+func (reg *ModelRegistry) Remove(name string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var kept []*ModelEntry
+	found := false
+	for _, e := range reg.table.entries() {
+		if e.Name == name {
+			found = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if found {
+		t := newRoutingTable(reg.table.version, reg.table.maxBodyBytes, kept)
+		t.tenants, t.aliases = reg.table.tenants, reg.table.aliases
+		reg.table = t
+		reg.overridden = true
+	}
+	return found
+}
+
+// SetWeight changes one backend's weight in the entry called name until
+// the next reload. In a traffic split it applies to every variant with a
+// backend of that name.
+func (reg *ModelRegistry) SetWeight(name, backend string, weight int) bool {
+	e, ok := reg.Entry(name)
+	if !ok {
+		return false
+	}
+	found := false
+	for _, p := range e.Pools() {
+		found = p.SetWeight(backend, weight) || found
+	}
+	if !found {
+		return false
+	}
+	reg.mu.Lock()
+	reg.overridden = true
+	reg.mu.Unlock()
+	return true
+}
+
+// RemoveBackend drops one backend from the entry called name (from every
+// variant of a traffic split) until the next reload.
+func (reg *ModelRegistry) RemoveBackend(name, backend string) bool {
+	e, ok := reg.Entry(name)
+	if !ok {
+		return false
+	}
+	found := false
+	for _, p := range e.Pools() {
+		found = p.Remove(backend) || found
+	}
+	if !found {
+		return false
+	}
+	reg.mu.Lock()
+	reg.overridden = true
+	reg.mu.Unlock()
+	return true
+}
+
+// Version is the config version of the active routing table.
+func (reg *ModelRegistry) Version() string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.table.version
+}
+
+// Reload re-reads and validates the config file. On any error the current
+// table stays active. It reports whether the table was replaced; an
+// unchanged file keeps the current table, breaker state included, unless
+// the admin API has modified it.
+func (reg *ModelRegistry) Reload() (bool, error) {
+	if reg.path == "" {
+		return false, fmt.Errorf("no config file set, nothing to reload")
+	}
+	reg.buildMu.Lock()
+	defer reg.buildMu.Unlock()
+	cfg, err := LoadConfig(reg.path)
+	if err != nil {
+		return false, err
+	}
+	for _, w := range cfg.Warnings {
+		reg.logger.Warn("config warning", slog.String("path", reg.path), slog.String("warning", w))
+	}
+	reg.base = cfg
+	reg.saveCache(cfg)
+	reg.mu.Lock()
+	unchanged := cfg.Version == reg.table.version && !reg.overridden
+	reg.stale = false
+	reg.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	t := reg.build(reg.layered(cfg))
+
+	reg.mu.Lock()
+	reg.table = t
+	reg.overridden = false
+	reg.mu.Unlock()
+	return true, nil
+}
+
+func (reg *ModelRegistry) reload(trigger string) {
+	stale := reg.Stale()
+	changed, err := reg.Reload()
+	switch {
+	case err != nil && stale:
+		reg.logger.Error("config reload failed, still serving the last-known-good config",
+			slog.String("trigger", trigger), slog.String("cache", reg.cachePath), slog.String("config_version", reg.Version()), slog.String("error", err.Error()))
+	case err != nil:
+		reg.logger.Error("config reload failed, keeping current config",
+			slog.String("trigger", trigger), slog.String("config_version", reg.Version()), slog.String("error", err.Error()))
+	case stale:
+		reg.logger.Warn("config file loads again, no longer serving the last-known-good config",
+			slog.String("path", reg.path), slog.String("trigger", trigger), slog.String("config_version", reg.Version()))
+	case changed:
+		reg.logger.Info("reloaded routing table",
+			slog.String("path", reg.path), slog.String("trigger", trigger), slog.String("config_version", reg.Version()))
+	}
+}
+
+// Stale reports whether the routing table comes from the last-known-good
+// copy of the config rather than the file, which failed to load.
+func (reg *ModelRegistry) Stale() bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.stale
+}
+
+// UseConfigCache keeps the last-known-good config at cachePath from now
+// on, writing every config the file loads as there. stale is whether the
+// current config was itself read from there, the file having failed to
+// load; until it loads again, it is retried every configRetryInterval
+// until ctx is cancelled, besides on SIGHUP and file changes.
+func (reg *ModelRegistry) UseConfigCache(ctx context.Context, cachePath string, stale bool) {
+	if reg.path == "" {
+		return
+	}
+	reg.buildMu.Lock()
+	reg.cachePath = cachePath
+	if stale {
+		reg.cached = reg.base.Version
+	} else {
+		reg.saveCache(reg.base)
+	}
+	reg.buildMu.Unlock()
+	if !stale {
+		return
+	}
+	reg.mu.Lock()
+	reg.stale = true
+	reg.mu.Unlock()
+	go func() {
+		tick := time.NewTicker(configRetryInterval)
+		defer tick.Stop()
+		for reg.Stale() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				if reg.Stale() {
+					reg.reload("retry")
+				}
+			}
+		}
+	}()
+}
+
+// saveCache writes cfg as the last-known-good config, unless it is what
+// was written last. Called with buildMu held.
+func (reg *ModelRegistry) saveCache(cfg *Config) {
+	if reg.cachePath == "" || cfg.Version == reg.cached {
+		return
+	}
+	if err := saveConfigCache(reg.cachePath, reg.path, cfg); err != nil {
+		reg.logger.Warn("could not save the last-known-good config", slog.String("error", err.Error()))
+		return
+	}
+	reg.cached = cfg.Version
+}
+
+// WatchSIGHUP reloads the registry each time the process receives SIGHUP
+// until ctx is cancelled.
+func (reg *ModelRegistry) WatchSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				reg.reload("SIGHUP")
+			}
+		}
+	}()
+}
+
+// reloadDebounce coalesces the burst of events a single save produces
+// (truncate + write, or rename-into-place).
+const reloadDebounce = 250 * time.Millisecond
+
+// WatchFile reloads the registry when the config file changes until ctx is
+// cancelled. It watches the parent directory rather than the file itself so
+// editors that replace the file and Kubernetes ConfigMap symlink swaps are
+// both picked up.
+func (reg *ModelRegistry) WatchFile(ctx context.Context) error {
+	if reg.path == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch config: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(reg.path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch config: %w", err)
+	}
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				debounce.Stop()
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Chmod) && !ev.Has(fsnotify.Write) {
+					continue
+				}
+				// ConfigMap updates only touch the "..data" symlink.
+				if base := filepath.Base(ev.Name); base != filepath.Base(reg.path) && !strings.HasPrefix(base, "..") {
+					continue
+				}
+				debounce.Reset(reloadDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				reg.logger.Warn("config watcher error", slog.String("error", err.Error()))
+			case <-debounce.C:
+				reg.reload("file change")
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// On SIGHUP the registry swaps in the config file's new routing table: a
+// request in flight finishes against the backend it was routed to, though
+// the new config drops it, and the next request goes by the new config.
+func TestReloadOnSIGHUP(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	before := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"from-before"}`)
+	}))
+	defer before.Close()
+	after := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"from-after"}`)
+	}))
+	defer after.Close()
+
+	const config = `
+providers:
+  %s: {base_url: %s}
+models:
+  m: %[1]s
+`
+	path := writeConfig(t, "router.yaml", fmt.Sprintf(config, "before", before.URL))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewModelRegistry(cfg, path, nil, nil, nil, nil, testLogger())
+	rt := NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger()))
+	h := routeChain(t, rt)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry.WatchSIGHUP(ctx)
+
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+		inFlight <- rec
+	}()
+	<-arrived
+
+	version := registry.Version()
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, "after", after.URL)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the reload", func() bool { return registry.Version() != version })
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id":"from-after"}` {
+		t.Errorf("new request: %d %s, want the new config's backend", rec.Code, rec.Body)
+	}
+
+	close(release)
+	rec = <-inFlight
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id":"from-before"}` {
+		t.Errorf("in-flight request: %d %s, want the old config's backend", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed upstream calls are retried. Only failures
+// that happened before any response byte reached the client are retried,
+// and statuses that may follow a processed request (5xx) only for
+// idempotent requests; see retrySafe.
+type RetryPolicy struct {
+	MaxAttempts int      `json:"max_attempts"`
+	BaseDelay   Duration `json:"base_delay"`
+	MaxDelay    Duration `json:"max_delay"`
+	RetryOn     []int    `json:"retry_on"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   Duration(100 * time.Millisecond),
+		MaxDelay:    Duration(2 * time.Second),
+		RetryOn: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+func (p RetryPolicy) retryableStatus(status int) bool {
+	return slices.Contains(p.RetryOn, status)
+}
+
+// retryableError reports whether a transport error is safe to retry: the
+// connection was refused, so the upstream never saw the request.
+func retryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// IdempotencyKeyHeader marks a request as safe to send more than once.
+const IdempotencyKeyHeader = "X-Idempotency-Key"
+
+// idempotentRequest reports whether the client's request may be repeated
+// upstream: safe methods always, POST only with an idempotency key, since a
+// retried completion is billed twice.
+func idempotentRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return idempotencyKey(r.Header) != ""
+}
+
+// retrySafe reports whether an upstream answer with status may be retried.
+// A 429 means the request was turned away unprocessed; any other status
+// may have cost a completion, so it needs an idempotent request.
+func retrySafe(status int, idempotent bool) bool {
+	return idempotent || status == http.StatusTooManyRequests
+}
+
+// backoff returns the delay before the given retry (1-based) using
+// exponential growth capped at MaxDelay, with full jitter.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := time.Duration(p.BaseDelay) << (retry - 1)
+	if d <= 0 || d > time.Duration(p.MaxDelay) {
+		d = time.Duration(p.MaxDelay)
+	}
+	return rand.N(d + 1)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/apierror"
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+	"github.com/aspendos/model-router/tracing"
+)
+
+const chatCompletionsPath = "/v1/chat/completions"
+
+type Provider struct {
+	Name string
+	// Source is the providers entry the backend came from; it is empty
+	// for backends configured by URL alone.
+	Source  string
+	BaseURL string
+	APIKey  string
+	// Credential, when set, is the provider's api_key_file, whose key
+	// replaces APIKey.
+	Credential *Credential
+	Timeout    time.Duration
+	Retry      RetryPolicy
+	// Adapter translates to and from a non-OpenAI API; nil passes
+	// requests through.
+	Adapter ProviderAdapter
+	Price   *Price
+	// Client, when set, carries the backend's own TLS settings or its
+	// provider's connection pool; nil uses the router's shared client.
+	Client *http.Client
+	// GRPC, when set, sends requests over the KServe v2 gRPC protocol
+	// instead of HTTP.
+	GRPC *GRPCBackend
+	// Encoding, when set, carries request and response bodies in a binary
+	// format instead of JSON.
+	Encoding BodyTransformer
+}
+
+// apiKey is the key to send p's requests with now.
+func (p *Provider) apiKey() string {
+	if p.Credential != nil {
+		return p.Credential.Key()
+	}
+	return p.APIKey
+}
+
+func (rt *Router) clientFor(p *Provider) *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return rt.client
+}
+
+// Router forwards requests to the backend the registry resolves for their model.
+type Router struct {
+	registry  *ModelRegistry
+	client    *http.Client
+	metrics   *metrics.Metrics
+	upstreams *UpstreamTracker
+	tracing   *tracing.Tracing
+
+	// onUpstreamUnauthorized runs when an upstream answers 401, e.g. to
+	// refresh JWT signing keys that may have rotated.
+	onUpstreamUnauthorized func()
+	logger                 *slog.Logger
+	usage                  *UsageAccumulator
+	batches                *EmbeddingBatcher
+	// defaultTimeout is the budget of requests to models without
+	// timeout_seconds, from REQUEST_TIMEOUT.
+	defaultTimeout time.Duration
+}
+
+// RouteRequest is the routing envelope. When Payload is set it is forwarded
+// as the upstream body; otherwise the whole request body is forwarded as-is.
+type RouteRequest struct {
+	Model    string          `json:"model"`
+	Messages json.RawMessage `json:"messages,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Stream   bool            `json:"stream,omitempty"`
+}
+
+func NewRouter(registry *ModelRegistry, m *metrics.Metrics, upstreams *UpstreamTracker, t *tracing.Tracing, logger *slog.Logger, usage *UsageAccumulator) *Router {
+	// Backends pointed at their own URL, without a provider, share one
+	// pool, whose connections are reported as provider "direct".
+	rt := &Router{
+		registry:  registry,
+		client:    NewUpstreamClient("direct", TransportConfig{}, m),
+		metrics:   m,
+		upstreams: upstreams,
+		tracing:   t,
+		logger:    logger,
+		usage:     usage,
+
+		defaultTimeout: defaultRequestTimeout,
+	}
+	rt.batches = newEmbeddingBatcher(rt)
+	return rt
+}
+
+func (rt *Router) handleRoute(w http.ResponseWriter, r *http.Request) {
+	rt.serve(w, r, chatCompletionsPath, ValidateRouteRequest)
+}
+
+func (rt *Router) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	rt.serve(w, r, embeddingsPath, ValidateEmbeddingsRequest)
+}
+
+// serve routes a request for the upstream endpoint at path, after validate
+// has checked its body.
+func (rt *Router) serve(w http.ResponseWriter, r *http.Request, path string, validate func(contentType string, body []byte) (RouteRequestInfo, *ValidationError)) {
+	// A body with a declared SHA-256 is hashed as it is read, for a model
+	// with integrity_check to compare.
+	var src io.Reader = r.Body
+	var digest hash.Hash
+	if r.Header.Get(ContentSHA256Header) != "" {
+		digest = sha256.New()
+		src = io.TeeReader(r.Body, digest)
+	}
+	body, err := io.ReadAll(src)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the router limit")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body")
+		return
+	}
+
+	req, verr := validate(r.Header.Get("Content-Type"), body)
+	if verr != nil {
+		writeError(w, verr.Status, verr.Code, verr.Message)
+		return
+	}
+
+	upstreamBody := body
+	if len(req.Payload) > 0 {
+		upstreamBody = req.Payload
+	}
+	entries := rt.registry.LookupFor(req.Model, upstreamBody)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "model_not_found", "no provider configured for model "+req.Model)
+		return
+	}
+	entry := entries[0]
+	if int64(len(body)) > entry.MaxBodyBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the limit for model "+req.Model)
+		return
+	}
+	if !acceptsContentType(entry.Config.acceptedContentTypes(), r.Header.Get("Content-Type")) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "content type not accepted for model "+req.Model)
+		return
+	}
+	if entry.Config.IntegrityCheck {
+		if verr := checkDigest(r.Header, digest); verr != nil {
+			writeError(w, verr.Status, verr.Code, verr.Message)
+			return
+		}
+	}
+	// Guardrails see the request before anything, the shadow included, is
+	// sent upstream.
+	upstreamBody, gerr := rt.checkRequest(r.Context(), req.Model, entry.Guardrails, upstreamBody)
+	if gerr != nil {
+		writeGuardrailError(w, req.Model, gerr)
+		return
+	}
+	timeout := rt.requestTimeout(r.Context(), entry.Config)
+	if timeout <= 0 {
+		writeDeadlineError(w, req.Model, phaseQueueing)
+		return
+	}
+	ctx, stopDeadline := withRequestDeadline(r.Context(), timeout, req.Stream)
+	defer stopDeadline()
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if req.Stream {
+		header.Set("Accept", "text/event-stream")
+	}
+
+	var res upstreamResult
+	if entry.Shadow != nil {
+		if cmp := rt.mirror(r.Context(), path, req.Model, entry.Shadow, upstreamBody, header, timeout); cmp != nil {
+			rw := middleware.WrapResponseWriter(w)
+			w = rw
+			start := time.Now()
+			defer func() {
+				primary := shadowOutcome{status: rw.StatusCode(), bytes: rw.Written, latency: time.Since(start)}
+				if res.backend != nil {
+					primary.backend = res.backend.Provider.Name
+				}
+				cmp.Done(primary)
+			}()
+		}
+	}
+
+	// Only the primary model's fallbacks are followed, each at most once, so
+	// the chain is bounded and cannot loop. Nothing has been written to the
+	// client while the chain runs, so every step is invisible to it.
+	// A tenant only falls back to models it may use.
+	chain := []string{req.Model}
+	tenant := rt.tenantOf(r)
+	for _, fb := range entry.Config.Fallbacks {
+		if tenant == nil || tenant.Allows(fb) {
+			chain = append(chain, fb)
+		}
+	}
+	hint := newRouteHint(upstreamBody, r)
+	for i, model := range chain {
+		candidates, modelBody := entries, upstreamBody
+		if i > 0 {
+			candidates = rt.registry.LookupFor(model, upstreamBody)
+			if modelBody, err = withModel(upstreamBody, model); err != nil {
+				// The last model's response is drained and closed by now,
+				// so there is nothing left to relay.
+				middleware.LoggerFrom(r.Context(), rt.logger).Warn("cannot fall back to next model",
+					slog.String("fallback", model), slog.String("error", err.Error()))
+				writeError(w, http.StatusBadGateway, "provider_unavailable",
+					"request for model "+req.Model+" failed, and fallback "+model+" cannot take a body that is not a JSON object")
+				return
+			}
+			if len(candidates) > 0 {
+				if modelBody, gerr = rt.checkRequest(r.Context(), model, candidates[0].Guardrails, modelBody); gerr != nil {
+					writeGuardrailError(w, model, gerr)
+					return
+				}
+			}
+		}
+		if i == 0 && path == embeddingsPath && entry.Config.EmbeddingBatchWindow > 0 {
+			res = rt.batches.Send(ctx, model, candidates, modelBody, header, hint, timeout)
+		} else {
+			res = rt.send(ctx, path, model, candidates, modelBody, header, hint)
+		}
+		if i == len(chain)-1 || !res.failed() || ctx.Err() != nil {
+			break
+		}
+		middleware.LoggerFrom(r.Context(), rt.logger).Warn("falling back to next model",
+			slog.String("model", model), slog.String("fallback", chain[i+1]), slog.String("reason", res.reason()))
+		if res.resp != nil {
+			io.Copy(io.Discard, io.LimitReader(res.resp.Body, 64<<10))
+			res.resp.Body.Close()
+		}
+	}
+
+	if res.backend == nil {
+		if len(rt.registry.LookupAll(res.model)) == 0 {
+			writeError(w, http.StatusServiceUnavailable, "provider_unavailable", "no backend available for model "+res.model)
+			return
+		}
+		if res.model == req.Model && !entry.Serving() {
+			writeError(w, http.StatusServiceUnavailable, "provider_unavailable", "no backend available for model "+res.model+": every backend has weight 0")
+			return
+		}
+		if until := rateLimitedUntil(rt.registry.LookupAll(res.model)); !until.IsZero() {
+			w.Header().Set("Retry-After", retryAfterSeconds(until))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "every provider of model "+res.model+" is at its rate limit")
+			return
+		}
+		writeError(w, http.StatusServiceUnavailable, "provider_unavailable", "no backend available for model "+res.model+": every backend is unhealthy")
+		return
+	}
+	provider := res.backend.Provider
+	if err := res.err; err != nil {
+		var qe *queueError
+		var se *schemaError
+		switch {
+		case errors.Is(err, errRequestTimeout):
+			phase, ok := deadlinePhase(err)
+			if !ok {
+				phase = phaseUpstream
+			}
+			writeDeadlineError(w, res.model, phase)
+			return
+		case r.Context().Err() != nil:
+		case errors.As(err, &qe):
+			w.Header().Set("Retry-After", qe.retryAfter())
+			writeError(w, http.StatusTooManyRequests, "rate_limited", qe.Error())
+			return
+		case errors.As(err, new(*pluginError)):
+			writeError(w, http.StatusBadGateway, "plugin_failed", "request for model "+res.model+" failed: "+err.Error())
+			return
+		case errors.As(err, &gerr):
+			writeGuardrailError(w, res.model, gerr)
+			return
+		case errors.As(err, new(*adapterError)):
+			writeError(w, http.StatusBadRequest, "invalid_request", "request cannot be sent to "+provider.Name+": "+err.Error())
+			return
+		case errors.As(err, &se):
+			apierror.WriteWithDetails(w, http.StatusBadGateway, "invalid_upstream_response",
+				"upstream "+provider.Name+" returned an invalid response for model "+res.model+": "+err.Error(),
+				map[string]any{"violations": se.violations})
+			return
+		case errors.As(err, new(*encodingError)):
+			writeError(w, http.StatusBadRequest, "invalid_request", "request cannot be encoded for "+provider.Name+": "+err.Error())
+			return
+		case errors.As(err, new(*transformError)):
+			writeError(w, http.StatusBadRequest, "invalid_request", "request cannot be transformed for model "+res.model+": "+err.Error())
+			return
+		case errors.Is(err, errUpstreamTimeout):
+			writeError(w, http.StatusGatewayTimeout, "timeout", "upstream "+provider.Name+" did not respond in time")
+			return
+		}
+		writeError(w, http.StatusBadGateway, "provider_unavailable", "upstream "+provider.Name+" request failed")
+		return
+	}
+	resp := res.resp
+	defer resp.Body.Close()
+	// Backends may stream whether or not the client asked them to; an
+	// event stream is relayed as one either way.
+	stream := resp.StatusCode == http.StatusOK && (req.Stream || isEventStream(resp.Header))
+	if resp.StatusCode == http.StatusOK {
+		sniffer := &usageSniffer{stream: stream}
+		body := resp.Body
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, sniffer), body}
+		defer func() {
+			info := middleware.RequestInfoFrom(r.Context())
+			usage := sniffer.Usage()
+			rt.usage.Record(usageCaller(info), res.model, usage)
+			tokens := usage.TotalTokens
+			if tokens == 0 {
+				tokens = int64(hint.InputTokens + hint.OutputTokens)
+			}
+			info.SetTokens(tokens)
+			info.SetTokenCounts(usage.PromptTokens, usage.CompletionTokens)
+		}()
+	}
+
+	w.Header().Set("X-Aspendos-Served-By", provider.Name+"/"+res.model)
+	w.Header().Set("X-Aspendos-Provider", provider.Name)
+	if res.variant != "" {
+		w.Header().Set("X-Aspendos-Variant", res.variant)
+	}
+	if res.canary != "" {
+		w.Header().Set(CanaryHeader, res.canary)
+	}
+	w.Header().Set(RouteDecisionHeader, res.decision.String())
+
+	// A stream request that fails before the first chunk gets the upstream's
+	// status and error body like any other request, never an event stream.
+	if stream {
+		// The deadline of a streamed request covers only the wait for the
+		// stream's first bytes; one that did not ask for a stream keeps it
+		// to the end.
+		stream := bufio.NewReader(resp.Body)
+		if _, err := stream.Peek(1); err != nil && errors.Is(context.Cause(ctx), errRequestTimeout) {
+			rt.metrics.UpstreamError(res.model, "timeout")
+			writeDeadlineError(w, res.model, phaseStreaming)
+			return
+		}
+		if req.Stream {
+			stopDeadline()
+		}
+		middleware.RequestInfoFrom(r.Context()).SetState(inflightStreaming)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		forwarded := func() { rt.metrics.SSEEventForwarded(res.model) }
+		if err := streamSSE(ctx, w, stream, provider.Name, middleware.LoggerFrom(r.Context(), rt.logger), forwarded); err != nil {
+			rt.metrics.UpstreamError(res.model, "stream_interrupted")
+		}
+		return
+	}
+
+	// A provider's 429 body and headers differ by provider; clients get the
+	// router's own error and a Retry-After from what the provider reported.
+	if resp.StatusCode == http.StatusTooManyRequests {
+		until := res.backend.RateLimit.Until()
+		if until.IsZero() {
+			until = time.Now().Add(defaultRateLimitCooldown)
+		}
+		w.Header().Set("Retry-After", retryAfterSeconds(until))
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "upstream "+provider.Name+" rate limited the request for model "+res.model)
+		return
+	}
+
+	if resp.StatusCode >= 400 {
+		writeUpstreamError(w, provider, res.model, resp)
+		return
+	}
+
+	// Status, content type and body are passed through unchanged so
+	// callers see exactly what the upstream sent.
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	var out io.Reader = resp.Body
+	done := func() {}
+	if entry.Config.IntegrityCheck {
+		out, done = writeDigestTrailer(w, resp.Body)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyAndFlush(w, out); err == nil {
+		done()
+	}
+}
+
+// upstreamResult is the outcome of sending the request for one model of
+// the fallback chain.
+type upstreamResult struct {
+	model    string
+	variant  string   // traffic-split variant, if the entry has one
+	canary   string   // "true" or "false" if the entry has a canary
+	backend  *Backend // nil when no backend could take the request
+	decision Decision // why the strategy chose backend
+	resp     *http.Response
+	err      error
+}
+
+// failed reports whether a fallback should be tried: no backend, a
+// transport error or timeout, 429 or 5xx. A plugin failing the request
+// ends the chain.
+func (res upstreamResult) failed() bool {
+	switch {
+	case errors.As(res.err, new(*pluginError)), errors.As(res.err, new(*guardrailError)):
+		return false
+	case res.backend == nil, res.err != nil:
+		return true
+	default:
+		return res.resp.StatusCode == http.StatusTooManyRequests || res.resp.StatusCode >= 500
+	}
+}
+
+func (res upstreamResult) reason() string {
+	switch {
+	case res.backend == nil:
+		return "no backend available"
+	case res.err != nil:
+		return res.err.Error()
+	default:
+		return "status " + strconv.Itoa(res.resp.StatusCode)
+	}
+}
+
+// send forwards body to path of the first entry with an available backend,
+// falling through to lower-priority matches while every backend of the
+// preferred entry is unavailable (open breakers or zero weights). For an
+// entry with a traffic split only the client's variant is considered, and
+// for a blue-green entry only the active slot.
+func (rt *Router) send(ctx context.Context, path, model string, entries []*ModelEntry, body []byte, header http.Header, hint RouteHint) upstreamResult {
+	res := upstreamResult{model: model}
+	target, _, err := SelectTarget(TargetRequest{Entries: entries, Hint: hint})
+	if err != nil {
+		return res
+	}
+	entry, variant, slot := target.Entry, target.Variant, target.Slot
+	res.backend, res.decision = target.Backend, target.Decision
+	info := middleware.RequestInfoFrom(ctx)
+	provider := rt.registry.Tenants().Lookup(info.Tenant()).Provider(res.backend.Provider)
+	info.SetRoute(model, provider.Name)
+	info.SetBackendURL(provider.BaseURL)
+	info.SetDecision(res.decision.String())
+	if entry.Canary != nil {
+		res.canary = strconv.FormatBool(entry.Canary.IsCanary(variant))
+	}
+	if variant != nil {
+		res.variant = variant.Name
+		info.SetVariant(variant.Name)
+		if variant.Model != "" {
+			rewritten, err := withModel(body, variant.Model)
+			if err != nil {
+				res.backend.Breaker.Cancel()
+				res.err = err
+				return res
+			}
+			body = rewritten
+		}
+	}
+
+	body, err = entry.Transforms.Request(body)
+	if err != nil {
+		res.backend.Breaker.Cancel()
+		res.err = &transformError{err}
+		return res
+	}
+	path, body, err = translateRequest(provider, path, body)
+	if err != nil {
+		res.backend.Breaker.Cancel()
+		res.err = &adapterError{err}
+		return res
+	}
+	body, header, err = entry.Plugins.processRequest(ctx, strings.TrimRight(provider.BaseURL, "/")+path, body, header)
+	if err != nil {
+		res.backend.Breaker.Cancel()
+		res.err = err
+		return res
+	}
+	if provider.Encoding != nil {
+		if body, header, err = encodeRequest(provider.Encoding, body, header); err != nil {
+			res.backend.Breaker.Cancel()
+			res.err = err
+			return res
+		}
+	}
+	// The slot is held until the response body is closed, so a stream
+	// counts against the limit for as long as it runs.
+	release, err := res.backend.Limiter.Acquire(ctx)
+	if err != nil {
+		res.backend.Breaker.Cancel()
+		if errors.Is(context.Cause(ctx), errRequestTimeout) {
+			err = &deadlineError{phase: phaseQueueing}
+		}
+		res.err = err
+		return res
+	}
+	middleware.RequestInfoFrom(ctx).SetState(inflightUpstream)
+	start := time.Now()
+	res.resp, res.err = rt.forward(observingFirstByte(ctx, res.backend), provider, path, body, header, hint.Idempotent)
+	if res.err == nil {
+		res.backend.ObserveLatency(time.Since(start))
+		res.backend.RateLimit.Observe(res.resp)
+		res.resp.Body = cancelOnClose{ReadCloser: res.resp.Body, cancel: release}
+	} else {
+		release()
+	}
+	deadlineHit := errors.Is(context.Cause(ctx), errRequestTimeout)
+	if res.err != nil && deadlineHit {
+		res.err = &deadlineError{phase: phaseUpstream}
+	}
+	clientGone := ctx.Err() != nil && !deadlineHit
+	if !clientGone {
+		res.backend.ObserveOutcome(time.Since(start), res.err != nil || res.resp.StatusCode >= 500)
+	}
+	// Whether a stream worked is only known once it ends, so the breaker
+	// hears of it then.
+	var outcome *streamOutcome
+	if res.err == nil && res.resp.StatusCode == http.StatusOK && isEventStream(res.resp.Header) {
+		outcome = &streamOutcome{ReadCloser: res.resp.Body, ctx: ctx, breaker: res.backend.Breaker}
+		res.resp.Body = outcome
+	} else {
+		recordOutcome(res.backend, res.resp, res.err, clientGone)
+	}
+	if res.canary != "" && !clientGone {
+		status := 0
+		if res.err == nil {
+			status = res.resp.StatusCode
+		}
+		rt.metrics.CanaryRequest(model, res.canary, status)
+	}
+	if slot != nil && !clientGone {
+		entry.BlueGreen.Observe(slot, res.err != nil || res.resp.StatusCode >= 500)
+	}
+	if res.err == nil && provider.Encoding != nil {
+		if err := decodeResponse(provider.Encoding, res.resp); err != nil {
+			res.resp, res.err = nil, err
+		}
+	}
+	if res.err == nil && provider.Adapter != nil {
+		if err := adaptResponse(provider.Adapter, res.resp); err != nil {
+			res.resp, res.err = nil, err
+		}
+	}
+	if res.err == nil {
+		if err := entry.Validator.Validate(res.resp); err != nil {
+			if errors.As(err, new(*schemaError)) {
+				rt.metrics.ResponseValidationFailure(model)
+			}
+			res.resp, res.err = nil, err
+		}
+	}
+	if res.err == nil {
+		if err := entry.Transforms.Response(res.resp); err != nil {
+			res.resp, res.err = nil, err
+		}
+	}
+	if res.err == nil {
+		if err := entry.Plugins.ProcessResponse(ctx, res.resp); err != nil {
+			res.resp.Body.Close()
+			res.resp, res.err = nil, err
+		}
+	}
+	if res.err == nil {
+		if err := rt.checkResponse(ctx, model, entry.Guardrails, res.resp); err != nil {
+			res.resp, res.err = nil, err
+		}
+	}
+	if outcome != nil && res.err != nil {
+		// The backend streamed; the router turned the stream down.
+		outcome.settle()
+	}
+	switch {
+	case res.err != nil && ctx.Err() != nil && !deadlineHit:
+		rt.metrics.UpstreamError(model, "client_canceled")
+	case errors.Is(res.err, errRequestTimeout), errors.Is(res.err, errUpstreamTimeout):
+		rt.metrics.UpstreamError(model, "timeout")
+	case res.err != nil:
+		rt.metrics.UpstreamError(model, "connection")
+	case res.resp.StatusCode >= 500:
+		rt.metrics.UpstreamError(model, "status_5xx")
+	case res.resp.StatusCode == http.StatusTooManyRequests:
+		rt.metrics.UpstreamError(model, "rate_limited")
+	case res.resp.StatusCode == http.StatusUnauthorized, res.resp.StatusCode == http.StatusForbidden:
+		rt.metrics.UpstreamAuthFailure(provider.Name, res.resp.StatusCode)
+		if res.resp.StatusCode == http.StatusUnauthorized && rt.onUpstreamUnauthorized != nil {
+			rt.onUpstreamUnauthorized()
+		}
+	}
+	return res
+}
+
+// withModel returns body with its "model" field set to model.
+func withModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	name, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = name
+	return json.Marshal(fields)
+}
+
+// LimitBody rejects bodies larger than anything the registry accepts. It runs
+// ahead of every middleware that reads the body, so oversized uploads are
+// refused from Content-Length alone or cut off mid-read. Multipart bodies
+// are counted as they stream upstream instead.
+func (rt *Router) LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := rt.registry.MaxBodyBytes()
+		if r.ContentLength > limit {
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the router limit")
+			return
+		}
+		if isMultipart(r.Header) {
+			r.Body = &uploadBody{ReadCloser: r.Body, limit: limit}
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func acceptsContentType(accepted []string, header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, a := range accepted {
+		if strings.EqualFold(a, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordOutcome feeds an upstream result into the backend's breaker. Only
+// transport failures and 5xx count against the backend; a request the
+// client abandoned says nothing about its health.
+func recordOutcome(b *Backend, resp *http.Response, err error, clientGone bool) {
+	switch {
+	case clientGone:
+		b.Breaker.Cancel()
+	case err != nil || resp.StatusCode >= 500:
+		b.Breaker.Failure()
+	default:
+		b.Breaker.Success()
+	}
+}
+
+// copyAndFlush streams src to w, flushing after every read so partial
+// upstream output reaches the client without waiting for the full body.
+// Middleware that records responses to replay holds any but an event
+// stream back until it ends: the cache for models with cache_enabled,
+// deduplicate, and requests with an Idempotency-Key. So does a model's
+// response_schema, for JSON.
+func copyAndFlush(w http.ResponseWriter, src io.Reader) (int64, error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	apierror.Write(w, status, code, message)
+}
+
+// maxUpstreamErrorBytes bounds how much of a provider's error body is read
+// for its message.
+const maxUpstreamErrorBytes = 64 << 10
+
+// writeUpstreamError answers with the router's envelope for an error
+// response from provider to a request for model. The status maps to the
+// router's codes, and the provider's own message goes along as
+// provider_detail, with its credentials and any URLs taken out: provider
+// error bodies can echo keys and name internal hosts.
+func writeUpstreamError(w http.ResponseWriter, provider *Provider, model string, resp *http.Response) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamErrorBytes))
+	e := &apierror.APIError{
+		Provider:       provider.Name,
+		ProviderDetail: apierror.Redact(upstreamErrorMessage(body), provider.apiKey(), provider.BaseURL, hostOf(provider.BaseURL)),
+	}
+	switch status := resp.StatusCode; {
+	case status == http.StatusNotFound:
+		e.Status, e.Code = status, "model_not_found"
+		e.Message = "upstream " + provider.Name + " does not serve model " + model
+	case status == http.StatusRequestEntityTooLarge:
+		e.Status, e.Code = status, "request_too_large"
+		e.Message = "request for model " + model + " is too large for upstream " + provider.Name
+	case status == http.StatusTooManyRequests:
+		e.Status, e.Code = status, "rate_limited"
+		e.Message = "upstream " + provider.Name + " rate limited the request for model " + model
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		// The router's credentials, not the client's, were refused.
+		e.Status, e.Code = http.StatusBadGateway, "provider_unavailable"
+		e.Message = "upstream " + provider.Name + " refused the router's credentials"
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		e.Status, e.Code = http.StatusGatewayTimeout, "timeout"
+		e.Message = "upstream " + provider.Name + " did not respond in time"
+	case status >= 500:
+		e.Status, e.Code = http.StatusBadGateway, "provider_unavailable"
+		e.Message = "upstream " + provider.Name + " failed the request for model " + model + " with " + strconv.Itoa(status)
+	default:
+		e.Status, e.Code = status, "invalid_request"
+		e.Message = "upstream " + provider.Name + " rejected the request for model " + model
+	}
+	e.Write(w)
+}
+
+// upstreamErrorMessage picks the message out of a provider's error body:
+// OpenAI's and Anthropic's {"error": {"message": ...}}, the {"message":
+// ...} or {"detail": ...} of most self-hosted servers, or plain text. An
+// HTML error page has none worth passing on.
+func upstreamErrorMessage(body []byte) string {
+	var doc struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		text := strings.TrimSpace(string(body))
+		if strings.HasPrefix(text, "<") {
+			return ""
+		}
+		return text
+	}
+	var nested struct {
+		Message string `json:"message"`
+	}
+	var plain string
+	switch {
+	case json.Unmarshal(doc.Error, &nested) == nil && nested.Message != "":
+		return nested.Message
+	case json.Unmarshal(doc.Error, &plain) == nil && plain != "":
+		return plain
+	case doc.Message != "":
+		return doc.Message
+	case json.Unmarshal(doc.Detail, &plain) == nil && plain != "":
+		return plain
+	case len(doc.Detail) > 0:
+		return string(doc.Detail)
+	}
+	return ""
+}
+
+// withErrorEnvelope answers the requests mux has no handler for in the
+// error envelope, where ServeMux would answer in plain text: 404 for a
+// path it does not serve, or 405 with its Allow header for a method it
+// does not serve the path for.
+func withErrorEnvelope(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		rec := &headerRecorder{header: make(http.Header)}
+		h.ServeHTTP(rec, r)
+		if rec.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", rec.header.Get("Allow"))
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not allowed on "+r.URL.Path)
+			return
+		}
+		writeError(w, http.StatusNotFound, "not_found", "no endpoint at "+r.URL.Path)
+	})
+}
+
+// headerRecorder keeps the status and headers a handler answers with and
+// drops its body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (h *headerRecorder) Header() http.Header         { return h.header }
+func (h *headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (h *headerRecorder) WriteHeader(status int)      { h.status = status }
+
+// writeDeadlineError answers a request for model that ran out of time in
+// phase with 504.
+func writeDeadlineError(w http.ResponseWriter, model, phase string) {
+	apierror.WriteWithDetails(w, http.StatusGatewayTimeout, "timeout",
+		"request for model "+model+" ran out of time while "+phase,
+		map[string]any{"phase": phase})
+}
+
+// peekModel reads the "model" field from a JSON body, or the form of a
+// multipart one, and restores the body so the handler can read it again.
+func peekModel(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	if isMultipart(r.Header) {
+		model, _ := peekFormModel(r)
+		return model
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		// Replay the read error too, so the handler still sees e.g. a MaxBytesError.
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return ""
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+// peekModelWithinLimit is peekModel for middleware that runs ahead of
+// LimitBody: it reads no more than the body limit, and an oversized body
+// still fails with a MaxBytesError once it reaches the handler. Peeking
+// at a multipart body reads no more than its start anyway.
+func (rt *Router) peekModelWithinLimit(r *http.Request) string {
+	if r.Body == nil || isMultipart(r.Header) {
+		return peekModel(r)
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, rt.registry.MaxBodyBytes())
+	return peekModel(r)
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
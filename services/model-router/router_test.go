@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aspendos/model-router/metrics"
+	"github.com/aspendos/model-router/middleware"
+)
+
+// newTestRouter builds a router for cfg without metrics or tracing.
+func newTestRouter(t *testing.T, cfg *Config) *Router {
+	t.Helper()
+	registry := NewModelRegistry(cfg, "", nil, nil, nil, nil, testLogger())
+	return NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger()))
+}
+
+// newMeteredRouter is newTestRouter counting into metrics of its own.
+func newMeteredRouter(t *testing.T, cfg *Config) (*Router, *metrics.Metrics) {
+	t.Helper()
+	m := metrics.New()
+	registry := NewModelRegistry(cfg, "", m, nil, nil, nil, testLogger())
+	return NewRouter(registry, m, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger())), m
+}
+
+// scrape returns what m serves on /metrics.
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+// routeChain is the chat completions handler with the middleware that
+// records responses to replay, in the order main puts them.
+func routeChain(t *testing.T, rt *Router) http.Handler {
+	t.Helper()
+	return routeChainTracked(t, rt, NewInFlight())
+}
+
+// routeChainTracked is routeChain with its requests tracked by inflight.
+func routeChainTracked(t *testing.T, rt *Router, inflight *InFlight) http.Handler {
+	t.Helper()
+	return withRouteMiddleware(t, rt, inflight, http.HandlerFunc(rt.handleRoute))
+}
+
+// withRouteMiddleware wraps h, one of the routed handlers, with routeChain's
+// middleware.
+func withRouteMiddleware(t *testing.T, rt *Router, inflight *InFlight, h http.Handler) http.Handler {
+	t.Helper()
+	store, err := NewMemoryIdempotencyStore(IdempotencyConfig{}.withDefaults().MaxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewResponseCache(nil, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return middleware.Chain(h,
+		rt.LimitBody,
+		inflight.Middleware,
+		NewIdempotentRouter(IdempotencyConfig{}, store, nil).Middleware,
+		NewCachingRouter(rt.registry, cache, nil).Middleware,
+		NewSingleFlightRouter(rt.registry, nil).Middleware,
+	)
+}
+
+func chatRequest(body string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, chatCompletionsPath, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// The content type is the model's to accept: only a body that cannot be
+// read for a model is turned away before routing.
+func TestAcceptedContentTypes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer backend.Close()
+	cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  plain: a
+  binary: {provider: a, accepted_content_types: [application/json, application/octet-stream]}
+  vendor: {provider: a, accepted_content_types: [application/vnd.acme+json]}
+`, backend.URL))
+	handler := routeChain(t, newTestRouter(t, cfg))
+
+	const messages = `"messages":[{"role":"user","content":"hi"}]`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{name: "json to the default", contentType: "application/json", body: `{"model":"plain",` + messages + `}`, want: http.StatusOK},
+		{name: "text to the default", contentType: "text/plain", body: `{"model":"plain",` + messages + `}`, want: http.StatusUnsupportedMediaType},
+		{name: "no content type", body: `{"model":"plain",` + messages + `}`, want: http.StatusUnsupportedMediaType},
+		{name: "octet-stream accepted", contentType: "application/octet-stream", body: `{"model":"binary",` + messages + `}`, want: http.StatusOK},
+		{name: "octet-stream refused", contentType: "application/octet-stream", body: `{"model":"plain",` + messages + `}`, want: http.StatusUnsupportedMediaType},
+		{name: "vendor type accepted", contentType: "application/vnd.acme+json", body: `{"model":"vendor",` + messages + `}`, want: http.StatusOK},
+		{name: "plain json refused by a vendor model", contentType: "application/json", body: `{"model":"vendor",` + messages + `}`, want: http.StatusUnsupportedMediaType},
+		{name: "malformed json", contentType: "application/json", body: `{"model":`, want: http.StatusBadRequest},
+		{name: "binary body", contentType: "application/octet-stream", body: "\x00\x01", want: http.StatusBadRequest},
+		{name: "missing messages", contentType: "application/octet-stream", body: `{"model":"binary"}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := chatRequest(tt.body)
+			if tt.contentType == "" {
+				req.Header.Del("Content-Type")
+			} else {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+// A model failing with a 5xx falls back to the next, which gets the request
+// under its own name. A fallback that cannot take the request is answered
+// for with 502, rather than with the failed model's response, which was
+// discarded to try it.
+func TestFallbacks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	var fallbackBodies []string
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fallbackBodies = append(fallbackBodies, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"from-fallback"}`)
+	}))
+	defer fallback.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  down: {base_url: %s}
+  up: {base_url: %s}
+models:
+  primary: {provider: down, fallbacks: [secondary]}
+  secondary: up
+`, backend.URL, fallback.URL)))
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		want     string
+		fallback string
+	}{
+		{name: "chat", body: `{"model":"primary","messages":[{"role":"user","content":"hi"}]}`,
+			status: http.StatusOK, want: `"from-fallback"`, fallback: `"model":"secondary"`},
+		{name: "payload not an object", body: `{"model":"primary","payload":[1,2,3]}`,
+			status: http.StatusBadGateway, want: `fallback secondary cannot take`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fallbackBodies = nil
+			rec := httptest.NewRecorder()
+			rt.handleRoute(rec, chatRequest(tt.body))
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Fatalf("got %d %s, want %d with %s", rec.Code, rec.Body, tt.status, tt.want)
+			}
+			switch {
+			case tt.fallback == "" && len(fallbackBodies) > 0:
+				t.Errorf("fallback got %q, want no request", fallbackBodies)
+			case tt.fallback != "" && (len(fallbackBodies) != 1 || !strings.Contains(fallbackBodies[0], tt.fallback)):
+				t.Errorf("fallback got %q, want one request with %s", fallbackBodies, tt.fallback)
+			}
+		})
+	}
+}
+
+// After a few requests, /metrics, served and instrumented the way main
+// wires it, counts them by route pattern, and the upstream attempts behind
+// them by provider, model and status.
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"model":"broken"`) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	defer upstream.Close()
+	rt, m := newMeteredRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+  gone: {base_url: http://127.0.0.1:1, retry: {max_attempts: 1, base_delay: 1ms, max_delay: 1ms, retry_on: [429]}}
+models:
+  m: a
+  broken: a
+  offline: gone
+`, upstream.URL)))
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.Handler())
+	mux.Handle("POST "+chatCompletionsPath, middleware.Chain(http.HandlerFunc(rt.handleRoute), m.Middleware))
+	srv := httptest.NewServer(m.HTTPMiddleware(mux))
+	defer srv.Close()
+
+	for model, want := range map[string]int{"m": http.StatusOK, "broken": http.StatusBadGateway, "offline": http.StatusBadGateway} {
+		for range 2 {
+			resp, err := http.Post(srv.URL+chatCompletionsPath, "application/json",
+				strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Fatalf("%s: status = %d, want %d", model, resp.StatusCode, want)
+			}
+		}
+	}
+	resp, err := http.Get(srv.URL + "/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("/metrics: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	out := string(body)
+	for _, want := range []string{
+		`http_requests_total{method="POST",path="POST /v1/chat/completions",status="200"} 2`,
+		`http_requests_total{method="POST",path="POST /v1/chat/completions",status="502"} 4`,
+		`http_requests_total{method="GET",path="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="POST",path="POST /v1/chat/completions"} 6`,
+		// The scrape is the one request in flight.
+		`http_requests_in_flight 1`,
+		`model_router_request_duration_seconds_count{method="POST",model="m",status_code="200"} 2`,
+		`model_router_request_duration_seconds_count{method="POST",model="offline",status_code="502"} 2`,
+		`model_router_upstream_requests_total{model="m",provider="a",status="200"} 2`,
+		`model_router_upstream_requests_total{model="broken",provider="a",status="500"} 2`,
+		`model_router_upstream_requests_total{model="offline",provider="gone",status="error"} 2`,
+		`model_router_upstream_latency_seconds_count{model="m",provider="a"} 2`,
+		`model_router_upstream_latency_seconds_bucket{model="m",provider="a",le="+Inf"} 2`,
+		`model_router_upstream_errors_total{error_type="status_5xx",model="broken"} 2`,
+		`model_router_upstream_errors_total{error_type="connection",model="offline"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// RouteOverride is a routing rule added or disabled through the admin API.
+// Overrides are held in memory only: they are layered over every config the
+// registry loads, reloads included, and are gone after a restart.
+type RouteOverride struct {
+	Rule RuleConfig
+	// Disabled removes the model or rule matching Rule.Match instead of
+	// adding one.
+	Disabled  bool
+	ChangedBy string
+	ChangedAt time.Time
+}
+
+// withOverrides returns a copy of cfg with the overrides applied in match
+// order. An override replaces any model or rule of the same match; a
+// disabled one only removes it. An override that does not validate against
+// cfg, say because its provider was removed from the file, is left out and
+// reported by match.
+func withOverrides(cfg *Config, overrides map[string]RouteOverride) (*Config, map[string]error) {
+	out := *cfg
+	out.Models = maps.Clone(cfg.Models)
+	out.Rules = slices.Clone(cfg.Rules)
+	skipped := make(map[string]error)
+	for _, match := range slices.Sorted(maps.Keys(overrides)) {
+		next := applyOverride(&out, overrides[match])
+		if err := next.Validate(); err != nil {
+			skipped[match] = err
+			continue
+		}
+		out = *next
+	}
+	return &out, skipped
+}
+
+func applyOverride(cfg *Config, ov RouteOverride) *Config {
+	out := *cfg
+	match := ov.Rule.Match
+	out.Models = maps.Clone(cfg.Models)
+	delete(out.Models, match)
+	out.Rules = slices.DeleteFunc(slices.Clone(cfg.Rules), func(rc RuleConfig) bool { return rc.Match == match })
+	if !ov.Disabled {
+		out.Rules = append(out.Rules, ov.Rule)
+	}
+	return &out
+}
+
+// SetRoute adds or replaces the override for ov.Rule.Match and rebuilds the
+// routing table with it. If the override does not validate, nothing
+// changes. Like a reload, the rebuild resets breakers and admin weight
+// changes.
+func (reg *ModelRegistry) SetRoute(ov RouteOverride) error {
+	reg.buildMu.Lock()
+	defer reg.buildMu.Unlock()
+	base, _ := withOverrides(reg.base, reg.overrides)
+	if err := applyOverride(base, ov).Validate(); err != nil {
+		return fmt.Errorf("route %q: %w", ov.Rule.Match, err)
+	}
+	overrides := maps.Clone(reg.overrides)
+	if overrides == nil {
+		overrides = make(map[string]RouteOverride)
+	}
+	overrides[ov.Rule.Match] = ov
+	reg.overrides = overrides
+	reg.rebuild()
+	return nil
+}
+
+// DeleteRoute drops the override for match, restoring whatever the config
+// file says about it. It reports false if there was no such override.
+func (reg *ModelRegistry) DeleteRoute(match string) bool {
+	reg.buildMu.Lock()
+	defer reg.buildMu.Unlock()
+	if _, ok := reg.overrides[match]; !ok {
+		return false
+	}
+	overrides := maps.Clone(reg.overrides)
+	delete(overrides, match)
+	reg.overrides = overrides
+	reg.rebuild()
+	return true
+}
+
+// RouteOverrides lists the overrides in effect, sorted by match.
+func (reg *ModelRegistry) RouteOverrides() []RouteOverride {
+	reg.buildMu.Lock()
+	defer reg.buildMu.Unlock()
+	out := make([]RouteOverride, 0, len(reg.overrides))
+	for _, match := range slices.Sorted(maps.Keys(reg.overrides)) {
+		out = append(out, reg.overrides[match])
+	}
+	return out
+}
+
+// rebuild swaps in a table built from the file config and the overrides;
+// reg.buildMu must be held.
+func (reg *ModelRegistry) rebuild() {
+	t := reg.build(reg.layered(reg.base))
+	reg.mu.Lock()
+	reg.table = t
+	reg.overridden = false
+	reg.mu.Unlock()
+}
+
+// layered adds the models of any Services to cfg and applies the
+// overrides, logging any that no longer fit it.
+func (reg *ModelRegistry) layered(cfg *Config) *Config {
+	cfg = reg.withServices(cfg)
+	if len(reg.overrides) == 0 {
+		return cfg
+	}
+	out, skipped := withOverrides(cfg, reg.overrides)
+	for match, err := range skipped {
+		reg.logger.Warn("route override no longer valid, skipping it", slog.String("match", match), slog.String("error", err.Error()))
+	}
+	return out
+}
+
+// Routes lists the active entries in the order lookups try them: rules
+// with conditions, exact model names alphabetically, then globs by
+// priority and specificity.
+func (reg *ModelRegistry) Routes() []*ModelEntry {
+	reg.mu.RLock()
+	t := reg.table
+	reg.mu.RUnlock()
+	out := make([]*ModelEntry, 0, len(t.conditional)+len(t.exact)+len(t.routes))
+	for _, r := range t.conditional {
+		out = append(out, r.entry)
+	}
+	exact := make([]*ModelEntry, 0, len(t.exact))
+	for _, e := range t.exact {
+		exact = append(exact, e)
+	}
+	sort.Slice(exact, func(i, j int) bool { return exact[i].Name < exact[j].Name })
+	out = append(out, exact...)
+	for _, r := range t.routes {
+		out = append(out, r.entry)
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// maxSchemaViolations bounds the violations listed in an error response.
+const maxSchemaViolations = 10
+
+// ResponseValidator checks a model's successful JSON responses against its
+// response_schema before they reach the client, so a backend that returns
+// truncated or malformed output fails the request instead of passing it
+// on. Event streams and error responses are not checked; a JSON response
+// is held back until all of it has arrived, however the upstream sent it.
+type ResponseValidator struct {
+	schema *jsonschema.Schema
+}
+
+// NewResponseValidator compiles the JSON Schema file at path.
+func NewResponseValidator(path string) (*ResponseValidator, error) {
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseValidator{schema: schema}, nil
+}
+
+// SchemaViolation is one failed schema keyword: where in the response it
+// failed and why.
+type SchemaViolation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// schemaError is an upstream response that is not valid JSON or does not
+// match the model's schema.
+type schemaError struct {
+	violations []SchemaViolation
+}
+
+func (e *schemaError) Error() string {
+	if len(e.violations) == 0 {
+		return "response does not match the schema"
+	}
+	v := e.violations[0]
+	return fmt.Sprintf("response does not match the schema at %q: %s", v.Path, v.Message)
+}
+
+// Validate reads resp's body, checks it and gives resp the same bytes back
+// to be read again. A nil validator accepts everything without reading.
+func (rv *ResponseValidator) Validate(resp *http.Response) error {
+	if rv == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return &schemaError{violations: []SchemaViolation{{Path: "", Message: "not valid JSON: " + err.Error()}}}
+	}
+	err = rv.schema.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	se := &schemaError{}
+	var collect func(*jsonschema.ValidationError)
+	collect = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 && len(se.violations) < maxSchemaViolations {
+			se.violations = append(se.violations, SchemaViolation{Path: ve.InstanceLocation, Message: ve.Message})
+		}
+		for _, c := range ve.Causes {
+			collect(c)
+		}
+	}
+	collect(ve)
+	return se
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const chatSchema = "testdata/schema/chat-completion.json"
+
+// completion is a chat completion whose content is about size bytes.
+func completion(size int) string {
+	return `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+		strings.Repeat("x", size) + `"}}],"usage":{"prompt_tokens":9,"completion_tokens":12}}`
+}
+
+// A response that does not match the model's schema is answered with 502
+// listing where it failed, and counted; one that does passes as the
+// upstream sent it, and errors and other content types are not checked.
+func TestResponseValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		want        int
+		violation   string
+	}{
+		{name: "valid", body: completion(10), want: http.StatusOK},
+		{name: "null content", body: strings.Replace(completion(0), `""`, `null`, 1), want: http.StatusOK},
+		{name: "missing field", body: `{"id":"chatcmpl-1","object":"chat.completion"}`, want: http.StatusBadGateway, violation: ""},
+		{name: "wrong type", body: strings.Replace(completion(10), `"index":0`, `"index":"0"`, 1), want: http.StatusBadGateway, violation: "/choices/0/index"},
+		{name: "no choices", body: `{"id":"chatcmpl-1","object":"chat.completion","choices":[]}`, want: http.StatusBadGateway, violation: "/choices"},
+		{name: "truncated", body: completion(10)[:40], want: http.StatusBadGateway, violation: ""},
+		{name: "not JSON", contentType: "text/plain", body: "not json", want: http.StatusOK},
+		{name: "upstream error", status: http.StatusBadRequest, body: `{"error":{"message":"bad"}}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ct := tt.contentType
+				if ct == "" {
+					ct = "application/json"
+				}
+				w.Header().Set("Content-Type", ct)
+				w.WriteHeader(max(tt.status, http.StatusOK))
+				io.WriteString(w, tt.body)
+			}))
+			defer upstream.Close()
+			rt, m := newMeteredRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a, response_schema: %s}
+`, upstream.URL, chatSchema)))
+			rec := httptest.NewRecorder()
+			routeChain(t, rt).ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d: %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+			failures := `router_response_validation_failures_total{model="m"} 1`
+			if tt.want != http.StatusBadGateway {
+				if tt.want == http.StatusOK && rec.Body.String() != tt.body {
+					t.Errorf("body = %s, want the upstream's %s", rec.Body, tt.body)
+				}
+				if strings.Contains(scrape(t, m), failures) {
+					t.Error("a passing response was counted as a failure")
+				}
+				return
+			}
+			var resp struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+				Violations []SchemaViolation `json:"violations"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Error.Code != "invalid_upstream_response" || len(resp.Violations) == 0 {
+				t.Fatalf("error = %s, want invalid_upstream_response with violations", rec.Body)
+			}
+			if got := resp.Violations[0].Path; got != tt.violation {
+				t.Errorf("violation at %q, want %q", got, tt.violation)
+			}
+			if !strings.Contains(scrape(t, m), failures) {
+				t.Errorf("missing %s", failures)
+			}
+		})
+	}
+}
+
+// A validated response can be read again byte for byte, and a nil
+// validator never reads it.
+func TestResponseValidatorKeepsBody(t *testing.T) {
+	rv, err := NewResponseValidator(chatSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := completion(1024)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	if err := rv.Validate(resp); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(resp.Body); string(got) != body {
+		t.Errorf("body after validation = %.40q, want the original", got)
+	}
+	var nilValidator *ResponseValidator
+	resp.Body = io.NopCloser(errReader{io.ErrUnexpectedEOF})
+	if err := nilValidator.Validate(resp); err != nil {
+		t.Errorf("nil validator read the body: %v", err)
+	}
+}
+
+// BenchmarkResponseValidator times validating a 1 KB chat completion,
+// which must stay under 5ms.
+func BenchmarkResponseValidator(b *testing.B) {
+	rv, err := NewResponseValidator(chatSchema)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := []byte(completion(1024 - len(completion(0))))
+	if len(body) != 1024 {
+		b.Fatalf("response is %d bytes, want 1 KB", len(body))
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for range b.N {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}
+		if err := rv.Validate(resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if per := b.Elapsed() / time.Duration(b.N); per > 5*time.Millisecond {
+		b.Errorf("validation took %v per response, over the 5ms budget", per)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// modelNameAnnotation on a Service names the model it serves, and
+	// modelPortAnnotation the port to reach it on, if the Service has more
+	// than one.
+	modelNameAnnotation = "aspendos.io/model-name"
+	modelPortAnnotation = "aspendos.io/model-port"
+
+	// serviceWatchSeconds is how long each watch of Services lasts before
+	// the API server ends it and the next picks up where it left off.
+	serviceWatchSeconds = 300
+	minServiceBackoff   = time.Second
+	maxServiceBackoff   = 30 * time.Second
+)
+
+// errWatchExpired is the API server saying a watch's resourceVersion is
+// too old to resume from, so Services must be listed again.
+var errWatchExpired = errors.New("watch expired")
+
+// K8sDiscovery finds models deployed as Kubernetes Services, for clusters
+// where backends come and go with their deployments rather than with the
+// config file. A Service annotated with aspendos.io/model-name serves that
+// model at its ClusterIP, on the port named by aspendos.io/model-port or
+// its only port, over http.
+//
+// It lists and then watches the Services in its namespace through the
+// API server, like an informer, so a Service is routed to, or dropped,
+// as soon as it is created, changed or deleted. The router needs to run
+// in the cluster with permission to list and watch Services there.
+// onChange runs, without the lock, whenever the models found change, for
+// the registry to rebuild its table with them.
+type K8sDiscovery struct {
+	namespace string
+	logger    *slog.Logger
+	onChange  func()
+	// backoff is how long run first waits to list again after the API
+	// server fails, doubling up to maxServiceBackoff while it keeps
+	// failing.
+	backoff time.Duration
+
+	mu sync.Mutex
+	// services is the model each annotated Service serves, by Service
+	// name.
+	services map[string]serviceModel
+}
+
+type serviceModel struct {
+	model string
+	url   string
+}
+
+// NewK8sDiscovery watches the Services in namespace, or the router's own
+// namespace if it is empty.
+func NewK8sDiscovery(namespace string, logger *slog.Logger) (*K8sDiscovery, error) {
+	if namespace == "" {
+		ns, err := serviceAccountNamespace()
+		if err != nil {
+			return nil, fmt.Errorf("finding the router's namespace: %w", err)
+		}
+		namespace = ns
+	}
+	return &K8sDiscovery{namespace: namespace, logger: logger, backoff: minServiceBackoff, services: make(map[string]serviceModel)}, nil
+}
+
+// Models returns a backend for each model found, pointed at its Service.
+// A model claimed by more than one Service goes to the first by name. It
+// is safe to call on a nil K8sDiscovery, which finds nothing.
+func (kd *K8sDiscovery) Models() map[string]BackendConfig {
+	if kd == nil {
+		return nil
+	}
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	models := make(map[string]BackendConfig, len(kd.services))
+	for _, name := range sortedKeys(kd.services) {
+		sm := kd.services[name]
+		if _, taken := models[sm.model]; !taken {
+			models[sm.model] = BackendConfig{URL: sm.url}
+		}
+	}
+	return models
+}
+
+// run keeps the models in step with the Services until ctx ends, going on
+// from the first list's version and err. While the API server cannot be
+// reached, the models last found stay routed.
+func (kd *K8sDiscovery) run(ctx context.Context, version string, err error) {
+	backoff := kd.backoff
+	failing := false
+	for first := true; ; first = false {
+		if !first {
+			version, err = kd.list(ctx)
+		}
+		if err == nil && failing {
+			failing = false
+			kd.logger.Info("watching model services recovered", slog.String("namespace", kd.namespace))
+		}
+		for err == nil {
+			if version, err = kd.watch(ctx, version); err == nil {
+				backoff = kd.backoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errWatchExpired) {
+			continue
+		}
+		if !failing {
+			kd.logger.Warn("watching model services failed; keeping the models found",
+				slog.String("namespace", kd.namespace), slog.String("error", err.Error()))
+		}
+		failing = true
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxServiceBackoff)
+	}
+}
+
+// service is the part of a Kubernetes Service discovery reads.
+type service struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		ClusterIP string `json:"clusterIP"`
+		Ports     []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// list replaces the models with those of the Services there are now, and
+// returns the resourceVersion to watch from.
+func (kd *K8sDiscovery) list(ctx context.Context) (string, error) {
+	resp, err := kubernetesGet(ctx, "/api/v1/namespaces/"+url.PathEscape(kd.namespace)+"/services")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("listing services: Kubernetes API answered %s", resp.Status)
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []service `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("listing services: %w", err)
+	}
+	services := make(map[string]serviceModel)
+	for _, svc := range list.Items {
+		if sm, ok := kd.serviceModel(svc); ok {
+			services[svc.Metadata.Name] = sm
+		}
+	}
+	kd.mu.Lock()
+	prev := kd.services
+	kd.services = services
+	kd.mu.Unlock()
+	changed := false
+	for _, name := range sortedKeys(prev) {
+		if _, ok := services[name]; !ok {
+			kd.logRemoved(name, prev[name])
+			changed = true
+		}
+	}
+	for _, name := range sortedKeys(services) {
+		if sm, ok := prev[name]; !ok || sm != services[name] {
+			kd.logAdded(name, services[name])
+			changed = true
+		}
+	}
+	if changed {
+		kd.changed()
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies Service events from version on until the API server ends
+// the watch, and returns the version to resume from.
+func (kd *K8sDiscovery) watch(ctx context.Context, version string) (string, error) {
+	resp, err := kubernetesGet(ctx, "/api/v1/namespaces/"+url.PathEscape(kd.namespace)+"/services?watch=1&allowWatchBookmarks=true"+
+		"&timeoutSeconds="+strconv.Itoa(serviceWatchSeconds)+"&resourceVersion="+url.QueryEscape(version))
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return version, errWatchExpired
+	default:
+		return version, fmt.Errorf("watching services: Kubernetes API answered %s", resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return version, ctx.Err()
+			}
+			// The API server ending the watch at timeoutSeconds.
+			return version, nil
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errWatchExpired
+			}
+			return version, fmt.Errorf("watching services: %s", status.Message)
+		}
+		var svc service
+		if err := json.Unmarshal(event.Object, &svc); err != nil {
+			return version, fmt.Errorf("watching services: %w", err)
+		}
+		version = svc.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			kd.apply(svc.Metadata.Name, svc, true)
+		case "DELETED":
+			kd.apply(svc.Metadata.Name, svc, false)
+		}
+	}
+}
+
+// apply records the Service named name as it is now, or as gone if not
+// exists.
+func (kd *K8sDiscovery) apply(name string, svc service, exists bool) {
+	sm, ok := serviceModel{}, false
+	if exists {
+		sm, ok = kd.serviceModel(svc)
+	}
+	kd.mu.Lock()
+	prev, had := kd.services[name]
+	if ok {
+		kd.services[name] = sm
+	} else {
+		delete(kd.services, name)
+	}
+	kd.mu.Unlock()
+	switch {
+	case ok && (!had || prev != sm):
+		kd.logAdded(name, sm)
+	case !ok && had:
+		kd.logRemoved(name, prev)
+	default:
+		return
+	}
+	kd.changed()
+}
+
+// serviceModel returns the model svc serves, if it is annotated with one
+// and can be reached.
+func (kd *K8sDiscovery) serviceModel(svc service) (serviceModel, bool) {
+	model := svc.Metadata.Annotations[modelNameAnnotation]
+	if model == "" {
+		return serviceModel{}, false
+	}
+	skip := func(reason string) (serviceModel, bool) {
+		kd.logger.Warn("model service skipped", slog.String("service", svc.Metadata.Name),
+			slog.String("model", model), slog.String("reason", reason))
+		return serviceModel{}, false
+	}
+	ip := svc.Spec.ClusterIP
+	if ip == "" || ip == "None" {
+		return skip("the service has no cluster IP; route to a headless service with provider discovery instead")
+	}
+	port := 0
+	if v, ok := svc.Metadata.Annotations[modelPortAnnotation]; ok {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 {
+			return skip(fmt.Sprintf("%s: %q is not a valid port", modelPortAnnotation, v))
+		}
+		port = p
+	} else if len(svc.Spec.Ports) == 1 {
+		port = svc.Spec.Ports[0].Port
+	} else {
+		return skip(fmt.Sprintf("the service has %d ports; %s must name one", len(svc.Spec.Ports), modelPortAnnotation))
+	}
+	return serviceModel{model: model, url: "http://" + net.JoinHostPort(ip, strconv.Itoa(port))}, true
+}
+
+func (kd *K8sDiscovery) logAdded(name string, sm serviceModel) {
+	kd.logger.Info("model service found", slog.String("service", name), slog.String("model", sm.model), slog.String("url", sm.url))
+}
+
+func (kd *K8sDiscovery) logRemoved(name string, sm serviceModel) {
+	kd.logger.Info("model service gone", slog.String("service", name), slog.String("model", sm.model))
+}
+
+func (kd *K8sDiscovery) changed() {
+	if kd.onChange != nil {
+		kd.onChange()
+	}
+}
+
+// withServices returns cfg with a model for each one the registry's
+// Services serve. A model the config defines, or names as an alias, keeps
+// its config.
+func (reg *ModelRegistry) withServices(cfg *Config) *Config {
+	models := reg.services.Models()
+	if len(models) == 0 {
+		return cfg
+	}
+	out := *cfg
+	out.Models = maps.Clone(cfg.Models)
+	for _, name := range slices.Sorted(maps.Keys(models)) {
+		_, defined := cfg.Models[name]
+		_, aliased := cfg.Aliases[name]
+		if defined || aliased {
+			reg.logger.Warn("model service ignored; the config defines the model", slog.String("model", name))
+			continue
+		}
+		out.Models[name] = models[name]
+	}
+	return &out
+}
+
+// WatchServices routes the models kd finds alongside the config's, and
+// rebuilds the table whenever they change, until ctx ends. The Services
+// there are already are listed before it returns, so the router starts out
+// routing them.
+func (reg *ModelRegistry) WatchServices(ctx context.Context, kd *K8sDiscovery) {
+	listCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	version, err := kd.list(listCtx)
+	cancel()
+	reg.buildMu.Lock()
+	reg.services = kd
+	reg.rebuild()
+	reg.buildMu.Unlock()
+	kd.onChange = reg.targetsChanged
+	go kd.run(ctx, version, err)
+}
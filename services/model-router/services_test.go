@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeAPIServer is a Kubernetes API server serving the Services in
+// namespace "models" from items, and streaming the watch events sent on
+// events to whichever watch is open. An empty event ends the watch, as
+// does an ERROR.
+type fakeAPIServer struct {
+	events chan string
+
+	mu            sync.Mutex
+	items         []string
+	version       string
+	down          bool
+	failed        int
+	lists         int
+	watchVersions []string
+	pods          string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer sa-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	if s.down {
+		s.failed++
+		s.mu.Unlock()
+		http.Error(w, "etcd is unavailable", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case r.URL.Path == "/api/v1/namespaces/models/pods":
+		pods := s.pods
+		s.mu.Unlock()
+		fmt.Fprint(w, pods)
+	case r.URL.Path != "/api/v1/namespaces/models/services":
+		s.mu.Unlock()
+		http.NotFound(w, r)
+	case r.URL.Query().Get("watch") == "":
+		s.lists++
+		body := fmt.Sprintf(`{"metadata":{"resourceVersion":%q},"items":[%s]}`, s.version, strings.Join(s.items, ","))
+		s.mu.Unlock()
+		fmt.Fprint(w, body)
+	default:
+		s.watchVersions = append(s.watchVersions, r.URL.Query().Get("resourceVersion"))
+		s.mu.Unlock()
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-s.events:
+				if ev == "" {
+					return
+				}
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+				if strings.Contains(ev, `"type":"ERROR"`) {
+					// The API server ends a watch after an error.
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *fakeAPIServer) set(f func(s *fakeAPIServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *fakeAPIServer) get(f func(s *fakeAPIServer) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return f(s)
+}
+
+// inCluster runs api as the cluster's API server, over TLS, and gives the
+// router a service account for it in namespace "models".
+func inCluster(t *testing.T, api http.Handler) {
+	t.Helper()
+	srv := httptest.NewTLSServer(api)
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	for name, content := range map[string][]byte{"token": []byte("sa-token\n"), "ca.crt": ca, "namespace": []byte("models\n")} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	prevDir := serviceAccountDir
+	serviceAccountDir = dir
+	resetClient := func() {
+		kubernetesClientOnce = sync.Once{}
+		kubernetesHTTPClient, kubernetesClientErr = nil, nil
+	}
+	resetClient()
+	t.Cleanup(func() {
+		serviceAccountDir = prevDir
+		resetClient()
+	})
+}
+
+// serviceJSON is a Service named name at version, annotated as serving
+// model on port at ip.
+func serviceJSON(name, version, model, ip string, port int) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"resourceVersion":%q,"annotations":{%q:%q}},"spec":{"clusterIP":%q,"ports":[{"name":"http","port":%d}]}}`,
+		name, version, modelNameAnnotation, model, ip, port)
+}
+
+func watchEvent(kind, object string) string {
+	return fmt.Sprintf(`{"type":%q,"object":%s}`, kind, object)
+}
+
+// modelURLs is the URL kd routes each model it found to.
+func modelURLs(kd *K8sDiscovery) string {
+	models := kd.Models()
+	var urls []string
+	for _, name := range sortedKeys(models) {
+		urls = append(urls, name+"="+models[name].URL)
+	}
+	return strings.Join(urls, " ")
+}
+
+// The watch loop follows Services being created, changed and deleted,
+// resumes each watch where the last ended, lists again when the API
+// server expires its version, and keeps the models found while the API
+// server is down.
+func TestK8sDiscoveryWatch(t *testing.T) {
+	api := &fakeAPIServer{
+		events:  make(chan string),
+		version: "10",
+		items:   []string{serviceJSON("llama", "9", "llama-3", "10.0.0.1", 8000)},
+	}
+	inCluster(t, api)
+	kd, err := NewK8sDiscovery("", testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kd.namespace != "models" {
+		t.Fatalf("namespace = %q, want the service account's", kd.namespace)
+	}
+	kd.backoff = 5 * time.Millisecond
+	var changes sync.WaitGroup
+	kd.onChange = func() { changes.Done() }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes.Add(1)
+	version, err := kd.list(ctx)
+	if err != nil || version != "10" {
+		t.Fatalf("list = %q, %v, want version 10", version, err)
+	}
+	changes.Wait()
+	if got := modelURLs(kd); got != "llama-3=http://10.0.0.1:8000" {
+		t.Fatalf("models after the list = %q", got)
+	}
+	go kd.run(ctx, version, err)
+
+	steps := []struct {
+		name  string
+		event string
+		want  string
+	}{
+		{name: "added", event: watchEvent("ADDED", serviceJSON("qwen", "11", "qwen-2", "10.0.0.2", 9000)),
+			want: "llama-3=http://10.0.0.1:8000 qwen-2=http://10.0.0.2:9000"},
+		{name: "modified", event: watchEvent("MODIFIED", serviceJSON("llama", "12", "llama-3", "10.0.0.3", 8000)),
+			want: "llama-3=http://10.0.0.3:8000 qwen-2=http://10.0.0.2:9000"},
+		{name: "deleted", event: watchEvent("DELETED", serviceJSON("qwen", "13", "qwen-2", "10.0.0.2", 9000)),
+			want: "llama-3=http://10.0.0.3:8000"},
+	}
+	for _, step := range steps {
+		changes.Add(1)
+		api.events <- step.event
+		changes.Wait()
+		if got := modelURLs(kd); got != step.want {
+			t.Fatalf("after %s: models = %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	// A bookmark moves the version on without changing anything.
+	api.events <- watchEvent("BOOKMARK", `{"metadata":{"resourceVersion":"14"}}`)
+	api.events <- ""
+	waitFor(t, "the watch to resume", func() bool {
+		return api.get(func(s *fakeAPIServer) bool { return len(s.watchVersions) == 2 })
+	})
+	api.get(func(s *fakeAPIServer) bool {
+		if fmt.Sprint(s.watchVersions) != "[10 14]" || s.lists != 1 {
+			t.Errorf("watched from %v after %d lists, want [10 14] after 1", s.watchVersions, s.lists)
+		}
+		return true
+	})
+
+	// An expired version is listed again, which drops what went missing
+	// meanwhile.
+	api.set(func(s *fakeAPIServer) {
+		s.version = "20"
+		s.items = []string{serviceJSON("mistral", "19", "mistral-7b", "10.0.0.4", 8080)}
+	})
+	changes.Add(1)
+	api.events <- watchEvent("ERROR", `{"kind":"Status","code":410,"message":"too old resource version: 14 (19)"}`)
+	changes.Wait()
+	if got := modelURLs(kd); got != "mistral-7b=http://10.0.0.4:8080" {
+		t.Fatalf("models after the relist = %q", got)
+	}
+	waitFor(t, "the watch to resume from the new list", func() bool {
+		return api.get(func(s *fakeAPIServer) bool { return s.watchVersions[len(s.watchVersions)-1] == "20" })
+	})
+
+	// While the API server fails, the models found stay routed.
+	api.set(func(s *fakeAPIServer) { s.down = true })
+	api.events <- ""
+	waitFor(t, "the next watch to fail", func() bool {
+		return api.get(func(s *fakeAPIServer) bool { return s.failed > 0 })
+	})
+	if got := modelURLs(kd); got != "mistral-7b=http://10.0.0.4:8080" {
+		t.Fatalf("models while the API server is down = %q", got)
+	}
+	api.set(func(s *fakeAPIServer) { s.down = false })
+	waitFor(t, "the watch to recover", func() bool {
+		return api.get(func(s *fakeAPIServer) bool { return s.lists == 3 && len(s.watchVersions) == 4 })
+	})
+	changes.Add(1)
+	api.events <- watchEvent("ADDED", serviceJSON("qwen", "21", "qwen-2", "10.0.0.2", 9000))
+	changes.Wait()
+	if got := modelURLs(kd); got != "mistral-7b=http://10.0.0.4:8080 qwen-2=http://10.0.0.2:9000" {
+		t.Errorf("models after recovering = %q", got)
+	}
+}
+
+func TestReadyPods(t *testing.T) {
+	api := &fakeAPIServer{pods: `{"items":[
+		{"status":{"phase":"Running","podIP":"10.1.0.1","conditions":[{"type":"Ready","status":"True"}]}},
+		{"status":{"phase":"Running","podIP":"10.1.0.2","conditions":[{"type":"Ready","status":"False"}]}},
+		{"status":{"phase":"Pending","podIP":"10.1.0.3"}},
+		{"metadata":{"deletionTimestamp":"2026-01-01T00:00:00Z"},"status":{"phase":"Running","podIP":"10.1.0.4","conditions":[{"type":"Ready","status":"True"}]}},
+		{"status":{"phase":"Running","podIP":"10.1.0.5","conditions":[{"type":"PodScheduled","status":"True"},{"type":"Ready","status":"True"}]}}
+	]}`}
+	inCluster(t, api)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ips, err := readyPods(ctx, "", "app=vllm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ips) != "[10.1.0.1 10.1.0.5]" {
+		t.Errorf("ready pods = %v, want the running, ready ones not terminating", ips)
+	}
+
+	api.set(func(s *fakeAPIServer) { s.down = true })
+	if _, err := readyPods(ctx, "", "app=vllm"); err == nil {
+		t.Error("readyPods succeeded while the API server failed")
+	}
+}
+
+// clientsetAPIServer serves list and watch of the Services in cs, a
+// client-go fake clientset, as the API server would, and sends on watching
+// each time a watch has started.
+type clientsetAPIServer struct {
+	cs       *fake.Clientset
+	watching chan struct{}
+}
+
+func (s *clientsetAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns, ok := strings.CutPrefix(r.URL.Path, "/api/v1/namespaces/")
+	ns, ok2 := strings.CutSuffix(ns, "/services")
+	if !ok || !ok2 || r.Header.Get("Authorization") != "Bearer sa-token" {
+		http.NotFound(w, r)
+		return
+	}
+	services := s.cs.CoreV1().Services(ns)
+	if r.URL.Query().Get("watch") == "" {
+		list, err := services.List(r.Context(), metav1.ListOptions{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	watcher, err := services.Watch(r.Context(), metav1.ListOptions{ResourceVersion: r.URL.Query().Get("resourceVersion")})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer watcher.Stop()
+	w.(http.Flusher).Flush()
+	s.watching <- struct{}{}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			enc.Encode(map[string]any{"type": ev.Type, "object": ev.Object})
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func modelService(name, version, model, ip string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "models",
+			ResourceVersion: version,
+			Annotations:     map[string]string{modelNameAnnotation: model},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: ip,
+			Ports:     []corev1.ServicePort{{Name: "http", Port: port}},
+		},
+	}
+}
+
+// Services created, updated and deleted through client-go are routed to,
+// moved and dropped as they change, and Services without the annotation
+// are left alone.
+func TestK8sDiscoveryClientset(t *testing.T) {
+	cs := fake.NewClientset(
+		modelService("llama", "1", "llama-3", "10.0.0.1", 8000),
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "models"}, Spec: corev1.ServiceSpec{ClusterIP: "10.0.0.9"}},
+	)
+	api := &clientsetAPIServer{cs: cs, watching: make(chan struct{}, 1)}
+	inCluster(t, api)
+	kd, err := NewK8sDiscovery("", testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes sync.WaitGroup
+	kd.onChange = func() { changes.Done() }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes.Add(1)
+	version, err := kd.list(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes.Wait()
+	if got := modelURLs(kd); got != "llama-3=http://10.0.0.1:8000" {
+		t.Fatalf("models after the list = %q", got)
+	}
+	go kd.run(ctx, version, err)
+	<-api.watching
+
+	services := cs.CoreV1().Services("models")
+	steps := []struct {
+		name   string
+		change func() error
+		want   string
+	}{
+		{
+			name: "added",
+			change: func() error {
+				_, err := services.Create(ctx, modelService("qwen", "2", "qwen-2", "10.0.0.2", 9000), metav1.CreateOptions{})
+				return err
+			},
+			want: "llama-3=http://10.0.0.1:8000 qwen-2=http://10.0.0.2:9000",
+		},
+		{
+			name: "updated",
+			change: func() error {
+				_, err := services.Update(ctx, modelService("llama", "3", "llama-3", "10.0.0.3", 8000), metav1.UpdateOptions{})
+				return err
+			},
+			want: "llama-3=http://10.0.0.3:8000 qwen-2=http://10.0.0.2:9000",
+		},
+		{
+			name: "annotation removed",
+			change: func() error {
+				svc := modelService("qwen", "4", "qwen-2", "10.0.0.2", 9000)
+				svc.Annotations = nil
+				_, err := services.Update(ctx, svc, metav1.UpdateOptions{})
+				return err
+			},
+			want: "llama-3=http://10.0.0.3:8000",
+		},
+		{
+			name:   "deleted",
+			change: func() error { return services.Delete(ctx, "llama", metav1.DeleteOptions{}) },
+			want:   "",
+		},
+	}
+	for _, step := range steps {
+		changes.Add(1)
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		changes.Wait()
+		if got := modelURLs(kd); got != step.want {
+			t.Fatalf("after %s: models = %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	// Changing a Service the router does not route leaves the models be.
+	svc, err := services.Get(ctx, "redis", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Labels = map[string]string{"tier": "cache"}
+	if _, err := services.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	changes.Add(1)
+	if _, err := services.Create(ctx, modelService("mistral", "5", "mistral-7b", "10.0.0.4", 8080), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	changes.Wait()
+	if got := modelURLs(kd); got != "mistral-7b=http://10.0.0.4:8080" {
+		t.Errorf("models = %q, want only mistral-7b", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// Shadow is a model's dark-launch target: a sample of requests is mirrored
+// to it and the answer thrown away.
+type Shadow struct {
+	Provider   *Provider
+	Model      string
+	Timeout    time.Duration
+	SampleRate float64
+	// slots holds a token per shadow call in flight. It belongs to the
+	// routing table, so a reload starts the count afresh.
+	slots chan struct{}
+}
+
+// shadowOutcome is how one side of a mirrored request went. Status 0 means
+// no response arrived.
+type shadowOutcome struct {
+	backend string
+	status  int
+	bytes   int64
+	latency time.Duration
+}
+
+// shadowComparison carries the primary's outcome to the shadow call, which
+// logs the two side by side once both are known.
+type shadowComparison struct {
+	primary chan shadowOutcome
+}
+
+// Done reports the primary's outcome. It never blocks.
+func (c *shadowComparison) Done(o shadowOutcome) { c.primary <- o }
+
+// mirror sends a copy of the request to the entry's shadow backend in the
+// background if it is sampled and the shadow has a free slot. It never
+// blocks the caller; the outcome shows up in the shadow_* metrics and a
+// "shadow comparison" log line, which waits for the caller to report the
+// primary's through Done. primaryTimeout is the deadline of the real
+// request; the shadow gets twice that unless configured. mirror returns
+// nil when the request is not mirrored.
+func (rt *Router) mirror(ctx context.Context, path, model string, s *Shadow, body []byte, header http.Header, primaryTimeout time.Duration) *shadowComparison {
+	if s.SampleRate < 1 && rand.Float64() >= s.SampleRate {
+		return nil
+	}
+	if s.Model != "" {
+		rewritten, err := withModel(body, s.Model)
+		if err != nil {
+			rt.logger.Debug("shadow request skipped", slog.String("model", model), slog.String("error", err.Error()))
+			return nil
+		}
+		body = rewritten
+	}
+	p := s.Provider
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		rt.metrics.ShadowDropped(model, p.Name)
+		return nil
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 2 * primaryTimeout
+	}
+	requestID := middleware.RequestIDFrom(ctx)
+	// The shadow call outlives the client's request, so it must not share
+	// its cancellation.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	header = header.Clone()
+	if requestID != "" {
+		header.Set(middleware.RequestIDHeader, requestID)
+	}
+	cmp := &shadowComparison{primary: make(chan shadowOutcome, 1)}
+
+	go func() {
+		defer cancel()
+		start := time.Now()
+		status, size, err := rt.shadowCall(ctx, p, path, body, header)
+		<-s.slots
+		shadow := shadowOutcome{backend: p.Name, status: status, bytes: size, latency: time.Since(start)}
+		rt.metrics.ShadowRequest(model, p.Name, status, shadow.latency, size)
+		attrs := []any{
+			slog.String("request_id", requestID),
+			slog.String("model", model),
+			slog.String("backend", p.Name),
+		}
+		if err != nil {
+			rt.logger.Debug("shadow request failed", append(attrs, slog.String("error", err.Error()))...)
+		}
+
+		// A streamed primary may still be running; no slot is held while
+		// waiting for it.
+		primary := <-cmp.primary
+		rt.logger.Info("shadow comparison", append(attrs,
+			slog.String("primary_backend", primary.backend),
+			slog.Int("primary_status", primary.status),
+			slog.Int("shadow_status", shadow.status),
+			slog.Bool("status_match", primary.status == shadow.status),
+			slog.Int64("primary_latency_ms", primary.latency.Milliseconds()),
+			slog.Int64("shadow_latency_ms", shadow.latency.Milliseconds()),
+			slog.Int64("primary_bytes", primary.bytes),
+			slog.Int64("shadow_bytes", shadow.bytes),
+		)...)
+	}()
+	return cmp
+}
+
+// shadowCall bypasses forward: no retries, breakers or readiness tracking,
+// so a failing shadow cannot influence how real traffic is routed.
+// It returns the status and the size of the body read.
+func (rt *Router) shadowCall(ctx context.Context, p *Provider, path string, body []byte, header http.Header) (int, int64, error) {
+	path, body, err := translateRequest(p, path, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(p.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header = header
+	authorize(p, req.Header)
+	resp, err := rt.clientFor(p).Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	// Read the whole answer so the latency covers full generation, as it
+	// would for a client.
+	n, err := io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, n, err
+}
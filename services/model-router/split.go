@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand/v2"
+	"time"
+)
+
+// ClientIDHeader identifies the caller for sticky A/B assignment.
+const ClientIDHeader = "X-Client-ID"
+
+// TrafficSplit is the compiled form of a traffic_split. Variants own
+// consecutive ranges of 100 buckets in configuration order.
+type TrafficSplit struct {
+	Experiment string
+	Window     time.Duration
+	Variants   []*Variant
+}
+
+type Variant struct {
+	Name    string
+	Percent int
+	Model   string
+	Pool    *BackendPool
+}
+
+// Assign returns the variant for clientID at now. The bucket depends only
+// on the client, the experiment and the window, so every router replica
+// agrees without shared state. Requests without a client ID are assigned
+// at random.
+func (s *TrafficSplit) Assign(clientID string, now time.Time) *Variant {
+	bucket := rand.IntN(100)
+	if clientID != "" {
+		h := fnv.New32a()
+		h.Write([]byte(clientID + s.Experiment))
+		if s.Window > 0 {
+			h.Write(binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()/int64(s.Window))))
+		}
+		bucket = int(h.Sum32() % 100)
+	}
+	for _, v := range s.Variants {
+		if bucket < v.Percent {
+			return v
+		}
+		bucket -= v.Percent
+	}
+	return s.Variants[len(s.Variants)-1]
+}
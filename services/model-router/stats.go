@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	// statsWindow is how far back /metrics/models looks.
+	statsWindow = 5 * time.Minute
+	// statsRingSize is the samples kept per model: at more than
+	// statsRingSize requests per window, the statistics cover the latest
+	// statsRingSize of them.
+	statsRingSize = 4096
+	// maxStatsModels bounds the models tracked, as requests name models
+	// the registry may not route.
+	maxStatsModels = 1024
+
+	// A sample packs, into one word, the second it completed in (counted
+	// from the aggregator's start, plus one so zero is an empty slot) in
+	// the high 32 bits, whether it failed in the next, and its duration in
+	// microseconds, capped, in the low 31.
+	sampleErrorBit    = 1 << 31
+	maxSampleDuration = sampleErrorBit - 1
+)
+
+// StatsAggregator keeps recent request durations and outcomes per model,
+// for the SLA summary /metrics/models serves to dashboards and alerting
+// webhooks that do not speak the Prometheus exposition format. Recording
+// a request takes no lock: each model has a ring of samples written with
+// atomic operations, so concurrent requests never wait on each other, and
+// a summary may miss a sample being overwritten as it is read.
+type StatsAggregator struct {
+	registry *ModelRegistry
+	start    time.Time
+
+	models  sync.Map // model name to *statsRing
+	tracked atomic.Int64
+}
+
+type statsRing struct {
+	next  atomic.Uint64
+	slots [statsRingSize]atomic.Uint64
+}
+
+func NewStatsAggregator(registry *ModelRegistry) *StatsAggregator {
+	return &StatsAggregator{registry: registry, start: time.Now()}
+}
+
+// ModelStats is one model's row of /metrics/models over the last five
+// minutes. Errors are responses of status 500 and above: the router's or
+// the upstream's failures, not the client's.
+type ModelStats struct {
+	Model            string  `json:"model"`
+	RPS              float64 `json:"rps"`
+	P50Ms            float64 `json:"p50_ms"`
+	P95Ms            float64 `json:"p95_ms"`
+	P99Ms            float64 `json:"p99_ms"`
+	ErrorRatePercent float64 `json:"error_rate_percent"`
+	BackendCount     int     `json:"backend_count"`
+}
+
+// Record notes a request for model that took d and failed or not, at now.
+func (s *StatsAggregator) Record(model string, d time.Duration, failed bool, now time.Time) {
+	if s == nil || model == "" {
+		return
+	}
+	ring, ok := s.models.Load(model)
+	if !ok {
+		if s.tracked.Load() >= maxStatsModels {
+			return
+		}
+		var loaded bool
+		if ring, loaded = s.models.LoadOrStore(model, &statsRing{}); !loaded {
+			s.tracked.Add(1)
+		}
+	}
+	r := ring.(*statsRing)
+	i := r.next.Add(1) - 1
+	r.slots[i%statsRingSize].Store(s.pack(d, failed, now))
+}
+
+func (s *StatsAggregator) pack(d time.Duration, failed bool, now time.Time) uint64 {
+	sec := uint64(now.Sub(s.start)/time.Second) + 1
+	us := uint64(min(max(d.Microseconds(), 0), maxSampleDuration))
+	if failed {
+		us |= sampleErrorBit
+	}
+	return sec<<32 | us
+}
+
+// Middleware records every request under the model it was routed as, or
+// the model it asked for if no backend was found for it, once it has been
+// answered.
+func (s *StatsAggregator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requested := peekModel(r)
+		r, info := middleware.WithRequestInfo(r)
+		rw := middleware.WrapResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		now := time.Now()
+		model, _ := info.Route()
+		if model == "" {
+			model = requested
+		}
+		s.Record(model, now.Sub(start), rw.StatusCode() >= http.StatusInternalServerError, now)
+	})
+}
+
+// Stats summarizes the last statsWindow before now for every model of the
+// routing table, models without requests included, sorted by name.
+func (s *StatsAggregator) Stats(now time.Time) []ModelStats {
+	entries, _ := s.registry.Models()
+	out := make([]ModelStats, 0, len(entries))
+	for _, e := range entries {
+		st := ModelStats{Model: e.Name, BackendCount: len(e.Backends())}
+		if ring, ok := s.models.Load(e.Name); ok {
+			s.summarize(ring.(*statsRing), now, &st)
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+func (s *StatsAggregator) summarize(r *statsRing, now time.Time, st *ModelStats) {
+	nowSec := uint64(now.Sub(s.start)/time.Second) + 1
+	fromSec := uint64(0)
+	if w := uint64(statsWindow / time.Second); nowSec > w {
+		fromSec = nowSec - w
+	}
+	durations := make([]float64, 0, statsRingSize)
+	failures := 0
+	oldest := nowSec
+	for i := range r.slots {
+		v := r.slots[i].Load()
+		sec := v >> 32
+		if sec == 0 || sec < fromSec {
+			continue
+		}
+		oldest = min(oldest, sec)
+		if v&sampleErrorBit != 0 {
+			failures++
+		}
+		durations = append(durations, float64(v&maxSampleDuration)/1000)
+	}
+	if len(durations) == 0 {
+		return
+	}
+	// With the ring full of samples inside the window, requests came
+	// faster than it holds, and the rate is that of the samples kept.
+	span := min(now.Sub(s.start), statsWindow).Seconds()
+	if r.next.Load() > statsRingSize && len(durations) == statsRingSize {
+		span = max(float64(nowSec-oldest), 1)
+	}
+	slices.Sort(durations)
+	st.RPS = round2(float64(len(durations)) / max(span, 1))
+	st.P50Ms = percentile(durations, 50)
+	st.P95Ms = percentile(durations, 95)
+	st.P99Ms = percentile(durations, 99)
+	st.ErrorRatePercent = round2(100 * float64(failures) / float64(len(durations)))
+}
+
+// percentile is the nearest-rank pth percentile of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return round2(sorted[max(rank, 1)-1])
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// ServeModels serves GET /metrics/models.
+func (s *StatsAggregator) ServeModels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Stats(time.Now()))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStatsAggregator aggregates for models m and n, as if it had started
+// ten minutes before now.
+func newStatsAggregator(t *testing.T, now time.Time) *StatsAggregator {
+	t.Helper()
+	rt := newTestRouter(t, testConfig(t, `
+providers:
+  a: {base_url: "http://127.0.0.1:1"}
+models:
+  m: a
+  n: a
+`))
+	s := NewStatsAggregator(rt.registry)
+	s.start = now.Add(-10 * time.Minute)
+	return s
+}
+
+func statsOf(t *testing.T, s *StatsAggregator, now time.Time, model string) ModelStats {
+	t.Helper()
+	for _, st := range s.Stats(now) {
+		if st.Model == model {
+			return st
+		}
+	}
+	t.Fatalf("no stats for model %s", model)
+	return ModelStats{}
+}
+
+// 1000 samples, 1ms to 1000ms recorded in random order, give percentiles
+// within 5% of the true ones.
+func TestStatsPercentiles(t *testing.T) {
+	now := time.Now()
+	s := newStatsAggregator(t, now)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i, ms := range rng.Perm(1000) {
+		at := now.Add(-time.Duration(i) * 250 * time.Millisecond)
+		s.Record("m", time.Duration(ms+1)*time.Millisecond, ms%10 == 0, at)
+	}
+
+	st := statsOf(t, s, now, "m")
+	for _, p := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"p50", st.P50Ms, 500},
+		{"p95", st.P95Ms, 950},
+		{"p99", st.P99Ms, 990},
+	} {
+		if math.Abs(p.got-p.want) > 0.05*p.want {
+			t.Errorf("%s = %vms, want %vms within 5%%", p.name, p.got, p.want)
+		}
+	}
+	if st.ErrorRatePercent != 10 {
+		t.Errorf("error rate = %v%%, want 10%%", st.ErrorRatePercent)
+	}
+	if want := round2(1000 / statsWindow.Seconds()); st.RPS != want {
+		t.Errorf("rps = %v, want %v", st.RPS, want)
+	}
+	if st.BackendCount != 1 {
+		t.Errorf("backend count = %d, want 1", st.BackendCount)
+	}
+	if idle := statsOf(t, s, now, "n"); idle != (ModelStats{Model: "n", BackendCount: 1}) {
+		t.Errorf("model without requests = %+v, want zeroes", idle)
+	}
+}
+
+func TestStatsWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration
+		counted bool
+	}{
+		{name: "just now", age: 0, counted: true},
+		{name: "inside the window", age: statsWindow - 2*time.Second, counted: true},
+		{name: "outside the window", age: statsWindow + 2*time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			s := newStatsAggregator(t, now)
+			s.Record("m", 40*time.Millisecond, false, now.Add(-tt.age))
+			st := statsOf(t, s, now, "m")
+			if got := st.P50Ms == 40; got != tt.counted {
+				t.Errorf("sample %v old: stats %+v, counted %v, want %v", tt.age, st, got, tt.counted)
+			}
+		})
+	}
+}
+
+// With more requests than the ring holds, the latest are kept and the rate
+// is theirs.
+func TestStatsRingWraps(t *testing.T) {
+	now := time.Now()
+	s := newStatsAggregator(t, now)
+	const extra = 1000
+	for i := range statsRingSize + extra {
+		d := 900 * time.Millisecond
+		if i >= extra {
+			d = 10 * time.Millisecond
+		}
+		// 100 a second, the oldest first.
+		at := now.Add(-time.Duration(statsRingSize+extra-i) * 10 * time.Millisecond)
+		s.Record("m", d, false, at)
+	}
+	st := statsOf(t, s, now, "m")
+	if st.P99Ms != 10 {
+		t.Errorf("p99 = %vms, want 10ms: the oldest samples were kept", st.P99Ms)
+	}
+	if math.Abs(st.RPS-100) > 5 {
+		t.Errorf("rps = %v, want about 100", st.RPS)
+	}
+}
+
+// Samples recorded concurrently are all counted.
+func TestStatsConcurrentRecord(t *testing.T) {
+	now := time.Now()
+	s := newStatsAggregator(t, now)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				s.Record("m", time.Duration(g*100+i+1)*time.Millisecond, false, now)
+			}
+		}()
+	}
+	wg.Wait()
+	st := statsOf(t, s, now, "m")
+	if want := round2(800 / statsWindow.Seconds()); st.RPS != want || st.P50Ms != 400 {
+		t.Errorf("stats = %+v, want rps %v and p50 400ms", st, want)
+	}
+}
+
+// GET /metrics/models reports the requests routed through the middleware,
+// with their 5xx answers as errors.
+func TestServeModelStats(t *testing.T) {
+	var fail atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+  n: a
+`, backend.URL)))
+	s := NewStatsAggregator(rt.registry)
+	handler := s.Middleware(routeChain(t, rt))
+	for i := range 4 {
+		fail.Store(i == 3)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeModels(rec, httptest.NewRequest(http.MethodGet, "/metrics/models", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var rows []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["model"] != "m" || rows[1]["model"] != "n" {
+		t.Fatalf("rows = %v, want m and n", rows)
+	}
+	for _, field := range []string{"rps", "p50_ms", "p95_ms", "p99_ms", "error_rate_percent", "backend_count"} {
+		if _, ok := rows[0][field]; !ok {
+			t.Errorf("row has no %s: %v", field, rows[0])
+		}
+	}
+	if rows[0]["error_rate_percent"] != 25.0 || rows[0]["backend_count"] != 1.0 || rows[0]["rps"] == 0.0 {
+		t.Errorf("m = %v, want 25%% errors from 4 requests on 1 backend", rows[0])
+	}
+	if rows[1]["rps"] != 0.0 {
+		t.Errorf("n = %v, want no requests", rows[1])
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const (
+	// MaxLatencyHeader asks the cheapest strategy to skip backends whose
+	// recent latency exceeds the given number of milliseconds.
+	MaxLatencyHeader = "X-Aspendos-Max-Latency-Ms"
+	// RouteDecisionHeader reports which backend a strategy chose and why.
+	RouteDecisionHeader = "X-Aspendos-Route-Decision"
+)
+
+// Price is what a provider charges per 1K tokens, in whatever currency the
+// config uses; only comparisons between providers matter.
+type Price struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// Cost estimates what a request of in prompt and out completion tokens
+// costs at p.
+func (p Price) Cost(in, out int) float64 {
+	return (float64(in)*p.InputPer1K + float64(out)*p.OutputPer1K) / 1000
+}
+
+// RouteHint is what a strategy knows about the request it is placing.
+type RouteHint struct {
+	ClientID string
+	// APIKey is the name of the key that authenticated the request.
+	APIKey string
+	// InputTokens and OutputTokens are rough estimates used to price the
+	// request; see estimateTokens.
+	InputTokens  int
+	OutputTokens int
+	// MaxLatency, when positive, is the client's latency budget from
+	// MaxLatencyHeader.
+	MaxLatency time.Duration
+	// Idempotent allows retrying statuses that may follow a processed
+	// request; see idempotentRequest.
+	Idempotent bool
+	// Session is the conversation the request belongs to; see sessionKey.
+	Session string
+	// Request is the client's request, for routing policies to read its
+	// headers and Content-Length. Its body has been read.
+	Request *http.Request
+}
+
+// newRouteHint estimates the request's size from its body and reads the
+// caller, latency hint, idempotency and session from the request.
+func newRouteHint(body []byte, r *http.Request) RouteHint {
+	h := r.Header
+	hint := RouteHint{
+		ClientID:   h.Get(ClientIDHeader),
+		APIKey:     middleware.RequestInfoFrom(r.Context()).APIKey(),
+		Idempotent: idempotentRequest(r),
+		Session:    sessionKey(body, h),
+		Request:    r,
+	}
+	hint.InputTokens, hint.OutputTokens = estimateTokens(body)
+	if ms, err := strconv.Atoi(h.Get(MaxLatencyHeader)); err == nil && ms > 0 {
+		hint.MaxLatency = time.Duration(ms) * time.Millisecond
+	}
+	return hint
+}
+
+// estimateTokens guesses prompt tokens at four bytes each and takes the
+// completion size from max_completion_tokens or max_tokens, else assumes it
+// matches the prompt. Good enough to rank providers, not to bill.
+func estimateTokens(body []byte) (in, out int) {
+	in = max(len(body)/4, 1)
+	var req struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	}
+	json.Unmarshal(body, &req)
+	switch {
+	case req.MaxCompletionTokens > 0:
+		return in, req.MaxCompletionTokens
+	case req.MaxTokens > 0:
+		return in, req.MaxTokens
+	}
+	return in, in
+}
+
+// Decision records why a strategy picked a backend, for the response
+// header and the request log.
+type Decision struct {
+	Strategy string
+	Backend  string
+	Reason   string
+	// Pool is the pool routing policies chose, for models with them.
+	Pool string
+	// Price and Cost are set when the choice was made on price.
+	Price *Price
+	Cost  float64
+	// Latency is the backend's recent latency, when known.
+	Latency time.Duration
+}
+
+// String formats d as space-separated key=value pairs.
+func (d Decision) String() string {
+	parts := []string{"strategy=" + d.Strategy, "backend=" + d.Backend}
+	if d.Pool != "" {
+		parts = append(parts, "pool="+d.Pool)
+	}
+	if d.Reason != "" {
+		parts = append(parts, "reason="+d.Reason)
+	}
+	if d.Price != nil {
+		parts = append(parts,
+			"price_in="+strconv.FormatFloat(d.Price.InputPer1K, 'g', -1, 64),
+			"price_out="+strconv.FormatFloat(d.Price.OutputPer1K, 'g', -1, 64),
+			"est_cost="+strconv.FormatFloat(d.Cost, 'g', 6, 64))
+	}
+	if d.Latency > 0 {
+		parts = append(parts, "latency_ms="+strconv.FormatInt(d.Latency.Milliseconds(), 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Strategy chooses a backend from a pool's candidates: the replicas with a
+// positive weight whose breaker admits a request, in configuration order
+// and never empty. Pick runs under the pool's lock.
+type Strategy interface {
+	Name() string
+	Pick(candidates []*Backend, hint RouteHint) (*Backend, Decision)
+}
+
+var strategies = map[string]Strategy{
+	"static":        StaticStrategy{},
+	"weighted":      WeightedStrategy{},
+	"cheapest":      CheapestStrategy{},
+	"latency_aware": &LatencyAwareStrategy{},
+}
+
+// newStrategy builds the strategy of model's pool of backends as bc
+// configures it. Strategies that keep state of their backends get an
+// instance of their own.
+func newStrategy(model string, bc BackendConfig, backends []*Backend) Strategy {
+	if bc.Strategy == "latency_aware" {
+		return newLatencyAwareStrategy(model, bc.LatencyAware, backends)
+	}
+	return strategyFor(bc.Strategy)
+}
+
+// strategyFor resolves a configured strategy name; empty means weighted.
+func strategyFor(name string) Strategy {
+	if s, ok := strategies[name]; ok {
+		return s
+	}
+	return WeightedStrategy{}
+}
+
+// StaticStrategy always takes the first available replica, so later
+// replicas only serve while earlier ones are down or drained.
+type StaticStrategy struct{}
+
+func (StaticStrategy) Name() string { return "static" }
+
+func (s StaticStrategy) Pick(candidates []*Backend, _ RouteHint) (*Backend, Decision) {
+	b := candidates[0]
+	return b, Decision{Strategy: s.Name(), Backend: b.Name(), Latency: b.Latency()}
+}
+
+// WeightedStrategy spreads requests by weight with smooth weighted
+// round-robin, the default.
+type WeightedStrategy struct{}
+
+func (WeightedStrategy) Name() string { return "weighted" }
+
+func (s WeightedStrategy) Pick(candidates []*Backend, _ RouteHint) (*Backend, Decision) {
+	b := pickWeighted(candidates)
+	return b, Decision{Strategy: s.Name(), Backend: b.Name(), Latency: b.Latency()}
+}
+
+// CheapestStrategy sends each request to the replica whose provider
+// prices it lowest. With a latency hint, replicas whose recent latency is
+// over budget are skipped (those without a measurement yet are given the
+// benefit of the doubt); when none fits, the fastest replica is used.
+// Unpriced replicas rank after priced ones, ties go to configuration
+// order.
+type CheapestStrategy struct{}
+
+func (CheapestStrategy) Name() string { return "cheapest" }
+
+func (s CheapestStrategy) Pick(candidates []*Backend, hint RouteHint) (*Backend, Decision) {
+	within := candidates
+	if hint.MaxLatency > 0 {
+		within = make([]*Backend, 0, len(candidates))
+		for _, b := range candidates {
+			if l := b.Latency(); l == 0 || l <= hint.MaxLatency {
+				within = append(within, b)
+			}
+		}
+	}
+	if len(within) == 0 {
+		fastest := candidates[0]
+		for _, b := range candidates[1:] {
+			if b.Latency() < fastest.Latency() {
+				fastest = b
+			}
+		}
+		d := s.decision(fastest, hint)
+		d.Reason = "fastest; none within " + hint.MaxLatency.String()
+		return fastest, d
+	}
+
+	var best *Backend
+	bestCost := math.Inf(1)
+	for _, b := range within {
+		cost := math.Inf(1)
+		if p := b.Provider.Price; p != nil {
+			cost = p.Cost(hint.InputTokens, hint.OutputTokens)
+		}
+		if best == nil || cost < bestCost {
+			best, bestCost = b, cost
+		}
+	}
+	d := s.decision(best, hint)
+	switch {
+	case best.Provider.Price == nil:
+		d.Reason = "unpriced"
+	case hint.MaxLatency > 0:
+		d.Reason = "cheapest within " + hint.MaxLatency.String()
+	default:
+		d.Reason = "cheapest"
+	}
+	return best, d
+}
+
+func (s CheapestStrategy) decision(b *Backend, hint RouteHint) Decision {
+	d := Decision{Strategy: s.Name(), Backend: b.Name(), Latency: b.Latency()}
+	if p := b.Provider.Price; p != nil {
+		d.Price, d.Cost = p, p.Cost(hint.InputTokens, hint.OutputTokens)
+	}
+	return d
+}
+
+// latencyAlpha weights the newest sample in a backend's moving average.
+const latencyAlpha = 0.2
+
+// latencyEWMA is an exponentially weighted moving average of upstream
+// latency, lock-free so requests can feed it without the pool's lock.
+type latencyEWMA struct {
+	nanos atomic.Int64
+}
+
+func (l *latencyEWMA) observe(d time.Duration) {
+	for {
+		old := l.nanos.Load()
+		next := int64(d)
+		if old != 0 {
+			next = int64(latencyAlpha*float64(d) + (1-latencyAlpha)*float64(old))
+		}
+		if l.nanos.CompareAndSwap(old, max(next, 1)) {
+			return
+		}
+	}
+}
+
+func (l *latencyEWMA) value() time.Duration {
+	return time.Duration(l.nanos.Load())
+}
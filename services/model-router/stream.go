@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sync"
+)
+
+// isEventStream reports whether h declares a text/event-stream body.
+func isEventStream(h http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+var (
+	sseDone           = []byte("data: [DONE]")
+	errUpstreamClosed = errors.New("upstream closed stream before [DONE]")
+	errSSELineTooLong = errors.New("upstream stream line too long")
+)
+
+// maxSSELineBytes bounds a line of an upstream event stream, which is
+// buffered whole before it is relayed.
+const maxSSELineBytes = 1 << 20
+
+// readSSELine reads the next line of r into buf, failing with
+// errSSELineTooLong once it passes maxSSELineBytes. Like ReadBytes, it
+// returns a nil error only for a line ending in a newline.
+func readSSELine(r *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(buf)+len(frag) > maxSSELineBytes {
+			return nil, errSSELineTooLong
+		}
+		buf = append(buf, frag...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return buf, err
+		}
+	}
+}
+
+// streamSSE relays an upstream text/event-stream body to the client event by
+// event, flushing each and calling forwarded once it is written. It
+// returns when the upstream sends [DONE], closes the stream, or the client
+// goes away; the error is non-nil only when the upstream broke the stream.
+// Reads block only as long as the upstream request runs, which ends with
+// ctx, so a client that leaves mid-generation stops the upstream at once.
+// A line the upstream never finished is dropped rather than run into the
+// error event that follows it.
+func streamSSE(ctx context.Context, w http.ResponseWriter, body io.Reader, provider string, logger *slog.Logger, forwarded func()) error {
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	reader := bufio.NewReader(body)
+	var line []byte
+	// pending is an event written but not yet terminated.
+	pending := false
+	for {
+		var err error
+		line, err = readSSELine(reader, line)
+		if err == nil {
+			if _, werr := w.Write(line); werr != nil {
+				return nil
+			}
+			// A blank line terminates an SSE event.
+			if len(bytes.TrimSpace(line)) == 0 {
+				flush()
+				if pending {
+					forwarded()
+				}
+				pending = false
+				continue
+			}
+			pending = true
+			if bytes.Equal(bytes.TrimSpace(line), sseDone) {
+				// Terminate the event ourselves rather than wait on the upstream's blank line.
+				w.Write([]byte("\n"))
+				flush()
+				forwarded()
+				return nil
+			}
+			continue
+		}
+
+		if cancelledByAdmin(ctx) {
+			logger.Warn("stream cancelled by an operator", slog.String("provider", provider))
+			w.Write([]byte("\nevent: error\ndata: {\"error\":{\"message\":\"request cancelled by an operator\",\"type\":\"invalid_request_error\",\"code\":\"request_cancelled\"}}\n\n"))
+			flush()
+			return nil
+		}
+		if ctx.Err() != nil {
+			logger.Info("client disconnected mid-stream", slog.String("provider", provider))
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			// Upstream ended without [DONE]; surface that instead of a silent truncation.
+			logger.Warn("upstream closed stream before [DONE]", slog.String("provider", provider))
+			w.Write([]byte("\nevent: error\ndata: {\"error\":{\"message\":\"upstream closed stream unexpectedly\",\"type\":\"api_error\",\"code\":\"provider_unavailable\"}}\n\n"))
+			err = errUpstreamClosed
+		} else if errors.Is(err, errSSELineTooLong) {
+			logger.Warn("upstream stream line too long", slog.String("provider", provider), slog.Int("max_bytes", maxSSELineBytes))
+			w.Write([]byte("\nevent: error\ndata: {\"error\":{\"message\":\"upstream stream line too long\",\"type\":\"api_error\",\"code\":\"provider_unavailable\"}}\n\n"))
+		} else {
+			logger.Warn("upstream stream read failed", slog.String("provider", provider), slog.String("error", err.Error()))
+			w.Write([]byte("\nevent: error\ndata: {\"error\":{\"message\":\"upstream stream interrupted\",\"type\":\"api_error\",\"code\":\"provider_unavailable\"}}\n\n"))
+		}
+		flush()
+		return err
+	}
+}
+
+// streamOutcome tells a backend's breaker how a stream from it went, once
+// the stream is closed. Only a read failing while the request still runs,
+// a connection dropped mid-generation, counts against the backend; a
+// stream that ended, [DONE] or not, or that was closed early counts for
+// it, and one the client or the deadline cut short says nothing.
+type streamOutcome struct {
+	io.ReadCloser
+	ctx     context.Context
+	breaker *CircuitBreaker
+
+	failed bool
+	once   sync.Once
+}
+
+func (s *streamOutcome) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && s.ctx.Err() == nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *streamOutcome) Close() error {
+	err := s.ReadCloser.Close()
+	s.settle()
+	return err
+}
+
+// settle records the stream's outcome, once.
+func (s *streamOutcome) settle() {
+	s.once.Do(func() {
+		switch {
+		case s.failed:
+			s.breaker.Failure()
+		case s.ctx.Err() != nil:
+			s.breaker.Cancel()
+		default:
+			s.breaker.Success()
+		}
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	streamChunks   = 100
+	streamInterval = 10 * time.Millisecond
+	// streamMaxLag is how far behind the upstream a chunk may reach the
+	// client. Holding the response back to the end would put the first
+	// chunk a second behind.
+	streamMaxLag = 250 * time.Millisecond
+)
+
+// chunkedUpstream writes streamChunks lines, "chunk N", streamInterval
+// apart, as events when sse is set, and notes when it sent each. The time
+// is noted before the write, so a client that reads a chunk always finds
+// it.
+type chunkedUpstream struct {
+	sse  bool
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+func (u *chunkedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	for i := range streamChunks {
+		u.mu.Lock()
+		u.sent = append(u.sent, time.Now())
+		u.mu.Unlock()
+		if u.sse {
+			fmt.Fprintf(w, "data: chunk %d\n\n", i)
+		} else {
+			fmt.Fprintf(w, "chunk %d\n", i)
+		}
+		w.(http.Flusher).Flush()
+		time.Sleep(streamInterval)
+	}
+	if u.sse {
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+func (u *chunkedUpstream) sentAt(i int) time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.sent[i]
+}
+
+// Every chunk reaches the client while the upstream is still writing the
+// rest, whether or not the response is an event stream, and through the
+// middleware that records responses to replay.
+func TestStreamingDeliversChunksIncrementally(t *testing.T) {
+	tests := []struct {
+		name   string
+		sse    bool
+		model  string
+		body   string
+		header map[string]string
+	}{
+		{name: "chunked", model: "plain", body: `{"model":"plain","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "event stream", sse: true, model: "plain", body: `{"model":"plain","messages":[{"role":"user","content":"hi"}],"stream":true}`},
+		{name: "event stream to a cached model", sse: true, model: "cached", body: `{"model":"cached","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "event stream to a deduplicated model", sse: true, model: "deduplicated", body: `{"model":"deduplicated","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "event stream with an idempotency key", sse: true, model: "plain", body: `{"model":"plain","messages":[{"role":"user","content":"hi"}]}`, header: map[string]string{"Idempotency-Key": "k1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &chunkedUpstream{sse: tt.sse}
+			backend := httptest.NewServer(upstream)
+			defer backend.Close()
+			cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  plain: a
+  cached: {provider: a, cache_enabled: true}
+  deduplicated: {provider: a, deduplicate: true}
+`, backend.URL))
+			router := httptest.NewServer(routeChain(t, newTestRouter(t, cfg)))
+			defer router.Close()
+
+			req := chatRequest(tt.body)
+			req.URL, _ = req.URL.Parse(router.URL + chatCompletionsPath)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+
+			next := 0
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				_, n, ok := strings.Cut(scanner.Text(), "chunk ")
+				if !ok {
+					continue
+				}
+				i, err := strconv.Atoi(n)
+				if err != nil || i != next {
+					t.Fatalf("got chunk %q, want chunk %d", n, next)
+				}
+				if lag := time.Since(upstream.sentAt(i)); lag > streamMaxLag {
+					t.Fatalf("chunk %d reached the client %v after the upstream sent it", i, lag)
+				}
+				next++
+			}
+			if next != streamChunks {
+				t.Errorf("got %d chunks, want %d", next, streamChunks)
+			}
+		})
+	}
+}
+
+// A mock stream of 50 events holds its connection open until the client
+// has all 50, so each must be relayed as it comes rather than at the end,
+// and each is counted.
+func TestSSEForwardsEachEvent(t *testing.T) {
+	const events = 50
+	received := make(chan struct{})
+	var heldOpen atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-received:
+			heldOpen.Store(true)
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer backend.Close()
+	rt, m := newMeteredRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, backend.URL)))
+	router := httptest.NewServer(routeChain(t, rt))
+	defer router.Close()
+
+	req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}],"stream":true}`)
+	req.URL, _ = req.URL.Parse(router.URL + chatCompletionsPath)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var got []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		got = append(got, data)
+		if len(got) == events {
+			close(received)
+		}
+	}
+	if !heldOpen.Load() {
+		t.Fatalf("the client had %d events when the mock gave up waiting, want all %d", len(got), events)
+	}
+	if len(got) != events+1 || got[events] != "[DONE]" {
+		t.Fatalf("got %d events ending %q, want %d and [DONE]", len(got), got[len(got)-1], events)
+	}
+	for i, data := range got[:events] {
+		if data != fmt.Sprintf(`{"n":%d}`, i) {
+			t.Fatalf("event %d = %s", i, data)
+		}
+	}
+	if want := fmt.Sprintf(`router_sse_events_forwarded_total{model="m"} %d`, events+1); !strings.Contains(scrape(t, m), want) {
+		t.Errorf("/metrics has no %s", want)
+	}
+}
+
+// sseThenDrop writes three events, then [DONE] if done is set, and then
+// cuts the connection without ending the response.
+func sseThenDrop(done bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 3 {
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\n", i)
+		}
+		if done {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+	}
+}
+
+// Only a stream broken off by its connection counts against the backend's
+// breaker: one that ends with [DONE], whatever the connection does after,
+// or that the upstream ends cleanly does not.
+func TestSSEBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream http.Handler
+		want     BreakerState
+	}{
+		{name: "done, then dropped", upstream: sseThenDrop(true), want: Closed},
+		{name: "ended without done", upstream: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"n\":0}\n\n")
+		}), want: Closed},
+		{name: "dropped mid-stream", upstream: sseThenDrop(false), want: Open},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(tt.upstream)
+			defer backend.Close()
+			rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: {provider: a, circuit_breaker: {failure_threshold: 1, cooldown: 1m}}
+`, backend.URL)))
+			rec := httptest.NewRecorder()
+			rt.handleRoute(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if n := strings.Count(rec.Body.String(), `data: {"n":`); n < 1 {
+				t.Fatalf("client got %d events: %s", n, rec.Body)
+			}
+			if got := rt.registry.LookupAll("m")[0].Backends()[0].Breaker.State(); got != tt.want {
+				t.Errorf("breaker %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// sseError is the event the router ends a broken stream with.
+func sseError(message string) string {
+	return "\nevent: error\ndata: {\"error\":{\"message\":\"" + message + "\",\"type\":\"api_error\",\"code\":\"provider_unavailable\"}}\n\n"
+}
+
+// An upstream that stops mid-event gets the client the events it finished,
+// the lines of the one it did not, less any line it left unfinished, and an
+// error event after them; the stream counts as interrupted.
+func TestSSEUpstreamClosedMidEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		drop bool
+		want string
+	}{
+		{
+			name: "ended mid-line",
+			sent: "data: {\"n\":0}\n\ndata: {\"n\":1",
+			want: "data: {\"n\":0}\n\n" + sseError("upstream closed stream unexpectedly"),
+		},
+		{
+			name: "ended between an event's lines",
+			sent: "data: {\"n\":0}\n\nevent: delta\ndata: {\"n\":1}\n",
+			want: "data: {\"n\":0}\n\nevent: delta\ndata: {\"n\":1}\n" + sseError("upstream closed stream unexpectedly"),
+		},
+		{
+			name: "dropped mid-line",
+			sent: "data: {\"n\":0}\n\ndata: {\"n\":1",
+			drop: true,
+			want: "data: {\"n\":0}\n\n" + sseError("upstream stream interrupted"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.sent)
+				w.(http.Flusher).Flush()
+				if tt.drop {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						panic(err)
+					}
+					conn.Close()
+				}
+			}))
+			defer backend.Close()
+			rt, m := newMeteredRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, backend.URL)))
+			rec := httptest.NewRecorder()
+			rt.handleRoute(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+			if rec.Body.String() != tt.want {
+				t.Errorf("client got %q, want %q", rec.Body, tt.want)
+			}
+			if want := `model_router_upstream_errors_total{error_type="stream_interrupted",model="m"} 1`; !strings.Contains(scrape(t, m), want) {
+				t.Errorf("missing %s", want)
+			}
+		})
+	}
+}
+
+// A line longer than maxSSELineBytes ends the stream with an error event
+// instead of being buffered, or relayed, whole.
+func TestSSELineTooLong(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"n\":0}\n\n")
+		io.WriteString(w, "data: "+strings.Repeat("x", maxSSELineBytes)+"\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer backend.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, backend.URL)))
+	rec := httptest.NewRecorder()
+	rt.handleRoute(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	if want := "data: {\"n\":0}\n\n" + sseError("upstream stream line too long"); rec.Body.String() != want {
+		t.Errorf("client got %d bytes, starting %.100q, want %q", rec.Body.Len(), rec.Body, want)
+	}
+
+	// A line just within the limit is relayed.
+	line := "data: " + strings.Repeat("x", maxSSELineBytes-len("data: \n")) + "\n"
+	got, err := readSSELine(bufio.NewReader(strings.NewReader(line+"\n")), nil)
+	if err != nil || string(got) != line {
+		t.Errorf("readSSELine of %d bytes: %d bytes, %v", len(line), len(got), err)
+	}
+}
+
+// A client that goes away mid-stream cancels the upstream request at once,
+// rather than leaving the backend generating for no one.
+func TestSSEClientDisconnectCancelsUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(canceled)
+				return
+			case <-time.After(streamInterval):
+			}
+		}
+	}))
+	defer backend.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  m: a
+`, backend.URL)))
+	srv := httptest.NewServer(routeChain(t, rt))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+chatCompletionsPath,
+		strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: {\"n\":0}\n" {
+		t.Fatalf("first line %q, %v", line, err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream still streaming a second after the client left")
+	}
+}
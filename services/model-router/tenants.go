@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// TenantConfig is one customer sharing the router. Requests belong to the
+// tenant when they authenticate with one of APIKeys (names from
+// auth.keys) or, failing that, with a key starting with one of
+// KeyPrefixes; the longest matching prefix wins. ProviderKeys replaces
+// the provider's own API key on the tenant's upstream calls; providers
+// without one here are called with their own key. A model must match one
+// of AllowedModels, if any are listed, and none of DeniedModels, both
+// globs as in models. DefaultModel fills in requests that name no model,
+// and ModelOverrides sends requests for one model to another; the
+// allowlist applies to the result.
+type TenantConfig struct {
+	APIKeys        []string                     `json:"api_keys,omitempty"`
+	KeyPrefixes    []string                     `json:"key_prefixes,omitempty"`
+	ProviderKeys   map[string]TenantProviderKey `json:"provider_keys,omitempty"`
+	AllowedModels  []string                     `json:"allowed_models,omitempty"`
+	DeniedModels   []string                     `json:"denied_models,omitempty"`
+	DefaultModel   string                       `json:"default_model,omitempty"`
+	ModelOverrides map[string]string            `json:"model_overrides,omitempty"`
+}
+
+// TenantProviderKey is a tenant's credential for one provider, read from
+// APIKeyEnv when that is set and non-empty, then APIKey.
+type TenantProviderKey struct {
+	APIKey    string `json:"api_key,omitempty"`
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+}
+
+func (k TenantProviderKey) secret() string {
+	if v := os.Getenv(k.APIKeyEnv); k.APIKeyEnv != "" && v != "" {
+		return v
+	}
+	return k.APIKey
+}
+
+func validateTenants(cfg *Config) error {
+	if len(cfg.Tenants) == 0 {
+		return nil
+	}
+	if cfg.Auth == nil {
+		return fmt.Errorf("tenants: auth is required, as API keys are how requests are matched to tenants")
+	}
+	keys := make(map[string]bool)
+	for _, k := range cfg.Auth.Keys {
+		keys[k.Name] = true
+	}
+	keyOwner := make(map[string]string)
+	prefixOwner := make(map[string]string)
+	for name, tc := range cfg.Tenants {
+		if len(tc.APIKeys) == 0 && len(tc.KeyPrefixes) == 0 {
+			return fmt.Errorf("tenants[%q]: api_keys or key_prefixes is required", name)
+		}
+		for _, k := range tc.APIKeys {
+			if !keys[k] {
+				return fmt.Errorf("tenants[%q].api_keys: %q is not in auth.keys", name, k)
+			}
+			if other, ok := keyOwner[k]; ok {
+				return fmt.Errorf("tenants[%q].api_keys: %q already belongs to tenant %q", name, k, other)
+			}
+			keyOwner[k] = name
+		}
+		for _, p := range tc.KeyPrefixes {
+			if p == "" {
+				return fmt.Errorf("tenants[%q].key_prefixes: prefixes must not be empty", name)
+			}
+			if other, ok := prefixOwner[p]; ok {
+				return fmt.Errorf("tenants[%q].key_prefixes: %q already belongs to tenant %q", name, p, other)
+			}
+			prefixOwner[p] = name
+		}
+		for provider, k := range tc.ProviderKeys {
+			if _, ok := cfg.Providers[provider]; !ok {
+				return fmt.Errorf("tenants[%q].provider_keys: unknown provider %q", name, provider)
+			}
+			// An empty key would fall back to the provider's own, billing
+			// the tenant's traffic to someone else.
+			if k.secret() == "" {
+				return fmt.Errorf("tenants[%q].provider_keys[%q]: no key configured (is %s set?)", name, provider, k.APIKeyEnv)
+			}
+		}
+		for _, m := range append(append([]string{}, tc.AllowedModels...), tc.DeniedModels...) {
+			if m == "" {
+				return fmt.Errorf("tenants[%q]: allowed_models and denied_models must not contain empty patterns", name)
+			}
+		}
+		for from, to := range tc.ModelOverrides {
+			if from == "" || to == "" {
+				return fmt.Errorf("tenants[%q].model_overrides: model names must not be empty", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Tenant is a TenantConfig ready to apply to requests.
+type Tenant struct {
+	Name           string
+	providerKeys   map[string]string
+	allowed        []string
+	denied         []string
+	defaultModel   string
+	modelOverrides map[string]string
+}
+
+// Model returns the model a request for model should be routed as.
+func (t *Tenant) Model(model string) string {
+	if model == "" {
+		return t.defaultModel
+	}
+	if to, ok := t.modelOverrides[model]; ok {
+		return to
+	}
+	return model
+}
+
+// Allows reports whether the tenant may use model.
+func (t *Tenant) Allows(model string) bool {
+	for _, p := range t.denied {
+		if matchGlob(p, model) {
+			return false
+		}
+	}
+	if len(t.allowed) == 0 {
+		return true
+	}
+	for _, p := range t.allowed {
+		if matchGlob(p, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider returns p with the tenant's key for it, or p itself if the
+// tenant has none. A nil tenant leaves p alone.
+func (t *Tenant) Provider(p *Provider) *Provider {
+	if t == nil || p.Source == "" {
+		return p
+	}
+	key, ok := t.providerKeys[p.Source]
+	if !ok {
+		return p
+	}
+	own := *p
+	own.APIKey, own.Credential = key, nil
+	return &own
+}
+
+// Tenants resolves requests to tenants. A nil *Tenants has none.
+type Tenants struct {
+	byName map[string]*Tenant
+	byKey  map[string]*Tenant
+	// prefixes is sorted longest first.
+	prefixes []tenantPrefix
+}
+
+type tenantPrefix struct {
+	prefix string
+	tenant *Tenant
+}
+
+// newTenants compiles cfg's tenants, which Validate has checked.
+func newTenants(cfg *Config) *Tenants {
+	ts := &Tenants{byName: make(map[string]*Tenant), byKey: make(map[string]*Tenant)}
+	for name, tc := range cfg.Tenants {
+		t := &Tenant{
+			Name:           name,
+			providerKeys:   make(map[string]string),
+			allowed:        tc.AllowedModels,
+			denied:         tc.DeniedModels,
+			defaultModel:   tc.DefaultModel,
+			modelOverrides: tc.ModelOverrides,
+		}
+		for provider, k := range tc.ProviderKeys {
+			t.providerKeys[provider] = k.secret()
+		}
+		ts.byName[name] = t
+		for _, k := range tc.APIKeys {
+			ts.byKey[k] = t
+		}
+		for _, p := range tc.KeyPrefixes {
+			ts.prefixes = append(ts.prefixes, tenantPrefix{prefix: p, tenant: t})
+		}
+	}
+	sort.Slice(ts.prefixes, func(i, j int) bool {
+		return len(ts.prefixes[i].prefix) > len(ts.prefixes[j].prefix)
+	})
+	return ts
+}
+
+// Resolve names the tenant of a request authenticated with the key
+// called keyName, whose secret is secret, or returns "" if it has none.
+func (ts *Tenants) Resolve(keyName, secret string) string {
+	if ts == nil {
+		return ""
+	}
+	if t, ok := ts.byKey[keyName]; ok {
+		return t.Name
+	}
+	for _, p := range ts.prefixes {
+		if strings.HasPrefix(secret, p.prefix) {
+			return p.tenant.Name
+		}
+	}
+	return ""
+}
+
+// Lookup returns the tenant called name, or nil.
+func (ts *Tenants) Lookup(name string) *Tenant {
+	if ts == nil || name == "" {
+		return nil
+	}
+	return ts.byName[name]
+}
+
+// tenantOf returns the tenant the request in ctx resolved to, or nil.
+func (rt *Router) tenantOf(r *http.Request) *Tenant {
+	return rt.registry.Tenants().Lookup(middleware.RequestInfoFrom(r.Context()).Tenant())
+}
+
+// Tenants applies the request's tenant to its model: the default model
+// or an override rewrites the body, and a model the tenant may not use is
+// rejected with 403. Requests without a tenant pass through.
+func (rt *Router) Tenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := rt.tenantOf(r)
+		if t == nil || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isMultipart(r.Header) {
+			rt.tenantUpload(t, next, w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model string `json:"model"`
+		}
+		if json.Unmarshal(body, &req) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		model := rt.tenantModel(t, req.Model)
+		if model == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !t.Allows(model) {
+			writeError(w, http.StatusForbidden, "model_not_allowed", fmt.Sprintf("model %q is not available to tenant %s", model, t.Name))
+			return
+		}
+		if model != req.Model {
+			rewritten, err := withModel(body, model)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(rewritten))
+			r.ContentLength = int64(len(rewritten))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantModel is the model t's request for model is routed as. The
+// tenant's default or override may itself be an alias.
+func (rt *Router) tenantModel(t *Tenant, model string) string {
+	to := t.Model(model)
+	if to == model {
+		return to
+	}
+	if canonical, ok := rt.registry.Canonical(to); ok {
+		return canonical
+	}
+	return to
+}
+
+// tenantUpload is Tenants for a multipart upload, whose model is a field
+// of its form. An override replaces the field in place.
+func (rt *Router) tenantUpload(t *Tenant, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	sent, _ := peekFormModel(r)
+	model := rt.tenantModel(t, sent)
+	if model == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if !t.Allows(model) {
+		writeError(w, http.StatusForbidden, "model_not_allowed", fmt.Sprintf("model %q is not available to tenant %s", model, t.Name))
+		return
+	}
+	if model != sent && sent != "" {
+		setFormModel(r, model)
+	}
+	next.ServeHTTP(w, r)
+}
+
+// KeyModels rejects with 403 a request for a model its API key is not
+// allowed, as recorded by authentication. Requests naming no model, and
+// keys with no allowlist, pass through.
+func (rt *Router) KeyModels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := middleware.RequestInfoFrom(r.Context())
+		if len(info.KeyModels()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if model := peekModel(r); !keyAllows(info, model) {
+			writeKeyModelForbidden(w, info, model)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyAllows reports whether the API key recorded in info may use model.
+// Keys with no allowlist, and requests naming no model, are allowed.
+func keyAllows(info *middleware.RequestInfo, model string) bool {
+	patterns := info.KeyModels()
+	return len(patterns) == 0 || model == "" || slices.ContainsFunc(patterns, func(p string) bool { return matchGlob(p, model) })
+}
+
+func writeKeyModelForbidden(w http.ResponseWriter, info *middleware.RequestInfo, model string) {
+	writeError(w, http.StatusForbidden, "model_not_allowed", fmt.Sprintf("model %q is not available to API key %s", model, info.APIKey()))
+}
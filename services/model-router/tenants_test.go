@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// numberedUpstream answers each request with a new id and the credential
+// it was sent, so tests can tell a cached or replayed answer from a fresh
+// one and see whose key reached the provider.
+type numberedUpstream struct {
+	calls atomic.Int64
+}
+
+func (u *numberedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := u.calls.Add(1)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":"resp-%d","credential":%q,"usage":{"prompt_tokens":3,"completion_tokens":4,"total_tokens":7}}`,
+		n, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// tenantServer serves chat completions and usage behind API key auth for
+// two tenants, acme and globex, sharing model m with its cache on. Chat
+// completions also go through extra, innermost.
+func tenantServer(t *testing.T, extra ...middleware.Middleware) (http.Handler, *numberedUpstream) {
+	t.Helper()
+	upstream := &numberedUpstream{}
+	backend := httptest.NewServer(upstream)
+	t.Cleanup(backend.Close)
+	cfg := testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s, api_key: router-key}
+models:
+  m: {provider: a, cache_enabled: true}
+auth:
+  keys:
+    - {name: acme-prod, key: sk-acme}
+    - {name: globex-prod, key: gx_globex}
+tenants:
+  acme:
+    api_keys: [acme-prod]
+    provider_keys: {a: {api_key: acme-key}}
+  globex:
+    key_prefixes: [gx_]
+    provider_keys: {a: {api_key: globex-key}}
+`, backend.URL))
+	rt := newTestRouter(t, cfg)
+	auth, err := middleware.NewAuth(*cfg.Auth, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.ResolveTenants(rt.registry.ResolveTenant)
+	mux := http.NewServeMux()
+	mux.Handle("POST "+chatCompletionsPath, middleware.Chain(routeChain(t, rt), append([]middleware.Middleware{rt.Tenants, rt.KeyModels}, extra...)...))
+	mux.HandleFunc("GET /v1/usage", rt.handleUsage)
+	return middleware.Logging(testLogger())(auth.Middleware(mux)), upstream
+}
+
+type tenantResponse struct {
+	status     int
+	id         string
+	credential string
+	cache      string
+	replayed   bool
+}
+
+func callAs(t *testing.T, h http.Handler, key string, header map[string]string) tenantResponse {
+	t.Helper()
+	req := chatRequest(`{"model":"m","messages":[{"role":"user","content":"same prompt"}]}`)
+	req.Header.Set("Authorization", "Bearer "+key)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var body struct {
+		ID         string `json:"id"`
+		Credential string `json:"credential"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return tenantResponse{
+		status:     rec.Code,
+		id:         body.ID,
+		credential: body.Credential,
+		cache:      rec.Header().Get("X-Cache"),
+		replayed:   rec.Header().Get(IdempotentReplayHeader) == "true",
+	}
+}
+
+// One tenant's key neither reads nor replaces another tenant's cached
+// responses or idempotent replays.
+func TestTenantIsolation(t *testing.T) {
+	tests := []struct {
+		name string
+		// acme sends first and third with acme's header, globex sends
+		// second in between with globex's.
+		acme, globex map[string]string
+		check        func(t *testing.T, first, second, third tenantResponse)
+	}{
+		{
+			name: "cache",
+			check: func(t *testing.T, first, second, third tenantResponse) {
+				if second.cache != "MISS" || second.id == first.id {
+					t.Errorf("globex got acme's cached answer: %+v", second)
+				}
+				if third.cache != "HIT" || third.id != first.id {
+					t.Errorf("acme lost its cached answer: %+v, first %+v", third, first)
+				}
+			},
+		},
+		{
+			name:   "cache refreshed by another tenant",
+			globex: map[string]string{"Cache-Control": "no-cache"},
+			check: func(t *testing.T, first, second, third tenantResponse) {
+				if second.id == first.id {
+					t.Errorf("globex got acme's cached answer: %+v", second)
+				}
+				if third.cache != "HIT" || third.id != first.id {
+					t.Errorf("globex's fresh answer replaced acme's: %+v, first %+v", third, first)
+				}
+			},
+		},
+		{
+			name:   "idempotency key",
+			acme:   map[string]string{"Idempotency-Key": "order-1", "Cache-Control": "no-cache"},
+			globex: map[string]string{"Idempotency-Key": "order-1", "Cache-Control": "no-cache"},
+			check: func(t *testing.T, first, second, third tenantResponse) {
+				if second.status != http.StatusOK || second.replayed || second.id == first.id {
+					t.Errorf("globex got acme's idempotent response: %+v", second)
+				}
+				if !third.replayed || third.id != first.id {
+					t.Errorf("acme's retry was not replayed its own response: %+v, first %+v", third, first)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := tenantServer(t)
+			first := callAs(t, h, "sk-acme", tt.acme)
+			second := callAs(t, h, "gx_globex", tt.globex)
+			third := callAs(t, h, "sk-acme", tt.acme)
+			if first.credential != "acme-key" || second.credential != "globex-key" {
+				t.Fatalf("first %+v, second %+v: want each tenant's own provider key", first, second)
+			}
+			tt.check(t, first, second, third)
+		})
+	}
+}
+
+// A tenant's key sees only its own usage.
+func TestTenantUsageIsolation(t *testing.T) {
+	h, _ := tenantServer(t)
+	callAs(t, h, "sk-acme", nil)
+	callAs(t, h, "gx_globex", map[string]string{"Cache-Control": "no-cache"})
+	callAs(t, h, "gx_globex", map[string]string{"Cache-Control": "no-cache"})
+
+	tests := []struct {
+		name   string
+		key    string
+		query  string
+		status int
+		tokens int64
+	}{
+		{name: "own usage", key: "sk-acme", status: http.StatusOK, tokens: 7},
+		{name: "own usage by name", key: "gx_globex", query: "?key=globex-prod", status: http.StatusOK, tokens: 14},
+		{name: "another tenant's usage", key: "sk-acme", query: "?key=globex-prod", status: http.StatusForbidden},
+		{name: "another tenant's usage, the other way", key: "gx_globex", query: "?key=acme-prod", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/usage"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var report struct {
+				Data  []UsageRow  `json:"data"`
+				Total UsageTotals `json:"total"`
+			}
+			body, _ := io.ReadAll(rec.Body)
+			if err := json.Unmarshal(body, &report); err != nil {
+				t.Fatal(err)
+			}
+			if got := report.Total.TotalTokens; got != tt.tokens {
+				t.Errorf("total tokens = %d, want %d: %s", got, tt.tokens, body)
+			}
+		})
+	}
+}
+
+// A tenant's key spends its own tenant's token budget, whichever tenant
+// X-Tenant-ID names, so it can neither use up another's nor run on it.
+func TestTenantQuotaIsolation(t *testing.T) {
+	qm, err := NewQuotaManager(QuotaConfig{RedisURL: "redis://" + miniredis.RunT(t).Addr(), DefaultLimit: 10}, true, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := tenantServer(t, qm.Middleware)
+	asGlobex := map[string]string{TenantIDHeader: "globex", "Cache-Control": "no-cache"}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusPaymentRequired} {
+		if got := callAs(t, h, "sk-acme", asGlobex); got.status != want {
+			t.Fatalf("acme's request %d naming globex = %d, want %d", i, got.status, want)
+		}
+	}
+	if got := callAs(t, h, "gx_globex", map[string]string{"Cache-Control": "no-cache"}); got.status != http.StatusOK {
+		t.Errorf("globex = %d after acme named it, want its budget untouched", got.status)
+	}
+	st, err := qm.Status(context.Background(), "globex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Used != 7 {
+		t.Errorf("globex used %d tokens, want only its own 7", st.Used)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadPEM returns v itself when it holds PEM data, else the contents of the
+// file it names.
+func loadPEM(v string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+		return []byte(v), nil
+	}
+	return os.ReadFile(v)
+}
+
+func (b BackendConfig) hasTLS() bool {
+	return b.TLSCACert != "" || b.TLSClientCert != "" || b.TLSClientKey != ""
+}
+
+// tlsConfig builds the client TLS settings for the backend: its CA pinned
+// as the only trusted root and its client certificate presented for mTLS.
+// It returns nil when no tls_* field is set.
+func (b BackendConfig) tlsConfig() (*tls.Config, error) {
+	if !b.hasTLS() {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if b.TLSCACert != "" {
+		ca, err := loadPEM(b.TLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("tls_ca_cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("tls_ca_cert: no certificates found")
+		}
+		cfg.RootCAs = pool
+	}
+	if b.TLSClientCert != "" || b.TLSClientKey != "" {
+		if b.TLSClientCert == "" || b.TLSClientKey == "" {
+			return nil, fmt.Errorf("tls_client_cert and tls_client_key must be set together")
+		}
+		certPEM, err := loadPEM(b.TLSClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("tls_client_cert: %w", err)
+		}
+		keyPEM, err := loadPEM(b.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls_client_key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("tls_client_cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// tlsFiles lists the certificate and key files the config refers to, so
+// their contents can count towards the config version and a SIGHUP after
+// rotating them rebuilds the table.
+func (c *Config) tlsFiles() []string {
+	var files []string
+	var add func(b BackendConfig)
+	add = func(b BackendConfig) {
+		for _, v := range []string{b.TLSCACert, b.TLSClientCert, b.TLSClientKey} {
+			if v != "" && !strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+				files = append(files, v)
+			}
+		}
+		if ts := b.TrafficSplit; ts != nil {
+			for _, v := range ts.Variants {
+				add(v.Backend)
+			}
+		}
+	}
+	for _, bc := range c.Models {
+		add(bc)
+	}
+	for _, rule := range c.Rules {
+		add(rule.Backend)
+	}
+	sort.Strings(files)
+	return files
+}
+
+type errTransport struct{ err error }
+
+func (e errTransport) RoundTrip(*http.Request) (*http.Response, error) { return nil, e.err }
+
+// developmentEnvironment reports whether ENVIRONMENT names a development
+// setup, where plain-HTTP backends are expected.
+func developmentEnvironment() bool {
+	switch strings.ToLower(os.Getenv("ENVIRONMENT")) {
+	case "dev", "development", "local", "test":
+		return true
+	}
+	return false
+}
+
+// hashTLSFiles appends the contents of the config's certificate files to
+// data; unreadable files are left for Validate to report.
+func (c *Config) hashTLSFiles(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(data)
+	for _, f := range c.tlsFiles() {
+		if contents, err := os.ReadFile(f); err == nil {
+			buf.WriteString("\x00" + f + "\x00")
+			buf.Write(contents)
+		}
+	}
+	return buf.Bytes()
+}
+
+// certCheckInterval bounds how often the listener's certificate files are
+// checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// reloadingFile holds a value loaded from files and loads it again once
+// any of them has a newer modification time, so certificates rotated by
+// cert-manager are picked up without a restart. If the new files fail to
+// load, the last good value stays in use.
+type reloadingFile[T any] struct {
+	what   string
+	files  []string
+	load   func() (T, error)
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	value   T
+	modTime time.Time
+	checked time.Time
+}
+
+func newReloadingFile[T any](what string, files []string, load func() (T, error), logger *slog.Logger) (*reloadingFile[T], error) {
+	rf := &reloadingFile[T]{what: what, files: files, load: load, logger: logger}
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	rf.value, rf.modTime, rf.checked = v, rf.latestModTime(), time.Now()
+	return rf, nil
+}
+
+func (rf *reloadingFile[T]) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range rf.files {
+		// Stat follows the symlinks Kubernetes swaps when a secret changes.
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (rf *reloadingFile[T]) get() T {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if time.Since(rf.checked) < certCheckInterval {
+		return rf.value
+	}
+	rf.checked = time.Now()
+	if mt := rf.latestModTime(); mt.After(rf.modTime) {
+		v, err := rf.load()
+		if err != nil {
+			rf.logger.Warn("failed to reload "+rf.what+", keeping the previous one", slog.String("error", err.Error()))
+			return rf.value
+		}
+		rf.value, rf.modTime = v, mt
+		rf.logger.Info("reloaded "+rf.what, slog.String("files", strings.Join(rf.files, ",")))
+	}
+	return rf.value
+}
+
+// serverTLSConfig builds the listener's TLS settings from certFile and
+// keyFile: TLS 1.2 or later with forward-secret AEAD suites only. With
+// clientCAFile set every client must present a certificate signed by one of
+// its CAs, or the handshake fails. All three files are re-read when they
+// change.
+func serverTLSConfig(certFile, keyFile, clientCAFile string, logger *slog.Logger) (*tls.Config, error) {
+	cert, err := newReloadingFile("TLS certificate", []string{certFile, keyFile}, func() (*tls.Certificate, error) {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS_CERT_FILE/TLS_KEY_FILE: %w", err)
+		}
+		return &c, nil
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Only consulted for TLS 1.2; TLS 1.3 suites are all modern.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		},
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	cas, err := newReloadingFile("TLS client CA", []string{clientCAFile}, func() (*x509.CertPool, error) {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE: no certificates found in %s", clientCAFile)
+		}
+		return pool, nil
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = cas.get()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = cas.get()
+		return c, nil
+	}
+	return cfg, nil
+}
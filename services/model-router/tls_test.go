@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a self-signed certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a certificate for localhost named cn, valid until notAfter,
+// for a client or a server, and returns it and its key PEM encoded.
+func (ca *testCA) issue(t *testing.T, cn string, notAfter time.Time, client bool) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFiles writes files into dir by name.
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tlsServer serves ok with cfg alone; httptest's StartTLS would add its
+// own certificate.
+func tlsServer(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "https://", 1)
+}
+
+// tlsGet fetches url over a fresh connection with client settings tc.
+func tlsGet(url string, tc *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	return err
+}
+
+// The listener serves a certificate chaining to a CA the client trusts over
+// TLS 1.2 or later with AEAD suites only, and a client can tell an expired
+// or untrusted one.
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	tests := []struct {
+		name     string
+		notAfter time.Time
+		client   *tls.Config
+		wantErr  string
+	}{
+		{name: "valid chain", notAfter: time.Now().Add(time.Hour), client: &tls.Config{RootCAs: roots}},
+		{name: "expired", notAfter: time.Now().Add(-time.Minute), client: &tls.Config{RootCAs: roots}, wantErr: "expired"},
+		{name: "untrusted", notAfter: time.Now().Add(time.Hour), client: &tls.Config{}, wantErr: "unknown authority"},
+		{name: "TLS 1.1", notAfter: time.Now().Add(time.Hour), client: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, wantErr: "protocol version"},
+		{name: "CBC suite", notAfter: time.Now().Add(time.Hour), client: &tls.Config{
+			RootCAs: roots, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		}, wantErr: "handshake failure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPEM, keyPEM := ca.issue(t, "router", tt.notAfter, false)
+			writeFiles(t, dir, map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM})
+			cfg, err := serverTLSConfig(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), "", testLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tlsGet(tlsServer(t, cfg), tt.client)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// With a client CA configured, only clients presenting a current
+// certificate that CA signed get through.
+func TestServerTLSClientCerts(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "router", time.Now().Add(time.Hour), false)
+	writeFiles(t, dir, map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM, "ca.crt": ca.pem})
+	cfg, err := serverTLSConfig(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt"), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := tlsServer(t, cfg)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientCert := func(ca *testCA, notAfter time.Time) []tls.Certificate {
+		c, k := ca.issue(t, "client", notAfter, true)
+		cert, err := tls.X509KeyPair(c, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{name: "signed by the CA", certs: clientCert(ca, time.Now().Add(time.Hour)), ok: true},
+		{name: "none"},
+		{name: "signed by another CA", certs: clientCert(other, time.Now().Add(time.Hour))},
+		{name: "expired", certs: clientCert(ca, time.Now().Add(-time.Minute))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tlsGet(url, &tls.Config{RootCAs: roots, Certificates: tt.certs})
+			if tt.ok && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "router", time.Now().Add(time.Hour), false)
+	writeFiles(t, dir, map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM, "ca.crt": []byte("not a certificate")})
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	tests := []struct {
+		name              string
+		cert, key, caFile string
+		wantErr           string
+	}{
+		{name: "missing key", cert: cert, key: filepath.Join(dir, "missing.key"), wantErr: "TLS_CERT_FILE/TLS_KEY_FILE"},
+		{name: "key for another cert", cert: filepath.Join(dir, "ca.crt"), key: key, wantErr: "TLS_CERT_FILE/TLS_KEY_FILE"},
+		{name: "missing client CA", cert: cert, key: key, caFile: filepath.Join(dir, "missing.crt"), wantErr: "TLS_CLIENT_CA_FILE"},
+		{name: "client CA without certificates", cert: cert, key: key, caFile: filepath.Join(dir, "ca.crt"), wantErr: "no certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := serverTLSConfig(tt.cert, tt.key, tt.caFile, testLogger())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A rotated certificate is served once the files change and the check
+// interval has passed; a rotation that fails to load keeps the last good
+// certificate.
+func TestReloadingCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	rotate := func(cn string, age time.Duration) {
+		t.Helper()
+		certPEM, keyPEM := ca.issue(t, cn, time.Now().Add(time.Hour), false)
+		writeFiles(t, dir, map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM})
+		// Modification times are not always finer than the test is fast.
+		mt := time.Now().Add(-age)
+		os.Chtimes(certFile, mt, mt)
+		os.Chtimes(keyFile, mt, mt)
+	}
+	servedName := func(rf *reloadingFile[*tls.Certificate]) string {
+		t.Helper()
+		leaf, err := x509.ParseCertificate(rf.get().Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	rotate("first", time.Hour)
+	rf, err := newReloadingFile("TLS certificate", []string{certFile, keyFile}, func() (*tls.Certificate, error) {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		return &c, err
+	}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotate("second", 0)
+	if got := servedName(rf); got != "first" {
+		t.Errorf("within the check interval served %q, want first", got)
+	}
+	rf.checked = time.Now().Add(-certCheckInterval)
+	if got := servedName(rf); got != "second" {
+		t.Errorf("after the rotation served %q, want second", got)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("truncated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, mt, mt)
+	rf.checked = time.Now().Add(-certCheckInterval)
+	if got := servedName(rf); got != "second" {
+		t.Errorf("after a broken rotation served %q, want the last good second", got)
+	}
+}
+
+// mtlsUpstream is a TLS server for 127.0.0.1, with a certificate ca signed,
+// that requires a client certificate ca signed and answers with its common
+// name as the response ID.
+func mtlsUpstream(t *testing.T, ca *testCA) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "backend", time.Now().Add(time.Hour), false)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(ca.pem)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%q}`, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// mtlsCall sends a chat completion for m through h, returning the status
+// and the response ID.
+func mtlsCall(t *testing.T, h http.Handler) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	var resp struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp.ID
+}
+
+// A backend requiring mTLS is reached with the model's client certificate,
+// from files or inline PEM, and only when its own certificate chains to the
+// pinned CA.
+func TestUpstreamMTLS(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	upstream := mtlsUpstream(t, ca)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "router", time.Now().Add(time.Hour), true)
+	otherCert, otherKey := other.issue(t, "impostor", time.Now().Add(time.Hour), true)
+	writeFiles(t, dir, map[string][]byte{
+		"ca.pem": ca.pem, "router.pem": certPEM, "router.key": keyPEM,
+		"other-ca.pem": other.pem, "impostor.pem": otherCert, "impostor.key": otherKey,
+	})
+	file := func(name string) string { return strconv.Quote(filepath.Join(dir, name)) }
+	tests := []struct {
+		name   string
+		tls    string
+		status int
+	}{
+		{name: "files", tls: fmt.Sprintf("tls_ca_cert: %s, tls_client_cert: %s, tls_client_key: %s", file("ca.pem"), file("router.pem"), file("router.key")), status: http.StatusOK},
+		{name: "inline PEM", tls: fmt.Sprintf("tls_ca_cert: %q, tls_client_cert: %q, tls_client_key: %q", ca.pem, certPEM, keyPEM), status: http.StatusOK},
+		{name: "no client certificate", tls: "tls_ca_cert: " + file("ca.pem"), status: http.StatusBadGateway},
+		{name: "client certificate of another CA", tls: fmt.Sprintf("tls_ca_cert: %s, tls_client_cert: %s, tls_client_key: %s", file("ca.pem"), file("impostor.pem"), file("impostor.key")), status: http.StatusBadGateway},
+		{name: "backend not signed by the pinned CA", tls: fmt.Sprintf("tls_ca_cert: %s, tls_client_cert: %s, tls_client_key: %s", file("other-ca.pem"), file("router.pem"), file("router.key")), status: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: http://127.0.0.1:1, retry: {max_attempts: 1, base_delay: 1ms, max_delay: 1ms}}
+models:
+  m: {provider: a, url: %s, %s}
+`, upstream, tt.tls)))
+			status, id := mtlsCall(t, routeChain(t, rt))
+			if status != tt.status || (status == http.StatusOK && id != "router") {
+				t.Errorf("status %d as %q, want %d", status, id, tt.status)
+			}
+		})
+	}
+}
+
+// Rotated client certificate files are used from the next reload on.
+func TestUpstreamMTLSRotation(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	upstream := mtlsUpstream(t, ca)
+	dir := t.TempDir()
+	rotate := func(signer *testCA, cn string) {
+		t.Helper()
+		certPEM, keyPEM := signer.issue(t, cn, time.Now().Add(time.Hour), true)
+		writeFiles(t, dir, map[string][]byte{"router.pem": certPEM, "router.key": keyPEM})
+	}
+	writeFiles(t, dir, map[string][]byte{"ca.pem": ca.pem})
+	rotate(other, "untrusted")
+	path := writeConfig(t, "router.yaml", fmt.Sprintf(`
+providers:
+  a: {base_url: http://127.0.0.1:1, retry: {max_attempts: 1, base_delay: 1ms, max_delay: 1ms}}
+models:
+  m: {provider: a, url: %s, tls_ca_cert: %s, tls_client_cert: %s, tls_client_key: %s}
+`, upstream, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "router.pem"), filepath.Join(dir, "router.key")))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewModelRegistry(cfg, path, nil, nil, nil, nil, testLogger())
+	h := routeChain(t, NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger())))
+	if status, _ := mtlsCall(t, h); status != http.StatusBadGateway {
+		t.Fatalf("status = %d with a certificate the backend does not trust", status)
+	}
+
+	rotate(ca, "rotated")
+	if changed, err := registry.Reload(); err != nil || !changed {
+		t.Fatalf("Reload = %v, %v, want the rotated files to change the config", changed, err)
+	}
+	if status, id := mtlsCall(t, h); status != http.StatusOK || id != "rotated" {
+		t.Errorf("after the reload, status %d as %q, want 200 as rotated", status, id)
+	}
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"ca.pem": ca.pem, "junk.pem": []byte("junk")})
+	tests := []struct {
+		name    string
+		model   string
+		wantErr string
+	}{
+		{name: "plain HTTP url", model: fmt.Sprintf("{provider: a, url: http://10.0.0.1, tls_ca_cert: %s}", filepath.Join(dir, "ca.pem")), wantErr: "tls_* settings need an https url"},
+		{name: "certificate without key", model: "{provider: a, url: https://10.0.0.1, tls_client_cert: " + filepath.Join(dir, "ca.pem") + "}", wantErr: "tls_client_cert and tls_client_key must be set together"},
+		{name: "missing CA file", model: "{provider: a, url: https://10.0.0.1, tls_ca_cert: " + filepath.Join(dir, "missing.pem") + "}", wantErr: "tls_ca_cert"},
+		{name: "CA without certificates", model: "{provider: a, url: https://10.0.0.1, tls_ca_cert: " + filepath.Join(dir, "junk.pem") + "}", wantErr: "no certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "router.yaml", `
+providers:
+  a: {base_url: http://127.0.0.1:1}
+models:
+  m: `+tt.model+"\n"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadConfig error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package tracing adds OpenTelemetry spans with W3C TraceContext
+// propagation. Tracing is enabled by OTEL_EXPORTER_OTLP_ENDPOINT; without it
+// New returns nil and every method is a no-op.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+const instrumentationName = "github.com/aspendos/model-router"
+
+// Tracing owns the tracer provider and propagator. All methods are safe to
+// call on a nil *Tracing.
+type Tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New sets up an OTLP gRPC exporter when OTEL_EXPORTER_OTLP_ENDPOINT is set
+// and returns nil otherwise. The exporter also honours the standard
+// OTEL_EXPORTER_OTLP_* variables (insecure, headers, ...), and the sampler
+// OTEL_TRACES_SAMPLER.
+func New(ctx context.Context, service, version string) (*Tracing, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", service),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	return &Tracing{
+		provider:   provider,
+		tracer:     provider.Tracer(instrumentationName),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}, nil
+}
+
+// Shutdown flushes buffered spans.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// Middleware continues the trace from an incoming traceparent/tracestate
+// header (or starts a new one) with a server span per request, annotated
+// with the model and provider it was routed to and the tokens it used.
+func (t *Tracing) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+				attribute.Int64("request.size_bytes", r.ContentLength),
+			))
+		defer span.End()
+
+		rw := middleware.WrapResponseWriter(w)
+		r, info := middleware.WithRequestInfo(r.WithContext(ctx))
+		next.ServeHTTP(rw, r)
+		if model, provider := info.Route(); model != "" {
+			span.SetAttributes(attribute.String("model.name", model), attribute.String("backend.provider", provider))
+		}
+		setTokens(span, info)
+		setStatus(span, rw.StatusCode(), nil)
+	})
+}
+
+// EndFunc finishes an upstream span with the response status, or 0 and the
+// transport error when there was no response.
+type EndFunc func(status int, err error)
+
+func noopEnd(int, error) {}
+
+// StartUpstream starts a client span for one upstream attempt and injects
+// its trace context into header, which must be the outgoing request's.
+// Retries and fallbacks each get their own span; attempt counts from 1
+// within a provider's retries.
+func (t *Tracing) StartUpstream(ctx context.Context, provider, model, backendURL string, attempt, size int, header http.Header) (context.Context, EndFunc) {
+	if t == nil {
+		return ctx, noopEnd
+	}
+	ctx, span := t.tracer.Start(ctx, "upstream "+provider,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("model.name", model),
+			attribute.String("backend.url", backendURL),
+			attribute.String("backend.provider", provider),
+			attribute.Int("upstream.attempt", attempt),
+			attribute.Int("request.size_bytes", size),
+		))
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	return ctx, func(status int, err error) {
+		setTokens(span, middleware.RequestInfoFrom(ctx))
+		setStatus(span, status, err)
+		span.End()
+	}
+}
+
+// setTokens records the tokens the router charged for the request, once
+// its response has been read.
+func setTokens(span trace.Span, info *middleware.RequestInfo) {
+	if n := info.Tokens(); n > 0 {
+		span.SetAttributes(attribute.Int64("usage.total_tokens", n))
+	}
+}
+
+func setStatus(span trace.Span, status int, err error) {
+	if status > 0 {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+	}
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case status >= 500:
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// Transform rewrites one JSON document, a request before it is forwarded
+// or a response before it is returned, field by field. Fields are kept
+// raw so whatever a transform does not touch passes through unchanged.
+type Transform interface {
+	Apply(doc map[string]json.RawMessage) error
+}
+
+// TransformConfig is one step of a model's transforms. Params are the
+// transform's own settings; On is "request" (default) or "response".
+type TransformConfig struct {
+	Name   string         `json:"name"`
+	On     string         `json:"on,omitempty"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// transformError is a request a transform could not apply to, such as one
+// whose messages are not a list, which is the client's fault.
+type transformError struct{ err error }
+
+func (e *transformError) Error() string { return e.err.Error() }
+func (e *transformError) Unwrap() error { return e.err }
+
+// transforms maps a transform's name in the config to its constructor,
+// which decodes and checks the params.
+var transforms = map[string]func(params map[string]any) (Transform, error){
+	"cap_max_tokens":       newCapMaxTokens,
+	"strip_fields":         newStripFields,
+	"inject_system_prompt": newInjectSystemPrompt,
+	"rename_model":         newRenameModel,
+}
+
+// decodeParams decodes a transform's params into dst, rejecting unknown
+// ones.
+func decodeParams(params map[string]any, dst any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return decodeStrict(data, dst)
+}
+
+// TransformPipeline is a model's transforms, split by direction and kept in
+// config order.
+type TransformPipeline struct {
+	request  []Transform
+	response []Transform
+}
+
+func newTransformPipeline(configs []TransformConfig) (*TransformPipeline, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	tp := &TransformPipeline{}
+	for i, tc := range configs {
+		build, ok := transforms[tc.Name]
+		if !ok {
+			return nil, fmt.Errorf("transforms[%d]: unknown transform %q", i, tc.Name)
+		}
+		t, err := build(tc.Params)
+		if err != nil {
+			return nil, fmt.Errorf("transforms[%d] (%s): %w", i, tc.Name, err)
+		}
+		switch tc.On {
+		case "", "request":
+			tp.request = append(tp.request, t)
+		case "response":
+			tp.response = append(tp.response, t)
+		default:
+			return nil, fmt.Errorf("transforms[%d].on: %q is not request or response", i, tc.On)
+		}
+	}
+	return tp, nil
+}
+
+func applyTransforms(ts []Transform, body []byte) ([]byte, error) {
+	if len(ts) == 0 {
+		return body, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	for _, t := range ts {
+		if err := t.Apply(doc); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// Request applies the request transforms; a nil pipeline returns body as is.
+func (tp *TransformPipeline) Request(body []byte) ([]byte, error) {
+	if tp == nil {
+		return body, nil
+	}
+	return applyTransforms(tp.request, body)
+}
+
+// Response applies the response transforms to a successful JSON response.
+// Event streams and error bodies are passed through.
+func (tp *TransformPipeline) Response(resp *http.Response) error {
+	if tp == nil || len(tp.response) == 0 || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+	return rewriteBody(resp, func(body []byte) ([]byte, error) {
+		return applyTransforms(tp.response, body)
+	})
+}
+
+// rewriteBody replaces resp's body with what rewrite makes of it.
+func rewriteBody(resp *http.Response, rewrite func([]byte) ([]byte, error)) error {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	out, err := rewrite(body)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	return nil
+}
+
+// capMaxTokens lowers max_tokens and max_completion_tokens to a backend's
+// limit; requests asking for less, or not saying, are left alone.
+type capMaxTokens struct {
+	MaxTokens int64 `json:"max_tokens"`
+}
+
+func newCapMaxTokens(params map[string]any) (Transform, error) {
+	var t capMaxTokens
+	if err := decodeParams(params, &t); err != nil {
+		return nil, err
+	}
+	if t.MaxTokens <= 0 {
+		return nil, fmt.Errorf("max_tokens must be positive")
+	}
+	return t, nil
+}
+
+func (t capMaxTokens) Apply(doc map[string]json.RawMessage) error {
+	for _, field := range []string{"max_tokens", "max_completion_tokens"} {
+		raw, ok := doc[field]
+		if !ok {
+			continue
+		}
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		if n > float64(t.MaxTokens) {
+			doc[field] = json.RawMessage(strconv.FormatInt(t.MaxTokens, 10))
+		}
+	}
+	return nil
+}
+
+// stripFields drops top-level fields a backend rejects, such as "user".
+type stripFields struct {
+	Fields []string `json:"fields"`
+}
+
+func newStripFields(params map[string]any) (Transform, error) {
+	var t stripFields
+	if err := decodeParams(params, &t); err != nil {
+		return nil, err
+	}
+	if len(t.Fields) == 0 {
+		return nil, fmt.Errorf("fields is required")
+	}
+	return t, nil
+}
+
+func (t stripFields) Apply(doc map[string]json.RawMessage) error {
+	for _, f := range t.Fields {
+		delete(doc, f)
+	}
+	return nil
+}
+
+// injectSystemPrompt puts Prompt ahead of the conversation: prefixed to
+// the leading system message, or as a new one if there is none.
+type injectSystemPrompt struct {
+	Prompt string `json:"prompt"`
+}
+
+func newInjectSystemPrompt(params map[string]any) (Transform, error) {
+	var t injectSystemPrompt
+	if err := decodeParams(params, &t); err != nil {
+		return nil, err
+	}
+	if t.Prompt == "" {
+		return nil, fmt.Errorf("prompt is required")
+	}
+	return t, nil
+}
+
+func (t injectSystemPrompt) Apply(doc map[string]json.RawMessage) error {
+	var messages []map[string]json.RawMessage
+	if raw, ok := doc["messages"]; ok {
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return fmt.Errorf("messages: %w", err)
+		}
+	}
+	prompt, _ := json.Marshal(t.Prompt)
+	var role, content string
+	if len(messages) > 0 {
+		json.Unmarshal(messages[0]["role"], &role)
+	}
+	switch {
+	case role != "system":
+		messages = append([]map[string]json.RawMessage{{"role": json.RawMessage(`"system"`), "content": prompt}}, messages...)
+	case json.Unmarshal(messages[0]["content"], &content) == nil:
+		messages[0]["content"], _ = json.Marshal(t.Prompt + "\n\n" + content)
+	default:
+		// Content given as parts: the prompt becomes the first text part.
+		var parts []json.RawMessage
+		if err := json.Unmarshal(messages[0]["content"], &parts); err != nil {
+			return fmt.Errorf("messages[0].content: %w", err)
+		}
+		part, _ := json.Marshal(map[string]string{"type": "text", "text": t.Prompt})
+		messages[0]["content"], _ = json.Marshal(append([]json.RawMessage{part}, parts...))
+	}
+	var err error
+	doc["messages"], err = json.Marshal(messages)
+	return err
+}
+
+// renameModel sends the request under the name the backend knows the
+// model by.
+type renameModel struct {
+	Model string `json:"model"`
+}
+
+func newRenameModel(params map[string]any) (Transform, error) {
+	var t renameModel
+	if err := decodeParams(params, &t); err != nil {
+		return nil, err
+	}
+	if t.Model == "" {
+		return nil, fmt.Errorf("model is required")
+	}
+	return t, nil
+}
+
+func (t renameModel) Apply(doc map[string]json.RawMessage) error {
+	var err error
+	doc["model"], err = json.Marshal(t.Model)
+	return err
+}
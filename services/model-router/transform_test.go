@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sameJSON reports whether a and b hold the same JSON value.
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "cap_max_tokens lowers both limits",
+			config: TransformConfig{Name: "cap_max_tokens", Params: map[string]any{"max_tokens": 1024}},
+			in:     `{"max_tokens":4096,"max_completion_tokens":2000}`,
+			want:   `{"max_tokens":1024,"max_completion_tokens":1024}`,
+		},
+		{
+			name:   "cap_max_tokens leaves lower and missing limits",
+			config: TransformConfig{Name: "cap_max_tokens", Params: map[string]any{"max_tokens": 1024}},
+			in:     `{"max_tokens":100}`,
+			want:   `{"max_tokens":100}`,
+		},
+		{
+			name:    "cap_max_tokens on a limit that is not a number",
+			config:  TransformConfig{Name: "cap_max_tokens", Params: map[string]any{"max_tokens": 1024}},
+			in:      `{"max_tokens":"lots"}`,
+			wantErr: "max_tokens:",
+		},
+		{
+			name:   "strip_fields",
+			config: TransformConfig{Name: "strip_fields", Params: map[string]any{"fields": []any{"user", "logit_bias", "absent"}}},
+			in:     `{"model":"m","user":"u","logit_bias":{"1":2},"n":1}`,
+			want:   `{"model":"m","n":1}`,
+		},
+		{
+			name:   "inject_system_prompt adds a system message",
+			config: TransformConfig{Name: "inject_system_prompt", Params: map[string]any{"prompt": "Be brief."}},
+			in:     `{"messages":[{"role":"user","content":"hi"}]}`,
+			want:   `{"messages":[{"role":"system","content":"Be brief."},{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name:   "inject_system_prompt prefixes the system message",
+			config: TransformConfig{Name: "inject_system_prompt", Params: map[string]any{"prompt": "Be brief."}},
+			in:     `{"messages":[{"role":"system","content":"You are a poet."},{"role":"user","content":"hi"}]}`,
+			want:   `{"messages":[{"role":"system","content":"Be brief.\n\nYou are a poet."},{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name:   "inject_system_prompt into content parts",
+			config: TransformConfig{Name: "inject_system_prompt", Params: map[string]any{"prompt": "Be brief."}},
+			in:     `{"messages":[{"role":"system","content":[{"type":"text","text":"You are a poet."}]}]}`,
+			want:   `{"messages":[{"role":"system","content":[{"type":"text","text":"Be brief."},{"type":"text","text":"You are a poet."}]}]}`,
+		},
+		{
+			name:    "inject_system_prompt into messages that are not a list",
+			config:  TransformConfig{Name: "inject_system_prompt", Params: map[string]any{"prompt": "Be brief."}},
+			in:      `{"messages":"hi"}`,
+			wantErr: "messages:",
+		},
+		{
+			name:   "rename_model",
+			config: TransformConfig{Name: "rename_model", Params: map[string]any{"model": "meta-llama/Llama-3-8B"}},
+			in:     `{"model":"llama-3-8b","stream":true}`,
+			want:   `{"model":"meta-llama/Llama-3-8B","stream":true}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp, err := newTransformPipeline([]TransformConfig{tt.config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tp.Request([]byte(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameJSON(t, got, []byte(tt.want)) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Response transforms rewrite successful JSON responses only, and request
+// transforms leave them alone.
+func TestTransformResponse(t *testing.T) {
+	tp, err := newTransformPipeline([]TransformConfig{
+		{Name: "rename_model", Params: map[string]any{"model": "backend-name"}},
+		{Name: "rename_model", On: "response", Params: map[string]any{"model": "public-name"}},
+		{Name: "strip_fields", On: "response", Params: map[string]any{"fields": []any{"system_fingerprint"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const body = `{"model":"backend-name","system_fingerprint":"fp_1"}`
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		want        string
+	}{
+		{name: "json", status: http.StatusOK, contentType: "application/json; charset=utf-8", want: `{"model":"public-name"}`},
+		{name: "error", status: http.StatusBadRequest, contentType: "application/json", want: body},
+		{name: "stream", status: http.StatusOK, contentType: "text/event-stream", want: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Header:     http.Header{"Content-Type": {tt.contentType}},
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}
+			if err := tp.Response(resp); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want && !sameJSON(t, got, []byte(tt.want)) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if tt.name == "json" && resp.Header.Get("Content-Length") != fmt.Sprint(len(got)) {
+				t.Errorf("Content-Length = %s for %d bytes", resp.Header.Get("Content-Length"), len(got))
+			}
+		})
+	}
+	if got, err := (*TransformPipeline)(nil).Request([]byte("not json")); err != nil || string(got) != "not json" {
+		t.Errorf("nil pipeline Request = %q, %v", got, err)
+	}
+}
+
+// Through the router, the upstream receives the transformed request and
+// the client the transformed response.
+func TestTransformsRouted(t *testing.T) {
+	got := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- string(body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"resp-1","model":"meta-llama/Llama-3-8B"}`)
+	}))
+	defer upstream.Close()
+	h := routeChain(t, newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  llama:
+    provider: a
+    transforms:
+      - {name: rename_model, params: {model: meta-llama/Llama-3-8B}}
+      - {name: cap_max_tokens, params: {max_tokens: 512}}
+      - {name: strip_fields, params: {fields: [user]}}
+      - {name: rename_model, on: response, params: {model: llama}}
+`, upstream.URL))))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, chatRequest(`{"model":"llama","max_tokens":4096,"user":"u-1","messages":[{"role":"user","content":"hi"}]}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if want := `{"model":"meta-llama/Llama-3-8B","max_tokens":512,"messages":[{"role":"user","content":"hi"}]}`; !sameJSON(t, []byte(<-got), []byte(want)) {
+		t.Errorf("upstream got a request other than %s", want)
+	}
+	if !sameJSON(t, rec.Body.Bytes(), []byte(`{"id":"resp-1","model":"llama"}`)) {
+		t.Errorf("client got %s", rec.Body)
+	}
+}
+
+func TestTransformConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		wantErr string
+	}{
+		{name: "unknown", config: TransformConfig{Name: "uppercase"}, wantErr: `transforms[0]: unknown transform "uppercase"`},
+		{name: "bad direction", config: TransformConfig{Name: "strip_fields", On: "both", Params: map[string]any{"fields": []any{"user"}}}, wantErr: `transforms[0].on: "both" is not request or response`},
+		{name: "unknown param", config: TransformConfig{Name: "rename_model", Params: map[string]any{"model": "m", "to": "n"}}, wantErr: "transforms[0] (rename_model)"},
+		{name: "cap without a limit", config: TransformConfig{Name: "cap_max_tokens"}, wantErr: "max_tokens must be positive"},
+		{name: "strip without fields", config: TransformConfig{Name: "strip_fields"}, wantErr: "fields is required"},
+		{name: "inject without a prompt", config: TransformConfig{Name: "inject_system_prompt"}, wantErr: "prompt is required"},
+		{name: "rename without a model", config: TransformConfig{Name: "rename_model"}, wantErr: "model is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTransformPipeline([]TransformConfig{tt.config})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
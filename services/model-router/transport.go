@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 64
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportConfig tunes the connection pool of a provider's HTTP client:
+// MaxIdleConns and MaxIdleConnsPerHost (defaults 256 and 64) idle
+// connections kept for IdleConnTimeout (default 90s), DialTimeout
+// (default 30s) to connect, TLSHandshakeTimeout (default 10s) for the
+// handshake and ResponseHeaderTimeout (default none beyond the request's
+// timeout) for response headers. DisableHTTP2 keeps to HTTP/1.1, for
+// servers whose HTTP/2 misbehaves.
+type TransportConfig struct {
+	MaxIdleConns          int      `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host,omitempty"`
+	IdleConnTimeout       Duration `json:"idle_conn_timeout,omitempty"`
+	DialTimeout           Duration `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty"`
+	DisableHTTP2          bool     `json:"disable_http2,omitempty"`
+}
+
+func (tc TransportConfig) validate() error {
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns and max_idle_conns_per_host must not be negative")
+	}
+	if tc.IdleConnTimeout < 0 || tc.DialTimeout < 0 || tc.TLSHandshakeTimeout < 0 || tc.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("idle_conn_timeout, dial_timeout, tls_handshake_timeout and response_header_timeout must not be negative")
+	}
+	return nil
+}
+
+// transport builds the connection pool for HTTP clients with tc's
+// settings. Go's default keeps only two idle connections per host, so a
+// busy backend would otherwise open and tear down a connection, and burn
+// an ephemeral port, for most requests.
+func (tc TransportConfig) transport(tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.MaxIdleConns = defaultMaxIdleConns
+	if tc.MaxIdleConns > 0 {
+		t.MaxIdleConns = tc.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if tc.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+	t.IdleConnTimeout = defaultIdleConnTimeout
+	if tc.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = time.Duration(tc.IdleConnTimeout)
+	}
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: 30 * time.Second}
+	if tc.DialTimeout > 0 {
+		dialer.Timeout = time.Duration(tc.DialTimeout)
+	}
+	t.DialContext = dialer.DialContext
+	t.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	if tc.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = time.Duration(tc.TLSHandshakeTimeout)
+	}
+	if tc.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = time.Duration(tc.ResponseHeaderTimeout)
+	}
+	if tc.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto is how net/http is told not to
+		// negotiate HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+func (b BackendConfig) hasTransport() bool {
+	return b.MaxIdleConns > 0 || b.MaxIdleConnsPerHost > 0 || b.IdleConnTimeoutSeconds > 0 || b.ResponseHeaderTimeoutSeconds > 0
+}
+
+// transport builds the connection pool for the backend's HTTP clients.
+func (b BackendConfig) transport(tlsConfig *tls.Config) *http.Transport {
+	return TransportConfig{
+		MaxIdleConns:          b.MaxIdleConns,
+		MaxIdleConnsPerHost:   b.MaxIdleConnsPerHost,
+		IdleConnTimeout:       Duration(b.IdleConnTimeoutSeconds * float64(time.Second)),
+		ResponseHeaderTimeout: Duration(b.ResponseHeaderTimeoutSeconds * float64(time.Second)),
+	}.transport(tlsConfig)
+}
+
+// client returns the HTTP client for backends with bc's TLS and connection
+// pool settings, built once per distinct setting within a table and reused
+// by every request to them. A certificate that stopped loading since
+// validation fails every request rather than falling back to an
+// unauthenticated connection.
+func (tb *tableBuilder) client(bc BackendConfig) *http.Client {
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%d\x00%g\x00%g", bc.TLSCACert, bc.TLSClientCert, bc.TLSClientKey,
+		bc.MaxIdleConns, bc.MaxIdleConnsPerHost, bc.IdleConnTimeoutSeconds, bc.ResponseHeaderTimeoutSeconds)
+	if c, ok := tb.clients[key]; ok {
+		return c
+	}
+	var c *http.Client
+	if cfg, err := bc.tlsConfig(); err != nil {
+		c = &http.Client{Transport: errTransport{err}}
+	} else {
+		c = &http.Client{Transport: bc.transport(cfg)}
+	}
+	tb.clients[key] = c
+	return c
+}
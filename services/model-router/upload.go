@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// uploadPaths are the OpenAI endpoints whose requests are files sent as
+// multipart/form-data, with the model as one of the form's fields.
+var uploadPaths = []string{
+	"/v1/audio/transcriptions",
+	"/v1/audio/translations",
+	"/v1/images/edits",
+	"/v1/images/variations",
+}
+
+// maxFormPeekBytes bounds how far into an upload the router reads to find
+// its model field. Clients send form fields ahead of files, so the field is
+// normally in the first few hundred bytes.
+const maxFormPeekBytes = 1 << 20
+
+var errNoFormModel = errors.New(`multipart body must have a "model" field ahead of its files`)
+
+// isMultipart reports whether h declares a multipart/form-data body. Such
+// bodies are streamed upstream as they arrive, so middleware that reads
+// request bodies leaves them alone.
+func isMultipart(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// uploadBody counts the bytes of an upload as they stream through and
+// fails the read that would take it past limit with a MaxBytesError, like
+// http.MaxBytesReader, without holding any of it.
+type uploadBody struct {
+	io.ReadCloser
+	limit int64
+	n     int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if b.n > b.limit {
+		return 0, &http.MaxBytesError{Limit: b.limit}
+	}
+	if room := b.limit - b.n; int64(len(p)) > room {
+		p = p[:room+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.n > b.limit {
+		return n - 1, &http.MaxBytesError{Limit: b.limit}
+	}
+	return n, err
+}
+
+func (b *uploadBody) tooLarge() bool { return b.n > b.limit }
+
+// readFormPrefix reads up to maxFormPeekBytes of r's multipart body and
+// returns them with the form's boundary and the rest of the body. The
+// caller puts the two back together.
+func readFormPrefix(r *http.Request) (prefix []byte, boundary string, rest io.ReadCloser, err error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, "", r.Body, errors.New("multipart content type has no boundary")
+	}
+	prefix, err = io.ReadAll(io.LimitReader(r.Body, maxFormPeekBytes))
+	return prefix, params["boundary"], r.Body, err
+}
+
+func withPrefix(prefix []byte, rest io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), rest), rest}
+}
+
+// peekFormModel reads the "model" field of r's multipart body and restores
+// the body so it can be read again from the start.
+func peekFormModel(r *http.Request) (string, error) {
+	prefix, boundary, rest, err := readFormPrefix(r)
+	if err != nil {
+		// Replay the read error too, so the handler still sees e.g. a MaxBytesError.
+		r.Body = withPrefix(prefix, struct {
+			io.Reader
+			io.Closer
+		}{errReader{err}, rest})
+		return "", err
+	}
+	r.Body = withPrefix(prefix, rest)
+	start, end, ok := formField(prefix, boundary, "model")
+	if !ok {
+		return "", errNoFormModel
+	}
+	return string(prefix[start:end]), nil
+}
+
+// setFormModel rewrites the "model" field of r's multipart body, leaving
+// every other byte of it as the client sent it.
+func setFormModel(r *http.Request, model string) error {
+	prefix, boundary, rest, err := readFormPrefix(r)
+	if err != nil {
+		r.Body = withPrefix(prefix, rest)
+		return err
+	}
+	start, end, ok := formField(prefix, boundary, "model")
+	if !ok {
+		r.Body = withPrefix(prefix, rest)
+		return errNoFormModel
+	}
+	r.Body = withPrefix(slices.Concat(prefix[:start], []byte(model), prefix[end:]), rest)
+	if r.ContentLength > 0 {
+		r.ContentLength += int64(len(model) - (end - start))
+	}
+	return nil
+}
+
+// formField finds the value of the form field name among the parts that
+// are whole within prefix, the start of a multipart body, and returns
+// where it starts and ends. File parts are never the field.
+func formField(prefix []byte, boundary, name string) (start, end int, ok bool) {
+	delim := []byte("--" + boundary)
+	i := bytes.Index(prefix, delim)
+	for i >= 0 {
+		i += len(delim)
+		if bytes.HasPrefix(prefix[i:], []byte("--")) {
+			return 0, 0, false
+		}
+		headerEnd := bytes.Index(prefix[i:], []byte("\r\n\r\n"))
+		if headerEnd < 0 || !bytes.HasPrefix(prefix[i:], []byte("\r\n")) {
+			return 0, 0, false
+		}
+		start = i + headerEnd + 4
+		next := bytes.Index(prefix[start:], append([]byte("\r\n"), delim...))
+		if next < 0 {
+			return 0, 0, false
+		}
+		end = start + next
+		header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(prefix[i+2 : start]))).ReadMIMEHeader()
+		if err == nil {
+			_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+			if err == nil && params["name"] == name {
+				if _, file := params["filename"]; !file {
+					return start, end, true
+				}
+			}
+		}
+		i = end + 2
+	}
+	return 0, 0, false
+}
+
+// handleUpload forwards a multipart/form-data request, such as an audio
+// file to transcribe or an image to edit, to the backend of the model named
+// in its form. The body streams upstream as it arrives, boundary and all,
+// and counts against the model's max_body_bytes as it does, so a large
+// file is never held in memory. The model must list multipart/form-data in
+// accepted_content_types.
+//
+// An upload can only be read once, so it is sent in a single attempt:
+// there are no retries, fallbacks or shadow traffic, and transforms,
+// plugins and guardrails, which work on JSON bodies, do not run.
+func (rt *Router) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !isMultipart(r.Header) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", "content type must be multipart/form-data")
+		return
+	}
+	model, err := peekFormModel(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the router limit")
+		case errors.Is(err, errNoFormModel):
+			writeError(w, http.StatusBadRequest, "missing_model", err.Error())
+		default:
+			writeError(w, http.StatusBadRequest, "invalid_request", "could not read request body: "+err.Error())
+		}
+		return
+	}
+	entries := rt.registry.LookupFor(model, nil)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, "model_not_found", "no provider configured for model "+model)
+		return
+	}
+	entry := entries[0]
+	if r.ContentLength > entry.MaxBodyBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the limit for model "+model)
+		return
+	}
+	if !acceptsContentType(entry.Config.acceptedContentTypes(), r.Header.Get("Content-Type")) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "content type not accepted for model "+model)
+		return
+	}
+	timeout := rt.requestTimeout(r.Context(), entry.Config)
+	if timeout <= 0 {
+		writeDeadlineError(w, model, phaseQueueing)
+		return
+	}
+	ctx, stopDeadline := withRequestDeadline(r.Context(), timeout, false)
+	defer stopDeadline()
+
+	target, _, err := SelectTarget(TargetRequest{Entries: entries, Hint: newRouteHint(nil, r)})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "provider_unavailable", "no backend available for model "+model)
+		return
+	}
+	backend := target.Backend
+	info := middleware.RequestInfoFrom(ctx)
+	provider := rt.registry.Tenants().Lookup(info.Tenant()).Provider(backend.Provider)
+	if provider.Adapter != nil || provider.GRPC != nil || provider.Encoding != nil {
+		backend.Breaker.Cancel()
+		writeError(w, http.StatusBadRequest, "invalid_request", "uploads cannot be sent to "+provider.Name)
+		return
+	}
+	if target.Variant != nil && target.Variant.Model != "" {
+		setFormModel(r, target.Variant.Model)
+	}
+	info.SetRoute(model, provider.Name)
+	info.SetBackendURL(provider.BaseURL)
+	info.SetDecision(target.Decision.String())
+
+	release, err := backend.Limiter.Acquire(ctx)
+	if err != nil {
+		backend.Breaker.Cancel()
+		var qe *queueError
+		switch {
+		case errors.Is(context.Cause(ctx), errRequestTimeout):
+			writeDeadlineError(w, model, phaseQueueing)
+		case errors.As(err, &qe):
+			w.Header().Set("Retry-After", qe.retryAfter())
+			writeError(w, http.StatusTooManyRequests, "rate_limited", qe.Error())
+		}
+		return
+	}
+	defer release()
+
+	var src io.ReadCloser = r.Body
+	var digest *digestReader
+	if entry.Config.IntegrityCheck {
+		want, err := declaredDigest(r.Header)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_content_sha256", err.Error())
+			return
+		}
+		if want != nil {
+			digest = newDigestReader(r.Body, want)
+			src = digest
+		}
+	}
+	body := &uploadBody{ReadCloser: src, limit: entry.MaxBodyBytes}
+	header := http.Header{"Content-Type": {r.Header.Get("Content-Type")}}
+	size := r.ContentLength
+	if size == 0 {
+		size = -1
+	}
+	info.SetState(inflightUpstream)
+	start := time.Now()
+	resp, err := rt.attempt(observingFirstByte(ctx, backend), provider, r.URL.Path, body, size, header, 1)
+	deadlineHit := errors.Is(context.Cause(ctx), errRequestTimeout)
+	clientGone := ctx.Err() != nil && !deadlineHit
+	// A body cut off at its limit, or that failed its integrity check, says
+	// nothing about the backend either.
+	tooLarge := body.tooLarge() || errors.As(err, new(*http.MaxBytesError))
+	corrupted := digest != nil && digest.mismatch
+	if err == nil {
+		backend.ObserveLatency(time.Since(start))
+		backend.RateLimit.Observe(resp)
+		defer resp.Body.Close()
+	}
+	recordOutcome(backend, resp, err, clientGone || tooLarge || corrupted)
+	if !clientGone && !tooLarge && !corrupted {
+		backend.ObserveOutcome(time.Since(start), err != nil || resp.StatusCode >= 500)
+	}
+	if target.Slot != nil && !clientGone {
+		target.Entry.BlueGreen.Observe(target.Slot, err != nil || resp.StatusCode >= 500)
+	}
+	if err != nil {
+		switch {
+		case tooLarge:
+			writeError(w, http.StatusRequestEntityTooLarge, "request_too_large", "request body exceeds the limit for model "+model)
+		case corrupted:
+			writeError(w, http.StatusBadRequest, "content_sha256_mismatch", errContentDigest.Error())
+		case clientGone:
+			rt.metrics.UpstreamError(model, "client_canceled")
+		case deadlineHit:
+			rt.metrics.UpstreamError(model, "timeout")
+			writeDeadlineError(w, model, phaseUpstream)
+		case errors.Is(err, errUpstreamTimeout):
+			rt.metrics.UpstreamError(model, "timeout")
+			writeError(w, http.StatusGatewayTimeout, "timeout", "upstream "+provider.Name+" did not respond in time")
+		default:
+			rt.metrics.UpstreamError(model, "connection")
+			writeError(w, http.StatusBadGateway, "provider_unavailable", "upstream "+provider.Name+" request failed")
+		}
+		return
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		rt.metrics.UpstreamError(model, "status_5xx")
+	case resp.StatusCode == http.StatusTooManyRequests:
+		rt.metrics.UpstreamError(model, "rate_limited")
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		rt.metrics.UpstreamAuthFailure(provider.Name, resp.StatusCode)
+		if resp.StatusCode == http.StatusUnauthorized && rt.onUpstreamUnauthorized != nil {
+			rt.onUpstreamUnauthorized()
+		}
+	}
+
+	w.Header().Set("X-Aspendos-Served-By", provider.Name+"/"+model)
+	w.Header().Set("X-Aspendos-Provider", provider.Name)
+	if target.Variant != nil {
+		w.Header().Set("X-Aspendos-Variant", target.Variant.Name)
+	}
+	w.Header().Set(RouteDecisionHeader, target.Decision.String())
+	if ra := resp.Header.Get("Retry-After"); ra != "" && resp.StatusCode == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", ra)
+	}
+	if resp.StatusCode >= 400 {
+		writeUpstreamError(w, provider, model, resp)
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	var out io.Reader = resp.Body
+	done := func() {}
+	if entry.Config.IntegrityCheck {
+		out, done = writeDigestTrailer(w, resp.Body)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyAndFlush(w, out); err == nil {
+		done()
+	}
+}
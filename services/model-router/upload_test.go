@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pngForm is a multipart form naming model ahead of a 10 MB PNG, and the
+// PNG.
+func pngForm(t *testing.T, model string) (form *bytes.Buffer, contentType string, png []byte) {
+	t.Helper()
+	png = make([]byte, 10<<20)
+	copy(png, "\x89PNG\r\n\x1a\n")
+	rng := rand.NewChaCha8([32]byte{1})
+	rng.Read(png[8:])
+	form = &bytes.Buffer{}
+	mw := multipart.NewWriter(form)
+	mw.WriteField("model", model)
+	fw, err := mw.CreateFormFile("image", "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(png)
+	mw.Close()
+	return form, mw.FormDataContentType(), png
+}
+
+// received is what an upload upstream was sent.
+type received struct {
+	contentType string
+	body        []byte
+}
+
+// A 10 MB image reaches the upstream byte for byte under the client's
+// boundary, whether it is sent with a length or chunked.
+func TestUploadForwardedIntact(t *testing.T) {
+	got := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{contentType: r.Header.Get("Content-Type"), body: body}
+		io.WriteString(w, `{"created":1,"data":[]}`)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  dall-e-2: {provider: a, max_body_bytes: 16777216, accepted_content_types: [multipart/form-data]}
+`, upstream.URL)))
+	srv := httptest.NewServer(withRouteMiddleware(t, rt, NewInFlight(), http.HandlerFunc(rt.handleUpload)))
+	defer srv.Close()
+	form, contentType, png := pngForm(t, "dall-e-2")
+
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(form.Bytes())
+			if chunked {
+				// Hides the length, so the client sends it chunked.
+				body = io.MultiReader(body)
+			}
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/images/edits", body)
+			req.Header.Set("Content-Type", contentType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			up := <-got
+			if up.contentType != contentType {
+				t.Errorf("upstream Content-Type = %q, want the client's %q", up.contentType, contentType)
+			}
+			if sha256Hex(up.body) != sha256Hex(form.Bytes()) {
+				t.Errorf("upstream received %d bytes differing from the %d sent", len(up.body), form.Len())
+			}
+			_, params, _ := mime.ParseMediaType(up.contentType)
+			part, err := multipart.NewReader(bytes.NewReader(up.body), params["boundary"]).NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if model, _ := io.ReadAll(part); string(model) != "dall-e-2" {
+				t.Errorf("model field = %q", model)
+			}
+			if file := fileOf(t, up.body, params["boundary"]); !bytes.Equal(file, png) {
+				t.Errorf("upstream PNG is %d bytes differing from the %d sent", len(file), len(png))
+			}
+		})
+	}
+}
+
+// fileOf is the file part of a multipart body.
+func fileOf(t *testing.T, body []byte, boundary string) []byte {
+	t.Helper()
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("no file part: %v", err)
+		}
+		if part.FileName() != "" {
+			b, _ := io.ReadAll(part)
+			return b
+		}
+	}
+}
+
+// Uploads are never answered from the cache, an idempotency replay or
+// another request in flight: each repeat, concurrent or not, reaches the
+// upstream.
+func TestUploadBypassesCacheAndDedup(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		n := calls.Add(1)
+		// Slow enough that a concurrent repeat arrives while it is in
+		// flight, when coalescing it would have had the chance to.
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"text":"call %d"}`, n)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  whisper: {provider: a, cache_enabled: true, accepted_content_types: [multipart/form-data]}
+`, upstream.URL)))
+	h := withRouteMiddleware(t, rt, NewInFlight(), http.HandlerFunc(rt.handleUpload))
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "whisper")
+	fw, _ := mw.CreateFormFile("file", "audio.wav")
+	fw.Write(bytes.Repeat([]byte("RIFF"), 1024))
+	mw.Close()
+	call := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/audio/transcriptions", bytes.NewReader(form.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("Idempotency-Key", "upload-1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := call(); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") == "HIT" {
+			t.Fatalf("upload %d: %d, X-Cache %q", i, rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := call(); rec.Code != http.StatusOK {
+				t.Errorf("concurrent upload: %d %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := calls.Load(); got != 4 {
+		t.Errorf("upstream called %d times for 4 uploads", got)
+	}
+}
+
+// No middleware ahead of the handler reads an upload whole: past the first
+// MiB the router reads for the model field, it reaches the upstream while
+// the client is still holding back the rest.
+func TestUploadStreamsThroughMiddleware(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, maxFormPeekBytes+64<<10)
+		if _, err := io.ReadFull(r.Body, buf); err != nil {
+			t.Errorf("reading the start: %v", err)
+		}
+		close(started)
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"text":"ok"}`)
+	}))
+	defer upstream.Close()
+	rt := newTestRouter(t, testConfig(t, fmt.Sprintf(`
+providers:
+  a: {base_url: %s}
+models:
+  whisper: {provider: a, cache_enabled: true, max_body_bytes: 16777216, accepted_content_types: [multipart/form-data]}
+`, upstream.URL)))
+	h := withRouteMiddleware(t, rt, NewInFlight(), http.HandlerFunc(rt.handleUpload))
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("model", "whisper")
+	fw, _ := mw.CreateFormFile("file", "audio.wav")
+	fw.Write(bytes.Repeat([]byte("RIFF"), 1<<20))
+	mw.Close()
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "/v1/audio/transcriptions", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Idempotency-Key", "upload-1")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		done <- rec
+	}()
+
+	half := form.Len() / 2
+	pw.Write(form.Bytes()[:half])
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream got no more than the first MiB of the upload's first half")
+	}
+	pw.Write(form.Bytes()[half:])
+	pw.Close()
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", rec.Code, rec.Body)
+	}
+}
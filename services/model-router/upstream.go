@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type upstreamState struct {
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+}
+
+// UpstreamTracker remembers when each provider last answered, so readiness
+// can tell a provider that is down from one that simply has not been used.
+type UpstreamTracker struct {
+	mu     sync.Mutex
+	states map[string]*upstreamState
+}
+
+func NewUpstreamTracker() *UpstreamTracker {
+	return &UpstreamTracker{states: make(map[string]*upstreamState)}
+}
+
+func (t *UpstreamTracker) state(provider string) *upstreamState {
+	s, ok := t.states[provider]
+	if !ok {
+		s = &upstreamState{}
+		t.states[provider] = s
+	}
+	return s
+}
+
+// RecordSuccess notes that provider returned an HTTP response of any status,
+// to live traffic or to a health check.
+func (t *UpstreamTracker) RecordSuccess(provider string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.state(provider).lastSuccess = time.Now()
+	t.mu.Unlock()
+}
+
+// RecordFailure notes that provider could not be reached at all.
+func (t *UpstreamTracker) RecordFailure(provider string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	s := t.state(provider)
+	s.lastFailure = time.Now()
+	s.lastError = err.Error()
+	t.mu.Unlock()
+}
+
+// Unreachable lists providers whose latest attempt failed and that have not
+// answered within window. Providers never contacted are not reported.
+func (t *UpstreamTracker) Unreachable(window time.Duration) map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]string)
+	now := time.Now()
+	for name, s := range t.states {
+		if s.lastFailure.After(s.lastSuccess) && now.Sub(s.lastSuccess) > window {
+			out[name] = s.lastError
+		}
+	}
+	return out
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// NewUpstreamClient returns the HTTP client for requests to the provider
+// called name, with a connection pool of its own tuned by tc. It reports
+// the pool's idle and in-use connections, overall and by backend URL, how
+// often a pooled connection is reused and how long the phases of a
+// request take, to m.
+func NewUpstreamClient(name string, tc TransportConfig, m *metrics.Metrics) *http.Client {
+	t := tc.transport(nil)
+	stats := &connStats{provider: name, metrics: m}
+	dial := t.DialContext
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		h := stats.host(addr, addr)
+		stats.add(h, 1, 0)
+		return &countedConn{Conn: c, stats: stats, host: h}, nil
+	}
+	return &http.Client{Transport: &tracedTransport{base: t, stats: stats}}
+}
+
+// connStats counts a pool's open connections and the requests holding
+// one, overall and by backend. Idle is the difference, which HTTP/2
+// requests sharing a connection can push below zero; it is reported as
+// zero then.
+type connStats struct {
+	provider string
+	metrics  *metrics.Metrics
+	open     atomic.Int64
+	inUse    atomic.Int64
+	// hosts holds a *hostConns per address dialed.
+	hosts sync.Map
+}
+
+// hostConns counts the connections to one backend address, reported under
+// its URL.
+type hostConns struct {
+	url   string
+	open  atomic.Int64
+	inUse atomic.Int64
+}
+
+// host returns the counts for addr, host:port as the transport dials it,
+// named backendURL if they are new. Requests name their backend before it
+// is dialed; a connection to an address no request named, such as a
+// proxy's, goes by the address.
+func (s *connStats) host(addr, backendURL string) *hostConns {
+	if h, ok := s.hosts.Load(addr); ok {
+		return h.(*hostConns)
+	}
+	h, _ := s.hosts.LoadOrStore(addr, &hostConns{url: backendURL})
+	return h.(*hostConns)
+}
+
+func (s *connStats) add(h *hostConns, open, inUse int64) {
+	o, u := s.open.Add(open), s.inUse.Add(inUse)
+	s.metrics.UpstreamConnections(s.provider, max(o-u, 0), u)
+	ho, hu := h.open.Add(open), h.inUse.Add(inUse)
+	s.metrics.IdleConnections(h.url, max(ho-hu, 0))
+}
+
+// countedConn leaves the count of open connections when closed.
+type countedConn struct {
+	net.Conn
+	stats  *connStats
+	host   *hostConns
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { c.stats.add(c.host, -1, 0) })
+	return c.Conn.Close()
+}
+
+// tracedTransport counts each request as holding a connection from the
+// moment it gets one until its response body is read or closed, and times
+// the DNS lookup, connect and TLS handshake of any connection it opens and
+// its wait for the first response byte.
+type tracedTransport struct {
+	base  *http.Transport
+	stats *connStats
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backendURL := req.URL.Scheme + "://" + req.URL.Host
+	held := &heldConn{stats: t.stats, host: t.stats.host(canonicalAddr(req.URL), backendURL)}
+	start := time.Now()
+	var phases phaseTimes
+	observe := func(phase string, since time.Time) {
+		t.stats.metrics.UpstreamPhase(backendURL, phase, time.Since(since))
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { phases.begin(&phases.dns) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if began, ok := phases.end(&phases.dns); ok && info.Err == nil {
+				observe("dns", began)
+			}
+		},
+		ConnectStart: func(string, string) { phases.begin(&phases.connect) },
+		ConnectDone: func(_, _ string, err error) {
+			if began, ok := phases.end(&phases.connect); ok && err == nil {
+				observe("connect", began)
+			}
+		},
+		TLSHandshakeStart: func() { phases.begin(&phases.tls) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if began, ok := phases.end(&phases.tls); ok && err == nil {
+				observe("tls_handshake", began)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.stats.metrics.ConnectionAcquired(t.stats.provider, info.Reused)
+			held.acquire()
+		},
+		GotFirstResponseByte: func() { observe("first_byte", start) },
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		held.release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, held: held}
+	return resp, nil
+}
+
+// canonicalAddr is the host:port the transport dials for u.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// phaseTimes is when each phase of setting up a request's connection
+// began. The trace's hooks may run on the transport's dialing goroutines,
+// and when it races addresses, several connects may overlap; only the
+// first of each phase is timed.
+type phaseTimes struct {
+	mu                sync.Mutex
+	dns, connect, tls phase
+}
+
+type phase struct {
+	began time.Time
+	timed bool
+}
+
+func (p *phaseTimes) begin(ph *phase) {
+	p.mu.Lock()
+	if ph.began.IsZero() {
+		ph.began = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// end returns when ph began, and false if it never began or has been
+// timed already.
+func (p *phaseTimes) end(ph *phase) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ph.began.IsZero() || ph.timed {
+		return time.Time{}, false
+	}
+	ph.timed = true
+	return ph.began, true
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// pool.
+func (t *tracedTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// heldConn is one request's claim on a connection. The transport may get
+// a second connection when a reused one turns out dead, so acquiring and
+// releasing count once each.
+type heldConn struct {
+	stats *connStats
+	host  *hostConns
+	state atomic.Int32 // 0 none, 1 held, 2 released
+}
+
+func (h *heldConn) acquire() {
+	if h.state.CompareAndSwap(0, 1) {
+		h.stats.add(h.host, 0, 1)
+	}
+}
+
+func (h *heldConn) release() {
+	if h.state.Swap(2) == 1 {
+		h.stats.add(h.host, 0, -1)
+	}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	held *heldConn
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.held.release()
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	b.held.release()
+	return b.ReadCloser.Close()
+}
+
+type upstreamClient struct {
+	cfg    TransportConfig
+	client *http.Client
+}
+
+// upstreamClients keeps each provider's client across reloads, so its
+// pooled connections survive them.
+type upstreamClients struct {
+	metrics *metrics.Metrics
+
+	mu      sync.Mutex
+	clients map[string]upstreamClient
+}
+
+// Update returns the client of each provider in cfg by name, reusing the
+// existing one when its transport settings are unchanged. Replaced
+// clients close their idle connections; requests still using them finish.
+func (uc *upstreamClients) Update(cfg *Config) map[string]*http.Client {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	next := make(map[string]upstreamClient, len(cfg.Providers))
+	out := make(map[string]*http.Client, len(cfg.Providers))
+	for name, pc := range cfg.Providers {
+		var tc TransportConfig
+		if pc.Transport != nil {
+			tc = *pc.Transport
+		}
+		c, ok := uc.clients[name]
+		if !ok || c.cfg != tc {
+			c = upstreamClient{cfg: tc, client: NewUpstreamClient(name, tc, uc.metrics)}
+		}
+		next[name] = c
+		out[name] = c.client
+	}
+	for name, c := range uc.clients {
+		if n, ok := next[name]; !ok || n.client != c.client {
+			c.client.CloseIdleConnections()
+		}
+	}
+	uc.clients = next
+	return out
+}
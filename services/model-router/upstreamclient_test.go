@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aspendos/model-router/metrics"
+)
+
+// tlsUpstream is a TLS server answering ok, and the client for provider
+// name set up to trust it, reached as localhost so the lookup is traced.
+func tlsUpstream(t *testing.T, name string, m *metrics.Metrics) (*http.Client, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(srv.Close)
+	client := NewUpstreamClient(name, TransportConfig{}, m)
+	tc := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	// httptest's certificate is for example.com, not localhost.
+	tc.ServerName = "example.com"
+	client.Transport.(*tracedTransport).base.TLSClientConfig = tc
+	u, _ := url.Parse(srv.URL)
+	return client, "https://localhost:" + u.Port()
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Against a real TLS server, a new connection times its lookup, connect,
+// handshake and first byte, and a request reusing it only its first byte.
+func TestUpstreamPhases(t *testing.T) {
+	m := metrics.New()
+	client, backend := tlsUpstream(t, "a", m)
+	get(t, client, backend)
+	get(t, client, backend)
+
+	out := scrape(t, m)
+	for phase, want := range map[string]int{"dns": 1, "connect": 1, "tls_handshake": 1, "first_byte": 2} {
+		series := fmt.Sprintf(`router_upstream_phase_duration_seconds_count{backend_url=%q,phase=%q} %d`, backend, phase, want)
+		if !strings.Contains(out, series) {
+			t.Errorf("missing %s", series)
+		}
+	}
+	if want := fmt.Sprintf(`router_idle_connections{backend_url=%q} 1`, backend); !strings.Contains(out, want) {
+		t.Errorf("missing %s", want)
+	}
+}
+
+// A second request to the same backend reuses the first one's connection,
+// and the pool's metrics say so.
+func TestUpstreamConnectionReused(t *testing.T) {
+	m := metrics.New()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	client := NewUpstreamClient("a", TransportConfig{}, m)
+
+	var reused []bool
+	for range 2 {
+		// The caller's trace runs alongside the client's own.
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+		})
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if !slices.Equal(reused, []bool{false, true}) {
+		t.Errorf("GotConn.Reused = %v, want [false true]", reused)
+	}
+	out := scrape(t, m)
+	for _, want := range []string{
+		`router_upstream_connections_acquired_total{provider="a",reused="false"} 1`,
+		`router_upstream_connections_acquired_total{provider="a",reused="true"} 1`,
+		`router_upstream_connections{provider="a",state="idle"} 1`,
+		`router_upstream_connections{provider="a",state="in_use"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
+
+// A provider's pooled connections survive a reload that leaves its
+// transport settings alone, and are replaced by one that changes them.
+func TestUpstreamConnectionsSurviveReload(t *testing.T) {
+	remotes := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes <- r.RemoteAddr
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"resp-1"}`)
+	}))
+	defer upstream.Close()
+	const config = `
+providers:
+  a: {base_url: %s, transport: {max_idle_conns_per_host: %d}}
+models:
+  m: a
+  %s: a
+`
+	path := writeConfig(t, "router.yaml", fmt.Sprintf(config, upstream.URL, 8, "first"))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewModelRegistry(cfg, path, nil, nil, nil, nil, testLogger())
+	rt := NewRouter(registry, nil, NewUpstreamTracker(), nil, testLogger(), NewUsageAccumulator(testLogger()))
+	h := routeChain(t, rt)
+	call := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, chatRequest(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		return <-remotes
+	}
+	reload := func(perHost int, model string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(config, upstream.URL, perHost, model)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := call()
+	if again := call(); again != first {
+		t.Errorf("second request came from %s, want the first's connection %s", again, first)
+	}
+	reload(8, "second")
+	if after := call(); after != first {
+		t.Errorf("after a reload keeping the transport, request came from %s, want %s", after, first)
+	}
+	reload(16, "second")
+	if after := call(); after == first {
+		t.Errorf("after a reload changing the transport, request still came from %s", after)
+	}
+}
+
+func TestTransportConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		tc    TransportConfig
+		check func(t *testing.T, tr *http.Transport)
+	}{
+		{name: "defaults", check: func(t *testing.T, tr *http.Transport) {
+			if tr.MaxIdleConns != 256 || tr.MaxIdleConnsPerHost != 64 || tr.IdleConnTimeout != 90*time.Second || tr.TLSHandshakeTimeout != 10*time.Second || tr.ResponseHeaderTimeout != 0 {
+				t.Errorf("pool %d, %d per host, idle %v, handshake %v, headers %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.TLSHandshakeTimeout, tr.ResponseHeaderTimeout)
+			}
+			if !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+				t.Error("HTTP/2 not attempted")
+			}
+		}},
+		{name: "tuned", tc: TransportConfig{
+			MaxIdleConns: 10, MaxIdleConnsPerHost: 5, IdleConnTimeout: Duration(time.Second),
+			TLSHandshakeTimeout: Duration(2 * time.Second), ResponseHeaderTimeout: Duration(3 * time.Second),
+		}, check: func(t *testing.T, tr *http.Transport) {
+			if tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 5 || tr.IdleConnTimeout != time.Second || tr.TLSHandshakeTimeout != 2*time.Second || tr.ResponseHeaderTimeout != 3*time.Second {
+				t.Errorf("pool %d, %d per host, idle %v, handshake %v, headers %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.TLSHandshakeTimeout, tr.ResponseHeaderTimeout)
+			}
+		}},
+		{name: "HTTP/2 disabled", tc: TransportConfig{DisableHTTP2: true}, check: func(t *testing.T, tr *http.Transport) {
+			if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+				t.Error("HTTP/2 still negotiated")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, tt.tc.transport(nil))
+		})
+	}
+	if err := (TransportConfig{DialTimeout: -1}).validate(); err == nil {
+		t.Error("negative dial_timeout accepted")
+	}
+}
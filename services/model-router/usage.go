@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aspendos/model-router/middleware"
+)
+
+// Usage accounting keeps token totals per caller and model in one-minute
+// buckets for a retention window, answers GET /v1/usage from them and
+// periodically writes what accumulated since the last flush as JSON lines
+// for billing pipelines.
+
+const (
+	usageBucket    = time.Minute
+	usageRetention = 24 * time.Hour
+	// maxUsageSniff bounds how much of a non-streamed response is kept to
+	// find its usage block.
+	maxUsageSniff = 4 << 20
+)
+
+type UsageTotals struct {
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+func (t *UsageTotals) add(o UsageTotals) {
+	t.Requests += o.Requests
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+}
+
+type usageKey struct {
+	key, model string
+}
+
+type usageSlot struct {
+	minute int64
+	usageKey
+}
+
+type UsageAccumulator struct {
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	buckets  map[usageSlot]*UsageTotals
+	pending  map[usageKey]*UsageTotals
+	periodAt time.Time
+}
+
+func NewUsageAccumulator(logger *slog.Logger) *UsageAccumulator {
+	return &UsageAccumulator{
+		logger:   logger,
+		buckets:  make(map[usageSlot]*UsageTotals),
+		pending:  make(map[usageKey]*UsageTotals),
+		periodAt: time.Now(),
+	}
+}
+
+// Record adds one completion's usage for the caller identified by key.
+func (u *UsageAccumulator) Record(key, model string, t UsageTotals) {
+	if u == nil {
+		return
+	}
+	k := usageKey{key: key, model: model}
+	slot := usageSlot{minute: time.Now().Truncate(usageBucket).Unix(), usageKey: k}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.buckets[slot] == nil {
+		u.buckets[slot] = &UsageTotals{}
+	}
+	u.buckets[slot].add(t)
+	if u.pending[k] == nil {
+		u.pending[k] = &UsageTotals{}
+	}
+	u.pending[k].add(t)
+}
+
+type UsageRow struct {
+	Key   string `json:"key"`
+	Model string `json:"model"`
+	UsageTotals
+}
+
+// Totals sums the buckets from since onwards, optionally for one key.
+func (u *UsageAccumulator) Totals(key string, since time.Time) []UsageRow {
+	from := since.Truncate(usageBucket).Unix()
+	sums := make(map[usageKey]*UsageTotals)
+	u.mu.Lock()
+	for slot, t := range u.buckets {
+		if slot.minute < from || (key != "" && slot.key != key) {
+			continue
+		}
+		if sums[slot.usageKey] == nil {
+			sums[slot.usageKey] = &UsageTotals{}
+		}
+		sums[slot.usageKey].add(*t)
+	}
+	u.mu.Unlock()
+	return usageRows(sums)
+}
+
+func usageRows(sums map[usageKey]*UsageTotals) []UsageRow {
+	rows := make([]UsageRow, 0, len(sums))
+	for k, t := range sums {
+		rows = append(rows, UsageRow{Key: k.key, Model: k.model, UsageTotals: *t})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Key != rows[j].Key {
+			return rows[i].Key < rows[j].Key
+		}
+		return rows[i].Model < rows[j].Model
+	})
+	return rows
+}
+
+type usageFlushLine struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	UsageRow
+}
+
+// Flush writes one JSON line per key and model for the usage recorded
+// since the previous flush and drops buckets past the retention window.
+func (u *UsageAccumulator) Flush(w io.Writer) error {
+	now := time.Now()
+	u.mu.Lock()
+	pending, start := u.pending, u.periodAt
+	u.pending, u.periodAt = make(map[usageKey]*UsageTotals), now
+	cutoff := now.Add(-usageRetention).Unix()
+	for slot := range u.buckets {
+		if slot.minute < cutoff {
+			delete(u.buckets, slot)
+		}
+	}
+	u.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range usageRows(pending) {
+		enc.Encode(usageFlushLine{PeriodStart: start.UTC(), PeriodEnd: now.UTC(), UsageRow: row})
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Run flushes to w every interval until ctx ends, then once more.
+func (u *UsageAccumulator) Run(ctx context.Context, w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := u.Flush(w); err != nil {
+				u.logger.Warn("final usage flush failed", slog.String("error", err.Error()))
+			}
+			return
+		case <-ticker.C:
+			if err := u.Flush(w); err != nil {
+				u.logger.Warn("usage flush failed", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// usageCaller names who a request is billed to: the API key name, else the
+// JWT subject, else "anonymous".
+func usageCaller(info *middleware.RequestInfo) string {
+	if key := info.APIKey(); key != "" {
+		return key
+	}
+	if sub := info.Subject(); sub != "" {
+		return sub
+	}
+	return "anonymous"
+}
+
+// handleUsage serves GET /v1/usage?key=<name>&since=<RFC 3339 or unix
+// seconds>. Authenticated callers only see their own usage; without auth
+// every key is visible and key filters.
+func (rt *Router) handleUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since := time.Now().Add(-usageRetention)
+	if v := q.Get("since"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		} else if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			since = time.Unix(secs, 0)
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid_request", "since must be an RFC 3339 time or unix seconds")
+			return
+		}
+	}
+	key := q.Get("key")
+	info := middleware.RequestInfoFrom(r.Context())
+	if caller := usageCaller(info); caller != "anonymous" {
+		if key != "" && key != caller {
+			writeError(w, http.StatusForbidden, "forbidden", "usage of other keys is not visible to "+caller)
+			return
+		}
+		key = caller
+	}
+
+	rows := rt.usage.Totals(key, since)
+	var total UsageTotals
+	for _, row := range rows {
+		total.add(row.UsageTotals)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"object": "usage",
+		"since":  since.UTC().Format(time.RFC3339),
+		"data":   rows,
+		"total":  total,
+	})
+}
+
+// usageSniffer watches a response body as it is relayed and picks out the
+// OpenAI usage block: from the whole body for plain responses, or from the
+// last data: event that carries one for streams. Providers that send no
+// usage simply yield nothing.
+type usageSniffer struct {
+	stream   bool
+	buf      bytes.Buffer
+	overflow bool
+	found    *UsageTotals
+}
+
+type usageBlock struct {
+	Usage *struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+		TotalTokens      int64 `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func (s *usageSniffer) Write(p []byte) (int, error) {
+	if !s.stream {
+		if s.overflow = s.overflow || s.buf.Len()+len(p) > maxUsageSniff; !s.overflow {
+			s.buf.Write(p)
+		}
+		return len(p), nil
+	}
+	s.buf.Write(p)
+	for {
+		line, err := s.buf.ReadBytes('\n')
+		if err != nil {
+			// Keep the partial line for the next write.
+			rest := bytes.Clone(line)
+			s.buf.Reset()
+			s.buf.Write(rest)
+			break
+		}
+		if data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok && bytes.Contains(data, []byte(`"usage"`)) {
+			s.parse(bytes.TrimSpace(data))
+		}
+	}
+	return len(p), nil
+}
+
+func (s *usageSniffer) parse(data []byte) {
+	var b usageBlock
+	if json.Unmarshal(data, &b) != nil || b.Usage == nil {
+		return
+	}
+	t := &UsageTotals{
+		Requests:         1,
+		PromptTokens:     b.Usage.PromptTokens,
+		CompletionTokens: b.Usage.CompletionTokens,
+		TotalTokens:      b.Usage.TotalTokens,
+	}
+	if t.TotalTokens == 0 {
+		t.TotalTokens = t.PromptTokens + t.CompletionTokens
+	}
+	s.found = t
+}
+
+// Usage returns what was found, or a request with no token counts.
+func (s *usageSniffer) Usage() UsageTotals {
+	if !s.stream && !s.overflow && s.found == nil {
+		s.parse(s.buf.Bytes())
+	}
+	if s.found == nil {
+		return UsageTotals{Requests: 1}
+	}
+	return *s.found
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ValidationError is a request rejected before routing. Code is the
+// machine-readable error code in the response envelope.
+type ValidationError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+// RouteRequestInfo holds the routing-relevant fields of a validated request.
+type RouteRequestInfo struct {
+	RouteRequest
+	MessageCount int
+}
+
+func invalid(code, message string) *ValidationError {
+	return &ValidationError{Status: http.StatusBadRequest, Code: code, Message: message}
+}
+
+// ValidateRouteRequest parses the fields the router needs before forwarding
+// and rejects requests that could never be served: a JSON body that does
+// not parse, no model, or a chat request without messages. Requests
+// carrying an explicit payload are exempt from the messages check, since
+// that body is forwarded untouched. Whether the model takes the content
+// type is for the model's accepted_content_types to decide once it is
+// known, so a body of another type is only read for its model; one that
+// is not JSON cannot name it.
+func ValidateRouteRequest(contentType string, body []byte) (RouteRequestInfo, *ValidationError) {
+	var info RouteRequestInfo
+	if verr := decodeBody(contentType, body, &info.RouteRequest); verr != nil {
+		return info, verr
+	}
+	if strings.TrimSpace(info.Model) == "" {
+		return info, invalid("missing_model", "model is required")
+	}
+	if len(info.Payload) > 0 {
+		return info, nil
+	}
+	if raw := bytes.TrimSpace(info.Messages); len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return info, invalid("empty_messages", "messages must contain at least one message")
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(info.Messages, &messages); err != nil {
+		return info, invalid("invalid_messages", "messages must be an array")
+	}
+	if len(messages) == 0 {
+		return info, invalid("empty_messages", "messages must contain at least one message")
+	}
+	info.MessageCount = len(messages)
+	return info, nil
+}
+
+// ValidateEmbeddingsRequest checks an embeddings request the same way: a
+// JSON body with a model and at least one input.
+func ValidateEmbeddingsRequest(contentType string, body []byte) (RouteRequestInfo, *ValidationError) {
+	var info RouteRequestInfo
+	var req struct {
+		Model string          `json:"model"`
+		Input json.RawMessage `json:"input"`
+	}
+	if verr := decodeBody(contentType, body, &req); verr != nil {
+		return info, verr
+	}
+	if strings.TrimSpace(req.Model) == "" {
+		return info, invalid("missing_model", "model is required")
+	}
+	inputs, err := embeddingInputs(req.Input)
+	if err != nil {
+		return info, invalid("invalid_input", err.Error())
+	}
+	info.Model = req.Model
+	info.MessageCount = len(inputs)
+	return info, nil
+}
+
+// decodeBody decodes a request body into v. A body declared JSON must be a
+// JSON object; one of any other type that is not has no model to route by.
+func decodeBody(contentType string, body []byte, v any) *ValidationError {
+	if err := json.Unmarshal(body, v); err != nil {
+		if isJSONMediaType(contentType) {
+			return invalid("invalid_json", "request body must be a valid JSON object")
+		}
+		return invalid("missing_model", "model is required, and a body that is not JSON cannot name one")
+	}
+	return nil
+}
+
+// isJSONMediaType accepts application/json and structured +json types.
+func isJSONMediaType(header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateRouteRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    string
+		wantModel   string
+		wantCount   int
+	}{
+		{name: "valid", contentType: "application/json", body: `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, wantModel: "m", wantCount: 1},
+		{name: "charset parameter", contentType: "application/json; charset=utf-8", body: `{"model":"m","messages":[{},{}]}`, wantModel: "m", wantCount: 2},
+		{name: "structured json type", contentType: "application/vnd.api+json", body: `{"model":"m","messages":[{}]}`, wantModel: "m", wantCount: 1},
+		{name: "payload skips messages", contentType: "application/json", body: `{"model":"m","payload":{"prompt":"hi"}}`, wantModel: "m"},
+		{name: "malformed json", contentType: "application/json", body: `{"model":`, wantCode: "invalid_json"},
+		{name: "json array", contentType: "application/json", body: `[]`, wantCode: "invalid_json"},
+		{name: "missing model", contentType: "application/json", body: `{"messages":[{}]}`, wantCode: "missing_model"},
+		{name: "blank model", contentType: "application/json", body: `{"model":"  ","messages":[{}]}`, wantCode: "missing_model"},
+		{name: "no messages", contentType: "application/json", body: `{"model":"m"}`, wantCode: "empty_messages"},
+		{name: "null messages", contentType: "application/json", body: `{"model":"m","messages":null}`, wantCode: "empty_messages"},
+		{name: "empty messages", contentType: "application/json", body: `{"model":"m","messages":[]}`, wantCode: "empty_messages"},
+		{name: "messages not an array", contentType: "application/json", body: `{"model":"m","messages":"hi"}`, wantCode: "invalid_messages"},
+		// Other content types are for the model to accept or refuse.
+		{name: "other type with a json body", contentType: "text/plain", body: `{"model":"m","messages":[{}]}`, wantModel: "m", wantCount: 1},
+		{name: "no content type with a json body", body: `{"model":"m","messages":[{}]}`, wantModel: "m", wantCount: 1},
+		{name: "other type still needs messages", contentType: "application/octet-stream", body: `{"model":"m"}`, wantCode: "empty_messages"},
+		{name: "other type without a json body", contentType: "application/octet-stream", body: "\x00\x01binary", wantCode: "missing_model"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, verr := ValidateRouteRequest(tt.contentType, []byte(tt.body))
+			if tt.wantCode != "" {
+				if verr == nil || verr.Code != tt.wantCode || verr.Status != http.StatusBadRequest {
+					t.Fatalf("error = %+v, want 400 %s", verr, tt.wantCode)
+				}
+				return
+			}
+			if verr != nil {
+				t.Fatalf("error = %+v, want none", verr)
+			}
+			if info.Model != tt.wantModel || info.MessageCount != tt.wantCount {
+				t.Errorf("model, messages = %q, %d, want %q, %d", info.Model, info.MessageCount, tt.wantModel, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestValidateEmbeddingsRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantCode    string
+		wantCount   int
+	}{
+		{name: "one input", contentType: "application/json", body: `{"model":"e","input":"hello"}`, wantCount: 1},
+		{name: "many inputs", contentType: "application/json", body: `{"model":"e","input":["a","b","c"]}`, wantCount: 3},
+		{name: "other type with a json body", contentType: "text/plain", body: `{"model":"e","input":"hello"}`, wantCount: 1},
+		{name: "malformed json", contentType: "application/json", body: `{`, wantCode: "invalid_json"},
+		{name: "missing model", contentType: "application/json", body: `{"input":"hello"}`, wantCode: "missing_model"},
+		{name: "missing input", contentType: "application/json", body: `{"model":"e"}`, wantCode: "invalid_input"},
+		{name: "other type without a json body", contentType: "application/octet-stream", body: "hello", wantCode: "missing_model"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, verr := ValidateEmbeddingsRequest(tt.contentType, []byte(tt.body))
+			if tt.wantCode != "" {
+				if verr == nil || verr.Code != tt.wantCode {
+					t.Fatalf("error = %+v, want %s", verr, tt.wantCode)
+				}
+				return
+			}
+			if verr != nil {
+				t.Fatalf("error = %+v, want none", verr)
+			}
+			if info.MessageCount != tt.wantCount {
+				t.Errorf("inputs = %d, want %d", info.MessageCount, tt.wantCount)
+			}
+		})
+	}
+}
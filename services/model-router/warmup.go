@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWarmupRequests   = 3
+	defaultWarmupMaxLatency = 10 * time.Second
+	defaultWarmupTimeout    = 2 * time.Minute
+	// warmupRetryDelay spaces out probes after a failed one, so a backend
+	// that is still loading is not hammered.
+	warmupRetryDelay = time.Second
+)
+
+// warmupConfig is a model's warm-up settings with defaults applied.
+type warmupConfig struct {
+	payload    string
+	requests   int
+	maxLatency time.Duration
+	timeout    time.Duration
+}
+
+// warmup returns the model's warm-up settings, or false if it has no
+// warmup_payload.
+func (bc BackendConfig) warmup() (warmupConfig, bool) {
+	if bc.WarmupPayload == "" {
+		return warmupConfig{}, false
+	}
+	wc := warmupConfig{
+		payload:    bc.WarmupPayload,
+		requests:   bc.WarmupRequests,
+		maxLatency: time.Duration(bc.WarmupMaxLatencySeconds * float64(time.Second)),
+		timeout:    time.Duration(bc.WarmupTimeoutSeconds * float64(time.Second)),
+	}
+	if wc.requests <= 0 {
+		wc.requests = defaultWarmupRequests
+	}
+	if wc.maxLatency <= 0 {
+		wc.maxLatency = defaultWarmupMaxLatency
+	}
+	if wc.timeout <= 0 {
+		wc.timeout = defaultWarmupTimeout
+	}
+	return wc, true
+}
+
+const (
+	warmReady int32 = iota
+	warmWarming
+	warmDegraded
+)
+
+// WarmUpState is where a backend stands in its warm-up. It is shared by
+// the backend's copies across reloads, so a reload during a warm-up does
+// not put the backend into service early.
+type WarmUpState struct {
+	state atomic.Int32
+}
+
+// Warming reports whether a warm-up is still running; nil is never warming.
+func (w *WarmUpState) Warming() bool {
+	return w != nil && w.state.Load() == warmWarming
+}
+
+// Degraded reports whether the last warm-up timed out.
+func (w *WarmUpState) Degraded() bool {
+	return w != nil && w.state.Load() == warmDegraded
+}
+
+func (w *WarmUpState) String() string {
+	switch w.state.Load() {
+	case warmWarming:
+		return "warming"
+	case warmDegraded:
+		return "degraded"
+	}
+	return "ready"
+}
+
+// begin moves w to warming, reporting false if a warm-up already runs.
+func (w *WarmUpState) begin() bool {
+	for {
+		s := w.state.Load()
+		if s == warmWarming {
+			return false
+		}
+		if w.state.CompareAndSwap(s, warmWarming) {
+			return true
+		}
+	}
+}
+
+// WarmUpProbe sends a model's warmup_payload to its new backends until
+// enough consecutive requests return 200 within the latency threshold,
+// keeping them out of their pools until then. A backend that does not get
+// there before the warm-up timeout is marked degraded: it serves again,
+// but only when no other replica of its pool can.
+type WarmUpProbe struct {
+	client *http.Client
+	logger *slog.Logger
+}
+
+func NewWarmUpProbe(logger *slog.Logger) *WarmUpProbe {
+	return &WarmUpProbe{client: &http.Client{}, logger: logger}
+}
+
+// Start warms b up in the background. It reports false, doing nothing, if
+// b is already warming up.
+func (wp *WarmUpProbe) Start(model string, b *Backend, cfg warmupConfig) bool {
+	if !b.Warmup.begin() {
+		return false
+	}
+	go wp.run(model, b, cfg)
+	return true
+}
+
+func (wp *WarmUpProbe) run(model string, b *Backend, cfg warmupConfig) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	logger := wp.logger.With(slog.String("model", model), slog.String("backend", b.Name()))
+	logger.Info("warming up backend", slog.Int("requests", cfg.requests), slog.String("max_latency", cfg.maxLatency.String()), slog.String("timeout", cfg.timeout.String()))
+
+	passed := 0
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		status, latency, err := wp.probe(ctx, b.Provider, cfg.payload)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		ok := err == nil && status == http.StatusOK && latency <= cfg.maxLatency
+		attrs := []any{slog.Int("attempt", attempt), slog.Bool("ok", ok), slog.String("latency", latency.String())}
+		switch {
+		case err != nil:
+			attrs = append(attrs, slog.String("error", err.Error()))
+		default:
+			attrs = append(attrs, slog.Int("status_code", status))
+		}
+		logger.Info("warm-up probe", attrs...)
+		if ok {
+			if passed++; passed >= cfg.requests {
+				b.Warmup.state.Store(warmReady)
+				logger.Info("backend warmed up", slog.String("duration", time.Since(start).String()), slog.Int("probes", attempt))
+				return
+			}
+			continue
+		}
+		passed = 0
+		timer := time.NewTimer(warmupRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+	b.Warmup.state.Store(warmDegraded)
+	logger.Warn("warm-up timed out, backend marked degraded", slog.String("duration", time.Since(start).String()), slog.Int("passed", passed))
+}
+
+// probe sends the payload once and times the full response.
+func (wp *WarmUpProbe) probe(ctx context.Context, p *Provider, payload string) (int, time.Duration, error) {
+	body, err := os.ReadFile(payload)
+	if err != nil {
+		return 0, 0, err
+	}
+	path := chatCompletionsPath
+	if a := p.Adapter; a != nil {
+		if body, err = a.TranslateRequest(body); err != nil {
+			return 0, 0, fmt.Errorf("translate warm-up payload: %w", err)
+		}
+		path = a.Path()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authorize(p, req.Header)
+	client := wp.client
+	if p.Client != nil {
+		client = p.Client
+	}
+	start := time.Now()
+	var resp *http.Response
+	if p.GRPC != nil {
+		resp, err = p.GRPC.Do(ctx, body, req.Header)
+	} else {
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// warmUpKey identifies a backend across routing tables.
+func warmUpKey(model string, b *Backend) string {
+	return model + "\x00" + b.Name() + "\x00" + b.Provider.BaseURL
+}
+
+// warmUpNew gives t's backends their warm-up state: backends that were in
+// the previous table keep theirs, new ones of models with a warmup_payload
+// start warming up. old is nil for the first table.
+func (reg *ModelRegistry) warmUpNew(old, t *routingTable) {
+	previous := make(map[string]*WarmUpState)
+	if old != nil {
+		for _, e := range old.entries() {
+			for _, b := range e.Backends() {
+				previous[warmUpKey(e.Name, b)] = b.Warmup
+			}
+		}
+	}
+	for _, e := range t.entries() {
+		wc, ok := e.Config.warmup()
+		if !ok {
+			continue
+		}
+		for _, b := range e.Backends() {
+			if state, seen := previous[warmUpKey(e.Name, b)]; seen && state != nil {
+				b.Warmup = state
+				continue
+			}
+			b.Warmup = &WarmUpState{}
+			reg.warmup.Start(e.Name, b, wc)
+		}
+	}
+}
+
+// WarmUp starts a manual warm-up of every backend of the entry called
+// name, taking each out of service until it passes. It returns the
+// backends that started warming up, and false if there is no such entry
+// or it has no warmup_payload.
+func (reg *ModelRegistry) WarmUp(name string) ([]string, bool) {
+	e, ok := reg.Entry(name)
+	if !ok {
+		return nil, false
+	}
+	wc, ok := e.Config.warmup()
+	if !ok {
+		return nil, false
+	}
+	started := []string{}
+	for _, b := range e.Backends() {
+		if b.Warmup != nil && reg.warmup.Start(e.Name, b, wc) {
+			started = append(started, b.Name())
+		}
+	}
+	return started, true
+}